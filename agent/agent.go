@@ -5,74 +5,221 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"os"
-	"os/signal"
+	"net"
+	"net/http"
 	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 
 	"github.com/kolapsis/shm-agent/agent/aggregator"
 	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/gelf"
 	"github.com/kolapsis/shm-agent/agent/identity"
+	"github.com/kolapsis/shm-agent/agent/journald"
+	"github.com/kolapsis/shm-agent/agent/kubernetes"
+	"github.com/kolapsis/shm-agent/agent/logthrottle"
 	"github.com/kolapsis/shm-agent/agent/matcher"
 	"github.com/kolapsis/shm-agent/agent/parser"
+	"github.com/kolapsis/shm-agent/agent/positions"
+	"github.com/kolapsis/shm-agent/agent/prometheus"
+	"github.com/kolapsis/shm-agent/agent/sdnotify"
 	"github.com/kolapsis/shm-agent/agent/sender"
+	"github.com/kolapsis/shm-agent/agent/spool"
 	"github.com/kolapsis/shm-agent/agent/tailer"
 )
 
 // Agent orchestrates log collection and metric aggregation.
 type Agent struct {
+	logger       *slog.Logger
+	errors       *logthrottle.Logger // recurring errors
+	aggregator   *aggregator.Aggregator
+	events       *eventWindows // metrics of sources with a timestamp
+	sender       *sender.Sender
+	exports      []*destination // the outputs snapshots are delivered to, the server included
+	matchedLines *matchedLines  // nil unless matched lines are published
+	outputs      []Output
+	dryRun       bool
+	verbosity    int
+
+	systemdNotify bool // readiness and watchdog reported to systemd
+
+	errorSamples    int // lines kept per source that failed to parse or matched no metric
+	shutdownTimeout time.Duration
+	drainTimeout    time.Duration // 0 or negative to stop without draining
+
+	// procMu guards cfg and processors, which are replaced on reload.
+	procMu     sync.RWMutex
 	cfg        *config.Config
-	logger     *slog.Logger
-	aggregator *aggregator.Aggregator
-	sender     *sender.Sender
-	tailers    []*tailer.Tailer
 	processors []*sourceProcessor
-	dryRun     bool
-	verbosity  int
+
+	history history
+	bursts  burstDetector
+
+	exporter   *prometheus.Exporter // nil unless listen_addr is set
+	server     *http.Server
+	listenAddr net.Addr
+
+	tailersMu sync.Mutex
+	tailers   map[tailerKey]*tailer.Tailer
+	parked    map[tailerKey]parkedFile      // files closed to stay within max_open_files
+	journals  map[string]*journald.Reader   // keyed by source key
+	gelfs     map[string]*gelf.Listener     // keyed by source key
+	kube      map[string]*kubernetes.Client // keyed by source key
+
+	stdin        io.Reader        // nil for os.Stdin
+	stdinStarted bool             // guarded by tailersMu
+	inputDone    chan struct{}    // closed when stdin, the only input, is closed
+	positions    *positions.Store // nil when offsets are not persisted
+	uniqueFile   string           // empty when windowed sets are not persisted
 
 	mu          sync.Mutex
 	running     bool
+	run         *runState // the current or last run, nil before the first Start
+	reloaded    chan struct{}
 	startTime   time.Time
 	linesParsed atomic.Int64
 	linesErrors atomic.Int64
+
+	// Read by the health endpoints without taking mu.
+	live         atomic.Bool
+	liveSince    atomic.Int64 // unix nanoseconds of the last Start
+	lastSnapshot atomic.Int64 // unix nanoseconds, 0 before the first snapshot
+
+	telemetry      telemetry
+	outputFailures atomic.Int64 // snapshots an output failed to receive
+
+	versionStatus        atomic.Pointer[VersionStatus] // nil until the server answered
+	heartbeatUnsupported atomic.Bool
+	registrationPending  atomic.Bool // registration failed at startup, nothing delivered since
+
+	loadConfig   ConfigLoader                       // nil when not polling remote configurations
+	remoteConfig atomic.Pointer[RemoteConfigStatus] // nil until the server answered
+
+	// podFields holds the metadata of the agent's pod added to lines with
+	// kubernetes_metadata, nil until resolved.
+	podFields atomic.Pointer[map[string]interface{}]
+
+	identMu sync.Mutex
+	ident   *loadedIdentity // nil until first needed
+}
+
+// runState is one run of the agent, from Start until it stops.
+type runState struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	loopDone chan struct{}
+	errc     chan error    // fatal errors reported by the agent's goroutines
+	done     chan struct{} // closed once the run has stopped
+	err      error         // why the run stopped, set before done is closed
+}
+
+// fail reports a fatal error, which stops the run. Only the first error
+// is kept.
+func (r *runState) fail(err error) {
+	select {
+	case r.errc <- err:
+	default:
+	}
 }
 
 // sourceProcessor processes lines from a single source.
 type sourceProcessor struct {
-	source     *config.Source
-	parser     parser.Parser
-	metrics    []*metricProcessor
-	aggregator *aggregator.Aggregator
-	logger     *slog.Logger
-	verbosity  int
+	key          string // identifies the source across reloads
+	source       *config.Source
+	parser       parser.Parser
+	filter       *fieldFilter                            // nil when all fields are kept
+	types        fieldTypes                              // types, nil when none
+	added        map[string]interface{}                  // add_fields
+	mapped       []mappedField                           // map_fields
+	pod          *atomic.Pointer[map[string]interface{}] // kubernetes_metadata, nil for kubernetes sources
+	events       *eventWindows                           // nil without a timestamp
+	replay       *replayRange                            // set while backfilling
+	paths        *pathFields                             // path_pattern, nil when unset
+	keep         *matcher.Matcher                        // filter, nil when unset
+	matchFields  *matcher.Fields                         // read by the filter and metric matchers
+	prefilter    *linePrefilter                          // nil when every line is parsed
+	sample       *lineSampler                            // sample_rate, nil when every line is processed
+	countLines   bool                                    // a metric reads __line__
+	multiline    *multilineJoiner                        // nil when lines are records
+	queue        *recordQueue                            // workers, nil unless the source is queued
+	unmatched    *unmatchedCapture                       // nil unless unmatched lines are captured
+	samples      *lineSamples                            // nil unless error samples are kept
+	matchedLines *matchedLines                           // nil unless matched lines are published
+	metrics      []*metricProcessor
+	aggregator   *aggregator.Aggregator
+	logger       *slog.Logger
+	errors       *logthrottle.Logger // recurring errors, such as parse failures
+	verbosity    int
 
-	linesParsed  atomic.Int64
-	linesMatched atomic.Int64
-	parseErrors  atomic.Int64
+	linesRead        atomic.Int64 // lines read, before anything is left out
+	linesParsed      atomic.Int64
+	linesMatched     atomic.Int64
+	linesFiltered    atomic.Int64 // lines dropped by the filter
+	linesPrefiltered atomic.Int64 // lines left out by the prefilter
+	linesSkipped     atomic.Int64 // lines left out by sample_rate
+	linesLate        atomic.Int64 // lines whose event time interval was closed
+	parseErrors      atomic.Int64
+	timeErrors       atomic.Int64 // lines without a valid timestamp
+	rotations        atomic.Int64 // files reopened after being moved or deleted
+	truncations      atomic.Int64 // files reopened after being truncated
 }
 
 // metricProcessor processes a single metric configuration.
 type metricProcessor struct {
-	cfg     *config.Metric
-	matcher *matcher.Matcher
+	cfg      *config.Metric
+	matcher  *matcher.Matcher
+	valueMap *valueMap    // extract map, nil when unset
+	sample   *lineSampler // sample_rate, nil when every line is recorded
+
+	logger *slog.Logger
+
+	matched        atomic.Int64
+	extractMissing atomic.Int64 // extract field absent
+	extractInvalid atomic.Int64 // extract field present but not convertible
+	lastMatch      atomic.Int64 // unix nanoseconds, 0 if never matched
 }
 
 // Options configures the agent.
+// It is kept for compatibility; new code should prefer NewBuilder.
 type Options struct {
 	Config    *config.Config
 	Logger    *slog.Logger
 	DryRun    bool
 	Verbosity int // 0=errors, 1=matches, 2=all lines
+
+	// ShutdownTimeout bounds how long Run waits for tailers to stop once
+	// its context is cancelled. Defaults to DefaultShutdownTimeout.
+	ShutdownTimeout time.Duration
 }
 
+// DefaultShutdownTimeout is the default upper bound for stopping tailers.
+const DefaultShutdownTimeout = 5 * time.Second
+
+// DefaultDrainTimeout is the default upper bound for reading the lines
+// tailers had not delivered when stopping.
+const DefaultDrainTimeout = 2 * time.Second
+
 // New creates a new Agent.
 func New(opts Options) (*Agent, error) {
-	logger := opts.Logger
+	return NewBuilder(opts.Config,
+		WithLogger(opts.Logger),
+		WithDryRun(opts.DryRun),
+		WithVerbosity(opts.Verbosity),
+		WithShutdownTimeout(opts.ShutdownTimeout),
+	).Build()
+}
+
+// newAgent creates an Agent from a builder.
+func newAgent(b *Builder) (*Agent, error) {
+	if b.cfg == nil {
+		return nil, fmt.Errorf("config is required")
+	}
+
+	logger := b.logger
 	if logger == nil {
 		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
 	}
@@ -81,293 +228,1086 @@ func New(opts Options) (*Agent, error) {
 
 	// Initialize processors for each source
 	var processors []*sourceProcessor
-	for i := range opts.Config.Sources {
-		src := &opts.Config.Sources[i]
-		proc, err := newSourceProcessor(src, agg, logger, opts.Verbosity)
+	for i := range b.cfg.Sources {
+		src := &b.cfg.Sources[i]
+		proc, err := newSourceProcessor(src, agg, logger, b.verbosity)
 		if err != nil {
 			return nil, fmt.Errorf("source %s: %w", src.Path, err)
 		}
 		processors = append(processors, proc)
 	}
 
-	return &Agent{
-		cfg:        opts.Config,
-		logger:     logger,
-		aggregator: agg,
-		processors: processors,
-		dryRun:     opts.DryRun,
-		verbosity:  opts.Verbosity,
-	}, nil
+	shutdownTimeout := b.shutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = DefaultShutdownTimeout
+	}
+
+	a := &Agent{
+		cfg:             b.cfg,
+		logger:          logger,
+		errors:          logthrottle.New(logger, 0),
+		aggregator:      agg,
+		events:          newEventWindows(agg),
+		processors:      processors,
+		outputs:         b.outputs,
+		dryRun:          b.dryRun,
+		verbosity:       b.verbosity,
+		errorSamples:    b.errorSamples,
+		shutdownTimeout: shutdownTimeout,
+		drainTimeout:    b.drainTimeout,
+		reloaded:        make(chan struct{}, 1),
+		stdin:           b.stdin,
+		inputDone:       make(chan struct{}),
+		matchedLines:    newMatchedLines(b.cfg, b.dryRun),
+		loadConfig:      b.loadConfig,
+		systemdNotify:   b.systemdNotify,
+	}
+	a.events.configure(b.cfg)
+	for _, proc := range processors {
+		a.attachPodFields(proc)
+		a.attachEventWindows(proc)
+		a.attachLineSamples(proc)
+		a.attachMatchedLines(proc)
+	}
+	a.history.resize(b.cfg.History)
+	return a, nil
 }
 
-// newSourceProcessor creates a processor for a source.
+// newSourceProcessor creates a processor for a source and registers its
+// metrics with agg.
 func newSourceProcessor(src *config.Source, agg *aggregator.Aggregator, logger *slog.Logger, verbosity int) (*sourceProcessor, error) {
-	p, err := parser.New(src.Format, src.Pattern)
+	proc, err := buildSourceProcessor(src, agg, logger, verbosity)
+	if err != nil {
+		return nil, err
+	}
+	registerMetrics(src, agg)
+	return proc, nil
+}
+
+// registerMetrics registers the metrics of a source with agg, and applies
+// their settings.
+func registerMetrics(src *config.Source, agg *aggregator.Aggregator) {
+	for i := range src.Metrics {
+		m := &src.Metrics[i]
+		agg.RegisterLabeled(m.Name, aggregatorType(m), m.Labels, m.MaxSeries)
+		switch m.Type {
+		case "percentile":
+			agg.SetQuantiles(m.Name, m.Quantiles)
+		case "counter_by":
+			agg.SetCountKey(m.Name, m.Extract.Field)
+		case "gauge":
+			agg.SetSeriesTTL(m.Name, m.SeriesTTL)
+		case "set":
+			agg.SetApproximate(m.Name, m.Approximate)
+			agg.SetWindow(m.Name, aggregator.Window(m.UniqueWindow))
+		}
+	}
+}
+
+// buildSourceProcessor creates a processor for a source recording in agg,
+// without registering its metrics, so that nothing is registered when it
+// fails.
+func buildSourceProcessor(src *config.Source, agg *aggregator.Aggregator, logger *slog.Logger, verbosity int) (*sourceProcessor, error) {
+	p, err := newParser(src)
 	if err != nil {
 		return nil, fmt.Errorf("creating parser: %w", err)
 	}
 
+	// The filter and the metrics read each field and evaluate each
+	// condition once per line
+	matchFields := matcher.NewFields()
+
 	var metrics []*metricProcessor
 	for i := range src.Metrics {
 		m := &src.Metrics[i]
-
-		// Register metric with aggregator
-		agg.Register(m.Name, aggregator.MetricType(m.Type))
+		if m.Type == "derived" {
+			continue // computed at snapshot time, not from lines
+		}
 
 		// Create matcher
-		match, err := matcher.New(m.Match)
+		match, err := matchFields.New(m.Match)
 		if err != nil {
 			return nil, fmt.Errorf("metric %s: %w", m.Name, err)
 		}
 
+		var vm *valueMap
+		if m.Extract != nil {
+			if vm, err = newValueMap(m.Extract.Map); err != nil {
+				return nil, fmt.Errorf("metric %s: map: %w", m.Name, err)
+			}
+		}
+
 		metrics = append(metrics, &metricProcessor{
-			cfg:     m,
-			matcher: match,
+			cfg:      m,
+			matcher:  match,
+			valueMap: vm,
+			sample:   newLineSampler(m.SampleRate),
+			logger:   logger,
 		})
 	}
 
-	return &sourceProcessor{
-		source:     src,
-		parser:     p,
-		metrics:    metrics,
-		aggregator: agg,
-		logger:     logger,
-		verbosity:  verbosity,
-	}, nil
+	paths, err := newPathFields(src.PathPattern)
+	if err != nil {
+		return nil, fmt.Errorf("path_pattern: %w", err)
+	}
+
+	mapped, err := newMappedFields(src)
+	if err != nil {
+		return nil, err
+	}
+
+	var keep *matcher.Matcher
+	if src.Filter != nil {
+		if keep, err = matchFields.New(src.Filter); err != nil {
+			return nil, fmt.Errorf("filter: %w", err)
+		}
+	}
+
+	prefilter, err := newLinePrefilter(src.Prefilter)
+	if err != nil {
+		return nil, fmt.Errorf("prefilter: %w", err)
+	}
+
+	proc := &sourceProcessor{
+		key:         sourceKey(src),
+		source:      src,
+		parser:      p,
+		filter:      newFieldFilter(src.KeepFields, src.DropFields),
+		types:       src.Types,
+		added:       addedFields(src.AddFields),
+		mapped:      mapped,
+		paths:       paths,
+		keep:        keep,
+		matchFields: matchFields,
+		prefilter:   prefilter,
+		sample:      newLineSampler(src.SampleRate),
+		countLines:  src.Reads(config.FieldLine),
+		metrics:     metrics,
+		aggregator:  agg,
+		logger:      logger,
+		errors:      logthrottle.New(logger, 0),
+		verbosity:   verbosity,
+	}
+	if src.Queued() {
+		proc.queue = newRecordQueue(max(src.Workers, 1), src.QueueCapacity(), src.OnOverflow, proc.handleRecord)
+	}
+	proc.multiline = newMultilineJoiner(src.Multiline, proc.processRecord, logger)
+	proc.unmatched = newUnmatchedCapture(src.Unmatched, proc.errors)
+	return proc, nil
+}
+
+// newParser creates the parser of a source. Journald sources parse journal
+// entries, and MESSAGE with the source format when one is set; gelf sources
+// likewise parse GELF messages and their short_message.
+func newParser(src *config.Source) (parser.Parser, error) {
+	if !src.IsJournald() && !src.IsGELF() {
+		return newFormatParser(src)
+	}
+
+	var inner parser.Parser
+	if src.Format != "" {
+		p, err := newFormatParser(src)
+		if err != nil {
+			return nil, err
+		}
+		inner = p
+	}
+	if src.IsGELF() {
+		return parser.NewGELFParser(inner), nil
+	}
+	return parser.NewJournaldParser(inner), nil
 }
 
-// Run starts the agent and blocks until stopped.
+// newFormatParser creates the parser of the source format, with the
+// source's own grok patterns, access log preset or CSV columns.
+func newFormatParser(src *config.Source) (parser.Parser, error) {
+	switch {
+	case src.Format == "grok":
+		return parser.NewGrokParser(src.Pattern, src.GrokPatterns)
+	case src.Format == "access_log":
+		return parser.NewAccessLogParser(src.Preset)
+	case src.Format == "csv" && src.CSV != nil:
+		return parser.NewCSVParser(src.CSV.Comma(), src.CSV.Columns, src.CSV.Header), nil
+	}
+	return parser.New(src.Format, src.Pattern)
+}
+
+// Run starts the agent and blocks until it stops (see Start and Wait).
+// Signal handling is left to the caller: cancel ctx to request shutdown.
+// In-flight requests to the server are aborted through ctx.
 func (a *Agent) Run(ctx context.Context) error {
+	if err := a.Start(ctx); err != nil {
+		return err
+	}
+	return a.Wait()
+}
+
+// Start loads the identity (unless in dry-run mode), starts the tailers and
+// the snapshot loop, which registers with the server, then returns.
+// The agent runs until Stop is called, ctx is cancelled, standard input is
+// closed when all sources read it, or a fatal error occurs; Wait returns
+// once it has stopped. Calling Start on a running agent is a no-op.
+func (a *Agent) Start(ctx context.Context) (err error) {
 	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	if a.running {
-		a.mu.Unlock()
-		return fmt.Errorf("agent already running")
+		return nil
 	}
-	a.running = true
-	a.startTime = time.Now()
-	a.mu.Unlock()
 
-	// Load or generate identity
-	ident, err := identity.LoadOrGenerate(a.cfg.IdentityFile)
-	if err != nil {
-		return fmt.Errorf("loading identity: %w", err)
+	cfg := a.Config()
+	r := &runState{
+		errc: make(chan error, 1),
+		done: make(chan struct{}),
 	}
-	a.logger.Info("loaded identity", "instance_id", ident.InstanceID, "identity_file", a.cfg.IdentityFile)
+	defer func() {
+		if err != nil {
+			a.abortStart()
+		}
+	}()
 
-	// Create sender (unless dry-run)
 	if !a.dryRun {
-		a.sender = sender.New(sender.Config{
-			ServerURL:   a.cfg.ServerURL,
-			AppName:     a.cfg.AppName,
-			AppVersion:  a.cfg.AppVersion,
-			Environment: a.cfg.Environment,
-			Identity:    ident,
-			Logger:      a.logger,
-		})
+		if err := checkWritable(cfg.WritableDirs()); err != nil {
+			return err
+		}
+	}
 
-		// Register with server
-		if err := a.sender.Register(ctx); err != nil {
-			return fmt.Errorf("registering with server: %w", err)
+	if !a.dryRun && cfg.UsesServer() {
+		retention := spool.Retention{
+			MaxAge:     cfg.Spool.MaxAge,
+			MaxBytes:   cfg.Spool.MaxBytes,
+			MaxEntries: cfg.Spool.MaxSnapshots,
+		}
+		var queue spool.Queue = spool.NewMemory(retention)
+		if cfg.Spool.Dir != "" {
+			sp, err := spool.Open(cfg.Spool.Dir, retention)
+			if err != nil {
+				return fmt.Errorf("opening spool: %w", err)
+			}
+			if n := sp.Len(); n > 0 {
+				a.logger.Info("found undelivered snapshots", "spool_dir", cfg.Spool.Dir, "queued", n)
+			}
+			queue = sp
+		}
+
+		if err := a.connect(cfg, queue); err != nil {
+			return err
 		}
 	}
 
-	// Start tailers
-	for _, proc := range a.processors {
-		t := tailer.New(proc.source.Path, proc.processLine, a.logger)
-		if err := t.Start(ctx); err != nil {
-			a.stopTailers()
-			return fmt.Errorf("starting tailer for %s: %w", proc.source.Path, err)
+	if !a.dryRun {
+		if err := a.connectExporters(cfg); err != nil {
+			return err
 		}
-		a.tailers = append(a.tailers, t)
 	}
 
-	// Setup signal handlers
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR1)
+	if !a.dryRun && cfg.PositionsEnabled() {
+		store, err := positions.Open(cfg.PositionsFile)
+		if err != nil {
+			return fmt.Errorf("loading positions: %w", err)
+		}
+		a.positions = store
+	}
 
-	// Start snapshot ticker
-	ticker := time.NewTicker(a.cfg.Interval)
-	defer ticker.Stop()
+	if !a.dryRun && cfg.UniqueFileEnabled() {
+		if err := a.loadUniqueSets(cfg.UniqueFile); err != nil {
+			return err
+		}
+	}
+
+	if cfg.ListenAddr != "" {
+		if err := a.startListener(cfg.ListenAddr, r.fail); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Offline && !a.dryRun && cfg.ListenAddr == "" && len(a.outputs) == 0 && len(a.exports) == 0 {
+		a.logger.Warn("offline mode without listen_addr or outputs, metrics will not be exported")
+	}
+
+	a.resolvePodMetadata(ctx, cfg)
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	// Start tailers
+	if err := a.discover(ctx, discoverInitial); err != nil {
+		cancel()
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), a.shutdownTimeout)
+		defer stopCancel()
+		a.stopTailers(stopCtx, 0)
+		return err
+	}
+
+	r.ctx = ctx
+	r.cancel = cancel
+	r.loopDone = make(chan struct{})
+
+	a.running = true
+	a.run = r
+	a.startTime = time.Now()
+	a.liveSince.Store(a.startTime.UnixNano())
+	a.live.Store(true)
+
+	go a.loop(ctx, r.loopDone)
+	go a.supervise(r)
 
 	a.logger.Info("agent started",
-		"interval", a.cfg.Interval,
-		"sources", len(a.processors),
+		"interval", cfg.Interval,
+		"sources", len(cfg.Sources),
+		"outputs", len(a.outputs)+len(a.exports),
 		"dry_run", a.dryRun,
+		"offline", cfg.Offline,
 	)
 
+	return nil
+}
+
+// abortStart releases what a failed Start opened, so that Start can be
+// called again.
+func (a *Agent) abortStart() {
+	a.stopListener(a.shutdownTimeout)
+	a.closeExporters()
+	a.exports = nil
+	if a.sender != nil {
+		a.sender.Close()
+		a.sender = nil
+	}
+	a.positions = nil
+}
+
+// register registers with the server, if the agent delivers to it, then
+// reports the agent ready to systemd. An unreachable server is not fatal:
+// registration is retried before the next delivery. It runs in the loop
+// rather than in Start, so as not to hold the agent lock over the network.
+func (a *Agent) register(ctx context.Context) {
+	status := statusRunning
+	if a.sender != nil {
+		err := a.sender.Register(ctx)
+		if err != nil {
+			a.logger.Warn("registering with server failed, will retry", "error", err)
+			status = statusRegistrationPending
+		}
+		a.registrationPending.Store(err != nil)
+	}
+	// Readiness does not wait for a pending registration: systemd would
+	// restart the agent while the server is down, and the lines written
+	// meanwhile would not be read. The status tells until it succeeds.
+	a.notifySystemd(sdnotify.Ready, sdnotify.Status(status))
+}
+
+// connect loads or generates the identity and creates the sender, which
+// queues snapshots in queue until they are delivered. The identity saved
+// by an interrupted key rotation is used if the server holds its key.
+func (a *Agent) connect(cfg *config.Config, queue spool.Queue) error {
+	if err := a.settleRotation(cfg); err != nil {
+		a.logger.Warn("could not settle an interrupted key rotation, using the current identity", "error", err)
+	}
+	ident, opts, err := a.identity(cfg)
+	if err != nil {
+		return err
+	}
+	a.logger.Info("loaded identity", "instance_id", ident.InstanceID, "identity_file", cfg.IdentityFile,
+		"encryption", cfg.IdentityEncryption.Mode)
+
+	scfg, err := senderConfig(cfg, a.logger)
+	if err != nil {
+		return err
+	}
+	scfg.Identity = ident
+	scfg.Queue = queue
+	scfg.Types = a.aggregator.GetMetricType
+	scfg.PersistIdentity = func(id *sender.Identity) error {
+		return identity.SaveWithOptions(cfg.IdentityFile, id, opts)
+	}
+	if cfg.SequenceFileEnabled() {
+		scfg.SequenceFile = cfg.SequenceFile
+	}
+	a.sender = sender.New(scfg)
+	return nil
+}
+
+// Stop stops the snapshot loop and the tailers, reads the lines the tailers
+// had not delivered yet for at most the drain timeout, and sends a final
+// snapshot so the last interval is not lost. The whole shutdown takes at
+// most timeout, plus stopping the listener; 0 uses the shutdown timeout
+// set with WithShutdownTimeout.
+// Stop is safe to call concurrently; calling it on an agent that is not
+// running is a no-op.
+func (a *Agent) Stop(timeout time.Duration) error {
+	a.stop(nil, timeout, nil)
+	return nil
+}
+
+// Wait blocks until the agent stops and returns the fatal error that
+// stopped it, or nil when it was stopped by Stop, the cancellation of the
+// Start context or the end of standard input. It returns nil at once if
+// the agent was never started.
+func (a *Agent) Wait() error {
+	a.mu.Lock()
+	r := a.run
+	a.mu.Unlock()
+
+	if r == nil {
+		return nil
+	}
+	<-r.done
+	return r.err
+}
+
+// supervise stops the run when its context is cancelled, standard input,
+// the only input, is closed or a goroutine reports a fatal error.
+func (a *Agent) supervise(r *runState) {
+	var cause error
+	select {
+	case <-r.ctx.Done():
+	case <-a.inputDone:
+		a.logger.Info("input closed")
+	case cause = <-r.errc:
+		a.logger.Error("fatal error", "error", cause)
+	}
+	a.stop(r, 0, cause)
+}
+
+// stop stops run r, or the current run when r is nil, recording cause as
+// the reason it stopped. It does nothing when that run is already stopped.
+func (a *Agent) stop(r *runState, timeout time.Duration, cause error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.running || (r != nil && r != a.run) {
+		return
+	}
+	r = a.run
+	if timeout <= 0 {
+		timeout = a.shutdownTimeout
+	}
+
+	a.logger.Info("shutting down...")
+	a.notifySystemd(sdnotify.Stopping)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	a.live.Store(false)
+	r.cancel()
+	<-r.loopDone
+	a.stopTailers(ctx, a.drainTimeout)
+	a.Flush()
+
+	if err := a.sendSnapshot(ctx); err != nil {
+		a.logger.Error("failed to send final snapshot", "error", err)
+	}
+
+	a.stopListener(timeout)
+	a.closeExporters()
+	a.errors.Flush()
+	for _, proc := range a.currentProcessors() {
+		proc.close()
+	}
+
+	a.running = false
+	r.err = cause
+	close(r.done)
+
+	a.logger.Info("agent stopped")
+}
+
+// loop registers with the server, then sends a snapshot at every interval
+// until ctx is cancelled, and reports the agent's version to the server
+// from the start.
+// The tickers are rebuilt whenever the configuration is reloaded.
+func (a *Agent) loop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	a.register(ctx)
+	if a.sender != nil {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.sender.Run(ctx)
+		}()
+		defer wg.Wait()
+
+		if a.Config().VersionCheckInterval > 0 {
+			a.checkVersion(ctx)
+		}
+		if a.loadConfig != nil {
+			go a.pollRemoteConfig(ctx)
+		}
+	}
+
+	for {
+		if !a.runTickers(ctx) {
+			return
+		}
+	}
+}
+
+// runTickers runs the snapshot, rescan and version check tickers for the
+// current configuration. It returns false when ctx is cancelled and true
+// when the configuration was reloaded.
+func (a *Agent) runTickers(ctx context.Context) bool {
+	cfg := a.Config()
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	// Only glob and kubernetes sources need periodic rescans
+	var rescan <-chan time.Time
+	if a.needsRescan() {
+		interval := cfg.RescanInterval
+		if interval <= 0 {
+			interval = config.DefaultRescanInterval
+		}
+		rescanTicker := time.NewTicker(interval)
+		defer rescanTicker.Stop()
+		rescan = rescanTicker.C
+	}
+
+	var versionCheck <-chan time.Time
+	if a.sender != nil && cfg.VersionCheckInterval > 0 {
+		versionTicker := time.NewTicker(cfg.VersionCheckInterval)
+		defer versionTicker.Stop()
+		versionCheck = versionTicker.C
+	}
+
+	// The watchdog is pinged from this loop, so that systemd restarts
+	// the agent when it is stuck
+	var watchdog <-chan time.Time
+	if watchdogTicker := a.watchdogTicker(); watchdogTicker != nil {
+		defer watchdogTicker.Stop()
+		watchdog = watchdogTicker.C
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
-			a.logger.Info("shutting down...")
-			a.stopTailers()
-			return nil
-
-		case sig := <-sigChan:
-			switch sig {
-			case syscall.SIGUSR1:
-				a.logger.Info("received SIGUSR1, dumping metrics")
-				a.dumpMetrics()
-			case syscall.SIGTERM, syscall.SIGINT:
-				a.logger.Info("received shutdown signal")
-				a.stopTailers()
-				return nil
+			return false
+
+		case <-a.reloaded:
+			return true
+
+		case <-rescan:
+			if err := a.discover(ctx, discoverRescan); err != nil {
+				a.errors.Error("rescan", "failed to rescan sources", "error", err)
 			}
 
+		case <-versionCheck:
+			a.checkVersion(ctx)
+
+		case <-watchdog:
+			a.notifySystemd(sdnotify.Watchdog)
+
 		case <-ticker.C:
 			if err := a.sendSnapshot(ctx); err != nil {
-				a.logger.Error("failed to send snapshot", "error", err)
+				a.errors.Error("send", "failed to send snapshot", "error", err)
 			}
+			a.notifyRegistered()
+			a.savePositions(a.currentTailers())
 		}
 	}
 }
 
+// lineContext describes where a line was read from.
+type lineContext struct {
+	path   string                 // file the line was read from, if any
+	line   int64                  // line number in that file, 0 if unknown
+	fields map[string]interface{} // extra fields set by the source
+}
+
 // processLine processes a single log line.
 func (p *sourceProcessor) processLine(line string) {
+	p.processLineWith(line, lineContext{})
+}
+
+// processLineWith processes a line read from lc, or adds it to the record
+// being assembled when the source joins multiline records.
+func (p *sourceProcessor) processLineWith(line string, lc lineContext) {
+	p.linesRead.Add(1)
+	if p.multiline != nil {
+		p.multiline.add(line, lc)
+		return
+	}
+	p.processRecord(line, lc)
+}
+
+// processRecord skips header and comment lines and the lines left out by
+// the prefilter or sample_rate, then handles the record, a line or the
+// lines joined by multiline, or queues it for the workers of the source.
+// Headers are skipped here, in the order they were read, so that workers
+// parse the records that follow them with the right columns.
+func (p *sourceProcessor) processRecord(line string, lc lineContext) {
+	if s, ok := p.parser.(parser.Skipper); ok && s.Skip(line) {
+		return // a header or comment
+	}
+	if !p.prefilter.keep(line) {
+		p.linesPrefiltered.Add(1)
+		return
+	}
+	if !p.sample.keep() {
+		p.linesSkipped.Add(1)
+		return
+	}
+	if p.queue != nil {
+		p.queue.push(line, lc)
+		return
+	}
+	p.handleRecord(line, lc)
+}
+
+// handleRecord parses a record and records it in the metrics it matches.
+// Lines the source filter does not match are dropped. The lines of sources
+// with a timestamp are counted in the interval of their event time.
+func (p *sourceProcessor) handleRecord(line string, lc lineContext) {
 	if p.verbosity >= 2 {
 		p.logger.Debug("processing line", "line", line)
 	}
 
-	// Parse the line
-	data := p.parser.Parse(line)
+	data := p.fields(line, lc)
 	if data == nil {
 		p.parseErrors.Add(1)
 		if p.verbosity >= 1 {
-			p.logger.Debug("failed to parse line", "line", line)
+			p.errors.Debug("parse", "failed to parse line", "source", p.source.Location(), "line", line)
 		}
+		if p.unmatched != nil {
+			p.unmatched.record(line)
+		}
+		p.samples.parseError(line, lc)
 		return
 	}
 
 	p.linesParsed.Add(1)
 
+	view := p.matchFields.View(data)
+	defer p.matchFields.Release(view)
+
+	if p.keep != nil && !p.keep.MatchView(view) {
+		p.linesFiltered.Add(1)
+		return
+	}
+
+	agg := p.aggregator
+	if p.events != nil {
+		ts := p.source.Timestamp
+		t, ok := parseEventTime(ts, data)
+		if !ok {
+			p.timeErrors.Add(1)
+			if p.replay != nil {
+				return // historical lines have no current time
+			}
+			if p.verbosity >= 1 {
+				p.errors.Debug("timestamp", "invalid timestamp, using the current time", "source", p.source.Location(), "field", ts.Field)
+			}
+			t = time.Now()
+		}
+		if p.replay != nil && !p.replay.includes(t) {
+			p.replay.outside.Add(1)
+			return
+		}
+		if agg, ok = p.events.acquire(t, ts.Lateness); !ok {
+			p.linesLate.Add(1)
+			return
+		}
+		defer p.events.release()
+	}
+
 	// Process each metric
+	matched := false
+	var names []string // metrics matched, when matched lines are published
 	for _, m := range p.metrics {
-		if !m.matcher.Match(data) {
+		if !m.matcher.MatchView(view) {
 			continue
 		}
 
+		matched = true
+		if p.matchedLines != nil {
+			names = append(names, m.cfg.Name)
+		}
 		p.linesMatched.Add(1)
+		m.matched.Add(1)
+		m.lastMatch.Store(time.Now().UnixNano())
 
 		if p.verbosity >= 1 {
 			p.logger.Debug("matched metric", "metric", m.cfg.Name, "type", m.cfg.Type)
 		}
 
+		if !m.sample.keep() {
+			continue
+		}
+		weight := p.sample.weight() * m.sample.weight()
+		labels := m.labelValues(data)
+
 		switch m.cfg.Type {
 		case "counter":
-			p.aggregator.Inc(m.cfg.Name)
+			agg.IncByLabeled(m.cfg.Name, labels, weight)
+
+		case "counter_by":
+			if val, ok := m.extractString(data); ok {
+				agg.CountLabeled(m.cfg.Name, labels, val, weight)
+			}
 
 		case "gauge":
-			if m.cfg.Extract != nil {
-				if val, ok := parser.GetFieldFloat(data, m.cfg.Extract.Field); ok {
-					p.aggregator.SetGauge(m.cfg.Name, val)
-				}
+			if val, ok := m.extractFloat(data); ok {
+				agg.SetGaugeLabeled(m.cfg.Name, labels, val)
 			}
 
 		case "sum":
-			if m.cfg.Extract != nil {
-				if val, ok := parser.GetFieldFloat(data, m.cfg.Extract.Field); ok {
-					p.aggregator.Add(m.cfg.Name, val)
-				}
+			if val, ok := m.extractFloat(data); ok {
+				agg.AddLabeled(m.cfg.Name, labels, val*weight)
 			}
 
 		case "set":
-			if m.cfg.Extract != nil {
-				if val, ok := parser.GetFieldString(data, m.cfg.Extract.Field); ok {
-					p.aggregator.AddToSet(m.cfg.Name, val)
-				}
+			if val, ok := m.extractString(data); ok {
+				agg.AddToSetLabeled(m.cfg.Name, labels, val)
+			}
+
+		case "percentile":
+			if val, ok := m.extractFloat(data); ok {
+				agg.ObserveLabeled(m.cfg.Name, labels, val)
 			}
 		}
 	}
-}
 
-// sendSnapshot sends the current metrics.
-func (a *Agent) sendSnapshot(ctx context.Context) error {
-	metrics := a.aggregator.Snapshot()
+	if !matched {
+		if p.unmatched != nil {
+			p.unmatched.record(line)
+		}
+		p.samples.noMatch(line, lc)
+	} else if p.matchedLines != nil {
+		p.matchedLines.record(p.source.Location(), names, line)
+	}
+}
 
-	if a.dryRun {
-		a.printDryRunSnapshot(metrics)
+// fields parses a record and returns its fields, or nil when it does not
+// parse. Typed fields are converted after filtering fields. The pod
+// metadata, the path_pattern fields, fields added by the source, then the
+// synthetic __source__, __path__ and __line__ fields, replace parsed fields
+// of the same name; map_fields are applied last.
+func (p *sourceProcessor) fields(line string, lc lineContext) map[string]interface{} {
+	data := p.parser.Parse(line)
+	if data == nil {
 		return nil
 	}
 
-	if a.sender != nil {
-		return a.sender.SendSnapshot(ctx, metrics)
+	if p.filter != nil {
+		data = p.filter.apply(data)
+	}
+	p.types.apply(data)
+	if p.pod != nil {
+		if fields := p.pod.Load(); fields != nil {
+			for k, v := range *fields {
+				data[k] = v
+			}
+		}
+	}
+	if p.paths != nil {
+		for k, v := range p.paths.get(lc.path) {
+			data[k] = v
+		}
+	}
+	for k, v := range p.added {
+		data[k] = v
+	}
+	for k, v := range lc.fields {
+		data[k] = v
 	}
+	data[config.FieldSource] = p.source.Location()
+	if lc.path != "" {
+		data[config.FieldPath] = lc.path
+	}
+	if lc.line > 0 {
+		data[config.FieldLine] = float64(lc.line)
+	}
+	applyMappedFields(p.mapped, data)
+	return data
+}
 
-	return nil
+// extractFailureSamples is how many extraction failures are logged per
+// metric before switching to one sample every extractFailureSampleRate.
+const (
+	extractFailureSamples    = 10
+	extractFailureSampleRate = 1000
+)
+
+// extractFloat extracts the metric's numeric value, counting failures.
+func (m *metricProcessor) extractFloat(data map[string]interface{}) (float64, bool) {
+	if m.cfg.Extract == nil {
+		return 0, false
+	}
+	val, ok := extractFloat(m.cfg.Extract, m.valueMap, data)
+	if !ok {
+		m.recordExtractFailure(data)
+	}
+	return val, ok
 }
 
-// dumpMetrics prints current metrics without reset (for SIGUSR1).
-func (a *Agent) dumpMetrics() {
-	metrics := a.aggregator.Peek()
-	a.printDryRunSnapshot(metrics)
+// extractString extracts the metric's value as a string, counting failures.
+func (m *metricProcessor) extractString(data map[string]interface{}) (string, bool) {
+	if m.cfg.Extract == nil {
+		return "", false
+	}
+	val, ok := extractString(m.cfg.Extract, m.valueMap, data)
+	if !ok {
+		m.recordExtractFailure(data)
+	}
+	return val, ok
 }
 
-// printDryRunSnapshot prints the snapshot in dry-run format.
-func (a *Agent) printDryRunSnapshot(metrics map[string]interface{}) {
-	elapsed := time.Since(a.startTime).Round(time.Second)
-	now := time.Now().UTC().Format(time.RFC3339)
+// recordExtractFailure counts a failed extraction as missing (the field is
+// absent) or invalid (present but not convertible), and logs a sample.
+func (m *metricProcessor) recordExtractFailure(data map[string]interface{}) {
+	field := m.cfg.Extract.Field
 
-	fmt.Println()
-	fmt.Println("───────────────────────────────────────────────────────────")
-	fmt.Printf(" SNAPSHOT @ %s (%s elapsed)\n", now, elapsed)
-	fmt.Println("───────────────────────────────────────────────────────────")
+	reason := "missing"
+	raw, present := parser.GetField(data, field)
+	if present {
+		reason = "invalid"
+		m.extractInvalid.Add(1)
+	} else {
+		m.extractMissing.Add(1)
+	}
 
-	// Source stats
-	for _, proc := range a.processors {
-		fmt.Printf(" Source: %s\n", proc.source.Path)
-		fmt.Printf("   Lines parsed:   %d\n", proc.linesParsed.Load())
-		fmt.Printf("   Lines matched:  %d\n", proc.linesMatched.Load())
-		fmt.Printf("   Parse errors:   %d\n", proc.parseErrors.Load())
-		fmt.Println()
+	n := m.extractMissing.Load() + m.extractInvalid.Load()
+	if n <= extractFailureSamples || n%extractFailureSampleRate == 0 {
+		m.logger.Debug("extract failed",
+			"metric", m.cfg.Name,
+			"field", field,
+			"reason", reason,
+			"value", raw,
+			"failures", n,
+		)
+	}
+}
+
+// labelValues extracts the metric's label values from parsed data.
+// Missing fields yield an empty label value. Returns nil for unlabeled metrics.
+func (m *metricProcessor) labelValues(data map[string]interface{}) []string {
+	if len(m.cfg.Labels) == 0 {
+		return nil
 	}
 
-	// Metrics table
-	fmt.Println(" Aggregated Metrics:")
-	fmt.Println(" ┌─────────────────────────────┬──────────┬────────────────┐")
-	fmt.Println(" │ Metric                      │ Type     │ Value          │")
-	fmt.Println(" ├─────────────────────────────┼──────────┼────────────────┤")
+	values := make([]string, len(m.cfg.Labels))
+	for i, field := range m.cfg.Labels {
+		values[i], _ = parser.GetFieldString(data, field)
+	}
+	return values
+}
 
-	for _, proc := range a.processors {
-		for _, m := range proc.metrics {
-			val := metrics[m.cfg.Name]
-			valStr := formatValue(val)
-			fmt.Printf(" │ %-27s │ %-8s │ %14s │\n", m.cfg.Name, m.cfg.Type, valStr)
+// withoutMetrics returns a copy of m without the given metric names.
+func withoutMetrics[V any](m map[string]V, names map[string]bool) map[string]V {
+	out := make(map[string]V, len(m))
+	for name, v := range m {
+		if !names[name] {
+			out[name] = v
 		}
 	}
+	return out
+}
+
+// sendSnapshot sends the current metrics to the server and every output.
+// A failing output does not prevent the others from receiving the snapshot.
+// Shadow metrics are kept in the history but only passed to the outputs
+// in dry-run mode. Metrics of sources with a timestamp are sent apart, one
+// snapshot per closed interval of event time; all of them once the agent
+// is no longer live.
+func (a *Agent) sendSnapshot(ctx context.Context) error {
+	for _, name := range a.aggregator.Overflowed() {
+		a.logger.Warn("metric reached its series limit, extra label combinations were merged",
+			"metric", name, "overflow_label", aggregator.OverflowLabelValue)
+	}
+
+	a.recordSelfMetrics()
+	snapshot := a.aggregator.Snapshot()
+	a.saveUniqueSets()
+	metrics := withoutMetrics(snapshot, a.events.metricNames())
+	a.derive(a.Config(), metrics)
+	now := time.Now()
+	start := a.liveSince.Load()
+	if prev := a.lastSnapshot.Swap(now.UnixNano()); prev > start {
+		start = prev
+	}
+	a.history.add(now, metrics)
 
-	fmt.Println(" └─────────────────────────────┴──────────┴────────────────┘")
-	fmt.Println()
+	annotations := a.bursts.observe(a.Config(), metrics)
+	for name, ann := range annotations {
+		a.logger.Info("metric burst detected", "metric", name,
+			"value", ann.Value, "baseline", ann.Baseline, "ratio", ann.Ratio)
+	}
 
-	if a.dryRun {
-		fmt.Printf(" [DRY-RUN] Would send to %s\n", a.cfg.ServerURL)
+	snap := sender.Snapshot{
+		Metrics:      metrics,
+		Annotations:  annotations,
+		Start:        time.Unix(0, start),
+		End:          now,
+		WindowStarts: a.windowStarts(metrics),
 	}
-	fmt.Println("───────────────────────────────────────────────────────────")
+	errs := a.publish(ctx, snap)
+	for _, win := range a.events.close(!a.live.Load()) {
+		a.derive(a.Config(), win.Metrics)
+		errs = append(errs, a.publish(ctx, sender.Snapshot{Metrics: win.Metrics, Start: win.Start, End: win.End})...)
+	}
+	return errors.Join(errs...)
 }
 
-// formatValue formats a metric value for display.
-func formatValue(v interface{}) string {
-	switch val := v.(type) {
-	case float64:
-		if val == float64(int64(val)) {
-			return fmt.Sprintf("%d", int64(val))
+// windowStarts returns the start of the window of the windowed sets among
+// metrics, read right after the snapshot that rolled them over.
+func (a *Agent) windowStarts(metrics map[string]interface{}) map[string]time.Time {
+	var starts map[string]time.Time
+	for name := range metrics {
+		if start, ok := a.aggregator.WindowStart(name); ok {
+			if starts == nil {
+				starts = make(map[string]time.Time)
+			}
+			starts[name] = start
 		}
-		return fmt.Sprintf("%.2f", val)
-	case int:
-		return fmt.Sprintf("%d", val)
-	case int64:
-		return fmt.Sprintf("%d", val)
-	default:
-		return fmt.Sprintf("%v", val)
 	}
+	return starts
 }
 
-// stopTailers stops all tailers.
-func (a *Agent) stopTailers() {
-	for _, t := range a.tailers {
-		if err := t.Stop(); err != nil {
-			a.logger.Error("error stopping tailer", "path", t.Path(), "error", err)
+// publish sends the metrics of snap to every destination and output, and
+// returns their errors.
+func (a *Agent) publish(ctx context.Context, snap sender.Snapshot) []error {
+	metrics, annotations := snap.Metrics, snap.Annotations
+	public := metrics
+	if shadow := a.Config().ShadowMetrics(); shadow != nil {
+		public = withoutMetrics(metrics, shadow)
+		annotations = withoutMetrics(annotations, shadow)
+	}
+
+	snap.Metrics, snap.Annotations = public, annotations
+	if a.Config().SnapshotTimestamp == config.SnapshotTimestampStart {
+		snap.Timestamp = snap.Start
+	}
+	errs := a.deliver(ctx, snap)
+
+	if a.exporter != nil {
+		a.exporter.Send(ctx, public)
+	}
+
+	outMetrics := public
+	if a.dryRun {
+		outMetrics = metrics
+	}
+	for _, out := range a.outputs {
+		if err := out.Send(ctx, outMetrics); err != nil {
+			a.outputFailures.Add(1)
+			errs = append(errs, fmt.Errorf("output %s: %w", out.Name(), err))
 		}
 	}
+
+	return errs
+}
+
+// stopTailers stops all tailers concurrently, then reads the lines they had
+// not delivered for at most drain (unless it is 0). It waits until ctx is
+// done at most, then saves their final positions.
+func (a *Agent) stopTailers(ctx context.Context, drain time.Duration) {
+	a.tailersMu.Lock()
+	tailers := make([]*tailer.Tailer, 0, len(a.tailers))
+	for _, t := range a.tailers {
+		tailers = append(tailers, t)
+	}
+	journals := a.journals
+	gelfs := a.gelfs
 	a.tailers = nil
+	a.journals = nil
+	a.gelfs = nil
+	a.tailersMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, t := range tailers {
+		wg.Add(1)
+		go func(t *tailer.Tailer) {
+			defer wg.Done()
+			if err := t.Stop(); err != nil {
+				a.logger.Error("error stopping tailer", "path", t.Path(), "error", err)
+			}
+			if drain <= 0 {
+				return
+			}
+			drainCtx, cancel := context.WithTimeout(ctx, drain)
+			defer cancel()
+			if err := t.Drain(drainCtx); err != nil {
+				a.logger.Warn("lines left unread on shutdown", "path", t.Path(), "error", err)
+			}
+		}(t)
+	}
+	for _, r := range journals {
+		wg.Add(1)
+		go func(r *journald.Reader) {
+			defer wg.Done()
+			r.Stop()
+		}(r)
+	}
+	for _, l := range gelfs {
+		wg.Add(1)
+		go func(l *gelf.Listener) {
+			defer wg.Done()
+			l.Stop()
+		}(l)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		a.logger.Warn("timed out waiting for tailers to stop")
+	}
+
+	a.savePositions(tailers)
+}
+
+// currentTailers returns the running tailers.
+func (a *Agent) currentTailers() []*tailer.Tailer {
+	a.tailersMu.Lock()
+	defer a.tailersMu.Unlock()
+
+	tailers := make([]*tailer.Tailer, 0, len(a.tailers))
+	for _, t := range a.tailers {
+		tailers = append(tailers, t)
+	}
+	return tailers
+}
+
+// savePositions persists the offsets of the given tailers and of parked
+// files. When several sources tail the same file, the smallest offset is
+// kept so no line is skipped on resume.
+func (a *Agent) savePositions(tailers []*tailer.Tailer) {
+	if a.positions == nil {
+		return
+	}
+
+	offsets := make(map[string]int64, len(tailers))
+	keep := func(path string, offset int64) {
+		if prev, ok := offsets[path]; !ok || offset < prev {
+			offsets[path] = offset
+		}
+	}
+	for _, t := range tailers {
+		keep(t.Path(), t.Offset())
+	}
+	a.tailersMu.Lock()
+	for key, p := range a.parked {
+		keep(key.path, p.offset)
+	}
+	a.tailersMu.Unlock()
+
+	paths := make([]string, 0, len(offsets))
+	for path, offset := range offsets {
+		a.positions.Set(path, offset)
+		paths = append(paths, path)
+	}
+	a.positions.Retain(paths)
+
+	if err := a.positions.Save(); err != nil {
+		a.logger.Error("failed to save positions", "path", a.positions.Path(), "error", err)
+	}
 }
 
 // GetAggregator returns the aggregator (for testing).
@@ -375,19 +1315,110 @@ func (a *Agent) GetAggregator() *aggregator.Aggregator {
 	return a.aggregator
 }
 
+// Metrics returns the current metric values without resetting them.
+// Metrics of sources with a timestamp are those of their latest interval.
+func (a *Agent) Metrics() map[string]interface{} {
+	metrics := a.aggregator.Peek()
+	for name, v := range a.events.latest() {
+		metrics[name] = v
+	}
+	a.derive(a.Config(), metrics)
+	return metrics
+}
+
+// Config returns the configuration currently in use.
+func (a *Agent) Config() *config.Config {
+	a.procMu.RLock()
+	defer a.procMu.RUnlock()
+	return a.cfg
+}
+
+// currentProcessors returns the source processors currently in use.
+func (a *Agent) currentProcessors() []*sourceProcessor {
+	a.procMu.RLock()
+	defer a.procMu.RUnlock()
+	return a.processors
+}
+
+// processor returns the current processor for a source key, or nil if the
+// source was removed by a reload.
+func (a *Agent) processor(key string) *sourceProcessor {
+	a.procMu.RLock()
+	defer a.procMu.RUnlock()
+	for _, proc := range a.processors {
+		if proc.key == key {
+			return proc
+		}
+	}
+	return nil
+}
+
+// StartTime returns when the agent was last started.
+func (a *Agent) StartTime() time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.startTime
+}
+
 // ProcessLine processes a line for a specific source (for testing).
 func (a *Agent) ProcessLine(sourceIndex int, line string) {
-	if sourceIndex >= 0 && sourceIndex < len(a.processors) {
-		a.processors[sourceIndex].processLine(line)
+	processors := a.currentProcessors()
+	if sourceIndex >= 0 && sourceIndex < len(processors) {
+		processors[sourceIndex].processLine(line)
 	}
 }
 
 // ProcessFile processes an entire file through the first source processor.
 func (a *Agent) ProcessFile(path string) (int, error) {
-	if len(a.processors) == 0 {
+	return a.ProcessFileLimit(path, 0)
+}
+
+// ProcessFileLimit processes the first limit lines of a file (all when
+// limit is 0) through the first source processor.
+func (a *Agent) ProcessFileLimit(path string, limit int) (int, error) {
+	processors := a.currentProcessors()
+	if len(processors) == 0 {
 		return 0, fmt.Errorf("no processors configured")
 	}
 
-	proc := a.processors[0]
-	return tailer.ProcessFile(path, proc.processLine, 0)
+	proc := processors[0]
+	var n int64
+	defer proc.flush()
+	return tailer.ProcessFile(path, func(line string) {
+		n++
+		proc.processLineWith(line, lineContext{path: path, line: n})
+	}, limit)
+}
+
+// Flush processes the records multiline sources are still assembling,
+// typically after feeding lines with ProcessLine. Stop and ProcessFile
+// flush on their own.
+func (a *Agent) Flush() {
+	for _, proc := range a.currentProcessors() {
+		proc.flush()
+	}
+}
+
+// flush processes the records still being assembled or queued, if any.
+func (p *sourceProcessor) flush() {
+	if p.multiline != nil {
+		p.multiline.flush()
+	}
+	if p.queue != nil {
+		p.queue.wait()
+	}
+}
+
+// close handles the queued records, stops the workers and releases the
+// files of a processor that is no longer used.
+func (p *sourceProcessor) close() {
+	if p.queue != nil {
+		p.queue.close()
+	}
+	p.errors.Flush()
+	if p.unmatched != nil {
+		if err := p.unmatched.close(); err != nil {
+			p.logger.Error("error closing unmatched lines file", "file", p.source.Unmatched.File, "error", err)
+		}
+	}
 }
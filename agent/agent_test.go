@@ -3,12 +3,27 @@
 package agent
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/kolapsis/shm-agent/agent/aggregator"
 	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/kafka"
+	"github.com/kolapsis/shm-agent/agent/sender"
+	"github.com/kolapsis/shm-agent/agent/sender/shmtest"
 )
 
 func TestAgent_ProcessJSON(t *testing.T) {
@@ -418,3 +433,726 @@ func TestAgent_MalformedLines(t *testing.T) {
 		t.Errorf("requests = %v, want 3", v)
 	}
 }
+
+func TestAgent_RunStopsOnContextCancel(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+
+	if err := os.WriteFile(path, []byte{}, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cfg := &config.Config{
+		ServerURL:    "https://example.com",
+		IdentityFile: filepath.Join(dir, "identity.json"),
+		AppName:      "test-app",
+		AppVersion:   "1.0.0",
+		Environment:  "test",
+		Interval:     time.Hour,
+		Sources: []config.Source{
+			{
+				Path:   path,
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+				},
+			},
+		},
+	}
+
+	agent, err := New(Options{
+		Config:          cfg,
+		DryRun:          true,
+		ShutdownTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- agent.Run(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run() did not return after context cancellation")
+	}
+}
+
+func TestAgent_LabeledMetrics(t *testing.T) {
+	cfg := &config.Config{
+		ServerURL:   "https://example.com",
+		AppName:     "test-app",
+		AppVersion:  "1.0.0",
+		Environment: "test",
+		Sources: []config.Source{
+			{
+				Path:   "/var/log/test.log",
+				Format: "json",
+				Metrics: []config.Metric{
+					{
+						Name:   "http_requests",
+						Type:   "counter",
+						Labels: []string{"method", "status"},
+					},
+					{
+						Name:    "bytes_by_method",
+						Type:    "sum",
+						Labels:  []string{"method"},
+						Extract: &config.Extract{Field: "bytes"},
+					},
+					{
+						Name:    "requests_by_status",
+						Type:    "counter_by",
+						Extract: &config.Extract{Field: "status"},
+					},
+				},
+			},
+		},
+	}
+
+	agent, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	lines := []string{
+		`{"method": "GET", "status": 200, "bytes": 100}`,
+		`{"method": "GET", "status": 200, "bytes": 50}`,
+		`{"method": "POST", "status": 201, "bytes": 10}`,
+	}
+	for _, line := range lines {
+		agent.ProcessLine(0, line)
+	}
+
+	metrics := agent.GetAggregator().Peek()
+
+	requests := metrics["http_requests"].([]aggregator.Series)
+	if len(requests) != 2 {
+		t.Fatalf("len(http_requests) = %d, want 2", len(requests))
+	}
+	if requests[0].Labels["status"] != "200" || requests[0].Value.(float64) != 2 {
+		t.Errorf("http_requests[0] = %+v, want status=200 value=2", requests[0])
+	}
+
+	bytes := metrics["bytes_by_method"].([]aggregator.Series)
+	if len(bytes) != 2 || bytes[0].Value.(float64) != 150 {
+		t.Errorf("bytes_by_method = %+v, want GET=150", bytes)
+	}
+
+	byStatus := metrics["requests_by_status"].(aggregator.Counts)
+	if byStatus.Key != "status" || byStatus.Values["200"] != 2 || byStatus.Values["201"] != 1 || len(byStatus.Values) != 2 {
+		t.Errorf("requests_by_status = %+v, want 200=2 201=1", byStatus)
+	}
+}
+
+func TestAgent_ShadowMetrics(t *testing.T) {
+	server := newTestServer(t)
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(logPath, nil, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cfg := &config.Config{
+		ServerURL:     server.URL,
+		IdentityFile:  filepath.Join(dir, "identity.json"),
+		PositionsFile: "none",
+		AppName:       "test-app",
+		AppVersion:    "1.0.0",
+		Interval:      time.Hour,
+		History:       1,
+		Sources: []config.Source{
+			{
+				Path:   logPath,
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+					{Name: "trial_requests", Type: "counter", Shadow: true},
+				},
+			},
+		},
+	}
+
+	run := func(dryRun bool) (sent, history map[string]interface{}) {
+		var out map[string]interface{}
+		ag, err := NewBuilder(cfg, WithDryRun(dryRun), WithOutput(OutputFunc(
+			func(_ context.Context, metrics map[string]interface{}) error {
+				out = metrics
+				return nil
+			}))).Build()
+		if err != nil {
+			t.Fatalf("Build() error = %v", err)
+		}
+		if err := ag.Start(context.Background()); err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		ag.ProcessLine(0, `{}`)
+		ag.Stop(0)
+
+		entries := ag.History()
+		return out, entries[len(entries)-1].Metrics
+	}
+
+	out, history := run(false)
+	if _, ok := out["trial_requests"]; ok || out["requests"] != float64(1) {
+		t.Errorf("output received %v, want requests without the shadow metric", out)
+	}
+	if history["trial_requests"] != float64(1) {
+		t.Errorf("history = %v, want the shadow metric", history)
+	}
+	received := server.received()
+	if len(received) != 1 {
+		t.Fatalf("server received %d snapshots, want 1", len(received))
+	}
+	if _, ok := received[0]["trial_requests"]; ok {
+		t.Errorf("server received the shadow metric: %v", received[0])
+	}
+
+	// Dry-run outputs show shadow metrics
+	if out, _ := run(true); out["trial_requests"] != float64(1) {
+		t.Errorf("dry-run output = %v, want the shadow metric", out)
+	}
+}
+
+func TestAgent_OTLPOutput(t *testing.T) {
+	var mu sync.Mutex
+	var requests []map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		if r.URL.Path != "/v1/metrics" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	dir := t.TempDir()
+	cfg := &config.Config{
+		AppName:       "test-app",
+		Output:        config.OutputOTLP,
+		OTLP:          config.OTLPConfig{Endpoint: collector.URL},
+		IdentityFile:  filepath.Join(dir, "identity.json"),
+		PositionsFile: "none",
+		Interval:      time.Hour,
+		Sources: []config.Source{
+			{
+				Path:   filepath.Join(dir, "app.log"),
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+				},
+			},
+		},
+	}
+	if err := os.WriteFile(cfg.Sources[0].Path, nil, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	ag, err := New(Options{Config: cfg})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	ag.ProcessLine(0, `{}`)
+	ag.Stop(0)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 1 {
+		t.Fatalf("collector received %d requests, want the final snapshot", len(requests))
+	}
+	data, _ := json.Marshal(requests[0])
+	for _, want := range []string{`"service.name"`, `"name":"requests"`, `"isMonotonic":true`, `"asDouble":1`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("export request lacks %s: %s", want, data)
+		}
+	}
+	if _, err := os.Stat(cfg.IdentityFile); err == nil {
+		t.Error("identity generated though no server is used")
+	}
+	if ag.health().LastDelivery == nil {
+		t.Error("health has no last delivery after an export")
+	}
+}
+
+func TestAgent_StatsDOutput(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	dir := t.TempDir()
+	cfg := &config.Config{
+		AppName:       "test-app",
+		Output:        config.OutputStatsD,
+		StatsD:        config.StatsDConfig{Address: pc.LocalAddr().String(), Prefix: "app."},
+		PositionsFile: "none",
+		Interval:      time.Hour,
+		Sources: []config.Source{
+			{
+				Path:   filepath.Join(dir, "app.log"),
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+				},
+			},
+		},
+	}
+	if err := os.WriteFile(cfg.Sources[0].Path, nil, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	ag, err := New(Options{Config: cfg})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	ag.ProcessLine(0, `{}`)
+	ag.Stop(0)
+
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom() error = %v", err)
+	}
+	if lines := strings.Split(string(buf[:n]), "\n"); !slices.Contains(lines, "app.requests:1|c") {
+		t.Errorf("received %q, want the requests counter", lines)
+	}
+}
+
+func TestAgent_InfluxDBOutput(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	influxdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(data))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influxdb.Close()
+
+	dir := t.TempDir()
+	cfg := &config.Config{
+		AppName:       "test-app",
+		Output:        config.OutputInfluxDB,
+		InfluxDB:      config.InfluxDBConfig{URL: influxdb.URL, Bucket: "metrics"},
+		PositionsFile: "none",
+		Interval:      time.Hour,
+		Sources: []config.Source{
+			{
+				Path:   filepath.Join(dir, "app.log"),
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter", Labels: []string{"method"}},
+				},
+			},
+		},
+	}
+	if err := os.WriteFile(cfg.Sources[0].Path, nil, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	ag, err := New(Options{Config: cfg})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	ag.ProcessLine(0, `{"method":"GET"}`)
+	ag.Stop(0)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 1 {
+		t.Fatalf("InfluxDB received %d writes, want the final snapshot", len(bodies))
+	}
+	if !strings.Contains(bodies[0], "requests,method=GET value=1 ") {
+		t.Errorf("write = %q, want the requests point", bodies[0])
+	}
+}
+
+func TestAgent_FileOutput(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{
+		AppName:       "test-app",
+		Output:        config.OutputFile,
+		File:          config.FileOutputConfig{Path: filepath.Join(dir, "snapshots.jsonl")},
+		PositionsFile: "none",
+		Interval:      time.Hour,
+		Sources: []config.Source{
+			{
+				Path:   filepath.Join(dir, "app.log"),
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+				},
+			},
+		},
+	}
+	if err := os.WriteFile(cfg.Sources[0].Path, nil, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	ag, err := New(Options{Config: cfg})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	ag.ProcessLine(0, `{"method":"GET"}`)
+	ag.Stop(0)
+
+	data, err := os.ReadFile(cfg.File.Path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	var line struct {
+		AppName string             `json:"app_name"`
+		Metrics map[string]float64 `json:"metrics"`
+	}
+	if err := json.Unmarshal(data, &line); err != nil {
+		t.Fatalf("file %q: %v", data, err)
+	}
+	if line.AppName != "test-app" || line.Metrics["requests"] != 1 {
+		t.Errorf("file = %s, want the final snapshot", data)
+	}
+}
+
+func TestAgent_Outputs(t *testing.T) {
+	var mu sync.Mutex
+	var influxWrites int
+	influxdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		influxWrites++
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influxdb.Close()
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+
+	dir := t.TempDir()
+	cfg := &config.Config{
+		AppName:       "test-app",
+		Outputs:       []string{config.OutputOTLP, config.OutputInfluxDB},
+		OTLP:          config.OTLPConfig{Endpoint: collector.URL},
+		InfluxDB:      config.InfluxDBConfig{URL: influxdb.URL, Bucket: "metrics"},
+		PositionsFile: "none",
+		Interval:      time.Hour,
+		Sources: []config.Source{
+			{
+				Path:    filepath.Join(dir, "app.log"),
+				Format:  "json",
+				Metrics: []config.Metric{{Name: "requests", Type: "counter"}},
+			},
+		},
+	}
+	if err := os.WriteFile(cfg.Sources[0].Path, nil, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	ag, err := New(Options{Config: cfg})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	ag.ProcessLine(0, `{}`)
+	ag.Stop(0)
+
+	// The failing collector does not keep InfluxDB from receiving the snapshot
+	mu.Lock()
+	writes := influxWrites
+	mu.Unlock()
+	if writes != 1 {
+		t.Errorf("InfluxDB received %d writes, want the final snapshot", writes)
+	}
+
+	h := ag.health()
+	if len(h.Outputs) != 2 {
+		t.Fatalf("health outputs = %+v, want otlp and influxdb", h.Outputs)
+	}
+	otlpHealth, influxHealth := h.Outputs[0], h.Outputs[1]
+	if otlpHealth.Name != "otlp" || otlpHealth.Failures != 1 || otlpHealth.LastError == "" || otlpHealth.LastDelivery != nil {
+		t.Errorf("otlp health = %+v, want a failure", otlpHealth)
+	}
+	if influxHealth.Name != "influxdb" || influxHealth.Failures != 0 || influxHealth.LastDelivery == nil {
+		t.Errorf("influxdb health = %+v, want a delivery", influxHealth)
+	}
+	if h.LastDelivery != nil {
+		t.Errorf("LastDelivery = %v, want nil as otlp never accepted a snapshot", h.LastDelivery)
+	}
+}
+
+// eventRecorder is an exporter publishing matched lines, or failing to.
+type eventRecorder struct {
+	fail   bool
+	events []kafka.Event
+}
+
+func (e *eventRecorder) Name() string                                { return "events" }
+func (e *eventRecorder) Send(context.Context, sender.Snapshot) error { return nil }
+func (e *eventRecorder) LastDelivery() time.Time                     { return time.Time{} }
+func (e *eventRecorder) Close() error                                { return nil }
+func (e *eventRecorder) SendEvents(_ context.Context, events []kafka.Event) error {
+	if e.fail {
+		return errors.New("brokers unavailable")
+	}
+	e.events = append(e.events, events...)
+	return nil
+}
+
+func TestAgent_KafkaMatchedLines(t *testing.T) {
+	cfg := &config.Config{
+		AppName: "test-app",
+		Output:  config.OutputKafka,
+		Kafka:   config.KafkaConfig{Brokers: []string{"127.0.0.1:9092"}, Topic: "snapshots", EventsTopic: "events"},
+		Sources: []config.Source{
+			{
+				Path:   "/var/log/app.log",
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+					{Name: "errors", Type: "counter", Match: &config.Match{Field: "level", Equals: "error"}},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	ag.ProcessLine(0, `{"level":"error"}`)
+	ag.ProcessLine(0, `not json`)
+
+	events, dropped := ag.matchedLines.take()
+	if len(events) != 1 || dropped != 0 {
+		t.Fatalf("matched lines = %+v, dropped %d, want the line that matched", events, dropped)
+	}
+	ev := events[0]
+	if ev.Line != `{"level":"error"}` || ev.Source != "/var/log/app.log" || strings.Join(ev.Metrics, ",") != "requests,errors" {
+		t.Errorf("matched line = %+v", ev)
+	}
+
+	// Lines that could not be published go with the next snapshot
+	exp := &eventRecorder{fail: true}
+	ag.exports = []*destination{{exporter: exp}}
+	ag.ProcessLine(0, `{"n":1}`)
+	if errs := ag.deliver(context.Background(), sender.Snapshot{}); len(errs) != 1 {
+		t.Fatalf("deliver() errors = %v, want the events failure", errs)
+	}
+	ag.ProcessLine(0, `{"n":2}`)
+	exp.fail = false
+	if errs := ag.deliver(context.Background(), sender.Snapshot{}); len(errs) != 0 {
+		t.Fatalf("deliver() errors = %v", errs)
+	}
+	events = exp.events
+	if len(events) != 2 || events[0].Line != `{"n":1}` || events[1].Line != `{"n":2}` {
+		t.Errorf("published lines = %+v, want the requeued line first", events)
+	}
+
+	// Beyond the buffer, the oldest requeued lines are dropped
+	ag.matchedLines.requeue(make([]kafka.Event, maxMatchedLines+1))
+	if events, dropped := ag.matchedLines.take(); len(events) != maxMatchedLines || dropped != 1 {
+		t.Errorf("requeued %d lines, dropped %d, want %d and 1", len(events), dropped, maxMatchedLines)
+	}
+
+	// Dry runs publish nothing, so they buffer nothing
+	dry, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if dry.matchedLines != nil {
+		t.Error("matched lines are buffered in a dry run")
+	}
+}
+
+func TestAgent_SecurityPreset(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+app_name: test-app
+offline: true
+presets:
+  - name: security
+    auth_log: /var/log/auth.log
+    web_log: /var/log/nginx/access.log
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	for _, line := range []string{
+		"Jan 15 10:00:00 web-01 sshd[1234]: Failed password for root from 203.0.113.7 port 52144 ssh2",
+		"Jan 15 10:00:01 web-01 sshd[1234]: Failed password for invalid user admin from 203.0.113.7 port 52146 ssh2",
+		"Jan 15 10:00:01 web-01 sshd[1234]: Invalid user admin from 203.0.113.7 port 52146",
+		"2024-01-15T10:00:02.123456+00:00 web-01 sshd[1240]: Accepted publickey for alice from 198.51.100.2 port 40022 ssh2: ED25519 SHA256:abc",
+		"Jan 15 10:00:03 web-01 sudo:    alice : TTY=pts/0 ; PWD=/home/alice ; USER=root ; COMMAND=/usr/bin/systemctl restart nginx",
+		"Jan 15 10:00:04 web-01 sudo: pam_unix(sudo:auth): authentication failure; logname=bob uid=1001 euid=0 tty=/dev/pts/1 ruser=bob rhost=  user=bob",
+		"Jan 15 10:00:05 web-01 CRON[99]: pam_unix(cron:session): session opened for user root",
+	} {
+		ag.ProcessLine(0, line)
+	}
+	for _, line := range []string{
+		`203.0.113.9 - - [15/Jan/2024:10:00:00 +0000] "POST /login HTTP/1.1" 401 12 "-" "curl/8.0"`,
+		`203.0.113.9 - - [15/Jan/2024:10:00:01 +0000] "GET /admin HTTP/1.1" 403 12 "-" "curl/8.0"`,
+		`198.51.100.2 - alice [15/Jan/2024:10:00:02 +0000] "GET / HTTP/1.1" 200 512 "-" "Mozilla/5.0"`,
+	} {
+		ag.ProcessLine(1, line)
+	}
+
+	got := ag.Metrics()
+	for name, want := range map[string]float64{
+		"security_ssh_failed_logins":   2,
+		"security_ssh_invalid_users":   1,
+		"security_ssh_accepted_logins": 1,
+		"security_sudo_commands":       1,
+		"security_sudo_auth_failures":  1,
+		"security_web_auth_failures":   2,
+	} {
+		if v := seriesTotal(got[name]); v != want {
+			t.Errorf("%s = %v, want %v", name, got[name], want)
+		}
+	}
+
+	series := got["security_ssh_failed_logins"].([]aggregator.Series)
+	if len(series) != 1 || series[0].Labels["ip"] != "203.0.113.7" {
+		t.Errorf("ssh_failed_logins series = %v, want one for 203.0.113.7", series)
+	}
+	series = got["security_sudo_commands"].([]aggregator.Series)
+	if len(series) != 1 || series[0].Labels["sudo_user"] != "alice" || series[0].Labels["sudo_target"] != "root" {
+		t.Errorf("sudo_commands series = %v, want alice to root", series)
+	}
+	if s := ag.Stats().Sources[0]; s.ParseErrors != 0 {
+		t.Errorf("parse errors = %d, want every auth log line parsed", s.ParseErrors)
+	}
+}
+
+// seriesTotal returns a counter value, summing the series of a labeled one.
+func seriesTotal(v interface{}) float64 {
+	if series, ok := v.([]aggregator.Series); ok {
+		var total float64
+		for _, s := range series {
+			total += s.Value.(float64)
+		}
+		return total
+	}
+	f, _ := v.(float64)
+	return f
+}
+
+func BenchmarkSourceProcessor_HandleRecord(b *testing.B) {
+	src := &config.Source{Path: "/var/log/app.log", Format: "json"}
+	for _, class := range []string{"2", "3", "4", "5"} {
+		src.Metrics = append(src.Metrics,
+			config.Metric{Name: "status_" + class + "xx", Type: "counter",
+				Match: &config.Match{Field: "status", Regex: "^" + class + `\d\d$`}},
+			config.Metric{Name: "api_" + class + "xx", Type: "counter",
+				Match: &config.Match{All: []config.Match{
+					{Field: "status", Regex: "^" + class + `\d\d$`},
+					{Field: "path", Contains: "/api/"},
+				}}})
+	}
+	src.Metrics = append(src.Metrics,
+		config.Metric{Name: "bytes", Type: "sum", Extract: &config.Extract{Field: "bytes"}},
+		config.Metric{Name: "methods", Type: "counter_by", Extract: &config.Extract{Field: "method"}})
+
+	proc, err := newSourceProcessor(src, aggregator.New(), slog.New(slog.NewTextHandler(io.Discard, nil)), 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer proc.close()
+
+	line := `{"status": 503, "path": "/api/users", "method": "GET", "bytes": 512}`
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		proc.handleRecord(line, lineContext{})
+	}
+}
+
+func TestAgent_StartFailureReleases(t *testing.T) {
+	srv := shmtest.NewServer()
+	defer srv.Close()
+
+	// The listener cannot bind an address in use, after the sender and the
+	// exporters were created
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	dir := t.TempDir()
+	cfg := &config.Config{
+		AppName:       "test-app",
+		AppVersion:    "1.0.0",
+		ServerURL:     srv.URL,
+		Outputs:       []string{config.OutputSHM, config.OutputFile},
+		File:          config.FileOutputConfig{Path: filepath.Join(dir, "snapshots.jsonl")},
+		IdentityFile:  filepath.Join(dir, "identity.json"),
+		PositionsFile: filepath.Join(dir, "positions.json"),
+		SequenceFile:  "none",
+		ListenAddr:    busy.Addr().String(),
+		Interval:      time.Hour,
+		Sources: []config.Source{
+			{
+				Path:   filepath.Join(dir, "app.log"),
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+				},
+			},
+		},
+	}
+	if err := os.WriteFile(cfg.Sources[0].Path, nil, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	ag, err := New(Options{Config: cfg})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := ag.Start(context.Background()); err == nil {
+		ag.Stop(0)
+		t.Fatal("Start() succeeded on an address in use")
+	}
+	if ag.sender != nil || ag.exports != nil || ag.positions != nil {
+		t.Errorf("failed Start left sender %t, exports %t, positions %t", ag.sender != nil, ag.exports != nil, ag.positions != nil)
+	}
+
+	// Start can be retried once the address is free
+	busy.Close()
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("second Start() error = %v", err)
+	}
+	ag.Stop(0)
+}
@@ -4,7 +4,12 @@
 package aggregator
 
 import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 // MetricType represents the type of a metric.
@@ -15,31 +20,219 @@ const (
 	Gauge   MetricType = "gauge"
 	Sum     MetricType = "sum"
 	Set     MetricType = "set"
+
+	// Percentile estimates quantiles of the values observed in an interval.
+	Percentile MetricType = "percentile"
+
+	// CounterBy counts observations per value of a field, such as
+	// requests per path.
+	CounterBy MetricType = "counter_by"
 )
 
-// MetricValue holds the current state of a metric.
+// DefaultQuantiles are the quantiles exported for percentile metrics
+// unless set with SetQuantiles.
+var DefaultQuantiles = []float64{0.5, 0.95, 0.99}
+
+// DefaultMaxSeries is the default cardinality cap for labeled metrics.
+const DefaultMaxSeries = 1000
+
+// OverflowLabelValue is the label value used for the series that collects
+// observations once a labeled metric has reached its cardinality cap.
+const OverflowLabelValue = "__overflow__"
+
+// MetricValue holds the current state of a metric series.
 type MetricValue struct {
-	Type  MetricType
-	Value float64            // Used for counter, gauge, sum
-	Set   map[string]struct{} // Used for set (unique values)
+	Type   MetricType
+	Value  float64             // Used for counter, gauge, sum
+	Set    map[string]struct{} // Used for set (unique values)
+	HLL    *HyperLogLog        // Replaces Set once an approximate set grows large
+	Sketch *Sketch             // Used for percentile
+	Counts map[string]float64  // Used for counter_by, keyed by value
+
+	approximate bool
+}
+
+// hllExactLimit is the number of values an approximate set counts exactly
+// before switching to a HyperLogLog.
+const hllExactLimit = 1024
+
+// addToSet adds a value to a set, switching approximate sets to a
+// HyperLogLog once they hold more than hllExactLimit values.
+func (mv *MetricValue) addToSet(value string) {
+	if mv.HLL != nil {
+		mv.HLL.Add(value)
+		return
+	}
+
+	mv.Set[value] = struct{}{}
+	if mv.approximate && len(mv.Set) > hllExactLimit {
+		mv.HLL = NewHyperLogLog()
+		for v := range mv.Set {
+			mv.HLL.Add(v)
+		}
+		mv.Set = nil
+	}
+}
+
+// Distribution is the exported value of a percentile series: the number
+// and sum of the values observed ("count" and "sum") and one entry per
+// quantile, named by QuantileName. Quantiles are omitted when no value was
+// observed.
+type Distribution map[string]float64
+
+// Counts is the exported value of a counter_by series: the number of
+// observations per value of the field named Key. It is encoded in JSON as
+// the map of values alone.
+type Counts struct {
+	Key    string
+	Values map[string]float64
+}
+
+// MarshalJSON encodes the counts as a map of values.
+func (c Counts) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.Values)
+}
+
+// Total returns the number of observations of all values.
+func (c Counts) Total() float64 {
+	var total float64
+	for _, n := range c.Values {
+		total += n
+	}
+	return total
+}
+
+// Series returns a series per value, sorted by value, with labels and the
+// value under Key, for outputs without maps.
+func (c Counts) Series(labels map[string]string) []Series {
+	values := make([]string, 0, len(c.Values))
+	for v := range c.Values {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+
+	series := make([]Series, 0, len(values))
+	for _, v := range values {
+		l := make(map[string]string, len(labels)+1)
+		for k, lv := range labels {
+			l[k] = lv
+		}
+		l[c.Key] = v
+		series = append(series, Series{Labels: l, Value: c.Values[v]})
+	}
+	return series
+}
+
+// Flatten replaces the series of a labeled counter_by metric with a series
+// per counted value, see Counts.Series. Other series are returned as is.
+func Flatten(series []Series) []Series {
+	var flat []Series
+	for i, s := range series {
+		c, ok := s.Value.(Counts)
+		if !ok {
+			if flat != nil {
+				flat = append(flat, s)
+			}
+			continue
+		}
+		if flat == nil {
+			flat = append([]Series(nil), series[:i]...)
+		}
+		flat = append(flat, c.Series(s.Labels)...)
+	}
+	if flat == nil {
+		return series
+	}
+	return flat
+}
+
+// SeriesOf returns the series of a metric value, for outputs without
+// maps: those of a labeled metric, one per value of a counter_by metric,
+// or a single unlabeled one.
+func SeriesOf(value interface{}) []Series {
+	switch v := value.(type) {
+	case []Series:
+		return Flatten(v)
+	case Counts:
+		return v.Series(nil)
+	case nil:
+		return nil
+	default:
+		return []Series{{Value: v}}
+	}
+}
+
+// Float converts a numeric metric value to float64. It reports whether
+// the value is a finite number.
+func Float(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, !math.IsNaN(n) && !math.IsInf(n, 0)
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
+
+// Series is a single label combination of a labeled metric, as returned by
+// Snapshot and Peek.
+type Series struct {
+	Labels map[string]string `json:"labels"`
+	Value  interface{}       `json:"value"`
+}
+
+// metric is a registered metric with all of its series.
+// Unlabeled metrics have a single series stored under the empty key.
+type metric struct {
+	typ         MetricType
+	labelNames  []string
+	maxSeries   int
+	quantiles   []float64     // for percentile metrics
+	countKey    string        // for counter_by metrics, the field counted
+	approximate bool          // for set metrics
+	window      Window        // for set metrics kept across snapshots
+	windowStart time.Time     // start of the current window
+	seriesTTL   time.Duration // for labeled gauges, how long a series is kept without update
+	series      map[string]*series
+	overflowed  bool
+}
+
+// series is the state of one label combination.
+type series struct {
+	labelValues []string
+	value       *MetricValue
+	updated     time.Time // last observation
 }
 
 // Aggregator manages metric aggregation.
 type Aggregator struct {
 	mu      sync.RWMutex
-	metrics map[string]*MetricValue
+	metrics map[string]*metric
+	now     func() time.Time // the clock of windows
 }
 
 // New creates a new Aggregator.
 func New() *Aggregator {
 	return &Aggregator{
-		metrics: make(map[string]*MetricValue),
+		metrics: make(map[string]*metric),
+		now:     time.Now,
 	}
 }
 
 // Register registers a metric with the given name and type.
 // Must be called before using Inc, SetGauge, Add, or AddToSet.
 func (a *Aggregator) Register(name string, metricType MetricType) {
+	a.RegisterLabeled(name, metricType, nil, 0)
+}
+
+// RegisterLabeled registers a metric whose observations are split by the
+// given label names. At most maxSeries label combinations are tracked per
+// interval; further combinations are folded into a single overflow series.
+// A maxSeries of 0 uses DefaultMaxSeries.
+func (a *Aggregator) RegisterLabeled(name string, metricType MetricType, labelNames []string, maxSeries int) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
@@ -47,76 +240,322 @@ func (a *Aggregator) Register(name string, metricType MetricType) {
 		return
 	}
 
-	mv := &MetricValue{Type: metricType}
-	if metricType == Set {
+	if maxSeries <= 0 {
+		maxSeries = DefaultMaxSeries
+	}
+
+	m := &metric{
+		typ:        metricType,
+		labelNames: labelNames,
+		maxSeries:  maxSeries,
+		series:     make(map[string]*series),
+	}
+	if !m.labeled() {
+		m.series[""] = &series{value: m.newValue()}
+	}
+	a.metrics[name] = m
+}
+
+// Fork returns an empty aggregator with the given metrics registered as
+// they are in a, without their windows. Names that are not registered are
+// skipped.
+func (a *Aggregator) Fork(names []string) *Aggregator {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	f := New()
+	f.now = a.now
+	for _, name := range names {
+		m, ok := a.metrics[name]
+		if !ok {
+			continue
+		}
+		fm := &metric{
+			typ:         m.typ,
+			labelNames:  m.labelNames,
+			maxSeries:   m.maxSeries,
+			quantiles:   m.quantiles,
+			countKey:    m.countKey,
+			approximate: m.approximate,
+			seriesTTL:   m.seriesTTL,
+			series:      make(map[string]*series),
+		}
+		if !fm.labeled() {
+			fm.series[""] = &series{value: fm.newValue()}
+		}
+		f.metrics[name] = fm
+	}
+	return f
+}
+
+// Unregister removes a metric and its series. Observations of a metric
+// that is not registered are ignored. It reports whether the metric was
+// registered.
+func (a *Aggregator) Unregister(name string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, exists := a.metrics[name]; !exists {
+		return false
+	}
+	delete(a.metrics, name)
+	return true
+}
+
+// Prune unregisters every metric for which keep returns false, such as
+// metrics removed from the configuration, and returns their names sorted.
+func (a *Aggregator) Prune(keep func(name string) bool) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var removed []string
+	for name := range a.metrics {
+		if !keep(name) {
+			delete(a.metrics, name)
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// newValue creates an empty value for a series of the metric.
+func (m *metric) newValue() *MetricValue {
+	mv := &MetricValue{Type: m.typ, approximate: m.approximate}
+	switch m.typ {
+	case Set:
 		mv.Set = make(map[string]struct{})
+	case Percentile:
+		mv.Sketch = NewSketch()
+	case CounterBy:
+		mv.Counts = make(map[string]float64)
 	}
-	a.metrics[name] = mv
+	return mv
+}
+
+// labeled reports whether the metric has labels.
+func (m *metric) labeled() bool {
+	return len(m.labelNames) > 0
+}
+
+// get returns the series for the given label values, creating it if needed.
+// Returns nil if the metric is not of the expected type.
+// Must be called with the aggregator lock held.
+func (a *Aggregator) get(name string, metricType MetricType, labelValues []string) *MetricValue {
+	m, ok := a.metrics[name]
+	if !ok || m.typ != metricType {
+		return nil
+	}
+	now := a.now()
+	m.roll(now)
+
+	if !m.labeled() {
+		return m.series[""].value
+	}
+
+	values := normalizeLabelValues(labelValues, len(m.labelNames))
+	key := seriesKey(values)
+	if s, ok := m.series[key]; ok {
+		s.updated = now
+		return s.value
+	}
+
+	if len(m.series) >= m.maxSeries {
+		m.overflowed = true
+		values = make([]string, len(m.labelNames))
+		for i := range values {
+			values[i] = OverflowLabelValue
+		}
+		key = seriesKey(values)
+		if s, ok := m.series[key]; ok {
+			s.updated = now
+			return s.value
+		}
+	}
+
+	s := &series{labelValues: values, value: m.newValue(), updated: now}
+	m.series[key] = s
+	return s.value
+}
+
+// normalizeLabelValues pads or truncates values to n entries.
+func normalizeLabelValues(values []string, n int) []string {
+	out := make([]string, n)
+	copy(out, values)
+	return out
+}
+
+// seriesKey builds the map key for a label value combination.
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
 }
 
 // Inc increments a counter metric by 1.
 func (a *Aggregator) Inc(name string) {
+	a.IncLabeled(name, nil)
+}
+
+// IncLabeled increments the series of a counter metric identified by
+// labelValues (in the order the labels were registered).
+func (a *Aggregator) IncLabeled(name string, labelValues []string) {
+	a.IncByLabeled(name, labelValues, 1)
+}
+
+// IncByLabeled increments the series of a counter metric by n, e.g. the
+// number of lines a sampled line stands for.
+func (a *Aggregator) IncByLabeled(name string, labelValues []string, n float64) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	if m, ok := a.metrics[name]; ok && m.Type == Counter {
-		m.Value++
+	if mv := a.get(name, Counter, labelValues); mv != nil {
+		mv.Value += n
 	}
 }
 
 // SetGauge sets the value of a gauge metric.
 func (a *Aggregator) SetGauge(name string, value float64) {
+	a.SetGaugeLabeled(name, nil, value)
+}
+
+// SetGaugeLabeled sets the value of a gauge series.
+func (a *Aggregator) SetGaugeLabeled(name string, labelValues []string, value float64) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	if m, ok := a.metrics[name]; ok && m.Type == Gauge {
-		m.Value = value
+	if mv := a.get(name, Gauge, labelValues); mv != nil {
+		mv.Value = value
 	}
 }
 
 // Add adds a value to a sum metric.
 func (a *Aggregator) Add(name string, value float64) {
+	a.AddLabeled(name, nil, value)
+}
+
+// AddLabeled adds a value to a sum series.
+func (a *Aggregator) AddLabeled(name string, labelValues []string, value float64) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	if m, ok := a.metrics[name]; ok && m.Type == Sum {
-		m.Value += value
+	if mv := a.get(name, Sum, labelValues); mv != nil {
+		mv.Value += value
 	}
 }
 
 // AddToSet adds a value to a set metric.
 func (a *Aggregator) AddToSet(name string, value string) {
+	a.AddToSetLabeled(name, nil, value)
+}
+
+// AddToSetLabeled adds a value to a set series.
+func (a *Aggregator) AddToSetLabeled(name string, labelValues []string, value string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if mv := a.get(name, Set, labelValues); mv != nil {
+		mv.addToSet(value)
+	}
+}
+
+// SetCountKey names the field whose values a counter_by metric counts.
+func (a *Aggregator) SetCountKey(name, key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if m, ok := a.metrics[name]; ok && m.typ == CounterBy {
+		m.countKey = key
+	}
+}
+
+// CountLabeled counts an observation of value, weighted by n, in a series
+// of a counter_by metric. Once the series holds as many values as the
+// metric's series cap, further values are counted as OverflowLabelValue.
+func (a *Aggregator) CountLabeled(name string, labelValues []string, value string, n float64) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	if m, ok := a.metrics[name]; ok && m.Type == Set {
-		m.Set[value] = struct{}{}
+	mv := a.get(name, CounterBy, labelValues)
+	if mv == nil {
+		return
+	}
+	if _, ok := mv.Counts[value]; !ok {
+		if m := a.metrics[name]; len(mv.Counts) >= m.maxSeries {
+			m.overflowed = true
+			value = OverflowLabelValue
+		}
 	}
+	mv.Counts[value] += n
 }
 
-// Snapshot returns the current metrics and resets counters, sums, and sets.
-// Gauges are not reset.
+// SetQuantiles sets the quantiles exported for a percentile metric.
+func (a *Aggregator) SetQuantiles(name string, quantiles []float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if m, ok := a.metrics[name]; ok && m.typ == Percentile {
+		m.quantiles = quantiles
+	}
+}
+
+// SetSeriesTTL drops the series of a labeled gauge metric that were not
+// updated for ttl at the next snapshot. A ttl of 0 keeps them.
+func (a *Aggregator) SetSeriesTTL(name string, ttl time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if m, ok := a.metrics[name]; ok && m.typ == Gauge {
+		m.seriesTTL = ttl
+	}
+}
+
+// SetApproximate makes a set metric count unique values approximately,
+// with bounded memory, once a series holds many of them.
+func (a *Aggregator) SetApproximate(name string, approximate bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if m, ok := a.metrics[name]; ok && m.typ == Set {
+		m.approximate = approximate
+		for _, s := range m.series {
+			s.value.approximate = approximate
+		}
+	}
+}
+
+// Observe records a value of a percentile metric.
+func (a *Aggregator) Observe(name string, value float64) {
+	a.ObserveLabeled(name, nil, value)
+}
+
+// ObserveLabeled records a value of a percentile series.
+func (a *Aggregator) ObserveLabeled(name string, labelValues []string, value float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if mv := a.get(name, Percentile, labelValues); mv != nil {
+		mv.Sketch.Add(value)
+	}
+}
+
+// Snapshot returns the current metrics and resets counters, sums, sets and
+// percentiles. Gauges are not reset, except for the series of a labeled
+// gauge not updated within its series TTL, nor sets with a window until it
+// rolls over.
+//
+// Unlabeled metrics map to their value (float64, int for sets, a
+// Distribution for percentiles, or Counts for counter_by metrics).
+// Labeled metrics map to a []Series sorted by label values.
 func (a *Aggregator) Snapshot() map[string]interface{} {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
 	result := make(map[string]interface{})
 
+	now := a.now()
 	for name, m := range a.metrics {
-		switch m.Type {
-		case Counter:
-			result[name] = m.Value
-			m.Value = 0 // Reset
-		case Gauge:
-			result[name] = m.Value
-			// No reset for gauges
-		case Sum:
-			result[name] = m.Value
-			m.Value = 0 // Reset
-		case Set:
-			result[name] = len(m.Set)
-			m.Set = make(map[string]struct{}) // Reset
-		}
+		m.roll(now)
+		result[name] = m.export()
+		m.reset(now)
 	}
 
 	return result
@@ -130,12 +569,7 @@ func (a *Aggregator) Peek() map[string]interface{} {
 	result := make(map[string]interface{})
 
 	for name, m := range a.metrics {
-		switch m.Type {
-		case Counter, Gauge, Sum:
-			result[name] = m.Value
-		case Set:
-			result[name] = len(m.Set)
-		}
+		result[name] = m.export()
 	}
 
 	return result
@@ -147,11 +581,111 @@ func (a *Aggregator) Reset() {
 	defer a.mu.Unlock()
 
 	for _, m := range a.metrics {
-		m.Value = 0
-		if m.Type == Set {
-			m.Set = make(map[string]struct{})
+		m.clear()
+	}
+}
+
+// export returns the metric's exported value.
+// Must be called with the aggregator lock held.
+func (m *metric) export() interface{} {
+	if !m.labeled() {
+		return m.exportValue(m.series[""].value)
+	}
+
+	keys := m.seriesKeys()
+	result := make([]Series, 0, len(keys))
+	for _, key := range keys {
+		s := m.series[key]
+		labels := make(map[string]string, len(m.labelNames))
+		for i, labelName := range m.labelNames {
+			labels[labelName] = s.labelValues[i]
 		}
+		result = append(result, Series{Labels: labels, Value: m.exportValue(s.value)})
 	}
+	return result
+}
+
+// seriesKeys returns the keys of the metric's series, sorted.
+func (m *metric) seriesKeys() []string {
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// reset clears the metric after a snapshot. Gauges and windowed sets are
+// kept, but for the gauge series that expired at now.
+// Must be called with the aggregator lock held.
+func (m *metric) reset(now time.Time) {
+	if m.typ == Gauge || m.window != "" {
+		m.overflowed = false
+		m.expire(now)
+		return
+	}
+	m.clear()
+}
+
+// expire drops the series of a labeled gauge not updated within its
+// series TTL, so that they stop being reported and free their place under
+// maxSeries.
+// Must be called with the aggregator lock held.
+func (m *metric) expire(now time.Time) {
+	if m.typ != Gauge || !m.labeled() || m.seriesTTL <= 0 {
+		return
+	}
+	for key, s := range m.series {
+		if now.Sub(s.updated) >= m.seriesTTL {
+			delete(m.series, key)
+		}
+	}
+}
+
+// clear drops the values of all series.
+// Must be called with the aggregator lock held.
+func (m *metric) clear() {
+	m.overflowed = false
+	if m.labeled() {
+		m.series = make(map[string]*series)
+		return
+	}
+	m.series[""].value = m.newValue()
+}
+
+// exportValue converts a series value into its snapshot representation.
+func (m *metric) exportValue(mv *MetricValue) interface{} {
+	switch mv.Type {
+	case Set:
+		if mv.HLL != nil {
+			return int(mv.HLL.Count())
+		}
+		return len(mv.Set)
+	case Percentile:
+		return m.distribution(mv.Sketch)
+	case CounterBy:
+		values := make(map[string]float64, len(mv.Counts))
+		for v, n := range mv.Counts {
+			values[v] = n
+		}
+		return Counts{Key: m.countKey, Values: values}
+	default:
+		return mv.Value
+	}
+}
+
+// distribution exports the quantiles of a percentile series.
+func (m *metric) distribution(s *Sketch) Distribution {
+	quantiles := m.quantiles
+	if len(quantiles) == 0 {
+		quantiles = DefaultQuantiles
+	}
+
+	d := Distribution{"count": float64(s.Count()), "sum": s.Sum()}
+	for i, v := range s.Quantiles(quantiles) {
+		d[QuantileName(quantiles[i])] = v
+	}
+	return d
 }
 
 // GetMetricType returns the type of a metric.
@@ -160,7 +694,45 @@ func (a *Aggregator) GetMetricType(name string) (MetricType, bool) {
 	defer a.mu.RUnlock()
 
 	if m, ok := a.metrics[name]; ok {
-		return m.Type, true
+		return m.typ, true
 	}
 	return "", false
 }
+
+// GetMetricLabels returns the label names of a metric.
+func (a *Aggregator) GetMetricLabels(name string) ([]string, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if m, ok := a.metrics[name]; ok {
+		return m.labelNames, true
+	}
+	return nil, false
+}
+
+// GetMetricMaxSeries returns the cardinality cap of a metric.
+func (a *Aggregator) GetMetricMaxSeries(name string) (int, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if m, ok := a.metrics[name]; ok {
+		return m.maxSeries, true
+	}
+	return 0, false
+}
+
+// Overflowed returns the names of labeled and counter_by metrics that
+// reached their cardinality cap since the last snapshot.
+func (a *Aggregator) Overflowed() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	var names []string
+	for name, m := range a.metrics {
+		if m.overflowed {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
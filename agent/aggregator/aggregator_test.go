@@ -3,8 +3,13 @@
 package aggregator
 
 import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestCounter(t *testing.T) {
@@ -19,6 +24,11 @@ func TestCounter(t *testing.T) {
 	if v := metrics["requests"].(float64); v != 3 {
 		t.Errorf("requests = %v, want 3", v)
 	}
+
+	a.IncByLabeled("requests", nil, 10)
+	if v := a.Peek()["requests"].(float64); v != 13 {
+		t.Errorf("requests after IncByLabeled = %v, want 13", v)
+	}
 }
 
 func TestCounterReset(t *testing.T) {
@@ -320,3 +330,308 @@ func TestRegisterTwice(t *testing.T) {
 		t.Errorf("metric = %v, want 1", v)
 	}
 }
+
+func TestUnregister(t *testing.T) {
+	a := New()
+	a.Register("kept", Counter)
+	a.Register("removed", Counter)
+	a.RegisterLabeled("pruned", Set, []string{"host"}, 0)
+	a.AddToSetLabeled("pruned", []string{"a"}, "x")
+
+	if !a.Unregister("removed") || a.Unregister("removed") {
+		t.Error("Unregister() should report whether the metric was registered")
+	}
+	a.Inc("removed") // ignored
+
+	if got := a.Prune(func(name string) bool { return name == "kept" }); len(got) != 1 || got[0] != "pruned" {
+		t.Errorf("Prune() = %v, want [pruned]", got)
+	}
+
+	metrics := a.Peek()
+	if len(metrics) != 1 || metrics["kept"] == nil {
+		t.Errorf("metrics = %v, want only kept", metrics)
+	}
+
+	// A removed metric can be registered again, with another type
+	a.Register("removed", Gauge)
+	if typ, _ := a.GetMetricType("removed"); typ != Gauge {
+		t.Errorf("type = %v, want gauge", typ)
+	}
+}
+
+func TestLabeledCounter(t *testing.T) {
+	a := New()
+	a.RegisterLabeled("http_requests", Counter, []string{"method", "status"}, 0)
+
+	a.IncLabeled("http_requests", []string{"GET", "200"})
+	a.IncLabeled("http_requests", []string{"GET", "200"})
+	a.IncLabeled("http_requests", []string{"POST", "500"})
+
+	series := a.Peek()["http_requests"].([]Series)
+	if len(series) != 2 {
+		t.Fatalf("len(series) = %d, want 2", len(series))
+	}
+
+	if series[0].Labels["method"] != "GET" || series[0].Labels["status"] != "200" {
+		t.Errorf("series[0].Labels = %v, want GET/200", series[0].Labels)
+	}
+	if v := series[0].Value.(float64); v != 2 {
+		t.Errorf("series[0].Value = %v, want 2", v)
+	}
+	if v := series[1].Value.(float64); v != 1 {
+		t.Errorf("series[1].Value = %v, want 1", v)
+	}
+
+	// Snapshot drops all series
+	a.Snapshot()
+	if series := a.Peek()["http_requests"].([]Series); len(series) != 0 {
+		t.Errorf("after snapshot len(series) = %d, want 0", len(series))
+	}
+}
+
+func TestLabeledSet(t *testing.T) {
+	a := New()
+	a.RegisterLabeled("users", Set, []string{"country"}, 0)
+
+	a.AddToSetLabeled("users", []string{"fr"}, "alice")
+	a.AddToSetLabeled("users", []string{"fr"}, "bob")
+	a.AddToSetLabeled("users", []string{"de"}, "alice")
+
+	series := a.Peek()["users"].([]Series)
+	if len(series) != 2 {
+		t.Fatalf("len(series) = %d, want 2", len(series))
+	}
+
+	// Sorted by label values: de, fr
+	if v := series[1].Value.(int); v != 2 {
+		t.Errorf("fr users = %v, want 2", v)
+	}
+}
+
+func TestLabeledCardinalityCap(t *testing.T) {
+	a := New()
+	a.RegisterLabeled("by_path", Counter, []string{"path"}, 2)
+
+	for _, path := range []string{"/a", "/b", "/c", "/d", "/a"} {
+		a.IncLabeled("by_path", []string{path})
+	}
+
+	if names := a.Overflowed(); len(names) != 1 || names[0] != "by_path" {
+		t.Errorf("Overflowed() = %v, want [by_path]", names)
+	}
+
+	series := a.Snapshot()["by_path"].([]Series)
+	if len(series) != 3 {
+		t.Fatalf("len(series) = %d, want 3 (2 + overflow)", len(series))
+	}
+
+	var total float64
+	var overflow float64
+	for _, s := range series {
+		total += s.Value.(float64)
+		if s.Labels["path"] == OverflowLabelValue {
+			overflow = s.Value.(float64)
+		}
+	}
+
+	if total != 5 {
+		t.Errorf("total = %v, want 5", total)
+	}
+	if overflow != 2 {
+		t.Errorf("overflow = %v, want 2", overflow)
+	}
+
+	if names := a.Overflowed(); len(names) != 0 {
+		t.Errorf("Overflowed() after snapshot = %v, want none", names)
+	}
+}
+
+func TestLabeledGaugeNoReset(t *testing.T) {
+	a := New()
+	a.RegisterLabeled("queue_depth", Gauge, []string{"queue"}, 0)
+
+	a.SetGaugeLabeled("queue_depth", []string{"mail"}, 7)
+	a.Snapshot()
+
+	series := a.Peek()["queue_depth"].([]Series)
+	if len(series) != 1 || series[0].Value.(float64) != 7 {
+		t.Errorf("after snapshot series = %v, want mail=7", series)
+	}
+}
+
+func TestLabeledGaugeSeriesTTL(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := New()
+	a.now = func() time.Time { return now }
+	a.RegisterLabeled("queue_depth", Gauge, []string{"queue"}, 2)
+	a.SetSeriesTTL("queue_depth", time.Hour)
+
+	a.SetGaugeLabeled("queue_depth", []string{"mail"}, 7)
+	a.SetGaugeLabeled("queue_depth", []string{"jobs"}, 3)
+	now = now.Add(30 * time.Minute)
+	a.SetGaugeLabeled("queue_depth", []string{"jobs"}, 4)
+
+	// The series is reported once more in the snapshot it expires at
+	now = now.Add(30 * time.Minute)
+	if series := a.Snapshot()["queue_depth"].([]Series); len(series) != 2 {
+		t.Errorf("snapshot series = %v, want jobs and mail", series)
+	}
+	series := a.Peek()["queue_depth"].([]Series)
+	if len(series) != 1 || series[0].Labels["queue"] != "jobs" {
+		t.Errorf("after expiry series = %v, want jobs=4", series)
+	}
+
+	// The expired series frees its place under maxSeries
+	a.SetGaugeLabeled("queue_depth", []string{"backup"}, 1)
+	for _, s := range a.Peek()["queue_depth"].([]Series) {
+		if s.Labels["queue"] == OverflowLabelValue {
+			t.Errorf("series = %v, want no overflow", s)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	a := New()
+	a.RegisterLabeled("latency", Percentile, []string{"method"}, 0)
+	a.SetQuantiles("latency", []float64{0.5, 0.9})
+
+	for i := 1; i <= 100; i++ {
+		a.ObserveLabeled("latency", []string{"GET"}, float64(i))
+	}
+
+	series := a.Snapshot()["latency"].([]Series)
+	if len(series) != 1 {
+		t.Fatalf("series = %v, want one", series)
+	}
+	d := series[0].Value.(Distribution)
+	if d["count"] != 100 || d["sum"] != 5050 {
+		t.Errorf("count = %v, sum = %v, want 100 and 5050", d["count"], d["sum"])
+	}
+	if p := d["p50"]; p < 49.5 || p > 51 {
+		t.Errorf("p50 = %v, want ~50", p)
+	}
+	if p := d["p90"]; p < 89 || p > 91 {
+		t.Errorf("p90 = %v, want ~90", p)
+	}
+	if _, ok := d["p99"]; ok {
+		t.Error("p99 exported although not configured")
+	}
+
+	a.Register("empty", Percentile)
+	d = a.Snapshot()["empty"].(Distribution)
+	if len(d) != 2 || d["count"] != 0 {
+		t.Errorf("empty distribution = %v, want count and sum only", d)
+	}
+}
+
+func TestCounterBy(t *testing.T) {
+	a := New()
+	a.RegisterLabeled("requests_by_path", CounterBy, nil, 2)
+	a.SetCountKey("requests_by_path", "path")
+
+	for _, path := range []string{"/a", "/b", "/a", "/c", "/d"} {
+		a.CountLabeled("requests_by_path", nil, path, 1)
+	}
+	a.CountLabeled("requests_by_path", nil, "/b", 10)
+
+	c := a.Snapshot()["requests_by_path"].(Counts)
+	want := map[string]float64{"/a": 2, "/b": 11, OverflowLabelValue: 2}
+	if c.Key != "path" || !reflect.DeepEqual(c.Values, want) {
+		t.Errorf("counts = %+v, want path %v", c, want)
+	}
+	if c.Total() != 15 {
+		t.Errorf("Total() = %v, want 15", c.Total())
+	}
+	if data, _ := json.Marshal(c); string(data) != `{"/a":2,"/b":11,"__overflow__":2}` {
+		t.Errorf("JSON = %s, want the map of values", data)
+	}
+	if len(a.Snapshot()["requests_by_path"].(Counts).Values) != 0 {
+		t.Error("counts not reset by the snapshot")
+	}
+
+	a.RegisterLabeled("status_by_method", CounterBy, []string{"method"}, 0)
+	a.SetCountKey("status_by_method", "status")
+	a.CountLabeled("status_by_method", []string{"GET"}, "200", 3)
+	a.CountLabeled("status_by_method", []string{"GET"}, "500", 1)
+
+	got := Flatten(a.Peek()["status_by_method"].([]Series))
+	wantSeries := []Series{
+		{Labels: map[string]string{"method": "GET", "status": "200"}, Value: 3.0},
+		{Labels: map[string]string{"method": "GET", "status": "500"}, Value: 1.0},
+	}
+	if !reflect.DeepEqual(got, wantSeries) {
+		t.Errorf("Flatten() = %v, want %v", got, wantSeries)
+	}
+}
+
+func TestSeriesOf(t *testing.T) {
+	counts := Counts{Key: "status", Values: map[string]float64{"200": 3, "500": 1}}
+	tests := []struct {
+		name  string
+		value interface{}
+		want  []Series
+	}{
+		{"number", 2.5, []Series{{Value: 2.5}}},
+		{"nil", nil, nil},
+		{"counts", counts, []Series{
+			{Labels: map[string]string{"status": "200"}, Value: 3.0},
+			{Labels: map[string]string{"status": "500"}, Value: 1.0},
+		}},
+		{"labeled counts", []Series{{Labels: map[string]string{"method": "GET"}, Value: counts}}, []Series{
+			{Labels: map[string]string{"method": "GET", "status": "200"}, Value: 3.0},
+			{Labels: map[string]string{"method": "GET", "status": "500"}, Value: 1.0},
+		}},
+	}
+	for _, tt := range tests {
+		if got := SeriesOf(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: SeriesOf() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFloat(t *testing.T) {
+	tests := []struct {
+		value  interface{}
+		want   float64
+		wantOK bool
+	}{
+		{1.5, 1.5, true},
+		{3, 3, true},
+		{int64(4), 4, true},
+		{"5", 0, false},
+		{math.Inf(1), math.Inf(1), false},
+	}
+	for _, tt := range tests {
+		got, ok := Float(tt.value)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("Float(%v) = %v, %v; want %v, %v", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestApproximateSet(t *testing.T) {
+	a := New()
+	a.Register("ips", Set)
+	a.SetApproximate("ips", true)
+
+	for i := 0; i < hllExactLimit; i++ {
+		a.AddToSet("ips", strconv.Itoa(i))
+	}
+	if v := a.Peek()["ips"].(int); v != hllExactLimit {
+		t.Errorf("small set = %d, want exact %d", v, hllExactLimit)
+	}
+
+	for i := 0; i < 100000; i++ {
+		a.AddToSet("ips", strconv.Itoa(i))
+	}
+	v := a.Snapshot()["ips"].(int)
+	if v < 97000 || v > 103000 {
+		t.Errorf("large set = %d, want ~100000", v)
+	}
+
+	// The snapshot starts a new exact set
+	a.AddToSet("ips", "a")
+	if v := a.Peek()["ips"].(int); v != 1 {
+		t.Errorf("after snapshot = %d, want 1", v)
+	}
+}
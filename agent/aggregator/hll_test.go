@@ -0,0 +1,25 @@
+// SPDX-License-Identifier: MIT
+
+package aggregator
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLog_Count(t *testing.T) {
+	for _, n := range []int{0, 10, 1000, 50000, 500000} {
+		h := NewHyperLogLog()
+		for i := 0; i < n; i++ {
+			v := "10.0." + strconv.Itoa(i)
+			h.Add(v)
+			h.Add(v) // duplicates are not counted
+		}
+
+		got := float64(h.Count())
+		if math.Abs(got-float64(n)) > float64(n)*0.03 {
+			t.Errorf("Count() = %v, want %d ±3%%", got, n)
+		}
+	}
+}
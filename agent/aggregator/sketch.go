@@ -0,0 +1,169 @@
+// SPDX-License-Identifier: MIT
+
+package aggregator
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// SketchAccuracy is the relative accuracy of quantile estimates: an
+// estimate is within 1% of the true value.
+const SketchAccuracy = 0.01
+
+// sketchMaxBins caps the number of buckets of each sign. Once exceeded, the
+// buckets closest to zero are merged until an eighth of them is left free,
+// which only degrades the accuracy of the lowest quantiles.
+const sketchMaxBins = 2048
+
+// sketchMinValue is the smallest magnitude tracked; smaller values are
+// counted as zero.
+const sketchMinValue = 1e-9
+
+var (
+	sketchGamma    = (1 + SketchAccuracy) / (1 - SketchAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+// Sketch is a streaming quantile sketch (DDSketch). Values are counted in
+// logarithmically sized buckets, so its size does not depend on the number
+// of values and quantile estimates have a bounded relative error.
+type Sketch struct {
+	positive map[int]uint64
+	negative map[int]uint64
+	zero     uint64
+	count    uint64
+	sum      float64
+	min, max float64
+}
+
+// NewSketch creates an empty sketch.
+func NewSketch() *Sketch {
+	return &Sketch{
+		positive: make(map[int]uint64),
+		negative: make(map[int]uint64),
+	}
+}
+
+// Add records a value. NaN values are ignored.
+func (s *Sketch) Add(v float64) {
+	if math.IsNaN(v) {
+		return
+	}
+
+	switch {
+	case v >= sketchMinValue:
+		addBin(s.positive, sketchIndex(v))
+	case v <= -sketchMinValue:
+		addBin(s.negative, sketchIndex(-v))
+	default:
+		s.zero++
+	}
+
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	s.count++
+	s.sum += v
+}
+
+// Count returns the number of values recorded.
+func (s *Sketch) Count() uint64 {
+	return s.count
+}
+
+// Sum returns the sum of the values recorded.
+func (s *Sketch) Sum() float64 {
+	return s.sum
+}
+
+// Quantiles returns an estimate of each quantile (between 0 and 1), or nil
+// if the sketch is empty.
+func (s *Sketch) Quantiles(qs []float64) []float64 {
+	if s.count == 0 {
+		return nil
+	}
+
+	// Buckets in ascending order of value: negative buckets from the
+	// largest magnitude, then zero, then positive buckets.
+	type bucket struct {
+		value float64
+		count uint64
+	}
+	buckets := make([]bucket, 0, len(s.negative)+len(s.positive)+1)
+	for _, i := range sortedBins(s.negative) {
+		buckets = append(buckets, bucket{-sketchValue(i), s.negative[i]})
+	}
+	for l, r := 0, len(buckets)-1; l < r; l, r = l+1, r-1 {
+		buckets[l], buckets[r] = buckets[r], buckets[l]
+	}
+	if s.zero > 0 {
+		buckets = append(buckets, bucket{0, s.zero})
+	}
+	for _, i := range sortedBins(s.positive) {
+		buckets = append(buckets, bucket{sketchValue(i), s.positive[i]})
+	}
+
+	result := make([]float64, len(qs))
+	for n, q := range qs {
+		rank := q * float64(s.count-1)
+		var seen uint64
+		value := s.max
+		for _, b := range buckets {
+			seen += b.count
+			if float64(seen) > rank {
+				value = b.value
+				break
+			}
+		}
+		result[n] = math.Min(math.Max(value, s.min), s.max)
+	}
+	return result
+}
+
+// QuantileName returns the name under which a quantile is exported,
+// e.g. "p99" for 0.99 or "p99.9" for 0.999.
+func QuantileName(q float64) string {
+	return "p" + strconv.FormatFloat(math.Round(q*1e6)/1e4, 'f', -1, 64)
+}
+
+// sketchIndex returns the bucket of a positive value: bucket i holds the
+// values in (gamma^(i-1), gamma^i].
+func sketchIndex(v float64) int {
+	return int(math.Ceil(math.Log(v) / sketchLogGamma))
+}
+
+// sketchValue returns the value representing bucket i, whose relative
+// distance to any value of the bucket is at most SketchAccuracy.
+func sketchValue(i int) float64 {
+	return 2 * math.Pow(sketchGamma, float64(i)) / (sketchGamma + 1)
+}
+
+// addBin increments a bucket, merging the lowest buckets when there are
+// too many.
+func addBin(bins map[int]uint64, i int) {
+	bins[i]++
+	if len(bins) <= sketchMaxBins {
+		return
+	}
+	keys := sortedBins(bins)
+	merged := len(keys) - sketchMaxBins + sketchMaxBins/8
+	for _, k := range keys[:merged] {
+		bins[keys[merged]] += bins[k]
+		delete(bins, k)
+	}
+}
+
+// sortedBins returns the bucket indexes in ascending order.
+func sortedBins(bins map[int]uint64) []int {
+	keys := make([]int, 0, len(bins))
+	for i := range bins {
+		keys = append(keys, i)
+	}
+	sort.Ints(keys)
+	return keys
+}
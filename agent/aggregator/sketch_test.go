@@ -0,0 +1,76 @@
+// SPDX-License-Identifier: MIT
+
+package aggregator
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestSketch_Accuracy(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	s := NewSketch()
+
+	values := make([]float64, 100000)
+	for i := range values {
+		values[i] = math.Exp(r.NormFloat64()*2) * 100 // log-normal latencies
+		s.Add(values[i])
+	}
+	sort.Float64s(values)
+
+	qs := []float64{0, 0.5, 0.95, 0.99, 1}
+	got := s.Quantiles(qs)
+	for i, q := range qs {
+		want := values[int(q*float64(len(values)-1))]
+		if math.Abs(got[i]-want) > want*SketchAccuracy {
+			t.Errorf("q%v = %v, want %v ±1%%", q, got[i], want)
+		}
+	}
+
+	if s.Count() != uint64(len(values)) {
+		t.Errorf("Count() = %d, want %d", s.Count(), len(values))
+	}
+}
+
+func TestSketch_SignsAndZero(t *testing.T) {
+	s := NewSketch()
+	for _, v := range []float64{-10, -1, 0, 0, 1, 10, math.NaN()} {
+		s.Add(v)
+	}
+
+	got := s.Quantiles([]float64{0, 0.5, 1})
+	if got[0] != -10 || got[1] != 0 || got[2] != 10 {
+		t.Errorf("Quantiles() = %v, want [-10 0 10]", got)
+	}
+	if s.Count() != 6 || s.Sum() != 0 {
+		t.Errorf("Count() = %d, Sum() = %v, want 6 and 0", s.Count(), s.Sum())
+	}
+
+	if got := NewSketch().Quantiles([]float64{0.5}); got != nil {
+		t.Errorf("empty Quantiles() = %v, want nil", got)
+	}
+}
+
+func TestSketch_MaxBins(t *testing.T) {
+	s := NewSketch()
+	for i := 0; i < 10000; i++ {
+		s.Add(math.Pow(1.05, float64(i%5000)))
+	}
+	if len(s.positive) > sketchMaxBins {
+		t.Errorf("bins = %d, want at most %d", len(s.positive), sketchMaxBins)
+	}
+	if got := s.Quantiles([]float64{1}); math.Abs(got[0]-s.max) > s.max*SketchAccuracy {
+		t.Errorf("max = %v, want %v ±1%%", got[0], s.max)
+	}
+}
+
+func TestQuantileName(t *testing.T) {
+	tests := map[float64]string{0.5: "p50", 0.99: "p99", 0.999: "p99.9", 0: "p0", 1: "p100"}
+	for q, want := range tests {
+		if got := QuantileName(q); got != want {
+			t.Errorf("QuantileName(%v) = %q, want %q", q, got, want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: MIT
+
+package aggregator
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Window is a calendar period over which a set metric keeps its values
+// across snapshots, e.g. to count daily unique users. Windows follow the
+// local time; weeks start on Monday.
+type Window string
+
+const (
+	WindowHour  Window = "hour"
+	WindowDay   Window = "day"
+	WindowWeek  Window = "week"
+	WindowMonth Window = "month"
+)
+
+// Start returns the start of the window containing t.
+func (w Window) Start(t time.Time) time.Time {
+	y, mo, d := t.Date()
+	switch w {
+	case WindowHour:
+		return time.Date(y, mo, d, t.Hour(), 0, 0, 0, t.Location())
+	case WindowDay:
+		return time.Date(y, mo, d, 0, 0, 0, 0, t.Location())
+	case WindowWeek:
+		offset := (int(t.Weekday()) + 6) % 7 // days since Monday
+		return time.Date(y, mo, d-offset, 0, 0, 0, 0, t.Location())
+	case WindowMonth:
+		return time.Date(y, mo, 1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Time{}
+}
+
+// SetWindow makes a set metric keep its values across snapshots until the
+// window rolls over. An empty window resets the set at every snapshot.
+func (a *Aggregator) SetWindow(name string, w Window) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if m, ok := a.metrics[name]; ok && m.typ == Set && m.window != w {
+		m.window = w
+		m.windowStart = w.Start(a.now())
+	}
+}
+
+// WindowStart returns the start of the current window of a set metric
+// with a window.
+func (a *Aggregator) WindowStart(name string) (time.Time, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if m, ok := a.metrics[name]; ok && m.window != "" {
+		return m.windowStart, true
+	}
+	return time.Time{}, false
+}
+
+// roll clears a windowed metric once its window has rolled over.
+// Must be called with the aggregator lock held.
+func (m *metric) roll(now time.Time) {
+	if m.window == "" {
+		return
+	}
+	if start := m.window.Start(now); !start.Equal(m.windowStart) {
+		m.windowStart = start
+		m.clear()
+	}
+}
+
+// WindowedSet is the saved state of a set metric with a window.
+type WindowedSet struct {
+	Start  time.Time        `json:"start"`
+	Series []WindowedSeries `json:"series"`
+}
+
+// WindowedSeries is the saved state of one series of a windowed set:
+// its exact values, or the registers of its HyperLogLog.
+type WindowedSeries struct {
+	Labels []string `json:"labels,omitempty"`
+	Values []string `json:"values,omitempty"`
+	HLL    []byte   `json:"hll,omitempty"`
+}
+
+// SaveWindows returns the state of the windowed set metrics, by name.
+func (a *Aggregator) SaveWindows() map[string]WindowedSet {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	saved := make(map[string]WindowedSet)
+	for name, m := range a.metrics {
+		if m.window == "" {
+			continue
+		}
+		m.roll(a.now())
+
+		ws := WindowedSet{Start: m.windowStart}
+		for _, key := range m.seriesKeys() {
+			s := m.series[key]
+			entry := WindowedSeries{Labels: s.labelValues}
+			if s.value.HLL != nil {
+				entry.HLL = append([]byte(nil), s.value.HLL.registers[:]...)
+			} else {
+				for v := range s.value.Set {
+					entry.Values = append(entry.Values, v)
+				}
+				sort.Strings(entry.Values)
+			}
+			ws.Series = append(ws.Series, entry)
+		}
+		saved[name] = ws
+	}
+	return saved
+}
+
+// RestoreWindows restores the state of windowed set metrics saved with
+// SaveWindows, e.g. by a previous run. Saved windows that have rolled over
+// since, and metrics that are no longer windowed sets, are ignored.
+func (a *Aggregator) RestoreWindows(saved map[string]WindowedSet) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for name, ws := range saved {
+		m, ok := a.metrics[name]
+		if !ok || m.window == "" {
+			continue
+		}
+		m.roll(a.now())
+		if !ws.Start.Equal(m.windowStart) {
+			continue
+		}
+
+		for _, entry := range ws.Series {
+			if len(entry.Labels) != len(m.labelNames) {
+				continue // the labels of the metric changed
+			}
+			mv := a.get(name, Set, entry.Labels)
+			if mv == nil {
+				continue
+			}
+			if entry.HLL != nil {
+				if len(entry.HLL) != hllRegisters {
+					return fmt.Errorf("metric %s: invalid HyperLogLog of %d registers", name, len(entry.HLL))
+				}
+				if mv.HLL == nil {
+					mv.HLL = NewHyperLogLog()
+					for v := range mv.Set {
+						mv.HLL.Add(v)
+					}
+					mv.Set = nil
+				}
+				mv.HLL.merge(entry.HLL)
+				continue
+			}
+			for _, v := range entry.Values {
+				mv.addToSet(v)
+			}
+		}
+	}
+	return nil
+}
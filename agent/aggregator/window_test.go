@@ -0,0 +1,130 @@
+// SPDX-License-Identifier: MIT
+
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWindow_Start(t *testing.T) {
+	at := time.Date(2024, 3, 14, 15, 9, 26, 0, time.UTC) // a Thursday
+	tests := []struct {
+		window Window
+		want   time.Time
+	}{
+		{WindowHour, time.Date(2024, 3, 14, 15, 0, 0, 0, time.UTC)},
+		{WindowDay, time.Date(2024, 3, 14, 0, 0, 0, 0, time.UTC)},
+		{WindowWeek, time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{WindowMonth, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := tt.window.Start(at); !got.Equal(tt.want) {
+			t.Errorf("%s: Start() = %v, want %v", tt.window, got, tt.want)
+		}
+	}
+	sunday := time.Date(2024, 3, 17, 23, 0, 0, 0, time.UTC)
+	if got := WindowWeek.Start(sunday); got.Day() != 11 {
+		t.Errorf("week of a Sunday starts on the %d, want 11", got.Day())
+	}
+}
+
+func TestAggregator_WindowedSet(t *testing.T) {
+	now := time.Date(2024, 3, 14, 10, 0, 0, 0, time.UTC)
+	agg := New()
+	agg.now = func() time.Time { return now }
+	agg.Register("daily_users", Set)
+	agg.SetWindow("daily_users", WindowDay)
+
+	agg.AddToSet("daily_users", "alice")
+	agg.AddToSet("daily_users", "bob")
+	if got := agg.Snapshot()["daily_users"]; got != 2 {
+		t.Errorf("first snapshot = %v, want 2", got)
+	}
+
+	// Kept across snapshots within the day
+	now = now.Add(time.Hour)
+	agg.AddToSet("daily_users", "alice")
+	agg.AddToSet("daily_users", "carol")
+	if got := agg.Snapshot()["daily_users"]; got != 3 {
+		t.Errorf("second snapshot = %v, want 3", got)
+	}
+
+	// Reset once the day rolls over
+	now = now.Add(24 * time.Hour)
+	agg.AddToSet("daily_users", "dave")
+	if got := agg.Snapshot()["daily_users"]; got != 1 {
+		t.Errorf("next day = %v, want 1", got)
+	}
+	now = now.Add(24 * time.Hour)
+	if got := agg.Snapshot()["daily_users"]; got != 0 {
+		t.Errorf("idle day = %v, want 0", got)
+	}
+}
+
+func TestAggregator_SaveRestoreWindows(t *testing.T) {
+	now := time.Date(2024, 3, 14, 10, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	agg := New()
+	agg.now = clock
+	agg.RegisterLabeled("users", Set, []string{"region"}, 0)
+	agg.SetWindow("users", WindowDay)
+	agg.Register("visitors", Set)
+	agg.SetApproximate("visitors", true)
+	agg.SetWindow("visitors", WindowDay)
+
+	agg.AddToSetLabeled("users", []string{"eu"}, "alice")
+	agg.AddToSetLabeled("users", []string{"us"}, "bob")
+	for i := 0; i < 5000; i++ {
+		agg.AddToSet("visitors", fmt.Sprint("v", i))
+	}
+	before := agg.Peek()["visitors"].(int)
+
+	// Through JSON, as saved to the state directory
+	data, err := json.Marshal(agg.SaveWindows())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]WindowedSet
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := New()
+	restored.now = clock
+	restored.RegisterLabeled("users", Set, []string{"region"}, 0)
+	restored.SetWindow("users", WindowDay)
+	restored.Register("visitors", Set)
+	restored.SetApproximate("visitors", true)
+	restored.SetWindow("visitors", WindowDay)
+	if err := restored.RestoreWindows(saved); err != nil {
+		t.Fatalf("RestoreWindows() error = %v", err)
+	}
+
+	restored.AddToSetLabeled("users", []string{"eu"}, "alice")
+	restored.AddToSetLabeled("users", []string{"eu"}, "carol")
+	series := restored.Peek()["users"].([]Series)
+	if len(series) != 2 || series[0].Value != 2 || series[1].Value != 1 {
+		t.Errorf("users = %+v, want eu=2 us=1", series)
+	}
+	restored.AddToSet("visitors", "v1")
+	if got := restored.Peek()["visitors"]; got != before {
+		t.Errorf("visitors = %v, want %d", got, before)
+	}
+
+	// A window that has rolled over since is not restored
+	now = now.Add(24 * time.Hour)
+	stale := New()
+	stale.now = clock
+	stale.Register("visitors", Set)
+	stale.SetWindow("visitors", WindowDay)
+	if err := stale.RestoreWindows(saved); err != nil {
+		t.Fatalf("RestoreWindows() error = %v", err)
+	}
+	if got := stale.Peek()["visitors"]; got != 0 {
+		t.Errorf("stale visitors = %v, want 0", got)
+	}
+}
@@ -0,0 +1,185 @@
+// SPDX-License-Identifier: MIT
+
+// Package archive appends snapshots to a local file, one JSON object per
+// line, for hosts whose snapshots are shipped by other means and to audit
+// what was sent.
+//
+// The file is rotated once it reaches its size limit: it is renamed to
+// path.1, path.1 to path.2 and so on, the oldest beyond the files kept
+// being removed. Every line is synced to disk before Send returns.
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+// Config configures a Writer.
+type Config struct {
+	Path     string
+	MaxBytes int64 // the file is rotated beyond this size, never when 0
+	MaxFiles int   // rotated files kept, path.1 being the most recent
+
+	// Identify the agent in every line.
+	AppName     string
+	AppVersion  string
+	Environment string
+}
+
+// record is a line of the file.
+type record struct {
+	AppName       string                       `json:"app_name"`
+	AppVersion    string                       `json:"app_version,omitempty"`
+	Environment   string                       `json:"environment,omitempty"`
+	Timestamp     time.Time                    `json:"timestamp"`
+	Sequence      uint64                       `json:"sequence"`
+	IntervalStart *time.Time                   `json:"interval_start,omitempty"`
+	IntervalEnd   *time.Time                   `json:"interval_end,omitempty"`
+	Metrics       map[string]interface{}       `json:"metrics"`
+	Annotations   map[string]sender.Annotation `json:"annotations,omitempty"`
+}
+
+// Writer appends snapshots to a file.
+type Writer struct {
+	cfg Config
+
+	mu       sync.Mutex
+	file     *os.File // opened on the first snapshot
+	size     int64
+	sequence uint64 // of the last snapshot, starting over at 1 on restart
+
+	lastDelivery atomic.Int64 // unix nanoseconds of the last snapshot written
+}
+
+// New creates a Writer. The file is opened on the first snapshot.
+func New(cfg Config) *Writer {
+	return &Writer{cfg: cfg}
+}
+
+// Name returns "file".
+func (w *Writer) Name() string {
+	return "file"
+}
+
+// Send appends a snapshot as a line, rotating the file first when the
+// line would take it beyond its size limit.
+func (w *Writer) Send(_ context.Context, snap sender.Snapshot) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	rec := record{
+		AppName:     w.cfg.AppName,
+		AppVersion:  w.cfg.AppVersion,
+		Environment: w.cfg.Environment,
+		Timestamp:   snap.Timestamp,
+		Sequence:    w.sequence + 1,
+		Metrics:     snap.Metrics,
+		Annotations: snap.Annotations,
+	}
+	if rec.Timestamp.IsZero() {
+		rec.Timestamp = snap.End
+	}
+	if rec.Timestamp.IsZero() {
+		rec.Timestamp = time.Now()
+	}
+	rec.Timestamp = rec.Timestamp.UTC()
+	if !snap.Start.IsZero() && !snap.End.IsZero() {
+		start, end := snap.Start.UTC(), snap.End.UTC()
+		rec.IntervalStart, rec.IntervalEnd = &start, &end
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encoding snapshot: %w", err)
+	}
+	line = append(line, '\n')
+
+	if err := w.write(line); err != nil {
+		return fmt.Errorf("writing %s: %w", w.cfg.Path, err)
+	}
+	w.sequence++
+	w.lastDelivery.Store(time.Now().UnixNano())
+	return nil
+}
+
+// write appends a line to the file and syncs it. Must be called with
+// w.mu held.
+func (w *Writer) write(line []byte) error {
+	if w.file != nil && w.cfg.MaxBytes > 0 && w.size > 0 && w.size+int64(len(line)) > w.cfg.MaxBytes {
+		w.file.Close()
+		w.file = nil
+		if err := w.rotate(); err != nil {
+			return fmt.Errorf("rotating: %w", err)
+		}
+	}
+	if w.file == nil {
+		f, err := os.OpenFile(w.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.file, w.size = f, info.Size()
+	}
+
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// rotate shifts the rotated files by one, removing the oldest, and renames
+// the file to path.1. Without rotated files kept, the file is removed.
+func (w *Writer) rotate() error {
+	if w.cfg.MaxFiles <= 0 {
+		return os.Remove(w.cfg.Path)
+	}
+	if err := os.Remove(w.rotated(w.cfg.MaxFiles)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i := w.cfg.MaxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(w.rotated(i), w.rotated(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(w.cfg.Path, w.rotated(1))
+}
+
+// rotated returns the path of the i-th rotated file.
+func (w *Writer) rotated(i int) string {
+	return w.cfg.Path + "." + strconv.Itoa(i)
+}
+
+// LastDelivery returns when a snapshot was last written, or the zero time.
+func (w *Writer) LastDelivery() time.Time {
+	if ns := w.lastDelivery.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// Close closes the file, if open.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: MIT
+
+package archive
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+func readLines(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []map[string]interface{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestWriter_Send(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshots.jsonl")
+	w := New(Config{Path: path, AppName: "shop", Environment: "staging"})
+
+	end := time.Date(2024, 1, 15, 10, 31, 0, 0, time.UTC)
+	snap := sender.Snapshot{
+		Metrics:     map[string]interface{}{"requests": float64(3)},
+		Annotations: map[string]sender.Annotation{"requests": {Type: sender.AnnotationBurst, Value: 3}},
+		Start:       end.Add(-time.Minute),
+		End:         end,
+	}
+	for i := 0; i < 2; i++ {
+		if err := w.Send(context.Background(), snap); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+	if w.LastDelivery().IsZero() {
+		t.Error("LastDelivery() is zero after Send")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := readLines(t, path)
+	if len(lines) != 2 {
+		t.Fatalf("file has %d lines, want 2", len(lines))
+	}
+	l := lines[0]
+	if l["app_name"] != "shop" || l["environment"] != "staging" || l["timestamp"] != "2024-01-15T10:31:00Z" ||
+		l["interval_start"] != "2024-01-15T10:30:00Z" || l["sequence"] != float64(1) ||
+		l["metrics"].(map[string]interface{})["requests"] != float64(3) || l["annotations"] == nil {
+		t.Errorf("line = %v", l)
+	}
+	if lines[1]["sequence"] != float64(2) {
+		t.Errorf("second line sequence = %v, want 2", lines[1]["sequence"])
+	}
+
+	// Appends to the existing file once reopened
+	w = New(Config{Path: path, AppName: "shop"})
+	defer w.Close()
+	if err := w.Send(context.Background(), snap); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(readLines(t, path)); n != 3 {
+		t.Errorf("file has %d lines after a restart, want 3", n)
+	}
+}
+
+func TestWriter_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshots.jsonl")
+	snap := sender.Snapshot{Metrics: map[string]interface{}{"requests": float64(1)}, End: time.Now()}
+	line, _ := json.Marshal(record{AppName: "shop", Timestamp: snap.End.UTC(), Sequence: 1, Metrics: snap.Metrics})
+
+	// Two lines fit in a file, and two rotated files are kept
+	w := New(Config{Path: path, MaxBytes: int64(2*len(line) + 2), MaxFiles: 2, AppName: "shop"})
+	defer w.Close()
+	for i := 0; i < 7; i++ {
+		if err := w.Send(context.Background(), snap); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+
+	for name, want := range map[string][]float64{
+		path:        {7},
+		path + ".1": {5, 6},
+		path + ".2": {3, 4},
+	} {
+		lines := readLines(t, name)
+		if len(lines) != len(want) {
+			t.Errorf("%s has %d lines, want %d", filepath.Base(name), len(lines), len(want))
+			continue
+		}
+		for i, seq := range want {
+			if lines[i]["sequence"] != seq {
+				t.Errorf("%s line %d sequence = %v, want %v", filepath.Base(name), i, lines[i]["sequence"], seq)
+			}
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists, want only 2 rotated files", filepath.Base(path))
+	}
+}
@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: MIT
+
+// Package atomicfile replaces files so that a crash never leaves a
+// truncated one behind: readers see either the old content or the new.
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempSuffix ends the name of the temporary files.
+const tempSuffix = ".tmp"
+
+// Write replaces the file at path with data. It writes a temporary file
+// with permissions perm in the same directory, then renames it over path.
+// The directory must exist.
+func Write(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+tempSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// TempTarget returns the name of the file a temporary file left by an
+// interrupted Write was to replace, given its name.
+func TempTarget(name string) (string, bool) {
+	rest, ok := strings.CutSuffix(name, tempSuffix)
+	if !ok {
+		return "", false
+	}
+	i := strings.LastIndexByte(rest, '.')
+	if i <= 0 {
+		return "", false
+	}
+	return rest[:i], true
+}
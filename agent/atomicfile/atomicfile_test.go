@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: MIT
+
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	for _, data := range []string{`{"n":1}`, `{}`} {
+		if err := Write(path, []byte(data), 0600); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != data {
+			t.Errorf("content = %q, want %q", got, data)
+		}
+	}
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Errorf("permissions = %o, want 600", perm)
+		}
+	}
+
+	// No temporary file is left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d files, want 1", len(entries))
+	}
+
+	if err := Write(filepath.Join(dir, "missing", "state.json"), nil, 0600); err == nil {
+		t.Error("Write() to a missing directory succeeded")
+	}
+}
+
+func TestTempTarget(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"state.json.123456.tmp", "state.json", true},
+		{"0001.snap.42.tmp", "0001.snap", true},
+		{"state.json", "", false},
+		{".tmp", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := TempTarget(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("TempTarget(%q) = %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
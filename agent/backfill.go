@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/sender"
+	"github.com/kolapsis/shm-agent/agent/spool"
+	"github.com/kolapsis/shm-agent/agent/tailer"
+)
+
+// backfillBatch is the number of lines read between two checks for closed
+// intervals while backfilling.
+const backfillBatch = 1000
+
+// BackfillOptions configures Backfill.
+type BackfillOptions struct {
+	// Since and Until restrict the lines counted to event times in
+	// [Since, Until); zero values do not restrict.
+	Since, Until time.Time
+
+	// OnInterval, if set, is called with the metrics of every interval
+	// before they are sent.
+	OnInterval func(start, end time.Time, metrics map[string]interface{})
+}
+
+// BackfillResult reports what Backfill read and sent.
+type BackfillResult struct {
+	Lines           int64 // lines read
+	Outside         int64 // lines outside Since and Until
+	Late            int64 // lines later than the lateness of the source
+	TimestampErrors int64 // lines without a valid timestamp
+
+	// Intervals is the number of intervals sent, from First to Last.
+	Intervals   int
+	First, Last time.Time
+}
+
+// replayRange restricts the lines counted while backfilling to event times
+// from since to until.
+type replayRange struct {
+	since, until time.Time
+	outside      atomic.Int64
+}
+
+// includes reports whether t is within the range.
+func (r *replayRange) includes(t time.Time) bool {
+	return !t.Before(r.since) && (r.until.IsZero() || t.Before(r.until))
+}
+
+// Backfill reads the files of paths, oldest first, through the source at
+// index source, which must have a timestamp, and sends the metrics of
+// every interval of event time with its own start and end. Intervals
+// close as in a running agent, lines later than the lateness of the source
+// being dropped. Backfill registers with the server unless in dry-run or
+// offline mode, and cannot be used while the agent is running; it stops
+// at the first interval that could not be sent.
+func (a *Agent) Backfill(ctx context.Context, source int, paths []string, opts BackfillOptions) (res BackfillResult, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.running {
+		return res, errors.New("cannot backfill while the agent is running")
+	}
+
+	processors := a.currentProcessors()
+	if source < 0 || source >= len(processors) {
+		return res, fmt.Errorf("no source %d", source)
+	}
+	proc := processors[source]
+	if proc.source.Timestamp == nil {
+		return res, fmt.Errorf("source %s has no timestamp", proc.source.Location())
+	}
+
+	cfg := a.Config()
+	if !a.dryRun && cfg.UsesServer() {
+		if err := a.connect(cfg, spool.NewMemory(spool.Retention{})); err != nil {
+			return res, err
+		}
+		if err := a.sender.Register(ctx); err != nil {
+			return res, fmt.Errorf("registering with server: %w", err)
+		}
+	}
+	if !a.dryRun {
+		// StatsD lines carry no time: replayed intervals would all count now
+		if cfg.HasOutput(config.OutputStatsD) {
+			return res, fmt.Errorf("the %s output cannot backfill, it has no timestamps", config.OutputStatsD)
+		}
+		if err := a.connectExporters(cfg); err != nil {
+			return res, err
+		}
+		defer a.closeExporters()
+	}
+
+	a.events.replay()
+	replay := &replayRange{since: opts.Since, until: opts.Until}
+	proc.replay = replay
+	late, timeErrors := proc.linesLate.Load(), proc.timeErrors.Load()
+	defer func() {
+		proc.replay = nil
+		res.Outside = replay.outside.Load()
+		res.Late = proc.linesLate.Load() - late
+		res.TimestampErrors = proc.timeErrors.Load() - timeErrors
+	}()
+
+	// send sends the intervals closed by the lines read so far, once they
+	// are handled; all closes every interval. A multiline record pending at
+	// a batch boundary may still continue, so it is only flushed at the end
+	// of a file.
+	send := func(all bool) error {
+		if proc.queue != nil {
+			proc.queue.wait()
+		}
+		for _, win := range a.events.close(all) {
+			a.derive(cfg, win.Metrics)
+			if opts.OnInterval != nil {
+				opts.OnInterval(win.Start, win.End, win.Metrics)
+			}
+			if err := errors.Join(a.publish(ctx, sender.Snapshot{Metrics: win.Metrics, Start: win.Start, End: win.End})...); err != nil {
+				return fmt.Errorf("sending interval %s: %w", win.Start.Format(time.RFC3339), err)
+			}
+			if res.Intervals == 0 {
+				res.First = win.Start
+			}
+			res.Intervals++
+			res.Last = win.Start
+		}
+		return nil
+	}
+
+	for _, path := range paths {
+		var n int64
+		var sendErr error
+		_, err := tailer.ProcessFile(path, func(line string) {
+			if sendErr != nil || ctx.Err() != nil {
+				return
+			}
+			n++
+			res.Lines++
+			proc.processLineWith(line, lineContext{path: path, line: n})
+			if res.Lines%backfillBatch == 0 {
+				sendErr = send(false)
+			}
+		}, 0)
+		if err != nil {
+			return res, fmt.Errorf("processing %s: %w", path, err)
+		}
+		if sendErr != nil {
+			return res, sendErr
+		}
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		// A record does not continue in the next file
+		proc.flush()
+		if err := send(false); err != nil {
+			return res, err
+		}
+	}
+	return res, send(true)
+}
@@ -0,0 +1,184 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/sender/shmtest"
+)
+
+// writeBackfillLog writes a log with a request every 10 seconds from base
+// for the given number of seconds, and returns its path.
+func writeBackfillLog(t *testing.T, dir, name string, base time.Time, seconds int) string {
+	t.Helper()
+	var b strings.Builder
+	for s := 0; s < seconds; s += 10 {
+		fmt.Fprintf(&b, "{\"ts\": %q}\n", base.Add(time.Duration(s)*time.Second).Format(time.RFC3339))
+	}
+	b.WriteString("{\"ts\": \"not a time\"}\n")
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func backfillConfig() *config.Config {
+	return &config.Config{
+		AppName:  "test-app",
+		Interval: time.Minute,
+		Sources: []config.Source{{
+			Path:      "/var/log/app.log",
+			Format:    "json",
+			Timestamp: &config.TimestampConfig{Field: "ts", Layout: config.TimestampRFC3339, Lateness: 10 * time.Second},
+			Metrics:   []config.Metric{{Name: "requests", Type: "counter"}},
+		}},
+	}
+}
+
+func TestAgent_Backfill(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	older := writeBackfillLog(t, dir, "app.log.1", base, 120)
+	newer := writeBackfillLog(t, dir, "app.log", base.Add(2*time.Minute), 90)
+
+	ag, err := NewBuilder(backfillConfig(), WithDryRun(true)).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	var starts []time.Time
+	var counts []interface{}
+	res, err := ag.Backfill(context.Background(), 0, []string{older, newer}, BackfillOptions{
+		Since: base.Add(30 * time.Second),
+		OnInterval: func(start, end time.Time, metrics map[string]interface{}) {
+			if end.Sub(start) != time.Minute {
+				t.Errorf("interval %v to %v is not a minute", start, end)
+			}
+			starts = append(starts, start)
+			counts = append(counts, metrics["requests"])
+		},
+	})
+	if err != nil {
+		t.Fatalf("Backfill() error = %v", err)
+	}
+
+	wantStarts := []time.Time{base, base.Add(time.Minute), base.Add(2 * time.Minute), base.Add(3 * time.Minute)}
+	wantCounts := []interface{}{float64(3), float64(6), float64(6), float64(3)}
+	if len(starts) != len(wantStarts) {
+		t.Fatalf("intervals = %v, want %v", starts, wantStarts)
+	}
+	for i := range starts {
+		if !starts[i].Equal(wantStarts[i]) || counts[i] != wantCounts[i] {
+			t.Errorf("interval %d = %v with %v requests, want %v with %v", i, starts[i], counts[i], wantStarts[i], wantCounts[i])
+		}
+	}
+	if res.Lines != 23 || res.Outside != 3 || res.TimestampErrors != 2 || res.Late != 0 {
+		t.Errorf("result = %+v, want 23 lines, 3 outside and 2 timestamp errors", res)
+	}
+	if res.Intervals != 4 || !res.First.Equal(base) || !res.Last.Equal(base.Add(3*time.Minute)) {
+		t.Errorf("result = %+v, want 4 intervals from %v", res, base)
+	}
+}
+
+func TestAgent_BackfillServer(t *testing.T) {
+	srv := shmtest.NewServer()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	base := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	path := writeBackfillLog(t, dir, "app.log", base, 120)
+
+	cfg := backfillConfig()
+	cfg.ServerURL = srv.URL
+	cfg.IdentityFile = filepath.Join(dir, "identity.json")
+	cfg.AppVersion = "1.0.0"
+	ag, err := New(Options{Config: cfg})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	res, err := ag.Backfill(context.Background(), 0, []string{path}, BackfillOptions{})
+	if err != nil {
+		t.Fatalf("Backfill() error = %v", err)
+	}
+	if res.Intervals != 2 {
+		t.Fatalf("sent %d intervals, want 2", res.Intervals)
+	}
+
+	snaps := srv.Snapshots()
+	if len(snaps) != 2 {
+		t.Fatalf("server received %d snapshots, want 2", len(snaps))
+	}
+	for i, snap := range snaps {
+		start := base.Add(time.Duration(i) * time.Minute)
+		if snap.IntervalStart == nil || !snap.IntervalStart.Equal(start) || !snap.IntervalEnd.Equal(start.Add(time.Minute)) {
+			t.Errorf("snapshot %d interval = %v to %v, want %v", i, snap.IntervalStart, snap.IntervalEnd, start)
+		}
+	}
+	if v := srv.Violations(); len(v) > 0 {
+		t.Errorf("protocol violations: %v", v)
+	}
+
+	if _, err := ag.Backfill(context.Background(), 1, []string{path}, BackfillOptions{}); err == nil {
+		t.Error("Backfill() of a missing source succeeded")
+	}
+}
+
+func TestAgent_BackfillMultilineAcrossBatches(t *testing.T) {
+	base := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	var b strings.Builder
+	for i := 1; i < backfillBatch; i++ {
+		fmt.Fprintf(&b, "%s INFO ok\n", base.Format(time.RFC3339))
+	}
+	// The record starts on the last line of the first batch
+	fmt.Fprintf(&b, "%s ERROR request failed\n", base.Format(time.RFC3339))
+	b.WriteString("java.lang.NullPointerException\n")
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		AppName:  "test-app",
+		Interval: time.Minute,
+		Sources: []config.Source{{
+			Path:      "/var/log/app.log",
+			Format:    "regex",
+			Pattern:   `(?s)^(?P<ts>\S+) (?P<level>[A-Z]+) (?P<message>.*)$`,
+			Timestamp: &config.TimestampConfig{Field: "ts", Layout: config.TimestampRFC3339, Lateness: 10 * time.Second},
+			Multiline: &config.MultilineConfig{
+				StartPattern: `^\d{4}-`,
+				MaxLines:     config.DefaultMultilineMaxLines,
+				Timeout:      time.Minute,
+			},
+			Metrics: []config.Metric{
+				{Name: "npe", Type: "counter", Match: &config.Match{Field: "message", Contains: "NullPointerException"}},
+			},
+		}},
+	}
+	ag, err := NewBuilder(cfg, WithDryRun(true)).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	var npe interface{}
+	if _, err := ag.Backfill(context.Background(), 0, []string{path}, BackfillOptions{
+		OnInterval: func(_, _ time.Time, metrics map[string]interface{}) { npe = metrics["npe"] },
+	}); err != nil {
+		t.Fatalf("Backfill() error = %v", err)
+	}
+	if npe != float64(1) {
+		t.Errorf("npe = %v, want the record joined across the batch boundary", npe)
+	}
+	if s := ag.Stats().Sources[0]; s.ParseErrors != 0 {
+		t.Errorf("parse errors = %d, want the continuation line joined", s.ParseErrors)
+	}
+}
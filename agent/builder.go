@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+// Builder assembles an Agent from a configuration and a set of options.
+//
+//	ag, err := agent.NewBuilder(cfg,
+//		agent.WithLogger(logger),
+//		agent.WithOutput(myOutput),
+//	).Build()
+type Builder struct {
+	cfg             *config.Config
+	logger          *slog.Logger
+	dryRun          bool
+	verbosity       int
+	shutdownTimeout time.Duration
+	drainTimeout    time.Duration
+	outputs         []Output
+	stdin           io.Reader
+	errorSamples    int
+	loadConfig      ConfigLoader
+	systemdNotify   bool
+}
+
+// Option configures a Builder.
+type Option func(*Builder)
+
+// NewBuilder creates a Builder for the given configuration.
+func NewBuilder(cfg *config.Config, opts ...Option) *Builder {
+	b := &Builder{cfg: cfg, drainTimeout: DefaultDrainTimeout}
+	return b.With(opts...)
+}
+
+// With applies additional options to the builder.
+func (b *Builder) With(opts ...Option) *Builder {
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Build creates the Agent.
+func (b *Builder) Build() (*Agent, error) {
+	return newAgent(b)
+}
+
+// WithLogger sets the logger. A nil logger discards all output.
+func WithLogger(logger *slog.Logger) Option {
+	return func(b *Builder) {
+		b.logger = logger
+	}
+}
+
+// WithDryRun disables the SHM server: no identity is loaded, nothing is
+// registered and snapshots only go to the configured outputs.
+func WithDryRun(dryRun bool) Option {
+	return func(b *Builder) {
+		b.dryRun = dryRun
+	}
+}
+
+// WithVerbosity sets the line-level debug verbosity
+// (0=errors, 1=matches, 2=all lines).
+func WithVerbosity(verbosity int) Option {
+	return func(b *Builder) {
+		b.verbosity = verbosity
+	}
+}
+
+// WithShutdownTimeout bounds how long Stop waits for tailers to stop.
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(b *Builder) {
+		b.shutdownTimeout = timeout
+	}
+}
+
+// WithDrainTimeout bounds how long Stop keeps reading the lines tailers had
+// not delivered yet, within the shutdown timeout, DefaultDrainTimeout by
+// default. A timeout of 0 disables draining.
+func WithDrainTimeout(timeout time.Duration) Option {
+	return func(b *Builder) {
+		b.drainTimeout = timeout
+	}
+}
+
+// WithOutput adds an output that receives every snapshot, in addition to
+// the SHM server.
+func WithOutput(out Output) Option {
+	return func(b *Builder) {
+		b.outputs = append(b.outputs, out)
+	}
+}
+
+// WithStdin sets the reader used by sources whose path is "-".
+// It defaults to os.Stdin.
+func WithStdin(r io.Reader) Option {
+	return func(b *Builder) {
+		b.stdin = r
+	}
+}
+
+// WithConfigLoader sets how the configuration is loaded with the document
+// served by the server when remote_config is enabled; without it, the
+// server is not asked for one.
+func WithConfigLoader(load ConfigLoader) Option {
+	return func(b *Builder) {
+		b.loadConfig = load
+	}
+}
+
+// WithSystemdNotify reports to systemd, when run as a Type=notify unit,
+// that the agent is ready once started and that it is stopping, and pings
+// the unit's watchdog from the snapshot loop.
+func WithSystemdNotify(enabled bool) Option {
+	return func(b *Builder) {
+		b.systemdNotify = enabled
+	}
+}
+
+// WithErrorSamples keeps, for every source, the first n lines that failed
+// to parse and the first n that matched no metric, reported in Stats.
+func WithErrorSamples(n int) Option {
+	return func(b *Builder) {
+		b.errorSamples = n
+	}
+}
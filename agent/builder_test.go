@@ -0,0 +1,263 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestBuilder_CustomOutput(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+
+	if err := os.WriteFile(path, []byte{}, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cfg := &config.Config{
+		ServerURL:   "https://example.com",
+		AppName:     "test-app",
+		AppVersion:  "1.0.0",
+		Environment: "test",
+		Interval:    50 * time.Millisecond,
+		Sources: []config.Source{
+			{
+				Path:   path,
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+				},
+			},
+		},
+	}
+
+	var mu sync.Mutex
+	var snapshots []map[string]interface{}
+	out := OutputFunc(func(_ context.Context, metrics map[string]interface{}) error {
+		mu.Lock()
+		snapshots = append(snapshots, metrics)
+		mu.Unlock()
+		return nil
+	})
+
+	ag, err := NewBuilder(cfg, WithDryRun(true)).With(WithOutput(out)).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	if err := ag.Start(context.Background()); err != nil {
+		t.Errorf("second Start() error = %v", err)
+	}
+
+	ag.ProcessLine(0, `{"event": "request"}`)
+	time.Sleep(200 * time.Millisecond)
+
+	if err := ag.Stop(0); err != nil {
+		t.Errorf("Stop() error = %v", err)
+	}
+	if err := ag.Stop(0); err != nil {
+		t.Errorf("second Stop() error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(snapshots) == 0 {
+		t.Fatal("output received no snapshots")
+	}
+
+	var total float64
+	for _, s := range snapshots {
+		total += s["requests"].(float64)
+	}
+	if total != 1 {
+		t.Errorf("requests across snapshots = %v, want 1", total)
+	}
+}
+
+func TestBuilder_NilConfig(t *testing.T) {
+	if _, err := NewBuilder(nil).Build(); err == nil {
+		t.Error("Build() should return error for nil config")
+	}
+}
+
+func TestBuilder_DrainTimeout(t *testing.T) {
+	cfg := &config.Config{AppName: "test-app", Offline: true}
+	tests := []struct {
+		name string
+		opts []Option
+		want time.Duration
+	}{
+		{"default", nil, DefaultDrainTimeout},
+		{"set", []Option{WithDrainTimeout(time.Second)}, time.Second},
+		{"no wait", []Option{WithDrainTimeout(0)}, 0},
+	}
+	for _, tt := range tests {
+		ag, err := NewBuilder(cfg, tt.opts...).Build()
+		if err != nil {
+			t.Fatalf("%s: Build() error = %v", tt.name, err)
+		}
+		if ag.drainTimeout != tt.want {
+			t.Errorf("%s: drain timeout = %v, want %v", tt.name, ag.drainTimeout, tt.want)
+		}
+	}
+}
+
+func TestAgent_StopDrainsAndSendsFinalSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+
+	if err := os.WriteFile(path, []byte{}, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cfg := &config.Config{
+		AppName:  "test-app",
+		Interval: time.Hour,
+		Offline:  true,
+		Sources: []config.Source{
+			{
+				Path:   path,
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+				},
+			},
+		},
+	}
+
+	var snapshots []map[string]interface{}
+	out := OutputFunc(func(_ context.Context, metrics map[string]interface{}) error {
+		snapshots = append(snapshots, metrics)
+		return nil
+	})
+
+	ag, err := NewBuilder(cfg, WithDryRun(true), WithOutput(out)).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Lines written just before stopping are read and sent on Stop
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	f.WriteString(strings.Repeat("{}\n", 1000))
+	f.Close()
+
+	if err := ag.Stop(0); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	if len(snapshots) != 1 {
+		t.Fatalf("got %d snapshots, want the final one", len(snapshots))
+	}
+	if v := snapshots[0]["requests"]; v != float64(1000) {
+		t.Errorf("requests = %v, want 1000", v)
+	}
+}
+
+func TestAgent_Lifecycle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	if err := os.WriteFile(path, []byte{}, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cfg := &config.Config{
+		AppName:  "test-app",
+		Interval: time.Hour,
+		Offline:  true,
+		Sources: []config.Source{
+			{
+				Path:   path,
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+				},
+			},
+		},
+	}
+
+	var mu sync.Mutex
+	finals := 0
+	out := OutputFunc(func(context.Context, map[string]interface{}) error {
+		mu.Lock()
+		finals++
+		mu.Unlock()
+		return nil
+	})
+
+	ag, err := NewBuilder(cfg, WithDryRun(true), WithOutput(out)).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if err := ag.Wait(); err != nil {
+		t.Errorf("Wait() before Start error = %v", err)
+	}
+
+	// Cancelling the Start context stops the agent
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := ag.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	cancel()
+	if err := ag.Wait(); err != nil {
+		t.Errorf("Wait() error = %v", err)
+	}
+
+	// Concurrent Stop calls stop the agent once
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("restart error = %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ag.Stop(time.Second); err != nil {
+				t.Errorf("Stop() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := ag.Wait(); err != nil {
+		t.Errorf("Wait() after Stop error = %v", err)
+	}
+
+	// A fatal error stops the agent and is returned by Wait
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("restart error = %v", err)
+	}
+	ag.mu.Lock()
+	ag.run.fail(errors.New("listener failed"))
+	ag.mu.Unlock()
+	if err := ag.Wait(); err == nil || err.Error() != "listener failed" {
+		t.Errorf("Wait() error = %v, want listener failed", err)
+	}
+	if err := ag.Stop(0); err != nil {
+		t.Errorf("Stop() after failure error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if finals != 3 {
+		t.Errorf("got %d final snapshots, want 3", finals)
+	}
+}
@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"sync"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+// minBurstSamples is the number of previous snapshots needed before a
+// metric can be flagged, so the first intervals are not compared to noise.
+const minBurstSamples = 3
+
+// burstDetector compares each snapshot to the trailing average of the
+// metrics that enable burst detection.
+type burstDetector struct {
+	mu      sync.Mutex
+	windows map[string][]float64 // previous values, oldest first
+}
+
+// observe records a snapshot and returns annotations for the metrics whose
+// value exceeds their burst factor times the trailing average.
+func (d *burstDetector) observe(cfg *config.Config, metrics map[string]interface{}) map[string]sender.Annotation {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var annotations map[string]sender.Annotation
+	seen := make(map[string]bool)
+
+	for _, src := range cfg.Sources {
+		for i := range src.Metrics {
+			m := &src.Metrics[i]
+			if m.Burst == nil || seen[m.Name] {
+				continue
+			}
+			seen[m.Name] = true
+
+			value := metricTotal(metrics[m.Name])
+			window := d.windows[m.Name]
+
+			if len(window) >= minBurstSamples {
+				var sum float64
+				for _, v := range window {
+					sum += v
+				}
+				avg := sum / float64(len(window))
+
+				if avg > 0 && value >= m.Burst.MinValue && value > m.Burst.Factor*avg {
+					if annotations == nil {
+						annotations = make(map[string]sender.Annotation)
+					}
+					annotations[m.Name] = sender.Annotation{
+						Type:     sender.AnnotationBurst,
+						Value:    value,
+						Baseline: avg,
+						Ratio:    value / avg,
+					}
+				}
+			}
+
+			size := m.Burst.Window
+			if size <= 0 {
+				size = config.DefaultBurstWindow
+			}
+			window = append(window, value)
+			if len(window) > size {
+				window = window[len(window)-size:]
+			}
+			if d.windows == nil {
+				d.windows = make(map[string][]float64)
+			}
+			d.windows[m.Name] = window
+		}
+	}
+
+	// Forget metrics that no longer enable burst detection
+	for name := range d.windows {
+		if !seen[name] {
+			delete(d.windows, name)
+		}
+	}
+
+	return annotations
+}
+
+// metricTotal returns a snapshot value as a number, summing labeled series
+// and the counts of counter_by metrics.
+func metricTotal(v interface{}) float64 {
+	switch val := v.(type) {
+	case float64:
+		return val
+	case int:
+		return float64(val)
+	case int64:
+		return float64(val)
+	case aggregator.Counts:
+		return val.Total()
+	case []aggregator.Series:
+		var total float64
+		for _, s := range val {
+			total += metricTotal(s.Value)
+		}
+		return total
+	default:
+		return 0
+	}
+}
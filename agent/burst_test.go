@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+func TestBurstDetector(t *testing.T) {
+	cfg := &config.Config{
+		Sources: []config.Source{{
+			Metrics: []config.Metric{
+				{Name: "errors", Type: "counter", Burst: &config.BurstConfig{Factor: 3, Window: 4, MinValue: 5}},
+				{Name: "requests", Type: "counter"},
+			},
+		}},
+	}
+
+	var d burstDetector
+	observe := func(v float64) map[string]sender.Annotation {
+		return d.observe(cfg, map[string]interface{}{"errors": v, "requests": v * 100})
+	}
+
+	// Not enough history yet
+	for _, v := range []float64{2, 2, 100} {
+		if got := observe(v); got != nil {
+			t.Fatalf("observe(%v) = %v, want no annotation before %d samples", v, got, minBurstSamples)
+		}
+	}
+
+	// Window is now [2 2 100], average ~34.7: 50 is not a burst
+	if got := observe(50); got != nil {
+		t.Errorf("observe(50) = %v, want none", got)
+	}
+
+	// Window slides to [2 100 50 2]: average 38.5
+	observe(2)
+	got := observe(200)
+	ann, ok := got["errors"]
+	if !ok {
+		t.Fatalf("observe(200) = %v, want a burst on errors", got)
+	}
+	if ann.Type != sender.AnnotationBurst || ann.Value != 200 || ann.Baseline != 38.5 {
+		t.Errorf("annotation = %+v", ann)
+	}
+	if _, ok := got["requests"]; ok {
+		t.Error("requests does not enable burst detection")
+	}
+}
+
+func TestBurstDetector_MinValue(t *testing.T) {
+	cfg := &config.Config{
+		Sources: []config.Source{{
+			Metrics: []config.Metric{
+				{Name: "errors", Type: "counter", Labels: []string{"code"}, Burst: &config.BurstConfig{Factor: 2, Window: 3, MinValue: 10}},
+			},
+		}},
+	}
+
+	var d burstDetector
+	series := func(a, b float64) map[string]interface{} {
+		return map[string]interface{}{"errors": []aggregator.Series{
+			{Labels: map[string]string{"code": "500"}, Value: a},
+			{Labels: map[string]string{"code": "502"}, Value: b},
+		}}
+	}
+
+	for i := 0; i < 3; i++ {
+		d.observe(cfg, series(1, 1))
+	}
+	if got := d.observe(cfg, series(4, 4)); got != nil {
+		t.Errorf("observe() = %v, want none below min_value", got)
+	}
+	if got := d.observe(cfg, series(20, 5)); got["errors"].Value != 25 {
+		t.Errorf("observe() = %v, want a burst on the series total", got)
+	}
+}
@@ -5,10 +5,18 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/kolapsis/shm-agent/agent/expr"
+	"github.com/kolapsis/shm-agent/agent/parser"
 	"gopkg.in/yaml.v3"
 )
 
@@ -21,149 +29,2182 @@ type Config struct {
 	Environment  string        `yaml:"environment"`
 	Interval     time.Duration `yaml:"interval"`
 	Sources      []Source      `yaml:"sources"`
+
+	// Tags are sent to the server with the registration and every
+	// snapshot, so that agents can be grouped by role, region or team.
+	Tags map[string]string `yaml:"tags"`
+
+	// HostMetadata sends the hostname, kernel, CPU count and cloud
+	// provider of the host along with the tags. Defaults to true.
+	HostMetadata *bool `yaml:"host_metadata"`
+
+	// RescanInterval is how often glob source paths are re-expanded and
+	// Kubernetes pods listed, to pick up new files.
+	RescanInterval time.Duration `yaml:"rescan_interval"`
+
+	// VersionCheckInterval is how often the agent reports its version and
+	// health to the server, which answers with the versions it supports.
+	// Negative to disable.
+	VersionCheckInterval time.Duration `yaml:"version_check_interval"`
+
+	// MaxOpenFiles caps the number of files tailed at once. Beyond it, the
+	// least recently written files are closed and reopened by a rescan
+	// once they grow. 0 means no limit.
+	MaxOpenFiles int `yaml:"max_open_files"`
+
+	// PositionsFile stores file read offsets so tailing resumes after a
+	// restart. Set to "none" to always start at the end of files.
+	PositionsFile string `yaml:"positions_file"`
+
+	// UniqueFile stores the values of set metrics with a unique_window, so
+	// that a restart does not reset them. Set to "none" to keep them in
+	// memory only.
+	UniqueFile string `yaml:"unique_file"`
+
+	// SequenceFile stores the sequence number of the last snapshot queued
+	// for the server, so that it keeps increasing across restarts. Set to
+	// "none" to start over at 1 at every start.
+	SequenceFile string `yaml:"sequence_file"`
+
+	// StateDir holds every file the agent writes: relative identity_file,
+	// positions_file and spool.dir paths, and their defaults, resolve
+	// against it rather than the working directory.
+	StateDir string `yaml:"state_dir"`
+
+	// MaxPayloadSize is the maximum snapshot request body size in bytes.
+	// Larger snapshots are split across several requests.
+	MaxPayloadSize int `yaml:"max_payload_size"`
+
+	// SnapshotTimestamp selects the time reported for a snapshot: the end
+	// (default) or the start of the interval it aggregates.
+	SnapshotTimestamp string `yaml:"snapshot_timestamp"`
+
+	// SnapshotFormat selects the encoding of snapshot metrics: a map of
+	// values by name (default), or structured entries carrying the type,
+	// labels and interval of every value.
+	SnapshotFormat string `yaml:"snapshot_format"`
+
+	// HTTP tunes the connection to the server.
+	HTTP HTTPConfig `yaml:"http"`
+
+	// Auth adds a token to requests, for servers behind a gateway that
+	// does not check signatures.
+	Auth AuthConfig `yaml:"auth"`
+
+	// IdentityEncryption encrypts the private key stored in
+	// identity_file.
+	IdentityEncryption IdentityEncryptionConfig `yaml:"identity_encryption"`
+
+	// TLS sets the certificates used to talk to the server, for servers
+	// behind an internal CA or requiring client certificates.
+	TLS TLSConfig `yaml:"tls"`
+
+	// Retry controls the backoff between delivery attempts.
+	Retry RetryConfig `yaml:"retry"`
+
+	// Spool keeps undelivered snapshots until the server is reachable.
+	Spool SpoolConfig `yaml:"spool"`
+
+	// ListenAddr enables a local HTTP listener (e.g. "127.0.0.1:9464")
+	// serving metrics at /metrics in Prometheus text format.
+	ListenAddr string `yaml:"listen_addr"`
+
+	// History is the number of recent snapshots kept in memory for
+	// retrospective dumps. Set to -1 to keep none.
+	History int `yaml:"history"`
+
+	// Offline runs the agent without an SHM server: nothing is registered
+	// or pushed to it, and metrics only go to listen_addr and the other
+	// outputs.
+	Offline bool `yaml:"offline"`
+
+	// Output selects where snapshots are delivered: the SHM server
+	// (OutputSHM, the default), an OpenTelemetry collector (OutputOTLP),
+	// a StatsD server (OutputStatsD), InfluxDB (OutputInfluxDB), Kafka
+	// (OutputKafka) or a local file (OutputFile).
+	Output string `yaml:"output"`
+
+	// Outputs lists several of these destinations, every snapshot being
+	// delivered to each of them. It defaults to Output alone.
+	Outputs []string `yaml:"outputs"`
+
+	// OTLP sets the endpoint of the otlp output.
+	OTLP OTLPConfig `yaml:"otlp"`
+
+	// StatsD sets the server of the statsd output.
+	StatsD StatsDConfig `yaml:"statsd"`
+
+	// InfluxDB sets the endpoint of the influxdb output.
+	InfluxDB InfluxDBConfig `yaml:"influxdb"`
+
+	// Kafka sets the brokers and topics of the kafka output.
+	Kafka KafkaConfig `yaml:"kafka"`
+
+	// File sets the path and rotation of the file output.
+	File FileOutputConfig `yaml:"file"`
+
+	// SelfMetrics adds metrics about the agent itself (lines read, parse
+	// and send failures, uptime, memory) to every snapshot. Defaults to true.
+	SelfMetrics *bool `yaml:"self_metrics"`
+
+	// UniqueMetricNames rejects configurations where several sources
+	// define the same metric name, which then share their values.
+	UniqueMetricNames bool `yaml:"unique_metric_names"`
+
+	// KubernetesMetadata adds the metadata of the pod the agent runs in
+	// to the lines of every source.
+	KubernetesMetadata KubernetesMetadataConfig `yaml:"kubernetes_metadata"`
+
+	// Presets add bundles of sources and metrics shipped with the agent.
+	Presets []Preset `yaml:"presets"`
+
+	// Include lists further files, or glob patterns, whose sources are
+	// appended to these. Relative paths resolve against this file.
+	Include []string `yaml:"include"`
+
+	// Remote fetches sources from the SHM server.
+	Remote RemoteConfig `yaml:"remote_config"`
+
+	// Profiles are named sets of overrides, e.g. dev, staging and prod,
+	// one of which is selected when loading.
+	Profiles map[string]Profile `yaml:"profiles"`
+
+	// Profile is the name of the selected profile, if any.
+	Profile string `yaml:"-"`
+
+	// Files lists the files and directories the configuration was read
+	// from, so they can be watched for changes.
+	Files []string `yaml:"-"`
+}
+
+// HTTPConfig holds HTTP client settings for talking to the server.
+type HTTPConfig struct {
+	Timeout             time.Duration `yaml:"timeout"`                 // per request
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`       // keep idle connections this long
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"` // idle connections kept for reuse
+	KeepAlive           time.Duration `yaml:"keep_alive"`              // TCP keep-alive period
+	DisableHTTP2        bool          `yaml:"disable_http2"`
+	DisableKeepAlives   bool          `yaml:"disable_keep_alives"`
+	Trace               bool          `yaml:"trace"` // log request/response summaries
+
+	// Retries is the number of times a request failing with a network
+	// error, a timeout or a 408, 429 or 5xx status is sent again, after
+	// RetryBackoff, doubled at every retry. Timeout then bounds each
+	// attempt. Requests to the SHM server are not retried this way.
+	Retries      int           `yaml:"retries"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+
+	// ProxyURL is the proxy requests go through, overriding the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	ProxyURL string `yaml:"proxy_url"`
+}
+
+// OTLPConfig sets where the otlp output exports snapshots. The http, tls
+// and proxy settings of the server apply to it too.
+type OTLPConfig struct {
+	// Endpoint is the OTLP/HTTP endpoint, e.g. http://collector:4318;
+	// /v1/metrics is added when it has no path.
+	Endpoint string `yaml:"endpoint"`
+
+	// Headers are added to every request, e.g. for authentication.
+	Headers map[string]string `yaml:"headers"`
+
+	// HTTP overrides the http settings of the server it sets.
+	HTTP HTTPConfig `yaml:"http"`
+}
+
+// StatsDConfig sets where and how the statsd output sends metrics.
+type StatsDConfig struct {
+	Address   string   `yaml:"address"`   // UDP address, defaults to DefaultStatsDAddress
+	Prefix    string   `yaml:"prefix"`    // added before every metric name
+	DogStatsD bool     `yaml:"dogstatsd"` // send labels as DogStatsD tags instead of in the name
+	Tags      []string `yaml:"tags"`      // DogStatsD tags added to every metric, e.g. env:prod
+}
+
+// InfluxDBConfig sets where the influxdb output writes snapshots. The
+// http, tls and proxy settings of the server apply to it too.
+type InfluxDBConfig struct {
+	// URL is the InfluxDB URL, e.g. http://influxdb:8086; /api/v2/write
+	// is added when it has no path.
+	URL       string            `yaml:"url"`
+	Org       string            `yaml:"org"`
+	Bucket    string            `yaml:"bucket"`
+	Token     string            `yaml:"token"`
+	TokenFile string            `yaml:"token_file"` // read at every request
+	Tags      map[string]string `yaml:"tags"`       // added to every point
+
+	// HTTP overrides the http settings of the server it sets.
+	HTTP HTTPConfig `yaml:"http"`
+}
+
+// KafkaConfig sets where and how the kafka output publishes snapshots.
+type KafkaConfig struct {
+	Brokers     []string      `yaml:"brokers"`      // bootstrap brokers, host:port
+	Topic       string        `yaml:"topic"`        // snapshots
+	EventsTopic string        `yaml:"events_topic"` // lines that matched a metric, not published when empty
+	Key         string        `yaml:"key"`          // message key: instance_id (default), app_name or none
+	Compression string        `yaml:"compression"`  // none (default), gzip or zstd
+	Acks        string        `yaml:"acks"`         // all (default), leader or none
+	Timeout     time.Duration `yaml:"timeout"`      // defaults to DefaultKafkaTimeout
+}
+
+// FileOutputConfig sets where the file output appends snapshots, one JSON
+// object per line, and how the file is rotated.
+type FileOutputConfig struct {
+	Path     string `yaml:"path"`      // relative to state_dir, defaults to DefaultFileOutputPath
+	MaxBytes int64  `yaml:"max_bytes"` // Path is rotated to Path.1 beyond this size
+	MaxFiles int    `yaml:"max_files"` // rotated files kept, Path.1 being the most recent
+}
+
+// DefaultStatsDAddress is the default address of the statsd output.
+const DefaultStatsDAddress = "127.0.0.1:8125"
+
+// AuthConfig holds the token sent with every request to the server, as a
+// Bearer token in the Authorization header unless Header is set.
+type AuthConfig struct {
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"` // read at every request
+	Header    string `yaml:"header"`     // e.g. X-API-Key, sent the raw token
+}
+
+// IdentityEncryptionConfig selects how the private key of the identity is
+// encrypted at rest. With a passphrase, it is read from PassphraseEnv or
+// PassphraseFile whenever the identity is loaded.
+type IdentityEncryptionConfig struct {
+	Mode           string `yaml:"mode"`           // none (default), passphrase or dpapi
+	PassphraseEnv  string `yaml:"passphrase_env"` // name of the variable holding the passphrase
+	PassphraseFile string `yaml:"passphrase_file"`
+}
+
+// TLSConfig holds the TLS settings for talking to the server. Without
+// them, the server certificate is verified against the system roots.
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file"`   // PEM certificates trusted instead of the system roots
+	CertFile           string `yaml:"cert_file"` // PEM client certificate
+	KeyFile            string `yaml:"key_file"`  // PEM key of the client certificate
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
 }
 
 // Source represents a log source configuration.
 type Source struct {
-	Path    string   `yaml:"path"`
-	Format  string   `yaml:"format"` // "json" or "regex"
-	Pattern string   `yaml:"pattern"` // regex pattern (only for format: regex)
+	Type    string   `yaml:"type,omitempty"`  // "file" (default), "journald", "kubernetes" or "gelf"
+	Units   []string `yaml:"units,omitempty"` // journald: only read entries of these systemd units
+	Path    string   `yaml:"path"`            // file path, glob pattern or "-" for stdin
+	Format  string   `yaml:"format"`          // "json", "regex", "grok", "csv", "access_log", "logfmt" or "syslog"
+	Pattern string   `yaml:"pattern"`         // regex or grok pattern (only for format: regex or grok)
 	Metrics []Metric `yaml:"metrics"`
+
+	// GrokPatterns adds named patterns to, or overrides, the built-in grok
+	// patterns, for format: grok.
+	GrokPatterns map[string]string `yaml:"grok_patterns,omitempty"`
+
+	// Preset selects the format of an access_log source: common,
+	// combined, nginx_default or haproxy_http.
+	Preset string `yaml:"preset,omitempty"`
+
+	// CSV names the columns of a csv source.
+	CSV *CSVConfig `yaml:"csv,omitempty"`
+
+	// MetricPrefix is prepended to the names of the source's metrics, so
+	// that sources defining the same names do not share their values.
+	MetricPrefix string `yaml:"metric_prefix,omitempty"`
+
+	// KeepFields and DropFields discard parsed fields before matching.
+	// With KeepFields, only the listed fields are kept; DropFields then
+	// removes the listed fields. Nested fields use dot notation.
+	KeepFields []string `yaml:"keep_fields,omitempty"`
+	DropFields []string `yaml:"drop_fields,omitempty"`
+
+	// AddFields are set on every parsed line, replacing parsed fields of
+	// the same name, e.g. to label metrics with deployment metadata.
+	AddFields map[string]string `yaml:"add_fields,omitempty"`
+
+	// MapFields sets fields to the category of another field's value, so
+	// that metrics can be labeled or matched by category, e.g. a
+	// status_class field of "2xx" to "5xx" from the status field. A field
+	// may also be mapped in place.
+	MapFields map[string]FieldMap `yaml:"map_fields,omitempty"`
+
+	// PathPattern is a regular expression matched against the path of the
+	// file each line was read from. Its named groups are set on the line,
+	// so a glob source can split its metrics by file, e.g. by vhost with
+	// '/var/log/nginx/(?P<vhost>[^/]+)\.access\.log'.
+	PathPattern string `yaml:"path_pattern,omitempty"`
+
+	// Filter drops the lines it does not match right after parsing, before
+	// any metric sees them, e.g. health checks with
+	// {not: {field: path, equals: /healthz}}. It uses the syntax of metric
+	// matches and sees the fields added by the source.
+	Filter *Match `yaml:"filter,omitempty"`
+
+	// Prefilter skips the raw lines it does not match before they are
+	// parsed, sparing the parsing of lines no metric needs.
+	Prefilter *PrefilterConfig `yaml:"prefilter,omitempty"`
+
+	// Timestamp reads the time lines were logged at, so that the source's
+	// metrics are counted in the interval of that time rather than the
+	// one they are read in.
+	Timestamp *TimestampConfig `yaml:"timestamp,omitempty"`
+
+	// SampleRate processes one in every SampleRate lines of the source and
+	// skips the others before parsing, to bound the CPU spent on very
+	// chatty logs. Counters and sums are multiplied by the rate.
+	SampleRate int `yaml:"sample_rate,omitempty"`
+
+	// Workers parses and records the lines of the source on that many
+	// goroutines, for sources too busy for one core. Lines are then
+	// recorded out of order. Defaults to 1, on the goroutine reading them.
+	Workers int `yaml:"workers,omitempty"`
+
+	// QueueSize is the number of lines waiting for the workers. Setting it
+	// or OnOverflow queues the lines of a source with a single worker, so
+	// that reading does not wait for parsing. Defaults to 1024 per worker.
+	QueueSize int `yaml:"queue_size,omitempty"`
+
+	// OnOverflow is what happens to a line read while the queue is full:
+	// block (default) waits for room, drop_oldest drops the line queued
+	// the longest and drop_newest the line read.
+	OnOverflow string `yaml:"on_overflow,omitempty"`
+
+	// Types converts parsed field values to int, float, bool or string,
+	// so that fields compare the same whatever the source format.
+	Types map[string]string `yaml:"types,omitempty"`
+
+	// Kubernetes selects the pods read by a kubernetes source.
+	Kubernetes *KubernetesConfig `yaml:"kubernetes,omitempty"`
+
+	// GELF sets where a gelf source receives messages.
+	GELF *GELFConfig `yaml:"gelf,omitempty"`
+
+	// Multiline joins continuation lines, such as stack traces, to the
+	// line that starts their record before parsing.
+	Multiline *MultilineConfig `yaml:"multiline,omitempty"`
+
+	// Unmatched captures the lines that failed to parse or matched no
+	// metric, to find out what the metrics miss.
+	Unmatched *UnmatchedConfig `yaml:"unmatched,omitempty"`
+
+	// origin is the file the source was read from, for error messages.
+	origin string
+
+	// podMetadata is set when the lines of the source carry the metadata
+	// of the agent's pod, see KubernetesMetadataConfig.
+	podMetadata bool
+}
+
+// KubernetesConfig selects pods through the API server. Their log files
+// are read from LogsDir, so only pods on the agent's node can be read.
+type KubernetesConfig struct {
+	Namespace string `yaml:"namespace"` // empty for all namespaces
+	Selector  string `yaml:"selector"`  // label selector, e.g. "app=checkout"
+	Container string `yaml:"container"` // only read this container's logs
+	NodeName  string `yaml:"node_name"` // defaults to $NODE_NAME
+	LogsDir   string `yaml:"logs_dir"`  // defaults to /var/log/pods
+
+	// APIServer, TokenFile and CAFile default to the in-cluster settings.
+	APIServer string `yaml:"api_server"`
+	TokenFile string `yaml:"token_file"`
+	CAFile    string `yaml:"ca_file"`
+}
+
+// KubernetesMetadataConfig enriches lines with the metadata of the pod the
+// agent runs in, under the same kubernetes.* fields as kubernetes sources
+// (kubernetes.pod, kubernetes.namespace, kubernetes.node, kubernetes.labels.<name>),
+// so metrics of a sidecar or node agent can be grouped by workload.
+// Kubernetes sources keep the metadata of the pods they read.
+type KubernetesMetadataConfig struct {
+	// Enabled defaults to true when running in a cluster, as detected by
+	// the KUBERNETES_SERVICE_HOST environment variable.
+	Enabled *bool `yaml:"enabled"`
+
+	// LabelsFile is the downward API volume file holding the pod labels.
+	// Defaults to /etc/podinfo/labels.
+	LabelsFile string `yaml:"labels_file"`
+
+	// LookupPod gets what the downward API does not provide, such as the
+	// labels or the node, from the API server. It requires the service
+	// account to be allowed to get its pod. Defaults to true.
+	LookupPod *bool `yaml:"lookup_pod"`
+}
+
+// DefaultPodLabelsFile is where the pod labels are commonly mounted with a
+// downward API volume.
+const DefaultPodLabelsFile = "/etc/podinfo/labels"
+
+// IsEnabled reports whether lines are enriched with the pod metadata.
+func (k *KubernetesMetadataConfig) IsEnabled() bool {
+	if k.Enabled != nil {
+		return *k.Enabled
+	}
+	return os.Getenv("KUBERNETES_SERVICE_HOST") != ""
+}
+
+// LookupEnabled reports whether the pod is looked up on the API server.
+func (k *KubernetesMetadataConfig) LookupEnabled() bool {
+	return k.LookupPod == nil || *k.LookupPod
+}
+
+// Metric represents a metric extraction configuration.
+type Metric struct {
+	Name      string    `yaml:"name"`
+	Type      string    `yaml:"type"` // "counter", "counter_by", "gauge", "sum", "set", "percentile", "derived"
+	Match     *Match    `yaml:"match,omitempty"`
+	Extract   *Extract  `yaml:"extract,omitempty"`
+	Labels    []string  `yaml:"labels,omitempty"`     // fields whose values split the metric into series
+	MaxSeries int       `yaml:"max_series,omitempty"` // cardinality cap for labeled metrics, and values of counter_by
+	Quantiles []float64 `yaml:"quantiles,omitempty"`  // for percentile, default p50, p95, p99
+
+	// Expression computes a derived metric from other metrics of the same
+	// snapshot, e.g. "http_5xx / http_requests * 100".
+	Expression string `yaml:"expression,omitempty"`
+
+	// Approximate makes a set count unique values with a HyperLogLog once
+	// it grows large, trading ~1% error for bounded memory.
+	Approximate bool `yaml:"approximate,omitempty"`
+
+	// UniqueWindow keeps the values of a set across snapshots until the
+	// hour, day, week or month rolls over, e.g. to count daily unique
+	// users, instead of counting the values of each interval.
+	UniqueWindow string `yaml:"unique_window,omitempty"`
+
+	// SeriesTTL drops the series of a labeled gauge that were not updated
+	// for this long, so that series that stopped reporting do not stay
+	// forever at their last value. Defaults to DefaultSeriesTTL.
+	SeriesTTL time.Duration `yaml:"series_ttl,omitempty"`
+
+	// SampleRate records one in every SampleRate matching lines. Counters
+	// and sums are multiplied by the rate to compensate.
+	SampleRate int `yaml:"sample_rate,omitempty"`
+
+	// Burst annotates intervals whose value is well above the recent average.
+	Burst *BurstConfig `yaml:"burst,omitempty"`
+
+	// Enabled set to false turns the metric off: it is validated, then
+	// removed when the configuration is loaded. Defaults to true.
+	Enabled *bool `yaml:"enabled,omitempty"`
+
+	// Shadow computes the metric and shows it in dry-run mode and the
+	// agent's status, but never sends it to the server or exports it, to
+	// trial a definition on live traffic.
+	Shadow bool `yaml:"shadow,omitempty"`
+}
+
+// validateDerived validates a derived metric, which is computed from other
+// metrics rather than lines. Its references are checked with the whole
+// configuration, by Config.validateDerived.
+func (m *Metric) validateDerived() error {
+	if m.Expression == "" {
+		return fmt.Errorf("expression is required for type 'derived'")
+	}
+	if _, err := expr.Parse(m.Expression); err != nil {
+		return fmt.Errorf("invalid expression: %w", err)
+	}
+	if m.Match != nil || m.Extract != nil || len(m.Labels) > 0 || len(m.Quantiles) > 0 || m.Approximate || m.UniqueWindow != "" || m.SampleRate != 0 {
+		return fmt.Errorf("type 'derived' does not support match, extract, labels, quantiles, approximate, unique_window or sample_rate")
+	}
+	if m.Burst != nil {
+		if err := m.Burst.Validate(); err != nil {
+			return fmt.Errorf("burst: %w", err)
+		}
+	}
+	return nil
+}
+
+// BurstConfig flags snapshots in which a metric exceeds Factor times its
+// average over the previous Window snapshots.
+type BurstConfig struct {
+	Factor   float64 `yaml:"factor"`    // e.g. 3 for three times the trailing average
+	Window   int     `yaml:"window"`    // number of previous snapshots averaged
+	MinValue float64 `yaml:"min_value"` // values below this are never flagged
+}
+
+// MultilineConfig joins lines into records: a record starts at a line
+// matching StartPattern and takes every following line that does not.
+type MultilineConfig struct {
+	StartPattern string        `yaml:"start_pattern"`
+	MaxLines     int           `yaml:"max_lines"` // lines kept per record, the rest are dropped
+	Timeout      time.Duration `yaml:"timeout"`   // a record is complete after this long without a line
+}
+
+// PrefilterConfig selects raw lines, before parsing, by a substring or a
+// regular expression.
+type PrefilterConfig struct {
+	Contains string `yaml:"contains,omitempty"`
+	Regex    string `yaml:"regex,omitempty"`
+}
+
+// TimestampConfig reads the event time of lines from Field, with Layout: a
+// Go time layout (local time unless it has a zone), or one of the
+// TimestampLayouts. Lines are counted in the interval of their event time
+// until Lateness after it ends; later lines are dropped.
+type TimestampConfig struct {
+	Field    string        `yaml:"field"`
+	Layout   string        `yaml:"layout"`   // rfc3339 by default
+	Lateness time.Duration `yaml:"lateness"` // the interval by default
+}
+
+// Timestamp layouts other than Go time layouts.
+const (
+	TimestampRFC3339 = "rfc3339"
+	TimestampUnix    = "unix"    // seconds, with an optional fraction
+	TimestampUnixMs  = "unix_ms" // milliseconds
+)
+
+// CSVConfig maps the values of delimited lines to fields, by position.
+type CSVConfig struct {
+	Delimiter string   `yaml:"delimiter"` // a single character, "," by default
+	Columns   []string `yaml:"columns"`   // field names; "" skips a column
+	Header    bool     `yaml:"header"`    // read the names from a header line instead
+}
+
+// UnmatchedConfig captures the lines of a source that failed to parse or
+// matched no metric. They are counted by first token, and written to File
+// when set.
+type UnmatchedConfig struct {
+	File     string `yaml:"file"`      // relative to state_dir
+	MaxBytes int64  `yaml:"max_bytes"` // File is rotated to File.1 beyond this size
+}
+
+// Source types.
+const (
+	SourceFile       = "file"
+	SourceJournald   = "journald"
+	SourceKubernetes = "kubernetes"
+	SourceGELF       = "gelf"
+)
+
+// Field types of Source.Types.
+const (
+	TypeInt    = "int"
+	TypeFloat  = "float"
+	TypeBool   = "bool"
+	TypeString = "string"
+)
+
+// SelfMetricPrefix starts the names of the agent's own metrics, which
+// configured metrics may not use.
+const SelfMetricPrefix = "shm_agent_"
+
+// GELFConfig sets where a gelf source receives GELF messages, such as
+// those of Docker's gelf log driver or Graylog client libraries.
+type GELFConfig struct {
+	Listen string `yaml:"listen"` // UDP address, defaults to DefaultGELFListen
+}
+
+// DefaultGELFListen is the default address of gelf sources, the standard
+// GELF port.
+const DefaultGELFListen = ":12201"
+
+// DefaultKubernetesLogsDir is where the kubelet writes container logs.
+const DefaultKubernetesLogsDir = "/var/log/pods"
+
+// DefaultHistory is the default number of snapshots kept in memory.
+const DefaultHistory = 12
+
+// DefaultVersionCheckInterval is the default interval between version
+// reports.
+const DefaultVersionCheckInterval = time.Hour
+
+// DefaultRescanInterval is the default interval between glob rescans.
+const DefaultRescanInterval = 10 * time.Second
+
+// DefaultSeriesTTL is the default time the series of a labeled gauge are
+// kept without update.
+const DefaultSeriesTTL = time.Hour
+
+// DefaultBurstWindow is the default number of snapshots a burst is compared to.
+const DefaultBurstWindow = 12
+
+// Multiline defaults.
+const (
+	DefaultMultilineMaxLines = 200
+	DefaultMultilineTimeout  = 2 * time.Second
+)
+
+// DefaultUnmatchedMaxBytes is the default size of an unmatched lines file.
+const DefaultUnmatchedMaxBytes = 10 << 20 // 10 MiB
+
+// DefaultMaxSeries is the default cardinality cap for labeled metrics.
+const DefaultMaxSeries = 1000
+
+// DefaultMaxPayloadSize is the default maximum snapshot request body size.
+const DefaultMaxPayloadSize = 1 << 20 // 1 MiB
+
+// MaxWorkers is the largest number of workers of a source.
+const MaxWorkers = 256
+
+// Values of on_overflow.
+const (
+	OverflowBlock      = "block"
+	OverflowDropOldest = "drop_oldest"
+	OverflowDropNewest = "drop_newest"
+)
+
+// DefaultQueueSizePerWorker is the default queue_size of a source, per
+// worker.
+const DefaultQueueSizePerWorker = 1024
+
+// MinMaxPayloadSize is the smallest accepted max_payload_size.
+const MinMaxPayloadSize = 1024
+
+// Values of output.
+const (
+	OutputSHM      = "shm"
+	OutputOTLP     = "otlp"
+	OutputStatsD   = "statsd"
+	OutputInfluxDB = "influxdb"
+	OutputKafka    = "kafka"
+	OutputFile     = "file"
+)
+
+// Values of kafka.key.
+const (
+	KafkaKeyInstanceID = "instance_id"
+	KafkaKeyAppName    = "app_name"
+	KafkaKeyNone       = "none"
+)
+
+// Values of kafka.compression.
+const (
+	KafkaCompressionNone = "none"
+	KafkaCompressionGzip = "gzip"
+	KafkaCompressionZstd = "zstd"
+)
+
+// Values of kafka.acks.
+const (
+	KafkaAcksAll    = "all"
+	KafkaAcksLeader = "leader"
+	KafkaAcksNone   = "none"
+)
+
+// DefaultKafkaTimeout is the default timeout of the kafka output.
+const DefaultKafkaTimeout = 10 * time.Second
+
+// Defaults of the file output.
+const (
+	DefaultFileOutputPath     = "./shm_snapshots.jsonl"
+	DefaultFileOutputMaxBytes = 100 << 20 // 100 MiB
+	DefaultFileOutputMaxFiles = 5
+)
+
+// Values of identity_encryption.mode.
+const (
+	IdentityEncryptionNone       = "none"
+	IdentityEncryptionPassphrase = "passphrase"
+	IdentityEncryptionDPAPI      = "dpapi"
+)
+
+// Values of snapshot_format.
+const (
+	SnapshotFormatMap        = "map"
+	SnapshotFormatStructured = "structured"
+)
+
+// Values of snapshot_timestamp.
+const (
+	SnapshotTimestampEnd   = "interval_end"
+	SnapshotTimestampStart = "interval_start"
+)
+
+// Retry and spool defaults.
+const (
+	DefaultInitialBackoff    = 5 * time.Second
+	DefaultMaxBackoff        = 5 * time.Minute
+	DefaultSpoolMaxAge       = 24 * time.Hour
+	DefaultSpoolMaxBytes     = 64 << 20 // 64 MiB
+	DefaultSpoolMaxSnapshots = 1000
+)
+
+// HTTP client defaults.
+const (
+	DefaultHTTPTimeout         = 30 * time.Second
+	DefaultIdleConnTimeout     = 90 * time.Second
+	DefaultMaxIdleConnsPerHost = 2
+	DefaultKeepAlive           = 30 * time.Second
+	DefaultRetryBackoff        = time.Second
+	MaxHTTPRetries             = 10
+)
+
+// Match represents a matching condition.
+//
+// A match is either a single condition on a field, or a composite of other
+// matches: all (AND), any (OR) or not.
+type Match struct {
+	Field    string   `yaml:"field,omitempty"`
+	Equals   string   `yaml:"equals,omitempty"`
+	In       []string `yaml:"in,omitempty"`
+	Regex    string   `yaml:"regex,omitempty"`
+	Contains string   `yaml:"contains,omitempty"`
+
+	// Negated conditions; a line without the field matches
+	NotEquals   string   `yaml:"not_equals,omitempty"`
+	NotIn       []string `yaml:"not_in,omitempty"`
+	NotContains string   `yaml:"not_contains,omitempty"`
+
+	// IgnoreCase compares equals, in, contains and their negations
+	// regardless of case
+	IgnoreCase bool `yaml:"ignore_case,omitempty"`
+
+	// Exists matches lines that have the field (true) or lack it (false);
+	// a null value counts as absent
+	Exists *bool `yaml:"exists,omitempty"`
+
+	// Numeric comparisons; the field value must be a number or a numeric string
+	Gt      *float64  `yaml:"gt,omitempty"`
+	Gte     *float64  `yaml:"gte,omitempty"`
+	Lt      *float64  `yaml:"lt,omitempty"`
+	Lte     *float64  `yaml:"lte,omitempty"`
+	Between []float64 `yaml:"between,omitempty"` // [min, max], inclusive
+
+	All []Match `yaml:"all,omitempty"` // every sub-match must match
+	Any []Match `yaml:"any,omitempty"` // at least one sub-match must match
+	Not *Match  `yaml:"not,omitempty"` // the sub-match must not match
+}
+
+// IsComposite reports whether the match combines other matches.
+func (m *Match) IsComposite() bool {
+	return len(m.All) > 0 || len(m.Any) > 0 || m.Not != nil
+}
+
+// Extract represents a field extraction configuration.
+type Extract struct {
+	Field string `yaml:"field"`
+
+	// Transform normalizes the value, in order, before it is converted:
+	// lowercase, uppercase or trim.
+	Transform []string `yaml:"transform,omitempty"`
+
+	// Map converts the transformed value into a category, e.g. a log
+	// level "warning" into "warn".
+	Map *ValueMap `yaml:"map,omitempty"`
+
+	// Type converts the value: int, float, duration ("1.5s", "250ms", in
+	// seconds) or bytes ("2MB", "512KiB", in bytes). By default, numbers
+	// are read as is.
+	Type string `yaml:"type,omitempty"`
+}
+
+// Extract value transforms and types.
+var (
+	ExtractTransforms = []string{"lowercase", "uppercase", "trim"}
+	ExtractTypes      = []string{"int", "float", "duration", "bytes"}
+)
+
+// Validate validates the transforms and type of an extraction.
+func (e *Extract) Validate() error {
+	for _, t := range e.Transform {
+		if !slices.Contains(ExtractTransforms, t) {
+			return fmt.Errorf("transform must be one of %s, got '%s'", strings.Join(ExtractTransforms, ", "), t)
+		}
+	}
+	if e.Type != "" && !slices.Contains(ExtractTypes, e.Type) {
+		return fmt.Errorf("type must be one of %s, got '%s'", strings.Join(ExtractTypes, ", "), e.Type)
+	}
+	if e.Map != nil {
+		if err := e.Map.Validate(); err != nil {
+			return fmt.Errorf("map: %w", err)
+		}
+	}
+	return nil
+}
+
+// ValueMap converts values into categories. A value listed in Values is
+// replaced by its category; otherwise the first matching rule applies,
+// then the default. Values nothing maps are kept when there is no default.
+type ValueMap struct {
+	Values  map[string]string `yaml:"values,omitempty"`
+	Rules   []ValueRule       `yaml:"rules,omitempty"`
+	Default string            `yaml:"default,omitempty"`
+}
+
+// ValueRule maps the values matching a regex, or numbers within bounds,
+// e.g. status codes '^5' to "5xx" or durations under 0.1 to "fast".
+type ValueRule struct {
+	Regex string   `yaml:"regex,omitempty"`
+	Gte   *float64 `yaml:"gte,omitempty"`
+	Lt    *float64 `yaml:"lt,omitempty"`
+	Value string   `yaml:"value"`
+}
+
+// Validate validates the values and rules of a value map.
+func (v *ValueMap) Validate() error {
+	if len(v.Values) == 0 && len(v.Rules) == 0 {
+		return fmt.Errorf("values or rules are required")
+	}
+	for i, r := range v.Rules {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("rules[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// validate validates a value rule.
+func (r *ValueRule) validate() error {
+	if r.Value == "" {
+		return fmt.Errorf("value is required")
+	}
+	bounded := r.Gte != nil || r.Lt != nil
+	switch {
+	case r.Regex == "" && !bounded:
+		return fmt.Errorf("regex, gte or lt is required")
+	case r.Regex != "" && bounded:
+		return fmt.Errorf("regex cannot be combined with gte or lt")
+	case r.Regex != "":
+		if _, err := regexp.Compile(r.Regex); err != nil {
+			return fmt.Errorf("invalid regex: %w", err)
+		}
+	case r.Gte != nil && r.Lt != nil && *r.Gte >= *r.Lt:
+		return fmt.Errorf("gte must be less than lt")
+	}
+	return nil
+}
+
+// FieldMap sets a field to the category of another field's value, see
+// Source.MapFields.
+type FieldMap struct {
+	Field    string `yaml:"field"`
+	ValueMap `yaml:",inline"`
+}
+
+// Load reads and parses a configuration file and the files it includes.
+func Load(path string) (*Config, error) {
+	return LoadWithDir(path, "")
+}
+
+// Parse parses configuration from YAML data.
+func Parse(data []byte) (*Config, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing YAML: %w", err)
+	}
+
+	if len(cfg.Include) > 0 {
+		return nil, fmt.Errorf("include is only supported when loading from a file")
+	}
+
+	if err := cfg.applyPresets(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.dropDisabled()
+
+	return &cfg, nil
+}
+
+// setDefaults sets default values for configuration fields.
+func (c *Config) setDefaults() error {
+	if c.IdentityFile == "" {
+		c.IdentityFile = "./shm_identity.json"
+	}
+
+	if c.KubernetesMetadata.LabelsFile == "" {
+		c.KubernetesMetadata.LabelsFile = DefaultPodLabelsFile
+	}
+
+	if c.PositionsFile == "" {
+		c.PositionsFile = "./shm_positions.json"
+	}
+
+	if c.UniqueFile == "" {
+		c.UniqueFile = "./shm_unique.json"
+	}
+
+	if c.SequenceFile == "" {
+		c.SequenceFile = "./shm_sequence.json"
+	}
+
+	if c.StateDir != "" {
+		c.IdentityFile = c.inStateDir(c.IdentityFile)
+		if c.PositionsEnabled() {
+			c.PositionsFile = c.inStateDir(c.PositionsFile)
+		}
+		if c.UniqueFile != "none" {
+			c.UniqueFile = c.inStateDir(c.UniqueFile)
+		}
+		if c.SequenceFile != "none" {
+			c.SequenceFile = c.inStateDir(c.SequenceFile)
+		}
+		if c.Spool.Dir != "" {
+			c.Spool.Dir = c.inStateDir(c.Spool.Dir)
+		}
+	}
+
+	if c.Remote.Mode == "" {
+		c.Remote.Mode = RemoteMerge
+	}
+	if c.Remote.PollInterval == 0 {
+		c.Remote.PollInterval = DefaultRemotePollInterval
+	}
+	c.Remote.CacheFile = c.remoteCacheFile()
+
+	if c.File.Path == "" {
+		c.File.Path = DefaultFileOutputPath
+	}
+	if c.StateDir != "" {
+		c.File.Path = c.inStateDir(c.File.Path)
+	}
+	if c.File.MaxBytes == 0 {
+		c.File.MaxBytes = DefaultFileOutputMaxBytes
+	}
+	if c.File.MaxFiles == 0 {
+		c.File.MaxFiles = DefaultFileOutputMaxFiles
+	}
+
+	if c.Interval == 0 {
+		c.Interval = 60 * time.Second
+	}
+
+	if c.Environment == "" {
+		c.Environment = "production"
+	}
+
+	if c.RescanInterval == 0 {
+		c.RescanInterval = DefaultRescanInterval
+	}
+
+	if c.VersionCheckInterval == 0 {
+		c.VersionCheckInterval = DefaultVersionCheckInterval
+	}
+
+	if c.History == 0 {
+		c.History = DefaultHistory
+	}
+
+	if c.MaxPayloadSize == 0 {
+		c.MaxPayloadSize = DefaultMaxPayloadSize
+	}
+
+	if c.SnapshotFormat == "" {
+		c.SnapshotFormat = SnapshotFormatMap
+	}
+	if c.IdentityEncryption.Mode == "" {
+		c.IdentityEncryption.Mode = IdentityEncryptionNone
+	}
+	if c.SnapshotTimestamp == "" {
+		c.SnapshotTimestamp = SnapshotTimestampEnd
+	}
+
+	if len(c.Outputs) == 0 {
+		if c.Output == "" {
+			c.Output = OutputSHM
+		}
+		c.Outputs = []string{c.Output}
+	}
+	if c.StatsD.Address == "" {
+		c.StatsD.Address = DefaultStatsDAddress
+	}
+	if c.Kafka.Key == "" {
+		c.Kafka.Key = KafkaKeyInstanceID
+	}
+	if c.Kafka.Compression == "" {
+		c.Kafka.Compression = KafkaCompressionNone
+	}
+	if c.Kafka.Acks == "" {
+		c.Kafka.Acks = KafkaAcksAll
+	}
+	if c.Kafka.Timeout == 0 {
+		c.Kafka.Timeout = DefaultKafkaTimeout
+	}
+
+	if c.HTTP.Timeout == 0 {
+		c.HTTP.Timeout = DefaultHTTPTimeout
+	}
+
+	if c.HTTP.IdleConnTimeout == 0 {
+		c.HTTP.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+
+	if c.HTTP.MaxIdleConnsPerHost == 0 {
+		c.HTTP.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+
+	if c.HTTP.KeepAlive == 0 {
+		c.HTTP.KeepAlive = DefaultKeepAlive
+	}
+
+	if c.HTTP.RetryBackoff == 0 {
+		c.HTTP.RetryBackoff = DefaultRetryBackoff
+	}
+
+	if c.Retry.InitialBackoff == 0 {
+		c.Retry.InitialBackoff = DefaultInitialBackoff
+	}
+
+	if c.Retry.MaxBackoff == 0 {
+		c.Retry.MaxBackoff = DefaultMaxBackoff
+	}
+
+	if c.Spool.MaxAge == 0 {
+		c.Spool.MaxAge = DefaultSpoolMaxAge
+	}
+
+	if c.Spool.MaxBytes == 0 {
+		c.Spool.MaxBytes = DefaultSpoolMaxBytes
+	}
+
+	if c.Spool.MaxSnapshots == 0 {
+		c.Spool.MaxSnapshots = DefaultSpoolMaxSnapshots
+	}
+
+	for i := range c.Sources {
+		for j := range c.Sources[i].Metrics {
+			m := &c.Sources[i].Metrics[j]
+			if m.Name != "" {
+				m.Name = c.Sources[i].MetricPrefix + m.Name
+			}
+			if len(m.Labels) > 0 && m.MaxSeries == 0 {
+				m.MaxSeries = DefaultMaxSeries
+			}
+			if m.Type == "gauge" && len(m.Labels) > 0 && m.SeriesTTL == 0 {
+				m.SeriesTTL = DefaultSeriesTTL
+			}
+			if m.Burst != nil && m.Burst.Window == 0 {
+				m.Burst.Window = DefaultBurstWindow
+			}
+		}
+
+		if ml := c.Sources[i].Multiline; ml != nil {
+			if ml.MaxLines == 0 {
+				ml.MaxLines = DefaultMultilineMaxLines
+			}
+			if ml.Timeout == 0 {
+				ml.Timeout = DefaultMultilineTimeout
+			}
+		}
+
+		if ts := c.Sources[i].Timestamp; ts != nil {
+			if ts.Layout == "" {
+				ts.Layout = TimestampRFC3339
+			}
+			if ts.Lateness == 0 {
+				ts.Lateness = c.Interval
+			}
+		}
+
+		if csv := c.Sources[i].CSV; csv != nil && csv.Delimiter == "" {
+			csv.Delimiter = ","
+		}
+
+		if u := c.Sources[i].Unmatched; u != nil {
+			if u.File != "" {
+				u.File = c.inStateDir(u.File)
+			}
+			if u.MaxBytes == 0 {
+				u.MaxBytes = DefaultUnmatchedMaxBytes
+			}
+		}
+
+		c.Sources[i].podMetadata = c.KubernetesMetadata.IsEnabled() && !c.Sources[i].IsKubernetes()
+
+		if c.Sources[i].IsGELF() {
+			if c.Sources[i].GELF == nil {
+				c.Sources[i].GELF = &GELFConfig{}
+			}
+			if c.Sources[i].GELF.Listen == "" {
+				c.Sources[i].GELF.Listen = DefaultGELFListen
+			}
+		}
+
+		if k := c.Sources[i].Kubernetes; k != nil {
+			if k.NodeName == "" {
+				k.NodeName = os.Getenv("NODE_NAME")
+			}
+			if k.LogsDir == "" {
+				k.LogsDir = DefaultKubernetesLogsDir
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validate validates the configuration.
+func (c *Config) Validate() error {
+	if c.ServerURL == "" && c.UsesServer() {
+		return fmt.Errorf("server_url is required")
+	}
+
+	if c.AppName == "" {
+		return fmt.Errorf("app_name is required")
+	}
+
+	if c.AppVersion == "" && c.UsesServer() {
+		return fmt.Errorf("app_version is required")
+	}
+
+	if c.Output != "" && len(c.Outputs) > 0 && !slices.Equal(c.Outputs, []string{c.Output}) {
+		return fmt.Errorf("output and outputs are mutually exclusive")
+	}
+	for i, out := range c.OutputNames() {
+		if slices.Contains(c.OutputNames()[:i], out) {
+			return fmt.Errorf("output %s is listed twice", out)
+		}
+		if err := c.validateOutput(out); err != nil {
+			return err
+		}
+	}
+
+	if c.Interval < time.Second {
+		return fmt.Errorf("interval must be at least 1 second")
+	}
+
+	for name := range c.Tags {
+		if name == "" {
+			return fmt.Errorf("tags: a tag name is empty")
+		}
+	}
+
+	if c.RescanInterval < time.Second {
+		return fmt.Errorf("rescan_interval must be at least 1 second")
+	}
+
+	if c.VersionCheckInterval > 0 && c.VersionCheckInterval < time.Minute {
+		return fmt.Errorf("version_check_interval must be at least 1 minute, or negative to disable")
+	}
+
+	if c.MaxOpenFiles < 0 {
+		return fmt.Errorf("max_open_files must not be negative")
+	}
+
+	if c.MaxPayloadSize < MinMaxPayloadSize {
+		return fmt.Errorf("max_payload_size must be at least %d bytes", MinMaxPayloadSize)
+	}
+
+	if c.SnapshotFormat != SnapshotFormatMap && c.SnapshotFormat != SnapshotFormatStructured {
+		return fmt.Errorf("snapshot_format must be %s or %s, got '%s'", SnapshotFormatMap, SnapshotFormatStructured, c.SnapshotFormat)
+	}
+	if c.SnapshotTimestamp != SnapshotTimestampEnd && c.SnapshotTimestamp != SnapshotTimestampStart {
+		return fmt.Errorf("snapshot_timestamp must be %s or %s, got '%s'", SnapshotTimestampEnd, SnapshotTimestampStart, c.SnapshotTimestamp)
+	}
+
+	if err := c.HTTP.Validate(); err != nil {
+		return fmt.Errorf("http: %w", err)
+	}
+
+	if err := c.Auth.Validate(); err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
+
+	if err := c.IdentityEncryption.Validate(); err != nil {
+		return fmt.Errorf("identity_encryption: %w", err)
+	}
+
+	if err := c.TLS.Validate(); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+
+	if c.Retry.InitialBackoff < 0 || c.Retry.MaxBackoff < c.Retry.InitialBackoff {
+		return fmt.Errorf("retry: max_backoff must be at least initial_backoff")
+	}
+
+	if c.Spool.MaxAge < 0 || c.Spool.MaxBytes < 0 || c.Spool.MaxSnapshots < 0 {
+		return fmt.Errorf("spool: limits must not be negative")
+	}
+
+	if c.ListenAddr != "" {
+		if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+			return fmt.Errorf("invalid listen_addr: %w", err)
+		}
+	}
+
+	for _, name := range c.profileNames() {
+		p := c.Profiles[name]
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("profiles.%s: %w", name, err)
+		}
+	}
+
+	if c.Remote.Enabled {
+		if err := c.Remote.Validate(); err != nil {
+			return fmt.Errorf("remote_config: %w", err)
+		}
+	}
+
+	// Sources may all come from the server
+	if len(c.Sources) == 0 && !c.Remote.Enabled {
+		return fmt.Errorf("at least one source is required")
+	}
+
+	for i, src := range c.Sources {
+		if err := src.Validate(); err != nil {
+			if src.origin != "" {
+				return fmt.Errorf("source[%d] (%s): %w", i, src.origin, err)
+			}
+			return fmt.Errorf("source[%d]: %w", i, err)
+		}
+	}
+
+	if err := c.validateMetricNames(); err != nil {
+		return err
+	}
+	return c.validateDerived()
+}
+
+// validateDerived checks that derived metrics only refer to enabled metrics
+// read from lines. A reference is a metric name, or for percentile metrics
+// "<name>.count", "<name>.sum" or "<name>.<quantile>", e.g. "latency.p95".
+func (c *Config) validateDerived() error {
+	metrics := make(map[string]*Metric)
+	for i := range c.Sources {
+		for j := range c.Sources[i].Metrics {
+			m := &c.Sources[i].Metrics[j]
+			if m.IsEnabled() {
+				metrics[m.Name] = m
+			}
+		}
+	}
+
+	for i := range c.Sources {
+		for _, m := range c.Sources[i].Metrics {
+			if m.Type != "derived" || !m.IsEnabled() {
+				continue
+			}
+			e, err := expr.Parse(m.Expression)
+			if err != nil {
+				return fmt.Errorf("source[%d]: metric %s: invalid expression: %w", i, m.Name, err)
+			}
+			for _, ref := range e.Vars() {
+				if err := checkReference(metrics, ref); err != nil {
+					return fmt.Errorf("source[%d]: metric %s: %w", i, m.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkReference checks a reference of a derived metric against the
+// enabled metrics. The name of a percentile metric and its entry may both
+// contain dots, e.g. "latency.p99.9": the longest name is matched first.
+func checkReference(metrics map[string]*Metric, ref string) error {
+	m, ok := metrics[ref]
+	if !ok {
+		for i := strings.LastIndexByte(ref, '.'); i > 0; i = strings.LastIndexByte(ref[:i], '.') {
+			if base, ok := metrics[ref[:i]]; ok && base.Type == "percentile" {
+				if len(base.Labels) > 0 {
+					return fmt.Errorf("expression refers to %s of labeled metric %s", ref[i+1:], base.Name)
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("expression refers to unknown or disabled metric %s", ref)
+	}
+
+	switch m.Type {
+	case "derived":
+		return fmt.Errorf("expression refers to derived metric %s", ref)
+	case "percentile":
+		return fmt.Errorf("expression refers to percentile metric %s, use %s.count, %s.sum or a quantile such as %s.p95", ref, ref, ref, ref)
+	}
+	return nil
+}
+
+// validateMetricNames checks the metrics defined under the same name,
+// which share their aggregated values: they must agree on type and labels,
+// and are rejected altogether with UniqueMetricNames. Disabled metrics are
+// ignored.
+func (c *Config) validateMetricNames() error {
+	type definition struct {
+		source int
+		metric *Metric
+	}
+	defined := make(map[string]definition)
+
+	for i := range c.Sources {
+		for j := range c.Sources[i].Metrics {
+			m := &c.Sources[i].Metrics[j]
+			if !m.IsEnabled() {
+				continue
+			}
+			prev, ok := defined[m.Name]
+			if !ok {
+				defined[m.Name] = definition{i, m}
+				continue
+			}
+
+			switch {
+			case c.UniqueMetricNames && prev.source == i:
+				return fmt.Errorf("source[%d]: metric %s is defined twice (unique_metric_names)", i, m.Name)
+			case c.UniqueMetricNames:
+				return fmt.Errorf("source[%d]: metric %s is already defined by source[%d] (unique_metric_names); set a metric_prefix on either source", i, m.Name, prev.source)
+			case prev.metric.Type != m.Type || !slices.Equal(prev.metric.Labels, m.Labels):
+				if prev.source == i {
+					return fmt.Errorf("source[%d]: metric %s is defined twice with another type or labels", i, m.Name)
+				}
+				return fmt.Errorf("source[%d]: metric %s is already defined by source[%d] with another type or labels; set a metric_prefix on either source", i, m.Name, prev.source)
+			}
+		}
+	}
+	return nil
+}
+
+// RetryConfig holds the backoff settings for undelivered snapshots.
+type RetryConfig struct {
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+}
+
+// SpoolConfig holds the settings of the undelivered snapshot queue.
+// Without a directory, the queue is kept in memory and lost on restart.
+type SpoolConfig struct {
+	Dir          string        `yaml:"dir"`
+	MaxAge       time.Duration `yaml:"max_age"`
+	MaxBytes     int64         `yaml:"max_bytes"`
+	MaxSnapshots int           `yaml:"max_snapshots"`
+}
+
+// Validate validates the HTTP client settings.
+func (h *HTTPConfig) Validate() error {
+	if h.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+
+	if h.IdleConnTimeout < 0 {
+		return fmt.Errorf("idle_conn_timeout must not be negative")
+	}
+
+	if h.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("max_idle_conns_per_host must not be negative")
+	}
+
+	if h.KeepAlive < 0 {
+		return fmt.Errorf("keep_alive must not be negative")
+	}
+
+	if h.Retries < 0 || h.Retries > MaxHTTPRetries {
+		return fmt.Errorf("retries must be between 0 and %d", MaxHTTPRetries)
+	}
+
+	if h.RetryBackoff < 0 {
+		return fmt.Errorf("retry_backoff must not be negative")
+	}
+
+	if h.ProxyURL != "" {
+		u, err := url.Parse(h.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid proxy_url: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("invalid proxy_url: scheme must be http, https or socks5")
+		}
+		if u.Host == "" {
+			return fmt.Errorf("invalid proxy_url: missing host")
+		}
+	}
+
+	return nil
+}
+
+// Inherit returns the settings, those left unset taken from base. Set
+// boolean settings cannot be unset.
+func (h HTTPConfig) Inherit(base HTTPConfig) HTTPConfig {
+	if h.Timeout == 0 {
+		h.Timeout = base.Timeout
+	}
+	if h.IdleConnTimeout == 0 {
+		h.IdleConnTimeout = base.IdleConnTimeout
+	}
+	if h.MaxIdleConnsPerHost == 0 {
+		h.MaxIdleConnsPerHost = base.MaxIdleConnsPerHost
+	}
+	if h.KeepAlive == 0 {
+		h.KeepAlive = base.KeepAlive
+	}
+	if h.Retries == 0 {
+		h.Retries = base.Retries
+	}
+	if h.RetryBackoff == 0 {
+		h.RetryBackoff = base.RetryBackoff
+	}
+	if h.ProxyURL == "" {
+		h.ProxyURL = base.ProxyURL
+	}
+	h.DisableHTTP2 = h.DisableHTTP2 || base.DisableHTTP2
+	h.DisableKeepAlives = h.DisableKeepAlives || base.DisableKeepAlives
+	h.Trace = h.Trace || base.Trace
+	return h
+}
+
+// validateOutput validates an output name and its settings.
+func (c *Config) validateOutput(name string) error {
+	switch name {
+	case OutputSHM:
+	case OutputOTLP:
+		if err := c.OTLP.Validate(); err != nil {
+			return fmt.Errorf("otlp: %w", err)
+		}
+	case OutputStatsD:
+		if err := c.StatsD.Validate(); err != nil {
+			return fmt.Errorf("statsd: %w", err)
+		}
+	case OutputInfluxDB:
+		if err := c.InfluxDB.Validate(); err != nil {
+			return fmt.Errorf("influxdb: %w", err)
+		}
+	case OutputKafka:
+		if err := c.Kafka.Validate(); err != nil {
+			return fmt.Errorf("kafka: %w", err)
+		}
+	case OutputFile:
+		if err := c.File.Validate(); err != nil {
+			return fmt.Errorf("file: %w", err)
+		}
+	default:
+		return unknownOutput(name)
+	}
+	return nil
+}
+
+// checkOutputName checks that name is one of the outputs.
+func checkOutputName(name string) error {
+	switch name {
+	case OutputSHM, OutputOTLP, OutputStatsD, OutputInfluxDB, OutputKafka, OutputFile:
+		return nil
+	}
+	return unknownOutput(name)
+}
+
+// unknownOutput returns the error for an output that does not exist.
+func unknownOutput(name string) error {
+	return fmt.Errorf("output must be one of %s, %s, %s, %s, %s or %s, got '%s'",
+		OutputSHM, OutputOTLP, OutputStatsD, OutputInfluxDB, OutputKafka, OutputFile, name)
+}
+
+// Validate validates the OTLP output settings.
+func (o *OTLPConfig) Validate() error {
+	if o.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+	u, err := url.Parse(o.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid endpoint: scheme must be http or https")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid endpoint: missing host")
+	}
+	for name := range o.Headers {
+		if name == "" || strings.ContainsAny(name, " \t:\r\n") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	if err := o.HTTP.Validate(); err != nil {
+		return fmt.Errorf("http: %w", err)
+	}
+	return nil
+}
+
+// Validate validates the InfluxDB output settings.
+func (i *InfluxDBConfig) Validate() error {
+	if i.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	u, err := url.Parse(i.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid url: scheme must be http or https")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid url: missing host")
+	}
+	if i.Token != "" && i.TokenFile != "" {
+		return fmt.Errorf("token and token_file are mutually exclusive")
+	}
+	if err := i.HTTP.Validate(); err != nil {
+		return fmt.Errorf("http: %w", err)
+	}
+	return nil
+}
+
+// Validate validates the Kafka output settings.
+func (k *KafkaConfig) Validate() error {
+	if len(k.Brokers) == 0 {
+		return fmt.Errorf("brokers is required")
+	}
+	for _, broker := range k.Brokers {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			return fmt.Errorf("invalid broker %q: %w", broker, err)
+		}
+	}
+	if k.Topic == "" {
+		return fmt.Errorf("topic is required")
+	}
+	for _, topic := range []string{k.Topic, k.EventsTopic} {
+		if topic != "" && !validKafkaTopic(topic) {
+			return fmt.Errorf("invalid topic %q: use up to 249 letters, digits, '.', '_' and '-'", topic)
+		}
+	}
+	if k.EventsTopic == k.Topic {
+		return fmt.Errorf("events_topic must differ from topic")
+	}
+	switch k.Key {
+	case KafkaKeyInstanceID, KafkaKeyAppName, KafkaKeyNone:
+	default:
+		return fmt.Errorf("key must be one of %s, %s or %s, got '%s'",
+			KafkaKeyInstanceID, KafkaKeyAppName, KafkaKeyNone, k.Key)
+	}
+	switch k.Compression {
+	case KafkaCompressionNone, KafkaCompressionGzip, KafkaCompressionZstd:
+	default:
+		return fmt.Errorf("compression must be one of %s, %s or %s, got '%s'",
+			KafkaCompressionNone, KafkaCompressionGzip, KafkaCompressionZstd, k.Compression)
+	}
+	switch k.Acks {
+	case KafkaAcksAll, KafkaAcksLeader, KafkaAcksNone:
+	default:
+		return fmt.Errorf("acks must be one of %s, %s or %s, got '%s'",
+			KafkaAcksAll, KafkaAcksLeader, KafkaAcksNone, k.Acks)
+	}
+	if k.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	return nil
+}
+
+// Validate validates the file output settings.
+func (f *FileOutputConfig) Validate() error {
+	if f.MaxBytes < 0 {
+		return fmt.Errorf("max_bytes must not be negative")
+	}
+	if f.MaxFiles < 0 {
+		return fmt.Errorf("max_files must not be negative")
+	}
+	return nil
+}
+
+// validKafkaTopic reports whether name is a legal Kafka topic name.
+func validKafkaTopic(name string) bool {
+	if len(name) > 249 || name == "." || name == ".." {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate validates the StatsD output settings.
+func (s *StatsDConfig) Validate() error {
+	if _, _, err := net.SplitHostPort(s.Address); err != nil {
+		return fmt.Errorf("invalid address: %w", err)
+	}
+	if len(s.Tags) > 0 && !s.DogStatsD {
+		return fmt.Errorf("tags require dogstatsd")
+	}
+	return nil
+}
+
+// Validate validates the authentication settings.
+func (a *AuthConfig) Validate() error {
+	if a.Token != "" && a.TokenFile != "" {
+		return fmt.Errorf("token and token_file are mutually exclusive")
+	}
+	if a.Header != "" && strings.ContainsAny(a.Header, " \t:\r\n") {
+		return fmt.Errorf("invalid header name %q", a.Header)
+	}
+	return nil
+}
+
+// Validate validates the identity encryption settings.
+func (e *IdentityEncryptionConfig) Validate() error {
+	switch e.Mode {
+	case IdentityEncryptionPassphrase:
+		if (e.PassphraseEnv == "") == (e.PassphraseFile == "") {
+			return fmt.Errorf("mode %s requires exactly one of passphrase_env and passphrase_file", e.Mode)
+		}
+	case IdentityEncryptionNone, IdentityEncryptionDPAPI:
+		if e.PassphraseEnv != "" || e.PassphraseFile != "" {
+			return fmt.Errorf("passphrase_env and passphrase_file only apply to mode %s", IdentityEncryptionPassphrase)
+		}
+	default:
+		return fmt.Errorf("mode must be %s, %s or %s, got '%s'", IdentityEncryptionNone, IdentityEncryptionPassphrase, IdentityEncryptionDPAPI, e.Mode)
+	}
+	return nil
+}
+
+// Validate validates the TLS settings.
+func (t *TLSConfig) Validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be set together")
+	}
+	return nil
+}
+
+// Validate validates a source configuration.
+func (s *Source) Validate() error {
+	switch s.Type {
+	case "", SourceFile:
+		if err := s.validateFile(); err != nil {
+			return err
+		}
+	case SourceJournald:
+		if err := s.validateJournald(); err != nil {
+			return err
+		}
+	case SourceKubernetes:
+		if err := s.validateKubernetes(); err != nil {
+			return err
+		}
+	case SourceGELF:
+		if err := s.validateGELF(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("type must be 'file', 'journald', 'kubernetes' or 'gelf', got '%s'", s.Type)
+	}
+
+	if s.Kubernetes != nil && s.Type != SourceKubernetes {
+		return fmt.Errorf("kubernetes is only valid for kubernetes sources")
+	}
+
+	if s.GELF != nil && s.Type != SourceGELF {
+		return fmt.Errorf("gelf is only valid for gelf sources")
+	}
+
+	if s.PathPattern != "" {
+		if err := s.validatePathPattern(); err != nil {
+			return err
+		}
+	}
+
+	if s.Format != "" {
+		if err := s.validateFormat(); err != nil {
+			return err
+		}
+	}
+
+	if s.Multiline != nil {
+		if s.IsJournald() || s.IsGELF() {
+			return fmt.Errorf("multiline is not supported for %s sources", s.Type)
+		}
+		if err := s.Multiline.Validate(); err != nil {
+			return fmt.Errorf("multiline: %w", err)
+		}
+	}
+
+	if s.SampleRate < 0 {
+		return fmt.Errorf("sample_rate must not be negative")
+	}
+
+	if s.Workers < 0 || s.Workers > MaxWorkers {
+		return fmt.Errorf("workers must be between 0 and %d, got %d", MaxWorkers, s.Workers)
+	}
+
+	if s.QueueSize < 0 {
+		return fmt.Errorf("queue_size must not be negative")
+	}
+
+	switch s.OnOverflow {
+	case "", OverflowBlock, OverflowDropOldest, OverflowDropNewest:
+	default:
+		return fmt.Errorf("on_overflow must be block, drop_oldest or drop_newest, got '%s'", s.OnOverflow)
+	}
+
+	if s.Unmatched != nil && s.Unmatched.MaxBytes < 0 {
+		return fmt.Errorf("unmatched: max_bytes must not be negative")
+	}
+
+	for _, name := range s.MappedFields() {
+		fm := s.MapFields[name]
+		if name == "" {
+			return fmt.Errorf("map_fields must not contain empty names")
+		}
+		if fm.Field == "" {
+			return fmt.Errorf("map_fields: %s: field is required", name)
+		}
+		if _, ok := s.MapFields[fm.Field]; ok && fm.Field != name {
+			return fmt.Errorf("map_fields: %s: field '%s' is itself mapped", name, fm.Field)
+		}
+		if err := fm.ValueMap.Validate(); err != nil {
+			return fmt.Errorf("map_fields: %s: %w", name, err)
+		}
+	}
+
+	if s.Filter != nil {
+		if err := s.Filter.Validate(); err != nil {
+			return fmt.Errorf("filter: %w", err)
+		}
+	}
+
+	if s.Prefilter != nil {
+		if err := s.Prefilter.Validate(); err != nil {
+			return fmt.Errorf("prefilter: %w", err)
+		}
+	}
+
+	if s.Timestamp != nil {
+		if err := s.Timestamp.Validate(); err != nil {
+			return fmt.Errorf("timestamp: %w", err)
+		}
+	}
+
+	if len(s.Metrics) == 0 {
+		return fmt.Errorf("at least one metric is required")
+	}
+
+	for i, m := range s.Metrics {
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("metric[%d]: %w", i, err)
+		}
+		if s.Timestamp != nil && m.UniqueWindow != "" {
+			return fmt.Errorf("metric %s: unique_window is not supported with a source timestamp", m.Name)
+		}
+	}
+
+	if err := s.validateFieldFilters(); err != nil {
+		return err
+	}
+
+	return s.validateRegexFields()
+}
+
+// validateFile validates the settings of a file source.
+func (s *Source) validateFile() error {
+	if s.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+
+	if IsGlob(s.Path) {
+		if _, err := filepath.Match(s.Path, ""); err != nil {
+			return fmt.Errorf("invalid glob pattern: %w", err)
+		}
+	}
+
+	if s.Format == "" {
+		return fmt.Errorf("format is required")
+	}
+
+	if len(s.Units) > 0 {
+		return fmt.Errorf("units is only valid for journald sources")
+	}
+
+	return nil
 }
 
-// Metric represents a metric extraction configuration.
-type Metric struct {
-	Name    string  `yaml:"name"`
-	Type    string  `yaml:"type"` // "counter", "gauge", "sum", "set"
-	Match   *Match  `yaml:"match,omitempty"`
-	Extract *Extract `yaml:"extract,omitempty"`
+// validatePathPattern checks that the path pattern compiles and captures
+// fields, and that the source reads files.
+func (s *Source) validatePathPattern() error {
+	if s.IsJournald() || s.IsGELF() || s.IsStdin() {
+		return fmt.Errorf("path_pattern is only valid for sources reading files")
+	}
+	re, err := regexp.Compile(s.PathPattern)
+	if err != nil {
+		return fmt.Errorf("invalid path_pattern: %w", err)
+	}
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("path_pattern has no named group, e.g. (?P<vhost>[^/]+)")
 }
 
-// Match represents a matching condition.
-type Match struct {
-	Field    string   `yaml:"field"`
-	Equals   string   `yaml:"equals,omitempty"`
-	In       []string `yaml:"in,omitempty"`
-	Regex    string   `yaml:"regex,omitempty"`
-	Contains string   `yaml:"contains,omitempty"`
+// PathFields returns the fields set on lines by the path pattern.
+func (s *Source) PathFields() []string {
+	if s.PathPattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(s.PathPattern)
+	if err != nil {
+		return nil
+	}
+	var fields []string
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			fields = append(fields, name)
+		}
+	}
+	return fields
 }
 
-// Extract represents a field extraction configuration.
-type Extract struct {
-	Field string `yaml:"field"`
-}
+// validateJournald validates the settings of a journald source.
+// The format is optional: when set, it is used to parse MESSAGE.
+func (s *Source) validateJournald() error {
+	if s.Path != "" {
+		return fmt.Errorf("path is not used by journald sources")
+	}
 
-// Load reads and parses a configuration file.
-func Load(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("reading config file: %w", err)
+	for _, unit := range s.Units {
+		if unit == "" {
+			return fmt.Errorf("units must not be empty")
+		}
 	}
 
-	return Parse(data)
+	return nil
 }
 
-// Parse parses configuration from YAML data.
-func Parse(data []byte) (*Config, error) {
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("parsing YAML: %w", err)
+// validateGELF validates the settings of a gelf source. The format is
+// optional: when set, it is used to parse short_message.
+func (s *Source) validateGELF() error {
+	if s.Path != "" {
+		return fmt.Errorf("path is not used by gelf sources")
 	}
 
-	if err := cfg.setDefaults(); err != nil {
-		return nil, err
+	if len(s.Units) > 0 {
+		return fmt.Errorf("units is only valid for journald sources")
 	}
 
-	if err := cfg.Validate(); err != nil {
-		return nil, err
+	if s.GELF != nil && s.GELF.Listen != "" {
+		if _, _, err := net.SplitHostPort(s.GELF.Listen); err != nil {
+			return fmt.Errorf("gelf: invalid listen address: %w", err)
+		}
 	}
 
-	return &cfg, nil
+	return nil
 }
 
-// setDefaults sets default values for configuration fields.
-func (c *Config) setDefaults() error {
-	if c.IdentityFile == "" {
-		c.IdentityFile = "./shm_identity.json"
+// validateKubernetes validates the settings of a kubernetes source.
+func (s *Source) validateKubernetes() error {
+	if s.Path != "" {
+		return fmt.Errorf("path is not used by kubernetes sources")
 	}
 
-	if c.Interval == 0 {
-		c.Interval = 60 * time.Second
+	if s.Format == "" {
+		return fmt.Errorf("format is required")
 	}
 
-	if c.Environment == "" {
-		c.Environment = "production"
+	if len(s.Units) > 0 {
+		return fmt.Errorf("units is only valid for journald sources")
 	}
 
 	return nil
 }
 
-// Validate validates the configuration.
-func (c *Config) Validate() error {
-	if c.ServerURL == "" {
-		return fmt.Errorf("server_url is required")
+// validateFormat validates the format and pattern of a source.
+func (s *Source) validateFormat() error {
+	switch s.Format {
+	case "json", "regex", "grok", "csv", "access_log", "logfmt", "syslog":
+	default:
+		return fmt.Errorf("format must be 'json', 'regex', 'grok', 'csv', 'access_log', 'logfmt' or 'syslog', got '%s'", s.Format)
 	}
 
-	if c.AppName == "" {
-		return fmt.Errorf("app_name is required")
+	if s.Format == "access_log" {
+		if s.Preset == "" {
+			return fmt.Errorf("preset is required for access_log format, one of %s", strings.Join(parser.AccessLogPresetNames(), ", "))
+		}
+		if s.Pattern != "" {
+			return fmt.Errorf("pattern is not used by access_log format, the preset sets it")
+		}
+	} else if s.Preset != "" {
+		return fmt.Errorf("preset is only valid for access_log format")
 	}
 
-	if c.AppVersion == "" {
-		return fmt.Errorf("app_version is required")
+	if s.Format == "csv" {
+		if s.CSV == nil {
+			return fmt.Errorf("csv is required for csv format, with columns or header")
+		}
+		if err := s.CSV.Validate(); err != nil {
+			return fmt.Errorf("csv: %w", err)
+		}
+	} else if s.CSV != nil {
+		return fmt.Errorf("csv is only valid for csv format")
 	}
 
-	if c.Interval < time.Second {
-		return fmt.Errorf("interval must be at least 1 second")
+	if (s.Format == "regex" || s.Format == "grok") && s.Pattern == "" {
+		return fmt.Errorf("pattern is required for %s format", s.Format)
 	}
 
-	if len(c.Sources) == 0 {
-		return fmt.Errorf("at least one source is required")
+	if len(s.GrokPatterns) > 0 && s.Format != "grok" {
+		return fmt.Errorf("grok_patterns is only valid for grok format")
 	}
 
-	for i, src := range c.Sources {
-		if err := src.Validate(); err != nil {
-			return fmt.Errorf("source[%d]: %w", i, err)
-		}
+	if _, err := s.RegexPattern(); err != nil {
+		return err
 	}
 
 	return nil
 }
 
-// Validate validates a source configuration.
-func (s *Source) Validate() error {
-	if s.Path == "" {
-		return fmt.Errorf("path is required")
+// RegexPattern returns the regular expression lines of a regex, grok or
+// access_log source are parsed with, with the grok patterns expanded. It
+// returns "" for other formats.
+func (s *Source) RegexPattern() (string, error) {
+	pattern := s.Pattern
+	switch s.Format {
+	case "regex":
+	case "grok":
+		expanded, err := parser.ExpandGrok(s.Pattern, s.GrokPatterns)
+		if err != nil {
+			return "", fmt.Errorf("invalid grok pattern: %w", err)
+		}
+		pattern = expanded
+	case "access_log":
+		expanded, err := parser.AccessLogPattern(s.Preset)
+		if err != nil {
+			return "", err
+		}
+		pattern = expanded
+	default:
+		return "", nil
 	}
 
-	if s.Format == "" {
-		return fmt.Errorf("format is required")
+	if _, err := regexp.Compile(pattern); err != nil {
+		return "", fmt.Errorf("invalid %s pattern: %w", s.Format, err)
+	}
+	return pattern, nil
+}
+
+// HostMetadataEnabled reports whether host facts are sent to the server.
+func (c *Config) HostMetadataEnabled() bool {
+	return c.HostMetadata == nil || *c.HostMetadata
+}
+
+// SelfMetricsEnabled reports whether self metrics are added to snapshots.
+func (c *Config) SelfMetricsEnabled() bool {
+	return c.SelfMetrics == nil || *c.SelfMetrics
+}
+
+// inStateDir resolves a relative path against the state directory.
+func (c *Config) inStateDir(path string) string {
+	if filepath.IsAbs(path) {
+		return path
 	}
+	return filepath.Join(c.StateDir, path)
+}
 
-	if s.Format != "json" && s.Format != "regex" {
-		return fmt.Errorf("format must be 'json' or 'regex', got '%s'", s.Format)
+// OutputNames returns the outputs snapshots are delivered to: Outputs,
+// or Output alone, the server by default.
+func (c *Config) OutputNames() []string {
+	switch {
+	case len(c.Outputs) > 0:
+		return c.Outputs
+	case c.Output != "":
+		return []string{c.Output}
+	default:
+		return []string{OutputSHM}
 	}
+}
 
-	if s.Format == "regex" && s.Pattern == "" {
-		return fmt.Errorf("pattern is required for regex format")
+// HasOutput reports whether snapshots are delivered to an output: when it
+// is one of OutputNames, but for the SHM server when offline.
+func (c *Config) HasOutput(name string) bool {
+	if c.Offline && name == OutputSHM {
+		return false
 	}
+	return slices.Contains(c.OutputNames(), name)
+}
+
+// UsesServer reports whether snapshots are delivered to the SHM server:
+// unless offline or only other outputs are selected.
+func (c *Config) UsesServer() bool {
+	return c.HasOutput(OutputSHM)
+}
+
+// RemoteEnabled reports whether sources are fetched from the SHM server:
+// when enabled and delivering to it.
+func (c *Config) RemoteEnabled() bool {
+	return c.Remote.Enabled && c.UsesServer()
+}
 
-	if s.Format == "regex" {
-		if _, err := regexp.Compile(s.Pattern); err != nil {
-			return fmt.Errorf("invalid regex pattern: %w", err)
+// UsesIdentity reports whether the agent loads its identity file: to
+// deliver to the server, or to identify itself in kafka messages.
+func (c *Config) UsesIdentity() bool {
+	return c.UsesServer() || c.HasOutput(OutputKafka)
+}
+
+// WritableDirs returns the directories the agent writes to: those of the
+// identity file (when it uses one), the positions file and unmatched lines
+// files, and the spool directory, without duplicates.
+func (c *Config) WritableDirs() []string {
+	var dirs []string
+	add := func(dir string) {
+		dir = filepath.Clean(dir)
+		for _, d := range dirs {
+			if d == dir {
+				return
+			}
 		}
+		dirs = append(dirs, dir)
 	}
 
-	if len(s.Metrics) == 0 {
-		return fmt.Errorf("at least one metric is required")
+	if c.StateDir != "" {
+		add(c.StateDir)
+	}
+	if c.UsesIdentity() {
+		add(filepath.Dir(c.IdentityFile))
+	}
+	if c.PositionsEnabled() {
+		add(filepath.Dir(c.PositionsFile))
+	}
+	if c.UniqueFileEnabled() {
+		add(filepath.Dir(c.UniqueFile))
+	}
+	if c.SequenceFileEnabled() {
+		add(filepath.Dir(c.SequenceFile))
 	}
+	if c.Spool.Dir != "" {
+		add(c.Spool.Dir)
+	}
+	if c.HasOutput(OutputFile) {
+		add(filepath.Dir(c.File.Path))
+	}
+	if c.RemoteEnabled() {
+		add(filepath.Dir(c.Remote.CacheFile))
+	}
+	for _, src := range c.Sources {
+		if src.Unmatched != nil && src.Unmatched.File != "" {
+			add(filepath.Dir(src.Unmatched.File))
+		}
+	}
+	return dirs
+}
 
-	for i, m := range s.Metrics {
-		if err := m.Validate(); err != nil {
-			return fmt.Errorf("metric[%d]: %w", i, err)
+// IsEnabled reports whether the metric is turned on.
+func (m *Metric) IsEnabled() bool {
+	return m.Enabled == nil || *m.Enabled
+}
+
+// dropDisabled removes the metrics turned off with enabled: false. A source
+// left without metrics is kept, so source indexes do not change.
+func (c *Config) dropDisabled() {
+	for i := range c.Sources {
+		src := &c.Sources[i]
+		metrics := src.Metrics[:0]
+		for _, m := range src.Metrics {
+			if m.IsEnabled() {
+				metrics = append(metrics, m)
+			}
 		}
+		src.Metrics = metrics
 	}
+}
 
-	return nil
+// ShadowMetrics returns the names of the shadow metrics, nil when there
+// are none.
+func (c *Config) ShadowMetrics() map[string]bool {
+	var names map[string]bool
+	for _, src := range c.Sources {
+		for _, m := range src.Metrics {
+			if m.Shadow {
+				if names == nil {
+					names = make(map[string]bool)
+				}
+				names[m.Name] = true
+			}
+		}
+	}
+	return names
+}
+
+// PositionsEnabled reports whether file offsets are persisted.
+func (c *Config) PositionsEnabled() bool {
+	return c.PositionsFile != "" && c.PositionsFile != "none"
+}
+
+// SequenceFileEnabled reports whether the snapshot sequence is persisted:
+// snapshots are sent to the server and sequence_file is not "none".
+func (c *Config) SequenceFileEnabled() bool {
+	return c.SequenceFile != "" && c.SequenceFile != "none" && c.UsesServer()
+}
+
+// UniqueFileEnabled reports whether the values of set metrics with a
+// unique_window are persisted: some metric has one and unique_file is not
+// "none".
+func (c *Config) UniqueFileEnabled() bool {
+	if c.UniqueFile == "" || c.UniqueFile == "none" {
+		return false
+	}
+	for _, src := range c.Sources {
+		for _, m := range src.Metrics {
+			if m.UniqueWindow != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Queued reports whether the lines of the source wait in a queue for its
+// workers rather than being processed by the goroutine reading them.
+func (s *Source) Queued() bool {
+	return s.Workers > 1 || s.QueueSize > 0 || s.OnOverflow != ""
+}
+
+// QueueCapacity returns the size of the queue of the source.
+func (s *Source) QueueCapacity() int {
+	if s.QueueSize > 0 {
+		return s.QueueSize
+	}
+	return max(s.Workers, 1) * DefaultQueueSizePerWorker
+}
+
+// IsJournald reports whether the source reads from the systemd journal.
+func (s *Source) IsJournald() bool {
+	return s.Type == SourceJournald
+}
+
+// StdinPath is the source path that reads lines from standard input.
+const StdinPath = "-"
+
+// IsStdin reports whether the source reads lines from standard input.
+func (s *Source) IsStdin() bool {
+	return (s.Type == "" || s.Type == SourceFile) && s.Path == StdinPath
+}
+
+// IsGELF reports whether the source receives GELF messages.
+func (s *Source) IsGELF() bool {
+	return s.Type == SourceGELF
+}
+
+// IsKubernetes reports whether the source reads the logs of Kubernetes pods.
+func (s *Source) IsKubernetes() bool {
+	return s.Type == SourceKubernetes
+}
+
+// Location describes where the source reads from: its path, "journald"
+// followed by its units, "kubernetes" followed by its pod selection, or
+// "gelf" followed by its address.
+func (s *Source) Location() string {
+	if s.IsGELF() {
+		if s.GELF == nil || s.GELF.Listen == "" {
+			return SourceGELF + ":" + DefaultGELFListen
+		}
+		return SourceGELF + ":" + s.GELF.Listen
+	}
+	if s.IsKubernetes() {
+		loc := SourceKubernetes + ":"
+		if k := s.Kubernetes; k != nil && k.Namespace != "" {
+			loc += k.Namespace
+		} else {
+			loc += "*"
+		}
+		if k := s.Kubernetes; k != nil && k.Selector != "" {
+			loc += "/" + k.Selector
+		}
+		return loc
+	}
+	if s.IsStdin() {
+		return "stdin"
+	}
+	if !s.IsJournald() {
+		return s.Path
+	}
+	if len(s.Units) == 0 {
+		return SourceJournald
+	}
+	return SourceJournald + ":" + strings.Join(s.Units, ",")
+}
+
+// IsGlob reports whether path contains glob metacharacters.
+func IsGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
 }
 
 // Validate validates a metric configuration.
@@ -172,21 +2213,80 @@ func (m *Metric) Validate() error {
 		return fmt.Errorf("name is required")
 	}
 
+	if strings.HasPrefix(m.Name, SelfMetricPrefix) {
+		return fmt.Errorf("name must not start with '%s', which is reserved for the agent's own metrics", SelfMetricPrefix)
+	}
+
 	validTypes := map[string]bool{
-		"counter": true,
-		"gauge":   true,
-		"sum":     true,
-		"set":     true,
+		"counter":    true,
+		"counter_by": true,
+		"gauge":      true,
+		"sum":        true,
+		"set":        true,
+		"percentile": true,
+		"derived":    true,
 	}
 
 	if !validTypes[m.Type] {
-		return fmt.Errorf("type must be one of: counter, gauge, sum, set; got '%s'", m.Type)
+		return fmt.Errorf("type must be one of: counter, counter_by, gauge, sum, set, percentile, derived; got '%s'", m.Type)
 	}
 
-	// sum, gauge, and set require extract (unless counter with no value extraction)
-	if (m.Type == "sum" || m.Type == "gauge" || m.Type == "set") && m.Extract == nil {
+	if m.Type == "derived" {
+		return m.validateDerived()
+	}
+	if m.Expression != "" {
+		return fmt.Errorf("expression is only supported for type 'derived'")
+	}
+
+	// Every type but counter reads its value from the line
+	if m.Type != "counter" && m.Extract == nil {
 		return fmt.Errorf("extract is required for type '%s'", m.Type)
 	}
+	if m.Extract != nil {
+		if err := m.Extract.Validate(); err != nil {
+			return fmt.Errorf("extract: %w", err)
+		}
+	}
+
+	if m.Approximate && m.Type != "set" {
+		return fmt.Errorf("approximate is only supported for type 'set'")
+	}
+
+	if m.UniqueWindow != "" {
+		if m.Type != "set" {
+			return fmt.Errorf("unique_window is only supported for type 'set'")
+		}
+		switch m.UniqueWindow {
+		case "hour", "day", "week", "month":
+		default:
+			return fmt.Errorf("unique_window must be hour, day, week or month, got '%s'", m.UniqueWindow)
+		}
+	}
+
+	if m.SeriesTTL != 0 && (m.Type != "gauge" || len(m.Labels) == 0) {
+		return fmt.Errorf("series_ttl is only supported for type 'gauge' with labels")
+	}
+	if m.SeriesTTL < 0 {
+		return fmt.Errorf("series_ttl must not be negative")
+	}
+
+	if m.SampleRate < 0 {
+		return fmt.Errorf("sample_rate must not be negative")
+	}
+
+	if len(m.Quantiles) > 0 && m.Type != "percentile" {
+		return fmt.Errorf("quantiles are only supported for type 'percentile'")
+	}
+	seenQuantiles := make(map[float64]bool, len(m.Quantiles))
+	for _, q := range m.Quantiles {
+		if q < 0 || q > 1 {
+			return fmt.Errorf("quantiles must be between 0 and 1, got %v", q)
+		}
+		if seenQuantiles[q] {
+			return fmt.Errorf("duplicate quantile %v", q)
+		}
+		seenQuantiles[q] = true
+	}
 
 	if m.Match != nil {
 		if err := m.Match.Validate(); err != nil {
@@ -194,11 +2294,135 @@ func (m *Metric) Validate() error {
 		}
 	}
 
+	seen := make(map[string]bool, len(m.Labels))
+	for _, label := range m.Labels {
+		if label == "" {
+			return fmt.Errorf("labels must not be empty")
+		}
+		if seen[label] {
+			return fmt.Errorf("duplicate label '%s'", label)
+		}
+		seen[label] = true
+	}
+	if m.Type == "counter_by" && seen[m.Extract.Field] {
+		return fmt.Errorf("labels must not include '%s', the field counted", m.Extract.Field)
+	}
+
+	if m.MaxSeries < 0 {
+		return fmt.Errorf("max_series must not be negative")
+	}
+
+	if m.Burst != nil {
+		if m.Type == "percentile" {
+			return fmt.Errorf("burst is not supported for type 'percentile'")
+		}
+		if err := m.Burst.Validate(); err != nil {
+			return fmt.Errorf("burst: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Validate validates burst detection settings.
+func (b *BurstConfig) Validate() error {
+	if b.Factor <= 1 {
+		return fmt.Errorf("factor must be greater than 1")
+	}
+	if b.Window < 0 {
+		return fmt.Errorf("window must not be negative")
+	}
+	if b.MinValue < 0 {
+		return fmt.Errorf("min_value must not be negative")
+	}
+	return nil
+}
+
+// Validate validates a multiline configuration.
+func (m *MultilineConfig) Validate() error {
+	if m.StartPattern == "" {
+		return fmt.Errorf("start_pattern is required")
+	}
+	if _, err := regexp.Compile(m.StartPattern); err != nil {
+		return fmt.Errorf("invalid start_pattern: %w", err)
+	}
+	if m.MaxLines < 0 {
+		return fmt.Errorf("max_lines must not be negative")
+	}
+	if m.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	return nil
+}
+
+// Validate validates a prefilter configuration.
+func (f *PrefilterConfig) Validate() error {
+	if (f.Contains == "") == (f.Regex == "") {
+		return fmt.Errorf("exactly one of contains or regex is required")
+	}
+	if f.Regex != "" {
+		if _, err := regexp.Compile(f.Regex); err != nil {
+			return fmt.Errorf("invalid regex: %w", err)
+		}
+	}
+	return nil
+}
+
+// Validate validates a timestamp configuration.
+func (t *TimestampConfig) Validate() error {
+	if t.Field == "" {
+		return fmt.Errorf("field is required")
+	}
+	switch t.Layout {
+	case TimestampRFC3339, TimestampUnix, TimestampUnixMs:
+	default:
+		// A layout without any element of the reference time is a typo
+		if time.Now().Format(t.Layout) == t.Layout {
+			return fmt.Errorf("layout '%s' is not a Go time layout nor one of %s, %s or %s",
+				t.Layout, TimestampRFC3339, TimestampUnix, TimestampUnixMs)
+		}
+	}
+	if t.Lateness < 0 {
+		return fmt.Errorf("lateness must not be negative")
+	}
+	return nil
+}
+
+// Validate validates a CSV configuration.
+func (c *CSVConfig) Validate() error {
+	if utf8.RuneCountInString(c.Delimiter) != 1 {
+		return fmt.Errorf("delimiter must be a single character, got %q", c.Delimiter)
+	}
+	switch c.Comma() {
+	case '"', '\r', '\n', utf8.RuneError:
+		return fmt.Errorf("invalid delimiter %q", c.Delimiter)
+	}
+
+	if c.Header == (len(c.Columns) > 0) {
+		return fmt.Errorf("exactly one of columns and header is required")
+	}
+	seen := make(map[string]bool, len(c.Columns))
+	for _, col := range c.Columns {
+		if col != "" && seen[col] {
+			return fmt.Errorf("duplicate column '%s'", col)
+		}
+		seen[col] = true
+	}
 	return nil
 }
 
+// Comma returns the delimiter character.
+func (c *CSVConfig) Comma() rune {
+	r, _ := utf8.DecodeRuneInString(c.Delimiter)
+	return r
+}
+
 // Validate validates a match configuration.
 func (m *Match) Validate() error {
+	if m.IsComposite() {
+		return m.validateComposite()
+	}
+
 	if m.Field == "" {
 		return fmt.Errorf("field is required")
 	}
@@ -216,13 +2440,42 @@ func (m *Match) Validate() error {
 	if m.Contains != "" {
 		conditions++
 	}
+	if m.NotEquals != "" {
+		conditions++
+	}
+	if len(m.NotIn) > 0 {
+		conditions++
+	}
+	if m.NotContains != "" {
+		conditions++
+	}
+	if m.Exists != nil {
+		conditions++
+	}
+	for _, bound := range []*float64{m.Gt, m.Gte, m.Lt, m.Lte} {
+		if bound != nil {
+			conditions++
+		}
+	}
+	if m.Between != nil {
+		conditions++
+	}
 
 	if conditions == 0 {
-		return fmt.Errorf("at least one condition (equals, in, regex, contains) is required")
+		return fmt.Errorf("at least one condition (equals, in, regex, contains, not_equals, not_in, not_contains, exists, gt, gte, lt, lte, between) or composite (all, any, not) is required")
 	}
 
 	if conditions > 1 {
-		return fmt.Errorf("only one condition (equals, in, regex, contains) is allowed")
+		return fmt.Errorf("only one condition (equals, in, regex, contains, not_equals, not_in, not_contains, exists, gt, gte, lt, lte, between) is allowed; use all for ranges")
+	}
+
+	if m.Between != nil {
+		if len(m.Between) != 2 {
+			return fmt.Errorf("between requires exactly two values [min, max]")
+		}
+		if m.Between[0] > m.Between[1] {
+			return fmt.Errorf("between: min must not be greater than max")
+		}
 	}
 
 	if m.Regex != "" {
@@ -231,5 +2484,51 @@ func (m *Match) Validate() error {
 		}
 	}
 
+	if m.IgnoreCase && m.Equals == "" && len(m.In) == 0 && m.Contains == "" &&
+		m.NotEquals == "" && len(m.NotIn) == 0 && m.NotContains == "" {
+		return fmt.Errorf("ignore_case applies to equals, in, contains and their negations; prefix a regex with (?i)")
+	}
+
+	return nil
+}
+
+// validateComposite validates an all, any or not match.
+func (m *Match) validateComposite() error {
+	composites := 0
+	if len(m.All) > 0 {
+		composites++
+	}
+	if len(m.Any) > 0 {
+		composites++
+	}
+	if m.Not != nil {
+		composites++
+	}
+	if composites > 1 {
+		return fmt.Errorf("only one of all, any, not is allowed per match")
+	}
+
+	if m.Field != "" || m.Equals != "" || len(m.In) > 0 || m.Regex != "" || m.Contains != "" ||
+		m.NotEquals != "" || len(m.NotIn) > 0 || m.NotContains != "" || m.Exists != nil ||
+		m.IgnoreCase || m.Gt != nil || m.Gte != nil || m.Lt != nil || m.Lte != nil || m.Between != nil {
+		return fmt.Errorf("a composite match (all, any, not) cannot also have a field condition")
+	}
+
+	for i := range m.All {
+		if err := m.All[i].Validate(); err != nil {
+			return fmt.Errorf("all[%d]: %w", i, err)
+		}
+	}
+	for i := range m.Any {
+		if err := m.Any[i].Validate(); err != nil {
+			return fmt.Errorf("any[%d]: %w", i, err)
+		}
+	}
+	if m.Not != nil {
+		if err := m.Not.Validate(); err != nil {
+			return fmt.Errorf("not: %w", err)
+		}
+	}
+
 	return nil
 }
@@ -3,6 +3,10 @@
 package config
 
 import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 )
@@ -78,6 +82,19 @@ sources:
 	if cfg.Environment != "production" {
 		t.Errorf("Environment = %q, want %q", cfg.Environment, "production")
 	}
+
+	if cfg.MaxPayloadSize != DefaultMaxPayloadSize {
+		t.Errorf("MaxPayloadSize = %d, want %d", cfg.MaxPayloadSize, DefaultMaxPayloadSize)
+	}
+
+	if cfg.HTTP.Timeout != DefaultHTTPTimeout || cfg.HTTP.IdleConnTimeout != DefaultIdleConnTimeout ||
+		cfg.HTTP.MaxIdleConnsPerHost != DefaultMaxIdleConnsPerHost {
+		t.Errorf("HTTP = %+v, want defaults", cfg.HTTP)
+	}
+
+	if cfg.History != DefaultHistory {
+		t.Errorf("History = %d, want %d", cfg.History, DefaultHistory)
+	}
 }
 
 func TestParse_MissingServerURL(t *testing.T) {
@@ -199,6 +216,26 @@ sources:
 	}
 }
 
+func TestParse_ReservedMetricName(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: shm_agent_lines_read
+        type: counter
+`
+
+	_, err := Parse([]byte(yaml))
+	if err == nil || !strings.Contains(err.Error(), "reserved") {
+		t.Fatalf("error = %v, want reserved name error", err)
+	}
+}
+
 func TestParse_SumWithoutExtract(t *testing.T) {
 	yaml := `
 server_url: https://shm.example.com
@@ -243,6 +280,93 @@ sources:
 	}
 }
 
+func TestParse_MatchNegated(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+        match:
+          field: path
+`
+
+	cfg, err := Parse([]byte(base + "          not_in: [/health, /metrics]\n"))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if got := cfg.Sources[0].Metrics[0].Match.NotIn; len(got) != 2 || got[0] != "/health" {
+		t.Errorf("NotIn = %v", got)
+	}
+
+	if _, err := Parse([]byte(base + "          not_equals: /health\n          equals: /api\n")); err == nil {
+		t.Error("expected error for not_equals with another condition")
+	}
+}
+
+func TestParse_MatchIgnoreCase(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: errors
+        type: counter
+        match:
+          field: level
+          ignore_case: true
+`
+
+	if _, err := Parse([]byte(base + "          equals: error\n")); err != nil {
+		t.Errorf("Parse() error = %v", err)
+	}
+	if _, err := Parse([]byte(base + "          regex: ^err\n")); err == nil {
+		t.Error("expected error for ignore_case with regex")
+	}
+}
+
+func TestParse_Prefilter(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: errors
+        type: counter
+    prefilter:
+`
+
+	tests := []struct {
+		prefilter string
+		wantErr   bool
+	}{
+		{"      contains: ERROR\n", false},
+		{"      regex: ' (ERROR|FATAL) '\n", false},
+		{"      contains: ERROR\n      regex: FATAL\n", true},
+		{"      regex: '[invalid'\n", true},
+		{"      {}\n", true},
+	}
+	for _, tt := range tests {
+		_, err := Parse([]byte(base + tt.prefilter))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("prefilter %q: error = %v, wantErr %v", tt.prefilter, err, tt.wantErr)
+		}
+	}
+}
+
 func TestParse_MatchNoCondition(t *testing.T) {
 	yaml := `
 server_url: https://shm.example.com
@@ -407,3 +531,2460 @@ sources:
 		t.Fatal("expected error for interval too short")
 	}
 }
+
+func TestParse_MaxPayloadSizeTooSmall(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+max_payload_size: 100
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	_, err := Parse([]byte(yaml))
+	if err == nil {
+		t.Fatal("expected error for max_payload_size too small")
+	}
+}
+
+func TestParse_Labels(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: http_requests
+        type: counter
+        labels: [method, status]
+`
+
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m := cfg.Sources[0].Metrics[0]
+	if len(m.Labels) != 2 || m.Labels[0] != "method" || m.Labels[1] != "status" {
+		t.Errorf("Labels = %v, want [method status]", m.Labels)
+	}
+
+	if m.MaxSeries != DefaultMaxSeries {
+		t.Errorf("MaxSeries = %d, want %d", m.MaxSeries, DefaultMaxSeries)
+	}
+}
+
+func TestParse_DuplicateLabels(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: http_requests
+        type: counter
+        labels: [method, method]
+`
+
+	_, err := Parse([]byte(yaml))
+	if err == nil {
+		t.Error("expected error for duplicate labels")
+	}
+}
+
+func TestParse_InvalidGlob(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/[nginx/*.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	_, err := Parse([]byte(yaml))
+	if err == nil {
+		t.Error("expected error for invalid glob pattern")
+	}
+}
+
+func TestParse_LogfmtFormat(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/app.log
+    format: logfmt
+    metrics:
+      - name: errors
+        type: counter
+        match:
+          field: level
+          equals: error
+`
+
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.Sources[0].Format != "logfmt" {
+		t.Errorf("Format = %q, want %q", cfg.Sources[0].Format, "logfmt")
+	}
+}
+
+func TestParse_HTTPSettings(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+http:
+  timeout: 10s
+  idle_conn_timeout: 5m
+  max_idle_conns_per_host: 4
+  keep_alive: 15s
+  retries: 2
+  disable_http2: true
+  proxy_url: http://proxy.internal:3128
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := HTTPConfig{
+		Timeout:             10 * time.Second,
+		IdleConnTimeout:     5 * time.Minute,
+		MaxIdleConnsPerHost: 4,
+		KeepAlive:           15 * time.Second,
+		DisableHTTP2:        true,
+		Retries:             2,
+		RetryBackoff:        DefaultRetryBackoff,
+		ProxyURL:            "http://proxy.internal:3128",
+	}
+	if cfg.HTTP != want {
+		t.Errorf("HTTP = %+v, want %+v", cfg.HTTP, want)
+	}
+
+	for name, invalid := range map[string]string{
+		"negative keep_alive":    strings.Replace(yaml, "keep_alive: 15s", "keep_alive: -1s", 1),
+		"too many retries":       strings.Replace(yaml, "retries: 2", "retries: 11", 1),
+		"negative retry_backoff": strings.Replace(yaml, "retries: 2", "retry_backoff: -1s", 1),
+	} {
+		if _, err := Parse([]byte(invalid)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParse_OutputHTTPSettings(t *testing.T) {
+	base := `
+app_name: my-app
+output: otlp
+http:
+  timeout: 10s
+  proxy_url: http://proxy.internal:3128
+otlp:
+  endpoint: http://collector:4318
+  http:
+    timeout: 2s
+    retries: 3
+    disable_keep_alives: true
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(base))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := cfg.OTLP.HTTP.Inherit(cfg.HTTP)
+	want := cfg.HTTP
+	want.Timeout = 2 * time.Second
+	want.Retries = 3
+	want.DisableKeepAlives = true
+	if got != want {
+		t.Errorf("OTLP.HTTP.Inherit() = %+v, want %+v", got, want)
+	}
+
+	if _, err := Parse([]byte(strings.Replace(base, "retries: 3", "retries: -1", 1))); err == nil {
+		t.Error("expected error for negative otlp.http.retries")
+	}
+}
+
+func TestParse_InvalidProxyURL(t *testing.T) {
+	for _, proxy := range []string{"proxy.internal:3128", "ftp://proxy.internal", "http://"} {
+		yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+http:
+  proxy_url: "` + proxy + `"
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+		if _, err := Parse([]byte(yaml)); err == nil {
+			t.Errorf("expected error for proxy_url %q", proxy)
+		}
+	}
+}
+
+func TestParse_Auth(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(base + `
+auth:
+  token_file: /etc/shm/token
+  header: X-API-Key
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := (AuthConfig{TokenFile: "/etc/shm/token", Header: "X-API-Key"}); cfg.Auth != want {
+		t.Errorf("Auth = %+v, want %+v", cfg.Auth, want)
+	}
+
+	for _, auth := range []string{
+		"auth:\n  token: abc\n  token_file: /etc/shm/token\n",
+		"auth:\n  token: abc\n  header: \"X-API-Key:\"\n",
+	} {
+		if _, err := Parse([]byte(base + auth)); err == nil {
+			t.Errorf("expected error for:\n%s", auth)
+		}
+	}
+}
+
+func TestParse_TLS(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(base + `
+tls:
+  ca_file: /etc/shm/ca.pem
+  cert_file: /etc/shm/agent.pem
+  key_file: /etc/shm/agent-key.pem
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := TLSConfig{CAFile: "/etc/shm/ca.pem", CertFile: "/etc/shm/agent.pem", KeyFile: "/etc/shm/agent-key.pem"}
+	if cfg.TLS != want {
+		t.Errorf("TLS = %+v, want %+v", cfg.TLS, want)
+	}
+
+	if _, err := Parse([]byte(base + `
+tls:
+  cert_file: /etc/shm/agent.pem
+`)); err == nil {
+		t.Error("expected error for cert_file without key_file")
+	}
+}
+
+func TestParse_InvalidListenAddr(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+listen_addr: "9464"
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	_, err := Parse([]byte(yaml))
+	if err == nil {
+		t.Fatal("expected error for listen_addr without port separator")
+	}
+}
+
+func TestParse_Offline(t *testing.T) {
+	yaml := `
+offline: true
+app_name: my-app
+listen_addr: "127.0.0.1:9464"
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !cfg.Offline {
+		t.Error("Offline = false, want true")
+	}
+
+	// Offline only leaves out the SHM server
+	cfg, err = Parse([]byte(yaml + "outputs: [shm, file]\nfile:\n  path: /tmp/snapshots.jsonl\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.UsesServer() || !cfg.HasOutput(OutputFile) {
+		t.Errorf("UsesServer() = %v, HasOutput(file) = %v, want only the file output offline", cfg.UsesServer(), cfg.HasOutput(OutputFile))
+	}
+}
+
+func TestParse_OTLPOutput(t *testing.T) {
+	base := `
+app_name: my-app
+output: otlp
+otlp:
+  endpoint: http://collector:4318
+  headers:
+    Authorization: Bearer secret
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(base))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.UsesServer() {
+		t.Error("UsesServer() = true, want false with output otlp")
+	}
+	if cfg.OTLP.Headers["Authorization"] != "Bearer secret" {
+		t.Errorf("headers = %v", cfg.OTLP.Headers)
+	}
+
+	defaults, err := Parse([]byte(strings.Replace(base, "output: otlp", "server_url: https://shm.example.com\napp_version: \"1.0.0\"", 1)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if defaults.Output != OutputSHM || !defaults.UsesServer() {
+		t.Errorf("Output = %q, UsesServer() = %v, want the server by default", defaults.Output, defaults.UsesServer())
+	}
+
+	for name, invalid := range map[string]string{
+		"unknown output":   strings.Replace(base, "output: otlp", "output: carrier-pigeon", 1),
+		"missing endpoint": strings.Replace(base, "endpoint: http://collector:4318", "endpoint: ''", 1),
+		"invalid scheme":   strings.Replace(base, "http://collector:4318", "grpc://collector:4317", 1),
+		"invalid header":   strings.Replace(base, "Authorization:", "'Bad Header':", 1),
+	} {
+		if _, err := Parse([]byte(invalid)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParse_StatsDOutput(t *testing.T) {
+	base := `
+app_name: my-app
+output: statsd
+statsd:
+  prefix: shop.
+  dogstatsd: true
+  tags: [env:prod]
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(base))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.UsesServer() {
+		t.Error("UsesServer() = true, want false with output statsd")
+	}
+	if cfg.StatsD.Address != DefaultStatsDAddress {
+		t.Errorf("Address = %q, want %q", cfg.StatsD.Address, DefaultStatsDAddress)
+	}
+
+	for name, invalid := range map[string]string{
+		"invalid address":        strings.Replace(base, "prefix: shop.", "address: localhost", 1),
+		"tags without dogstatsd": strings.Replace(base, "dogstatsd: true", "dogstatsd: false", 1),
+	} {
+		if _, err := Parse([]byte(invalid)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParse_InfluxDBOutput(t *testing.T) {
+	base := `
+app_name: my-app
+output: influxdb
+influxdb:
+  url: http://influxdb:8086
+  org: acme
+  bucket: metrics
+  token: secret
+  tags:
+    host: web-1
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(base))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.UsesServer() {
+		t.Error("UsesServer() = true, want false with output influxdb")
+	}
+	if cfg.InfluxDB.Bucket != "metrics" || cfg.InfluxDB.Tags["host"] != "web-1" {
+		t.Errorf("InfluxDB = %+v", cfg.InfluxDB)
+	}
+
+	for name, invalid := range map[string]string{
+		"missing url":    strings.Replace(base, "url: http://influxdb:8086", "org: acme", 1),
+		"invalid scheme": strings.Replace(base, "http://influxdb:8086", "udp://influxdb:8089", 1),
+		"token and file": strings.Replace(base, "token: secret", "token: secret\n  token_file: /run/token", 1),
+	} {
+		if _, err := Parse([]byte(invalid)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParse_KafkaOutput(t *testing.T) {
+	base := `
+app_name: my-app
+output: kafka
+kafka:
+  brokers: [kafka-1:9092, kafka-2:9092]
+  topic: shm.snapshots
+  events_topic: shm.events
+  compression: zstd
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(base))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.UsesServer() || !cfg.UsesIdentity() {
+		t.Errorf("UsesServer() = %v, UsesIdentity() = %v, want only the identity with output kafka", cfg.UsesServer(), cfg.UsesIdentity())
+	}
+	k := cfg.Kafka
+	if k.Key != KafkaKeyInstanceID || k.Acks != KafkaAcksAll || k.Compression != KafkaCompressionZstd || k.Timeout != DefaultKafkaTimeout {
+		t.Errorf("Kafka = %+v, want the defaults and zstd", k)
+	}
+
+	for name, invalid := range map[string]string{
+		"missing brokers":     strings.Replace(base, "brokers: [kafka-1:9092, kafka-2:9092]", "brokers: []", 1),
+		"broker without port": strings.Replace(base, "kafka-2:9092", "kafka-2", 1),
+		"missing topic":       strings.Replace(base, "topic: shm.snapshots", "acks: all", 1),
+		"invalid topic":       strings.Replace(base, "shm.snapshots", "shm/snapshots", 1),
+		"same topics":         strings.Replace(base, "shm.events", "shm.snapshots", 1),
+		"invalid compression": strings.Replace(base, "zstd", "snappy", 1),
+		"invalid acks":        strings.Replace(base, "compression: zstd", "acks: some", 1),
+		"invalid key":         strings.Replace(base, "compression: zstd", "key: hostname", 1),
+	} {
+		if _, err := Parse([]byte(invalid)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParse_FileOutput(t *testing.T) {
+	base := `
+app_name: my-app
+state_dir: /var/lib/shm-agent
+output: file
+file:
+  max_bytes: 1048576
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(base))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.UsesServer() || cfg.UsesIdentity() {
+		t.Errorf("UsesServer() = %v, UsesIdentity() = %v, want neither with output file", cfg.UsesServer(), cfg.UsesIdentity())
+	}
+	want := FileOutputConfig{
+		Path:     filepath.Join("/var/lib/shm-agent", "shm_snapshots.jsonl"),
+		MaxBytes: 1 << 20,
+		MaxFiles: DefaultFileOutputMaxFiles,
+	}
+	if cfg.File != want {
+		t.Errorf("File = %+v, want %+v", cfg.File, want)
+	}
+	if !slices.Contains(cfg.WritableDirs(), filepath.Dir(want.Path)) {
+		t.Errorf("WritableDirs() = %v, want the directory of the file", cfg.WritableDirs())
+	}
+
+	for name, invalid := range map[string]string{
+		"negative max_bytes": strings.Replace(base, "1048576", "-1", 1),
+		"negative max_files": strings.Replace(base, "max_bytes: 1048576", "max_files: -2", 1),
+	} {
+		if _, err := Parse([]byte(invalid)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParse_Outputs(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+outputs: [shm, statsd]
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(base))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.OutputNames(); strings.Join(got, ",") != "shm,statsd" {
+		t.Errorf("OutputNames() = %v, want shm and statsd", got)
+	}
+	if !cfg.UsesServer() || !cfg.HasOutput(OutputStatsD) || cfg.HasOutput(OutputOTLP) {
+		t.Errorf("UsesServer() = %v, HasOutput(statsd) = %v, HasOutput(otlp) = %v",
+			cfg.UsesServer(), cfg.HasOutput(OutputStatsD), cfg.HasOutput(OutputOTLP))
+	}
+
+	single, err := Parse([]byte(strings.Replace(base, "outputs: [shm, statsd]", "output: statsd", 1)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := single.OutputNames(); strings.Join(got, ",") != "statsd" {
+		t.Errorf("OutputNames() = %v, want statsd alone", got)
+	}
+
+	for name, invalid := range map[string]string{
+		"output and outputs": strings.Replace(base, "outputs: [shm, statsd]", "output: otlp\noutputs: [shm, statsd]", 1),
+		"duplicate":          strings.Replace(base, "[shm, statsd]", "[shm, statsd, shm]", 1),
+		"unknown":            strings.Replace(base, "[shm, statsd]", "[shm, graphite]", 1),
+		"invalid settings":   strings.Replace(base, "[shm, statsd]", "[shm, otlp]", 1),
+	} {
+		if _, err := Parse([]byte(invalid)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParse_Spool(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+retry:
+  initial_backoff: 1s
+spool:
+  dir: /var/lib/shm-agent/spool
+  max_snapshots: 50
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wantSpool := SpoolConfig{
+		Dir:          "/var/lib/shm-agent/spool",
+		MaxAge:       DefaultSpoolMaxAge,
+		MaxBytes:     DefaultSpoolMaxBytes,
+		MaxSnapshots: 50,
+	}
+	if cfg.Spool != wantSpool {
+		t.Errorf("Spool = %+v, want %+v", cfg.Spool, wantSpool)
+	}
+
+	wantRetry := RetryConfig{InitialBackoff: time.Second, MaxBackoff: DefaultMaxBackoff}
+	if cfg.Retry != wantRetry {
+		t.Errorf("Retry = %+v, want %+v", cfg.Retry, wantRetry)
+	}
+}
+
+func TestParse_InvalidRetry(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+retry:
+  initial_backoff: 1m
+  max_backoff: 10s
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	_, err := Parse([]byte(yaml))
+	if err == nil {
+		t.Fatal("expected error for max_backoff below initial_backoff")
+	}
+}
+
+func TestParse_CompositeMatch(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: api_errors
+        type: counter
+        match:
+          all:
+            - field: status
+              regex: "^5"
+            - any:
+                - field: path
+                  contains: /api/
+                - not:
+                    field: internal
+                    equals: "true"
+`
+
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	match := cfg.Sources[0].Metrics[0].Match
+	if len(match.All) != 2 || len(match.All[1].Any) != 2 || match.All[1].Any[1].Not == nil {
+		t.Errorf("composite match not parsed: %+v", match)
+	}
+}
+
+func TestParse_InvalidCompositeMatch(t *testing.T) {
+	tests := map[string]string{
+		"field and composite": `
+          field: status
+          equals: "500"
+          not:
+            field: path
+            equals: /`,
+		"two composites": `
+          all:
+            - field: a
+              equals: "1"
+          any:
+            - field: b
+              equals: "2"`,
+		"invalid nested": `
+          any:
+            - field: a`,
+	}
+
+	for name, match := range tests {
+		t.Run(name, func(t *testing.T) {
+			yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+        match:` + match + "\n"
+
+			if _, err := Parse([]byte(yaml)); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestParse_NumericMatch(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: slow_requests
+        type: counter
+        match:
+          field: duration_ms
+`
+
+	cfg, err := Parse([]byte(base + "          gt: 1000\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gt := cfg.Sources[0].Metrics[0].Match.Gt; gt == nil || *gt != 1000 {
+		t.Errorf("Gt = %v, want 1000", gt)
+	}
+
+	// A zero bound is a valid condition
+	if _, err := Parse([]byte(base + "          lte: 0\n")); err != nil {
+		t.Errorf("unexpected error for lte: 0: %v", err)
+	}
+
+	invalid := map[string]string{
+		"between one value":    "          between: [1]\n",
+		"between reversed":     "          between: [10, 1]\n",
+		"two numeric bounds":   "          gt: 1\n          lt: 10\n",
+		"numeric and equals":   "          gt: 1\n          equals: x\n",
+		"non-numeric gt value": "          gt: fast\n",
+	}
+	for name, cond := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Parse([]byte(base + cond)); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestParse_JournaldSource(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - type: journald
+    units: [nginx.service]
+    metrics:
+      - name: errors
+        type: counter
+        match:
+          field: PRIORITY
+          in: ["0", "1", "2", "3"]
+`
+
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	src := cfg.Sources[0]
+	if !src.IsJournald() {
+		t.Error("IsJournald() = false, want true")
+	}
+	if got := src.Location(); got != "journald:nginx.service" {
+		t.Errorf("Location() = %q, want %q", got, "journald:nginx.service")
+	}
+}
+
+func TestParse_InvalidJournaldSource(t *testing.T) {
+	tests := map[string]string{
+		"path on journald": `
+  - type: journald
+    path: /var/log/app.log`,
+		"units on file": `
+  - path: /var/log/app.log
+    format: json
+    units: [nginx.service]`,
+		"unknown type": `
+  - type: socket
+    format: json`,
+		"invalid format": `
+  - type: journald
+    format: xml`,
+	}
+
+	for name, src := range tests {
+		t.Run(name, func(t *testing.T) {
+			yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:` + src + `
+    metrics:
+      - name: requests
+        type: counter
+        match:
+          field: level
+          equals: error
+`
+
+			if _, err := Parse([]byte(yaml)); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestParse_GELFSource(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - type: gelf
+    metrics:
+      - name: errors
+        type: counter
+        match:
+          field: level
+          lte: 3
+  - type: gelf
+    format: logfmt
+    gelf:
+      listen: 127.0.0.1:12202
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !cfg.Sources[0].IsGELF() {
+		t.Error("IsGELF() = false, want true")
+	}
+	if got := cfg.Sources[0].Location(); got != "gelf::12201" {
+		t.Errorf("Location() = %q, want %q", got, "gelf::12201")
+	}
+	if got := cfg.Sources[1].Location(); got != "gelf:127.0.0.1:12202" {
+		t.Errorf("Location() = %q, want %q", got, "gelf:127.0.0.1:12202")
+	}
+}
+
+func TestParse_InvalidGELFSource(t *testing.T) {
+	tests := map[string]string{
+		"path on gelf": `
+  - type: gelf
+    path: /var/log/app.log`,
+		"invalid listen": `
+  - type: gelf
+    gelf:
+      listen: localhost`,
+		"gelf on file": `
+  - path: /var/log/app.log
+    format: json
+    gelf:
+      listen: :12201`,
+		"multiline on gelf": `
+  - type: gelf
+    multiline:
+      start_pattern: '^\S'`,
+	}
+
+	for name, src := range tests {
+		t.Run(name, func(t *testing.T) {
+			yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:` + src + `
+    metrics:
+      - name: requests
+        type: counter
+`
+
+			if _, err := Parse([]byte(yaml)); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestParse_Burst(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: errors
+        type: counter
+        burst:
+`
+
+	cfg, err := Parse([]byte(base + "          factor: 3\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b := cfg.Sources[0].Metrics[0].Burst; b.Factor != 3 || b.Window != DefaultBurstWindow {
+		t.Errorf("Burst = %+v, want factor 3 and the default window", b)
+	}
+
+	for _, invalid := range []string{
+		"          factor: 1\n",
+		"          factor: 2\n          window: -1\n",
+		"          factor: 2\n          min_value: -5\n",
+	} {
+		if _, err := Parse([]byte(base + invalid)); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestParse_PercentileAndApproximate(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: latency
+`
+
+	cfg, err := Parse([]byte(base + "        type: percentile\n        extract:\n          field: duration_ms\n        quantiles: [0.5, 0.999]\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if q := cfg.Sources[0].Metrics[0].Quantiles; len(q) != 2 || q[1] != 0.999 {
+		t.Errorf("Quantiles = %v, want [0.5 0.999]", q)
+	}
+
+	cfg, err = Parse([]byte(base + "        type: set\n        extract:\n          field: ip\n        approximate: true\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.Sources[0].Metrics[0].Approximate {
+		t.Error("Approximate = false, want true")
+	}
+
+	for _, invalid := range []string{
+		"        type: percentile\n",
+		"        type: percentile\n        extract:\n          field: d\n        quantiles: [1.5]\n",
+		"        type: percentile\n        extract:\n          field: d\n        quantiles: [0.5, 0.5]\n",
+		"        type: sum\n        extract:\n          field: d\n        quantiles: [0.5]\n",
+		"        type: sum\n        extract:\n          field: d\n        approximate: true\n",
+		"        type: percentile\n        extract:\n          field: d\n        burst:\n          factor: 2\n",
+	} {
+		if _, err := Parse([]byte(base + invalid)); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestParse_CounterBy(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests_by_path
+        type: counter_by
+`
+
+	cfg, err := Parse([]byte(base + "        extract:\n          field: path\n        labels: [method]\n        max_series: 50\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m := cfg.Sources[0].Metrics[0]; m.Extract.Field != "path" || m.MaxSeries != 50 {
+		t.Errorf("metric = %+v", m)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"        extract:\n          field: path\n        labels: [path]\n",
+		"        extract:\n          field: path\n        approximate: true\n",
+	} {
+		if _, err := Parse([]byte(base + invalid)); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestParse_KubernetesSource(t *testing.T) {
+	t.Setenv("NODE_NAME", "node-a")
+
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - type: kubernetes
+    format: json
+    kubernetes:
+      namespace: shop
+      selector: app=checkout
+    metrics:
+      - name: errors
+        type: counter
+        labels: [kubernetes.pod]
+`
+
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	src := cfg.Sources[0]
+	if src.Kubernetes.NodeName != "node-a" || src.Kubernetes.LogsDir != DefaultKubernetesLogsDir {
+		t.Errorf("Kubernetes = %+v, want node from $NODE_NAME and the default logs dir", src.Kubernetes)
+	}
+	if got := src.Location(); got != "kubernetes:shop/app=checkout" {
+		t.Errorf("Location() = %q", got)
+	}
+
+	invalid := map[string]string{
+		"path":        "  - type: kubernetes\n    format: json\n    path: /var/log/a.log\n",
+		"no format":   "  - type: kubernetes\n",
+		"on file":     "  - path: /var/log/a.log\n    format: json\n    kubernetes:\n      namespace: shop\n",
+		"on journald": "  - type: journald\n    kubernetes:\n      namespace: shop\n",
+	}
+	for name, src := range invalid {
+		yaml := "server_url: https://shm.example.com\napp_name: my-app\napp_version: \"1.0.0\"\nsources:\n" + src +
+			"    metrics:\n      - name: errors\n        type: counter\n"
+		if _, err := Parse([]byte(yaml)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParse_RegexFieldReferences(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/nginx/access.log
+    format: regex
+    pattern: '^(?P<method>\S+) (?P<path>\S+) (?P<status>\d+) (?P<bytes>\d+)$'
+    metrics:
+`
+
+	valid := `
+      - name: errors
+        type: counter
+        match:
+          any:
+            - field: status
+              equals: "500"
+            - not:
+                field: method
+                equals: GET
+        labels: [path, __path__]
+      - name: bytes
+        type: sum
+        extract:
+          field: bytes
+`
+	if _, err := Parse([]byte(base + valid)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := map[string]string{
+		"match": `
+      - name: errors
+        type: counter
+        match:
+          field: statuss
+          equals: "500"
+`,
+		"nested match": `
+      - name: errors
+        type: counter
+        match:
+          all:
+            - field: status
+              equals: "500"
+            - field: host
+              equals: example.com
+`,
+		"extract": `
+      - name: bytes
+        type: sum
+        extract:
+          field: size
+`,
+		"label": `
+      - name: requests
+        type: counter
+        labels: [Method]
+`,
+	}
+
+	for name, metrics := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Parse([]byte(base + metrics)); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+
+	_, err := Parse([]byte(base + tests["match"]))
+	if !strings.Contains(err.Error(), "did you mean 'status'") {
+		t.Errorf("error = %v, want a suggestion", err)
+	}
+}
+
+func TestConfig_Warnings(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: sessions
+        type: gauge
+        extract:
+          field: metrics..active
+      - name: requests
+        type: counter
+        labels: [http.method]
+`
+
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	warnings := cfg.Warnings()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "metrics..active") {
+		t.Errorf("Warnings() = %v, want one for metrics..active", warnings)
+	}
+}
+
+func TestParse_FieldFilters(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/app.log
+    format: json
+`
+	metric := `    metrics:
+      - name: errors
+        type: counter
+        match:
+          field: http.status
+          equals: "500"
+`
+
+	valid := []string{
+		"    keep_fields: [http]\n",
+		"    keep_fields: [http.status, level]\n    drop_fields: [user.email]\n",
+		"    drop_fields: [http.path, token]\n",
+	}
+	for _, filters := range valid {
+		if _, err := Parse([]byte(base + filters + metric)); err != nil {
+			t.Errorf("%q: unexpected error: %v", filters, err)
+		}
+	}
+
+	invalid := []string{
+		"    keep_fields: [level]\n",
+		"    drop_fields: [http]\n",
+		"    drop_fields: [http.status]\n",
+		"    drop_fields: [\"\"]\n",
+	}
+	for _, filters := range invalid {
+		if _, err := Parse([]byte(base + filters + metric)); err == nil {
+			t.Errorf("%q: expected error", filters)
+		}
+	}
+}
+
+func TestParse_AddFields(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/nginx/access.log
+    format: regex
+    pattern: '^(?P<status>\d+)$'
+    keep_fields: [status]
+    add_fields:
+      service: checkout
+    metrics:
+      - name: requests
+        type: counter
+        labels: [service, status]
+`
+
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Sources[0].AddFields["service"] != "checkout" {
+		t.Errorf("AddFields = %v", cfg.Sources[0].AddFields)
+	}
+
+	invalid := strings.Replace(yaml, "      service: checkout", `      "": checkout`, 1)
+	if _, err := Parse([]byte(invalid)); err == nil {
+		t.Error("expected error for an empty add_fields name")
+	}
+}
+
+func TestParse_Types(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/nginx/access.log
+    format: regex
+    pattern: '^(?P<status>\d+) (?P<duration>\S+)$'
+    types:
+      status: int
+      duration: float
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Sources[0].Types["status"] != TypeInt {
+		t.Errorf("Types = %v", cfg.Sources[0].Types)
+	}
+
+	invalid := []string{
+		strings.Replace(yaml, "status: int", "status: integer", 1),
+		strings.Replace(yaml, "status: int", `"": int`, 1),
+		strings.Replace(yaml, "status: int", "__path__: string", 1),
+	}
+	for _, y := range invalid {
+		if _, err := Parse([]byte(y)); err == nil {
+			t.Errorf("expected error for types in:\n%s", y)
+		}
+	}
+}
+
+func TestParse_Unmatched(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+state_dir: /var/lib/shm-agent
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    unmatched:
+      file: unmatched.log
+    metrics:
+      - name: errors
+        type: counter
+`
+
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := UnmatchedConfig{File: filepath.Join("/var/lib/shm-agent", "unmatched.log"), MaxBytes: DefaultUnmatchedMaxBytes}
+	if got := *cfg.Sources[0].Unmatched; got != want {
+		t.Errorf("Unmatched = %+v, want %+v", got, want)
+	}
+
+	if _, err := Parse([]byte(strings.Replace(yaml, "file: unmatched.log", "max_bytes: -1", 1))); err == nil {
+		t.Error("expected error for negative max_bytes")
+	}
+}
+
+func TestParse_Multiline(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/app.log
+    format: regex
+    pattern: '(?s)^(?P<level>\S+) (?P<message>.*)$'
+    multiline:
+      start_pattern: '^\d{4}-'
+    metrics:
+      - name: errors
+        type: counter
+`
+
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ml := cfg.Sources[0].Multiline
+	if ml.MaxLines != DefaultMultilineMaxLines || ml.Timeout != DefaultMultilineTimeout {
+		t.Errorf("Multiline = %+v, want defaults", ml)
+	}
+
+	invalid := []string{
+		strings.Replace(yaml, `start_pattern: '^\d{4}-'`, "max_lines: 10", 1),
+		strings.Replace(yaml, `'^\d{4}-'`, `'^(\d'`, 1),
+		strings.Replace(yaml, `start_pattern: '^\d{4}-'`, `{start_pattern: '^\d', max_lines: -1}`, 1),
+		strings.Replace(yaml, "  - path: /var/log/app.log\n    format: regex", "  - type: journald\n    format: regex", 1),
+	}
+	for _, y := range invalid {
+		if _, err := Parse([]byte(y)); err == nil {
+			t.Errorf("expected error for multiline in:\n%s", y)
+		}
+	}
+}
+
+func TestParse_StateDir(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+state_dir: /var/lib/shm-agent
+identity_file: identity/id.json
+spool:
+  dir: /data/spool
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.IdentityFile != "/var/lib/shm-agent/identity/id.json" {
+		t.Errorf("IdentityFile = %q, want it in the state directory", cfg.IdentityFile)
+	}
+	if cfg.PositionsFile != "/var/lib/shm-agent/shm_positions.json" {
+		t.Errorf("PositionsFile = %q, want the default in the state directory", cfg.PositionsFile)
+	}
+	if cfg.Spool.Dir != "/data/spool" {
+		t.Errorf("Spool.Dir = %q, want absolute path unchanged", cfg.Spool.Dir)
+	}
+
+	want := []string{"/var/lib/shm-agent", "/var/lib/shm-agent/identity", "/data/spool"}
+	if got := cfg.WritableDirs(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("WritableDirs() = %v, want %v", got, want)
+	}
+}
+
+func TestParse_EnabledAndShadow(t *testing.T) {
+	yaml := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+      - name: old_requests
+        type: counter
+        enabled: false
+      - name: trial_requests
+        type: counter
+        shadow: true
+`
+
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var names []string
+	for _, m := range cfg.Sources[0].Metrics {
+		names = append(names, m.Name)
+	}
+	if strings.Join(names, ",") != "requests,trial_requests" {
+		t.Errorf("metrics = %v, want the disabled metric removed", names)
+	}
+	if shadow := cfg.ShadowMetrics(); len(shadow) != 1 || !shadow["trial_requests"] {
+		t.Errorf("ShadowMetrics() = %v, want trial_requests", shadow)
+	}
+
+	// Disabled metrics are still validated
+	invalid := strings.Replace(yaml, "name: old_requests\n        type: counter", "name: old_requests\n        type: histogram", 1)
+	if _, err := Parse([]byte(invalid)); err == nil {
+		t.Error("expected error for an invalid disabled metric")
+	}
+}
+
+func TestParse_MetricNamesAcrossSources(t *testing.T) {
+	source := func(prefix, labels string) string {
+		return `
+  - path: /var/log/app.log
+    format: json
+    metric_prefix: "` + prefix + `"
+    metrics:
+      - name: requests
+        type: counter
+        labels: [` + labels + `]
+`
+	}
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+`
+
+	cfg, err := Parse([]byte(base + "sources:" + source("nginx_", "") + source("app_", "")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if a, b := cfg.Sources[0].Metrics[0].Name, cfg.Sources[1].Metrics[0].Name; a != "nginx_requests" || b != "app_requests" {
+		t.Errorf("names = %q, %q; want nginx_requests, app_requests", a, b)
+	}
+
+	// A shared name is allowed unless unique_metric_names is set
+	shared := "sources:" + source("", "") + source("", "")
+	if _, err := Parse([]byte(base + shared)); err != nil {
+		t.Errorf("unexpected error for a shared name: %v", err)
+	}
+	if _, err := Parse([]byte(base + "unique_metric_names: true\n" + shared)); err == nil {
+		t.Error("expected error for a shared name with unique_metric_names")
+	}
+
+	// So is a name defined twice by the same source
+	twice := `sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+      - name: requests
+        type: %s
+`
+	if _, err := Parse([]byte(base + fmt.Sprintf(twice, "counter"))); err != nil {
+		t.Errorf("unexpected error for a name defined twice by a source: %v", err)
+	}
+	if _, err := Parse([]byte(base + "unique_metric_names: true\n" + fmt.Sprintf(twice, "counter"))); err == nil {
+		t.Error("expected error for a name defined twice by a source with unique_metric_names")
+	}
+
+	for name, yaml := range map[string]string{
+		"labels mismatch": "sources:" + source("", "") + source("", "status"),
+		"same source":     fmt.Sprintf(twice, "gauge"),
+	} {
+		if _, err := Parse([]byte(base + yaml)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParse_SnapshotTimestamp(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(base))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.SnapshotTimestamp != SnapshotTimestampEnd {
+		t.Errorf("SnapshotTimestamp = %q, want %q", cfg.SnapshotTimestamp, SnapshotTimestampEnd)
+	}
+
+	cfg, err = Parse([]byte(base + "snapshot_timestamp: interval_start\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.SnapshotTimestamp != SnapshotTimestampStart {
+		t.Errorf("SnapshotTimestamp = %q, want %q", cfg.SnapshotTimestamp, SnapshotTimestampStart)
+	}
+
+	if _, err := Parse([]byte(base + "snapshot_timestamp: now\n")); err == nil {
+		t.Error("expected error for an invalid snapshot_timestamp")
+	}
+}
+
+func TestParse_SnapshotFormat(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(base))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.SnapshotFormat != SnapshotFormatMap {
+		t.Errorf("SnapshotFormat = %q, want %q", cfg.SnapshotFormat, SnapshotFormatMap)
+	}
+
+	cfg, err = Parse([]byte(base + "snapshot_format: structured\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.SnapshotFormat != SnapshotFormatStructured {
+		t.Errorf("SnapshotFormat = %q, want %q", cfg.SnapshotFormat, SnapshotFormatStructured)
+	}
+
+	if _, err := Parse([]byte(base + "snapshot_format: array\n")); err == nil {
+		t.Error("expected error for an invalid snapshot_format")
+	}
+}
+
+func TestParse_IdentityEncryption(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+	cfg, err := Parse([]byte(base))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.IdentityEncryption.Mode != IdentityEncryptionNone {
+		t.Errorf("Mode = %q, want %q", cfg.IdentityEncryption.Mode, IdentityEncryptionNone)
+	}
+
+	cfg, err = Parse([]byte(base + "identity_encryption:\n  mode: passphrase\n  passphrase_env: SHM_IDENTITY_PASSPHRASE\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.IdentityEncryption.PassphraseEnv != "SHM_IDENTITY_PASSPHRASE" {
+		t.Errorf("PassphraseEnv = %q", cfg.IdentityEncryption.PassphraseEnv)
+	}
+
+	for name, enc := range map[string]string{
+		"no passphrase source":   "  mode: passphrase\n",
+		"two passphrase sources": "  mode: passphrase\n  passphrase_env: A\n  passphrase_file: /etc/a\n",
+		"passphrase with dpapi":  "  mode: dpapi\n  passphrase_file: /etc/a\n",
+		"unknown mode":           "  mode: keychain\n",
+	} {
+		if _, err := Parse([]byte(base + "identity_encryption:\n" + enc)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParse_DerivedMetrics(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+      - name: errors
+        type: counter
+      - name: latency
+        type: percentile
+        extract:
+          field: duration
+`
+
+	cfg, err := Parse([]byte(base + `
+      - name: error_rate
+        type: derived
+        expression: errors / requests * 100
+      - name: latency_avg
+        type: derived
+        expression: latency.sum / latency.count
+      - name: latency_tail
+        type: derived
+        expression: latency.p99.9 / latency.p50
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m := cfg.Sources[0].Metrics[3]; m.Expression != "errors / requests * 100" {
+		t.Errorf("Expression = %q", m.Expression)
+	}
+
+	for name, metric := range map[string]string{
+		"no expression":         "type: derived",
+		"invalid expression":    "type: derived\n        expression: errors /",
+		"unknown metric":        "type: derived\n        expression: errors / missing",
+		"percentile directly":   "type: derived\n        expression: latency * 2",
+		"derived reference":     "type: derived\n        expression: error_rate",
+		"match":                 "type: derived\n        expression: errors\n        match:\n          field: status\n          equals: \"500\"",
+		"expression on counter": "type: counter\n        expression: errors",
+	} {
+		yaml := base + "      - name: error_rate\n        " + metric + "\n"
+		if _, err := Parse([]byte(yaml)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParse_Presets(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+`
+
+	cfg, err := Parse([]byte(base + `
+presets:
+  - name: security
+    auth_log: /var/log/secure
+    web_log: /var/log/httpd/access_log
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Sources) != 2 {
+		t.Fatalf("got %d sources, want 2", len(cfg.Sources))
+	}
+	if cfg.Sources[0].Path != "/var/log/secure" || cfg.Sources[1].Path != "/var/log/httpd/access_log" {
+		t.Errorf("paths = %s, %s", cfg.Sources[0].Path, cfg.Sources[1].Path)
+	}
+	if name := cfg.Sources[0].Metrics[0].Name; name != "security_ssh_failed_logins" {
+		t.Errorf("first metric = %s, want security_ssh_failed_logins", name)
+	}
+
+	// The short form, without web metrics
+	cfg, err = Parse([]byte(base + `
+presets: [security]
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := len(cfg.Sources); n < 2 || cfg.Sources[1].Metrics[0].Name != "security_ssh_failed_logins" {
+		t.Errorf("preset sources not appended: %d sources", n)
+	}
+
+	if _, err := Parse([]byte(base + "presets: [unknown]\n")); err == nil {
+		t.Error("expected error for an unknown preset")
+	}
+}
+
+func TestParse_GrokSource(t *testing.T) {
+	source := func(extra string) string {
+		return `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/nginx/access.log
+    format: grok
+` + extra
+	}
+
+	_, err := Parse([]byte(source(`    pattern: '^%{COMBINEDAPACHELOG} %{DURATION:duration}$'
+    grok_patterns:
+      DURATION: '%{NUMBER}s'
+    metrics:
+      - name: server_errors
+        type: counter
+        labels: [verb]
+        match:
+          field: response
+          regex: '^5'
+      - name: latency
+        type: percentile
+        extract:
+          field: duration
+`)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name, extra := range map[string]string{
+		"no pattern":      "    metrics:\n      - name: lines\n        type: counter\n",
+		"unknown pattern": "    pattern: '%{NOPE:x}'\n    metrics:\n      - name: lines\n        type: counter\n",
+		"unknown field":   "    pattern: '%{COMBINEDAPACHELOG}'\n    metrics:\n      - name: errors\n        type: counter\n        labels: [status]\n",
+	} {
+		if _, err := Parse([]byte(source(extra))); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	regex := strings.Replace(source("    pattern: '(?P<x>.*)'\n    grok_patterns:\n      A: x\n    metrics:\n      - name: lines\n        type: counter\n"), "format: grok", "format: regex", 1)
+	if _, err := Parse([]byte(regex)); err == nil {
+		t.Error("expected error for grok_patterns on a regex source")
+	}
+}
+
+func TestParse_CSVSource(t *testing.T) {
+	source := func(csv string) string {
+		return `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/app.tsv
+    format: csv
+` + csv + `
+    metrics:
+      - name: errors
+        type: counter
+        match:
+          field: status
+          equals: "500"
+`
+	}
+
+	cfg, err := Parse([]byte(source("    csv:\n      columns: [time, status]")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c := cfg.Sources[0].CSV; c.Delimiter != "," || c.Comma() != ',' {
+		t.Errorf("delimiter = %q, want the default ','", c.Delimiter)
+	}
+
+	cfg, err = Parse([]byte(source("    csv:\n      delimiter: \"\\t\"\n      header: true")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c := cfg.Sources[0].CSV; c.Comma() != '\t' {
+		t.Errorf("delimiter = %q, want a tab", c.Delimiter)
+	}
+
+	for name, csv := range map[string]string{
+		"no csv":           "",
+		"neither":          "    csv:\n      delimiter: ;",
+		"both":             "    csv:\n      columns: [status]\n      header: true",
+		"long delimiter":   "    csv:\n      delimiter: ;;\n      columns: [status]",
+		"quote delimiter":  "    csv:\n      delimiter: '\"'\n      columns: [status]",
+		"duplicate column": "    csv:\n      columns: [status, status]",
+		"unknown field":    "    csv:\n      columns: [time, code]",
+	} {
+		if _, err := Parse([]byte(source(csv))); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParse_KubernetesMetadata(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/app.log
+    format: regex
+    pattern: '(?P<status>\d+)'
+    metrics:
+      - name: requests
+        type: counter
+        labels: [kubernetes.namespace, kubernetes.labels.app]
+`
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	if _, err := Parse([]byte(base)); err == nil {
+		t.Error("expected error for kubernetes fields outside a cluster")
+	}
+
+	cfg, err := Parse([]byte(base + `
+kubernetes_metadata:
+  enabled: true
+  lookup_pod: false
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.KubernetesMetadata.LabelsFile != DefaultPodLabelsFile {
+		t.Errorf("labels_file = %q, want %q", cfg.KubernetesMetadata.LabelsFile, DefaultPodLabelsFile)
+	}
+	if cfg.KubernetesMetadata.LookupEnabled() {
+		t.Error("lookup_pod: false not applied")
+	}
+
+	t.Setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")
+	if _, err := Parse([]byte(base)); err != nil {
+		t.Errorf("enabled by default in a cluster: unexpected error: %v", err)
+	}
+	if _, err := Parse([]byte(base + `
+kubernetes_metadata:
+  enabled: false
+`)); err == nil {
+		t.Error("expected error for kubernetes fields with kubernetes_metadata disabled")
+	}
+}
+
+func TestParse_PathPattern(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: %s
+    format: regex
+    pattern: '(?P<status>\d+)'
+    path_pattern: '%s'
+    metrics:
+      - name: requests
+        type: counter
+        labels: [vhost]
+`
+	tests := []struct {
+		name    string
+		path    string
+		pattern string
+		wantErr bool
+	}{
+		{"vhost from glob", "/var/log/nginx/*.access.log", `/(?P<vhost>[^/]+)\.access\.log$`, false},
+		{"invalid regex", "/var/log/nginx/*.access.log", `(?P<vhost>[`, true},
+		{"no named group", "/var/log/nginx/*.access.log", `/([^/]+)\.access\.log$`, true},
+		{"stdin", "-", `(?P<vhost>.+)`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(fmt.Sprintf(base, tt.path, tt.pattern)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParse_Filter(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/app.log
+    format: regex
+    pattern: '(?P<path>\S+) (?P<status>\d+)'
+    add_fields:
+      env: prod
+    filter: %s
+    metrics:
+      - name: requests
+        type: counter
+`
+	tests := []struct {
+		name    string
+		filter  string
+		wantErr string
+	}{
+		{"not health checks", `{not: {field: path, equals: /healthz}}`, ""},
+		{"added field", `{field: env, equals: prod}`, ""},
+		{"synthetic field", `{field: __path__, contains: app}`, ""},
+		{"unknown field", `{field: paht, equals: /healthz}`, "filter: field 'paht' is not a named group of the pattern (did you mean 'path'?)"},
+		{"invalid regex", `{field: path, regex: "["}`, "filter:"},
+		{"no condition", `{field: path}`, "filter:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Parse([]byte(fmt.Sprintf(base, tt.filter)))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Parse() error = %v", err)
+				}
+				if cfg.Sources[0].Filter == nil {
+					t.Error("Filter = nil")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Parse() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// A filter reading a dropped field never matches
+	_, err := Parse([]byte(strings.Replace(fmt.Sprintf(base, `{field: status, equals: "200"}`), "    add_fields:", "    drop_fields: [status]\n    add_fields:", 1)))
+	if err == nil || !strings.Contains(err.Error(), "filter: field 'status' is removed by drop_fields") {
+		t.Errorf("Parse() error = %v, want drop_fields error", err)
+	}
+}
+
+func TestParse_Timestamp(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+interval: 30s
+sources:
+  - path: /var/log/nginx/access.log
+    format: regex
+    pattern: '\[(?P<time>[^\]]+)\] (?P<status>\d+)'
+    timestamp: %s
+    metrics:
+      - name: requests
+        type: counter
+`
+	cfg, err := Parse([]byte(fmt.Sprintf(base, `{field: time, layout: "02/Jan/2006:15:04:05 -0700"}`)))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	ts := cfg.Sources[0].Timestamp
+	if ts.Layout != "02/Jan/2006:15:04:05 -0700" || ts.Lateness != 30*time.Second {
+		t.Errorf("Timestamp = %+v, want the layout and a lateness of one interval", ts)
+	}
+
+	cfg, err = Parse([]byte(fmt.Sprintf(base, `{field: time, lateness: 5m}`)))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if ts := cfg.Sources[0].Timestamp; ts.Layout != TimestampRFC3339 || ts.Lateness != 5*time.Minute {
+		t.Errorf("Timestamp = %+v, want rfc3339 and 5m", ts)
+	}
+
+	for _, tt := range []struct {
+		timestamp string
+		wantErr   string
+	}{
+		{`{layout: unix}`, "timestamp: field is required"},
+		{`{field: tme}`, "timestamp: field 'tme' is not a named group of the pattern (did you mean 'time'?)"},
+		{`{field: time, layout: "dd/MM/yyyy"}`, "is not a Go time layout"},
+		{`{field: time, lateness: -1s}`, "lateness must not be negative"},
+	} {
+		_, err := Parse([]byte(fmt.Sprintf(base, tt.timestamp)))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: Parse() error = %v, want %q", tt.timestamp, err, tt.wantErr)
+		}
+	}
+
+	_, err = Parse([]byte(fmt.Sprintf(base, `{field: time}`) + `      - name: users
+        type: set
+        extract:
+          field: status
+        unique_window: day
+`))
+	if err == nil || !strings.Contains(err.Error(), "unique_window is not supported with a source timestamp") {
+		t.Errorf("Parse() error = %v, want unique_window error", err)
+	}
+}
+
+func TestParse_AccessLogSource(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/nginx/access.log
+    format: access_log
+`
+	tests := []struct {
+		name    string
+		source  string
+		wantErr bool
+	}{
+		{"combined", `
+    preset: combined
+    metrics:
+      - name: slow_clients
+        type: counter
+        match: {field: status, gte: 500}
+        labels: [method, user_agent]
+      - name: last_request
+        type: gauge
+        extract: {field: timestamp}
+`, false},
+		{"haproxy fields", `
+    preset: haproxy_http
+    metrics:
+      - name: response_time
+        type: percentile
+        extract: {field: time_response}
+        labels: [backend]
+`, false},
+		{"missing preset", `
+    metrics:
+      - name: requests
+        type: counter
+`, true},
+		{"unknown preset", `
+    preset: iis
+    metrics:
+      - name: requests
+        type: counter
+`, true},
+		{"field not in preset", `
+    preset: common
+    metrics:
+      - name: requests
+        type: counter
+        labels: [user_agent]
+`, true},
+		{"pattern with preset", `
+    preset: common
+    pattern: '(?P<status>\d+)'
+    metrics:
+      - name: requests
+        type: counter
+`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(base + strings.TrimPrefix(tt.source, "\n")))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	_, err := Parse([]byte(`
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/app.log
+    format: json
+    preset: combined
+    metrics:
+      - name: requests
+        type: counter
+`))
+	if err == nil {
+		t.Error("expected error for preset on a json source")
+	}
+}
+
+func TestParse_UniqueWindow(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+state_dir: /var/lib/shm-agent
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+`
+	cfg, err := Parse([]byte(base + `
+      - name: daily_users
+        type: set
+        unique_window: day
+        extract: {field: user}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.UniqueFile != filepath.Join("/var/lib/shm-agent", "shm_unique.json") {
+		t.Errorf("unique_file = %q", cfg.UniqueFile)
+	}
+	if !cfg.UniqueFileEnabled() {
+		t.Error("UniqueFileEnabled() = false with a unique_window")
+	}
+
+	for _, metric := range []string{`
+      - name: users
+        type: set
+        unique_window: year
+        extract: {field: user}
+`, `
+      - name: requests
+        type: counter
+        unique_window: day
+`} {
+		if _, err := Parse([]byte(base + strings.TrimPrefix(metric, "\n"))); err == nil {
+			t.Errorf("expected error for %s", metric)
+		}
+	}
+
+	cfg, err = Parse([]byte(base + `
+      - name: users
+        type: set
+        extract: {field: user}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.UniqueFileEnabled() {
+		t.Error("UniqueFileEnabled() = true without a unique_window")
+	}
+}
+
+func TestParse_SeriesTTL(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+`
+	cfg, err := Parse([]byte(base + `
+      - name: queue_depth
+        type: gauge
+        labels: [queue]
+        extract: {field: depth}
+      - name: workers
+        type: gauge
+        labels: [pool]
+        series_ttl: 10m
+        extract: {field: workers}
+      - name: load
+        type: gauge
+        extract: {field: load}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, want := range []time.Duration{DefaultSeriesTTL, 10 * time.Minute, 0} {
+		if got := cfg.Sources[0].Metrics[i].SeriesTTL; got != want {
+			t.Errorf("%s: series_ttl = %v, want %v", cfg.Sources[0].Metrics[i].Name, got, want)
+		}
+	}
+
+	for _, metric := range []string{`
+      - name: load
+        type: gauge
+        series_ttl: 10m
+        extract: {field: load}
+`, `
+      - name: requests
+        type: counter
+        labels: [method]
+        series_ttl: 10m
+`, `
+      - name: workers
+        type: gauge
+        labels: [pool]
+        series_ttl: -1m
+        extract: {field: workers}
+`} {
+		if _, err := Parse([]byte(base + strings.TrimPrefix(metric, "\n"))); err == nil {
+			t.Errorf("expected error for %s", metric)
+		}
+	}
+}
+
+func TestParse_ExtractTransforms(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: value
+        type: sum
+        extract:
+          field: took
+`
+	tests := []struct {
+		name    string
+		extract string
+		wantErr bool
+	}{
+		{"duration", "          type: duration\n", false},
+		{"transforms and bytes", "          transform: [trim, lowercase]\n          type: bytes\n", false},
+		{"unknown type", "          type: percent\n", true},
+		{"unknown transform", "          transform: [reverse]\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(base + tt.extract))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParse_MapFields(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/app.log
+    format: regex
+    pattern: '(?P<level>\w+) (?P<status>\d+)'
+    map_fields: %s
+    metrics:
+      - name: requests
+        type: counter
+        labels: [status_class]
+`
+	tests := []struct {
+		name     string
+		mapField string
+		wantErr  string
+	}{
+		{"rules", `{status_class: {field: status, rules: [{regex: '^5', value: 5xx}, {gte: 400, lt: 500, value: 4xx}], default: other}}`, ""},
+		{"in place", `{status_class: {field: status, rules: [{regex: '^5', value: 5xx}]}, level: {field: level, values: {warning: warn}}}`, ""},
+		{"unknown field", `{status_class: {field: statsu, rules: [{regex: '^5', value: 5xx}]}}`, "map_fields status_class: field 'statsu' is not a named group of the pattern (did you mean 'status'?)"},
+		{"no field", `{status_class: {rules: [{regex: '^5', value: 5xx}]}}`, "map_fields: status_class: field is required"},
+		{"no mapping", `{status_class: {field: status}}`, "map_fields: status_class: values or rules are required"},
+		{"no value", `{status_class: {field: status, rules: [{regex: '^5'}]}}`, "rules[0]: value is required"},
+		{"no condition", `{status_class: {field: status, rules: [{value: 5xx}]}}`, "rules[0]: regex, gte or lt is required"},
+		{"regex and bounds", `{status_class: {field: status, rules: [{regex: '^5', lt: 600, value: 5xx}]}}`, "regex cannot be combined with gte or lt"},
+		{"empty range", `{status_class: {field: status, rules: [{gte: 500, lt: 500, value: 5xx}]}}`, "gte must be less than lt"},
+		{"invalid regex", `{status_class: {field: status, rules: [{regex: '[', value: 5xx}]}}`, "invalid regex"},
+		{"chained", `{status_class: {field: level, rules: [{regex: '^5', value: 5xx}]}, level: {field: status, values: {"500": error}}}`, "map_fields: status_class: field 'level' is itself mapped"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Parse([]byte(fmt.Sprintf(base, tt.mapField)))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Parse() error = %v", err)
+				}
+				if cfg.Sources[0].MapFields["status_class"].Field != "status" {
+					t.Errorf("MapFields = %+v", cfg.Sources[0].MapFields)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Parse() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// An extract map is validated with the metric
+	_, err := Parse([]byte(strings.Replace(fmt.Sprintf(base, `{}`), "type: counter\n        labels: [status_class]", "type: set\n        extract: {field: level, map: {}}", 1)))
+	if err == nil || !strings.Contains(err.Error(), "map: values or rules are required") {
+		t.Errorf("Parse() error = %v, want extract map error", err)
+	}
+}
+
+func TestParse_SampleRate(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/app.log
+    format: json
+    sample_rate: %d
+    metrics:
+      - name: requests
+        type: counter
+        sample_rate: %d
+      - name: ratio
+        type: derived
+        expression: requests / 2
+`
+	cfg, err := Parse([]byte(fmt.Sprintf(base, 10, 2)))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if cfg.Sources[0].SampleRate != 10 || cfg.Sources[0].Metrics[0].SampleRate != 2 {
+		t.Errorf("sample rates = %d and %d, want 10 and 2", cfg.Sources[0].SampleRate, cfg.Sources[0].Metrics[0].SampleRate)
+	}
+
+	for _, tt := range []struct {
+		source, metric int
+		wantErr        string
+	}{
+		{-1, 0, "sample_rate must not be negative"},
+		{0, -5, "metric[0]: sample_rate must not be negative"},
+	} {
+		if _, err := Parse([]byte(fmt.Sprintf(base, tt.source, tt.metric))); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("Parse(%d, %d) error = %v, want %q", tt.source, tt.metric, err, tt.wantErr)
+		}
+	}
+
+	derived := strings.Replace(fmt.Sprintf(base, 0, 0), "expression: requests / 2", "expression: requests / 2\n        sample_rate: 2", 1)
+	if _, err := Parse([]byte(derived)); err == nil || !strings.Contains(err.Error(), "does not support") {
+		t.Errorf("Parse() error = %v, want derived sample_rate error", err)
+	}
+}
+
+func TestParse_Workers(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/app.log
+    format: json
+    workers: %d
+    metrics:
+      - name: requests
+        type: counter
+`
+	cfg, err := Parse([]byte(fmt.Sprintf(base, 8)))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if cfg.Sources[0].Workers != 8 {
+		t.Errorf("Workers = %d, want 8", cfg.Sources[0].Workers)
+	}
+	for _, n := range []int{-1, MaxWorkers + 1} {
+		if _, err := Parse([]byte(fmt.Sprintf(base, n))); err == nil || !strings.Contains(err.Error(), "workers must be between") {
+			t.Errorf("workers %d: Parse() error = %v", n, err)
+		}
+	}
+}
+
+func TestParse_QueueOverflow(t *testing.T) {
+	base := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/app.log
+    format: json
+    %s
+    metrics:
+      - name: requests
+        type: counter
+`
+	tests := []struct {
+		options  string
+		queued   bool
+		capacity int
+		wantErr  string
+	}{
+		{`workers: 1`, false, DefaultQueueSizePerWorker, ""},
+		{`workers: 4`, true, 4 * DefaultQueueSizePerWorker, ""},
+		{`queue_size: 100`, true, 100, ""},
+		{`on_overflow: drop_oldest`, true, DefaultQueueSizePerWorker, ""},
+		{`{workers: 2, queue_size: 10, on_overflow: drop_newest}`, true, 10, ""},
+		{`queue_size: -1`, false, 0, "queue_size must not be negative"},
+		{`on_overflow: drop_all`, false, 0, "on_overflow must be block, drop_oldest or drop_newest"},
+	}
+	for _, tt := range tests {
+		options := tt.options
+		if strings.HasPrefix(options, "{") {
+			options = strings.ReplaceAll(strings.Trim(options, "{}"), ", ", "\n    ")
+		}
+		cfg, err := Parse([]byte(fmt.Sprintf(base, options)))
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: Parse() error = %v, want %q", tt.options, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Parse() error = %v", tt.options, err)
+			continue
+		}
+		src := &cfg.Sources[0]
+		if src.Queued() != tt.queued || src.QueueCapacity() != tt.capacity {
+			t.Errorf("%s: Queued() = %v, QueueCapacity() = %d, want %v and %d", tt.options, src.Queued(), src.QueueCapacity(), tt.queued, tt.capacity)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Synthetic fields set on every line, describing where it was read from.
+const (
+	FieldSource = "__source__" // source location, see Source.Location
+	FieldPath   = "__path__"   // file the line was read from
+	FieldLine   = "__line__"   // line number in that file
+)
+
+// Fields returns the fields a metric reads: match fields (including those
+// of nested matches), the extract field and the labels.
+func (m *Metric) Fields() []string {
+	var fields []string
+	if m.Match != nil {
+		fields = m.Match.fields(fields)
+	}
+	if m.Extract != nil && m.Extract.Field != "" {
+		fields = append(fields, m.Extract.Field)
+	}
+	return append(fields, m.Labels...)
+}
+
+// fields appends the fields referenced by the match to dst.
+func (m *Match) fields(dst []string) []string {
+	if m.Field != "" {
+		dst = append(dst, m.Field)
+	}
+	for i := range m.All {
+		dst = m.All[i].fields(dst)
+	}
+	for i := range m.Any {
+		dst = m.Any[i].fields(dst)
+	}
+	if m.Not != nil {
+		dst = m.Not.fields(dst)
+	}
+	return dst
+}
+
+// fieldUse is a field read by the timestamp, the filter or a metric of a
+// source.
+type fieldUse struct {
+	by    string // "map_fields <name>", "timestamp", "filter" or "metric <name>"
+	field string
+}
+
+// MappedFields returns the names of the map_fields of the source, sorted.
+func (s *Source) MappedFields() []string {
+	names := make([]string, 0, len(s.MapFields))
+	for name := range s.MapFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fieldUses returns the fields read by map_fields, the timestamp, the
+// filter and the metrics of the source.
+func (s *Source) fieldUses() []fieldUse {
+	var uses []fieldUse
+	for _, name := range s.MappedFields() {
+		uses = append(uses, fieldUse{by: "map_fields " + name, field: s.MapFields[name].Field})
+	}
+	if s.Timestamp != nil {
+		uses = append(uses, fieldUse{by: "timestamp", field: s.Timestamp.Field})
+	}
+	if s.Filter != nil {
+		for _, f := range s.Filter.fields(nil) {
+			uses = append(uses, fieldUse{by: "filter", field: f})
+		}
+	}
+	for _, m := range s.Metrics {
+		for _, f := range m.Fields() {
+			uses = append(uses, fieldUse{by: "metric " + m.Name, field: f})
+		}
+	}
+	return uses
+}
+
+// Reads reports whether map_fields, the timestamp, the filter or any
+// metric of the source reads field.
+func (s *Source) Reads(field string) bool {
+	for _, u := range s.fieldUses() {
+		if u.field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRegexFields checks that every field read by the filter or the
+// metrics of a regex, grok or access_log source is a named group of its
+// pattern, or of a CSV source a listed column, or a field added by the
+// source itself.
+// Journald and gelf sources are not checked since any field of their
+// entries may be referenced, nor CSV sources reading their columns from a
+// header.
+func (s *Source) validateRegexFields() error {
+	if s.IsJournald() || s.IsGELF() {
+		return nil
+	}
+
+	var available []string
+	what := "a named group of the pattern"
+	switch s.Format {
+	case "regex", "grok", "access_log":
+		pattern, err := s.RegexPattern()
+		if err != nil {
+			return err
+		}
+		available = regexp.MustCompile(pattern).SubexpNames()
+		if s.Format == "access_log" {
+			available = append(available, "timestamp")
+		}
+	case "csv":
+		if s.CSV == nil || s.CSV.Header {
+			return nil
+		}
+		available = s.CSV.Columns
+		what = "a column of the source"
+	default:
+		return nil
+	}
+
+	groups := make(map[string]bool)
+	var names []string
+	for _, name := range available {
+		if name != "" && !groups[name] {
+			groups[name] = true
+			names = append(names, name)
+		}
+	}
+
+	for _, u := range s.fieldUses() {
+		if groups[u.field] || s.addsField(u.field) {
+			continue
+		}
+		msg := fmt.Sprintf("%s: field '%s' is not %s", u.by, u.field, what)
+		if guess := closest(u.field, names); guess != "" {
+			msg += fmt.Sprintf(" (did you mean '%s'?)", guess)
+		}
+		return fmt.Errorf("%s", msg)
+	}
+
+	return nil
+}
+
+// validateFieldFilters checks keep_fields, drop_fields, add_fields and
+// types, and that neither the filter nor any metric reads a field they
+// discard.
+func (s *Source) validateFieldFilters() error {
+	for _, f := range append(append([]string(nil), s.KeepFields...), s.DropFields...) {
+		if f == "" {
+			return fmt.Errorf("keep_fields and drop_fields must not contain empty names")
+		}
+	}
+	if _, ok := s.AddFields[""]; ok {
+		return fmt.Errorf("add_fields must not contain empty names")
+	}
+	for field, typ := range s.Types {
+		if field == "" {
+			return fmt.Errorf("types must not contain empty names")
+		}
+		switch typ {
+		case TypeInt, TypeFloat, TypeBool, TypeString:
+		default:
+			return fmt.Errorf("types: field '%s' must be int, float, bool or string, got '%s'", field, typ)
+		}
+		if s.addsField(field) {
+			return fmt.Errorf("types: field '%s' is not parsed from the line", field)
+		}
+	}
+
+	for _, u := range s.fieldUses() {
+		if s.addsField(u.field) {
+			continue
+		}
+		for _, d := range s.DropFields {
+			if u.field == d || strings.HasPrefix(u.field, d+".") {
+				return fmt.Errorf("%s: field '%s' is removed by drop_fields", u.by, u.field)
+			}
+		}
+		if len(s.KeepFields) > 0 && !keptBy(u.field, s.KeepFields) {
+			return fmt.Errorf("%s: field '%s' is not in keep_fields", u.by, u.field)
+		}
+	}
+
+	return nil
+}
+
+// keptBy reports whether field, or part of it, survives keep.
+func keptBy(field string, keep []string) bool {
+	for _, k := range keep {
+		if field == k || strings.HasPrefix(field, k+".") || strings.HasPrefix(k, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// addsField reports whether field is added to every line by the source
+// rather than parsed from it.
+func (s *Source) addsField(field string) bool {
+	switch field {
+	case FieldSource, FieldPath, FieldLine:
+		return true
+	}
+	if _, ok := s.AddFields[field]; ok {
+		return true
+	}
+	if fm, ok := s.MapFields[field]; ok && fm.Field != field {
+		return true
+	}
+	if slices.Contains(s.PathFields(), field) {
+		return true
+	}
+	return (s.IsKubernetes() || s.podMetadata) && strings.HasPrefix(field, "kubernetes.")
+}
+
+// Warnings returns likely configuration mistakes that do not prevent the
+// agent from running, such as JSON paths that can never match.
+func (c *Config) Warnings() []string {
+	var warnings []string
+	for _, src := range c.Sources {
+		if src.Format != "json" {
+			continue
+		}
+		for _, m := range src.Metrics {
+			for _, field := range m.Fields() {
+				if impossiblePath(field) {
+					warnings = append(warnings, fmt.Sprintf(
+						"source %s: metric %s: field '%s' has an empty path segment and can never match",
+						src.Location(), m.Name, field))
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+// impossiblePath reports whether a dotted JSON path has an empty segment,
+// like "a..b" or "a.", so it can only match a top-level key of that exact
+// name, which JSON logs practically never have.
+func impossiblePath(field string) bool {
+	if !strings.Contains(field, ".") {
+		return false
+	}
+	for _, part := range strings.Split(field, ".") {
+		if strings.TrimSpace(part) == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// closest returns the candidate nearest to s, if it is within two edits.
+func closest(s string, candidates []string) string {
+	best, bestDist := "", 3
+	for _, c := range candidates {
+		if d := editDistance(s, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
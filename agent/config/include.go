@@ -0,0 +1,215 @@
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fragment is a configuration file pulled in through include or a config
+// directory. It may only add sources and include further files.
+type fragment struct {
+	Include []string `yaml:"include"`
+	Sources []Source `yaml:"sources"`
+}
+
+// fragmentKeys are the top-level keys accepted in a fragment.
+var fragmentKeys = map[string]bool{"include": true, "sources": true}
+
+// LoadOptions selects what is loaded besides the main configuration file.
+type LoadOptions struct {
+	Dir     string // directory of *.yaml or *.yml files adding sources
+	Profile string // profile overriding settings, none when empty
+
+	// Remote is the document served by the SHM server, applied when
+	// remote_config is enabled. When nil, the last one served is read
+	// from remote_config.cache_file.
+	Remote []byte
+}
+
+// LoadWithDir reads a configuration file, its includes and every *.yaml or
+// *.yml file of dir, in lexical order. Sources are appended in the order
+// the files are read: the main file, its includes, then the directory.
+// An empty dir reads the main file and its includes only.
+func LoadWithDir(path, dir string) (*Config, error) {
+	return LoadWithOptions(path, LoadOptions{Dir: dir})
+}
+
+// LoadWithOptions reads a configuration file like LoadWithDir, reading
+// opts.Dir, then applies the profile opts.Profile before validating.
+func LoadWithOptions(path string, opts LoadOptions) (*Config, error) {
+	dir := opts.Dir
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing YAML: %w", err)
+	}
+
+	l := &loader{cfg: &cfg, seen: make(map[string]bool)}
+	if _, err := l.visit(path); err != nil {
+		return nil, err
+	}
+	for i := range cfg.Sources {
+		cfg.Sources[i].origin = path
+	}
+	if err := l.include(filepath.Dir(path), cfg.Include); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if dir != "" {
+		files, err := dirFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if err := l.load(file); err != nil {
+				return nil, err
+			}
+		}
+		cfg.Files = append(cfg.Files, dir)
+	}
+
+	if err := cfg.applyPresets(); err != nil {
+		return nil, err
+	}
+
+	if opts.Profile != "" {
+		if err := cfg.applyProfile(opts.Profile); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.RemoteEnabled() {
+		if err := cfg.applyRemote(opts.Remote); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.dropDisabled()
+
+	return &cfg, nil
+}
+
+// loader merges fragments into a configuration.
+type loader struct {
+	cfg  *Config
+	seen map[string]bool
+}
+
+// visit records a file as read. It reports false for a file already read,
+// so a file matched twice, or an include cycle, adds its sources once.
+func (l *loader) visit(path string) (bool, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false, fmt.Errorf("resolving %s: %w", path, err)
+	}
+	if l.seen[abs] {
+		return false, nil
+	}
+	l.seen[abs] = true
+	l.cfg.Files = append(l.cfg.Files, path)
+	return true, nil
+}
+
+// include loads the files matched by patterns, relative to base.
+// A pattern without glob characters must name an existing file.
+func (l *loader) include(base string, patterns []string) error {
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(base, pattern)
+		}
+
+		files := []string{pattern}
+		if IsGlob(pattern) {
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid include pattern %q: %w", pattern, err)
+			}
+			sort.Strings(matches)
+			files = matches
+		}
+
+		for _, file := range files {
+			if err := l.load(file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// load reads a fragment, appends its sources and follows its includes.
+func (l *loader) load(path string) error {
+	if first, err := l.visit(path); !first || err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading included file: %w", err)
+	}
+
+	var keys map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("%s: parsing YAML: %w", path, err)
+	}
+	for key := range keys {
+		if !fragmentKeys[key] {
+			return fmt.Errorf("%s: %q cannot be set in an included file, only sources and include", path, key)
+		}
+	}
+
+	var frag fragment
+	if err := yaml.Unmarshal(data, &frag); err != nil {
+		return fmt.Errorf("%s: parsing YAML: %w", path, err)
+	}
+
+	for _, src := range frag.Sources {
+		src.origin = path
+		l.cfg.Sources = append(l.cfg.Sources, src)
+	}
+
+	if err := l.include(filepath.Dir(path), frag.Include); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// dirFiles lists the YAML files of a config directory in lexical order.
+func dirFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading config directory: %w", err)
+	}
+
+	var files []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		switch filepath.Ext(e.Name()) {
+		case ".yaml", ".yml":
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,163 @@
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sourceFragment(path string) string {
+	return `
+sources:
+  - path: ` + path + `
+    format: json
+    metrics:
+      - name: lines
+        type: counter
+`
+}
+
+func TestLoadWithDir_IncludesAndConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "config.yaml")
+	writeConfig(t, main, `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+include:
+  - teams/*.yaml
+  - extra.yaml
+sources:
+  - path: /var/log/main.log
+    format: json
+    metrics:
+      - name: lines
+        type: counter
+`)
+	writeConfig(t, filepath.Join(dir, "teams", "b.yaml"), sourceFragment("/var/log/b.log"))
+	writeConfig(t, filepath.Join(dir, "teams", "a.yaml"), sourceFragment("/var/log/a.log"))
+	writeConfig(t, filepath.Join(dir, "extra.yaml"), "include: [nested.yaml]\n"+sourceFragment("/var/log/extra.log"))
+	writeConfig(t, filepath.Join(dir, "nested.yaml"), sourceFragment("/var/log/nested.log"))
+
+	confd := filepath.Join(dir, "conf.d")
+	writeConfig(t, filepath.Join(confd, "20-web.yml"), sourceFragment("/var/log/web.log"))
+	writeConfig(t, filepath.Join(confd, "10-db.yaml"), sourceFragment("/var/log/db.log"))
+	writeConfig(t, filepath.Join(confd, "README.md"), "not a config")
+	writeConfig(t, filepath.Join(confd, ".10-db.yaml.swp"), "not a config")
+	// Already included through teams/*.yaml: read once.
+	writeConfig(t, filepath.Join(confd, "30-dup.yaml"), "include: [../teams/a.yaml]\n")
+
+	cfg, err := LoadWithDir(main, confd)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var paths []string
+	for _, src := range cfg.Sources {
+		paths = append(paths, src.Path)
+	}
+	want := []string{
+		"/var/log/main.log",
+		"/var/log/a.log",
+		"/var/log/b.log",
+		"/var/log/extra.log",
+		"/var/log/nested.log",
+		"/var/log/db.log",
+		"/var/log/web.log",
+	}
+	if strings.Join(paths, ",") != strings.Join(want, ",") {
+		t.Errorf("source paths = %v, want %v", paths, want)
+	}
+
+	// Every file read, plus the directory, is watched.
+	if len(cfg.Files) != 9 {
+		t.Errorf("Files = %v, want 9 entries", cfg.Files)
+	}
+	if cfg.Files[0] != main || cfg.Files[len(cfg.Files)-1] != confd {
+		t.Errorf("Files = %v, want main file first and directory last", cfg.Files)
+	}
+}
+
+func TestLoadWithDir_Errors(t *testing.T) {
+	header := `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+`
+	tests := []struct {
+		name     string
+		main     string
+		fragment string
+		wantErr  string
+	}{
+		{
+			name:    "missing include",
+			main:    header + "include: [missing.yaml]\n" + sourceFragment("/var/log/app.log"),
+			wantErr: "missing.yaml",
+		},
+		{
+			name:     "setting in fragment",
+			main:     header + "include: [fragment.yaml]\n" + sourceFragment("/var/log/app.log"),
+			fragment: "interval: 5s\n" + sourceFragment("/var/log/other.log"),
+			wantErr:  `"interval" cannot be set in an included file`,
+		},
+		{
+			name:     "invalid source in fragment",
+			main:     header + "include: [fragment.yaml]\n" + sourceFragment("/var/log/app.log"),
+			fragment: "sources:\n  - path: /var/log/other.log\n    format: xml\n",
+			wantErr:  "fragment.yaml",
+		},
+		{
+			name:     "sources only in fragments",
+			main:     header + "include: [fragment.yaml]\n",
+			fragment: sourceFragment("/var/log/other.log"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			main := filepath.Join(dir, "config.yaml")
+			writeConfig(t, main, tt.main)
+			if tt.fragment != "" {
+				writeConfig(t, filepath.Join(dir, "fragment.yaml"), tt.fragment)
+			}
+
+			_, err := Load(main)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParse_IncludeRequiresFile(t *testing.T) {
+	_, err := Parse([]byte(`
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+include: [other.yaml]
+` + sourceFragment("/var/log/app.log")))
+	if err == nil {
+		t.Error("expected error for include in Parse")
+	}
+}
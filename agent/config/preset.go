@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// presetFiles holds the presets shipped with the agent, as templates of
+// configuration fragments executed with a Preset.
+//
+//go:embed presets/*.yaml
+var presetFiles embed.FS
+
+// Preset enables a bundle of sources and metrics shipped with the agent.
+// It is written as its name, or as a mapping to override its log paths.
+type Preset struct {
+	Name string `yaml:"name"`
+
+	// AuthLog is the syslog authentication log read by the security
+	// preset. Defaults to /var/log/auth.log, or /var/log/secure when only
+	// that one exists.
+	AuthLog string `yaml:"auth_log"`
+
+	// WebLog is the access log, in combined format, read by the security
+	// preset. Defaults to /var/log/nginx/access.log when it exists; "none"
+	// leaves web metrics out.
+	WebLog string `yaml:"web_log"`
+}
+
+// Default log paths of the security preset.
+var (
+	defaultAuthLogs = []string{"/var/log/auth.log", "/var/log/secure"}
+	defaultWebLog   = "/var/log/nginx/access.log"
+)
+
+// UnmarshalYAML accepts a preset name as well as a mapping.
+func (p *Preset) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&p.Name)
+	}
+	type plain Preset
+	return value.Decode((*plain)(p))
+}
+
+// PresetNames returns the names of the presets shipped with the agent.
+func PresetNames() []string {
+	entries, _ := presetFiles.ReadDir("presets")
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), ".yaml"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyPresets appends the sources of the selected presets.
+func (c *Config) applyPresets() error {
+	for _, p := range c.Presets {
+		sources, err := p.sources()
+		if err != nil {
+			return fmt.Errorf("preset %s: %w", p.Name, err)
+		}
+		for _, src := range sources {
+			src.origin = "preset " + p.Name
+			c.Sources = append(c.Sources, src)
+		}
+	}
+	return nil
+}
+
+// sources returns the sources of the preset, with its paths defaulted.
+func (p Preset) sources() ([]Source, error) {
+	data, err := presetFiles.ReadFile("presets/" + p.Name + ".yaml")
+	if err != nil || p.Name == "" {
+		return nil, fmt.Errorf("unknown preset (available: %s)", strings.Join(PresetNames(), ", "))
+	}
+
+	if p.AuthLog == "" {
+		p.AuthLog = defaultAuthLogs[0]
+		for _, path := range defaultAuthLogs {
+			if fileExists(path) {
+				p.AuthLog = path
+				break
+			}
+		}
+	}
+	switch {
+	case p.WebLog == "none":
+		p.WebLog = ""
+	case p.WebLog == "" && fileExists(defaultWebLog):
+		p.WebLog = defaultWebLog
+	}
+
+	tmpl, err := template.New(p.Name).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("parsing template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, p); err != nil {
+		return nil, fmt.Errorf("executing template: %w", err)
+	}
+
+	var frag fragment
+	if err := yaml.Unmarshal(buf.Bytes(), &frag); err != nil {
+		return nil, fmt.Errorf("parsing YAML: %w", err)
+	}
+	return frag.Sources, nil
+}
+
+// fileExists reports whether path names an existing file.
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
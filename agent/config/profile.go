@@ -0,0 +1,127 @@
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Profile overrides settings of the configuration when selected with
+// --profile, so that one file serves several environments. Unset fields
+// keep the value of the configuration.
+type Profile struct {
+	Environment string        `yaml:"environment"`
+	Interval    time.Duration `yaml:"interval"`
+	ListenAddr  *string       `yaml:"listen_addr"` // "" disables the listener
+	Offline     *bool         `yaml:"offline"`
+
+	// Output or Outputs replace the outputs of the configuration, and the
+	// settings of an output replace those of the configuration.
+	Output   string            `yaml:"output"`
+	Outputs  []string          `yaml:"outputs"`
+	OTLP     *OTLPConfig       `yaml:"otlp"`
+	StatsD   *StatsDConfig     `yaml:"statsd"`
+	InfluxDB *InfluxDBConfig   `yaml:"influxdb"`
+	Kafka    *KafkaConfig      `yaml:"kafka"`
+	File     *FileOutputConfig `yaml:"file"`
+
+	// DryRun and Verbose are command-line settings, applied by the
+	// command when the profile is selected.
+	DryRun  bool `yaml:"dry_run"`
+	Verbose int  `yaml:"verbose"`
+}
+
+// Validate validates a profile.
+func (p *Profile) Validate() error {
+	if p.Interval != 0 && p.Interval < time.Second {
+		return fmt.Errorf("interval must be at least 1 second")
+	}
+	if p.ListenAddr != nil && *p.ListenAddr != "" {
+		if _, _, err := net.SplitHostPort(*p.ListenAddr); err != nil {
+			return fmt.Errorf("invalid listen_addr: %w", err)
+		}
+	}
+	if p.Verbose < 0 {
+		return fmt.Errorf("verbose must not be negative")
+	}
+	// The output settings are validated with the configuration they apply to
+	if p.Output != "" && len(p.Outputs) > 0 {
+		return fmt.Errorf("output and outputs are mutually exclusive")
+	}
+	for _, out := range append([]string{p.Output}, p.Outputs...) {
+		if out == "" {
+			continue
+		}
+		if err := checkOutputName(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyProfile overrides the settings of c with those of the named
+// profile and records it as the selected profile.
+func (c *Config) applyProfile(name string) error {
+	p, ok := c.Profiles[name]
+	if !ok {
+		defined := "none"
+		if len(c.Profiles) > 0 {
+			defined = strings.Join(c.profileNames(), ", ")
+		}
+		return fmt.Errorf("unknown profile %q (defined: %s)", name, defined)
+	}
+
+	if p.Environment != "" {
+		c.Environment = p.Environment
+	}
+	if p.Interval != 0 {
+		c.Interval = p.Interval
+	}
+	if p.ListenAddr != nil {
+		c.ListenAddr = *p.ListenAddr
+	}
+	if p.Offline != nil {
+		c.Offline = *p.Offline
+	}
+	if p.Output != "" || len(p.Outputs) > 0 {
+		c.Output, c.Outputs = p.Output, p.Outputs
+	}
+	if p.OTLP != nil {
+		c.OTLP = *p.OTLP
+	}
+	if p.StatsD != nil {
+		c.StatsD = *p.StatsD
+	}
+	if p.InfluxDB != nil {
+		c.InfluxDB = *p.InfluxDB
+	}
+	if p.Kafka != nil {
+		c.Kafka = *p.Kafka
+	}
+	if p.File != nil {
+		c.File = *p.File
+	}
+
+	c.Profile = name
+	return nil
+}
+
+// SelectedProfile returns the profile the configuration was loaded with,
+// or the zero Profile when none was selected.
+func (c *Config) SelectedProfile() Profile {
+	return c.Profiles[c.Profile]
+}
+
+// profileNames returns the names of the defined profiles, sorted.
+func (c *Config) profileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
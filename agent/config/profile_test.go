@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const profilesConfig = `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+interval: 60s
+listen_addr: 127.0.0.1:9464
+profiles:
+  dev:
+    interval: 5s
+    offline: true
+    listen_addr: ""
+    dry_run: true
+    verbose: 2
+  staging:
+    environment: staging
+    interval: 30s
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: lines
+        type: counter
+`
+
+func TestLoadWithOptions_Profile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, profilesConfig)
+
+	tests := []struct {
+		profile     string
+		interval    time.Duration
+		environment string
+		offline     bool
+		listenAddr  string
+	}{
+		{"", time.Minute, "production", false, "127.0.0.1:9464"},
+		{"dev", 5 * time.Second, "production", true, ""},
+		{"staging", 30 * time.Second, "staging", false, "127.0.0.1:9464"},
+	}
+
+	for _, tt := range tests {
+		cfg, err := LoadWithOptions(path, LoadOptions{Profile: tt.profile})
+		if err != nil {
+			t.Fatalf("profile %q: unexpected error: %v", tt.profile, err)
+		}
+		if cfg.Interval != tt.interval || cfg.Environment != tt.environment ||
+			cfg.Offline != tt.offline || cfg.ListenAddr != tt.listenAddr {
+			t.Errorf("profile %q: interval=%s environment=%s offline=%v listen_addr=%q", tt.profile,
+				cfg.Interval, cfg.Environment, cfg.Offline, cfg.ListenAddr)
+		}
+		if cfg.Profile != tt.profile {
+			t.Errorf("Profile = %q, want %q", cfg.Profile, tt.profile)
+		}
+	}
+
+	cfg, _ := LoadWithOptions(path, LoadOptions{Profile: "dev"})
+	if p := cfg.SelectedProfile(); !p.DryRun || p.Verbose != 2 {
+		t.Errorf("SelectedProfile() = %+v, want dry_run and verbose 2", p)
+	}
+
+	_, err := LoadWithOptions(path, LoadOptions{Profile: "prod"})
+	if err == nil || !strings.Contains(err.Error(), "defined: dev, staging") {
+		t.Errorf("error = %v, want unknown profile listing dev and staging", err)
+	}
+}
+
+func TestLoadWithOptions_ProfileOutputs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, strings.Replace(profilesConfig, "profiles:\n", `output: statsd
+statsd:
+  address: statsd.example.com:8125
+profiles:
+  local:
+    outputs: [shm, file]
+    file:
+      path: /tmp/snapshots.jsonl
+  udp:
+    statsd:
+      address: 127.0.0.1:9125
+`, 1))
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.OutputNames(); len(got) != 1 || got[0] != OutputStatsD {
+		t.Errorf("outputs = %v, want statsd", got)
+	}
+
+	cfg, err = LoadWithOptions(path, LoadOptions{Profile: "local"})
+	if err != nil {
+		t.Fatalf("profile local: unexpected error: %v", err)
+	}
+	if got := cfg.OutputNames(); strings.Join(got, ",") != "shm,file" {
+		t.Errorf("profile local: outputs = %v, want shm and file", got)
+	}
+	if cfg.File.Path != "/tmp/snapshots.jsonl" {
+		t.Errorf("profile local: file.path = %q", cfg.File.Path)
+	}
+
+	cfg, err = LoadWithOptions(path, LoadOptions{Profile: "udp"})
+	if err != nil {
+		t.Fatalf("profile udp: unexpected error: %v", err)
+	}
+	if !cfg.HasOutput(OutputStatsD) || cfg.StatsD.Address != "127.0.0.1:9125" {
+		t.Errorf("profile udp: outputs = %v, statsd.address = %q", cfg.OutputNames(), cfg.StatsD.Address)
+	}
+}
+
+func TestLoadWithOptions_ProfileMakesConfigValid(t *testing.T) {
+	// Without a server, the base configuration is only valid offline
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, strings.Replace(profilesConfig, "server_url: https://shm.example.com\n", "", 1))
+
+	if _, err := Load(path); err == nil {
+		t.Error("expected error without server_url")
+	}
+	if _, err := LoadWithOptions(path, LoadOptions{Profile: "dev"}); err != nil {
+		t.Errorf("unexpected error with the offline profile: %v", err)
+	}
+}
+
+func TestParse_InvalidProfile(t *testing.T) {
+	for _, invalid := range []string{"interval: 10ms", "listen_addr: nohost", "verbose: -1",
+		"output: nowhere", "outputs: [shm, nowhere]", "output: file\n    outputs: [shm]"} {
+		yaml := strings.Replace(profilesConfig, "interval: 30s", invalid, 1)
+		_, err := Parse([]byte(yaml))
+		if err == nil || !strings.Contains(err.Error(), "profiles.staging") {
+			t.Errorf("%s: error = %v, want profiles.staging error", invalid, err)
+		}
+	}
+}
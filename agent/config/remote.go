@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RemoteConfig fetches sources from the SHM server, so that a fleet of
+// agents is reconfigured centrally. The server serves a document holding
+// sources, as an included file does; the last one served is kept in
+// CacheFile, so that the agent starts with it when the server is
+// unreachable.
+type RemoteConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	Mode         string        `yaml:"mode"`          // merge (default) or replace
+	PollInterval time.Duration `yaml:"poll_interval"` // defaults to DefaultRemotePollInterval
+	CacheFile    string        `yaml:"cache_file"`    // relative to state_dir
+}
+
+// Values of remote_config.mode.
+const (
+	RemoteMerge   = "merge"   // remote sources are added to the local ones
+	RemoteReplace = "replace" // remote sources replace the local ones
+)
+
+// Defaults of remote_config.
+const (
+	DefaultRemotePollInterval = 5 * time.Minute
+	DefaultRemoteCacheFile    = "./shm_remote_config.yaml"
+)
+
+// MinRemotePollInterval is the shortest accepted poll_interval.
+const MinRemotePollInterval = 10 * time.Second
+
+// RemoteOrigin is the origin of remote sources in error messages.
+const RemoteOrigin = "remote configuration"
+
+// Validate validates the remote configuration settings.
+func (r *RemoteConfig) Validate() error {
+	switch r.Mode {
+	case RemoteMerge, RemoteReplace:
+	default:
+		return fmt.Errorf("mode must be %s or %s, got '%s'", RemoteMerge, RemoteReplace, r.Mode)
+	}
+	if r.PollInterval < MinRemotePollInterval {
+		return fmt.Errorf("poll_interval must be at least %s", MinRemotePollInterval)
+	}
+	return nil
+}
+
+// remoteCacheFile returns the path of the cache file, as set by
+// setDefaults.
+func (c *Config) remoteCacheFile() string {
+	path := c.Remote.CacheFile
+	if path == "" {
+		path = DefaultRemoteCacheFile
+	}
+	if c.StateDir != "" {
+		path = c.inStateDir(path)
+	}
+	return path
+}
+
+// applyRemote adds the sources of a remote document to c, or replaces
+// the local ones with them. A nil document is read from the cache file,
+// none being applied when there is no cache yet.
+func (c *Config) applyRemote(data []byte) error {
+	if data == nil {
+		var err error
+		data, err = os.ReadFile(c.remoteCacheFile())
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading remote configuration cache: %w", err)
+		}
+	}
+
+	sources, err := ParseRemote(data)
+	if err != nil {
+		return err
+	}
+	if c.Remote.Mode == RemoteReplace {
+		c.Sources = nil
+	}
+	c.Sources = append(c.Sources, sources...)
+	return nil
+}
+
+// ParseRemote parses a remote document: sources only, as in an included
+// file. An empty document has no sources.
+func ParseRemote(data []byte) ([]Source, error) {
+	var keys map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("%s: parsing YAML: %w", RemoteOrigin, err)
+	}
+	for key := range keys {
+		if key != "sources" {
+			return nil, fmt.Errorf("%s: %q cannot be set, only sources", RemoteOrigin, key)
+		}
+	}
+
+	var frag fragment
+	if err := yaml.Unmarshal(data, &frag); err != nil {
+		return nil, fmt.Errorf("%s: parsing YAML: %w", RemoteOrigin, err)
+	}
+	for i := range frag.Sources {
+		frag.Sources[i].origin = RemoteOrigin
+	}
+	return frag.Sources, nil
+}
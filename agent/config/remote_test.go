@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const remoteConfig = `
+server_url: https://shm.example.com
+app_name: my-app
+app_version: "1.0.0"
+remote_config:
+  enabled: true
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`
+
+const remoteSources = `
+sources:
+  - path: /var/log/worker.log
+    format: json
+    metrics:
+      - name: jobs
+        type: counter
+`
+
+func TestLoadWithOptions_Remote(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	writeConfig(t, path, remoteConfig+"state_dir: "+dir+"\n")
+
+	// Without a cache, the local sources only
+	cfg, err := LoadWithOptions(path, LoadOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Sources) != 1 {
+		t.Fatalf("sources = %d, want the local one", len(cfg.Sources))
+	}
+	if cfg.Remote.Mode != RemoteMerge || cfg.Remote.PollInterval != DefaultRemotePollInterval ||
+		cfg.Remote.CacheFile != filepath.Join(dir, "shm_remote_config.yaml") {
+		t.Errorf("Remote = %+v, want the defaults", cfg.Remote)
+	}
+
+	cfg, err = LoadWithOptions(path, LoadOptions{Remote: []byte(remoteSources)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Sources) != 2 || cfg.Sources[1].Path != "/var/log/worker.log" {
+		t.Errorf("sources = %+v, want the local and the remote one", cfg.Sources)
+	}
+
+	// The cache is read when no document is given
+	if err := os.WriteFile(cfg.Remote.CacheFile, []byte(remoteSources), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	writeConfig(t, path, strings.Replace(remoteConfig, "enabled: true", "enabled: true\n  mode: replace", 1)+"state_dir: "+dir+"\n")
+	cfg, err = LoadWithOptions(path, LoadOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Sources) != 1 || cfg.Sources[0].Path != "/var/log/worker.log" {
+		t.Errorf("sources = %+v, want the remote one replacing the local one", cfg.Sources)
+	}
+
+	// An empty document replaces the local sources with none
+	if _, err := LoadWithOptions(path, LoadOptions{Remote: []byte{}}); err != nil {
+		t.Errorf("empty document: unexpected error: %v", err)
+	}
+
+	for name, remote := range map[string]string{
+		"setting":        "interval: 5s\n" + remoteSources,
+		"invalid source": strings.Replace(remoteSources, "format: json", "format: nope", 1),
+	} {
+		_, err := LoadWithOptions(path, LoadOptions{Remote: []byte(remote)})
+		if err == nil || !strings.Contains(err.Error(), RemoteOrigin) {
+			t.Errorf("%s: error = %v, want one naming the remote configuration", name, err)
+		}
+	}
+}
+
+func TestParse_RemoteConfig(t *testing.T) {
+	for name, invalid := range map[string]string{
+		"invalid mode":  strings.Replace(remoteConfig, "enabled: true", "enabled: true\n  mode: patch", 1),
+		"short polling": strings.Replace(remoteConfig, "enabled: true", "enabled: true\n  poll_interval: 1s", 1),
+	} {
+		if _, err := Parse([]byte(invalid)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"strings"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/expr"
+)
+
+// aggregatorType returns the aggregator type of a metric. Derived metrics
+// are registered as gauges, whose value is replaced at snapshot time.
+func aggregatorType(m *config.Metric) aggregator.MetricType {
+	if m.Type == "derived" {
+		return aggregator.Gauge
+	}
+	return aggregator.MetricType(m.Type)
+}
+
+// derive computes the derived metrics of cfg from the other metrics of a
+// snapshot. A derived metric that cannot be computed, e.g. on division by
+// zero, is left out of the snapshot.
+func (a *Agent) derive(cfg *config.Config, metrics map[string]interface{}) {
+	for _, src := range cfg.Sources {
+		for _, m := range src.Metrics {
+			if m.Type != "derived" {
+				continue
+			}
+			e, err := expr.Parse(m.Expression) // validated with the config
+			if err == nil {
+				var v float64
+				if v, err = e.Eval(func(name string) (float64, bool) { return metricValue(metrics, name) }); err == nil {
+					metrics[m.Name] = v
+					continue
+				}
+			}
+			delete(metrics, m.Name)
+			a.logger.Debug("derived metric left out of the snapshot", "metric", m.Name, "error", err)
+		}
+	}
+}
+
+// metricValue returns the value of a reference of a derived metric: the
+// value of a metric, the sum of the series of a labeled metric or of the
+// counts of a counter_by metric, or an entry of a percentile distribution
+// as "<name>.<entry>". Both may contain dots, e.g. "latency.p99.9": the
+// longest name of a distribution is matched first.
+func metricValue(metrics map[string]interface{}, name string) (float64, bool) {
+	if v, ok := metrics[name]; ok {
+		return scalarValue(v)
+	}
+	for i := strings.LastIndexByte(name, '.'); i > 0; i = strings.LastIndexByte(name[:i], '.') {
+		if d, ok := metrics[name[:i]].(aggregator.Distribution); ok {
+			v, ok := d[name[i+1:]]
+			return v, ok
+		}
+	}
+	return 0, false
+}
+
+// scalarValue converts a snapshot value to a number.
+func scalarValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case aggregator.Counts:
+		return v.Total(), true
+	case []aggregator.Series:
+		var sum float64
+		for _, s := range v {
+			n, ok := scalarValue(s.Value)
+			if !ok {
+				return 0, false
+			}
+			sum += n
+		}
+		return sum, true
+	}
+	return 0, false
+}
@@ -0,0 +1,64 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestAgent_DerivedMetrics(t *testing.T) {
+	cfg := &config.Config{
+		AppName: "test-app",
+		Sources: []config.Source{
+			{
+				Path:   "/var/log/app.log",
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter", Labels: []string{"method"}},
+					{Name: "errors", Type: "counter", Match: &config.Match{Field: "status", Equals: "500"}},
+					{Name: "latency", Type: "percentile", Extract: &config.Extract{Field: "duration"}, Quantiles: []float64{0.5, 0.999}},
+					{Name: "api.latency", Type: "percentile", Extract: &config.Extract{Field: "duration"}, Quantiles: []float64{0.5}},
+					{Name: "error_rate", Type: "derived", Expression: "errors / requests * 100"},
+					{Name: "latency_avg", Type: "derived", Expression: "latency.sum / latency.count"},
+					{Name: "latency_tail", Type: "derived", Expression: "latency.p99.9 / latency.p50"},
+					{Name: "api_latency_count", Type: "derived", Expression: "api.latency.count"},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if got := ag.Metrics(); got["error_rate"] != nil {
+		t.Errorf("error_rate = %v without requests, want it left out", got["error_rate"])
+	}
+
+	for _, line := range []string{
+		`{"method": "GET", "status": "200", "duration": 10}`,
+		`{"method": "GET", "status": "500", "duration": 20}`,
+		`{"method": "POST", "status": "200", "duration": 30}`,
+		`{"method": "POST", "status": "200", "duration": 40}`,
+	} {
+		ag.ProcessLine(0, line)
+	}
+
+	got := ag.Metrics()
+	if got["error_rate"] != 25.0 {
+		t.Errorf("error_rate = %v, want 25", got["error_rate"])
+	}
+	if got["latency_avg"] != 25.0 {
+		t.Errorf("latency_avg = %v, want 25", got["latency_avg"])
+	}
+	// Quantiles and metric names may contain dots
+	if v, ok := got["latency_tail"].(float64); !ok || v < 1 {
+		t.Errorf("latency_tail = %v, want p99.9 / p50", got["latency_tail"])
+	}
+	if got["api_latency_count"] != 4.0 {
+		t.Errorf("api_latency_count = %v, want 4", got["api_latency_count"])
+	}
+}
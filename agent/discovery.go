@@ -0,0 +1,270 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/gelf"
+	"github.com/kolapsis/shm-agent/agent/journald"
+	"github.com/kolapsis/shm-agent/agent/tailer"
+)
+
+// tailerKey identifies a tailer by source and file path, since several
+// files may feed the same source and a file may feed several sources.
+type tailerKey struct {
+	source string
+	path   string
+}
+
+// discoverMode controls how discover treats the files it finds.
+type discoverMode int
+
+const (
+	// discoverInitial requires literal paths to exist and tails from the end.
+	discoverInitial discoverMode = iota
+	// discoverRescan tails newly created files from the beginning.
+	discoverRescan
+	// discoverReload tails files of newly configured sources from the end
+	// and only logs files that cannot be opened.
+	discoverReload
+)
+
+// sourceKey identifies a source across configuration reloads.
+func sourceKey(src *config.Source) string {
+	key := src.Path + "\x00" + src.Format + "\x00" + src.Pattern
+	if src.IsJournald() {
+		key = src.Type + "\x00" + strings.Join(src.Units, ",") + "\x00" + key
+	}
+	if src.IsKubernetes() && src.Kubernetes != nil {
+		key = src.Type + "\x00" + fmt.Sprintf("%v", *src.Kubernetes) + "\x00" + key
+	}
+	if src.IsGELF() && src.GELF != nil {
+		key = src.Type + "\x00" + src.GELF.Listen + "\x00" + key
+	}
+	return key
+}
+
+// needsRescan reports whether any source must be rediscovered periodically:
+// glob paths and kubernetes sources, whose pods come and go, and all files
+// when max_open_files may close some of them.
+func (a *Agent) needsRescan() bool {
+	if a.Config().MaxOpenFiles > 0 {
+		return true
+	}
+	for _, proc := range a.currentProcessors() {
+		if proc.source.IsKubernetes() {
+			return true
+		}
+		if !proc.source.IsJournald() && !proc.source.IsGELF() && config.IsGlob(proc.source.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// discover starts a tailer for every file matching a source path, a reader
+// for every journald source and a listener for every gelf source, that is
+// not already running.
+//
+// On the initial pass, literal paths must exist and files are tailed from
+// their end. Files discovered by later rescans are new, so they are read
+// from the beginning.
+func (a *Agent) discover(ctx context.Context, mode discoverMode) error {
+	a.tailersMu.Lock()
+	defer a.tailersMu.Unlock()
+
+	if a.tailers == nil {
+		a.tailers = make(map[tailerKey]*tailer.Tailer)
+	}
+
+	for _, proc := range a.currentProcessors() {
+		if proc.source.IsJournald() {
+			if err := a.startJournal(ctx, proc, mode); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if proc.source.IsGELF() {
+			if err := a.startGELF(ctx, proc, mode); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if proc.source.IsKubernetes() {
+			if err := a.discoverPods(ctx, proc, mode); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if proc.source.IsStdin() {
+			a.startStdin(ctx)
+			continue
+		}
+
+		paths, err := resolvePaths(proc.source.Path)
+		if err != nil {
+			return fmt.Errorf("resolving %s: %w", proc.source.Path, err)
+		}
+
+		if mode != discoverRescan && len(paths) == 0 {
+			a.logger.Warn("no files match source path yet", "path", proc.source.Path)
+		}
+
+		current := make(map[string]bool, len(paths))
+		for _, path := range paths {
+			current[path] = true
+			key := tailerKey{source: proc.key, path: path}
+			if _, ok := a.tailers[key]; ok {
+				continue
+			}
+			if _, ok := a.parked[key]; ok {
+				a.unpark(ctx, key, func() *tailer.Tailer { return a.newTailer(proc, path, nil) })
+				continue
+			}
+
+			a.makeRoom()
+			t := a.newTailer(proc, path, nil)
+			if offset, ok := a.resumeOffset(path); ok {
+				err = t.StartAt(ctx, offset)
+			} else if mode == discoverRescan {
+				err = t.StartFromBeginning(ctx)
+			} else {
+				err = t.Start(ctx)
+			}
+			if err != nil {
+				if mode == discoverInitial {
+					return fmt.Errorf("starting tailer for %s: %w", path, err)
+				}
+				a.logger.Error("failed to start tailer", "path", path, "error", err)
+				continue
+			}
+
+			if mode == discoverRescan {
+				a.logger.Info("discovered new file", "source", proc.source.Path, "path", path)
+			}
+			a.tailers[key] = t
+		}
+		a.forgetParked(proc.key, current)
+	}
+
+	return nil
+}
+
+// startJournal starts a journal reader for a journald source that is not
+// already read. Only the initial pass fails on error.
+func (a *Agent) startJournal(ctx context.Context, proc *sourceProcessor, mode discoverMode) error {
+	if a.journals == nil {
+		a.journals = make(map[string]*journald.Reader)
+	}
+	if _, ok := a.journals[proc.key]; ok {
+		return nil
+	}
+
+	r := journald.New(proc.source.Units, a.lineHandler(proc.key), a.logger)
+	if err := r.Start(ctx); err != nil {
+		if mode == discoverInitial {
+			return fmt.Errorf("starting journal reader: %w", err)
+		}
+		a.logger.Error("failed to start journal reader", "units", proc.source.Units, "error", err)
+		return nil
+	}
+
+	a.journals[proc.key] = r
+	return nil
+}
+
+// startGELF starts a GELF listener for a gelf source that is not already
+// receiving. Only the initial pass fails on error.
+func (a *Agent) startGELF(ctx context.Context, proc *sourceProcessor, mode discoverMode) error {
+	if a.gelfs == nil {
+		a.gelfs = make(map[string]*gelf.Listener)
+	}
+	if _, ok := a.gelfs[proc.key]; ok {
+		return nil
+	}
+
+	l := gelf.New(proc.source.GELF.Listen, a.lineHandler(proc.key), a.logger)
+	if err := l.Start(ctx); err != nil {
+		if mode == discoverInitial {
+			return fmt.Errorf("starting GELF listener: %w", err)
+		}
+		a.logger.Error("failed to start GELF listener", "listen", proc.source.GELF.Listen, "error", err)
+		return nil
+	}
+
+	a.gelfs[proc.key] = l
+	return nil
+}
+
+// resumeOffset returns the saved offset of path, if any.
+func (a *Agent) resumeOffset(path string) (int64, bool) {
+	if a.positions == nil {
+		return 0, false
+	}
+	return a.positions.Resume(path)
+}
+
+// lineHandler returns a handler that forwards lines to the current
+// processor of a source, so readers survive configuration reloads.
+func (a *Agent) lineHandler(key string) tailer.LineHandler {
+	return func(line string) {
+		if proc := a.processor(key); proc != nil {
+			proc.processLine(line)
+		}
+	}
+}
+
+// newTailer creates a tailer for a file of a source. Its lines are
+// forwarded like with lineHandler, along with their path, line number and
+// fields.
+func (a *Agent) newTailer(proc *sourceProcessor, path string, fields map[string]interface{}) *tailer.Tailer {
+	var t *tailer.Tailer
+	t = tailer.New(path, func(line string) {
+		if p := a.processor(proc.key); p != nil {
+			p.processLineWith(line, lineContext{path: path, line: t.Line(), fields: fields})
+		}
+	}, a.logger)
+	if proc.countLines {
+		t.CountLines()
+	}
+	t.OnReopen(a.reopenHandler(proc.key))
+	return t
+}
+
+// reopenHandler returns a function counting the reopened files of a
+// source on its current processor.
+func (a *Agent) reopenHandler(key string) func(truncated bool) {
+	return func(truncated bool) {
+		if p := a.processor(key); p != nil {
+			if truncated {
+				p.truncations.Add(1)
+			} else {
+				p.rotations.Add(1)
+			}
+		}
+	}
+}
+
+// resolvePaths expands a source path. Literal paths are returned as is so
+// that a missing file is reported by the tailer.
+func resolvePaths(pattern string) ([]string, error) {
+	if !config.IsGlob(pattern) {
+		return []string{pattern}, nil
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
@@ -0,0 +1,398 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestAgent_GlobSource(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, name := range []string{"a.log", "b.log", "ignored.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte{}, 0644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	cfg := &config.Config{
+		ServerURL:      "https://example.com",
+		AppName:        "test-app",
+		AppVersion:     "1.0.0",
+		Environment:    "test",
+		Interval:       time.Hour,
+		RescanInterval: 50 * time.Millisecond,
+		Sources: []config.Source{
+			{
+				Path:   filepath.Join(dir, "*.log"),
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer ag.Stop(0)
+
+	ag.tailersMu.Lock()
+	initial := len(ag.tailers)
+	ag.tailersMu.Unlock()
+
+	if initial != 2 {
+		t.Errorf("initial tailers = %d, want 2", initial)
+	}
+
+	// A file created after startup is picked up by the rescan and read
+	// from the beginning.
+	if err := os.WriteFile(filepath.Join(dir, "c.log"), []byte("{}\n{}\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+
+	ag.tailersMu.Lock()
+	rescanned := len(ag.tailers)
+	ag.tailersMu.Unlock()
+
+	if rescanned != 3 {
+		t.Errorf("tailers after rescan = %d, want 3", rescanned)
+	}
+
+	if v := ag.Metrics()["requests"].(float64); v != 2 {
+		t.Errorf("requests = %v, want 2", v)
+	}
+}
+
+func TestAgent_MaxOpenFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, name := range []string{"a.log", "b.log", "c.log"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte{}, 0644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	cfg := &config.Config{
+		ServerURL:      "https://example.com",
+		AppName:        "test-app",
+		AppVersion:     "1.0.0",
+		Environment:    "test",
+		Interval:       time.Hour,
+		RescanInterval: 50 * time.Millisecond,
+		MaxOpenFiles:   2,
+		Sources: []config.Source{
+			{
+				Path:   filepath.Join(dir, "*.log"),
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer ag.Stop(0)
+
+	counts := func() (open, parked int) {
+		ag.tailersMu.Lock()
+		defer ag.tailersMu.Unlock()
+		return len(ag.tailers), len(ag.parked)
+	}
+
+	// a.log, the least recently started, was closed to open c.log
+	if open, parked := counts(); open != 2 || parked != 1 {
+		t.Fatalf("open = %d, parked = %d, want 2 and 1", open, parked)
+	}
+
+	// Writes to closed files are read once a rescan reopens them
+	for i, name := range []string{"a.log", "b.log"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("{}\n"), 0644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+
+		time.Sleep(400 * time.Millisecond)
+
+		if v := ag.Metrics()["requests"].(float64); v != float64(i+1) {
+			t.Errorf("requests after writing %s = %v, want %d", name, v, i+1)
+		}
+		if open, parked := counts(); open != 2 || parked != 1 {
+			t.Errorf("open = %d, parked = %d, want 2 and 1", open, parked)
+		}
+	}
+}
+
+func TestResolvePaths_Literal(t *testing.T) {
+	paths, err := resolvePaths("/var/log/app.log")
+	if err != nil {
+		t.Fatalf("resolvePaths() error = %v", err)
+	}
+
+	if len(paths) != 1 || paths[0] != "/var/log/app.log" {
+		t.Errorf("resolvePaths() = %v, want [/var/log/app.log]", paths)
+	}
+}
+
+func TestAgent_JournaldSource(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake journalctl requires a POSIX shell")
+	}
+
+	// A fake journalctl prints two entries and then blocks until killed
+	dir := t.TempDir()
+	script := "#!/bin/sh\n" +
+		"echo '{\"__CURSOR\":\"c1\",\"MESSAGE\":\"level=error\",\"_SYSTEMD_UNIT\":\"app.service\"}'\n" +
+		"echo '{\"__CURSOR\":\"c2\",\"MESSAGE\":\"level=info\",\"_SYSTEMD_UNIT\":\"app.service\"}'\n" +
+		"exec sleep 60\n"
+	if err := os.WriteFile(filepath.Join(dir, "journalctl"), []byte(script), 0755); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cfg := &config.Config{
+		ServerURL:   "https://example.com",
+		AppName:     "test-app",
+		AppVersion:  "1.0.0",
+		Environment: "test",
+		Interval:    time.Hour,
+		Sources: []config.Source{
+			{
+				Type:   config.SourceJournald,
+				Units:  []string{"app.service"},
+				Format: "logfmt",
+				Metrics: []config.Metric{
+					{Name: "entries", Type: "counter"},
+					{
+						Name:  "errors",
+						Type:  "counter",
+						Match: &config.Match{Field: "level", Equals: "error"},
+					},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer ag.Stop(0)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ag.Metrics()["entries"].(float64) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for journal entries")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if v := ag.Metrics()["errors"].(float64); v != 1 {
+		t.Errorf("errors = %v, want 1", v)
+	}
+	if got := ag.Stats().Sources[0].Path; got != "journald:app.service" {
+		t.Errorf("source path = %q, want %q", got, "journald:app.service")
+	}
+}
+
+func TestAgent_GELFSource(t *testing.T) {
+	cfg := &config.Config{
+		ServerURL:   "https://example.com",
+		AppName:     "test-app",
+		AppVersion:  "1.0.0",
+		Environment: "test",
+		Interval:    time.Hour,
+		Sources: []config.Source{
+			{
+				Type:   config.SourceGELF,
+				Format: "logfmt",
+				GELF:   &config.GELFConfig{Listen: "127.0.0.1:0"},
+				Metrics: []config.Metric{
+					{Name: "messages", Type: "counter"},
+					{
+						Name:  "errors",
+						Type:  "counter",
+						Match: &config.Match{Field: "status", Equals: "500"},
+					},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer ag.Stop(0)
+
+	ag.tailersMu.Lock()
+	var addr net.Addr
+	for _, l := range ag.gelfs {
+		addr = l.Addr()
+	}
+	ag.tailersMu.Unlock()
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The additional field _status comes with the fields of short_message
+	for _, msg := range []string{
+		`{"version":"1.1","host":"web-1","short_message":"path=/ msg=ok","_status":500}`,
+		`{"version":"1.1","host":"web-1","short_message":"path=/health","_status":200}`,
+	} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ag.Metrics()["messages"].(float64) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for GELF messages")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if v := ag.Metrics()["errors"].(float64); v != 1 {
+		t.Errorf("errors = %v, want 1", v)
+	}
+	if got := ag.Stats().Sources[0].Path; got != "gelf:127.0.0.1:0" {
+		t.Errorf("source path = %q, want %q", got, "gelf:127.0.0.1:0")
+	}
+}
+
+func TestAgent_KubernetesSource(t *testing.T) {
+	logsDir := t.TempDir()
+	logFile := filepath.Join(logsDir, "shop_web-1_u1", "app", "0.log")
+	if err := os.MkdirAll(filepath.Dir(logFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(logFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var gone atomic.Bool
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if gone.Load() {
+			w.Write([]byte(`{"items":[]}`))
+			return
+		}
+		w.Write([]byte(`{"items":[{"metadata":{"name":"web-1","namespace":"shop","uid":"u1"},` +
+			`"spec":{"nodeName":"node-a","containers":[{"name":"app"}]}}]}`))
+	}))
+	defer api.Close()
+
+	cfg := &config.Config{
+		ServerURL:      "https://example.com",
+		AppName:        "test-app",
+		AppVersion:     "1.0.0",
+		Environment:    "test",
+		Interval:       time.Hour,
+		RescanInterval: 50 * time.Millisecond,
+		Sources: []config.Source{
+			{
+				Type:   config.SourceKubernetes,
+				Format: "json",
+				Kubernetes: &config.KubernetesConfig{
+					Namespace: "shop",
+					LogsDir:   logsDir,
+					APIServer: api.URL,
+				},
+				Metrics: []config.Metric{
+					{
+						Name:   "errors",
+						Type:   "counter",
+						Match:  &config.Match{Field: "level", Equals: "error"},
+						Labels: []string{"kubernetes.pod"},
+					},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer ag.Stop(0)
+	time.Sleep(100 * time.Millisecond)
+
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("2024-01-01T00:00:00Z stdout F {\"level\":\"error\"}\n")
+	f.WriteString("2024-01-01T00:00:01Z stdout P {\"level\":\n")
+	f.WriteString("2024-01-01T00:00:01Z stdout F \"error\"}\n")
+	f.WriteString("2024-01-01T00:00:02Z stdout F {\"level\":\"info\"}\n")
+	f.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ag.Stats().Sources[0].LinesParsed < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for pod log lines")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	series, ok := ag.Metrics()["errors"].([]aggregator.Series)
+	if !ok || len(series) != 1 || series[0].Labels["kubernetes.pod"] != "web-1" || series[0].Value != float64(2) {
+		t.Errorf("errors = %#v, want 2 for pod web-1", ag.Metrics()["errors"])
+	}
+
+	// Once the pod is gone, its file is no longer tailed
+	gone.Store(true)
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		ag.tailersMu.Lock()
+		n := len(ag.tailers)
+		ag.tailersMu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tailer of a deleted pod was not stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
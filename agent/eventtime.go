@@ -0,0 +1,212 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/parser"
+)
+
+// parseEventTime reads the event time of a line as configured by the
+// timestamp of its source.
+func parseEventTime(ts *config.TimestampConfig, data map[string]interface{}) (time.Time, bool) {
+	switch ts.Layout {
+	case config.TimestampUnix, config.TimestampUnixMs:
+		f, ok := parser.GetFieldFloat(data, ts.Field)
+		if !ok {
+			return time.Time{}, false
+		}
+		if ts.Layout == config.TimestampUnixMs {
+			f /= 1e3
+		}
+		return time.Unix(0, int64(f*1e9)), true
+	}
+
+	s, ok := parser.GetFieldString(data, ts.Field)
+	if !ok {
+		return time.Time{}, false
+	}
+	var t time.Time
+	var err error
+	if ts.Layout == config.TimestampRFC3339 {
+		t, err = time.Parse(time.RFC3339Nano, s)
+	} else {
+		t, err = time.ParseInLocation(ts.Layout, s, time.Local)
+	}
+	return t, err == nil
+}
+
+// eventWindow is the snapshot of the metrics of event-time sources over
+// one interval of event time.
+type eventWindow struct {
+	Start, End time.Time
+	Metrics    map[string]interface{}
+}
+
+// openWindow is an interval of event time still counting lines.
+type openWindow struct {
+	agg *aggregator.Aggregator
+	end time.Time
+}
+
+// eventWindows counts the metrics of sources with a timestamp in the
+// interval their lines were logged in. Each open interval has its own
+// aggregator, forked from the agent's. An interval closes once the latest
+// event time seen, the watermark, is past its end by the largest lateness
+// of the sources, or when no line arrived for that long.
+type eventWindows struct {
+	mu        sync.Mutex
+	agg       *aggregator.Aggregator
+	names     map[string]bool // metrics of event-time sources
+	interval  time.Duration
+	lateness  time.Duration
+	open      map[int64]*openWindow // by start, unix nanoseconds
+	closed    time.Time             // end of the last closed interval
+	watermark time.Time
+	lastLine  time.Time // when the last line arrived
+	now       func() time.Time
+
+	// use is held for reading while a line is counted in an interval, so
+	// that an interval is not snapshot in the middle of it.
+	use sync.RWMutex
+}
+
+// newEventWindows creates the event-time intervals of an agent.
+func newEventWindows(agg *aggregator.Aggregator) *eventWindows {
+	return &eventWindows{
+		agg:  agg,
+		open: make(map[int64]*openWindow),
+		now:  time.Now,
+	}
+}
+
+// configure sets the metrics counted by event time and the intervals of
+// cfg. Open intervals keep the metrics they had.
+func (w *eventWindows) configure(cfg *config.Config) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.names = make(map[string]bool)
+	w.lateness = 0
+	for _, src := range cfg.Sources {
+		if src.Timestamp == nil {
+			continue
+		}
+		for _, m := range src.Metrics {
+			w.names[m.Name] = true
+		}
+		w.lateness = max(w.lateness, src.Timestamp.Lateness)
+	}
+	w.interval = cfg.Interval
+}
+
+// replay makes intervals close on event time only, for lines read from
+// history rather than as they are logged.
+func (w *eventWindows) replay() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.now = func() time.Time { return time.Time{} }
+}
+
+// metricNames returns the names of the metrics counted by event time.
+func (w *eventWindows) metricNames() map[string]bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.names
+}
+
+// acquire returns the aggregator of the interval of t, or false when the
+// line is later than lateness behind the watermark or its interval was
+// already sent. On success, release must be called once the line is
+// counted.
+func (w *eventWindows) acquire(t time.Time, lateness time.Duration) (*aggregator.Aggregator, bool) {
+	w.use.RLock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.lastLine = w.now()
+	if t.After(w.watermark) {
+		w.watermark = t
+	}
+	start := t.Truncate(w.interval)
+	if w.watermark.Sub(t) > lateness || start.Before(w.closed) {
+		w.use.RUnlock()
+		return nil, false
+	}
+
+	win, ok := w.open[start.UnixNano()]
+	if !ok {
+		names := make([]string, 0, len(w.names))
+		for name := range w.names {
+			names = append(names, name)
+		}
+		win = &openWindow{agg: w.agg.Fork(names), end: start.Add(w.interval)}
+		w.open[start.UnixNano()] = win
+	}
+	return win.agg, true
+}
+
+// release ends the counting of a line in an interval.
+func (w *eventWindows) release() {
+	w.use.RUnlock()
+}
+
+// close returns the snapshots of the intervals that closed, oldest first,
+// or of every open interval when all is set.
+func (w *eventWindows) close(all bool) []eventWindow {
+	w.use.Lock()
+	defer w.use.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	watermark := w.watermark
+	if now := w.now(); now.Sub(w.lastLine) > w.lateness && now.After(watermark) {
+		watermark = now // the sources are idle
+	}
+
+	var windows []eventWindow
+	for key, win := range w.open {
+		if !all && watermark.Sub(win.end) < w.lateness {
+			continue
+		}
+		windows = append(windows, eventWindow{Start: time.Unix(0, key), End: win.end, Metrics: win.agg.Snapshot()})
+		delete(w.open, key)
+		if win.end.After(w.closed) {
+			w.closed = win.end
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Start.Before(windows[j].Start) })
+	return windows
+}
+
+// latest returns the current values of the most recent open interval, or
+// nil when none is open.
+func (w *eventWindows) latest() map[string]interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var last int64
+	var latest *openWindow
+	for key, win := range w.open {
+		if latest == nil || key > last {
+			last, latest = key, win
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+	return latest.agg.Peek()
+}
+
+// attachEventWindows lets a processor count its lines by event time, if
+// its source has a timestamp.
+func (a *Agent) attachEventWindows(proc *sourceProcessor) {
+	if proc.source.Timestamp != nil {
+		proc.events = a.events
+	}
+}
@@ -0,0 +1,185 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestParseEventTime(t *testing.T) {
+	want := time.Date(2024, 1, 15, 10, 30, 0, 500e6, time.UTC)
+	tests := []struct {
+		layout string
+		value  interface{}
+		ok     bool
+	}{
+		{config.TimestampRFC3339, "2024-01-15T10:30:00.5Z", true},
+		{config.TimestampRFC3339, "2024-01-15T11:30:00.5+01:00", true},
+		{config.TimestampUnix, float64(1705314600.5), true},
+		{config.TimestampUnix, "1705314600.5", true},
+		{config.TimestampUnixMs, int64(1705314600500), true},
+		{"02/Jan/2006:15:04:05.000 -0700", "15/Jan/2024:10:30:00.500 +0000", true},
+		{config.TimestampRFC3339, "15/Jan/2024:10:30:00 +0000", false},
+		{config.TimestampUnix, "yesterday", false},
+	}
+	for _, tt := range tests {
+		ts := &config.TimestampConfig{Field: "time", Layout: tt.layout}
+		got, ok := parseEventTime(ts, map[string]interface{}{"time": tt.value})
+		if ok != tt.ok {
+			t.Errorf("%s %v: ok = %v, want %v", tt.layout, tt.value, ok, tt.ok)
+			continue
+		}
+		if ok && !got.Equal(want) {
+			t.Errorf("%s %v: time = %v, want %v", tt.layout, tt.value, got, want)
+		}
+	}
+
+	if _, ok := parseEventTime(&config.TimestampConfig{Field: "time", Layout: config.TimestampRFC3339}, map[string]interface{}{}); ok {
+		t.Error("missing field: ok = true")
+	}
+}
+
+func TestEventWindows(t *testing.T) {
+	agg := aggregator.New()
+	agg.Register("requests", aggregator.Counter)
+	agg.Register("live", aggregator.Counter)
+
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	w := newEventWindows(agg)
+	w.now = func() time.Time { return now }
+	w.configure(&config.Config{
+		Interval: time.Minute,
+		Sources: []config.Source{{
+			Timestamp: &config.TimestampConfig{Field: "time", Lateness: 30 * time.Second},
+			Metrics:   []config.Metric{{Name: "requests", Type: "counter"}},
+		}},
+	})
+
+	// Catching up on lines logged an hour ago
+	base := now.Add(-time.Hour)
+	count := func(at time.Time) bool {
+		win, ok := w.acquire(at, 30*time.Second)
+		if ok {
+			win.Inc("requests")
+			win.Inc("live") // not counted by event time
+			w.release()
+		}
+		return ok
+	}
+	for _, s := range []int{0, 10, 59, 61, 70} {
+		if !count(base.Add(time.Duration(s) * time.Second)) {
+			t.Fatalf("line at +%ds dropped", s)
+		}
+	}
+	if got := w.close(false); len(got) != 0 {
+		t.Fatalf("closed %d intervals before the watermark passed their end and lateness", len(got))
+	}
+
+	// Late by less than lateness: still counted
+	if !count(base.Add(50 * time.Second)) {
+		t.Error("line within lateness dropped")
+	}
+	// The watermark passes the end of the first interval by lateness
+	count(base.Add(95 * time.Second))
+	if count(base.Add(20 * time.Second)) {
+		t.Error("line later than lateness counted")
+	}
+
+	got := w.close(false)
+	if len(got) != 1 || !got[0].Start.Equal(base) || !got[0].End.Equal(base.Add(time.Minute)) {
+		t.Fatalf("closed %+v, want the first interval", got)
+	}
+	if v := got[0].Metrics["requests"]; v != float64(4) {
+		t.Errorf("first interval requests = %v, want 4", v)
+	}
+	if _, ok := got[0].Metrics["live"]; ok {
+		t.Error("first interval has a metric not counted by event time")
+	}
+	if v := w.latest()["requests"]; v != float64(3) {
+		t.Errorf("latest requests = %v, want 3", v)
+	}
+
+	// A line for a closed interval is dropped, even within lateness
+	w.watermark = base.Add(time.Minute)
+	if count(base.Add(59 * time.Second)) {
+		t.Error("line for a sent interval counted")
+	}
+
+	// Idle sources close their intervals on the wall clock
+	now = now.Add(time.Minute)
+	if got := w.close(false); len(got) != 1 || got[0].Metrics["requests"] != float64(3) {
+		t.Errorf("idle close = %+v, want the second interval", got)
+	}
+}
+
+func TestAgent_EventTime(t *testing.T) {
+	cfg := &config.Config{
+		AppName:  "test-app",
+		Interval: time.Minute,
+		Sources: []config.Source{
+			{
+				Path:      "/var/log/app.log",
+				Format:    "json",
+				Timestamp: &config.TimestampConfig{Field: "ts", Layout: config.TimestampRFC3339, Lateness: time.Minute},
+				Metrics:   []config.Metric{{Name: "requests", Type: "counter"}},
+			},
+			{
+				Path:    "/var/log/other.log",
+				Format:  "json",
+				Metrics: []config.Metric{{Name: "other", Type: "counter"}},
+			},
+		},
+	}
+
+	var sent []map[string]interface{}
+	ag, err := NewBuilder(cfg, WithDryRun(true), WithOutput(OutputFunc(
+		func(_ context.Context, metrics map[string]interface{}) error {
+			sent = append(sent, metrics)
+			return nil
+		}))).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	for _, line := range []string{
+		`{"ts": "2024-01-15T10:30:10Z"}`,
+		`{"ts": "2024-01-15T10:30:50Z"}`,
+		`{"ts": "2024-01-15T10:31:20Z"}`,
+		`{"ts": "2024-01-15T10:20:00Z"}`, // late
+	} {
+		ag.ProcessLine(0, line)
+	}
+	ag.ProcessLine(1, `{}`)
+
+	if got := ag.Metrics()["requests"]; got != float64(1) {
+		t.Errorf("Metrics() requests = %v, want 1 from the latest interval", got)
+	}
+	st := ag.Stats().Sources[0]
+	if st.LinesLate != 1 || st.TimestampErrors != 0 {
+		t.Errorf("late = %d, timestamp errors = %d, want 1 and 0", st.LinesLate, st.TimestampErrors)
+	}
+
+	// Not running: every interval is sent, after the live snapshot
+	if err := ag.sendSnapshot(context.Background()); err != nil {
+		t.Fatalf("sendSnapshot() error = %v", err)
+	}
+	if len(sent) != 3 {
+		t.Fatalf("sent %d snapshots, want 3", len(sent))
+	}
+	if _, ok := sent[0]["requests"]; ok || sent[0]["other"] != float64(1) {
+		t.Errorf("live snapshot = %v, want other only", sent[0])
+	}
+	for i, want := range []float64{2, 1} {
+		if got := sent[i+1]["requests"]; got != want {
+			t.Errorf("interval %d requests = %v, want %v", i, got, want)
+		}
+		if _, ok := sent[i+1]["other"]; ok {
+			t.Errorf("interval %d has a live metric: %v", i, sent[i+1])
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/matcher"
+	"github.com/kolapsis/shm-agent/agent/parser"
+)
+
+// Explanation describes how a source processes a line.
+type Explanation struct {
+	Source string `json:"source"`
+	Line   string `json:"line"`
+
+	// Prefiltered is true when the prefilter skipped the line, which is
+	// then not parsed.
+	Prefiltered bool `json:"prefiltered,omitempty"`
+
+	Parsed bool `json:"parsed"`
+
+	// Fields are the fields of the line once parsed, converted and
+	// completed as configured by the source; nil when it did not parse.
+	Fields map[string]interface{} `json:"fields,omitempty"`
+
+	// Filter is the outcome of the source filter, if any; Kept is false
+	// when the filter dropped the line.
+	Filter []matcher.Step `json:"filter,omitempty"`
+	Kept   bool           `json:"kept"`
+
+	// EventTime is the timestamp of the line for sources with one;
+	// TimestampError is set when it is missing or invalid.
+	EventTime      *time.Time `json:"event_time,omitempty"`
+	TimestampError bool       `json:"timestamp_error,omitempty"`
+
+	Metrics []MetricExplanation `json:"metrics,omitempty"`
+}
+
+// MetricExplanation describes how a metric processes a line.
+type MetricExplanation struct {
+	Name       string         `json:"name"`
+	Type       string         `json:"type"`
+	Matched    bool           `json:"matched"`
+	Conditions []matcher.Step `json:"conditions"`
+
+	// Value is the value extracted from the line, for metrics that extract
+	// one; ExtractError tells why there is none.
+	Value        interface{} `json:"value,omitempty"`
+	ExtractError string      `json:"extract_error,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Explain runs a line through the parser and field settings of the source
+// at index source of cfg, unless its prefilter skips it, and evaluates the
+// source filter and the match conditions, extraction and labels of every
+// metric on it, without recording anything. The line is taken as a whole
+// record, not read from a file: the fields derived from the file path and
+// line number are not set.
+func Explain(cfg *config.Config, source int, line string) (*Explanation, error) {
+	if source < 0 || source >= len(cfg.Sources) {
+		return nil, fmt.Errorf("no source %d", source)
+	}
+	src := &cfg.Sources[source]
+	proc, err := newSourceProcessor(src, aggregator.New(), slog.New(slog.NewTextHandler(io.Discard, nil)), 0)
+	if err != nil {
+		return nil, fmt.Errorf("source[%d]: %w", source, err)
+	}
+	defer proc.close()
+
+	ex := &Explanation{Source: src.Location(), Line: line}
+	if !proc.prefilter.keep(line) {
+		ex.Prefiltered = true
+		return ex, nil
+	}
+	data := proc.fields(line, lineContext{})
+	if data == nil {
+		return ex, nil
+	}
+	ex.Parsed = true
+	ex.Fields = data
+
+	ex.Kept = true
+	if proc.keep != nil {
+		ex.Filter = proc.keep.Explain(data)
+		ex.Kept = ex.Filter[0].Matched
+	}
+	if src.Timestamp != nil {
+		if t, ok := parseEventTime(src.Timestamp, data); ok {
+			ex.EventTime = &t
+		} else {
+			ex.TimestampError = true
+		}
+	}
+
+	for _, m := range proc.metrics {
+		mx := MetricExplanation{
+			Name:       m.cfg.Name,
+			Type:       m.cfg.Type,
+			Conditions: m.matcher.Explain(data),
+		}
+		mx.Matched = mx.Conditions[0].Matched
+		if m.cfg.Extract != nil && m.cfg.Type != "counter" {
+			mx.Value, mx.ExtractError = m.explainValue(data)
+		}
+		if values := m.labelValues(data); values != nil {
+			mx.Labels = make(map[string]string, len(values))
+			for i, name := range m.cfg.Labels {
+				mx.Labels[name] = values[i]
+			}
+		}
+		ex.Metrics = append(ex.Metrics, mx)
+	}
+	return ex, nil
+}
+
+// explainValue returns the value the metric extracts from data, or why it
+// extracts none.
+func (m *metricProcessor) explainValue(data map[string]interface{}) (interface{}, string) {
+	e := m.cfg.Extract
+	if m.cfg.Type == "set" || m.cfg.Type == "counter_by" {
+		if val, ok := extractString(e, m.valueMap, data); ok {
+			return val, ""
+		}
+	} else if val, ok := extractFloat(e, m.valueMap, data); ok {
+		return val, ""
+	}
+
+	switch raw, present := parser.GetField(data, e.Field); {
+	case !present:
+		return nil, fmt.Sprintf("field %q is missing", e.Field)
+	case e.Type != "":
+		return nil, fmt.Sprintf("field %q is not a valid %s: %v", e.Field, e.Type, raw)
+	default:
+		return nil, fmt.Sprintf("field %q is not numeric: %v", e.Field, raw)
+	}
+}
@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestExplain(t *testing.T) {
+	gte := 500.0
+	cfg := &config.Config{
+		Sources: []config.Source{{
+			Path:      "/var/log/app.log",
+			Format:    "json",
+			Types:     map[string]string{"status": "int"},
+			AddFields: map[string]string{"env": "prod"},
+			Filter:    &config.Match{Field: "path", Contains: "/api"},
+			Metrics: []config.Metric{
+				{Name: "requests", Type: "counter", Labels: []string{"method"}},
+				{Name: "errors", Type: "counter", Match: &config.Match{Field: "status", Gte: &gte}},
+				{Name: "latency", Type: "sum", Extract: &config.Extract{Field: "duration"}},
+				{Name: "bytes", Type: "sum", Extract: &config.Extract{Field: "size", Type: "bytes"}},
+			},
+		}},
+	}
+
+	ex, err := Explain(cfg, 0, `{"status": "404", "path": "/api/users", "method": "GET", "duration": 0.25, "size": "lots"}`)
+	if err != nil {
+		t.Fatalf("Explain() error = %v", err)
+	}
+	if !ex.Parsed || !ex.Kept || ex.Fields["env"] != "prod" || ex.Fields["status"] != float64(404) {
+		t.Fatalf("Explain() = %+v, want a parsed and kept line with typed and added fields", ex)
+	}
+	if len(ex.Metrics) != 4 {
+		t.Fatalf("len(Metrics) = %d, want 4", len(ex.Metrics))
+	}
+
+	requests, errs, latency, size := ex.Metrics[0], ex.Metrics[1], ex.Metrics[2], ex.Metrics[3]
+	if !requests.Matched || requests.Labels["method"] != "GET" {
+		t.Errorf("requests = %+v, want a match labeled method=GET", requests)
+	}
+	if errs.Matched || len(errs.Conditions) != 1 || errs.Conditions[0].Value != "404" {
+		t.Errorf("errors = %+v, want no match on status 404", errs)
+	}
+	if latency.Value != 0.25 || latency.ExtractError != "" {
+		t.Errorf("latency = %+v, want the value 0.25", latency)
+	}
+	if size.Value != nil || size.ExtractError != `field "size" is not a valid bytes: lots` {
+		t.Errorf("bytes = %+v, want an extract error", size)
+	}
+
+	ex, err = Explain(cfg, 0, `{"path": "/health"}`)
+	if err != nil {
+		t.Fatalf("Explain() error = %v", err)
+	}
+	if ex.Kept || len(ex.Filter) != 1 || ex.Filter[0].Matched {
+		t.Errorf("Explain() = %+v, want a line dropped by the filter", ex)
+	}
+
+	ex, err = Explain(cfg, 0, `not json`)
+	if err != nil || ex.Parsed || ex.Fields != nil {
+		t.Errorf("Explain() = %+v, %v, want a line that does not parse", ex, err)
+	}
+
+	if _, err := Explain(cfg, 1, `{}`); err == nil {
+		t.Error("Explain() of a missing source succeeded")
+	}
+}
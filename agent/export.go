@@ -0,0 +1,343 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/archive"
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/influx"
+	"github.com/kolapsis/shm-agent/agent/kafka"
+	"github.com/kolapsis/shm-agent/agent/otlp"
+	"github.com/kolapsis/shm-agent/agent/sender"
+	"github.com/kolapsis/shm-agent/agent/statsd"
+)
+
+// exporter delivers snapshots to one of the destinations selected by the
+// output settings.
+type exporter interface {
+	Name() string
+	Send(ctx context.Context, snap sender.Snapshot) error
+
+	// LastDelivery returns when a snapshot was last delivered, or the
+	// zero time.
+	LastDelivery() time.Time
+
+	Close() error
+}
+
+// eventExporter is implemented by exporters that also publish the lines
+// that matched a metric.
+type eventExporter interface {
+	SendEvents(ctx context.Context, events []kafka.Event) error
+}
+
+// exporterFactory creates the exporter of an output.
+type exporterFactory func(a *Agent, cfg *config.Config) (exporter, error)
+
+// exporterFactories holds the outputs, by name. The server is not among
+// them: its sender is created by connect, with the spool, and registers
+// with the server once the agent runs.
+var exporterFactories = map[string]exporterFactory{
+	config.OutputOTLP:     newOTLPOutput,
+	config.OutputStatsD:   newStatsDOutput,
+	config.OutputInfluxDB: newInfluxDBOutput,
+	config.OutputKafka:    newKafkaOutput,
+	config.OutputFile:     newFileOutput,
+}
+
+// destination is an exporter snapshots are delivered to, with its own
+// delivery state: every destination is sent every snapshot concurrently,
+// so that one that fails or hangs does not hold back the others.
+type destination struct {
+	exporter
+	failures  atomic.Int64           // snapshots it failed to receive
+	lastError atomic.Pointer[string] // nil until a delivery failed
+}
+
+// deliver sends a snapshot, and the matched lines to exporters that
+// publish them, recording a failure. Matched lines that could not be
+// published are handed to requeue.
+func (d *destination) deliver(ctx context.Context, snap sender.Snapshot, events []kafka.Event, requeue func([]kafka.Event)) error {
+	err := d.Send(ctx, snap)
+	if ee, ok := d.exporter.(eventExporter); ok && len(events) > 0 {
+		if eerr := ee.SendEvents(ctx, events); eerr != nil {
+			requeue(events)
+			err = errors.Join(err, fmt.Errorf("publishing %d matched lines, kept for the next snapshot: %w", len(events), eerr))
+		}
+	}
+	if err != nil {
+		d.failures.Add(1)
+		msg := err.Error()
+		d.lastError.Store(&msg)
+		return fmt.Errorf("%s: %w", d.Name(), err)
+	}
+	return nil
+}
+
+// requeueMatchedLines keeps matched lines that could not be published for
+// the next snapshot.
+func (a *Agent) requeueMatchedLines(events []kafka.Event) {
+	if a.matchedLines != nil {
+		a.matchedLines.requeue(events)
+	}
+}
+
+// deliver sends a snapshot to every destination concurrently, and returns
+// the errors of those that failed.
+func (a *Agent) deliver(ctx context.Context, snap sender.Snapshot) []error {
+	var events []kafka.Event
+	if a.matchedLines != nil {
+		var dropped int64
+		events, dropped = a.matchedLines.take()
+		if dropped > 0 {
+			a.logger.Warn("too many matched lines waiting to be published, some were dropped",
+				"publishing", len(events), "dropped", dropped)
+		}
+	}
+
+	errs := make([]error, len(a.exports))
+	var wg sync.WaitGroup
+	for i, d := range a.exports {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = d.deliver(ctx, snap, events, a.requeueMatchedLines)
+		}()
+	}
+	wg.Wait()
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			a.outputFailures.Add(1)
+			failed = append(failed, err)
+		}
+	}
+	return failed
+}
+
+// serverOutput delivers snapshots to the SHM server through its sender,
+// which queues them until they are accepted.
+type serverOutput struct {
+	*sender.Sender
+}
+
+// Name returns "shm".
+func (serverOutput) Name() string {
+	return config.OutputSHM
+}
+
+// Close stops the sender.
+func (s serverOutput) Close() error {
+	s.Sender.Close()
+	return nil
+}
+
+// connectExporters creates the exporters of the configured outputs and
+// makes them, with the sender of the server if connected, the
+// destinations. On error, the exporters already created are closed.
+func (a *Agent) connectExporters(cfg *config.Config) error {
+	var exports []*destination
+	for _, name := range cfg.OutputNames() {
+		if name == config.OutputSHM {
+			if a.sender != nil {
+				exports = append(exports, &destination{exporter: serverOutput{a.sender}})
+			}
+			continue
+		}
+		newExporter, ok := exporterFactories[name]
+		if !ok {
+			a.closeDestinations(exports)
+			return fmt.Errorf("unknown output %s", name)
+		}
+		exp, err := newExporter(a, cfg)
+		if err != nil {
+			a.closeDestinations(exports)
+			return fmt.Errorf("output %s: %w", name, err)
+		}
+		exports = append(exports, &destination{exporter: exp})
+	}
+	a.exports = exports
+	return nil
+}
+
+// closeExporters closes the exporters of every destination, the sender
+// of the server included. The destinations are kept, so that their
+// state is still reported once stopped.
+func (a *Agent) closeExporters() {
+	a.closeDestinations(a.exports)
+}
+
+// closeDestinations closes the exporters of destinations.
+func (a *Agent) closeDestinations(ds []*destination) {
+	for _, d := range ds {
+		if err := d.Close(); err != nil {
+			a.logger.Warn("error closing output", "output", d.Name(), "error", err)
+		}
+	}
+}
+
+// newOTLPOutput creates the exporter of the otlp output.
+func newOTLPOutput(a *Agent, cfg *config.Config) (exporter, error) {
+	exp, err := a.newOTLPExporter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	a.logger.Info("exporting metrics over OTLP", "endpoint", otlp.MetricsURL(cfg.OTLP.Endpoint))
+	return exp, nil
+}
+
+// newStatsDOutput creates the client of the statsd output.
+func newStatsDOutput(a *Agent, cfg *config.Config) (exporter, error) {
+	c := statsd.New(statsd.Config{
+		Address:   cfg.StatsD.Address,
+		Prefix:    cfg.StatsD.Prefix,
+		DogStatsD: cfg.StatsD.DogStatsD,
+		Tags:      cfg.StatsD.Tags,
+		Types:     a.aggregator.GetMetricType,
+	})
+	if err := c.Dial(); err != nil {
+		return nil, err
+	}
+	a.logger.Info("sending metrics to statsd", "address", cfg.StatsD.Address, "dogstatsd", cfg.StatsD.DogStatsD)
+	return c, nil
+}
+
+// newInfluxDBOutput creates the writer of the influxdb output.
+func newInfluxDBOutput(a *Agent, cfg *config.Config) (exporter, error) {
+	client, err := a.outputHTTPClient(cfg, cfg.InfluxDB.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	w := influx.New(influx.Config{
+		URL:       cfg.InfluxDB.URL,
+		Org:       cfg.InfluxDB.Org,
+		Bucket:    cfg.InfluxDB.Bucket,
+		Token:     cfg.InfluxDB.Token,
+		TokenFile: cfg.InfluxDB.TokenFile,
+		Tags:      cfg.InfluxDB.Tags,
+		Client:    client,
+	})
+	a.logger.Info("writing metrics to InfluxDB", "url", cfg.InfluxDB.URL, "bucket", cfg.InfluxDB.Bucket)
+	return w, nil
+}
+
+// newKafkaOutput creates the writer of the kafka output.
+func newKafkaOutput(a *Agent, cfg *config.Config) (exporter, error) {
+	w, err := newKafkaWriter(a, cfg)
+	if err != nil {
+		return nil, err
+	}
+	a.logger.Info("producing metrics to Kafka", "brokers", cfg.Kafka.Brokers, "topic", cfg.Kafka.Topic,
+		"events_topic", cfg.Kafka.EventsTopic)
+	return w, nil
+}
+
+// newFileOutput creates the writer of the file output.
+func newFileOutput(a *Agent, cfg *config.Config) (exporter, error) {
+	w := archive.New(archive.Config{
+		Path:        cfg.File.Path,
+		MaxBytes:    cfg.File.MaxBytes,
+		MaxFiles:    cfg.File.MaxFiles,
+		AppName:     cfg.AppName,
+		AppVersion:  cfg.AppVersion,
+		Environment: cfg.Environment,
+	})
+	a.logger.Info("writing metrics to a file", "path", cfg.File.Path)
+	return w, nil
+}
+
+// newOTLPExporter creates the exporter of the otlp output.
+func (a *Agent) newOTLPExporter(cfg *config.Config) (*otlp.Exporter, error) {
+	client, err := a.outputHTTPClient(cfg, cfg.OTLP.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	resource := map[string]string{"service.name": cfg.AppName}
+	if cfg.AppVersion != "" {
+		resource["service.version"] = cfg.AppVersion
+	}
+	if cfg.Environment != "" {
+		resource["deployment.environment"] = cfg.Environment
+	}
+	if host, err := os.Hostname(); err == nil {
+		resource["host.name"] = host
+	}
+
+	return otlp.New(otlp.Config{
+		Endpoint: cfg.OTLP.Endpoint,
+		Headers:  cfg.OTLP.Headers,
+		Client:   client,
+		Types:    a.aggregator.GetMetricType,
+		Resource: resource,
+		Version:  Version,
+	}), nil
+}
+
+// outputHTTPClient creates the HTTP client of an output, with the http,
+// tls and proxy settings of the server overridden by the http settings of
+// the output.
+func (a *Agent) outputHTTPClient(cfg *config.Config, h config.HTTPConfig) (*http.Client, error) {
+	ocfg := *cfg
+	ocfg.HTTP = h.Inherit(cfg.HTTP)
+	scfg, err := senderConfig(&ocfg, a.logger)
+	if err != nil {
+		return nil, err
+	}
+	return sender.NewHTTPClient(scfg.Transport, a.logger), nil
+}
+
+// newKafkaWriter creates the exporter of the kafka output. Messages carry
+// the instance id, so the identity is loaded, or generated, as with the
+// server.
+func newKafkaWriter(a *Agent, cfg *config.Config) (*kafka.Writer, error) {
+	ident, _, err := a.identity(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	switch cfg.Kafka.Key {
+	case config.KafkaKeyInstanceID:
+		key = []byte(ident.InstanceID)
+	case config.KafkaKeyAppName:
+		key = []byte(cfg.AppName)
+	}
+	codec := kafka.CodecNone
+	switch cfg.Kafka.Compression {
+	case config.KafkaCompressionGzip:
+		codec = kafka.CodecGzip
+	case config.KafkaCompressionZstd:
+		codec = kafka.CodecZstd
+	}
+	acks := kafka.AcksAll
+	switch cfg.Kafka.Acks {
+	case config.KafkaAcksLeader:
+		acks = kafka.AcksLeader
+	case config.KafkaAcksNone:
+		acks = kafka.AcksNone
+	}
+
+	return kafka.New(kafka.Config{
+		Brokers:     cfg.Kafka.Brokers,
+		Topic:       cfg.Kafka.Topic,
+		EventsTopic: cfg.Kafka.EventsTopic,
+		Key:         key,
+		Acks:        acks,
+		Codec:       codec,
+		Timeout:     cfg.Kafka.Timeout,
+		InstanceID:  ident.InstanceID,
+		AppName:     cfg.AppName,
+		AppVersion:  cfg.AppVersion,
+		Environment: cfg.Environment,
+	}), nil
+}
@@ -0,0 +1,276 @@
+// SPDX-License-Identifier: MIT
+
+// Package expr evaluates arithmetic expressions over named values, such as
+// "http_5xx / http_requests * 100".
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// ErrDivisionByZero is returned by Eval when a divisor evaluates to zero.
+var ErrDivisionByZero = errors.New("division by zero")
+
+// Expr is a parsed expression.
+type Expr struct {
+	root node
+	vars []string
+}
+
+// node is a node of the expression tree.
+type node interface {
+	eval(lookup func(string) (float64, bool)) (float64, error)
+}
+
+type number float64
+
+type variable string
+
+type unary struct {
+	x node // negated
+}
+
+type binary struct {
+	op   byte // '+', '-', '*' or '/'
+	x, y node
+}
+
+func (n number) eval(func(string) (float64, bool)) (float64, error) {
+	return float64(n), nil
+}
+
+func (v variable) eval(lookup func(string) (float64, bool)) (float64, error) {
+	value, ok := lookup(string(v))
+	if !ok {
+		return 0, fmt.Errorf("no value for %s", string(v))
+	}
+	return value, nil
+}
+
+func (u unary) eval(lookup func(string) (float64, bool)) (float64, error) {
+	x, err := u.x.eval(lookup)
+	return -x, err
+}
+
+func (b binary) eval(lookup func(string) (float64, bool)) (float64, error) {
+	x, err := b.x.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	y, err := b.y.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	switch b.op {
+	case '+':
+		return x + y, nil
+	case '-':
+		return x - y, nil
+	case '*':
+		return x * y, nil
+	default:
+		if y == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return x / y, nil
+	}
+}
+
+// Parse parses an expression made of numbers, variables, the +, -, * and /
+// operators and parentheses. Variable names start with a letter or an
+// underscore and may contain letters, digits, underscores and dots.
+func Parse(s string) (*Expr, error) {
+	p := &exprParser{input: s}
+	p.next()
+	root, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+
+	names := make([]string, 0, len(p.vars))
+	for name := range p.vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &Expr{root: root, vars: names}, nil
+}
+
+// Vars returns the names of the variables of the expression, sorted.
+func (e *Expr) Vars() []string {
+	return e.vars
+}
+
+// Eval evaluates the expression, reading variables with lookup. It fails
+// when a variable has no value or on division by zero.
+func (e *Expr) Eval(lookup func(name string) (float64, bool)) (float64, error) {
+	return e.root.eval(lookup)
+}
+
+// Token kinds.
+const (
+	tokEOF = iota
+	tokNumber
+	tokIdent
+	tokOp // one of + - * / ( )
+	tokInvalid
+)
+
+type token struct {
+	kind int
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// exprParser is a recursive descent parser:
+//
+//	sum     = product { ("+" | "-") product }
+//	product = unary { ("*" | "/") unary }
+//	unary   = "-" unary | primary
+//	primary = number | variable | "(" sum ")"
+type exprParser struct {
+	input string
+	pos   int
+	tok   token
+	vars  map[string]bool
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("at offset %d: %s", p.tok.pos, fmt.Sprintf(format, args...))
+}
+
+// next reads the next token into p.tok.
+func (p *exprParser) next() {
+	for p.pos < len(p.input) && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos == len(p.input) {
+		p.tok = token{kind: tokEOF, pos: start}
+		return
+	}
+
+	c := p.input[p.pos]
+	switch {
+	case isDigit(c) || c == '.':
+		for p.pos < len(p.input) && (isDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		p.tok = token{kind: tokNumber, text: p.input[start:p.pos], pos: start}
+	case isLetter(c):
+		for p.pos < len(p.input) && (isLetter(p.input[p.pos]) || isDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		p.tok = token{kind: tokIdent, text: p.input[start:p.pos], pos: start}
+	case c == '+' || c == '-' || c == '*' || c == '/' || c == '(' || c == ')':
+		p.pos++
+		p.tok = token{kind: tokOp, text: string(c), pos: start}
+	default:
+		p.pos++
+		p.tok = token{kind: tokInvalid, text: string(c), pos: start}
+	}
+}
+
+// isOp reports whether the current token is the operator op.
+func (p *exprParser) isOp(op string) bool {
+	return p.tok.kind == tokOp && p.tok.text == op
+}
+
+func (p *exprParser) parseSum() (node, error) {
+	x, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+") || p.isOp("-") {
+		op := p.tok.text[0]
+		p.next()
+		y, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		x = binary{op: op, x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseProduct() (node, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("*") || p.isOp("/") {
+		op := p.tok.text[0]
+		p.next()
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		x = binary{op: op, x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseUnary() (node, error) {
+	if p.isOp("-") {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unary{x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (node, error) {
+	tok := p.tok
+	switch {
+	case tok.kind == tokNumber:
+		v, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", tok)
+		}
+		p.next()
+		return number(v), nil
+	case tok.kind == tokIdent:
+		if p.vars == nil {
+			p.vars = make(map[string]bool)
+		}
+		p.vars[tok.text] = true
+		p.next()
+		return variable(tok.text), nil
+	case p.isOp("("):
+		p.next()
+		x, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOp(")") {
+			return nil, p.errorf("expected \")\", got %s", p.tok)
+		}
+		p.next()
+		return x, nil
+	default:
+		return nil, p.errorf("unexpected %s", tok)
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: MIT
+
+package expr
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	values := map[string]float64{
+		"http_5xx":      5,
+		"http_requests": 200,
+		"latency.sum":   30,
+		"latency.count": 10,
+		"zero":          0,
+	}
+	lookup := func(name string) (float64, bool) {
+		v, ok := values[name]
+		return v, ok
+	}
+
+	tests := []struct {
+		expr string
+		want float64
+	}{
+		{"http_5xx / http_requests * 100", 2.5},
+		{"latency.sum / latency.count", 3},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"-http_5xx + 10", 5},
+		{"--2", 2},
+		{"0.5 * 4", 2},
+	}
+	for _, tt := range tests {
+		e, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", tt.expr, err)
+			continue
+		}
+		got, err := e.Eval(lookup)
+		if err != nil || got != tt.want {
+			t.Errorf("Eval(%q) = %v, %v; want %v", tt.expr, got, err, tt.want)
+		}
+	}
+
+	e, _ := Parse("http_5xx / zero")
+	if _, err := e.Eval(lookup); !errors.Is(err, ErrDivisionByZero) {
+		t.Errorf("division by zero: error = %v", err)
+	}
+	e, _ = Parse("missing + 1")
+	if _, err := e.Eval(lookup); err == nil {
+		t.Error("expected error for a variable without value")
+	}
+}
+
+func TestParse(t *testing.T) {
+	e, err := Parse("b / (a + b) * a")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if got := e.Vars(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("Vars() = %v, want [a b]", got)
+	}
+
+	for _, s := range []string{"", "a +", "(a", "a)", "a b", "a % b", "1.2.3", "*a"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q): expected error", s)
+		}
+	}
+}
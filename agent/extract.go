@@ -0,0 +1,195 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/parser"
+)
+
+// extractFloat returns the numeric value of an extract field, after its
+// transforms, value map vm (nil for none) and type conversion.
+func extractFloat(e *config.Extract, vm *valueMap, data map[string]interface{}) (float64, bool) {
+	if len(e.Transform) == 0 && vm == nil && e.Type == "" {
+		return parser.GetFieldFloat(data, e.Field)
+	}
+	s, ok := extractTransformed(e, vm, data)
+	if !ok {
+		return 0, false
+	}
+	return convertValue(e.Type, s)
+}
+
+// extractString returns the value of an extract field as a string, after
+// its transforms and value map. With a type, the converted number is
+// formatted, so that "1.5s" and "1500ms" are the same value.
+func extractString(e *config.Extract, vm *valueMap, data map[string]interface{}) (string, bool) {
+	if e.Type == "" {
+		return extractTransformed(e, vm, data)
+	}
+	v, ok := extractFloat(e, vm, data)
+	if !ok {
+		return "", false
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64), true
+}
+
+// extractTransformed returns the value of an extract field as a string,
+// with its transforms applied in order, then its value map.
+func extractTransformed(e *config.Extract, vm *valueMap, data map[string]interface{}) (string, bool) {
+	s, ok := parser.GetFieldString(data, e.Field)
+	if !ok {
+		return "", false
+	}
+	for _, t := range e.Transform {
+		switch t {
+		case "lowercase":
+			s = strings.ToLower(s)
+		case "uppercase":
+			s = strings.ToUpper(s)
+		case "trim":
+			s = strings.TrimSpace(s)
+		}
+	}
+	return vm.apply(s), true
+}
+
+// valueMap converts values into categories, see config.ValueMap.
+type valueMap struct {
+	values     map[string]string
+	rules      []valueRule
+	def        string
+	hasDefault bool
+}
+
+// valueRule is a compiled config.ValueRule.
+type valueRule struct {
+	re      *regexp.Regexp // nil for numeric bounds
+	gte, lt *float64
+	value   string
+}
+
+// newValueMap compiles a value map, returning nil for a nil map.
+func newValueMap(cfg *config.ValueMap) (*valueMap, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	vm := &valueMap{values: cfg.Values, def: cfg.Default, hasDefault: cfg.Default != ""}
+	for _, r := range cfg.Rules {
+		rule := valueRule{gte: r.Gte, lt: r.Lt, value: r.Value}
+		if r.Regex != "" {
+			re, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex: %w", err)
+			}
+			rule.re = re
+		}
+		vm.rules = append(vm.rules, rule)
+	}
+	return vm, nil
+}
+
+// apply returns the category of s, or s itself when nothing maps it and
+// there is no default. A nil map returns s.
+func (vm *valueMap) apply(s string) string {
+	if vm == nil {
+		return s
+	}
+	if v, ok := vm.values[s]; ok {
+		return v
+	}
+	for _, r := range vm.rules {
+		if r.matches(s) {
+			return r.value
+		}
+	}
+	if vm.hasDefault {
+		return vm.def
+	}
+	return s
+}
+
+// matches reports whether s matches the regex, or is a number within the
+// bounds, of the rule.
+func (r *valueRule) matches(s string) bool {
+	if r.re != nil {
+		return r.re.MatchString(s)
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(f) {
+		return false
+	}
+	return (r.gte == nil || f >= *r.gte) && (r.lt == nil || f < *r.lt)
+}
+
+// convertValue converts a string to a number of the given extract type.
+func convertValue(typ, s string) (float64, bool) {
+	switch typ {
+	case "int":
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return float64(n), true
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			return 0, false
+		}
+		return math.Trunc(f), true
+	case "duration":
+		return parseDuration(s)
+	case "bytes":
+		return parseBytes(s)
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+// parseDuration parses a Go duration such as "1.5s" or "1m30s" into
+// seconds. A plain number is taken as seconds.
+func parseDuration(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, true
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, false
+	}
+	return d.Seconds(), true
+}
+
+// byteSize matches a size such as "2MB", "1.5 GiB" or "512".
+var byteSize = regexp.MustCompile(`^([0-9]*\.?[0-9]+)\s*([A-Za-z]*)$`)
+
+// byteUnits are the multipliers of size units, lowercased. Single letters
+// are binary, as in nginx or JVM settings.
+var byteUnits = map[string]float64{
+	"": 1, "b": 1,
+	"k": 1 << 10, "kib": 1 << 10, "kb": 1e3,
+	"m": 1 << 20, "mib": 1 << 20, "mb": 1e6,
+	"g": 1 << 30, "gib": 1 << 30, "gb": 1e9,
+	"t": 1 << 40, "tib": 1 << 40, "tb": 1e12,
+}
+
+// parseBytes parses a size with an optional unit into bytes.
+func parseBytes(s string) (float64, bool) {
+	m := byteSize.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, false
+	}
+	unit, ok := byteUnits[strings.ToLower(m[2])]
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	return f * unit, true
+}
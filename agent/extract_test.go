@@ -0,0 +1,122 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestConvertValue(t *testing.T) {
+	tests := []struct {
+		typ  string
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"", "1.5", 1.5, true},
+		{"", "1.5s", 0, false},
+		{"int", "42", 42, true},
+		{"int", "42.9", 42, true},
+		{"int", "forty", 0, false},
+		{"float", "0.25", 0.25, true},
+		{"duration", "1.5s", 1.5, true},
+		{"duration", "250ms", 0.25, true},
+		{"duration", "1m30s", 90, true},
+		{"duration", "2", 2, true},
+		{"duration", "soon", 0, false},
+		{"bytes", "512", 512, true},
+		{"bytes", "2MB", 2e6, true},
+		{"bytes", "1.5 KiB", 1536, true},
+		{"bytes", "2k", 2048, true},
+		{"bytes", "3G", 3 << 30, true},
+		{"bytes", "10 parsecs", 0, false},
+		{"bytes", "-", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := convertValue(tt.typ, tt.in)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("convertValue(%q, %q) = %v, %v; want %v, %v", tt.typ, tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAgent_ExtractTransforms(t *testing.T) {
+	cfg := &config.Config{
+		AppName: "test-app",
+		Sources: []config.Source{
+			{
+				Path:   "/var/log/app.log",
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "users", Type: "set", Extract: &config.Extract{Field: "user", Transform: []string{"trim", "lowercase"}}},
+					{Name: "latency", Type: "sum", Extract: &config.Extract{Field: "took", Type: "duration"}},
+					{Name: "payload", Type: "sum", Extract: &config.Extract{Field: "size", Type: "bytes"}},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	for _, line := range []string{
+		`{"user": "Alice", "took": "1.5s", "size": "2KiB"}`,
+		`{"user": " alice ", "took": "250ms", "size": "512"}`,
+		`{"user": "BOB", "took": 1, "size": "1k"}`,
+	} {
+		ag.ProcessLine(0, line)
+	}
+
+	got := ag.Metrics()
+	if got["users"] != 2 {
+		t.Errorf("users = %v, want 2", got["users"])
+	}
+	if got["latency"] != 2.75 {
+		t.Errorf("latency = %v, want 2.75", got["latency"])
+	}
+	if got["payload"] != 3584.0 {
+		t.Errorf("payload = %v, want 3584", got["payload"])
+	}
+}
+
+func TestValueMap(t *testing.T) {
+	lt, gte := 0.1, 1.0
+	vm, err := newValueMap(&config.ValueMap{
+		Values: map[string]string{"warning": "warn", "information": "info"},
+		Rules: []config.ValueRule{
+			{Regex: `^[1-5]\d\d$`, Value: "web"},
+			{Lt: &lt, Value: "fast"},
+			{Gte: &gte, Value: "slow"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("newValueMap() error = %v", err)
+	}
+
+	tests := map[string]string{
+		"warning": "warn",
+		"error":   "error", // kept without a default
+		"404":     "web",
+		"0.05":    "fast",
+		"2.5":     "slow",
+		"0.5":     "0.5",
+	}
+	for in, want := range tests {
+		if got := vm.apply(in); got != want {
+			t.Errorf("apply(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	vm.def, vm.hasDefault = "other", true
+	if got := vm.apply("error"); got != "other" {
+		t.Errorf("apply(error) with a default = %q, want other", got)
+	}
+
+	var none *valueMap
+	if got := none.apply("error"); got != "error" {
+		t.Errorf("nil map apply(error) = %q", got)
+	}
+}
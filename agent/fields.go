@@ -0,0 +1,280 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/parser"
+)
+
+// fieldFilter discards parsed fields according to a source's keep_fields
+// and drop_fields.
+type fieldFilter struct {
+	keep []string
+	drop []string
+}
+
+// newFieldFilter returns a filter, or nil when there is nothing to filter.
+func newFieldFilter(keep, drop []string) *fieldFilter {
+	if len(keep) == 0 && len(drop) == 0 {
+		return nil
+	}
+	return &fieldFilter{keep: keep, drop: drop}
+}
+
+// apply returns data restricted to the kept fields, without the dropped
+// ones. A listed name matches a top-level key of that exact name first,
+// then a nested field in dot notation. data may be modified.
+func (f *fieldFilter) apply(data map[string]interface{}) map[string]interface{} {
+	if len(f.keep) > 0 {
+		kept := make(map[string]interface{}, len(f.keep))
+		for _, path := range f.keep {
+			if v, ok := data[path]; ok {
+				kept[path] = v
+				continue
+			}
+			if v, ok := lookupPath(data, path); ok {
+				setPath(kept, path, v)
+			}
+		}
+		data = kept
+	}
+
+	for _, path := range f.drop {
+		if _, ok := data[path]; ok {
+			delete(data, path)
+			continue
+		}
+		deletePath(data, path)
+	}
+
+	return data
+}
+
+// fieldTypes converts parsed field values according to a source's types,
+// keyed by field name.
+type fieldTypes map[string]string
+
+// apply converts the typed fields of data in place. A listed name matches
+// a top-level key of that exact name first, then a nested field in dot
+// notation. Values that cannot be converted are left unchanged.
+func (t fieldTypes) apply(data map[string]interface{}) {
+	for path, typ := range t {
+		if v, ok := data[path]; ok {
+			if c, ok := coerce(v, typ); ok {
+				data[path] = c
+			}
+			continue
+		}
+		if v, ok := lookupPath(data, path); ok {
+			if c, ok := coerce(v, typ); ok {
+				setPath(data, path, c)
+			}
+		}
+	}
+}
+
+// coerce converts a scalar value to a field type. Numbers are float64, as
+// produced by the JSON parser; int truncates towards zero.
+func coerce(v interface{}, typ string) (interface{}, bool) {
+	switch typ {
+	case config.TypeInt, config.TypeFloat:
+		var f float64
+		switch x := v.(type) {
+		case float64:
+			f = x
+		case string:
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+			if err != nil {
+				return nil, false
+			}
+			f = parsed
+		case bool:
+			if x {
+				f = 1
+			}
+		default:
+			return nil, false
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, false
+		}
+		if typ == config.TypeInt {
+			f = math.Trunc(f)
+		}
+		return f, true
+
+	case config.TypeBool:
+		switch x := v.(type) {
+		case bool:
+			return x, true
+		case float64:
+			return x != 0, true
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(x))
+			if err != nil {
+				return nil, false
+			}
+			return b, true
+		}
+		return nil, false
+
+	case config.TypeString:
+		switch x := v.(type) {
+		case string:
+			return x, true
+		case float64:
+			return strconv.FormatFloat(x, 'f', -1, 64), true
+		case bool:
+			return strconv.FormatBool(x), true
+		}
+	}
+	return nil, false
+}
+
+// addedFields converts a source's add_fields to parsed data values.
+func addedFields(fields map[string]string) map[string]interface{} {
+	if len(fields) == 0 {
+		return nil
+	}
+	added := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		added[k] = v
+	}
+	return added
+}
+
+// mappedField is a compiled map_fields entry.
+type mappedField struct {
+	name, from string
+	vm         *valueMap
+}
+
+// newMappedFields compiles the map_fields of a source, in name order.
+func newMappedFields(src *config.Source) ([]mappedField, error) {
+	var fields []mappedField
+	for _, name := range src.MappedFields() {
+		fm := src.MapFields[name]
+		vm, err := newValueMap(&fm.ValueMap)
+		if err != nil {
+			return nil, fmt.Errorf("map_fields: %s: %w", name, err)
+		}
+		fields = append(fields, mappedField{name: name, from: fm.Field, vm: vm})
+	}
+	return fields, nil
+}
+
+// applyMappedFields sets the mapped fields of a line whose source field is
+// present.
+func applyMappedFields(fields []mappedField, data map[string]interface{}) {
+	for _, f := range fields {
+		if s, ok := parser.GetFieldString(data, f.from); ok {
+			data[f.name] = f.vm.apply(s)
+		}
+	}
+}
+
+// maxPathFieldsCache bounds the paths whose fields are cached. A glob
+// source following dated or rotated files keeps seeing new paths, so the
+// cache starts over once full.
+const maxPathFieldsCache = 1024
+
+// pathFields derives fields from the path of the file a line was read
+// from, with the named groups of a source's path_pattern.
+type pathFields struct {
+	re *regexp.Regexp
+
+	mu    sync.Mutex
+	cache map[string]map[string]interface{} // nil fields when the path does not match
+}
+
+// newPathFields returns the path fields of a pattern, or nil without one.
+func newPathFields(pattern string) (*pathFields, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &pathFields{re: re}, nil
+}
+
+// get returns the fields of a path, nil when it does not match.
+func (f *pathFields) get(path string) map[string]interface{} {
+	if path == "" {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fields, ok := f.cache[path]; ok {
+		return fields
+	}
+
+	var fields map[string]interface{}
+	if m := f.re.FindStringSubmatch(path); m != nil {
+		fields = make(map[string]interface{})
+		for i, name := range f.re.SubexpNames() {
+			if name != "" && m[i] != "" {
+				fields[name] = m[i]
+			}
+		}
+	}
+	if f.cache == nil || len(f.cache) >= maxPathFieldsCache {
+		f.cache = make(map[string]map[string]interface{})
+	}
+	f.cache[path] = fields
+	return fields
+}
+
+// lookupPath returns the nested value at a dotted path.
+func lookupPath(data map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = data
+	for _, part := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// setPath sets the nested value at a dotted path, creating the
+// intermediate maps.
+func setPath(data map[string]interface{}, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	current := data
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := current[part].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			current[part] = next
+		}
+		current = next
+	}
+	current[parts[len(parts)-1]] = value
+}
+
+// deletePath removes the nested value at a dotted path, if present.
+func deletePath(data map[string]interface{}, path string) {
+	parts := strings.Split(path, ".")
+	current := data
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := current[part].(map[string]interface{})
+		if !ok {
+			return
+		}
+		current = next
+	}
+	delete(current, parts[len(parts)-1])
+}
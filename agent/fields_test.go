@@ -0,0 +1,425 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/parser"
+)
+
+func TestFieldFilter(t *testing.T) {
+	line := `{"level":"error","user":{"email":"a@b.c","id":7},"http":{"status":500,"path":"/"},"http.method":"GET","token":"s3cr3t"}`
+
+	tests := []struct {
+		name string
+		keep []string
+		drop []string
+		want map[string]interface{}
+	}{
+		{
+			name: "keep",
+			keep: []string{"level", "http.status", "http.method"},
+			want: map[string]interface{}{
+				"level":       "error",
+				"http":        map[string]interface{}{"status": float64(500)},
+				"http.method": "GET",
+			},
+		},
+		{
+			name: "drop",
+			drop: []string{"token", "user.email", "missing.field"},
+			want: map[string]interface{}{
+				"level":       "error",
+				"user":        map[string]interface{}{"id": float64(7)},
+				"http":        map[string]interface{}{"status": float64(500), "path": "/"},
+				"http.method": "GET",
+			},
+		},
+		{
+			name: "keep then drop",
+			keep: []string{"level", "user"},
+			drop: []string{"user.email"},
+			want: map[string]interface{}{
+				"level": "error",
+				"user":  map[string]interface{}{"id": float64(7)},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := parser.NewJSONParser().Parse(line)
+			got := newFieldFilter(tt.keep, tt.drop).apply(data)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("apply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if newFieldFilter(nil, nil) != nil {
+		t.Error("newFieldFilter() without fields should be nil")
+	}
+}
+
+func TestAgent_AddFields(t *testing.T) {
+	cfg := &config.Config{
+		AppName: "test-app",
+		Sources: []config.Source{
+			{
+				Path:       "/var/log/test.log",
+				Format:     "logfmt",
+				DropFields: []string{"service"},
+				AddFields:  map[string]string{"service": "checkout", "tier": "backend"},
+				Metrics: []config.Metric{
+					{
+						Name:   "requests",
+						Type:   "counter",
+						Match:  &config.Match{Field: "tier", Equals: "backend"},
+						Labels: []string{"service"},
+					},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	// The parsed service is dropped and replaced by the static one
+	ag.ProcessLine(0, `level=info service=other`)
+	ag.ProcessLine(0, `level=error tier=frontend`)
+
+	series, ok := ag.Metrics()["requests"].([]aggregator.Series)
+	if !ok || len(series) != 1 {
+		t.Fatalf("requests = %#v, want one series", ag.Metrics()["requests"])
+	}
+	if series[0].Labels["service"] != "checkout" || series[0].Value != float64(2) {
+		t.Errorf("series = %+v, want service=checkout with 2 lines", series[0])
+	}
+}
+
+func TestCoerce(t *testing.T) {
+	tests := []struct {
+		value  interface{}
+		typ    string
+		want   interface{}
+		wantOK bool
+	}{
+		{"200", config.TypeInt, float64(200), true},
+		{"3.7", config.TypeInt, float64(3), true},
+		{float64(-3.7), config.TypeInt, float64(-3), true},
+		{" 1.50", config.TypeFloat, 1.5, true},
+		{"-", config.TypeFloat, nil, false},
+		{"NaN", config.TypeFloat, nil, false},
+		{true, config.TypeInt, float64(1), true},
+		{"true", config.TypeBool, true, true},
+		{"0", config.TypeBool, false, true},
+		{float64(2), config.TypeBool, true, true},
+		{"yes", config.TypeBool, nil, false},
+		{float64(1.5), config.TypeString, "1.5", true},
+		{false, config.TypeString, "false", true},
+		{map[string]interface{}{}, config.TypeString, nil, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := coerce(tt.value, tt.typ)
+		if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("coerce(%#v, %s) = %#v, %v; want %#v, %v", tt.value, tt.typ, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestAgent_FieldTypes(t *testing.T) {
+	metrics := func(name string) []config.Metric {
+		return []config.Metric{
+			{Name: name + "_slow", Type: "counter", Match: &config.Match{Field: "status", Equals: "500"}},
+			{Name: name + "_durations", Type: "set", Extract: &config.Extract{Field: "duration"}},
+		}
+	}
+	types := map[string]string{"status": config.TypeInt, "duration": config.TypeFloat}
+
+	cfg := &config.Config{
+		AppName: "test-app",
+		Sources: []config.Source{
+			{
+				Path:    "/var/log/app.json",
+				Format:  "json",
+				Types:   types,
+				Metrics: metrics("json"),
+			},
+			{
+				Path:    "/var/log/app.log",
+				Format:  "regex",
+				Pattern: `^(?P<status>\S+) (?P<duration>\S+)$`,
+				Types:   types,
+				Metrics: metrics("regex"),
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	ag.ProcessLine(0, `{"status":500.0,"duration":1.50}`)
+	ag.ProcessLine(0, `{"status":"500","duration":"1.5"}`)
+	ag.ProcessLine(1, `500.0 1.50`)
+	ag.ProcessLine(1, `500 1.5`)
+
+	// Both formats produce the same values once typed
+	got := ag.Metrics()
+	for _, name := range []string{"json", "regex"} {
+		if got[name+"_slow"] != float64(2) {
+			t.Errorf("%s_slow = %v, want 2", name, got[name+"_slow"])
+		}
+		if got[name+"_durations"] != 1 {
+			t.Errorf("%s_durations = %v, want 1 unique value", name, got[name+"_durations"])
+		}
+	}
+}
+
+func TestAgent_ContextFields(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+
+	if err := os.WriteFile(path, []byte("a\nb\nc\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	one := 1.0
+	cfg := &config.Config{
+		ServerURL:   "https://example.com",
+		AppName:     "test-app",
+		AppVersion:  "1.0.0",
+		Environment: "test",
+		Sources: []config.Source{
+			{
+				Path:    filepath.Join(dir, "*.log"),
+				Format:  "regex",
+				Pattern: `^(?P<msg>\w+)$`,
+				Metrics: []config.Metric{
+					{
+						Name:   "lines",
+						Type:   "counter",
+						Labels: []string{config.FieldPath},
+					},
+					{
+						Name:  "after_first",
+						Type:  "counter",
+						Match: &config.Match{Field: config.FieldLine, Gt: &one},
+					},
+					{
+						Name:  "from_source",
+						Type:  "counter",
+						Match: &config.Match{Field: config.FieldSource, Equals: filepath.Join(dir, "*.log")},
+					},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true, Logger: slog.Default()})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if _, err := ag.ProcessFile(path); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+
+	series, ok := ag.Metrics()["lines"].([]aggregator.Series)
+	if !ok || len(series) != 1 {
+		t.Fatalf("lines = %#v, want one series", ag.Metrics()["lines"])
+	}
+	if series[0].Labels[config.FieldPath] != path || series[0].Value != float64(3) {
+		t.Errorf("series = %+v, want __path__=%s with 3 lines", series[0], path)
+	}
+
+	metrics := ag.GetAggregator().Peek()
+	if v, _ := metrics["after_first"].(float64); v != 2 {
+		t.Errorf("after_first = %v, want 2", metrics["after_first"])
+	}
+	if v, _ := metrics["from_source"].(float64); v != 3 {
+		t.Errorf("from_source = %v, want 3", metrics["from_source"])
+	}
+}
+
+func TestAgent_PathPattern(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"shop.access.log": "GET\nPOST\n",
+		"blog.access.log": "GET\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &config.Config{
+		AppName: "test-app",
+		Sources: []config.Source{
+			{
+				Path:        filepath.Join(dir, "*.access.log"),
+				Format:      "regex",
+				Pattern:     `^(?P<method>\w+)$`,
+				PathPattern: `(?P<vhost>[^/\\]+)\.access\.log$`,
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter", Labels: []string{"vhost"}},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	for _, name := range []string{"shop.access.log", "blog.access.log"} {
+		if _, err := ag.ProcessFile(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("ProcessFile() error = %v", err)
+		}
+	}
+
+	got := make(map[string]interface{})
+	series, _ := ag.Metrics()["requests"].([]aggregator.Series)
+	for _, s := range series {
+		got[s.Labels["vhost"]] = s.Value
+	}
+	want := map[string]interface{}{"shop": float64(2), "blog": float64(1)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("requests by vhost = %v, want %v", got, want)
+	}
+}
+
+func TestPathFields_Cache(t *testing.T) {
+	f, err := newPathFields(`app-(?P<day>\d{4}-\d{2}-\d{2})\.log$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Dated files keep adding paths, the cache stays bounded
+	for i := 0; i < 3*maxPathFieldsCache; i++ {
+		path := fmt.Sprintf("/var/log/app-%04d-01-01.log", i)
+		if got := f.get(path); got["day"] != fmt.Sprintf("%04d-01-01", i) {
+			t.Fatalf("get(%q) = %v", path, got)
+		}
+		if n := len(f.cache); n > maxPathFieldsCache {
+			t.Fatalf("cache holds %d paths, want at most %d", n, maxPathFieldsCache)
+		}
+	}
+	if got := f.get("/var/log/other.log"); got != nil {
+		t.Errorf("get() = %v for a path that does not match, want nil", got)
+	}
+}
+
+func TestAgent_Filter(t *testing.T) {
+	cfg := &config.Config{
+		AppName: "test-app",
+		Sources: []config.Source{
+			{
+				Path:    "/var/log/app.log",
+				Format:  "regex",
+				Pattern: `^(?P<path>\S+) (?P<status>\d+)$`,
+				Filter:  &config.Match{Not: &config.Match{Field: "path", Equals: "/healthz"}},
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+					{Name: "errors", Type: "counter", Match: &config.Match{Field: "status", Equals: "500"}},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	for _, line := range []string{"/healthz 200", "/api 200", "/healthz 500", "/api 500"} {
+		ag.ProcessLine(0, line)
+	}
+
+	metrics := ag.Metrics()
+	if metrics["requests"] != float64(2) || metrics["errors"] != float64(1) {
+		t.Errorf("requests = %v, errors = %v, want 2 and 1", metrics["requests"], metrics["errors"])
+	}
+	st := ag.Stats().Sources[0]
+	if st.LinesParsed != 4 || st.LinesFiltered != 2 || st.LinesMatched != 3 {
+		t.Errorf("parsed %d, filtered %d, matched %d, want 4, 2 and 3", st.LinesParsed, st.LinesFiltered, st.LinesMatched)
+	}
+}
+
+func TestAgent_MapFields(t *testing.T) {
+	cfg := &config.Config{
+		AppName: "test-app",
+		Sources: []config.Source{
+			{
+				Path:   "/var/log/app.log",
+				Format: "json",
+				MapFields: map[string]config.FieldMap{
+					"status_class": {Field: "status", ValueMap: config.ValueMap{
+						Rules: []config.ValueRule{
+							{Regex: `^2`, Value: "2xx"},
+							{Regex: `^4`, Value: "4xx"},
+							{Regex: `^5`, Value: "5xx"},
+						},
+						Default: "other",
+					}},
+					"level": {Field: "level", ValueMap: config.ValueMap{
+						Values: map[string]string{"warning": "warn"},
+					}},
+				},
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter", Labels: []string{"status_class"}},
+					{Name: "warnings", Type: "counter", Match: &config.Match{Field: "level", Equals: "warn"}},
+					{Name: "levels", Type: "set", Extract: &config.Extract{
+						Field:     "level",
+						Transform: []string{"lowercase"},
+						Map:       &config.ValueMap{Values: map[string]string{"warn": "w", "error": "e"}},
+					}},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	for _, line := range []string{
+		`{"status": 200, "level": "info"}`,
+		`{"status": 204, "level": "warning"}`,
+		`{"status": 404, "level": "warn"}`,
+		`{"status": 503, "level": "ERROR"}`,
+		`{"status": 101}`,
+		`{}`,
+	} {
+		ag.ProcessLine(0, line)
+	}
+
+	metrics := ag.Metrics()
+	got := make(map[string]interface{})
+	series, _ := metrics["requests"].([]aggregator.Series)
+	for _, s := range series {
+		got[s.Labels["status_class"]] = s.Value
+	}
+	want := map[string]interface{}{"2xx": float64(2), "4xx": float64(1), "5xx": float64(1), "other": float64(1), "": float64(1)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("requests by status_class = %v, want %v", got, want)
+	}
+	if metrics["warnings"] != float64(2) {
+		t.Errorf("warnings = %v, want 2", metrics["warnings"])
+	}
+	if metrics["levels"] != 3 { // info, w, e
+		t.Errorf("levels = %v, want 3", metrics["levels"])
+	}
+}
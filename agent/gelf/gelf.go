@@ -0,0 +1,286 @@
+// SPDX-License-Identifier: MIT
+
+// Package gelf receives GELF (Graylog Extended Log Format) messages over
+// UDP.
+//
+// Messages may be chunked, and compressed with gzip or zlib. Each message
+// is delivered to the handler as one JSON line, once reassembled and
+// decompressed.
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/logthrottle"
+	"github.com/kolapsis/shm-agent/agent/tailer"
+)
+
+// Limits of the messages received.
+const (
+	maxDatagramSize = 65536   // largest UDP datagram read
+	maxChunks       = 128     // chunks of a message, per the GELF specification
+	maxMessageSize  = 1 << 20 // largest decompressed message delivered
+
+	maxPendingMessages = 1024     // incomplete messages kept at once
+	maxPendingSize     = 32 << 20 // bytes of chunks kept at once
+)
+
+// chunkTimeout is how long the chunks of a message are kept until all of
+// them arrived, per the GELF specification.
+const chunkTimeout = 5 * time.Second
+
+// chunkMagic starts the datagrams holding a chunk of a message.
+var chunkMagic = []byte{0x1e, 0x0f}
+
+// Listener receives GELF messages on a UDP address.
+type Listener struct {
+	addr    string
+	handler tailer.LineHandler
+	logger  *slog.Logger
+	errors  *logthrottle.Logger // recurring errors
+
+	mu     sync.Mutex
+	conn   net.PacketConn
+	done   chan struct{}
+	chunks map[[8]byte]*chunkedMessage // by message ID, only used by run
+	size   int                         // bytes held by chunks
+}
+
+// chunkedMessage is a message whose chunks are still arriving.
+type chunkedMessage struct {
+	parts    [][]byte
+	received int
+	first    time.Time
+}
+
+// New creates a Listener for a UDP address such as ":12201".
+func New(addr string, handler tailer.LineHandler, logger *slog.Logger) *Listener {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return &Listener{
+		addr:    addr,
+		handler: handler,
+		logger:  logger,
+		errors:  logthrottle.New(logger, 0),
+		chunks:  make(map[[8]byte]*chunkedMessage),
+	}
+}
+
+// Start begins receiving messages. They are received until ctx is
+// cancelled or Stop is called.
+func (l *Listener) Start(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.done != nil {
+		return fmt.Errorf("GELF listener already running")
+	}
+
+	conn, err := net.ListenPacket("udp", l.addr)
+	if err != nil {
+		return fmt.Errorf("listening for GELF messages: %w", err)
+	}
+	l.conn = conn
+	l.done = make(chan struct{})
+	go l.run(conn, l.done)
+	go func(done chan struct{}) {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}(l.done)
+
+	l.logger.Info("started receiving GELF messages", "listen", conn.LocalAddr().String())
+	return nil
+}
+
+// Addr returns the address the listener receives on, nil when stopped.
+func (l *Listener) Addr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return nil
+	}
+	return l.conn.LocalAddr()
+}
+
+// Stop stops receiving messages. It waits for the handler to return so no
+// message is delivered after Stop returns.
+func (l *Listener) Stop() {
+	l.mu.Lock()
+	conn, done := l.conn, l.done
+	l.conn, l.done = nil, nil
+	l.mu.Unlock()
+
+	if conn == nil {
+		return
+	}
+	conn.Close()
+	<-done
+	l.errors.Flush()
+	l.logger.Info("stopped receiving GELF messages", "listen", l.addr)
+}
+
+// run receives datagrams until conn is closed. done is closed on return.
+func (l *Listener) run(conn net.PacketConn, done chan struct{}) {
+	defer close(done)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		// Wake up regularly to drop incomplete messages
+		conn.SetReadDeadline(time.Now().Add(chunkTimeout))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				l.expire(time.Now())
+				continue
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				l.logger.Error("error receiving GELF messages", "error", err)
+			}
+			return
+		}
+		l.receive(buf[:n], time.Now())
+	}
+}
+
+// receive handles a datagram: a whole message or a chunk of one.
+func (l *Listener) receive(datagram []byte, now time.Time) {
+	if !bytes.HasPrefix(datagram, chunkMagic) {
+		l.deliver(datagram)
+		return
+	}
+
+	l.expire(now)
+	if len(datagram) < 12 {
+		l.errors.Warn("chunk", "dropping truncated GELF chunk")
+		return
+	}
+	var id [8]byte
+	copy(id[:], datagram[2:10])
+	seq, count := int(datagram[10]), int(datagram[11])
+	if count == 0 || count > maxChunks || seq >= count {
+		l.errors.Warn("chunk", "dropping invalid GELF chunk", "sequence", seq, "count", count)
+		return
+	}
+
+	msg, ok := l.chunks[id]
+	if !ok {
+		if len(l.chunks) >= maxPendingMessages {
+			l.evictOldest()
+		}
+		msg = &chunkedMessage{parts: make([][]byte, count), first: now}
+		l.chunks[id] = msg
+	}
+	if len(msg.parts) != count {
+		l.errors.Warn("chunk", "dropping GELF chunk with an inconsistent count", "count", count)
+		return
+	}
+	if msg.parts[seq] != nil {
+		return // duplicate
+	}
+	msg.parts[seq] = append([]byte(nil), datagram[12:]...)
+	msg.received++
+	l.size += len(msg.parts[seq])
+	if msg.received < count {
+		for l.size > maxPendingSize {
+			l.evictOldest()
+		}
+		return
+	}
+
+	l.drop(id, msg)
+	l.deliver(bytes.Join(msg.parts, nil))
+}
+
+// expire drops the messages whose chunks did not all arrive in time.
+func (l *Listener) expire(now time.Time) {
+	for id, msg := range l.chunks {
+		if now.Sub(msg.first) > chunkTimeout {
+			l.drop(id, msg)
+			l.errors.Warn("incomplete", "dropping incomplete GELF message", "chunks", len(msg.parts), "received", msg.received)
+		}
+	}
+}
+
+// evictOldest drops the incomplete message received first, to make room
+// for another one.
+func (l *Listener) evictOldest() {
+	var oldest [8]byte
+	var msg *chunkedMessage
+	for id, m := range l.chunks {
+		if msg == nil || m.first.Before(msg.first) {
+			oldest, msg = id, m
+		}
+	}
+	if msg == nil {
+		return
+	}
+	l.drop(oldest, msg)
+	l.errors.Warn("pending", "too many incomplete GELF messages, dropping the oldest", "chunks", len(msg.parts), "received", msg.received)
+}
+
+// drop forgets the chunks of a message.
+func (l *Listener) drop(id [8]byte, msg *chunkedMessage) {
+	delete(l.chunks, id)
+	for _, part := range msg.parts {
+		l.size -= len(part)
+	}
+}
+
+// deliver decompresses a message and hands it to the handler.
+func (l *Listener) deliver(payload []byte) {
+	data, err := decompress(payload)
+	if err != nil {
+		l.errors.Warn("decompress", "dropping GELF message", "error", err)
+		return
+	}
+	data = bytes.TrimSpace(bytes.TrimRight(data, "\x00"))
+	if len(data) > 0 && l.handler != nil {
+		l.handler(string(data))
+	}
+}
+
+// decompress returns a message payload decompressed if it is gzip or zlib
+// compressed, or as is.
+func decompress(payload []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch {
+	case len(payload) >= 2 && payload[0] == 0x1f && payload[1] == 0x8b:
+		r, err = gzip.NewReader(bytes.NewReader(payload))
+	case len(payload) >= 2 && payload[0]&0x0f == 8 && (int(payload[0])<<8|int(payload[1]))%31 == 0:
+		r, err = zlib.NewReader(bytes.NewReader(payload))
+	default:
+		if len(payload) > maxMessageSize {
+			return nil, fmt.Errorf("message larger than %d bytes", maxMessageSize)
+		}
+		return payload, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decompressing: %w", err)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(io.LimitReader(r, maxMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing: %w", err)
+	}
+	if len(data) > maxMessageSize {
+		return nil, fmt.Errorf("message larger than %d bytes", maxMessageSize)
+	}
+	return data, nil
+}
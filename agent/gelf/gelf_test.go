@@ -0,0 +1,177 @@
+// SPDX-License-Identifier: MIT
+
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type collector struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (c *collector) handle(line string) {
+	c.mu.Lock()
+	c.lines = append(c.lines, line)
+	c.mu.Unlock()
+}
+
+func (c *collector) get() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.lines...)
+}
+
+func compress(t *testing.T, zl bool, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if zl {
+		w := zlib.NewWriter(&buf)
+		w.Write([]byte(data))
+		w.Close()
+	} else {
+		w := gzip.NewWriter(&buf)
+		w.Write([]byte(data))
+		w.Close()
+	}
+	return buf.Bytes()
+}
+
+// chunk splits payload into n GELF chunks of a message.
+func chunk(id byte, payload []byte, n int) [][]byte {
+	size := (len(payload) + n - 1) / n
+	var chunks [][]byte
+	for i := 0; i < n; i++ {
+		part := payload[min(i*size, len(payload)):min((i+1)*size, len(payload))]
+		header := []byte{0x1e, 0x0f, id, 0, 0, 0, 0, 0, 0, 0, byte(i), byte(n)}
+		chunks = append(chunks, append(header, part...))
+	}
+	return chunks
+}
+
+func TestListener_Receive(t *testing.T) {
+	var c collector
+	l := New("127.0.0.1:0", c.handle, nil)
+	now := time.Now()
+
+	msg := `{"version":"1.1","host":"web-1","short_message":"GET /","_status":200}`
+	l.receive([]byte(msg), now)
+	l.receive(compress(t, false, msg), now)
+	l.receive(compress(t, true, msg), now)
+
+	// Chunks arrive out of order, with a duplicate
+	chunks := chunk(1, compress(t, false, msg), 3)
+	l.receive(chunks[2], now)
+	l.receive(chunks[0], now)
+	l.receive(chunks[0], now)
+	if got := len(c.get()); got != 3 {
+		t.Fatalf("delivered %d messages before the last chunk, want 3", got)
+	}
+	l.receive(chunks[1], now)
+
+	// A message missing a chunk is dropped once chunkTimeout passed
+	l.receive(chunk(2, []byte(msg), 2)[0], now)
+	l.expire(now.Add(chunkTimeout + time.Second))
+	if len(l.chunks) != 0 {
+		t.Errorf("%d incomplete messages kept after their timeout", len(l.chunks))
+	}
+
+	// Invalid chunks and compressed garbage are dropped
+	l.receive([]byte{0x1e, 0x0f, 3}, now)
+	l.receive([]byte{0x1e, 0x0f, 3, 0, 0, 0, 0, 0, 0, 0, 5, 2}, now)
+	l.receive([]byte{0x1f, 0x8b, 0, 0}, now)
+
+	got := c.get()
+	if len(got) != 4 {
+		t.Fatalf("delivered %d messages, want 4: %q", len(got), got)
+	}
+	for i, line := range got {
+		if line != msg {
+			t.Errorf("message %d = %q, want %q", i, line, msg)
+		}
+	}
+}
+
+func TestListener_PendingLimits(t *testing.T) {
+	var c collector
+	l := New("127.0.0.1:0", c.handle, nil)
+	now := time.Now()
+
+	// The oldest incomplete message makes room for a new one
+	header := func(id int) []byte {
+		return []byte{0x1e, 0x0f, byte(id), byte(id >> 8), 0, 0, 0, 0, 0, 0, 0, 2}
+	}
+	for i := 0; i <= maxPendingMessages; i++ {
+		l.receive(append(header(i), 'x'), now.Add(time.Duration(i)*time.Microsecond))
+	}
+	if len(l.chunks) != maxPendingMessages {
+		t.Fatalf("%d incomplete messages kept, want %d", len(l.chunks), maxPendingMessages)
+	}
+	if _, ok := l.chunks[[8]byte{0, 0}]; ok {
+		t.Error("the oldest incomplete message was kept")
+	}
+	if l.size != maxPendingMessages {
+		t.Errorf("size = %d, want %d", l.size, maxPendingMessages)
+	}
+
+	// Large chunks are bounded by their size
+	l = New("127.0.0.1:0", c.handle, nil)
+	part := make([]byte, maxDatagramSize-12)
+	for i := 0; i < 2*maxPendingSize/len(part); i++ {
+		l.receive(append(header(i), part...), now.Add(time.Duration(i)*time.Microsecond))
+	}
+	if l.size > maxPendingSize {
+		t.Errorf("size = %d, above %d", l.size, maxPendingSize)
+	}
+	if len(c.get()) != 0 {
+		t.Error("incomplete messages were delivered")
+	}
+}
+
+func TestListener_UDP(t *testing.T) {
+	var c collector
+	l := New("127.0.0.1:0", c.handle, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := l.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer l.Stop()
+
+	conn, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := `{"version":"1.1","host":"web-1","short_message":"hello"}`
+	for _, datagram := range chunk(7, compress(t, false, msg), 2) {
+		if _, err := conn.Write(datagram); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.get()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the message")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := c.get()[0]; got != msg {
+		t.Errorf("message = %q, want %q", got, msg)
+	}
+
+	l.Stop()
+	if l.Addr() != nil {
+		t.Error("Addr() is set after Stop")
+	}
+}
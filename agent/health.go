@@ -0,0 +1,221 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// staleIntervals is how many snapshot intervals may pass without a snapshot,
+// or without a delivery to an output, before the agent reports a problem.
+const staleIntervals = 3
+
+// Health is the agent's state as reported by /healthz and /readyz.
+type Health struct {
+	Status   string   `json:"status"` // "ok" or "unavailable"
+	Problems []string `json:"problems,omitempty"`
+
+	// LastSnapshot is when metrics were last snapshotted.
+	LastSnapshot *time.Time `json:"last_snapshot,omitempty"`
+
+	// LastDelivery is the least recent of the last deliveries of the
+	// outputs; nil when not sending anywhere or before every output
+	// accepted a snapshot.
+	LastDelivery *time.Time `json:"last_delivery,omitempty"`
+
+	// Outputs describes the deliveries to every output.
+	Outputs []OutputHealth `json:"outputs,omitempty"`
+
+	// Queued is the number of snapshot requests waiting for delivery.
+	Queued int `json:"queued"`
+
+	// Version is the agent's version; VersionDeprecated is set once the
+	// server reported it is no longer supported. It is not a problem: the
+	// agent keeps working until upgraded.
+	Version           string `json:"version"`
+	VersionDeprecated bool   `json:"version_deprecated,omitempty"`
+
+	// RemoteConfig is the state of the configuration served by the
+	// server, nil until it answered.
+	RemoteConfig *RemoteConfigStatus `json:"remote_config,omitempty"`
+
+	Sources []SourceHealth `json:"sources"`
+}
+
+// SourceHealth describes the inputs and parse errors of a source.
+type SourceHealth struct {
+	Path        string `json:"path"`
+	OpenFiles   int    `json:"open_files"`   // files, journals, GELF listeners or stdin being read
+	ParkedFiles int    `json:"parked_files"` // files closed to stay within max_open_files
+
+	LinesParsed int64 `json:"lines_parsed"`
+	ParseErrors int64 `json:"parse_errors"`
+
+	// ParseErrorRatio is the share of lines that failed to parse since
+	// the agent was created.
+	ParseErrorRatio float64 `json:"parse_error_ratio"`
+}
+
+// OutputHealth describes the deliveries to an output.
+type OutputHealth struct {
+	Name         string     `json:"name"`
+	LastDelivery *time.Time `json:"last_delivery,omitempty"`
+	Failures     int64      `json:"failures"` // snapshots it failed to receive
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+// Live reports whether the agent is running and still taking snapshots.
+// A wedged agent stops snapshotting and is reported as not live.
+func (a *Agent) Live() Health {
+	h := a.health()
+	a.checkLive(&h)
+	h.setStatus()
+	return h
+}
+
+// Ready reports whether the agent is live, reads at least one input and
+// has recently delivered a snapshot to every output it sends to.
+func (a *Agent) Ready() Health {
+	h := a.health()
+	if a.checkLive(&h) {
+		a.checkReady(&h)
+	}
+	h.setStatus()
+	return h
+}
+
+// health collects the state shared by Live and Ready. It does not take
+// a.mu, which Start and Stop hold while the listener may be serving.
+func (a *Agent) health() Health {
+	vs := a.VersionStatus()
+	h := Health{Version: vs.Version, VersionDeprecated: vs.Deprecated, RemoteConfig: a.remoteConfig.Load()}
+	if ns := a.lastSnapshot.Load(); ns != 0 {
+		t := time.Unix(0, ns)
+		h.LastSnapshot = &t
+	}
+
+	if snd := a.sender; snd != nil {
+		h.Queued = snd.QueueStats().Entries
+	}
+	for i, d := range a.exports {
+		oh := OutputHealth{Name: d.Name(), Failures: d.failures.Load()}
+		if t := d.LastDelivery(); !t.IsZero() {
+			oh.LastDelivery = &t
+		}
+		if msg := d.lastError.Load(); msg != nil {
+			oh.LastError = *msg
+		}
+		if i == 0 || h.LastDelivery != nil && (oh.LastDelivery == nil || oh.LastDelivery.Before(*h.LastDelivery)) {
+			h.LastDelivery = oh.LastDelivery
+		}
+		h.Outputs = append(h.Outputs, oh)
+	}
+
+	open := make(map[string]int)
+	parked := make(map[string]int)
+	a.tailersMu.Lock()
+	for key := range a.tailers {
+		open[key.source]++
+	}
+	for key := range a.parked {
+		parked[key.source]++
+	}
+	for key := range a.journals {
+		open[key]++
+	}
+	for key := range a.gelfs {
+		open[key]++
+	}
+	stdin := a.stdinStarted
+	a.tailersMu.Unlock()
+
+	for _, proc := range a.currentProcessors() {
+		sh := SourceHealth{
+			Path:        proc.source.Location(),
+			OpenFiles:   open[proc.key],
+			ParkedFiles: parked[proc.key],
+			LinesParsed: proc.linesParsed.Load(),
+			ParseErrors: proc.parseErrors.Load(),
+		}
+		if stdin && proc.source.IsStdin() {
+			sh.OpenFiles++
+		}
+		if total := sh.LinesParsed + sh.ParseErrors; total > 0 {
+			sh.ParseErrorRatio = float64(sh.ParseErrors) / float64(total)
+		}
+		h.Sources = append(h.Sources, sh)
+	}
+	return h
+}
+
+// checkLive adds the liveness problems to h and reports whether there
+// were none.
+func (a *Agent) checkLive(h *Health) bool {
+	if !a.live.Load() {
+		h.Problems = append(h.Problems, "agent is not running")
+		return false
+	}
+
+	if stale := a.staleFor(h.LastSnapshot); stale > 0 {
+		h.Problems = append(h.Problems, fmt.Sprintf("no snapshot taken for %s", stale.Round(time.Second)))
+		return false
+	}
+	return true
+}
+
+// checkReady adds the readiness problems to h.
+func (a *Agent) checkReady(h *Health) {
+	inputs := 0
+	for _, src := range h.Sources {
+		inputs += src.OpenFiles + src.ParkedFiles
+	}
+	if inputs == 0 {
+		h.Problems = append(h.Problems, "no log input is open")
+	}
+
+	for _, out := range h.Outputs {
+		if stale := a.staleFor(out.LastDelivery); stale > 0 {
+			h.Problems = append(h.Problems, fmt.Sprintf("no snapshot delivered to %s for %s", out.Name, stale.Round(time.Second)))
+		}
+	}
+}
+
+// staleFor returns how long it has been since last, or since the agent
+// started when last is nil, if that exceeds staleIntervals intervals.
+// Otherwise it returns 0.
+func (a *Agent) staleFor(last *time.Time) time.Duration {
+	since := time.Unix(0, a.liveSince.Load())
+	if last != nil && last.After(since) {
+		since = *last
+	}
+	if elapsed := time.Since(since); elapsed > staleIntervals*a.Config().Interval {
+		return elapsed
+	}
+	return 0
+}
+
+// setStatus sets the status from the problems found.
+func (h *Health) setStatus() {
+	h.Status = "ok"
+	if len(h.Problems) > 0 {
+		h.Status = "unavailable"
+	}
+}
+
+// serveHealth returns a handler writing the result of check as JSON, with
+// status 503 when there are problems.
+func (a *Agent) serveHealth(check func() Health) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		h := check()
+		w.Header().Set("Content-Type", "application/json")
+		if len(h.Problems) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(h); err != nil {
+			a.logger.Debug("writing health failed", "error", err)
+		}
+	}
+}
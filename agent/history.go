@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+// HistoryEntry is a snapshot kept in the in-memory history.
+type HistoryEntry struct {
+	Time    time.Time              `json:"time"`
+	Metrics map[string]interface{} `json:"metrics"`
+}
+
+// history is a bounded ring of the most recent snapshots.
+type history struct {
+	mu      sync.Mutex
+	entries []HistoryEntry // oldest first
+	size    int
+}
+
+// add records a snapshot, evicting the oldest one when full.
+// The metrics map is kept as is and must not be modified afterwards.
+func (h *history) add(t time.Time, metrics map[string]interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.size <= 0 {
+		return
+	}
+	if len(h.entries) >= h.size {
+		copy(h.entries, h.entries[len(h.entries)-h.size+1:])
+		h.entries = h.entries[:h.size-1]
+	}
+	h.entries = append(h.entries, HistoryEntry{Time: t, Metrics: metrics})
+}
+
+// resize changes the number of snapshots kept, dropping the oldest ones.
+// A size of zero or less disables the history.
+func (h *history) resize(size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.size = size
+	if size <= 0 {
+		h.entries = nil
+		return
+	}
+	if len(h.entries) > size {
+		h.entries = append([]HistoryEntry(nil), h.entries[len(h.entries)-size:]...)
+	}
+}
+
+// list returns the recorded snapshots, oldest first.
+func (h *history) list() []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]HistoryEntry(nil), h.entries...)
+}
+
+// History returns the most recent snapshots, oldest first.
+// The number kept is set by the history option.
+func (a *Agent) History() []HistoryEntry {
+	return a.history.list()
+}
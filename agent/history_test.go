@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory_Ring(t *testing.T) {
+	var h history
+	h.resize(3)
+
+	base := time.Unix(0, 0)
+	for i := 0; i < 5; i++ {
+		h.add(base.Add(time.Duration(i)*time.Second), map[string]interface{}{"n": float64(i)})
+	}
+
+	entries := h.list()
+	if len(entries) != 3 {
+		t.Fatalf("len = %d, want 3", len(entries))
+	}
+	for i, e := range entries {
+		if want := float64(i + 2); e.Metrics["n"] != want {
+			t.Errorf("entries[%d] = %v, want %v", i, e.Metrics["n"], want)
+		}
+	}
+
+	h.resize(2)
+	if entries := h.list(); len(entries) != 2 || entries[0].Metrics["n"] != float64(3) {
+		t.Errorf("after shrink = %v, want the 2 newest", entries)
+	}
+
+	h.resize(-1)
+	h.add(base, map[string]interface{}{})
+	if entries := h.list(); len(entries) != 0 {
+		t.Errorf("disabled history kept %d entries", len(entries))
+	}
+}
+
+func TestAgent_HistoryEndpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(path, []byte{}, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cfg := reloadTestConfig(path)
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.History = 2
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer ag.Stop(0)
+
+	for i := 1; i <= 3; i++ {
+		for j := 0; j < i; j++ {
+			ag.ProcessLine(0, `{}`)
+		}
+		if err := ag.sendSnapshot(context.Background()); err != nil {
+			t.Fatalf("sendSnapshot() error = %v", err)
+		}
+	}
+
+	resp, err := http.Get("http://" + ag.ListenAddr().String() + "/history")
+	if err != nil {
+		t.Fatalf("GET /history error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	var entries []HistoryEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatalf("decoding history: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("len = %d, want 2", len(entries))
+	}
+	if entries[0].Metrics["requests"] != float64(2) || entries[1].Metrics["requests"] != float64(3) {
+		t.Errorf("history = %v, want requests 2 then 3", entries)
+	}
+}
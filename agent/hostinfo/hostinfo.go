@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: MIT
+
+// Package hostinfo describes the host the agent runs on, so that the
+// server can group and filter agents by machine.
+package hostinfo
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Host holds the facts detected about a host. Facts that could not be
+// detected are empty.
+type Host struct {
+	Hostname        string `json:"hostname,omitempty"`
+	Kernel          string `json:"kernel,omitempty"` // kernel release, e.g. 6.1.0-18-amd64
+	CPUs            int    `json:"cpus"`
+	CloudProvider   string `json:"cloud_provider,omitempty"`    // aws, gcp, azure, digitalocean, hetzner
+	CloudInstanceID string `json:"cloud_instance_id,omitempty"` // when exposed to the host
+}
+
+// dmiDir holds the DMI identification of a Linux host (allows testing).
+var dmiDir = "/sys/class/dmi/id"
+
+// Detect returns the facts of the current host. It reads local files only
+// and never queries a cloud metadata service.
+func Detect() *Host {
+	h := &Host{CPUs: runtime.NumCPU(), Kernel: kernelRelease()}
+	h.Hostname, _ = os.Hostname()
+	h.CloudProvider, h.CloudInstanceID = detectCloud(dmiDir)
+	return h
+}
+
+// detectCloud identifies the cloud provider of a virtual machine from its
+// DMI identification in dir. Only AWS exposes the instance ID there, as
+// the asset tag of Nitro instances.
+func detectCloud(dir string) (provider, instanceID string) {
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(data))
+	}
+
+	vendor, product := read("sys_vendor"), read("product_name")
+	switch {
+	case vendor == "Amazon EC2" || strings.Contains(read("product_version"), "amazon") || read("bios_vendor") == "Amazon EC2":
+		if tag := read("board_asset_tag"); strings.HasPrefix(tag, "i-") {
+			instanceID = tag
+		}
+		return "aws", instanceID
+	case vendor == "Google" || product == "Google Compute Engine":
+		return "gcp", ""
+	case vendor == "Microsoft Corporation" && product == "Virtual Machine" &&
+		read("chassis_asset_tag") == "7783-7084-3265-9085-8269-3286-77":
+		return "azure", ""
+	case vendor == "DigitalOcean":
+		return "digitalocean", ""
+	case vendor == "Hetzner":
+		return "hetzner", ""
+	}
+	return "", ""
+}
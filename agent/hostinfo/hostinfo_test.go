@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: MIT
+
+package hostinfo
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestDetectCloud(t *testing.T) {
+	tests := []struct {
+		name         string
+		files        map[string]string
+		wantProvider string
+		wantID       string
+	}{
+		{"aws nitro", map[string]string{"sys_vendor": "Amazon EC2\n", "board_asset_tag": "i-0123456789abcdef0\n"}, "aws", "i-0123456789abcdef0"},
+		{"aws xen", map[string]string{"sys_vendor": "Xen", "product_version": "4.11.amazon"}, "aws", ""},
+		{"gcp", map[string]string{"sys_vendor": "Google", "product_name": "Google Compute Engine"}, "gcp", ""},
+		{"azure", map[string]string{"sys_vendor": "Microsoft Corporation", "product_name": "Virtual Machine",
+			"chassis_asset_tag": "7783-7084-3265-9085-8269-3286-77"}, "azure", ""},
+		{"hyper-v", map[string]string{"sys_vendor": "Microsoft Corporation", "product_name": "Virtual Machine"}, "", ""},
+		{"bare metal", map[string]string{"sys_vendor": "Dell Inc."}, "", ""},
+		{"no dmi", nil, "", ""},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		for name, content := range tt.files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		provider, id := detectCloud(dir)
+		if provider != tt.wantProvider || id != tt.wantID {
+			t.Errorf("%s: detectCloud() = %q, %q, want %q, %q", tt.name, provider, id, tt.wantProvider, tt.wantID)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	dmiDir = t.TempDir()
+	h := Detect()
+	if h.CPUs != runtime.NumCPU() || h.CloudProvider != "" {
+		t.Errorf("Detect() = %+v", h)
+	}
+	if host, _ := os.Hostname(); h.Hostname != host {
+		t.Errorf("Hostname = %q, want %q", h.Hostname, host)
+	}
+	if runtime.GOOS == "linux" && h.Kernel == "" {
+		t.Error("Kernel is empty")
+	}
+}
@@ -0,0 +1,16 @@
+// SPDX-License-Identifier: MIT
+
+//go:build !windows
+
+package hostinfo
+
+import "golang.org/x/sys/unix"
+
+// kernelRelease returns the release of the running kernel, as uname -r.
+func kernelRelease() string {
+	var u unix.Utsname
+	if err := unix.Uname(&u); err != nil {
+		return ""
+	}
+	return unix.ByteSliceToString(u.Release[:])
+}
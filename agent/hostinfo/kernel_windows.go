@@ -0,0 +1,17 @@
+// SPDX-License-Identifier: MIT
+
+//go:build windows
+
+package hostinfo
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// kernelRelease returns the version of Windows, e.g. 10.0.20348.
+func kernelRelease() string {
+	v := windows.RtlGetVersion()
+	return fmt.Sprintf("%d.%d.%d", v.MajorVersion, v.MinorVersion, v.BuildNumber)
+}
@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/identity"
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+// identityOptions returns how the identity file of cfg is encrypted, with
+// the passphrase read now.
+func identityOptions(cfg *config.Config) (identity.Options, error) {
+	enc := cfg.IdentityEncryption
+	switch enc.Mode {
+	case config.IdentityEncryptionPassphrase:
+		secret, err := readPassphrase(enc)
+		if err != nil {
+			return identity.Options{}, err
+		}
+		return identity.Options{Protector: identity.Passphrase(secret)}, nil
+	case config.IdentityEncryptionDPAPI:
+		protector, err := identity.DPAPI()
+		if err != nil {
+			return identity.Options{}, err
+		}
+		return identity.Options{Protector: protector}, nil
+	}
+	return identity.Options{}, nil
+}
+
+// readPassphrase reads the passphrase from the environment or a file,
+// without its trailing newline.
+func readPassphrase(enc config.IdentityEncryptionConfig) ([]byte, error) {
+	if enc.PassphraseEnv != "" {
+		secret := os.Getenv(enc.PassphraseEnv)
+		if secret == "" {
+			return nil, fmt.Errorf("identity passphrase variable %s is not set", enc.PassphraseEnv)
+		}
+		return []byte(secret), nil
+	}
+	data, err := os.ReadFile(enc.PassphraseFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading identity passphrase: %w", err)
+	}
+	secret := bytes.TrimRight(data, "\r\n")
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("identity passphrase file %s is empty", enc.PassphraseFile)
+	}
+	return secret, nil
+}
+
+// loadIdentity loads the identity of cfg, or generates it, with the
+// options it is saved with.
+func loadIdentity(cfg *config.Config) (*sender.Identity, identity.Options, error) {
+	opts, err := identityOptions(cfg)
+	if err != nil {
+		return nil, identity.Options{}, err
+	}
+	ident, err := identity.LoadOrGenerateWithOptions(cfg.IdentityFile, opts)
+	if err != nil {
+		return nil, identity.Options{}, fmt.Errorf("loading identity: %w", err)
+	}
+	return ident, opts, nil
+}
+
+// loadedIdentity is an identity loaded by Agent.identity, with the
+// settings it was loaded with.
+type loadedIdentity struct {
+	file       string
+	encryption config.IdentityEncryptionConfig
+	ident      *sender.Identity
+	opts       identity.Options
+}
+
+// identity returns the identity of cfg, loaded or generated once and then
+// shared by the sender and the outputs: decrypting it with a passphrase
+// runs Argon2, too slow to repeat whenever an output is rebuilt.
+func (a *Agent) identity(cfg *config.Config) (*sender.Identity, identity.Options, error) {
+	a.identMu.Lock()
+	defer a.identMu.Unlock()
+
+	if l := a.ident; l != nil && l.file == cfg.IdentityFile && l.encryption == cfg.IdentityEncryption {
+		return l.ident, l.opts, nil
+	}
+	ident, opts, err := loadIdentity(cfg)
+	if err != nil {
+		return nil, identity.Options{}, err
+	}
+	a.ident = &loadedIdentity{file: cfg.IdentityFile, encryption: cfg.IdentityEncryption, ident: ident, opts: opts}
+	return ident, opts, nil
+}
+
+// forgetIdentity makes the next call to identity load the identity file
+// again, once it changed.
+func (a *Agent) forgetIdentity() {
+	a.identMu.Lock()
+	a.ident = nil
+	a.identMu.Unlock()
+}
@@ -0,0 +1,13 @@
+// SPDX-License-Identifier: MIT
+
+//go:build !windows
+
+package identity
+
+import "fmt"
+
+// DPAPI returns a protector encrypting keys with the Windows Data
+// Protection API. It is only available on Windows.
+func DPAPI() (Protector, error) {
+	return nil, fmt.Errorf("%s encryption is only available on Windows", SchemeDPAPI)
+}
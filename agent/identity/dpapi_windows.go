@@ -0,0 +1,59 @@
+// SPDX-License-Identifier: MIT
+
+//go:build windows
+
+package identity
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// dpapi encrypts keys with the Windows Data Protection API, for the user
+// the agent runs as, with the instance ID as additional entropy.
+type dpapi struct{}
+
+// DPAPI returns a protector encrypting keys with the Windows Data
+// Protection API: only the same user on the same machine can decrypt
+// them.
+func DPAPI() (Protector, error) {
+	return dpapi{}, nil
+}
+
+func (dpapi) Scheme() string {
+	return SchemeDPAPI
+}
+
+func (dpapi) Seal(key []byte, instanceID string) ([]byte, error) {
+	var out windows.DataBlob
+	err := windows.CryptProtectData(dataBlob(key), nil, dataBlob([]byte(instanceID)), 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return nil, fmt.Errorf("CryptProtectData: %w", err)
+	}
+	return takeBlob(out), nil
+}
+
+func (dpapi) Open(sealed []byte, instanceID string) ([]byte, error) {
+	var out windows.DataBlob
+	err := windows.CryptUnprotectData(dataBlob(sealed), nil, dataBlob([]byte(instanceID)), 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecrypt, err)
+	}
+	return takeBlob(out), nil
+}
+
+// dataBlob points a DataBlob at b.
+func dataBlob(b []byte) *windows.DataBlob {
+	if len(b) == 0 {
+		return &windows.DataBlob{}
+	}
+	return &windows.DataBlob{Size: uint32(len(b)), Data: &b[0]}
+}
+
+// takeBlob copies a blob allocated by the system and frees it.
+func takeBlob(b windows.DataBlob) []byte {
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(b.Data)))
+	return append([]byte(nil), unsafe.Slice(b.Data, b.Size)...)
+}
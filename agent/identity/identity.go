@@ -12,27 +12,58 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/kolapsis/shm-agent/agent/atomicfile"
 	"github.com/kolapsis/shm-agent/agent/sender"
 )
 
 // storedIdentity is the JSON structure for identity persistence.
 type storedIdentity struct {
 	InstanceID string `json:"instance_id"`
-	PrivateKey string `json:"private_key"`
+	PrivateKey string `json:"private_key,omitempty"`
 	PublicKey  string `json:"public_key"`
+
+	// EncryptedKey replaces PrivateKey when the key is encrypted.
+	EncryptedKey *encryptedKey `json:"encrypted_private_key,omitempty"`
+
+	Registration *sender.Registration `json:"registration,omitempty"`
+}
+
+// encryptedKey is a private key sealed by a Protector.
+type encryptedKey struct {
+	Scheme string `json:"scheme"`
+	Data   string `json:"data"` // hex encoded
+}
+
+// Options controls how identities are stored.
+type Options struct {
+	// Protector encrypts the private key in the file. Without it, the key
+	// is stored in plaintext.
+	Protector Protector
 }
 
 // LoadOrGenerate loads an existing identity or generates a new one.
 func LoadOrGenerate(path string) (*sender.Identity, error) {
+	return LoadOrGenerateWithOptions(path, Options{})
+}
+
+// LoadOrGenerateWithOptions is like LoadOrGenerate, with the private key
+// encrypted as set by opts. A plaintext identity file is encrypted in
+// place once loaded.
+func LoadOrGenerateWithOptions(path string, opts Options) (*sender.Identity, error) {
 	// Try to load existing identity
-	identity, err := Load(path)
+	identity, encrypted, err := load(path, opts)
 	if err == nil {
+		if opts.Protector != nil && !encrypted {
+			if err := SaveWithOptions(path, identity, opts); err != nil {
+				return nil, fmt.Errorf("encrypting identity: %w", err)
+			}
+		}
 		return identity, nil
 	}
 
 	// If file doesn't exist, generate new identity
 	if os.IsNotExist(err) {
-		return Generate(path)
+		return generate(path, opts)
 	}
 
 	return nil, fmt.Errorf("loading identity: %w", err)
@@ -40,51 +71,111 @@ func LoadOrGenerate(path string) (*sender.Identity, error) {
 
 // Load loads an identity from a file.
 func Load(path string) (*sender.Identity, error) {
+	return LoadWithOptions(path, Options{})
+}
+
+// LoadWithOptions is like Load, decrypting the private key with the
+// protector of opts. Plaintext identity files load with any options.
+func LoadWithOptions(path string, opts Options) (*sender.Identity, error) {
+	identity, _, err := load(path, opts)
+	return identity, err
+}
+
+// load loads an identity and reports whether its key was encrypted.
+func load(path string, opts Options) (*sender.Identity, bool, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	var stored storedIdentity
 	if err := json.Unmarshal(data, &stored); err != nil {
-		return nil, fmt.Errorf("parsing identity file: %w", err)
+		return nil, false, fmt.Errorf("parsing identity file: %w", err)
 	}
 
-	privateKey, err := hex.DecodeString(stored.PrivateKey)
+	privateKey, err := decodePrivateKey(stored, opts)
 	if err != nil {
-		return nil, fmt.Errorf("decoding private key: %w", err)
+		return nil, false, err
 	}
 
 	publicKey, err := hex.DecodeString(stored.PublicKey)
 	if err != nil {
-		return nil, fmt.Errorf("decoding public key: %w", err)
+		return nil, false, fmt.Errorf("decoding public key: %w", err)
 	}
 
 	if len(privateKey) != ed25519.PrivateKeySize {
-		return nil, fmt.Errorf("invalid private key size: got %d, want %d", len(privateKey), ed25519.PrivateKeySize)
+		return nil, false, fmt.Errorf("invalid private key size: got %d, want %d", len(privateKey), ed25519.PrivateKeySize)
 	}
 
 	if len(publicKey) != ed25519.PublicKeySize {
-		return nil, fmt.Errorf("invalid public key size: got %d, want %d", len(publicKey), ed25519.PublicKeySize)
+		return nil, false, fmt.Errorf("invalid public key size: got %d, want %d", len(publicKey), ed25519.PublicKeySize)
 	}
 
 	return &sender.Identity{
 		InstanceID: stored.InstanceID,
 		PrivateKey: privateKey,
 		PublicKey:  publicKey,
-		PrivKeyHex: stored.PrivateKey,
+		PrivKeyHex: hex.EncodeToString(privateKey),
 		PubKeyHex:  stored.PublicKey,
-	}, nil
+
+		Registration: stored.Registration,
+	}, stored.EncryptedKey != nil, nil
+}
+
+// decodePrivateKey returns the private key of a stored identity,
+// decrypting it if needed.
+func decodePrivateKey(stored storedIdentity, opts Options) ([]byte, error) {
+	enc := stored.EncryptedKey
+	if enc == nil {
+		privateKey, err := hex.DecodeString(stored.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("decoding private key: %w", err)
+		}
+		return privateKey, nil
+	}
+
+	if opts.Protector == nil {
+		return nil, fmt.Errorf("private key is encrypted with %s, but no decryption is configured", enc.Scheme)
+	}
+	if enc.Scheme != opts.Protector.Scheme() {
+		return nil, fmt.Errorf("private key is encrypted with %s, not %s", enc.Scheme, opts.Protector.Scheme())
+	}
+	sealed, err := hex.DecodeString(enc.Data)
+	if err != nil {
+		return nil, fmt.Errorf("decoding encrypted private key: %w", err)
+	}
+	return opts.Protector.Open(sealed, stored.InstanceID)
 }
 
 // Generate creates a new identity and saves it to a file.
 func Generate(path string) (*sender.Identity, error) {
+	return generate(path, Options{})
+}
+
+// generate creates a new identity and saves it with opts.
+func generate(path string, opts Options) (*sender.Identity, error) {
 	// Ensure directory exists
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, fmt.Errorf("creating identity directory: %w", err)
 	}
 
+	identity, err := New()
+	if err != nil {
+		return nil, err
+	}
+
+	// Save to file
+	if err := SaveWithOptions(path, identity, opts); err != nil {
+		return nil, err
+	}
+
+	return identity, nil
+}
+
+// New creates a new identity without saving it, e.g. for a one-off
+// connection test.
+func New() (*sender.Identity, error) {
 	// Generate Ed25519 keypair
 	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
@@ -97,28 +188,47 @@ func Generate(path string) (*sender.Identity, error) {
 		return nil, fmt.Errorf("generating instance ID: %w", err)
 	}
 
-	identity := &sender.Identity{
+	return &sender.Identity{
 		InstanceID: instanceID,
 		PrivateKey: privateKey,
 		PublicKey:  publicKey,
 		PrivKeyHex: hex.EncodeToString(privateKey),
 		PubKeyHex:  hex.EncodeToString(publicKey),
-	}
+	}, nil
+}
 
-	// Save to file
-	if err := Save(path, identity); err != nil {
-		return nil, err
+// NewKey generates an Ed25519 private key, e.g. to rotate the key of an
+// identity with sender.Sender.RotateKey.
+func NewKey() (ed25519.PrivateKey, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating keypair: %w", err)
 	}
-
-	return identity, nil
+	return privateKey, nil
 }
 
-// Save saves an identity to a file.
+// Save saves an identity, including its registration state, to a file.
+// The file is replaced atomically.
 func Save(path string, identity *sender.Identity) error {
+	return SaveWithOptions(path, identity, Options{})
+}
+
+// SaveWithOptions is like Save, with the private key encrypted by the
+// protector of opts.
+func SaveWithOptions(path string, identity *sender.Identity, opts Options) error {
 	stored := storedIdentity{
-		InstanceID: identity.InstanceID,
-		PrivateKey: identity.PrivKeyHex,
-		PublicKey:  identity.PubKeyHex,
+		InstanceID:   identity.InstanceID,
+		PrivateKey:   identity.PrivKeyHex,
+		PublicKey:    identity.PubKeyHex,
+		Registration: identity.Registration,
+	}
+	if opts.Protector != nil {
+		sealed, err := opts.Protector.Seal(identity.PrivateKey, identity.InstanceID)
+		if err != nil {
+			return fmt.Errorf("encrypting private key: %w", err)
+		}
+		stored.PrivateKey = ""
+		stored.EncryptedKey = &encryptedKey{Scheme: opts.Protector.Scheme(), Data: hex.EncodeToString(sealed)}
 	}
 
 	data, err := json.MarshalIndent(stored, "", "  ")
@@ -127,7 +237,7 @@ func Save(path string, identity *sender.Identity) error {
 	}
 
 	// Write with restricted permissions (owner read/write only)
-	if err := os.WriteFile(path, data, 0600); err != nil {
+	if err := atomicfile.Write(path, data, 0600); err != nil {
 		return fmt.Errorf("writing identity file: %w", err)
 	}
 
@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: MIT
+
+package identity
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+func TestSaveLoad_Registration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.json")
+
+	ident, err := LoadOrGenerate(path)
+	if err != nil {
+		t.Fatalf("LoadOrGenerate() error = %v", err)
+	}
+	if ident.Registration != nil {
+		t.Fatal("new identity should not be registered")
+	}
+
+	ident.Registration = &sender.Registration{
+		ServerURL:    "https://shm.example.com",
+		Fingerprint:  "abc",
+		RegisteredAt: time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC),
+	}
+	if err := Save(path, ident); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if loaded.InstanceID != ident.InstanceID || !loaded.PrivateKey.Equal(ident.PrivateKey) {
+		t.Error("loaded identity differs from saved one")
+	}
+	if loaded.Registration == nil || *loaded.Registration != *ident.Registration {
+		t.Errorf("Registration = %+v, want %+v", loaded.Registration, ident.Registration)
+	}
+}
+
+func TestSaveLoad_Passphrase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.json")
+	plain, err := Generate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A plaintext identity is encrypted in place
+	opts := Options{Protector: Passphrase([]byte("correct horse"))}
+	ident, err := LoadOrGenerateWithOptions(path, opts)
+	if err != nil {
+		t.Fatalf("LoadOrGenerateWithOptions() error = %v", err)
+	}
+	if ident.InstanceID != plain.InstanceID || !ident.PrivateKey.Equal(plain.PrivateKey) {
+		t.Fatal("loaded identity differs from the plaintext one")
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), plain.PrivKeyHex) || !strings.Contains(string(data), `"scheme": "passphrase"`) {
+		t.Fatalf("identity file not encrypted:\n%s", data)
+	}
+
+	loaded, err := LoadWithOptions(path, opts)
+	if err != nil {
+		t.Fatalf("LoadWithOptions() error = %v", err)
+	}
+	if !loaded.PrivateKey.Equal(plain.PrivateKey) || loaded.PrivKeyHex != plain.PrivKeyHex {
+		t.Error("decrypted key differs from the saved one")
+	}
+
+	if _, err := LoadWithOptions(path, Options{Protector: Passphrase([]byte("wrong"))}); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("wrong passphrase: error = %v, want ErrDecrypt", err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("Load() without a passphrase: error = nil")
+	}
+
+	// The key is bound to its instance ID
+	sealed, _ := opts.Protector.Seal(plain.PrivateKey, plain.InstanceID)
+	if _, err := opts.Protector.Open(sealed, "other"); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Open() with another instance ID: error = %v, want ErrDecrypt", err)
+	}
+}
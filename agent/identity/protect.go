@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: MIT
+
+package identity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Schemes of the encrypted private keys, recorded in identity files.
+const (
+	SchemePassphrase = "passphrase" // Argon2id and AES-256-GCM
+	SchemeDPAPI      = "dpapi"      // Windows Data Protection API
+)
+
+// ErrDecrypt is returned when an encrypted private key cannot be
+// decrypted: a wrong passphrase, another machine or user for DPAPI, or a
+// corrupted file.
+var ErrDecrypt = errors.New("cannot decrypt private key")
+
+// Protector encrypts the private key of an identity at rest.
+type Protector interface {
+	// Scheme names the encryption, recorded in the identity file.
+	Scheme() string
+
+	// Seal encrypts a private key, bound to the instance ID, so that it
+	// cannot be moved to another identity.
+	Seal(key []byte, instanceID string) ([]byte, error)
+
+	// Open decrypts what Seal returned for the same instance ID.
+	Open(sealed []byte, instanceID string) ([]byte, error)
+}
+
+// Argon2id parameters deriving the key of a passphrase. Changing them
+// requires a new scheme, as they are not recorded in identity files.
+const (
+	argonTime    = 3
+	argonMemory  = 64 << 10 // KiB
+	argonThreads = 4
+	saltSize     = 16
+)
+
+// passphrase derives an AES-256-GCM key from a passphrase with Argon2id,
+// with a random salt per Seal. Sealed keys are salt | nonce | ciphertext.
+type passphrase struct {
+	secret []byte
+}
+
+// Passphrase returns a protector encrypting keys with a passphrase.
+func Passphrase(secret []byte) Protector {
+	return passphrase{secret: secret}
+}
+
+func (p passphrase) Scheme() string {
+	return SchemePassphrase
+}
+
+func (p passphrase) Seal(key []byte, instanceID string) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("generating salt: %w", err)
+	}
+	aead, err := p.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+
+	out := append(salt, nonce...)
+	return aead.Seal(out, nonce, key, []byte(instanceID)), nil
+}
+
+func (p passphrase) Open(sealed []byte, instanceID string) ([]byte, error) {
+	if len(sealed) < saltSize {
+		return nil, ErrDecrypt
+	}
+	aead, err := p.aead(sealed[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	rest := sealed[saltSize:]
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	key, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(instanceID))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return key, nil
+}
+
+// aead returns the cipher keyed by the passphrase and salt.
+func (p passphrase) aead(salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(argon2.IDKey(p.secret, salt, argonTime, argonMemory, argonThreads, 32))
+	if err != nil {
+		return nil, fmt.Errorf("creating cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
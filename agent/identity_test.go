@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestLoadIdentity_Passphrase(t *testing.T) {
+	dir := t.TempDir()
+	passFile := filepath.Join(dir, "passphrase")
+	if err := os.WriteFile(passFile, []byte("correct horse\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		IdentityFile: filepath.Join(dir, "identity.json"),
+		IdentityEncryption: config.IdentityEncryptionConfig{
+			Mode:           config.IdentityEncryptionPassphrase,
+			PassphraseFile: passFile,
+		},
+	}
+
+	generated, _, err := loadIdentity(cfg)
+	if err != nil {
+		t.Fatalf("loadIdentity() error = %v", err)
+	}
+	loaded, _, err := loadIdentity(cfg)
+	if err != nil {
+		t.Fatalf("loadIdentity() error = %v", err)
+	}
+	if loaded.InstanceID != generated.InstanceID || !loaded.PrivateKey.Equal(generated.PrivateKey) {
+		t.Error("reloaded identity differs from the generated one")
+	}
+
+	// The same passphrase from the environment, without the newline
+	t.Setenv("TEST_IDENTITY_PASSPHRASE", "correct horse")
+	cfg.IdentityEncryption.PassphraseFile = ""
+	cfg.IdentityEncryption.PassphraseEnv = "TEST_IDENTITY_PASSPHRASE"
+	if _, _, err := loadIdentity(cfg); err != nil {
+		t.Errorf("loadIdentity() from the environment error = %v", err)
+	}
+
+	cfg.IdentityEncryption.PassphraseEnv = "TEST_IDENTITY_PASSPHRASE_UNSET"
+	if _, _, err := loadIdentity(cfg); err == nil {
+		t.Error("loadIdentity() with an unset variable: error = nil")
+	}
+}
+
+func TestAgent_IdentityLoadedOnce(t *testing.T) {
+	dir := t.TempDir()
+	passFile := filepath.Join(dir, "passphrase")
+	if err := os.WriteFile(passFile, []byte("correct horse\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		IdentityFile: filepath.Join(dir, "identity.json"),
+		IdentityEncryption: config.IdentityEncryptionConfig{
+			Mode:           config.IdentityEncryptionPassphrase,
+			PassphraseFile: passFile,
+		},
+	}
+	a := &Agent{}
+
+	first, _, err := a.identity(cfg)
+	if err != nil {
+		t.Fatalf("identity() error = %v", err)
+	}
+
+	// Later outputs reuse it, even once the passphrase is gone
+	if err := os.Remove(passFile); err != nil {
+		t.Fatal(err)
+	}
+	again, _, err := a.identity(cfg)
+	if err != nil {
+		t.Fatalf("identity() error = %v", err)
+	}
+	if again != first {
+		t.Error("identity() loaded the identity again")
+	}
+
+	// until the identity settings change
+	other := *cfg
+	other.IdentityFile = filepath.Join(dir, "other.json")
+	if _, _, err := a.identity(&other); err == nil {
+		t.Error("identity() of another file without passphrase: error = nil")
+	}
+}
@@ -0,0 +1,258 @@
+// SPDX-License-Identifier: MIT
+
+// Package influx writes snapshots to InfluxDB v2, or any endpoint
+// accepting the InfluxDB line protocol.
+//
+// Every series of a metric is a point of the measurement named after the
+// metric, its labels as tags. Counters, sums, gauges and sets have a single
+// "value" field; percentiles have "count", "sum" and one field per
+// quantile. A counter_by metric has a point per value, tagged with the
+// field counted. Points are timestamped with the snapshot time, in nanoseconds.
+package influx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+// WritePath is the path of the InfluxDB v2 write API, added to URLs
+// without a path.
+const WritePath = "/api/v2/write"
+
+// maxErrorBody caps the response body quoted in errors.
+const maxErrorBody = 512
+
+// Config configures a Writer.
+type Config struct {
+	URL       string // e.g. http://influxdb:8086 or a full write URL
+	Org       string
+	Bucket    string
+	Token     string
+	TokenFile string            // read at every request, so that a rotated token applies
+	Tags      map[string]string // added to every point
+	Client    *http.Client      // defaults to http.DefaultClient
+}
+
+// Writer writes snapshots to an InfluxDB write endpoint.
+type Writer struct {
+	url       string
+	token     string
+	tokenFile string
+	tags      map[string]string
+	client    *http.Client
+
+	lastDelivery atomic.Int64 // unix nanoseconds of the last successful write
+}
+
+// New creates a Writer.
+func New(cfg Config) *Writer {
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Writer{
+		url:       WriteURL(cfg.URL, cfg.Org, cfg.Bucket),
+		token:     cfg.Token,
+		tokenFile: cfg.TokenFile,
+		tags:      cfg.Tags,
+		client:    client,
+	}
+}
+
+// WriteURL returns the write URL of an InfluxDB URL: WritePath is added
+// when it has no path, then the org, the bucket and a nanosecond precision
+// as query parameters.
+func WriteURL(base, org, bucket string) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		return base
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = WritePath
+	}
+	q := u.Query()
+	if org != "" {
+		q.Set("org", org)
+	}
+	if bucket != "" {
+		q.Set("bucket", bucket)
+	}
+	q.Set("precision", "ns")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Name returns "influxdb".
+func (w *Writer) Name() string {
+	return "influxdb"
+}
+
+// Send writes the metrics of a snapshot. It makes a single attempt: a
+// failed write is reported but not retried.
+func (w *Writer) Send(ctx context.Context, snap sender.Snapshot) error {
+	ts := snap.Timestamp
+	if ts.IsZero() {
+		ts = snap.End
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	body := Lines(snap.Metrics, w.tags, ts)
+	if len(body) == 0 {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating write request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	token := w.token
+	if w.tokenFile != "" {
+		data, err := os.ReadFile(w.tokenFile)
+		if err != nil {
+			return fmt.Errorf("reading token file: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending write request: %w", err)
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return &sender.StatusError{Op: "write", StatusCode: resp.StatusCode, Body: string(data)}
+	}
+	w.lastDelivery.Store(time.Now().UnixNano())
+	return nil
+}
+
+// LastDelivery returns when a snapshot was last written, or the zero time.
+func (w *Writer) LastDelivery() time.Time {
+	if ns := w.lastDelivery.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// Close closes the idle connections to the endpoint.
+func (w *Writer) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
+
+// Lines renders metrics in line protocol, one line per series in metric
+// name order, all at time ts. tags are added to the labels of every series.
+func Lines(metrics map[string]interface{}, tags map[string]string, ts time.Time) []byte {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	stamp := strconv.FormatInt(ts.UnixNano(), 10)
+	var buf bytes.Buffer
+	for _, name := range names {
+		for _, s := range aggregator.SeriesOf(metrics[name]) {
+			fields := fieldsOf(s.Value)
+			if len(fields) == 0 {
+				continue
+			}
+			buf.WriteString(measurementEscaper.Replace(name))
+			writeTags(&buf, tags, s.Labels)
+			buf.WriteByte(' ')
+			writeFields(&buf, fields)
+			buf.WriteByte(' ')
+			buf.WriteString(stamp)
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// writeTags writes the tags of a point in key order, labels overriding
+// tags of the same name. Empty values are left out: line protocol has no
+// empty tag value.
+func writeTags(buf *bytes.Buffer, tags, labels map[string]string) {
+	all := make(map[string]string, len(tags)+len(labels))
+	for k, v := range tags {
+		all[k] = v
+	}
+	for k, v := range labels {
+		all[k] = v
+	}
+	keys := make([]string, 0, len(all))
+	for k, v := range all {
+		if k != "" && v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		buf.WriteByte(',')
+		buf.WriteString(keyEscaper.Replace(k))
+		buf.WriteByte('=')
+		buf.WriteString(keyEscaper.Replace(all[k]))
+	}
+}
+
+// writeFields writes the fields of a point in key order.
+func writeFields(buf *bytes.Buffer, fields map[string]float64) {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(keyEscaper.Replace(k))
+		buf.WriteByte('=')
+		buf.WriteString(strconv.FormatFloat(fields[k], 'g', -1, 64))
+	}
+}
+
+// fieldsOf returns the fields of a series value, without the values line
+// protocol cannot carry (NaN and infinities).
+func fieldsOf(value interface{}) map[string]float64 {
+	fields := make(map[string]float64)
+	if d, ok := value.(aggregator.Distribution); ok {
+		for k, f := range d {
+			if !math.IsNaN(f) && !math.IsInf(f, 0) {
+				fields[k] = f
+			}
+		}
+	} else if f, ok := aggregator.Float(value); ok {
+		fields["value"] = f
+	}
+	return fields
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: MIT
+
+package influx
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+func TestWriteURL(t *testing.T) {
+	tests := []struct {
+		base, want string
+	}{
+		{"http://influxdb:8086", "http://influxdb:8086/api/v2/write?bucket=metrics&org=acme&precision=ns"},
+		{"https://influx.example.com/", "https://influx.example.com/api/v2/write?bucket=metrics&org=acme&precision=ns"},
+		{"http://vm:8428/write", "http://vm:8428/write?bucket=metrics&org=acme&precision=ns"},
+	}
+	for _, tt := range tests {
+		if got := WriteURL(tt.base, "acme", "metrics"); got != tt.want {
+			t.Errorf("WriteURL(%q) = %q, want %q", tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestLines(t *testing.T) {
+	metrics := map[string]interface{}{
+		"requests": []aggregator.Series{
+			{Labels: map[string]string{"method": "GET", "path": "/a b,c"}, Value: float64(3)},
+			{Labels: map[string]string{"method": "", "path": "/"}, Value: float64(1)},
+		},
+		"latency": aggregator.Distribution{"count": 4, "sum": 10, "p99": 4.5},
+		"users":   2,
+		"broken":  aggregator.Distribution{},
+		"by_code": aggregator.Counts{Key: "code", Values: map[string]float64{"500": 2}},
+	}
+
+	got := string(Lines(metrics, map[string]string{"host": "web-1"}, time.Unix(1, 5)))
+	want := "by_code,code=500,host=web-1 value=2 1000000005\n" +
+		"latency,host=web-1 count=4,p99=4.5,sum=10 1000000005\n" +
+		`requests,host=web-1,method=GET,path=/a\ b\,c value=3 1000000005` + "\n" +
+		"requests,host=web-1,path=/ value=1 1000000005\n" +
+		"users,host=web-1 value=2 1000000005\n"
+	if got != want {
+		t.Errorf("Lines() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriter_Send(t *testing.T) {
+	var body, auth, query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		body, auth, query = string(data), r.Header.Get("Authorization"), r.URL.RawQuery
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New(Config{URL: srv.URL, Org: "acme", Bucket: "metrics", TokenFile: tokenFile})
+	err := w.Send(context.Background(), sender.Snapshot{
+		Metrics: map[string]interface{}{"requests": float64(2)},
+		End:     time.Unix(60, 0),
+	})
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if body != "requests value=2 60000000000\n" {
+		t.Errorf("body = %q", body)
+	}
+	if auth != "Token secret" {
+		t.Errorf("Authorization = %q, want the token from the file", auth)
+	}
+	if query != "bucket=metrics&org=acme&precision=ns" {
+		t.Errorf("query = %q", query)
+	}
+	if w.LastDelivery().IsZero() {
+		t.Error("LastDelivery() is zero after a write")
+	}
+
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+	if err := w.Send(context.Background(), sender.Snapshot{Metrics: map[string]interface{}{"x": 1.0}}); err == nil {
+		t.Error("Send() error = nil on a rejected write")
+	}
+}
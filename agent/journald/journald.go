@@ -0,0 +1,244 @@
+// SPDX-License-Identifier: MIT
+
+// Package journald reads entries from the systemd journal.
+//
+// Entries are read by following `journalctl --output=json`, so the agent
+// does not need to link against libsystemd. Each entry is delivered to the
+// handler as one JSON line.
+package journald
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/logthrottle"
+	"github.com/kolapsis/shm-agent/agent/tailer"
+)
+
+// DefaultCommand is the journalctl binary looked up in PATH.
+const DefaultCommand = "journalctl"
+
+// maxEntrySize is the largest journal entry delivered to the handler.
+// Larger entries are skipped.
+const maxEntrySize = 1024 * 1024
+
+// restartDelay is the delay before journalctl is restarted after it exits.
+const restartDelay = 5 * time.Second
+
+// Reader follows the systemd journal.
+type Reader struct {
+	units   []string
+	handler tailer.LineHandler
+	logger  *slog.Logger
+	errors  *logthrottle.Logger // recurring errors
+
+	command      string
+	restartDelay time.Duration
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	cursor string // cursor of the last handled entry
+}
+
+// New creates a Reader for the entries of the given systemd units.
+// With no units, the whole journal is read.
+func New(units []string, handler tailer.LineHandler, logger *slog.Logger) *Reader {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	return &Reader{
+		units:        units,
+		handler:      handler,
+		logger:       logger,
+		errors:       logthrottle.New(logger, 0),
+		command:      DefaultCommand,
+		restartDelay: restartDelay,
+	}
+}
+
+// Start begins following the journal from its current end.
+// journalctl is restarted if it exits, resuming after the last entry read.
+func (r *Reader) Start(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done != nil {
+		return fmt.Errorf("journal reader already running")
+	}
+
+	path, err := exec.LookPath(r.command)
+	if err != nil {
+		return fmt.Errorf("finding %s: %w", r.command, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cmd, stdout, err := r.startCommand(ctx, path, "")
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	go r.run(ctx, path, cmd, stdout, r.done)
+
+	r.logger.Info("started reading journal", "units", r.units)
+	return nil
+}
+
+// startCommand starts journalctl, resuming after cursor when it is set.
+func (r *Reader) startCommand(ctx context.Context, path, cursor string) (*exec.Cmd, io.Reader, error) {
+	cmd := exec.CommandContext(ctx, path, r.args(cursor)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating journalctl pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("starting journalctl: %w", err)
+	}
+	return cmd, stdout, nil
+}
+
+// args returns the journalctl arguments.
+func (r *Reader) args(cursor string) []string {
+	args := []string{"--follow", "--output=json", "--no-pager"}
+	if cursor != "" {
+		args = append(args, "--after-cursor="+cursor)
+	} else {
+		args = append(args, "--lines=0")
+	}
+	for _, unit := range r.units {
+		args = append(args, "--unit="+unit)
+	}
+	return args
+}
+
+// run reads entries until ctx is cancelled, restarting journalctl when it
+// exits. done is closed on return.
+func (r *Reader) run(ctx context.Context, path string, cmd *exec.Cmd, stdout io.Reader, done chan struct{}) {
+	defer close(done)
+
+	for {
+		r.read(stdout)
+		err := cmd.Wait()
+		if ctx.Err() != nil {
+			return
+		}
+		r.errors.Warn("exited", "journalctl exited, restarting", "error", err, "delay", r.restartDelay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.restartDelay):
+		}
+
+		cmd, stdout, err = r.startCommand(ctx, path, r.Cursor())
+		for err != nil {
+			r.errors.Error("restart", "restarting journalctl failed", "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(r.restartDelay):
+			}
+			cmd, stdout, err = r.startCommand(ctx, path, r.Cursor())
+		}
+	}
+}
+
+// read delivers each entry of stdout to the handler until EOF.
+func (r *Reader) read(stdout io.Reader) {
+	br := bufio.NewReaderSize(stdout, 64*1024)
+	var buf []byte
+	tooLong := false
+
+	for {
+		chunk, isPrefix, err := br.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				r.logger.Error("error reading journal", "error", err)
+			}
+			return
+		}
+
+		if !tooLong {
+			buf = append(buf, chunk...)
+			if len(buf) > maxEntrySize {
+				tooLong = true
+			}
+		}
+		if isPrefix {
+			continue
+		}
+
+		if tooLong {
+			r.errors.Warn("oversized", "skipping oversized journal entry", "limit", maxEntrySize)
+		} else if len(buf) > 0 {
+			line := string(buf)
+			if r.handler != nil {
+				r.handler(line)
+			}
+			if cursor := entryCursor(line); cursor != "" {
+				r.mu.Lock()
+				r.cursor = cursor
+				r.mu.Unlock()
+			}
+		}
+		buf = buf[:0]
+		tooLong = false
+	}
+}
+
+// Stop stops reading the journal.
+// It waits for the handler to return so no entries are delivered after
+// Stop returns.
+func (r *Reader) Stop() {
+	r.mu.Lock()
+	cancel, done := r.cancel, r.done
+	r.cancel, r.done = nil, nil
+	r.mu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+	r.errors.Flush()
+	r.logger.Info("stopped reading journal", "units", r.units)
+}
+
+// Cursor returns the cursor of the last entry delivered to the handler.
+func (r *Reader) Cursor() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cursor
+}
+
+// Units returns the units the reader is filtered on.
+func (r *Reader) Units() []string {
+	return r.units
+}
+
+// entryCursor extracts __CURSOR from a JSON entry without decoding it.
+// Cursors never contain quotes or escapes.
+func entryCursor(line string) string {
+	const key = `"__CURSOR":"`
+	i := strings.Index(line, key)
+	if i < 0 {
+		return ""
+	}
+	rest := line[i+len(key):]
+	end := strings.IndexByte(rest, '"')
+	if end < 0 {
+		return ""
+	}
+	return rest[:end]
+}
@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: MIT
+
+package journald
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeJournalctl writes a script that records its arguments to args.log
+// and prints entries, then exits.
+func fakeJournalctl(t *testing.T, entries ...string) (string, string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake journalctl requires a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args.log")
+	script := "#!/bin/sh\necho \"$@\" >> " + argsFile + "\n"
+	for _, e := range entries {
+		script += "echo '" + e + "'\n"
+	}
+
+	path := filepath.Join(dir, "journalctl")
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path, argsFile
+}
+
+type collector struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (c *collector) handle(line string) {
+	c.mu.Lock()
+	c.lines = append(c.lines, line)
+	c.mu.Unlock()
+}
+
+func (c *collector) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.lines)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReader_ReadsEntries(t *testing.T) {
+	cmd, argsFile := fakeJournalctl(t,
+		`{"__CURSOR":"c1","MESSAGE":"one"}`,
+		`{"__CURSOR":"c2","MESSAGE":"two"}`,
+	)
+
+	var c collector
+	r := New([]string{"nginx.service", "app.service"}, c.handle, nil)
+	r.command = cmd
+	r.restartDelay = 10 * time.Millisecond
+
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer r.Stop()
+
+	// The fake exits after printing, so the reader restarts it after c2
+	waitFor(t, func() bool { return c.count() >= 4 })
+	r.Stop()
+
+	data, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(runs) < 2 {
+		t.Fatalf("journalctl ran %d times, want at least 2", len(runs))
+	}
+	want := "--follow --output=json --no-pager --lines=0 --unit=nginx.service --unit=app.service"
+	if runs[0] != want {
+		t.Errorf("first run args = %q, want %q", runs[0], want)
+	}
+	if !strings.Contains(runs[1], "--after-cursor=c2") {
+		t.Errorf("restart args = %q, want --after-cursor=c2", runs[1])
+	}
+
+	if got := c.lines[0]; got != `{"__CURSOR":"c1","MESSAGE":"one"}` {
+		t.Errorf("first line = %q", got)
+	}
+	if r.Cursor() == "" {
+		t.Error("Cursor() is empty after reading entries")
+	}
+}
+
+func TestReader_MissingCommand(t *testing.T) {
+	r := New(nil, nil, nil)
+	r.command = "shm-agent-no-such-journalctl"
+
+	if err := r.Start(context.Background()); err == nil {
+		r.Stop()
+		t.Fatal("Start() should fail when journalctl is missing")
+	}
+}
+
+func TestEntryCursor(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`{"__CURSOR":"s=abc;i=1","MESSAGE":"x"}`, "s=abc;i=1"},
+		{`{"MESSAGE":"x"}`, ""},
+		{`{"__CURSOR":"unterminated`, ""},
+	}
+	for _, tt := range tests {
+		if got := entryCursor(tt.line); got != tt.want {
+			t.Errorf("entryCursor(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// SPDX-License-Identifier: MIT
+
+// Package kafka publishes snapshots, and optionally the lines that matched
+// a metric, to Kafka topics.
+//
+// It implements the two requests a producer needs, metadata and produce,
+// with record batches compressed with gzip or zstd, over plaintext
+// connections. Keyed messages are partitioned as the Java client does, so
+// that all the messages of a key land on the same partition. Messages are
+// JSON objects.
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+// DefaultClientID identifies the agent to brokers.
+const DefaultClientID = "shm-agent"
+
+// maxEventsPerBatch caps the events produced in a request, keeping
+// batches well below the default message size limit of brokers.
+const maxEventsPerBatch = 500
+
+// Config configures a Writer.
+type Config struct {
+	Brokers     []string      // bootstrap brokers, host:port
+	Topic       string        // snapshots
+	EventsTopic string        // matched lines, see SendEvents
+	Key         []byte        // key of every message, nil to spread messages over partitions
+	Acks        int16         // AcksAll, AcksLeader or AcksNone
+	Codec       Codec         // compression of record batches
+	Timeout     time.Duration // defaults to DefaultTimeout
+	ClientID    string        // defaults to DefaultClientID
+
+	// Identify the agent in every message.
+	InstanceID  string
+	AppName     string
+	AppVersion  string
+	Environment string
+}
+
+// Event is a line that matched at least one metric.
+type Event struct {
+	Time    time.Time `json:"timestamp"`
+	Source  string    `json:"source"`
+	Metrics []string  `json:"metrics"` // names of the metrics matched
+	Line    string    `json:"line"`
+}
+
+// origin identifies the agent in messages.
+type origin struct {
+	InstanceID  string `json:"instance_id,omitempty"`
+	AppName     string `json:"app_name"`
+	AppVersion  string `json:"app_version,omitempty"`
+	Environment string `json:"environment,omitempty"`
+}
+
+// snapshotMessage is the value of the messages of the snapshot topic.
+type snapshotMessage struct {
+	origin
+	Timestamp     time.Time                    `json:"timestamp"`
+	IntervalStart *time.Time                   `json:"interval_start,omitempty"`
+	IntervalEnd   *time.Time                   `json:"interval_end,omitempty"`
+	Metrics       map[string]interface{}       `json:"metrics"`
+	Annotations   map[string]sender.Annotation `json:"annotations,omitempty"`
+}
+
+// eventMessage is the value of the messages of the events topic.
+type eventMessage struct {
+	origin
+	Event
+}
+
+// Writer publishes snapshots and events to Kafka.
+type Writer struct {
+	topic       string
+	eventsTopic string
+	key         []byte
+	origin      origin
+	producer    *producer
+
+	lastDelivery atomic.Int64 // unix nanoseconds of the last snapshot produced
+}
+
+// New creates a Writer. Brokers are connected to on the first send.
+func New(cfg Config) *Writer {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = DefaultClientID
+	}
+	return &Writer{
+		topic:       cfg.Topic,
+		eventsTopic: cfg.EventsTopic,
+		key:         cfg.Key,
+		origin: origin{
+			InstanceID:  cfg.InstanceID,
+			AppName:     cfg.AppName,
+			AppVersion:  cfg.AppVersion,
+			Environment: cfg.Environment,
+		},
+		producer: &producer{
+			brokers:  cfg.Brokers,
+			clientID: cfg.ClientID,
+			acks:     cfg.Acks,
+			codec:    cfg.Codec,
+			timeout:  cfg.Timeout,
+			conns:    make(map[string]net.Conn),
+			leaders:  make(map[string][]int32),
+		},
+	}
+}
+
+// Name returns "kafka".
+func (w *Writer) Name() string {
+	return "kafka"
+}
+
+// Send produces a snapshot as a single message to the snapshot topic.
+func (w *Writer) Send(ctx context.Context, snap sender.Snapshot) error {
+	msg := snapshotMessage{
+		origin:      w.origin,
+		Timestamp:   snap.Timestamp,
+		Metrics:     snap.Metrics,
+		Annotations: snap.Annotations,
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = snap.End
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	if !snap.Start.IsZero() && !snap.End.IsZero() {
+		msg.IntervalStart, msg.IntervalEnd = &snap.Start, &snap.End
+	}
+	value, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("encoding snapshot: %w", err)
+	}
+
+	m := Message{Key: w.key, Value: value, Time: msg.Timestamp}
+	if err := w.producer.produce(ctx, w.topic, []Message{m}); err != nil {
+		return fmt.Errorf("producing to %s: %w", w.topic, err)
+	}
+	w.lastDelivery.Store(time.Now().UnixNano())
+	return nil
+}
+
+// SendEvents produces events to the events topic, one message per event.
+// It does nothing without an events topic.
+func (w *Writer) SendEvents(ctx context.Context, events []Event) error {
+	if w.eventsTopic == "" {
+		return nil
+	}
+	for len(events) > 0 {
+		n := min(len(events), maxEventsPerBatch)
+		msgs := make([]Message, 0, n)
+		for _, ev := range events[:n] {
+			value, err := json.Marshal(eventMessage{origin: w.origin, Event: ev})
+			if err != nil {
+				return fmt.Errorf("encoding event: %w", err)
+			}
+			msgs = append(msgs, Message{Key: w.key, Value: value, Time: ev.Time})
+		}
+		if err := w.producer.produce(ctx, w.eventsTopic, msgs); err != nil {
+			return fmt.Errorf("producing to %s: %w", w.eventsTopic, err)
+		}
+		events = events[n:]
+	}
+	return nil
+}
+
+// LastDelivery returns when a snapshot was last produced, or the zero
+// time. With AcksNone, produced means sent.
+func (w *Writer) LastDelivery() time.Time {
+	if ns := w.lastDelivery.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// Close closes the connections to the brokers.
+func (w *Writer) Close() error {
+	return w.producer.close()
+}
@@ -0,0 +1,328 @@
+// SPDX-License-Identifier: MIT
+
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+// fakeBroker is a single broker leading every partition of every topic.
+type fakeBroker struct {
+	ln         net.Listener
+	partitions int
+
+	mu       sync.Mutex
+	produced map[string]map[int32][]Message // by topic and partition
+	fail     []Error                        // errors of the next produce requests
+	metadata int                            // metadata requests received
+	acks     []int16                        // acks of the produce requests
+}
+
+func newFakeBroker(t *testing.T, partitions int) *fakeBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{ln: ln, partitions: partitions, produced: make(map[string]map[int32][]Message)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return b
+}
+
+func (b *fakeBroker) addr() string { return b.ln.Addr().String() }
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		d := decoder{buf: req}
+		api, _, id := d.int16(), d.int16(), d.int32()
+		d.string() // client id
+
+		var resp []byte
+		switch api {
+		case apiMetadata:
+			resp = b.handleMetadata(&d)
+		case apiProduce:
+			resp = b.handleProduce(&d)
+		}
+		if resp == nil {
+			continue
+		}
+		var e encoder
+		e.int32(int32(len(resp) + 4))
+		e.int32(id)
+		e.buf = append(e.buf, resp...)
+		if _, err := conn.Write(e.buf); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) handleMetadata(d *decoder) []byte {
+	b.mu.Lock()
+	b.metadata++
+	b.mu.Unlock()
+
+	host, port, _ := net.SplitHostPort(b.addr())
+	portNum, _ := strconv.Atoi(port)
+	var e encoder
+	e.int32(0) // throttle time
+	e.int32(1)
+	e.int32(7) // node id
+	e.string(host)
+	e.int32(int32(portNum))
+	e.int16(-1) // rack
+	e.int16(-1) // cluster id
+	e.int32(7)  // controller
+	n := d.arrayLen()
+	e.int32(int32(n))
+	for i := 0; i < n; i++ {
+		e.int16(0)
+		e.string(d.string())
+		e.int8(0)
+		e.int32(int32(b.partitions))
+		for p := 0; p < b.partitions; p++ {
+			e.int16(0)
+			e.int32(int32(p))
+			e.int32(7) // leader
+			e.int32(1)
+			e.int32(7)
+			e.int32(1)
+			e.int32(7)
+		}
+	}
+	return e.buf
+}
+
+func (b *fakeBroker) handleProduce(d *decoder) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d.string() // transactional id
+	acks := d.int16()
+	b.acks = append(b.acks, acks)
+	d.int32() // timeout
+	var code Error
+	if len(b.fail) > 0 {
+		code, b.fail = b.fail[0], b.fail[1:]
+	}
+
+	var e encoder
+	n := d.arrayLen()
+	e.int32(int32(n))
+	for i := 0; i < n; i++ {
+		topic := d.string()
+		e.string(topic)
+		m := d.arrayLen()
+		e.int32(int32(m))
+		for j := 0; j < m; j++ {
+			part := d.int32()
+			msgs, err := decodeBatch(d.bytes())
+			if err != nil {
+				code = 2 // corrupt message
+			}
+			if code == 0 {
+				if b.produced[topic] == nil {
+					b.produced[topic] = make(map[int32][]Message)
+				}
+				b.produced[topic][part] = append(b.produced[topic][part], msgs...)
+			}
+			e.int32(part)
+			e.int16(int16(code))
+			e.int64(0)
+			e.int64(-1)
+			e.int64(0)
+		}
+	}
+	e.int32(0) // throttle time
+	if acks == AcksNone {
+		return nil
+	}
+	return e.buf
+}
+
+// messages returns a copy of the messages produced to topic by partition.
+func (b *fakeBroker) messages(topic string) map[int32][]Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := make(map[int32][]Message, len(b.produced[topic]))
+	for part, msgs := range b.produced[topic] {
+		out[part] = append([]Message(nil), msgs...)
+	}
+	return out
+}
+
+func TestWriter_Send(t *testing.T) {
+	b := newFakeBroker(t, 3)
+	w := New(Config{
+		Brokers:    []string{b.addr()},
+		Topic:      "snapshots",
+		Key:        []byte("instance-1"),
+		Acks:       AcksAll,
+		Codec:      CodecGzip,
+		InstanceID: "instance-1",
+		AppName:    "shop",
+	})
+	defer w.Close()
+
+	end := time.Unix(1700000060, 0).UTC()
+	snap := sender.Snapshot{
+		Metrics: map[string]interface{}{"requests": float64(3)},
+		Start:   end.Add(-time.Minute),
+		End:     end,
+	}
+	for i := 0; i < 2; i++ {
+		if err := w.Send(context.Background(), snap); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+	if w.LastDelivery().IsZero() {
+		t.Error("LastDelivery() is zero after Send")
+	}
+
+	// Both messages land on the partition of the key
+	produced := b.messages("snapshots")
+	part := partitionOf([]byte("instance-1"), 3)
+	if len(produced) != 1 || len(produced[part]) != 2 {
+		t.Fatalf("produced = %v, want 2 messages on partition %d", produced, part)
+	}
+	m := produced[part][0]
+	if string(m.Key) != "instance-1" || !m.Time.Equal(end) {
+		t.Errorf("message key = %q, time = %v", m.Key, m.Time)
+	}
+	var value struct {
+		InstanceID    string             `json:"instance_id"`
+		AppName       string             `json:"app_name"`
+		Timestamp     time.Time          `json:"timestamp"`
+		IntervalStart time.Time          `json:"interval_start"`
+		Metrics       map[string]float64 `json:"metrics"`
+	}
+	if err := json.Unmarshal(m.Value, &value); err != nil {
+		t.Fatalf("message value %s: %v", m.Value, err)
+	}
+	if value.InstanceID != "instance-1" || value.AppName != "shop" || !value.Timestamp.Equal(end) ||
+		!value.IntervalStart.Equal(snap.Start) || value.Metrics["requests"] != 3 {
+		t.Errorf("message value = %s", m.Value)
+	}
+
+	b.mu.Lock()
+	metadata := b.metadata
+	b.mu.Unlock()
+	if metadata != 1 {
+		t.Errorf("metadata requests = %d, want 1 as leaders are cached", metadata)
+	}
+}
+
+func TestWriter_SendRetries(t *testing.T) {
+	b := newFakeBroker(t, 1)
+	b.fail = []Error{ErrNotLeaderForPartition}
+	w := New(Config{Brokers: []string{b.addr()}, Topic: "snapshots", Acks: AcksLeader})
+	defer w.Close()
+
+	snap := sender.Snapshot{Metrics: map[string]interface{}{"requests": float64(1)}}
+	if err := w.Send(context.Background(), snap); err != nil {
+		t.Fatalf("Send() error = %v, want a successful retry", err)
+	}
+	if n := len(b.messages("snapshots")[0]); n != 1 {
+		t.Errorf("produced %d messages, want 1", n)
+	}
+	b.mu.Lock()
+	metadata := b.metadata
+	b.mu.Unlock()
+	if metadata != 2 {
+		t.Errorf("metadata requests = %d, want 2 as leaders are refreshed", metadata)
+	}
+
+	b.mu.Lock()
+	b.fail = []Error{ErrTopicAuthorization}
+	b.mu.Unlock()
+	err := w.Send(context.Background(), snap)
+	if !errors.Is(err, ErrTopicAuthorization) {
+		t.Errorf("Send() error = %v, want %v", err, ErrTopicAuthorization)
+	}
+}
+
+func TestWriter_SendEvents(t *testing.T) {
+	b := newFakeBroker(t, 2)
+	w := New(Config{
+		Brokers:     []string{b.addr()},
+		Topic:       "snapshots",
+		EventsTopic: "events",
+		Acks:        AcksNone,
+		Codec:       CodecZstd,
+		AppName:     "shop",
+	})
+	defer w.Close()
+
+	events := make([]Event, maxEventsPerBatch+1)
+	for i := range events {
+		events[i] = Event{Time: time.Now(), Source: "/var/log/app.log", Metrics: []string{"errors"}, Line: "line " + strconv.Itoa(i)}
+	}
+	if err := w.SendEvents(context.Background(), events); err != nil {
+		t.Fatalf("SendEvents() error = %v", err)
+	}
+
+	// Without acknowledgement, wait for the broker to read the requests
+	var total int
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		total = 0
+		for _, msgs := range b.messages("events") {
+			total += len(msgs)
+		}
+		if total == len(events) {
+			break
+		}
+	}
+	if total != len(events) {
+		t.Fatalf("produced %d events, want %d", total, len(events))
+	}
+
+	var value map[string]interface{}
+	for _, msgs := range b.messages("events") {
+		if err := json.Unmarshal(msgs[0].Value, &value); err != nil {
+			t.Fatal(err)
+		}
+		if msgs[0].Key != nil {
+			t.Errorf("event key = %q, want none", msgs[0].Key)
+		}
+		break
+	}
+	if value["app_name"] != "shop" || value["source"] != "/var/log/app.log" || value["line"] == nil {
+		t.Errorf("event value = %v", value)
+	}
+	b.mu.Lock()
+	acks := b.acks
+	b.mu.Unlock()
+	if len(acks) != 2 || acks[0] != AcksNone {
+		t.Errorf("produce requests acks = %v, want 2 requests without acks", acks)
+	}
+}
@@ -0,0 +1,377 @@
+// SPDX-License-Identifier: MIT
+
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout bounds connecting to a broker, a request and, with acks,
+// the time the broker waits for replicas.
+const DefaultTimeout = 10 * time.Second
+
+// Acknowledgements a produce request waits for.
+const (
+	AcksNone   int16 = 0  // none, the broker does not respond
+	AcksLeader int16 = 1  // the partition leader wrote the records
+	AcksAll    int16 = -1 // every in-sync replica wrote the records
+)
+
+// maxAttempts bounds the attempts to produce messages; the metadata is
+// refreshed between attempts, as leaders may have moved.
+const maxAttempts = 3
+
+// retryBackoff is the wait before the second attempt, doubled after.
+const retryBackoff = 250 * time.Millisecond
+
+// maxResponseSize caps the responses read, against a peer that is not a
+// Kafka broker.
+const maxResponseSize = 64 << 20
+
+// producer sends produce requests to the leaders of the partitions.
+// Requests are serialized: the agent produces once per interval.
+type producer struct {
+	brokers  []string
+	clientID string
+	acks     int16
+	codec    Codec
+	timeout  time.Duration
+
+	mu          sync.Mutex
+	correlation int32
+	addrs       map[int32]string    // broker addresses by node id
+	conns       map[string]net.Conn // by address
+	leaders     map[string][]int32  // leader of every partition, by topic
+	next        int                 // partition of the next messages without key
+}
+
+// produce produces messages to a topic, retrying those that failed with a
+// retriable error.
+func (p *producer) produce(ctx context.Context, topic string, msgs []Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pending := msgs
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			delete(p.leaders, topic)
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(retryBackoff << (attempt - 1)):
+			}
+		}
+		failed, perr := p.attempt(ctx, topic, pending)
+		if perr == nil {
+			return nil
+		}
+		pending, err = failed, perr
+		if !retriable(ctx, err) {
+			break
+		}
+	}
+	return err
+}
+
+// attempt produces messages once, and returns those that failed.
+func (p *producer) attempt(ctx context.Context, topic string, msgs []Message) ([]Message, error) {
+	leaders, err := p.partitions(ctx, topic)
+	if err != nil {
+		return msgs, err
+	}
+
+	// Messages without key all go to the same partition, the next one
+	// at every attempt, as batches are cheaper than single records.
+	keyless := int32(p.next % len(leaders))
+	p.next++
+	byPartition := make(map[int32][]Message)
+	for _, m := range msgs {
+		part := keyless
+		if m.Key != nil {
+			part = partitionOf(m.Key, len(leaders))
+		}
+		byPartition[part] = append(byPartition[part], m)
+	}
+	byLeader := make(map[int32][]int32)
+	for part := range byPartition {
+		byLeader[leaders[part]] = append(byLeader[leaders[part]], part)
+	}
+
+	var failed []Message
+	var errs []error
+	for leader, parts := range byLeader {
+		failedParts, err := p.send(ctx, leader, topic, parts, byPartition)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, part := range failedParts {
+			failed = append(failed, byPartition[part]...)
+		}
+	}
+	return failed, errors.Join(errs...)
+}
+
+// send sends the batches of the partitions a broker leads in a produce
+// request, and returns the partitions that failed.
+func (p *producer) send(ctx context.Context, leader int32, topic string, parts []int32, batches map[int32][]Message) ([]int32, error) {
+	addr, ok := p.addrs[leader]
+	if !ok {
+		return parts, fmt.Errorf("partitions %v: %w", parts, ErrLeaderNotAvailable)
+	}
+
+	var body encoder
+	body.int16(-1) // transactional id
+	body.int16(p.acks)
+	body.int32(int32(p.timeout / time.Millisecond))
+	body.int32(1)
+	body.string(topic)
+	body.int32(int32(len(parts)))
+	for _, part := range parts {
+		batch, err := encodeBatch(batches[part], p.codec)
+		if err != nil {
+			return parts, err
+		}
+		body.int32(part)
+		body.bytes(batch)
+	}
+
+	resp, err := p.roundTrip(ctx, addr, apiProduce, produceVersion, body.buf, p.acks != AcksNone)
+	if err != nil {
+		return parts, err
+	}
+	if p.acks == AcksNone {
+		return nil, nil
+	}
+
+	var failed []int32
+	var errs []error
+	d := decoder{buf: resp}
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		d.string() // topic
+		for j, m := 0, d.arrayLen(); j < m; j++ {
+			part := d.int32()
+			code := Error(d.int16())
+			d.int64() // base offset
+			d.int64() // log append time
+			d.int64() // log start offset
+			if code != 0 && d.err == nil {
+				failed = append(failed, part)
+				errs = append(errs, fmt.Errorf("partition %d: %w", part, code))
+			}
+		}
+	}
+	d.int32() // throttle time
+	if d.err != nil {
+		p.drop(addr)
+		return parts, fmt.Errorf("decoding produce response from %s: %w", addr, d.err)
+	}
+	return failed, errors.Join(errs...)
+}
+
+// partitions returns the leader of every partition of a topic, fetching
+// the metadata unless known.
+func (p *producer) partitions(ctx context.Context, topic string) ([]int32, error) {
+	if leaders, ok := p.leaders[topic]; ok {
+		return leaders, nil
+	}
+
+	var body encoder
+	body.int32(1)
+	body.string(topic)
+	body.int8(1) // allow auto topic creation, as the Java client does
+
+	var resp []byte
+	var err error
+	for _, addr := range p.metadataBrokers() {
+		if resp, err = p.roundTrip(ctx, addr, apiMetadata, metadataVersion, body.buf, true); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching metadata: %w", err)
+	}
+
+	d := decoder{buf: resp}
+	d.int32() // throttle time
+	addrs := make(map[int32]string)
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		addrs[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() // cluster id
+	d.int32()  // controller id
+
+	var leaders []int32
+	var topicErr error
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		code := Error(d.int16())
+		name := d.string()
+		d.int8() // internal
+		byPartition := make(map[int32]int32)
+		for j, m := 0, d.arrayLen(); j < m; j++ {
+			d.int16() // partition error, partitions without leader have leader -1
+			part := d.int32()
+			byPartition[part] = d.int32()
+			for k, r := 0, d.arrayLen(); k < r; k++ {
+				d.int32() // replicas
+			}
+			for k, r := 0, d.arrayLen(); k < r; k++ {
+				d.int32() // in-sync replicas
+			}
+		}
+		if name != topic {
+			continue
+		}
+		if code != 0 {
+			topicErr = fmt.Errorf("topic %s: %w", topic, code)
+			continue
+		}
+		leaders = make([]int32, len(byPartition))
+		for part, leader := range byPartition {
+			if part >= 0 && int(part) < len(leaders) {
+				leaders[part] = leader
+			}
+		}
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("decoding metadata: %w", d.err)
+	}
+
+	p.addrs = addrs
+	if topicErr != nil {
+		return nil, topicErr
+	}
+	if len(leaders) == 0 {
+		return nil, fmt.Errorf("topic %s: %w", topic, ErrUnknownTopicOrPartition)
+	}
+	p.leaders[topic] = leaders
+	return leaders, nil
+}
+
+// metadataBrokers returns the brokers to ask for metadata: the bootstrap
+// brokers, then those learned from earlier metadata.
+func (p *producer) metadataBrokers() []string {
+	addrs := append([]string(nil), p.brokers...)
+	for _, addr := range p.addrs {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// roundTrip sends a request to a broker and reads its response, unless
+// none is expected. The connection is dropped on failure.
+func (p *producer) roundTrip(ctx context.Context, addr string, api, version int16, body []byte, response bool) ([]byte, error) {
+	conn, err := p.conn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p.correlation++
+	id := p.correlation
+	var e encoder
+	e.int32(0) // size, set below
+	e.int16(api)
+	e.int16(version)
+	e.int32(id)
+	e.string(p.clientID)
+	e.buf = append(e.buf, body...)
+	binary.BigEndian.PutUint32(e.buf, uint32(len(e.buf)-4))
+
+	// The broker may wait for the timeout before acknowledging
+	deadline := time.Now().Add(2 * p.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write(e.buf); err != nil {
+		p.drop(addr)
+		return nil, fmt.Errorf("sending request to %s: %w", addr, err)
+	}
+	if !response {
+		return nil, nil
+	}
+
+	var header [8]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		p.drop(addr)
+		return nil, fmt.Errorf("reading response from %s: %w", addr, err)
+	}
+	size := int32(binary.BigEndian.Uint32(header[:4]))
+	if size < 4 || size > maxResponseSize {
+		p.drop(addr)
+		return nil, fmt.Errorf("invalid response size %d from %s", size, addr)
+	}
+	if got := int32(binary.BigEndian.Uint32(header[4:])); got != id {
+		p.drop(addr)
+		return nil, fmt.Errorf("response from %s has correlation id %d, want %d", addr, got, id)
+	}
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		p.drop(addr)
+		return nil, fmt.Errorf("reading response from %s: %w", addr, err)
+	}
+	return resp, nil
+}
+
+// conn returns the connection to a broker, connecting unless connected.
+func (p *producer) conn(ctx context.Context, addr string) (net.Conn, error) {
+	if conn, ok := p.conns[addr]; ok {
+		return conn, nil
+	}
+	dialer := net.Dialer{Timeout: p.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to broker: %w", err)
+	}
+	p.conns[addr] = conn
+	return conn, nil
+}
+
+// drop closes the connection to a broker, after an error left it in an
+// unknown state.
+func (p *producer) drop(addr string) {
+	if conn, ok := p.conns[addr]; ok {
+		conn.Close()
+		delete(p.conns, addr)
+	}
+}
+
+// close closes the connections to the brokers.
+func (p *producer) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var errs []error
+	for addr, conn := range p.conns {
+		if err := conn.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(p.conns, addr)
+	}
+	return errors.Join(errs...)
+}
+
+// retriable reports whether producing may succeed once retried: broker
+// errors that say so, and connection errors, unless ctx is done.
+func retriable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var kerr Error
+	if errors.As(err, &kerr) {
+		return kerr.Retriable()
+	}
+	return true
+}
@@ -0,0 +1,341 @@
+// SPDX-License-Identifier: MIT
+
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// API keys and versions of the requests sent. Both versions predate
+// flexible encodings, and are supported by brokers since Kafka 2.1.
+const (
+	apiProduce      int16 = 0
+	apiMetadata     int16 = 3
+	produceVersion  int16 = 7
+	metadataVersion int16 = 4
+)
+
+// Codec is the compression of record batches.
+type Codec int8
+
+// Supported codecs, with their record batch attribute values.
+const (
+	CodecNone Codec = 0
+	CodecGzip Codec = 1
+	CodecZstd Codec = 4
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// errShort reports a response that ends before its last field.
+var errShort = errors.New("truncated response")
+
+// encoder appends protocol fields to a buffer.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) int8(v int8) { e.buf = append(e.buf, byte(v)) }
+
+func (e *encoder) int16(v int16) { e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(v)) }
+
+func (e *encoder) int32(v int32) { e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(v)) }
+
+func (e *encoder) int64(v int64) { e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v)) }
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// varint appends a zigzag varint, as in records.
+func (e *encoder) varint(v int64) { e.buf = binary.AppendVarint(e.buf, v) }
+
+// varbytes appends a varint length, -1 for nil, and the bytes.
+func (e *encoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// decoder reads protocol fields from a buffer. The first error is kept and
+// makes every later read return zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = errShort
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a nullable string; null reads as "".
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// arrayLen reads the length of an array; a null array reads as empty.
+// Lengths the remaining bytes cannot hold are an error.
+func (d *decoder) arrayLen() int {
+	n := d.int32()
+	if n > int32(len(d.buf)) {
+		d.err = errShort
+		return 0
+	}
+	return max(int(n), 0)
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errShort
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) varbytes() []byte {
+	n := d.varint()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// Message is a record to produce.
+type Message struct {
+	Key   []byte // nil to spread messages over partitions
+	Value []byte
+	Time  time.Time
+}
+
+// encodeBatch encodes messages as a record batch (magic 2), their records
+// compressed with codec.
+func encodeBatch(msgs []Message, codec Codec) ([]byte, error) {
+	first := msgs[0].Time.UnixMilli()
+	last := first
+	var recs encoder
+	for i, m := range msgs {
+		ts := m.Time.UnixMilli()
+		last = max(last, ts)
+
+		var r encoder
+		r.int8(0) // attributes
+		r.varint(ts - first)
+		r.varint(int64(i))
+		r.varbytes(m.Key)
+		r.varbytes(m.Value)
+		r.varint(0) // headers
+		recs.varint(int64(len(r.buf)))
+		recs.buf = append(recs.buf, r.buf...)
+	}
+	records, err := compress(codec, recs.buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var e encoder
+	e.int64(0)  // base offset, assigned by the broker
+	e.int32(0)  // batch length, set below
+	e.int32(-1) // partition leader epoch
+	e.int8(2)   // magic
+	e.int32(0)  // CRC, set below
+	e.int16(int16(codec))
+	e.int32(int32(len(msgs) - 1)) // last offset delta
+	e.int64(first)
+	e.int64(last)
+	e.int64(-1) // producer id
+	e.int16(-1) // producer epoch
+	e.int32(-1) // base sequence
+	e.int32(int32(len(msgs)))
+	e.buf = append(e.buf, records...)
+
+	binary.BigEndian.PutUint32(e.buf[8:], uint32(len(e.buf)-12))
+	binary.BigEndian.PutUint32(e.buf[17:], crc32.Checksum(e.buf[21:], castagnoli))
+	return e.buf, nil
+}
+
+// compress compresses the records of a batch.
+func compress(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return data, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, fmt.Errorf("compressing records: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, fmt.Errorf("compressing records: %w", err)
+		}
+		return buf.Bytes(), nil
+	case CodecZstd:
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("compressing records: %w", err)
+		}
+		defer enc.Close()
+		return enc.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported codec %d", codec)
+	}
+}
+
+// murmur2 is the hash the Java client partitions keyed messages with, so
+// that a key lands on the same partition whichever client produced it.
+func murmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+	n := len(data)
+	h := seed ^ uint32(n)
+	for i := 0; i+4 <= n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[n&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// partitionOf returns the partition of a keyed message among n.
+func partitionOf(key []byte, n int) int32 {
+	return (murmur2(key) & 0x7fffffff) % int32(n)
+}
+
+// Error is an error code returned by a broker.
+type Error int16
+
+// Error codes the producer handles.
+const (
+	ErrUnknownTopicOrPartition Error = 3
+	ErrLeaderNotAvailable      Error = 5
+	ErrNotLeaderForPartition   Error = 6
+	ErrRequestTimedOut         Error = 7
+	ErrMessageTooLarge         Error = 10
+	ErrNotEnoughReplicas       Error = 19
+	ErrTopicAuthorization      Error = 29
+)
+
+var errorNames = map[Error]string{
+	2:                          "corrupt message",
+	ErrUnknownTopicOrPartition: "unknown topic or partition",
+	ErrLeaderNotAvailable:      "leader not available",
+	ErrNotLeaderForPartition:   "not leader for partition",
+	ErrRequestTimedOut:         "request timed out",
+	ErrMessageTooLarge:         "message too large",
+	17:                         "invalid topic",
+	18:                         "record list too large",
+	ErrNotEnoughReplicas:       "not enough replicas",
+	20:                         "not enough replicas after append",
+	ErrTopicAuthorization:      "topic authorization failed",
+	35:                         "unsupported version",
+	76:                         "unsupported compression type",
+}
+
+func (e Error) Error() string {
+	if name, ok := errorNames[e]; ok {
+		return fmt.Sprintf("kafka error %d: %s", int16(e), name)
+	}
+	return fmt.Sprintf("kafka error %d", int16(e))
+}
+
+// Retriable reports whether the request may succeed once retried, usually
+// after refreshing the metadata.
+func (e Error) Retriable() bool {
+	switch e {
+	case 2, ErrUnknownTopicOrPartition, ErrLeaderNotAvailable, ErrNotLeaderForPartition,
+		ErrRequestTimedOut, ErrNotEnoughReplicas, 20:
+		return true
+	}
+	return false
+}
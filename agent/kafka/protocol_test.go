@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: MIT
+
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestMurmur2(t *testing.T) {
+	// Values of the Java client
+	tests := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+	for key, want := range tests {
+		if got := murmur2([]byte(key)); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", key, got, want)
+		}
+	}
+}
+
+func TestEncodeBatch(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	msgs := []Message{
+		{Key: []byte("k"), Value: []byte("one"), Time: now},
+		{Value: []byte("two"), Time: now.Add(5 * time.Millisecond)},
+	}
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecZstd} {
+		batch, err := encodeBatch(msgs, codec)
+		if err != nil {
+			t.Fatalf("encodeBatch(%d) error = %v", codec, err)
+		}
+		got, err := decodeBatch(batch)
+		if err != nil {
+			t.Fatalf("decodeBatch(%d) error = %v", codec, err)
+		}
+		if len(got) != 2 ||
+			string(got[0].Key) != "k" || string(got[0].Value) != "one" || !got[0].Time.Equal(now) ||
+			got[1].Key != nil || string(got[1].Value) != "two" || !got[1].Time.Equal(now.Add(5*time.Millisecond)) {
+			t.Errorf("codec %d: decoded %+v", codec, got)
+		}
+	}
+}
+
+// decodeBatch decodes a record batch as a broker does, checking its CRC.
+func decodeBatch(batch []byte) ([]Message, error) {
+	d := decoder{buf: batch}
+	d.int64() // base offset
+	if n := d.int32(); int(n) != len(d.buf) {
+		return nil, fmt.Errorf("batch length %d, %d bytes left", n, len(d.buf))
+	}
+	d.int32() // partition leader epoch
+	if magic := d.int8(); magic != 2 {
+		return nil, fmt.Errorf("magic %d", magic)
+	}
+	crc := uint32(d.int32())
+	if got := crc32.Checksum(d.buf, crc32.MakeTable(crc32.Castagnoli)); got != crc {
+		return nil, fmt.Errorf("CRC %x, want %x", got, crc)
+	}
+	codec := Codec(d.int16() & 7)
+	d.int32() // last offset delta
+	first := d.int64()
+	d.int64() // max timestamp
+	d.int64() // producer id
+	d.int16() // producer epoch
+	d.int32() // base sequence
+	count := int(d.int32())
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	records := d.buf
+	switch codec {
+	case CodecGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(records))
+		if err != nil {
+			return nil, err
+		}
+		if records, err = io.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	case CodecZstd:
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		if records, err = dec.DecodeAll(records, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	var msgs []Message
+	rd := decoder{buf: records}
+	for i := 0; i < count; i++ {
+		r := decoder{buf: rd.take(int(rd.varint()))}
+		r.int8() // attributes
+		ts := first + r.varint()
+		if delta := r.varint(); delta != int64(i) {
+			return nil, fmt.Errorf("record %d has offset delta %d", i, delta)
+		}
+		m := Message{Key: r.varbytes(), Value: r.varbytes(), Time: time.UnixMilli(ts)}
+		r.varint() // headers
+		if r.err != nil {
+			return nil, r.err
+		}
+		msgs = append(msgs, m)
+	}
+	if rd.err != nil {
+		return nil, rd.err
+	}
+	return msgs, nil
+}
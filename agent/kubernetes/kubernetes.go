@@ -0,0 +1,226 @@
+// SPDX-License-Identifier: MIT
+
+// Package kubernetes discovers pods through the Kubernetes API server and
+// locates their log files on the node.
+//
+// Only the few API calls the agent needs are implemented, using the pod's
+// service account credentials, so no client library is required.
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// In-cluster service account paths.
+const (
+	DefaultTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	DefaultCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// DefaultLogsDir is where the kubelet writes container logs.
+const DefaultLogsDir = "/var/log/pods"
+
+// requestTimeout bounds a single API request.
+const requestTimeout = 30 * time.Second
+
+// Config locates the API server and its credentials.
+type Config struct {
+	// Host is the API server URL. Defaults to the in-cluster address from
+	// KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT.
+	Host string
+
+	// TokenFile holds the bearer token. It is read on every request since
+	// projected service account tokens are rotated.
+	TokenFile string
+
+	// CAFile holds the API server CA certificate for https hosts.
+	CAFile string
+}
+
+// Client lists pods from the API server.
+type Client struct {
+	host      string
+	tokenFile string
+	client    *http.Client
+}
+
+// Pod is the subset of a pod the agent uses.
+type Pod struct {
+	Name       string
+	Namespace  string
+	UID        string
+	NodeName   string
+	Labels     map[string]string
+	Containers []string
+}
+
+// NewClient creates a client. Unset fields of cfg fall back to the
+// in-cluster defaults.
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.Host == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("not running in a cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+		}
+		cfg.Host = "https://" + net.JoinHostPort(host, port)
+	}
+	if cfg.TokenFile == "" {
+		cfg.TokenFile = DefaultTokenFile
+	}
+	if cfg.CAFile == "" {
+		cfg.CAFile = DefaultCAFile
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if strings.HasPrefix(cfg.Host, "https://") {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return &Client{
+		host:      strings.TrimSuffix(cfg.Host, "/"),
+		tokenFile: cfg.TokenFile,
+		client:    &http.Client{Transport: transport, Timeout: requestTimeout},
+	}, nil
+}
+
+// PodFilter selects the pods to list.
+type PodFilter struct {
+	Namespace     string // empty for all namespaces
+	LabelSelector string // e.g. "app=checkout,tier!=cache"
+	NodeName      string // empty for all nodes
+}
+
+// podItem mirrors the fields of a Pod used by the agent.
+type podItem struct {
+	Metadata struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace"`
+		UID       string            `json:"uid"`
+		Labels    map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName   string `json:"nodeName"`
+		Containers []struct {
+			Name string `json:"name"`
+		} `json:"containers"`
+		InitContainers []struct {
+			Name string `json:"name"`
+		} `json:"initContainers"`
+	} `json:"spec"`
+}
+
+// pod converts the item to a Pod.
+func (item *podItem) pod() Pod {
+	pod := Pod{
+		Name:      item.Metadata.Name,
+		Namespace: item.Metadata.Namespace,
+		UID:       item.Metadata.UID,
+		NodeName:  item.Spec.NodeName,
+		Labels:    item.Metadata.Labels,
+	}
+	for _, ctr := range item.Spec.InitContainers {
+		pod.Containers = append(pod.Containers, ctr.Name)
+	}
+	for _, ctr := range item.Spec.Containers {
+		pod.Containers = append(pod.Containers, ctr.Name)
+	}
+	return pod
+}
+
+// podList mirrors the fields of a PodList used by the agent.
+type podList struct {
+	Items []podItem `json:"items"`
+}
+
+// ListPods returns the pods matching filter.
+func (c *Client) ListPods(ctx context.Context, filter PodFilter) ([]Pod, error) {
+	path := "/api/v1/pods"
+	if filter.Namespace != "" {
+		path = "/api/v1/namespaces/" + url.PathEscape(filter.Namespace) + "/pods"
+	}
+
+	query := url.Values{}
+	if filter.LabelSelector != "" {
+		query.Set("labelSelector", filter.LabelSelector)
+	}
+	if filter.NodeName != "" {
+		query.Set("fieldSelector", "spec.nodeName="+filter.NodeName)
+	}
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var list podList
+	if err := c.get(ctx, path, "listing pods", &list); err != nil {
+		return nil, err
+	}
+
+	pods := make([]Pod, 0, len(list.Items))
+	for i := range list.Items {
+		pods = append(pods, list.Items[i].pod())
+	}
+	return pods, nil
+}
+
+// GetPod returns a single pod.
+func (c *Client) GetPod(ctx context.Context, namespace, name string) (Pod, error) {
+	path := "/api/v1/namespaces/" + url.PathEscape(namespace) + "/pods/" + url.PathEscape(name)
+	var item podItem
+	if err := c.get(ctx, path, "getting pod", &item); err != nil {
+		return Pod{}, err
+	}
+	return item.pod(), nil
+}
+
+// get requests path from the API server and decodes the JSON response
+// into v. what describes the request in errors.
+func (c *Client) get(ctx context.Context, path, what string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.host+path, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	token, err := os.ReadFile(c.tokenFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading token file: %w", err)
+	}
+	if t := strings.TrimSpace(string(token)); t != "" {
+		req.Header.Set("Authorization", "Bearer "+t)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", what, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: status %d: %s", what, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: decoding response: %w", what, err)
+	}
+	return nil
+}
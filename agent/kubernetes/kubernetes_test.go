@@ -0,0 +1,222 @@
+// SPDX-License-Identifier: MIT
+
+package kubernetes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const podListJSON = `{"items":[{
+  "metadata":{"name":"checkout-1","namespace":"shop","uid":"u1","labels":{"app":"checkout"}},
+  "spec":{"nodeName":"node-a","initContainers":[{"name":"init"}],"containers":[{"name":"app"},{"name":"proxy"}]}
+}]}`
+
+func TestClient_ListPods(t *testing.T) {
+	var gotPath, gotQuery, gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotQuery, gotAuth = r.URL.Path, r.URL.RawQuery, r.Header.Get("Authorization")
+		w.Write([]byte(podListJSON))
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewClient(Config{Host: srv.URL, TokenFile: tokenFile})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+
+	pods, err := c.ListPods(context.Background(), PodFilter{Namespace: "shop", LabelSelector: "app=checkout", NodeName: "node-a"})
+	if err != nil {
+		t.Fatalf("ListPods() error = %v", err)
+	}
+
+	if gotPath != "/api/v1/namespaces/shop/pods" {
+		t.Errorf("path = %q", gotPath)
+	}
+	if gotQuery != "fieldSelector=spec.nodeName%3Dnode-a&labelSelector=app%3Dcheckout" {
+		t.Errorf("query = %q", gotQuery)
+	}
+	if gotAuth != "Bearer secret" {
+		t.Errorf("Authorization = %q", gotAuth)
+	}
+
+	want := []Pod{{
+		Name:       "checkout-1",
+		Namespace:  "shop",
+		UID:        "u1",
+		NodeName:   "node-a",
+		Labels:     map[string]string{"app": "checkout"},
+		Containers: []string{"init", "app", "proxy"},
+	}}
+	if !reflect.DeepEqual(pods, want) {
+		t.Errorf("ListPods() = %+v, want %+v", pods, want)
+	}
+}
+
+func TestClient_ListPodsError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(Config{Host: srv.URL, TokenFile: filepath.Join(t.TempDir(), "missing")})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if _, err := c.ListPods(context.Background(), PodFilter{}); err == nil {
+		t.Error("ListPods() should fail on 403")
+	}
+}
+
+func TestClient_GetPod(t *testing.T) {
+	var gotPath string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Write([]byte(`{"metadata":{"name":"agent-x","namespace":"ops","uid":"u2","labels":{"app":"shm"}},"spec":{"nodeName":"node-b"}}`))
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(Config{Host: srv.URL, TokenFile: filepath.Join(t.TempDir(), "missing")})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	pod, err := c.GetPod(context.Background(), "ops", "agent-x")
+	if err != nil {
+		t.Fatalf("GetPod() error = %v", err)
+	}
+	if gotPath != "/api/v1/namespaces/ops/pods/agent-x" {
+		t.Errorf("path = %q", gotPath)
+	}
+	want := Pod{Name: "agent-x", Namespace: "ops", UID: "u2", NodeName: "node-b", Labels: map[string]string{"app": "shm"}}
+	if !reflect.DeepEqual(pod, want) {
+		t.Errorf("GetPod() = %+v, want %+v", pod, want)
+	}
+}
+
+func TestNewClient_NotInCluster(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "")
+
+	if _, err := NewClient(Config{}); err == nil {
+		t.Error("NewClient() should fail outside a cluster without a host")
+	}
+}
+
+func TestLogFiles(t *testing.T) {
+	dir := t.TempDir()
+	pod := Pod{Name: "web", Namespace: "shop", UID: "u1", Containers: []string{"app", "proxy"}}
+
+	for _, f := range []string{"app/0.log", "app/1.log", "app/0.log.20240101-000000.gz", "proxy/0.log"} {
+		path := filepath.Join(dir, "shop_web_u1", f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := LogFiles(dir, pod, "")
+	if err != nil {
+		t.Fatalf("LogFiles() error = %v", err)
+	}
+	if len(files) != 3 {
+		t.Errorf("LogFiles() = %v, want 3 files", files)
+	}
+
+	files, _ = LogFiles(dir, pod, "proxy")
+	if len(files) != 1 || ContainerFromPath(files[0]) != "proxy" {
+		t.Errorf("LogFiles(proxy) = %v", files)
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want Line
+	}{
+		{
+			raw:  `2024-01-01T00:00:00.000000001Z stdout F {"level":"error"}`,
+			want: Line{Message: `{"level":"error"}`, Stream: "stdout"},
+		},
+		{
+			raw:  `2024-01-01T00:00:00Z stderr P first half`,
+			want: Line{Message: "first half", Stream: "stderr", Partial: true},
+		},
+		{
+			raw:  `2024-01-01T00:00:00Z stdout F`,
+			want: Line{Stream: "stdout"},
+		},
+		{
+			raw:  `{"log":"hello world\n","stream":"stdout","time":"2024-01-01T00:00:00Z"}`,
+			want: Line{Message: "hello world", Stream: "stdout"},
+		},
+		{
+			raw:  `{"log":"no newline","stream":"stderr"}`,
+			want: Line{Message: "no newline", Stream: "stderr", Partial: true},
+		},
+		{
+			raw:  `plain line`,
+			want: Line{Message: "plain line"},
+		},
+		{
+			raw:  `{"level":"info"}`,
+			want: Line{Message: `{"level":"info"}`},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := ParseLine(tt.raw); got != tt.want {
+			t.Errorf("ParseLine(%q) = %+v, want %+v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestSelf(t *testing.T) {
+	t.Setenv(EnvPodName, "agent-x")
+	t.Setenv(EnvPodNamespace, "ops")
+	t.Setenv(EnvPodUID, "")
+	t.Setenv(EnvNodeName, "node-b")
+
+	labelsFile := filepath.Join(t.TempDir(), "labels")
+	content := "app=\"shm\"\npod-template-hash=\"5d4f\"\nnote=\"a \\\"quoted\\\" value\"\n"
+	if err := os.WriteFile(labelsFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pod, err := Self(labelsFile)
+	if err != nil {
+		t.Fatalf("Self() error = %v", err)
+	}
+	want := Pod{
+		Name:      "agent-x",
+		Namespace: "ops",
+		NodeName:  "node-b",
+		Labels:    map[string]string{"app": "shm", "pod-template-hash": "5d4f", "note": `a "quoted" value`},
+	}
+	if !reflect.DeepEqual(pod, want) {
+		t.Errorf("Self() = %+v, want %+v", pod, want)
+	}
+
+	pod, err = Self(filepath.Join(t.TempDir(), "missing"))
+	if err != nil || pod.Labels != nil {
+		t.Errorf("Self(missing) = %+v, %v; want no labels", pod, err)
+	}
+
+	if err := os.WriteFile(labelsFile, []byte("app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Self(labelsFile); err == nil {
+		t.Error("Self() should fail on a malformed labels file")
+	}
+}
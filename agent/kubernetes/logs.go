@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: MIT
+
+package kubernetes
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LogFiles returns the log files of a pod's containers under logsDir,
+// following the kubelet layout <namespace>_<pod>_<uid>/<container>/<restart>.log.
+// When container is set, only that container's files are returned.
+func LogFiles(logsDir string, pod Pod, container string) ([]string, error) {
+	podDir := filepath.Join(logsDir, pod.Namespace+"_"+pod.Name+"_"+pod.UID)
+
+	var files []string
+	for _, name := range pod.Containers {
+		if container != "" && name != container {
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(podDir, name, "*.log"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// ContainerFromPath returns the container name of a log file path.
+func ContainerFromPath(path string) string {
+	return filepath.Base(filepath.Dir(path))
+}
+
+// Fields returns the metadata attached to the lines of a container, under
+// the "kubernetes" key.
+func Fields(pod Pod, container string) map[string]interface{} {
+	labels := make(map[string]interface{}, len(pod.Labels))
+	for k, v := range pod.Labels {
+		labels[k] = v
+	}
+	return map[string]interface{}{
+		"kubernetes": map[string]interface{}{
+			"pod":       pod.Name,
+			"namespace": pod.Namespace,
+			"pod_uid":   pod.UID,
+			"container": container,
+			"node":      pod.NodeName,
+			"labels":    labels,
+		},
+	}
+}
+
+// Line is a container log line with its runtime framing removed.
+type Line struct {
+	Message string
+	Stream  string // "stdout" or "stderr"
+	Partial bool   // the message continues on the next line
+}
+
+// ParseLine decodes a line written by the container runtime, either in the
+// CRI format (`<time> <stream> <P|F> <message>`) or the Docker json-file
+// format. Lines in neither format are returned unchanged.
+func ParseLine(raw string) Line {
+	if strings.HasPrefix(raw, "{") {
+		var entry struct {
+			Log    *string `json:"log"`
+			Stream string  `json:"stream"`
+		}
+		if err := json.Unmarshal([]byte(raw), &entry); err == nil && entry.Log != nil {
+			msg := *entry.Log
+			partial := !strings.HasSuffix(msg, "\n")
+			return Line{Message: strings.TrimSuffix(msg, "\n"), Stream: entry.Stream, Partial: partial}
+		}
+	}
+
+	parts := strings.SplitN(raw, " ", 4)
+	if len(parts) >= 3 && (parts[1] == "stdout" || parts[1] == "stderr") && (parts[2] == "P" || parts[2] == "F") {
+		line := Line{Stream: parts[1], Partial: parts[2] == "P"}
+		if len(parts) == 4 {
+			line.Message = parts[3]
+		}
+		return line
+	}
+
+	return Line{Message: raw}
+}
@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: MIT
+
+package kubernetes
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultNamespaceFile holds the namespace of the pod's service account.
+const DefaultNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Downward API environment variables describing the pod the agent runs in,
+// set in the pod spec with fieldRef.
+const (
+	EnvPodName      = "POD_NAME"      // metadata.name
+	EnvPodNamespace = "POD_NAMESPACE" // metadata.namespace
+	EnvPodUID       = "POD_UID"       // metadata.uid
+	EnvNodeName     = "NODE_NAME"     // spec.nodeName
+)
+
+// Self returns what the downward API tells of the pod the agent runs in:
+// its name, namespace, UID and node from the environment, and its labels
+// from labelsFile. The name defaults to the hostname and the namespace to
+// the service account's. Labels is nil when labelsFile does not exist.
+func Self(labelsFile string) (Pod, error) {
+	pod := Pod{
+		Name:      os.Getenv(EnvPodName),
+		Namespace: os.Getenv(EnvPodNamespace),
+		UID:       os.Getenv(EnvPodUID),
+		NodeName:  os.Getenv(EnvNodeName),
+	}
+	if pod.Name == "" {
+		pod.Name, _ = os.Hostname()
+	}
+	if pod.Namespace == "" {
+		ns, err := os.ReadFile(DefaultNamespaceFile)
+		if err == nil {
+			pod.Namespace = strings.TrimSpace(string(ns))
+		}
+	}
+
+	if labelsFile != "" {
+		labels, err := ReadLabelsFile(labelsFile)
+		if err != nil && !os.IsNotExist(err) {
+			return pod, err
+		}
+		pod.Labels = labels
+	}
+	return pod, nil
+}
+
+// ReadLabelsFile reads a downward API labels file, made of key="value"
+// lines with Go-quoted values.
+func ReadLabelsFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	labels := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		key, quoted, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key=\"value\"", path, n)
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid value for %s: %w", path, n, key, err)
+		}
+		labels[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return labels, nil
+}
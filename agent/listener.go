@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/prometheus"
+)
+
+// startListener starts the local HTTP listener serving /metrics, /history,
+// /healthz and /readyz.
+// The address is bound synchronously so that errors surface from Start;
+// the listener failing later is reported to fail.
+func (a *Agent) startListener(addr string, fail func(error)) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", addr, err)
+	}
+
+	a.exporter = prometheus.New(a.aggregator.GetMetricType)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", a.exporter)
+	mux.HandleFunc("/history", a.serveHistory)
+	mux.Handle("/healthz", a.serveHealth(a.Live))
+	mux.Handle("/readyz", a.serveHealth(a.Ready))
+
+	a.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func(srv *http.Server) {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fail(fmt.Errorf("serving %s: %w", addr, err))
+		}
+	}(a.server)
+
+	a.listenAddr = ln.Addr()
+	a.logger.Info("serving metrics", "addr", a.listenAddr.String(), "path", "/metrics")
+	return nil
+}
+
+// serveHistory writes the recent snapshots as JSON, oldest first.
+func (a *Agent) serveHistory(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a.History()); err != nil {
+		a.logger.Debug("writing history failed", "error", err)
+	}
+}
+
+// ListenAddr returns the address of the local HTTP listener, or nil if it
+// is not running.
+func (a *Agent) ListenAddr() net.Addr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.listenAddr
+}
+
+// stopListener shuts the local HTTP listener down, waiting at most timeout
+// for in-flight requests.
+func (a *Agent) stopListener(timeout time.Duration) {
+	if a.server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := a.server.Shutdown(ctx); err != nil {
+		a.logger.Warn("error stopping listener", "error", err)
+	}
+	a.server = nil
+	a.listenAddr = nil
+}
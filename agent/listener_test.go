@@ -0,0 +1,161 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAgent_PrometheusEndpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(path, []byte{}, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cfg := reloadTestConfig(path)
+	cfg.ListenAddr = "127.0.0.1:0"
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer ag.Stop(0)
+
+	ag.ProcessLine(0, `{}`)
+	ag.ProcessLine(0, `{}`)
+	if err := ag.sendSnapshot(context.Background()); err != nil {
+		t.Fatalf("sendSnapshot() error = %v", err)
+	}
+
+	resp, err := http.Get("http://" + ag.ListenAddr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics error = %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if !strings.Contains(string(body), "# TYPE requests counter\nrequests 2\n") {
+		t.Errorf("body = %q, want requests counter at 2", body)
+	}
+
+	ag.Stop(0)
+	if ag.ListenAddr() != nil {
+		t.Error("ListenAddr() should be nil after Stop")
+	}
+}
+
+func TestAgent_Offline(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(path, []byte{}, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cfg := reloadTestConfig(path)
+	cfg.Offline = true
+	cfg.ServerURL = ""
+	cfg.AppVersion = ""
+	cfg.IdentityFile = filepath.Join(dir, "identity.json")
+	cfg.PositionsFile = "none"
+	cfg.ListenAddr = "127.0.0.1:0"
+
+	ag, err := New(Options{Config: cfg})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer ag.Stop(0)
+
+	if ag.sender != nil {
+		t.Error("offline agent should not create a sender")
+	}
+	if _, err := os.Stat(cfg.IdentityFile); !os.IsNotExist(err) {
+		t.Error("offline agent should not create an identity")
+	}
+
+	ag.ProcessLine(0, `{}`)
+	if err := ag.sendSnapshot(context.Background()); err != nil {
+		t.Fatalf("sendSnapshot() error = %v", err)
+	}
+
+	var b strings.Builder
+	ag.exporter.Write(&b)
+	if !strings.Contains(b.String(), "requests 1\n") {
+		t.Errorf("exporter = %q, want requests 1", b.String())
+	}
+}
+
+func TestAgent_HealthEndpoints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(path, []byte{}, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cfg := reloadTestConfig(path)
+	cfg.ListenAddr = "127.0.0.1:0"
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer ag.Stop(0)
+
+	ag.ProcessLine(0, `{}`)
+	ag.ProcessLine(0, `not json`)
+
+	get := func(path string) (int, Health) {
+		t.Helper()
+		resp, err := http.Get("http://" + ag.ListenAddr().String() + path)
+		if err != nil {
+			t.Fatalf("GET %s error = %v", path, err)
+		}
+		defer resp.Body.Close()
+		var h Health
+		if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+			t.Fatalf("decoding %s: %v", path, err)
+		}
+		return resp.StatusCode, h
+	}
+
+	for _, endpoint := range []string{"/healthz", "/readyz"} {
+		code, h := get(endpoint)
+		if code != http.StatusOK || h.Status != "ok" {
+			t.Errorf("%s = %d %+v, want 200 ok", endpoint, code, h)
+		}
+	}
+
+	_, h := get("/readyz")
+	if len(h.Sources) != 1 || h.Sources[0].OpenFiles != 1 || h.Sources[0].ParseErrorRatio != 0.5 {
+		t.Errorf("sources = %+v, want one open file and half the lines failing", h.Sources)
+	}
+
+	// A snapshot loop that stopped ticking makes the agent unhealthy
+	ag.liveSince.Store(time.Now().Add(-4 * cfg.Interval).UnixNano())
+	code, h := get("/healthz")
+	if code != http.StatusServiceUnavailable || len(h.Problems) != 1 || !strings.Contains(h.Problems[0], "no snapshot taken") {
+		t.Errorf("/healthz = %d %+v, want 503 with a stale snapshot", code, h)
+	}
+
+	if err := ag.sendSnapshot(context.Background()); err != nil {
+		t.Fatalf("sendSnapshot() error = %v", err)
+	}
+	if code, h := get("/healthz"); code != http.StatusOK || h.LastSnapshot == nil {
+		t.Errorf("/healthz = %d %+v, want 200 after a snapshot", code, h)
+	}
+}
@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: MIT
+
+// Package logthrottle rate-limits recurring log messages, such as the same
+// parse or delivery error logged for every line or attempt.
+package logthrottle
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// DefaultWindow is how long repeats of a message are counted instead of
+// logged.
+const DefaultWindow = 30 * time.Second
+
+// Logger logs the first occurrence of a message, then counts its repeats
+// for a window and logs the last one once, with a "repeated" attribute
+// holding the count. Messages are told apart by a key.
+type Logger struct {
+	logger *slog.Logger
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// entry tracks a message whose repeats are being counted.
+type entry struct {
+	level    slog.Level
+	msg      string
+	args     []any // of the last repeat
+	repeated int
+	timer    *time.Timer
+}
+
+// New returns a Logger writing to logger. A window of 0 uses DefaultWindow.
+func New(logger *slog.Logger, window time.Duration) *Logger {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	return &Logger{
+		logger:  logger,
+		window:  window,
+		entries: make(map[string]*entry),
+	}
+}
+
+// Log logs msg unless a message with the same key was logged during the
+// current window, in which case it only counts a repeat.
+func (l *Logger) Log(level slog.Level, key, msg string, args ...any) {
+	if !l.logger.Enabled(context.Background(), level) {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e := l.entries[key]; e != nil {
+		e.level, e.msg, e.args = level, msg, args
+		e.repeated++
+		return
+	}
+
+	l.logger.Log(context.Background(), level, msg, args...)
+	e := &entry{}
+	e.timer = time.AfterFunc(l.window, func() { l.expire(key, e) })
+	l.entries[key] = e
+}
+
+// Debug logs at debug level, see Log.
+func (l *Logger) Debug(key, msg string, args ...any) {
+	l.Log(slog.LevelDebug, key, msg, args...)
+}
+
+// Warn logs at warning level, see Log.
+func (l *Logger) Warn(key, msg string, args ...any) {
+	l.Log(slog.LevelWarn, key, msg, args...)
+}
+
+// Error logs at error level, see Log.
+func (l *Logger) Error(key, msg string, args ...any) {
+	l.Log(slog.LevelError, key, msg, args...)
+}
+
+// expire ends the window of an entry. Repeats are summarized and counted
+// over a new window; without repeats, the next occurrence is logged.
+func (l *Logger) expire(key string, e *entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.entries[key] != e {
+		return
+	}
+	if e.repeated == 0 {
+		delete(l.entries, key)
+		return
+	}
+	l.summarize(e)
+	e.repeated = 0
+	e.timer.Reset(l.window)
+}
+
+// Flush logs the summaries of the repeats counted so far and resets every
+// window, e.g. on shutdown.
+func (l *Logger) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, e := range l.entries {
+		e.timer.Stop()
+		if e.repeated > 0 {
+			l.summarize(e)
+		}
+		delete(l.entries, key)
+	}
+}
+
+// summarize logs the last repeat of an entry with the number of repeats.
+// Must be called with l.mu held.
+func (l *Logger) summarize(e *entry) {
+	args := append(e.args[:len(e.args):len(e.args)], "repeated", e.repeated, "over", l.window)
+	l.logger.Log(context.Background(), e.level, e.msg, args...)
+}
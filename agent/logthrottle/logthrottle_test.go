@@ -0,0 +1,76 @@
+// SPDX-License-Identifier: MIT
+
+package logthrottle
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for the timer goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+}
+
+func TestLogger(t *testing.T) {
+	var buf syncBuffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	l := New(logger, 50*time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		l.Warn("parse", "failed to parse line", "n", i)
+	}
+	l.Warn("send", "failed to send snapshot")
+	l.Debug("debug", "not enabled at info level")
+
+	got := buf.lines()
+	want := []string{
+		`level=WARN msg="failed to parse line" n=0`,
+		`level=WARN msg="failed to send snapshot"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("logged:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// The repeats are summarized once the window ends
+	time.Sleep(120 * time.Millisecond)
+	got = buf.lines()
+	if len(got) != 3 || got[2] != `level=WARN msg="failed to parse line" n=99 repeated=99 over=50ms` {
+		t.Fatalf("logged:\n%s\nwant a summary of 99 repeats", strings.Join(got, "\n"))
+	}
+
+	// Without repeats the window closes: the next occurrence is logged
+	time.Sleep(120 * time.Millisecond)
+	l.Warn("parse", "failed to parse line", "n", 100)
+	l.Warn("parse", "failed to parse line", "n", 101)
+	l.Flush()
+	got = buf.lines()
+	if len(got) != 5 || got[3] != `level=WARN msg="failed to parse line" n=100` ||
+		got[4] != `level=WARN msg="failed to parse line" n=101 repeated=1 over=50ms` {
+		t.Fatalf("logged:\n%s\nwant the next occurrence, then a flushed summary", strings.Join(got, "\n"))
+	}
+}
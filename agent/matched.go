@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/kafka"
+)
+
+// maxMatchedLines caps the matched lines buffered between two snapshots;
+// further lines are dropped until the next snapshot.
+const maxMatchedLines = 10000
+
+// matchedLines buffers the lines that matched a metric until they are
+// published with the next snapshot, for the kafka events topic.
+type matchedLines struct {
+	mu      sync.Mutex
+	events  []kafka.Event
+	dropped int64
+}
+
+// newMatchedLines returns the buffer of matched lines, nil unless they
+// are published.
+func newMatchedLines(cfg *config.Config, dryRun bool) *matchedLines {
+	if dryRun || !cfg.HasOutput(config.OutputKafka) || cfg.Kafka.EventsTopic == "" {
+		return nil
+	}
+	return &matchedLines{}
+}
+
+// record buffers a line of a source and the metrics it matched.
+func (m *matchedLines) record(source string, metrics []string, line string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.events) >= maxMatchedLines {
+		m.dropped++
+		return
+	}
+	m.events = append(m.events, kafka.Event{Time: time.Now(), Source: source, Metrics: metrics, Line: line})
+}
+
+// take returns the buffered lines and the number dropped, and empties the
+// buffer.
+func (m *matchedLines) take() ([]kafka.Event, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events, dropped := m.events, m.dropped
+	m.events, m.dropped = nil, 0
+	return events, dropped
+}
+
+// requeue puts back lines that could not be published ahead of those
+// buffered since, so that they go with the next snapshot. The oldest are
+// dropped beyond maxMatchedLines.
+func (m *matchedLines) requeue(events []kafka.Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room := max(maxMatchedLines-len(m.events), 0)
+	if len(events) > room {
+		m.dropped += int64(len(events) - room)
+		events = events[len(events)-room:]
+	}
+	m.events = append(append([]kafka.Event(nil), events...), m.events...)
+}
+
+// attachMatchedLines makes a source processor buffer its matched lines.
+func (a *Agent) attachMatchedLines(proc *sourceProcessor) {
+	proc.matchedLines = a.matchedLines
+}
@@ -5,6 +5,7 @@ package matcher
 
 import (
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/kolapsis/shm-agent/agent/config"
@@ -18,25 +19,58 @@ type Matcher struct {
 	in       map[string]struct{}
 	regex    *regexp.Regexp
 	contains string
-	always   bool // true if no conditions (always matches)
+	negate   bool               // not_equals, not_in or not_contains
+	fold     bool               // ignore_case: values above are lowercase
+	exists   *bool              // whether the field must be present, if set
+	numeric  func(float64) bool // numeric comparison, if any
+	always   bool               // true if no conditions (always matches)
+	desc     string             // the condition, as shown by Explain
+	slot     int                // of the field in the views of its Fields
+	result   int                // of the condition in the views of its Fields
+
+	// Composite matchers; at most one is set
+	all []*Matcher
+	any []*Matcher
+	not *Matcher
 }
 
 // New creates a new Matcher from a config.Match.
 // If match is nil, creates a matcher that always matches.
 func New(match *config.Match) (*Matcher, error) {
-	if match == nil {
-		return &Matcher{always: true}, nil
-	}
+	return NewFields().New(match)
+}
 
+// newCondition creates a matcher for a condition on a single field.
+func newCondition(match *config.Match) (*Matcher, error) {
 	m := &Matcher{
 		field:    match.Field,
 		equals:   match.Equals,
 		contains: match.Contains,
+		exists:   match.Exists,
+	}
+
+	// A negated condition is its positive one, with the outcome inverted
+	in := match.In
+	switch {
+	case match.NotEquals != "":
+		m.equals, m.negate = match.NotEquals, true
+	case len(match.NotIn) > 0:
+		in, m.negate = match.NotIn, true
+	case match.NotContains != "":
+		m.contains, m.negate = match.NotContains, true
 	}
 
-	if len(match.In) > 0 {
-		m.in = make(map[string]struct{}, len(match.In))
-		for _, v := range match.In {
+	if match.IgnoreCase {
+		m.fold = true
+		m.equals, m.contains = strings.ToLower(m.equals), strings.ToLower(m.contains)
+	}
+
+	if len(in) > 0 {
+		m.in = make(map[string]struct{}, len(in))
+		for _, v := range in {
+			if m.fold {
+				v = strings.ToLower(v)
+			}
 			m.in[v] = struct{}{}
 		}
 	}
@@ -49,11 +83,137 @@ func New(match *config.Match) (*Matcher, error) {
 		m.regex = re
 	}
 
+	m.numeric = numericCondition(match)
+
+	return m, nil
+}
+
+// describe formats the condition of a match on a single field, such as
+// `status regex "^5\d{2}$"`.
+func describe(match *config.Match) string {
+	num := func(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) }
+	cond := ""
+	switch {
+	case match.Gt != nil:
+		cond = "gt " + num(*match.Gt)
+	case match.Gte != nil:
+		cond = "gte " + num(*match.Gte)
+	case match.Lt != nil:
+		cond = "lt " + num(*match.Lt)
+	case match.Lte != nil:
+		cond = "lte " + num(*match.Lte)
+	case len(match.Between) == 2:
+		cond = "between " + num(match.Between[0]) + " and " + num(match.Between[1])
+	case match.Equals != "":
+		cond = "equals " + strconv.Quote(match.Equals)
+	case len(match.In) > 0:
+		cond = "in " + quoteList(match.In)
+	case match.Regex != "":
+		cond = "regex " + strconv.Quote(match.Regex)
+	case match.Contains != "":
+		cond = "contains " + strconv.Quote(match.Contains)
+	case match.NotEquals != "":
+		cond = "not_equals " + strconv.Quote(match.NotEquals)
+	case len(match.NotIn) > 0:
+		cond = "not_in " + quoteList(match.NotIn)
+	case match.NotContains != "":
+		cond = "not_contains " + strconv.Quote(match.NotContains)
+	case match.Exists != nil:
+		cond = "exists " + strconv.FormatBool(*match.Exists)
+	}
+	if match.IgnoreCase {
+		cond += " ignore_case"
+	}
+	return strings.TrimSpace(match.Field + " " + cond)
+}
+
+// quoteList formats values as ["a", "b"].
+func quoteList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = strconv.Quote(v)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// numericCondition returns the comparison for a gt, gte, lt, lte or
+// between match, or nil if the match has none.
+func numericCondition(match *config.Match) func(float64) bool {
+	switch {
+	case match.Gt != nil:
+		bound := *match.Gt
+		return func(v float64) bool { return v > bound }
+	case match.Gte != nil:
+		bound := *match.Gte
+		return func(v float64) bool { return v >= bound }
+	case match.Lt != nil:
+		bound := *match.Lt
+		return func(v float64) bool { return v < bound }
+	case match.Lte != nil:
+		bound := *match.Lte
+		return func(v float64) bool { return v <= bound }
+	case len(match.Between) == 2:
+		lo, hi := match.Between[0], match.Between[1]
+		return func(v float64) bool { return v >= lo && v <= hi }
+	default:
+		return nil
+	}
+}
+
+// newComposite creates a matcher for an all, any or not match.
+func (f *Fields) newComposite(match *config.Match) (*Matcher, error) {
+	m := &Matcher{}
+	switch {
+	case len(match.All) > 0:
+		m.desc = "all"
+	case len(match.Any) > 0:
+		m.desc = "any"
+	default:
+		m.desc = "not"
+	}
+
+	for i := range match.All {
+		sub, err := f.New(&match.All[i])
+		if err != nil {
+			return nil, err
+		}
+		m.all = append(m.all, sub)
+	}
+
+	for i := range match.Any {
+		sub, err := f.New(&match.Any[i])
+		if err != nil {
+			return nil, err
+		}
+		m.any = append(m.any, sub)
+	}
+
+	if match.Not != nil {
+		sub, err := f.New(match.Not)
+		if err != nil {
+			return nil, err
+		}
+		m.not = sub
+	}
+
 	return m, nil
 }
 
 // Match checks if the parsed data matches the conditions.
 func (m *Matcher) Match(data map[string]interface{}) bool {
+	return m.match(data, nil)
+}
+
+// MatchView checks if the line of a view matches the conditions, reading
+// its fields and the outcome of conditions shared with other matchers
+// from the view. The view must be one of the Fields the matcher was
+// created with.
+func (m *Matcher) MatchView(v *View) bool {
+	return m.match(v.data, v)
+}
+
+// match checks the conditions on data, through v unless nil.
+func (m *Matcher) match(data map[string]interface{}, v *View) bool {
 	if m.always {
 		return true
 	}
@@ -62,13 +222,83 @@ func (m *Matcher) Match(data map[string]interface{}) bool {
 		return false
 	}
 
+	switch {
+	case m.all != nil:
+		for _, sub := range m.all {
+			if !sub.match(data, v) {
+				return false
+			}
+		}
+		return true
+	case m.any != nil:
+		for _, sub := range m.any {
+			if sub.match(data, v) {
+				return true
+			}
+		}
+		return false
+	case m.not != nil:
+		return !m.not.match(data, v)
+	}
+
+	if v == nil {
+		return m.matchField(data, nil)
+	}
+	result := &v.results[m.result]
+	if *result == 0 {
+		*result = -1
+		if m.matchField(data, v) {
+			*result = 1
+		}
+	}
+	return *result > 0
+}
+
+// matchField checks the condition on the field, read through v unless
+// nil.
+func (m *Matcher) matchField(data map[string]interface{}, v *View) bool {
+	if m.exists != nil {
+		var val interface{}
+		var ok bool
+		if v != nil {
+			val, ok = v.raw(m.slot, m.field)
+		} else {
+			val, ok = parser.GetField(data, m.field)
+		}
+		return (ok && val != nil) == *m.exists
+	}
+
+	if m.numeric != nil {
+		var val float64
+		var ok bool
+		if v != nil {
+			val, ok = v.float(m.slot, m.field)
+		} else {
+			val, ok = parser.GetFieldFloat(data, m.field)
+		}
+		return ok && m.numeric(val)
+	}
+
 	// Get field value as string
-	val, ok := parser.GetFieldString(data, m.field)
+	var val string
+	var ok bool
+	if v != nil {
+		val, ok = v.string(m.slot, m.field)
+	} else {
+		val, ok = parser.GetFieldString(data, m.field)
+	}
 	if !ok {
-		return false
+		return m.negate
+	}
+	return m.matchString(val) != m.negate
+}
+
+// matchString checks a string condition on the value of the field.
+func (m *Matcher) matchString(val string) bool {
+	if m.fold {
+		val = strings.ToLower(val)
 	}
 
-	// Check conditions
 	if m.equals != "" {
 		return val == m.equals
 	}
@@ -89,7 +319,58 @@ func (m *Matcher) Match(data map[string]interface{}) bool {
 	return false
 }
 
+// Step is the outcome of one condition of a matcher on a line.
+type Step struct {
+	Depth     int    `json:"depth"`           // nesting within all, any and not
+	Condition string `json:"condition"`       // e.g. `status regex "^5\d{2}$"`, or all, any or not
+	Field     string `json:"field,omitempty"` // field compared, empty for composites
+	Value     string `json:"value,omitempty"` // value of the field, when present
+	Present   bool   `json:"present"`         // whether the field is present
+	Matched   bool   `json:"matched"`
+}
+
+// Explain evaluates the conditions of the matcher on data and returns the
+// outcome of each, the matcher itself first and sub-matches after their
+// parent. Every sub-match is evaluated, even when the outcome of its
+// parent is already decided.
+func (m *Matcher) Explain(data map[string]interface{}) []Step {
+	var steps []Step
+	m.explain(data, 0, &steps)
+	return steps
+}
+
+// explain appends the steps of m at depth and returns its outcome.
+func (m *Matcher) explain(data map[string]interface{}, depth int, steps *[]Step) bool {
+	i := len(*steps)
+	*steps = append(*steps, Step{Depth: depth, Condition: m.desc, Field: m.field})
+
+	var matched bool
+	switch {
+	case m.always:
+		matched = true
+	case m.all != nil:
+		matched = true
+		for _, sub := range m.all {
+			matched = sub.explain(data, depth+1, steps) && matched
+		}
+	case m.any != nil:
+		for _, sub := range m.any {
+			matched = sub.explain(data, depth+1, steps) || matched
+		}
+	case m.not != nil:
+		matched = !m.not.explain(data, depth+1, steps)
+	default:
+		if val, ok := parser.GetFieldString(data, m.field); ok {
+			(*steps)[i].Value, (*steps)[i].Present = val, true
+		}
+		matched = m.Match(data)
+	}
+	(*steps)[i].Matched = matched
+	return matched
+}
+
 // Field returns the field name this matcher checks.
+// It is empty for composite matchers.
 func (m *Matcher) Field() string {
 	return m.field
 }
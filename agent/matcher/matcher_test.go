@@ -299,3 +299,338 @@ func TestMatcher_InWithNumbers(t *testing.T) {
 		})
 	}
 }
+
+func TestMatcher_Composite(t *testing.T) {
+	// status 5xx AND path under /api, but NOT the health check
+	m, err := New(&config.Match{
+		All: []config.Match{
+			{Field: "status", Regex: `^5\d\d$`},
+			{Any: []config.Match{
+				{Field: "path", Regex: `^/api/`},
+				{Field: "path", Equals: "/api"},
+			}},
+			{Not: &config.Match{Field: "path", Equals: "/api/health"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		data map[string]interface{}
+		want bool
+	}{
+		{map[string]interface{}{"status": float64(500), "path": "/api/users"}, true},
+		{map[string]interface{}{"status": "503", "path": "/api"}, true},
+		{map[string]interface{}{"status": float64(200), "path": "/api/users"}, false},
+		{map[string]interface{}{"status": float64(500), "path": "/static/app.js"}, false},
+		{map[string]interface{}{"status": float64(500), "path": "/api/health"}, false},
+		{map[string]interface{}{"path": "/api/users"}, false},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := m.Match(tt.data); got != tt.want {
+			t.Errorf("Match(%v) = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+
+	if m.Field() != "" {
+		t.Errorf("Field() = %q, want empty for a composite", m.Field())
+	}
+}
+
+func TestMatcher_NotMissingField(t *testing.T) {
+	m, err := New(&config.Match{Not: &config.Match{Field: "level", Equals: "debug"}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if !m.Match(map[string]interface{}{"msg": "no level"}) {
+		t.Error("not should match when the field is absent")
+	}
+	if m.Match(map[string]interface{}{"level": "debug"}) {
+		t.Error("not should not match debug")
+	}
+}
+
+func TestMatcher_Negated(t *testing.T) {
+	tests := []struct {
+		match config.Match
+		data  map[string]interface{}
+		want  bool
+	}{
+		{config.Match{Field: "path", NotEquals: "/health"}, map[string]interface{}{"path": "/api/users"}, true},
+		{config.Match{Field: "path", NotEquals: "/health"}, map[string]interface{}{"path": "/health"}, false},
+		{config.Match{Field: "path", NotEquals: "/health"}, map[string]interface{}{"status": "200"}, true}, // Field absent
+		{config.Match{Field: "status", NotIn: []string{"200", "304"}}, map[string]interface{}{"status": float64(500)}, true},
+		{config.Match{Field: "status", NotIn: []string{"200", "304"}}, map[string]interface{}{"status": float64(304)}, false},
+		{config.Match{Field: "agent", NotContains: "bot"}, map[string]interface{}{"agent": "Mozilla/5.0"}, true},
+		{config.Match{Field: "agent", NotContains: "bot"}, map[string]interface{}{"agent": "Googlebot/2.1"}, false},
+		{config.Match{Field: "agent", NotContains: "bot"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		m, err := New(&tt.match)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		if got := m.Match(tt.data); got != tt.want {
+			t.Errorf("%s: Match(%v) = %v, want %v", describe(&tt.match), tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestMatcher_IgnoreCase(t *testing.T) {
+	tests := []struct {
+		match config.Match
+		data  map[string]interface{}
+		want  bool
+	}{
+		{config.Match{Field: "level", Equals: "error", IgnoreCase: true}, map[string]interface{}{"level": "ERROR"}, true},
+		{config.Match{Field: "level", Equals: "Error", IgnoreCase: true}, map[string]interface{}{"level": "error"}, true},
+		{config.Match{Field: "level", Equals: "error", IgnoreCase: true}, map[string]interface{}{"level": "warn"}, false},
+		{config.Match{Field: "level", In: []string{"Error", "FATAL"}, IgnoreCase: true}, map[string]interface{}{"level": "fatal"}, true},
+		{config.Match{Field: "msg", Contains: "Timeout", IgnoreCase: true}, map[string]interface{}{"msg": "read TIMEOUT after 5s"}, true},
+		{config.Match{Field: "agent", NotContains: "bot", IgnoreCase: true}, map[string]interface{}{"agent": "Googlebot/2.1"}, false},
+		{config.Match{Field: "agent", NotContains: "bot", IgnoreCase: true}, map[string]interface{}{"agent": "BingBot"}, false},
+		{config.Match{Field: "level", Equals: "error"}, map[string]interface{}{"level": "Error"}, false},
+	}
+
+	for _, tt := range tests {
+		m, err := New(&tt.match)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		if got := m.Match(tt.data); got != tt.want {
+			t.Errorf("%s: Match(%v) = %v, want %v", describe(&tt.match), tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestMatcher_Exists(t *testing.T) {
+	yes, no := true, false
+	present, err := New(&config.Match{Field: "trace.id", Exists: &yes})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	missing, err := New(&config.Match{Field: "trace.id", Exists: &no})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		data map[string]interface{}
+		want bool // of present, missing being the opposite
+	}{
+		{map[string]interface{}{"trace": map[string]interface{}{"id": "abc"}}, true},
+		{map[string]interface{}{"trace.id": float64(0)}, true},
+		{map[string]interface{}{"trace": map[string]interface{}{"id": ""}}, true},
+		{map[string]interface{}{"trace": map[string]interface{}{"id": nil}}, false}, // null
+		{map[string]interface{}{"trace": map[string]interface{}{}}, false},
+		{map[string]interface{}{"msg": "no trace"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := present.Match(tt.data); got != tt.want {
+			t.Errorf("exists true: Match(%v) = %v, want %v", tt.data, got, tt.want)
+		}
+		if got := missing.Match(tt.data); got == tt.want {
+			t.Errorf("exists false: Match(%v) = %v, want %v", tt.data, got, !tt.want)
+		}
+	}
+	if missing.Match(nil) {
+		t.Error("exists false should not match an unparsed line")
+	}
+}
+
+func TestMatcher_CompositeInvalidRegex(t *testing.T) {
+	_, err := New(&config.Match{Any: []config.Match{{Field: "a", Regex: "[invalid"}}})
+	if err == nil {
+		t.Error("New() should return error for invalid nested regex")
+	}
+}
+
+func TestMatcher_Numeric(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name  string
+		match config.Match
+		value interface{}
+		want  bool
+	}{
+		{"gt above", config.Match{Field: "d", Gt: f(1000)}, float64(1500), true},
+		{"gt equal", config.Match{Field: "d", Gt: f(1000)}, float64(1000), false},
+		{"gte equal", config.Match{Field: "d", Gte: f(1000)}, float64(1000), true},
+		{"lt below", config.Match{Field: "d", Lt: f(10)}, float64(9.5), true},
+		{"lt equal", config.Match{Field: "d", Lt: f(10)}, float64(10), false},
+		{"lte equal", config.Match{Field: "d", Lte: f(10)}, float64(10), true},
+		{"between inside", config.Match{Field: "d", Between: []float64{500, 599}}, float64(503), true},
+		{"between bound", config.Match{Field: "d", Between: []float64{500, 599}}, float64(599), true},
+		{"between outside", config.Match{Field: "d", Between: []float64{500, 599}}, float64(404), false},
+		{"numeric string", config.Match{Field: "d", Gt: f(1000)}, "1200.5", true},
+		{"non-numeric string", config.Match{Field: "d", Gt: f(0)}, "slow", false},
+		{"zero bound", config.Match{Field: "d", Gt: f(0)}, float64(-1), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(&tt.match)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			data := map[string]interface{}{"d": tt.value}
+			if got := m.Match(data); got != tt.want {
+				t.Errorf("Match(%v) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+
+	m, _ := New(&config.Match{Field: "d", Gt: f(0)})
+	if m.Match(map[string]interface{}{"other": float64(1)}) {
+		t.Error("numeric matcher should not match a missing field")
+	}
+}
+
+func TestMatcher_Explain(t *testing.T) {
+	gte := 500.0
+	m, err := New(&config.Match{
+		All: []config.Match{
+			{Field: "status", Gte: &gte},
+			{Not: &config.Match{Field: "path", Regex: "^/health"}},
+			{Any: []config.Match{
+				{Field: "method", In: []string{"GET", "HEAD"}},
+				{Field: "user", Equals: "admin"},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	data := map[string]interface{}{"status": float64(503), "path": "/api", "method": "POST"}
+	want := []Step{
+		{Depth: 0, Condition: "all", Matched: false},
+		{Depth: 1, Condition: "status gte 500", Field: "status", Value: "503", Present: true, Matched: true},
+		{Depth: 1, Condition: "not", Matched: true},
+		{Depth: 2, Condition: `path regex "^/health"`, Field: "path", Value: "/api", Present: true, Matched: false},
+		{Depth: 1, Condition: "any", Matched: false},
+		{Depth: 2, Condition: `method in ["GET", "HEAD"]`, Field: "method", Value: "POST", Present: true, Matched: false},
+		{Depth: 2, Condition: `user equals "admin"`, Field: "user", Matched: false},
+	}
+	got := m.Explain(data)
+	if len(got) != len(want) {
+		t.Fatalf("Explain() = %+v, want %d steps", got, len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("step %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if got[0].Matched != m.Match(data) {
+		t.Error("Explain() and Match() disagree")
+	}
+
+	always, _ := New(nil)
+	if steps := always.Explain(nil); len(steps) != 1 || !steps[0].Matched {
+		t.Errorf("Explain() of an empty match = %+v", steps)
+	}
+}
+
+// sharedMatches are the matches of metrics that mostly read the same
+// fields, as the metrics of a busy source often do.
+func sharedMatches() []config.Match {
+	f := func(v float64) *float64 { return &v }
+	return []config.Match{
+		{Field: "status", Regex: `^5\d\d$`},
+		{Field: "status", Regex: `^5\d\d$`},
+		{Field: "status", Regex: `^4\d\d$`},
+		{Field: "status", In: []string{"200", "204"}},
+		{Field: "status", Gte: f(500)},
+		{All: []config.Match{
+			{Field: "status", Regex: `^5\d\d$`},
+			{Field: "path", Contains: "/api/"},
+		}},
+		{All: []config.Match{
+			{Field: "status", Regex: `^5\d\d$`},
+			{Not: &config.Match{Field: "path", Equals: "/health"}},
+		}},
+		{Field: "path", NotIn: []string{"/health", "/metrics"}},
+		{Field: "method", Equals: "POST"},
+		{Field: "trace_id", Exists: new(bool)},
+	}
+}
+
+func TestFields_Shared(t *testing.T) {
+	fields := NewFields()
+	matches := sharedMatches()
+	var matchers []*Matcher
+	for i := range matches {
+		m, err := fields.New(&matches[i])
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		matchers = append(matchers, m)
+	}
+	if matchers[0] != matchers[1] {
+		t.Error("identical conditions should share a matcher")
+	}
+	if len(fields.slots) != 4 || len(fields.conds) != 9 {
+		t.Errorf("%d fields and %d conditions, want 4 and 9", len(fields.slots), len(fields.conds))
+	}
+
+	lines := []map[string]interface{}{
+		{"status": float64(503), "path": "/api/users", "method": "POST"},
+		{"status": "500", "path": "/health", "trace_id": "abc"},
+		{"status": float64(204), "path": "/metrics"},
+		{"status": "not a number", "path": "/api/"},
+		{"path": nil},
+		{},
+	}
+	for _, data := range lines {
+		v := fields.View(data)
+		for i, m := range matchers {
+			if got, want := m.MatchView(v), m.Match(data); got != want {
+				t.Errorf("matcher %d: MatchView(%v) = %v, Match() = %v", i, data, got, want)
+			}
+		}
+		fields.Release(v)
+	}
+}
+
+func BenchmarkMatchers(b *testing.B) {
+	matches := sharedMatches()
+	data := map[string]interface{}{"status": float64(503), "path": "/api/users", "method": "GET"}
+
+	b.Run("match", func(b *testing.B) {
+		var matchers []*Matcher
+		for i := range matches {
+			m, _ := New(&matches[i])
+			matchers = append(matchers, m)
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, m := range matchers {
+				m.Match(data)
+			}
+		}
+	})
+
+	b.Run("view", func(b *testing.B) {
+		fields := NewFields()
+		var matchers []*Matcher
+		for i := range matches {
+			m, _ := fields.New(&matches[i])
+			matchers = append(matchers, m)
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			v := fields.View(data)
+			for _, m := range matchers {
+				m.MatchView(v)
+			}
+			fields.Release(v)
+		}
+	})
+}
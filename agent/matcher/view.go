@@ -0,0 +1,148 @@
+// SPDX-License-Identifier: MIT
+
+package matcher
+
+import (
+	"sync"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/parser"
+)
+
+// Fields numbers the fields and conditions read by a set of matchers, such
+// as those of a source, so that a View looks up and converts each field,
+// and evaluates each condition, once per line however many matchers share
+// it. Identical conditions on a field are compiled once.
+//
+// Fields must not be extended while views are in use.
+type Fields struct {
+	slots map[string]int      // value slots, by field name
+	conds map[string]*Matcher // single-field conditions, by description
+	pool  sync.Pool
+}
+
+// NewFields creates an empty set of fields.
+func NewFields() *Fields {
+	return &Fields{slots: make(map[string]int), conds: make(map[string]*Matcher)}
+}
+
+// New creates a matcher sharing the fields and conditions of f. It only
+// uses views of f. If match is nil, creates a matcher that always matches.
+func (f *Fields) New(match *config.Match) (*Matcher, error) {
+	if match == nil {
+		return &Matcher{always: true, desc: "always"}, nil
+	}
+	if match.IsComposite() {
+		return f.newComposite(match)
+	}
+
+	desc := describe(match)
+	if m, ok := f.conds[desc]; ok {
+		return m, nil
+	}
+	m, err := newCondition(match)
+	if err != nil {
+		return nil, err
+	}
+	m.desc = desc
+	m.result = len(f.conds)
+	if slot, ok := f.slots[m.field]; ok {
+		m.slot = slot
+	} else {
+		m.slot = len(f.slots)
+		f.slots[m.field] = m.slot
+	}
+	f.conds[desc] = m
+	return m, nil
+}
+
+// View returns a view of the fields of a line, to be given back with
+// Release once the line is matched. A view is not safe for concurrent
+// use.
+func (f *Fields) View(data map[string]interface{}) *View {
+	v, _ := f.pool.Get().(*View)
+	if v == nil {
+		v = &View{}
+	}
+	v.data = data
+	v.values = resize(v.values, len(f.slots))
+	v.results = resize(v.results, len(f.conds))
+	return v
+}
+
+// Release gives a view back for reuse.
+func (f *Fields) Release(v *View) {
+	v.data = nil
+	clear(v.values) // drop references to the line
+	f.pool.Put(v)
+}
+
+// resize returns s cleared, with length n.
+func resize[T any](s []T, n int) []T {
+	if cap(s) < n {
+		return make([]T, n)
+	}
+	s = s[:n]
+	clear(s)
+	return s
+}
+
+// View caches the field values and the outcome of the conditions of the
+// matchers of a Fields on one line.
+type View struct {
+	data    map[string]interface{}
+	values  []value
+	results []int8 // 0 when not evaluated yet, 1 matched, -1 did not
+}
+
+// value is a field of the line, converted on first use.
+type value struct {
+	looked, present bool
+	raw             interface{}
+
+	strDone, strOK bool
+	str            string
+
+	numDone, numOK bool
+	num            float64
+}
+
+// get returns the value of a field, looking it up on first use.
+func (v *View) get(slot int, field string) *value {
+	val := &v.values[slot]
+	if !val.looked {
+		val.raw, val.present = parser.GetField(v.data, field)
+		val.looked = true
+	}
+	return val
+}
+
+// raw returns the value of a field, as parser.GetField.
+func (v *View) raw(slot int, field string) (interface{}, bool) {
+	val := v.get(slot, field)
+	return val.raw, val.present
+}
+
+// string returns a field as a string, as parser.GetFieldString.
+func (v *View) string(slot int, field string) (string, bool) {
+	val := v.get(slot, field)
+	if !val.strDone {
+		if val.present {
+			val.str, val.strOK = parser.StringValue(val.raw)
+		}
+		val.strDone = true
+	}
+	return val.str, val.strOK
+}
+
+// float returns a field as a number, as parser.GetFieldFloat.
+func (v *View) float(slot int, field string) (float64, bool) {
+	val := v.get(slot, field)
+	if !val.numDone {
+		if val.present {
+			val.num, val.numOK = parser.FloatValue(val.raw)
+		}
+		val.numDone = true
+	}
+	return val.num, val.numOK
+}
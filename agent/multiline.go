@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+// multilineJoiner assembles the lines of a source into records, such as a
+// log line followed by its stack trace. Each file is a separate stream,
+// so interleaved files do not mix their records.
+type multilineJoiner struct {
+	start    *regexp.Regexp
+	maxLines int
+	timeout  time.Duration
+	emit     func(record string, lc lineContext)
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	streams map[string]*multilineStream // keyed by path
+}
+
+// multilineStream is the record being assembled from a stream.
+type multilineStream struct {
+	lines    []string
+	lc       lineContext // of the first line
+	dropping bool        // max_lines reached, continuation lines are dropped
+	deadline time.Time   // when the record is complete without a new line
+	timer    *time.Timer
+}
+
+// newMultilineJoiner returns a joiner handing complete records to emit,
+// or nil when cfg is nil. The start pattern was validated with the config.
+func newMultilineJoiner(cfg *config.MultilineConfig, emit func(string, lineContext), logger *slog.Logger) *multilineJoiner {
+	if cfg == nil {
+		return nil
+	}
+	return &multilineJoiner{
+		start:    regexp.MustCompile(cfg.StartPattern),
+		maxLines: cfg.MaxLines,
+		timeout:  cfg.Timeout,
+		emit:     emit,
+		logger:   logger,
+		streams:  make(map[string]*multilineStream),
+	}
+}
+
+// add appends a line to the record of its stream. A line matching the
+// start pattern completes the previous record and starts a new one; so
+// does any line when no record is being assembled.
+func (j *multilineJoiner) add(line string, lc lineContext) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	s := j.streams[lc.path]
+	if s == nil {
+		s = &multilineStream{}
+		j.streams[lc.path] = s
+	}
+	s.deadline = time.Now().Add(j.timeout)
+	if s.timer == nil {
+		path := lc.path
+		s.timer = time.AfterFunc(j.timeout, func() { j.expire(path, s) })
+	} else {
+		s.timer.Reset(j.timeout)
+	}
+
+	if j.start.MatchString(line) {
+		j.flushLocked(s)
+		s.dropping = false
+	} else if s.dropping {
+		return
+	}
+
+	if len(s.lines) == 0 {
+		s.lc = lc
+	}
+	s.lines = append(s.lines, line)
+
+	if len(s.lines) >= j.maxLines {
+		j.flushLocked(s)
+		s.dropping = true
+		j.logger.Debug("multiline record reached max_lines, dropping its remaining lines",
+			"path", lc.path, "max_lines", j.maxLines)
+	}
+}
+
+// expire completes the record of a stream that received no line for the
+// timeout, and forgets the stream.
+func (j *multilineJoiner) expire(path string, s *multilineStream) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.streams[path] != s || time.Now().Before(s.deadline) {
+		return // forgotten, or reset by a line added since
+	}
+	j.flushLocked(s)
+	delete(j.streams, path)
+}
+
+// flush completes the records of every stream.
+func (j *multilineJoiner) flush() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for path, s := range j.streams {
+		s.timer.Stop()
+		j.flushLocked(s)
+		delete(j.streams, path)
+	}
+}
+
+// flushLocked hands the record of s, if any, to emit.
+// Must be called with j.mu held.
+func (j *multilineJoiner) flushLocked(s *multilineStream) {
+	if len(s.lines) == 0 {
+		return
+	}
+	record := strings.Join(s.lines, "\n")
+	lc := s.lc
+	s.lines = s.lines[:0]
+	j.emit(record, lc)
+}
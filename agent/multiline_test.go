@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"io"
+	"log/slog"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestMultilineJoiner(t *testing.T) {
+	type record struct {
+		text string
+		line int64
+	}
+	var mu sync.Mutex
+	var got []record
+	j := newMultilineJoiner(&config.MultilineConfig{
+		StartPattern: `^\d{4}-`,
+		MaxLines:     3,
+		Timeout:      50 * time.Millisecond,
+	}, func(text string, lc lineContext) {
+		mu.Lock()
+		got = append(got, record{text, lc.line})
+		mu.Unlock()
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	lines := []string{
+		"\tat orphan.continuation", // before any start line: a record of its own
+		"2024-01-15 ERROR boom",
+		"java.lang.IllegalStateException: boom",
+		"\tat com.example.Main.run(Main.java:42)",
+		"\tat com.example.Main.main(Main.java:7)", // beyond max_lines: dropped
+		"2024-01-15 INFO ok",
+	}
+	for i, line := range lines {
+		j.add(line, lineContext{path: "a.log", line: int64(i + 1)})
+	}
+	// Another file does not interleave with a.log
+	j.add("2024-01-15 WARN other", lineContext{path: "b.log", line: 1})
+
+	mu.Lock()
+	want := []record{
+		{"\tat orphan.continuation", 1},
+		{"2024-01-15 ERROR boom\njava.lang.IllegalStateException: boom\n\tat com.example.Main.run(Main.java:42)", 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+	mu.Unlock()
+
+	// The last records complete after the timeout
+	time.Sleep(200 * time.Millisecond)
+	mu.Lock()
+	if len(got) != 4 {
+		t.Errorf("got %d records after the timeout, want 4: %q", len(got), got)
+	}
+	mu.Unlock()
+
+	j.add("2024-01-15 INFO pending", lineContext{path: "a.log", line: 7})
+	j.flush()
+	mu.Lock()
+	defer mu.Unlock()
+	if n := len(got); n != 5 || got[n-1].text != "2024-01-15 INFO pending" {
+		t.Errorf("flush did not complete the pending record: %q", got)
+	}
+}
+
+func TestAgent_Multiline(t *testing.T) {
+	cfg := &config.Config{
+		AppName: "test-app",
+		Sources: []config.Source{
+			{
+				Path:    "/var/log/app.log",
+				Format:  "regex",
+				Pattern: `(?s)^\S+ (?P<level>[A-Z]+) (?P<message>.*)$`,
+				Multiline: &config.MultilineConfig{
+					StartPattern: `^\d{4}-`,
+					MaxLines:     config.DefaultMultilineMaxLines,
+					Timeout:      time.Minute,
+				},
+				Metrics: []config.Metric{
+					{Name: "errors", Type: "counter", Match: &config.Match{Field: "level", Equals: "ERROR"}},
+					{Name: "npe", Type: "counter", Match: &config.Match{Field: "message", Contains: "NullPointerException"}},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	for _, line := range []string{
+		"2024-01-15T10:00:00Z ERROR request failed",
+		"java.lang.NullPointerException",
+		"\tat com.example.Handler.handle(Handler.java:12)",
+		"2024-01-15T10:00:01Z ERROR request failed",
+		"java.io.IOException: broken pipe",
+	} {
+		ag.ProcessLine(0, line)
+	}
+	ag.Flush()
+
+	got := ag.Metrics()
+	if got["errors"] != float64(2) || got["npe"] != float64(1) {
+		t.Errorf("errors = %v, npe = %v; want 2 and 1", got["errors"], got["npe"])
+	}
+	if s := ag.Stats().Sources[0]; s.ParseErrors != 0 {
+		t.Errorf("parse errors = %d, want continuation lines joined", s.ParseErrors)
+	}
+}
@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"os"
+
+	"github.com/kolapsis/shm-agent/agent/tailer"
+)
+
+// parkedFile is a file whose tailer was closed to stay within
+// max_open_files. Reading resumes from offset once the file grows.
+type parkedFile struct {
+	info   os.FileInfo
+	offset int64
+}
+
+// resumeOffset returns where to resume reading a parked file, and false
+// while it has not been written to. A file that was replaced or truncated
+// since is read from the beginning.
+func (p parkedFile) resumeOffset(path string) (int64, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+	if !os.SameFile(info, p.info) || info.Size() < p.offset {
+		return 0, true
+	}
+	return p.offset, info.Size() > p.offset
+}
+
+// makeRoom closes the least recently active tailers until one more file
+// can be opened within max_open_files.
+// Must be called with tailersMu held.
+func (a *Agent) makeRoom() {
+	limit := a.Config().MaxOpenFiles
+	if limit <= 0 {
+		return
+	}
+
+	for len(a.tailers) >= limit {
+		var lru tailerKey
+		var oldest *tailer.Tailer
+		for key, t := range a.tailers {
+			if oldest == nil || t.LastActive().Before(oldest.LastActive()) {
+				lru, oldest = key, t
+			}
+		}
+		a.park(lru, oldest)
+	}
+}
+
+// park stops the tailer of key and remembers where it stopped.
+// Must be called with tailersMu held.
+func (a *Agent) park(key tailerKey, t *tailer.Tailer) {
+	info, statErr := os.Stat(key.path)
+	if err := t.Stop(); err != nil {
+		a.logger.Error("error stopping tailer", "path", key.path, "error", err)
+	}
+	delete(a.tailers, key)
+
+	if statErr != nil {
+		return // the file is gone, there is nothing to resume
+	}
+	if a.parked == nil {
+		a.parked = make(map[tailerKey]parkedFile)
+	}
+	a.parked[key] = parkedFile{info: info, offset: t.Offset()}
+	a.logger.Debug("closed idle file to stay within max_open_files", "path", key.path, "offset", t.Offset())
+}
+
+// unpark reopens a parked file if it was written to since it was parked.
+// Must be called with tailersMu held.
+func (a *Agent) unpark(ctx context.Context, key tailerKey, newTailer func() *tailer.Tailer) {
+	offset, ok := a.parked[key].resumeOffset(key.path)
+	if !ok {
+		return
+	}
+
+	a.makeRoom()
+	t := newTailer()
+	if err := t.StartAt(ctx, offset); err != nil {
+		a.logger.Error("failed to reopen file", "path", key.path, "error", err)
+		return
+	}
+	delete(a.parked, key)
+	a.tailers[key] = t
+}
+
+// forgetParked drops the parked files of a source that no longer match it.
+// Must be called with tailersMu held.
+func (a *Agent) forgetParked(source string, current map[string]bool) {
+	for key := range a.parked {
+		if key.source == source && !current[key.path] {
+			delete(a.parked, key)
+		}
+	}
+}
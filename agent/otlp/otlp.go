@@ -0,0 +1,300 @@
+// SPDX-License-Identifier: MIT
+
+// Package otlp exports snapshots as OpenTelemetry metrics over OTLP/HTTP,
+// using the JSON encoding of the protocol.
+//
+// The aggregator resets counters, sums and sets at every snapshot, so
+// counters and sums are exported as sums with delta temporality over the
+// snapshot interval: monotonic for counters, non-monotonic for sums, whose
+// values may be negative. Gauges and sets are exported as gauges, and
+// percentiles as summaries holding their count, sum and quantiles.
+// Metrics of unknown type, such as derived metrics, are exported as gauges.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+// MetricsPath is the path of the OTLP/HTTP metrics endpoint, added to
+// endpoints without a path.
+const MetricsPath = "/v1/metrics"
+
+// scopeName is the instrumentation scope of the exported metrics.
+const scopeName = "shm-agent"
+
+// Aggregation temporalities of sums.
+const temporalityDelta = 1
+
+// maxErrorBody caps the response body quoted in errors.
+const maxErrorBody = 512
+
+// TypeFunc looks up the type of a metric, which selects its OTLP data point
+// kind.
+type TypeFunc func(name string) (aggregator.MetricType, bool)
+
+// Config configures an Exporter.
+type Config struct {
+	Endpoint string            // e.g. http://collector:4318 or a full metrics URL
+	Headers  map[string]string // added to every request, e.g. for authentication
+	Client   *http.Client      // defaults to http.DefaultClient
+
+	// Types maps counters and sums to delta Sum points, percentiles to
+	// Summary points and anything else, unknown metrics included, to Gauge
+	// points.
+	Types TypeFunc
+
+	// Resource lists the attributes of the resource the metrics describe,
+	// such as service.name.
+	Resource map[string]string
+
+	// Version is the version of the agent, reported as the version of the
+	// instrumentation scope.
+	Version string
+}
+
+// Exporter sends snapshots to an OTLP/HTTP endpoint.
+type Exporter struct {
+	url      string
+	headers  map[string]string
+	client   *http.Client
+	types    TypeFunc
+	resource []keyValue
+	version  string
+
+	lastDelivery atomic.Int64 // unix nanoseconds of the last successful export
+}
+
+// New creates an Exporter.
+func New(cfg Config) *Exporter {
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Exporter{
+		url:      MetricsURL(cfg.Endpoint),
+		headers:  cfg.Headers,
+		client:   client,
+		types:    cfg.Types,
+		resource: attributes(cfg.Resource),
+		version:  cfg.Version,
+	}
+}
+
+// MetricsURL returns the metrics URL of an endpoint: the endpoint itself
+// when it has a path, otherwise the endpoint followed by MetricsPath.
+func MetricsURL(endpoint string) string {
+	endpoint = strings.TrimRight(endpoint, "/")
+	if i := strings.Index(endpoint, "://"); i >= 0 && strings.Contains(endpoint[i+3:], "/") {
+		return endpoint
+	}
+	return endpoint + MetricsPath
+}
+
+// Name returns "otlp".
+func (e *Exporter) Name() string {
+	return "otlp"
+}
+
+// Send exports the metrics of a snapshot. It makes a single attempt: a
+// failed export is reported but not retried.
+func (e *Exporter) Send(ctx context.Context, snap sender.Snapshot) error {
+	body, err := json.Marshal(e.request(snap))
+	if err != nil {
+		return fmt.Errorf("marshaling export request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating export request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending export request: %w", err)
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return &sender.StatusError{Op: "export", StatusCode: resp.StatusCode, Body: string(data)}
+	}
+	e.lastDelivery.Store(time.Now().UnixNano())
+	return nil
+}
+
+// LastDelivery returns when a snapshot was last exported, or the zero time.
+func (e *Exporter) LastDelivery() time.Time {
+	if ns := e.lastDelivery.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// Close closes the idle connections to the endpoint.
+func (e *Exporter) Close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// request builds the export request of a snapshot, with its metrics in
+// name order.
+func (e *Exporter) request(snap sender.Snapshot) exportRequest {
+	end := snap.End
+	if end.IsZero() {
+		end = time.Now()
+	}
+	start := snap.Start
+	if start.IsZero() {
+		start = end
+	}
+	p := points{start: nanos(start), end: nanos(end)}
+
+	names := make([]string, 0, len(snap.Metrics))
+	for name := range snap.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := make([]metric, 0, len(names))
+	for _, name := range names {
+		var typ aggregator.MetricType
+		if e.types != nil {
+			typ, _ = e.types(name)
+		}
+		if m, ok := p.metric(name, typ, snap.Metrics[name]); ok {
+			metrics = append(metrics, m)
+		}
+	}
+
+	return exportRequest{ResourceMetrics: []resourceMetrics{{
+		Resource: resource{Attributes: e.resource},
+		ScopeMetrics: []scopeMetrics{{
+			Scope:   scope{Name: scopeName, Version: e.version},
+			Metrics: metrics,
+		}},
+	}}}
+}
+
+// points converts snapshot values to the data points of an interval.
+type points struct {
+	start, end string
+}
+
+// metric converts the value of a metric. It reports false when the metric
+// has no data point.
+func (p points) metric(name string, typ aggregator.MetricType, value interface{}) (metric, bool) {
+	series := aggregator.SeriesOf(value)
+	if len(series) == 0 {
+		return metric{}, false
+	}
+	m := metric{Name: name}
+
+	if typ == aggregator.Percentile {
+		dps := make([]summaryPoint, 0, len(series))
+		for _, s := range series {
+			d, ok := s.Value.(aggregator.Distribution)
+			if !ok {
+				continue
+			}
+			dps = append(dps, p.summaryPoint(s.Labels, d))
+		}
+		if len(dps) == 0 {
+			return metric{}, false
+		}
+		m.Summary = &summary{DataPoints: dps}
+		return m, true
+	}
+
+	dps := make([]numberPoint, 0, len(series))
+	for _, s := range series {
+		v, ok := aggregator.Float(s.Value)
+		if !ok {
+			continue
+		}
+		dps = append(dps, numberPoint{
+			Attributes:        attributes(s.Labels),
+			StartTimeUnixNano: p.start,
+			TimeUnixNano:      p.end,
+			AsDouble:          v,
+		})
+	}
+	if len(dps) == 0 {
+		return metric{}, false
+	}
+
+	switch typ {
+	case aggregator.Counter, aggregator.Sum, aggregator.CounterBy:
+		m.Sum = &sum{
+			DataPoints:             dps,
+			AggregationTemporality: temporalityDelta,
+			IsMonotonic:            typ != aggregator.Sum,
+		}
+	default:
+		for i := range dps {
+			dps[i].StartTimeUnixNano = ""
+		}
+		m.Gauge = &gauge{DataPoints: dps}
+	}
+	return m, true
+}
+
+// summaryPoint converts the distribution of a percentile series.
+func (p points) summaryPoint(labels map[string]string, d aggregator.Distribution) summaryPoint {
+	dp := summaryPoint{
+		Attributes:        attributes(labels),
+		StartTimeUnixNano: p.start,
+		TimeUnixNano:      p.end,
+		Count:             strconv.FormatUint(uint64(d["count"]), 10),
+		Sum:               d["sum"],
+	}
+	for name, v := range d {
+		q, err := strconv.ParseFloat(strings.TrimPrefix(name, "p"), 64)
+		if !strings.HasPrefix(name, "p") || err != nil {
+			continue
+		}
+		dp.QuantileValues = append(dp.QuantileValues, quantileValue{Quantile: q / 100, Value: v})
+	}
+	sort.Slice(dp.QuantileValues, func(i, j int) bool {
+		return dp.QuantileValues[i].Quantile < dp.QuantileValues[j].Quantile
+	})
+	return dp
+}
+
+// attributes converts labels to attributes, in name order.
+func attributes(labels map[string]string) []keyValue {
+	if len(labels) == 0 {
+		return nil
+	}
+	attrs := make([]keyValue, 0, len(labels))
+	for k, v := range labels {
+		attrs = append(attrs, keyValue{Key: k, Value: anyValue{StringValue: v}})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	return attrs
+}
+
+// nanos formats a time as nanoseconds since the epoch. The JSON encoding
+// of OTLP carries 64-bit integers as strings.
+func nanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: MIT
+
+package otlp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+func TestMetricsURL(t *testing.T) {
+	tests := map[string]string{
+		"http://collector:4318":               "http://collector:4318/v1/metrics",
+		"http://collector:4318/":              "http://collector:4318/v1/metrics",
+		"https://otel.example.com/v1/metrics": "https://otel.example.com/v1/metrics",
+		"https://otel.example.com/custom":     "https://otel.example.com/custom",
+	}
+	for endpoint, want := range tests {
+		if got := MetricsURL(endpoint); got != want {
+			t.Errorf("MetricsURL(%q) = %q, want %q", endpoint, got, want)
+		}
+	}
+}
+
+func TestExporter_Send(t *testing.T) {
+	var got exportRequest
+	var header http.Header
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header, path = r.Header, r.URL.Path
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	types := map[string]aggregator.MetricType{
+		"requests": aggregator.Counter,
+		"bytes":    aggregator.Sum,
+		"sessions": aggregator.Gauge,
+		"users":    aggregator.Set,
+		"latency":  aggregator.Percentile,
+	}
+	e := New(Config{
+		Endpoint: srv.URL,
+		Headers:  map[string]string{"Authorization": "Bearer secret"},
+		Types: func(name string) (aggregator.MetricType, bool) {
+			typ, ok := types[name]
+			return typ, ok
+		},
+		Resource: map[string]string{"service.name": "shop"},
+		Version:  "1.2.3",
+	})
+
+	start := time.Unix(100, 0)
+	end := time.Unix(160, 0)
+	err := e.Send(context.Background(), sender.Snapshot{
+		Metrics: map[string]interface{}{
+			"requests": []aggregator.Series{
+				{Labels: map[string]string{"method": "GET"}, Value: float64(3)},
+				{Labels: map[string]string{"method": "POST"}, Value: float64(1)},
+			},
+			"bytes":    float64(-20),
+			"sessions": float64(7),
+			"users":    2,
+			"latency":  aggregator.Distribution{"count": 4, "sum": 10, "p50": 2, "p99": 4},
+			"ratio":    0.5,
+		},
+		Start: start,
+		End:   end,
+	})
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	if path != MetricsPath {
+		t.Errorf("path = %q, want %q", path, MetricsPath)
+	}
+	if h := header.Get("Authorization"); h != "Bearer secret" {
+		t.Errorf("Authorization = %q, want the configured header", h)
+	}
+	if len(got.ResourceMetrics) != 1 || len(got.ResourceMetrics[0].ScopeMetrics) != 1 {
+		t.Fatalf("request = %+v, want one resource and one scope", got)
+	}
+	rm := got.ResourceMetrics[0]
+	if attrs := rm.Resource.Attributes; len(attrs) != 1 || attrs[0].Key != "service.name" || attrs[0].Value.StringValue != "shop" {
+		t.Errorf("resource attributes = %+v", attrs)
+	}
+	if s := rm.ScopeMetrics[0].Scope; s.Name != scopeName || s.Version != "1.2.3" {
+		t.Errorf("scope = %+v", s)
+	}
+
+	metrics := make(map[string]metric)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+	if len(metrics) != 6 {
+		t.Fatalf("got %d metrics, want 6", len(metrics))
+	}
+
+	requests := metrics["requests"].Sum
+	if requests == nil || !requests.IsMonotonic || requests.AggregationTemporality != temporalityDelta {
+		t.Fatalf("requests = %+v, want a monotonic delta sum", metrics["requests"])
+	}
+	if len(requests.DataPoints) != 2 {
+		t.Fatalf("requests has %d data points, want 2", len(requests.DataPoints))
+	}
+	for _, dp := range requests.DataPoints {
+		if dp.StartTimeUnixNano != "100000000000" || dp.TimeUnixNano != "160000000000" {
+			t.Errorf("data point interval = %s..%s, want the snapshot interval", dp.StartTimeUnixNano, dp.TimeUnixNano)
+		}
+		if len(dp.Attributes) != 1 || dp.Attributes[0].Key != "method" {
+			t.Errorf("data point attributes = %+v, want the method label", dp.Attributes)
+		}
+	}
+
+	if b := metrics["bytes"].Sum; b == nil || b.IsMonotonic || b.DataPoints[0].AsDouble != -20 {
+		t.Errorf("bytes = %+v, want a non-monotonic sum of -20", metrics["bytes"])
+	}
+	for name, want := range map[string]float64{"sessions": 7, "users": 2, "ratio": 0.5} {
+		g := metrics[name].Gauge
+		if g == nil || g.DataPoints[0].AsDouble != want {
+			t.Errorf("%s = %+v, want a gauge of %v", name, metrics[name], want)
+		}
+	}
+
+	s := metrics["latency"].Summary
+	if s == nil || len(s.DataPoints) != 1 {
+		t.Fatalf("latency = %+v, want a summary", metrics["latency"])
+	}
+	dp := s.DataPoints[0]
+	if dp.Count != "4" || dp.Sum != 10 {
+		t.Errorf("latency count, sum = %s, %v, want 4, 10", dp.Count, dp.Sum)
+	}
+	if len(dp.QuantileValues) != 2 || dp.QuantileValues[0] != (quantileValue{0.5, 2}) || dp.QuantileValues[1] != (quantileValue{0.99, 4}) {
+		t.Errorf("latency quantiles = %+v", dp.QuantileValues)
+	}
+}
+
+func TestExporter_SendError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad payload", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	e := New(Config{Endpoint: srv.URL})
+	err := e.Send(context.Background(), sender.Snapshot{Metrics: map[string]interface{}{"x": 1.0}})
+	var se *sender.StatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Send() error = %v, want a status error", err)
+	}
+}
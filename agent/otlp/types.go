@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: MIT
+
+package otlp
+
+// The messages of an export request, in the JSON encoding of OTLP.
+
+type exportRequest struct {
+	ResourceMetrics []resourceMetrics `json:"resourceMetrics"`
+}
+
+type resourceMetrics struct {
+	Resource     resource       `json:"resource"`
+	ScopeMetrics []scopeMetrics `json:"scopeMetrics"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes,omitempty"`
+}
+
+type scopeMetrics struct {
+	Scope   scope    `json:"scope"`
+	Metrics []metric `json:"metrics"`
+}
+
+type scope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+// metric holds exactly one of Sum, Gauge or Summary.
+type metric struct {
+	Name    string   `json:"name"`
+	Sum     *sum     `json:"sum,omitempty"`
+	Gauge   *gauge   `json:"gauge,omitempty"`
+	Summary *summary `json:"summary,omitempty"`
+}
+
+type sum struct {
+	DataPoints             []numberPoint `json:"dataPoints"`
+	AggregationTemporality int           `json:"aggregationTemporality"`
+	IsMonotonic            bool          `json:"isMonotonic"`
+}
+
+type gauge struct {
+	DataPoints []numberPoint `json:"dataPoints"`
+}
+
+type summary struct {
+	DataPoints []summaryPoint `json:"dataPoints"`
+}
+
+type numberPoint struct {
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string     `json:"timeUnixNano"`
+	AsDouble          float64    `json:"asDouble"`
+}
+
+type summaryPoint struct {
+	Attributes        []keyValue      `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	Count             string          `json:"count"`
+	Sum               float64         `json:"sum"`
+	QuantileValues    []quantileValue `json:"quantileValues,omitempty"`
+}
+
+type quantileValue struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue string `json:"stringValue"`
+}
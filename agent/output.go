@@ -0,0 +1,31 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+)
+
+// Output receives the metrics of every snapshot.
+// Implementations must be safe to call from the agent's snapshot loop.
+type Output interface {
+	// Name identifies the output in logs and errors.
+	Name() string
+
+	// Send delivers a snapshot. metrics maps metric names to their values
+	// for the elapsed interval.
+	Send(ctx context.Context, metrics map[string]interface{}) error
+}
+
+// OutputFunc adapts a function to the Output interface.
+type OutputFunc func(ctx context.Context, metrics map[string]interface{}) error
+
+// Name returns "func".
+func (f OutputFunc) Name() string {
+	return "func"
+}
+
+// Send calls f.
+func (f OutputFunc) Send(ctx context.Context, metrics map[string]interface{}) error {
+	return f(ctx, metrics)
+}
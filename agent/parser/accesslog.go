@@ -0,0 +1,108 @@
+// SPDX-License-Identifier: MIT
+
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// accessLogPreset is a web server log format, as a grok pattern.
+type accessLogPreset struct {
+	pattern    string
+	timeLayout string
+	timeLocal  bool // the time has no zone and is in local time
+}
+
+// accessLogPatterns are the grok patterns shared by the access log presets.
+var accessLogPatterns = map[string]string{
+	"QSVALUE":      `(?:[^"\\]|\\.)*`,
+	"HTTPREQUEST":  `(?:%{WORD:method} %{NOTSPACE:path}(?: HTTP/%{NUMBER:http_version})?|%{DATA:request})`,
+	"HAPROXYDATE":  `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{HOUR}:%{MINUTE}:%{SECOND}`,
+	"COMMONLOG":    `^%{IPORHOST:remote_addr} %{HTTPDUSER:ident} %{HTTPDUSER:remote_user} \[%{HTTPDATE:time}\] "%{HTTPREQUEST}" %{INT:status:int} (?:%{INT:bytes:int}|-)`,
+	"COMBINEDLOG":  `%{COMMONLOG} "%{QSVALUE:referer}" "%{QSVALUE:user_agent}"`,
+	"HAPROXYHTTP":  `%{IP:client_ip}:%{INT:client_port:int} \[%{HAPROXYDATE:time}\] %{NOTSPACE:frontend} %{NOTSPACE:backend}/%{NOTSPACE:server} %{INT:time_request:int}/%{INT:time_queue:int}/%{INT:time_connect:int}/%{INT:time_response:int}/%{INT:time_total:int} %{INT:status:int} %{INT:bytes:int} %{NOTSPACE:request_cookie} %{NOTSPACE:response_cookie} %{NOTSPACE:termination_state} %{INT:actconn:int}/%{INT:feconn:int}/%{INT:beconn:int}/%{INT:srvconn:int}/%{INT:retries:int} %{INT:srv_queue:int}/%{INT:backend_queue:int} (?:\{[^}]*\} )*"%{HTTPREQUEST}"`,
+	"NGINXDEFAULT": `%{COMBINEDLOG}(?: "%{QSVALUE:forwarded_for}")?`,
+}
+
+// accessLogPresets are the formats of format: access_log, by preset name.
+var accessLogPresets = map[string]accessLogPreset{
+	// Apache and nginx common log format
+	"common": {pattern: `%{COMMONLOG}$`, timeLayout: "02/Jan/2006:15:04:05 -0700"},
+	// Apache and nginx combined log format, with referer and user agent
+	"combined": {pattern: `%{COMBINEDLOG}$`, timeLayout: "02/Jan/2006:15:04:05 -0700"},
+	// nginx's stock "main" format: combined, then X-Forwarded-For
+	"nginx_default": {pattern: `%{NGINXDEFAULT}$`, timeLayout: "02/Jan/2006:15:04:05 -0700"},
+	// HAProxy's "option httplog", after any syslog header
+	"haproxy_http": {pattern: `%{HAPROXYHTTP}`, timeLayout: "02/Jan/2006:15:04:05", timeLocal: true},
+}
+
+// AccessLogPresetNames returns the names of the access log presets.
+func AccessLogPresetNames() []string {
+	names := make([]string, 0, len(accessLogPresets))
+	for name := range accessLogPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AccessLogPattern returns the regular expression of an access log preset.
+func AccessLogPattern(preset string) (string, error) {
+	p, ok := accessLogPresets[preset]
+	if !ok {
+		return "", unknownAccessLogPreset(preset)
+	}
+	return ExpandGrok(p.pattern, accessLogPatterns)
+}
+
+// AccessLogParser parses web server access logs in a preset format. The
+// status, the size and HAProxy's timers and counters are integers, and
+// the request time is also parsed into timestamp, in Unix seconds.
+type AccessLogParser struct {
+	*GrokParser
+	preset accessLogPreset
+}
+
+// NewAccessLogParser creates a parser for an access log preset: common,
+// combined, nginx_default or haproxy_http.
+func NewAccessLogParser(preset string) (*AccessLogParser, error) {
+	p, ok := accessLogPresets[preset]
+	if !ok {
+		return nil, unknownAccessLogPreset(preset)
+	}
+	grok, err := NewGrokParser(p.pattern, accessLogPatterns)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLogParser{GrokParser: grok, preset: p}, nil
+}
+
+// Parse parses an access log line. Returns nil if the line does not match
+// the preset format.
+func (p *AccessLogParser) Parse(line string) map[string]interface{} {
+	result := p.GrokParser.Parse(line)
+	if result == nil {
+		return nil
+	}
+	if s, ok := result["time"].(string); ok {
+		var t time.Time
+		var err error
+		if p.preset.timeLocal {
+			t, err = time.ParseInLocation(p.preset.timeLayout, s, time.Local)
+		} else {
+			t, err = time.Parse(p.preset.timeLayout, s)
+		}
+		if err == nil {
+			result["timestamp"] = float64(t.UnixNano()) / 1e9
+		}
+	}
+	return result
+}
+
+// unknownAccessLogPreset returns the error for an unknown preset.
+func unknownAccessLogPreset(preset string) error {
+	return fmt.Errorf("unknown access_log preset %q (available: %s)", preset, strings.Join(AccessLogPresetNames(), ", "))
+}
@@ -0,0 +1,130 @@
+// SPDX-License-Identifier: MIT
+
+package parser
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestAccessLogParser_Parse(t *testing.T) {
+	local := time.Date(2024, 1, 15, 10, 30, 0, 123e6, time.Local)
+
+	tests := []struct {
+		preset string
+		line   string
+		want   map[string]interface{}
+	}{
+		{
+			preset: "common",
+			line:   `192.168.1.1 - frank [15/Jan/2024:10:30:00 +0100] "GET /index.html HTTP/1.1" 200 -`,
+			want: map[string]interface{}{
+				"remote_addr":  "192.168.1.1",
+				"remote_user":  "frank",
+				"time":         "15/Jan/2024:10:30:00 +0100",
+				"timestamp":    float64(1705311000),
+				"method":       "GET",
+				"path":         "/index.html",
+				"http_version": "1.1",
+				"status":       int64(200),
+			},
+		},
+		{
+			preset: "combined",
+			line:   `2001:db8::1 - - [15/Jan/2024:10:30:00 +0000] "POST /api/orders HTTP/2.0" 502 157 "https://shop.example.com/cart" "Mozilla/5.0 (X11; \"quoted\")"`,
+			want: map[string]interface{}{
+				"remote_addr": "2001:db8::1",
+				"method":      "POST",
+				"path":        "/api/orders",
+				"status":      int64(502),
+				"bytes":       int64(157),
+				"referer":     "https://shop.example.com/cart",
+				"user_agent":  `Mozilla/5.0 (X11; \"quoted\")`,
+			},
+		},
+		{
+			preset: "combined",
+			line:   `10.0.0.1 - - [15/Jan/2024:10:30:00 +0000] "\x16\x03\x01" 400 0 "-" "-"`,
+			want: map[string]interface{}{
+				"request": `\x16\x03\x01`,
+				"status":  int64(400),
+				"bytes":   int64(0),
+			},
+		},
+		{
+			preset: "nginx_default",
+			line:   `10.0.0.1 - - [15/Jan/2024:10:30:00 +0000] "GET / HTTP/1.1" 304 0 "-" "curl/8.0" "203.0.113.7"`,
+			want: map[string]interface{}{
+				"status":        int64(304),
+				"user_agent":    "curl/8.0",
+				"forwarded_for": "203.0.113.7",
+			},
+		},
+		{
+			preset: "haproxy_http",
+			line:   `Jan 15 10:30:00 lb1 haproxy[1234]: 10.0.1.2:33317 [15/Jan/2024:10:30:00.123] http-in static/srv1 10/0/30/69/109 200 2750 - - ---- 1/1/1/1/0 0/0 {1wt.eu} {} "GET /index.html HTTP/1.1"`,
+			want: map[string]interface{}{
+				"client_ip":         "10.0.1.2",
+				"client_port":       int64(33317),
+				"timestamp":         float64(local.UnixNano()) / 1e9,
+				"frontend":          "http-in",
+				"backend":           "static",
+				"server":            "srv1",
+				"time_total":        int64(109),
+				"status":            int64(200),
+				"bytes":             int64(2750),
+				"termination_state": "----",
+				"retries":           int64(0),
+				"method":            "GET",
+				"path":              "/index.html",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		p, err := NewAccessLogParser(tt.preset)
+		if err != nil {
+			t.Fatalf("NewAccessLogParser(%s) error = %v", tt.preset, err)
+		}
+		result := p.Parse(tt.line)
+		if result == nil {
+			t.Errorf("%s: Parse(%q) = nil", tt.preset, tt.line)
+			continue
+		}
+		for k, v := range tt.want {
+			if result[k] != v {
+				t.Errorf("%s: result[%q] = %#v, want %#v", tt.preset, k, result[k], v)
+			}
+		}
+	}
+}
+
+func TestAccessLogParser_Invalid(t *testing.T) {
+	if _, err := NewAccessLogParser("iis"); err == nil {
+		t.Error("expected error for an unknown preset")
+	}
+
+	p, _ := NewAccessLogParser("common")
+	if result := p.Parse("not an access log line"); result != nil {
+		t.Errorf("Parse() = %v, want nil", result)
+	}
+	// The combined format does not match common lines
+	p, _ = NewAccessLogParser("combined")
+	if result := p.Parse(`192.168.1.1 - - [15/Jan/2024:10:30:00 +0000] "GET / HTTP/1.1" 200 12`); result != nil {
+		t.Errorf("Parse() = %v, want nil", result)
+	}
+}
+
+func TestAccessLogPattern(t *testing.T) {
+	for _, name := range AccessLogPresetNames() {
+		pattern, err := AccessLogPattern(name)
+		if err != nil {
+			t.Errorf("AccessLogPattern(%s) error = %v", name, err)
+			continue
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			t.Errorf("AccessLogPattern(%s) does not compile: %v", name, err)
+		}
+	}
+}
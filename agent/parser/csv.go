@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: MIT
+
+package parser
+
+import (
+	"encoding/csv"
+	"strings"
+	"sync"
+)
+
+// Skipper is implemented by parsers that recognize lines carrying no
+// record, such as the header of a CSV file. Such lines are neither parsed
+// nor counted.
+type Skipper interface {
+	Skip(line string) bool
+}
+
+// CSVParser parses delimited lines, mapping column positions to field
+// names. Empty values are omitted, as are values beyond the named columns.
+type CSVParser struct {
+	delimiter rune
+	header    bool // column names are read from a header line
+
+	mu         sync.RWMutex
+	columns    []string
+	headerLine string // the last header line read
+}
+
+// NewCSVParser creates a CSV parser. With header, the column names are
+// read from the first line, and again from any line starting with '#',
+// such as HAProxy's "# pxname,svname,..." header; columns is then unused.
+// Otherwise, lines starting with '#' are comments.
+func NewCSVParser(delimiter rune, columns []string, header bool) *CSVParser {
+	return &CSVParser{
+		delimiter: delimiter,
+		header:    header,
+		columns:   columns,
+	}
+}
+
+// Skip reports whether a line is a header or a comment, reading the
+// column names from a header.
+func (p *CSVParser) Skip(line string) bool {
+	p.mu.RLock()
+	seen := p.headerLine != ""
+	repeated := seen && line == p.headerLine
+	p.mu.RUnlock()
+
+	isComment := strings.HasPrefix(line, "#")
+	if !p.header {
+		return isComment
+	}
+	if repeated {
+		return true // header repeated by a new or rotated file
+	}
+	if seen && !isComment {
+		return false
+	}
+
+	values, err := p.split(strings.TrimLeft(strings.TrimPrefix(line, "#"), " "))
+	if err != nil {
+		return false
+	}
+	columns := make([]string, len(values))
+	for i, v := range values {
+		columns[i] = strings.TrimSpace(v)
+	}
+
+	p.mu.Lock()
+	p.columns = columns
+	p.headerLine = line
+	p.mu.Unlock()
+	return true
+}
+
+// Parse parses a delimited line. Returns nil if the line is not valid CSV
+// or no column names are known yet.
+func (p *CSVParser) Parse(line string) map[string]interface{} {
+	p.mu.RLock()
+	columns := p.columns
+	p.mu.RUnlock()
+	if len(columns) == 0 {
+		return nil
+	}
+
+	values, err := p.split(line)
+	if err != nil {
+		return nil
+	}
+
+	result := make(map[string]interface{}, len(columns))
+	for i, v := range values {
+		if i >= len(columns) {
+			break
+		}
+		if v != "" && columns[i] != "" {
+			result[columns[i]] = v
+		}
+	}
+	return result
+}
+
+// split splits a line into its values.
+func (p *CSVParser) split(line string) ([]string, error) {
+	r := csv.NewReader(strings.NewReader(line))
+	r.Comma = p.delimiter
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	return r.Read()
+}
@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCSVParser_Columns(t *testing.T) {
+	p := NewCSVParser('\t', []string{"time", "", "status", "path"}, false)
+
+	if !p.Skip("# time\tid\tstatus\tpath") {
+		t.Error("comment line not skipped")
+	}
+	if p.Skip("2024-01-15T10:00:00Z\t42\t200\t/") {
+		t.Error("record skipped")
+	}
+
+	got := p.Parse("2024-01-15T10:00:00Z\t42\t500\t\"/a\tb\"\textra")
+	want := map[string]interface{}{
+		"time":   "2024-01-15T10:00:00Z",
+		"status": "500",
+		"path":   "/a\tb",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse() = %v, want %v", got, want)
+	}
+
+	// Empty values are omitted
+	got = p.Parse("2024-01-15T10:00:00Z\t\t\t/")
+	if _, ok := got["status"]; ok || got["path"] != "/" {
+		t.Errorf("Parse() = %v, want no status", got)
+	}
+}
+
+func TestCSVParser_Header(t *testing.T) {
+	p := NewCSVParser(',', nil, true)
+
+	if p.Parse("web,FRONTEND,3") != nil {
+		t.Error("Parse() before the header should fail")
+	}
+
+	// HAProxy stats start with a '#' header
+	header := "# pxname,svname,scur"
+	if !p.Skip(header) {
+		t.Fatal("header not skipped")
+	}
+	if p.Skip("web,FRONTEND,3") {
+		t.Error("record skipped")
+	}
+	want := map[string]interface{}{"pxname": "web", "svname": "FRONTEND", "scur": "3"}
+	if got := p.Parse("web,FRONTEND,3"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse() = %v, want %v", got, want)
+	}
+
+	// A repeated header is skipped, a new one replaces the columns
+	if !p.Skip(header) {
+		t.Error("repeated header not skipped")
+	}
+	if !p.Skip("# svname,pxname") {
+		t.Error("new header not skipped")
+	}
+	want = map[string]interface{}{"svname": "BACKEND", "pxname": "api"}
+	if got := p.Parse("BACKEND,api"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse() = %v, want %v", got, want)
+	}
+
+	// Without '#', the first line is the header
+	p = NewCSVParser(',', nil, true)
+	if !p.Skip("status,bytes") || p.Skip("200,512") {
+		t.Error("first line not taken as the header")
+	}
+	if got := p.Parse("200,512"); got["bytes"] != "512" {
+		t.Errorf("Parse() = %v", got)
+	}
+}
@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: MIT
+
+package parser
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// GELFParser parses GELF messages, JSON objects such as
+//
+//	{"version": "1.1", "host": "web-1", "short_message": "...", "level": 6, "_status": 200}
+//
+// The standard fields (host, short_message, full_message, timestamp,
+// level, ...) are kept as is; additional fields lose their leading
+// underscore, so that "_status" becomes "status", unless a standard field
+// has the same name. When an inner parser is set, short_message is parsed
+// with it and the resulting fields are added alongside the GELF fields.
+type GELFParser struct {
+	inner Parser
+}
+
+// NewGELFParser creates a GELF message parser.
+// inner may be nil to only expose the GELF fields.
+func NewGELFParser(inner Parser) *GELFParser {
+	return &GELFParser{inner: inner}
+}
+
+// Parse parses a GELF message.
+// Returns nil if the message is not a JSON object, or if an inner parser
+// is set and short_message cannot be parsed with it.
+func (p *GELFParser) Parse(line string) map[string]interface{} {
+	var msg map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &msg); err != nil || msg == nil {
+		return nil
+	}
+
+	result := make(map[string]interface{}, len(msg))
+	for key, val := range msg {
+		if !strings.HasPrefix(key, "_") {
+			result[key] = val
+		}
+	}
+	for key, val := range msg {
+		name, ok := strings.CutPrefix(key, "_")
+		if !ok || name == "" {
+			continue
+		}
+		if _, exists := result[name]; !exists {
+			result[name] = val
+		}
+	}
+
+	if p.inner == nil {
+		return result
+	}
+
+	short, _ := result["short_message"].(string)
+	fields := p.inner.Parse(short)
+	if fields == nil {
+		return nil
+	}
+	for key, val := range fields {
+		// GELF fields take precedence over fields parsed from short_message
+		if _, exists := result[key]; !exists {
+			result[key] = val
+		}
+	}
+	return result
+}
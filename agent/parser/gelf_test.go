@@ -0,0 +1,50 @@
+// SPDX-License-Identifier: MIT
+
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGELFParser_Parse(t *testing.T) {
+	p := NewGELFParser(nil)
+
+	got := p.Parse(`{"version":"1.1","host":"web-1","short_message":"GET /","level":6,"_status":200,"_user":{"id":"u1"},"_host":"ignored","_":1}`)
+	want := map[string]interface{}{
+		"version":       "1.1",
+		"host":          "web-1",
+		"short_message": "GET /",
+		"level":         float64(6),
+		"status":        float64(200),
+		"user":          map[string]interface{}{"id": "u1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse() = %v, want %v", got, want)
+	}
+
+	for _, line := range []string{"not json", "[1, 2]", "null"} {
+		if got := p.Parse(line); got != nil {
+			t.Errorf("Parse(%q) = %v, want nil", line, got)
+		}
+	}
+}
+
+func TestGELFParser_Inner(t *testing.T) {
+	p := NewGELFParser(NewLogfmtParser())
+
+	got := p.Parse(`{"host":"web-1","short_message":"method=GET status=500 host=other","_env":"prod"}`)
+	if got == nil {
+		t.Fatal("Parse() = nil")
+	}
+	if got["method"] != "GET" || got["status"] != "500" || got["env"] != "prod" {
+		t.Errorf("message fields not merged: %v", got)
+	}
+	if got["host"] != "web-1" {
+		t.Errorf("host = %v, GELF field should take precedence", got["host"])
+	}
+
+	if got := p.Parse(`{"short_message":"   "}`); got != nil {
+		t.Errorf("Parse() with unparsable short_message = %v, want nil", got)
+	}
+}
@@ -0,0 +1,198 @@
+// SPDX-License-Identifier: MIT
+
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// GrokPatterns are the built-in grok patterns, after the Logstash library.
+// They are plain RE2 expressions: patterns relying on lookarounds are
+// simplified.
+var GrokPatterns = map[string]string{
+	// Basics
+	"USERNAME":     `[a-zA-Z0-9._-]+`,
+	"USER":         `%{USERNAME}`,
+	"INT":          `(?:[+-]?[0-9]+)`,
+	"BASE10NUM":    `(?:[+-]?(?:[0-9]+(?:\.[0-9]+)?|\.[0-9]+))`,
+	"NUMBER":       `(?:%{BASE10NUM})`,
+	"BASE16NUM":    `(?:[+-]?(?:0x)?[0-9A-Fa-f]+)`,
+	"POSINT":       `\b(?:[1-9][0-9]*)\b`,
+	"NONNEGINT":    `\b(?:[0-9]+)\b`,
+	"WORD":         `\b\w+\b`,
+	"NOTSPACE":     `\S+`,
+	"SPACE":        `\s*`,
+	"DATA":         `.*?`,
+	"GREEDYDATA":   `.*`,
+	"QUOTEDSTRING": `(?:"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|` + "`(?:[^`\\\\]|\\\\.)*`)",
+	"QS":           `%{QUOTEDSTRING}`,
+	"UUID":         `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+	"LOGLEVEL":     `(?:[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|[Ii]nfo(?:rmation)?|INFO(?:RMATION)?|[Ww]arn(?:ing)?|WARN(?:ING)?|[Ee]rr(?:or)?|ERR(?:OR)?|[Cc]rit(?:ical)?|CRIT(?:ICAL)?|[Ff]atal|FATAL|[Ss]evere|SEVERE|[Ee]merg(?:ency)?|EMERG(?:ENCY)?)`,
+
+	// Networking
+	"MAC":            `(?:(?:[A-Fa-f0-9]{2}[:-]){5}[A-Fa-f0-9]{2}|(?:[A-Fa-f0-9]{4}\.){2}[A-Fa-f0-9]{4})`,
+	"IPV4":           `(?:(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.){3}(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)`,
+	"IPV6":           `(?:(?:[0-9A-Fa-f]{0,4}:){2,7}(?:%{IPV4}|[0-9A-Fa-f]{0,4})(?:%\w+)?)`,
+	"IP":             `(?:%{IPV6}|%{IPV4})`,
+	"HOSTNAME":       `\b(?:[0-9A-Za-z][0-9A-Za-z-]{0,62})(?:\.(?:[0-9A-Za-z][0-9A-Za-z-]{0,62}))*\.?`,
+	"IPORHOST":       `(?:%{IP}|%{HOSTNAME})`,
+	"HOSTPORT":       `%{IPORHOST}:%{POSINT}`,
+	"EMAILLOCALPART": `[a-zA-Z0-9_.+=:-]+`,
+	"EMAILADDRESS":   `%{EMAILLOCALPART}@%{HOSTNAME}`,
+
+	// Paths and URIs
+	"UNIXPATH":     `(?:/[^/\s?#]*)+`,
+	"WINPATH":      `(?:[A-Za-z]+:|\\)(?:\\[^\\?*]*)+`,
+	"PATH":         `(?:%{UNIXPATH}|%{WINPATH})`,
+	"URIPROTO":     `[A-Za-z][A-Za-z0-9+.-]*`,
+	"URIHOST":      `%{IPORHOST}(?::%{POSINT})?`,
+	"URIPATH":      `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%&_-]*)+`,
+	"URIPARAM":     `\?[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\[\]<>-]*`,
+	"URIPATHPARAM": `%{URIPATH}(?:%{URIPARAM})?`,
+	"URI":          `%{URIPROTO}://(?:%{USER}(?::[^@]*)?@)?(?:%{URIHOST})?(?:%{URIPATHPARAM})?`,
+
+	// Dates and times
+	"MONTH":             `\b(?:[Jj]an(?:uary)?|[Ff]eb(?:ruary)?|[Mm]ar(?:ch)?|[Aa]pr(?:il)?|[Mm]ay|[Jj]un(?:e)?|[Jj]ul(?:y)?|[Aa]ug(?:ust)?|[Ss]ep(?:tember)?|[Oo]ct(?:ober)?|[Nn]ov(?:ember)?|[Dd]ec(?:ember)?)\b`,
+	"MONTHNUM":          `(?:0?[1-9]|1[0-2])`,
+	"MONTHDAY":          `(?:0[1-9]|[12][0-9]|3[01]|[1-9])`,
+	"DAY":               `(?:Mon(?:day)?|Tue(?:sday)?|Wed(?:nesday)?|Thu(?:rsday)?|Fri(?:day)?|Sat(?:urday)?|Sun(?:day)?)`,
+	"YEAR":              `(?:\d\d){1,2}`,
+	"HOUR":              `(?:2[0123]|[01]?[0-9])`,
+	"MINUTE":            `(?:[0-5][0-9])`,
+	"SECOND":            `(?:(?:[0-5]?[0-9]|60)(?:[:.,][0-9]+)?)`,
+	"TIME":              `%{HOUR}:%{MINUTE}(?::%{SECOND})?`,
+	"ISO8601_TIMEZONE":  `(?:Z|[+-]%{HOUR}(?::?%{MINUTE}))`,
+	"TIMESTAMP_ISO8601": `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}(?::?%{SECOND})?%{ISO8601_TIMEZONE}?`,
+	"HTTPDATE":          `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"SYSLOGTIMESTAMP":   `%{MONTH} +%{MONTHDAY} %{TIME}`,
+
+	// Syslog
+	"PROG":       `[\x21-\x5a\x5c\x5e-\x7e]+`,
+	"SYSLOGPROG": `%{PROG:program}(?:\[%{POSINT:pid}\])?`,
+	"SYSLOGHOST": `%{IPORHOST}`,
+	"SYSLOGBASE": `%{SYSLOGTIMESTAMP:timestamp} %{SYSLOGHOST:logsource} %{SYSLOGPROG}:`,
+
+	// Web servers
+	"HTTPDUSER":         `(?:%{EMAILADDRESS}|%{USER})`,
+	"COMMONAPACHELOG":   `%{IPORHOST:clientip} %{HTTPDUSER:ident} %{HTTPDUSER:auth} \[%{HTTPDATE:timestamp}\] "(?:%{WORD:verb} %{NOTSPACE:request}(?: HTTP/%{NUMBER:httpversion})?|%{DATA:rawrequest})" %{NUMBER:response} (?:%{NUMBER:bytes}|-)`,
+	"COMBINEDAPACHELOG": `%{COMMONAPACHELOG} %{QS:referrer} %{QS:agent}`,
+}
+
+// maxGrokDepth bounds the nesting of grok patterns, catching cycles.
+const maxGrokDepth = 20
+
+// grokReference matches %{NAME}, %{NAME:field} and %{NAME:field:type}.
+var grokReference = regexp.MustCompile(`%\{(\w+)(?::(\w+))?(?::(\w+))?\}`)
+
+// GrokParser parses log lines with a grok pattern: a regular expression
+// referencing named patterns as %{NAME}, or %{NAME:field} to capture the
+// match as a field. A field may be converted with %{NAME:field:int} or
+// %{NAME:field:float}; other fields are strings.
+type GrokParser struct {
+	*RegexParser
+	types map[string]string // conversion by field
+}
+
+// NewGrokParser creates a grok parser. custom adds patterns to, or
+// overrides, the built-in GrokPatterns.
+func NewGrokParser(pattern string, custom map[string]string) (*GrokParser, error) {
+	expanded, types, err := expandGrok(pattern, custom)
+	if err != nil {
+		return nil, err
+	}
+	re, err := NewRegexParser(expanded)
+	if err != nil {
+		return nil, err
+	}
+	return &GrokParser{RegexParser: re, types: types}, nil
+}
+
+// ExpandGrok returns the regular expression a grok pattern stands for.
+func ExpandGrok(pattern string, custom map[string]string) (string, error) {
+	expanded, _, err := expandGrok(pattern, custom)
+	return expanded, err
+}
+
+// Parse parses a log line, converting typed fields. A typed field that
+// does not convert is left out.
+func (p *GrokParser) Parse(line string) map[string]interface{} {
+	result := p.RegexParser.Parse(line)
+	for field, typ := range p.types {
+		s, ok := result[field].(string)
+		if !ok {
+			continue
+		}
+		var v interface{}
+		var err error
+		switch typ {
+		case "int":
+			v, err = strconv.ParseInt(s, 10, 64)
+		case "float":
+			v, err = strconv.ParseFloat(s, 64)
+		}
+		if err != nil {
+			delete(result, field)
+			continue
+		}
+		result[field] = v
+	}
+	return result
+}
+
+// expandGrok expands the pattern references of a grok pattern and returns
+// the conversions of its typed fields.
+func expandGrok(pattern string, custom map[string]string) (string, map[string]string, error) {
+	types := make(map[string]string)
+	var expand func(pattern string, depth int) (string, error)
+	expand = func(pattern string, depth int) (string, error) {
+		if depth > maxGrokDepth {
+			return "", fmt.Errorf("grok patterns nested more than %d levels deep, is there a cycle?", maxGrokDepth)
+		}
+
+		var firstErr error
+		out := grokReference.ReplaceAllStringFunc(pattern, func(ref string) string {
+			if firstErr != nil {
+				return ""
+			}
+			m := grokReference.FindStringSubmatch(ref)
+			name, field, typ := m[1], m[2], m[3]
+
+			def, ok := custom[name]
+			if !ok {
+				def, ok = GrokPatterns[name]
+			}
+			if !ok {
+				firstErr = fmt.Errorf("unknown grok pattern %s", name)
+				return ""
+			}
+			switch typ {
+			case "", "int", "float":
+			default:
+				firstErr = fmt.Errorf("%s: unsupported type %s, want int or float", ref, typ)
+				return ""
+			}
+
+			inner, err := expand(def, depth+1)
+			if err != nil {
+				firstErr = err
+				return ""
+			}
+			if field == "" {
+				return "(?:" + inner + ")"
+			}
+			if typ != "" {
+				types[field] = typ
+			}
+			return "(?P<" + field + ">" + inner + ")"
+		})
+		return out, firstErr
+	}
+
+	expanded, err := expand(pattern, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	return expanded, types, nil
+}
@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: MIT
+
+package parser
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGrokParser_Parse(t *testing.T) {
+	p, err := NewGrokParser(`^%{COMBINEDAPACHELOG}$`, nil)
+	if err != nil {
+		t.Fatalf("NewGrokParser() error = %v", err)
+	}
+
+	line := `192.168.1.1 - frank [15/Jan/2024:10:30:00 +0000] "GET /api/health?full=1 HTTP/1.1" 200 1234 "-" "curl/8.0"`
+	result := p.Parse(line)
+	if result == nil {
+		t.Fatal("Parse() = nil, want non-nil")
+	}
+
+	expected := map[string]interface{}{
+		"clientip":    "192.168.1.1",
+		"auth":        "frank",
+		"timestamp":   "15/Jan/2024:10:30:00 +0000",
+		"verb":        "GET",
+		"request":     "/api/health?full=1",
+		"httpversion": "1.1",
+		"response":    "200",
+		"bytes":       "1234",
+		"referrer":    `"-"`,
+		"agent":       `"curl/8.0"`,
+	}
+	for k, v := range expected {
+		if result[k] != v {
+			t.Errorf("result[%q] = %v, want %v", k, result[k], v)
+		}
+	}
+}
+
+func TestGrokParser_TypesAndCustomPatterns(t *testing.T) {
+	p, err := NewGrokParser(`^%{TIMESTAMP_ISO8601:time} %{LOGLEVEL:level} %{REQ} took %{NUMBER:duration:float}ms status=%{INT:status:int}`,
+		map[string]string{"REQ": `%{WORD:method} %{URIPATHPARAM:path}`})
+	if err != nil {
+		t.Fatalf("NewGrokParser() error = %v", err)
+	}
+
+	result := p.Parse("2024-01-15T10:30:00.123Z INFO GET /users/42 took 12.5ms status=200")
+	expected := map[string]interface{}{
+		"time":     "2024-01-15T10:30:00.123Z",
+		"level":    "INFO",
+		"method":   "GET",
+		"path":     "/users/42",
+		"duration": 12.5,
+		"status":   int64(200),
+	}
+	for k, v := range expected {
+		if result[k] != v {
+			t.Errorf("result[%q] = %#v, want %#v", k, result[k], v)
+		}
+	}
+}
+
+func TestGrokPatterns(t *testing.T) {
+	// Every built-in pattern expands to a valid regular expression
+	for name := range GrokPatterns {
+		expanded, err := ExpandGrok("%{"+name+"}", nil)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if _, err := regexp.Compile(expanded); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		pattern string
+		matches []string
+		rejects []string
+	}{
+		{"IP", []string{"10.0.0.1", "::1", "2001:db8::8a2e:370:7334"}, []string{"300.1.1.1", "host"}},
+		{"SYSLOGBASE", []string{"Jan 15 10:00:00 web-01 sshd[123]:"}, []string{"2024-01-15 web-01 sshd:"}},
+		{"HTTPDATE", []string{"15/Jan/2024:10:30:00 +0000"}, []string{"2024-01-15T10:30:00Z"}},
+		{"LOGLEVEL", []string{"WARN", "error", "Info"}, []string{"VERBOSE"}},
+	} {
+		expanded, _ := ExpandGrok("^%{"+tt.pattern+"}$", nil)
+		re := regexp.MustCompile(expanded)
+		for _, s := range tt.matches {
+			if !re.MatchString(s) {
+				t.Errorf("%s does not match %q", tt.pattern, s)
+			}
+		}
+		for _, s := range tt.rejects {
+			if re.MatchString(s) {
+				t.Errorf("%s matches %q", tt.pattern, s)
+			}
+		}
+	}
+}
+
+func TestExpandGrok_Errors(t *testing.T) {
+	for name, tt := range map[string]struct {
+		pattern string
+		custom  map[string]string
+	}{
+		"unknown pattern": {`%{NOPE}`, nil},
+		"unknown type":    {`%{INT:n:bool}`, nil},
+		"cycle":           {`%{A}`, map[string]string{"A": `x%{B}`, "B": `%{A}`}},
+	} {
+		if _, err := ExpandGrok(tt.pattern, tt.custom); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+
+package parser
+
+import "encoding/json"
+
+// JournaldParser parses systemd journal entries as written by
+// `journalctl --output=json`.
+//
+// Journal field names are kept as-is (MESSAGE, PRIORITY, _SYSTEMD_UNIT, ...).
+// Binary values, which journalctl encodes as arrays of bytes, are converted
+// to strings. When an inner parser is set, MESSAGE is parsed with it and the
+// resulting fields are added alongside the journal fields.
+type JournaldParser struct {
+	inner Parser
+}
+
+// NewJournaldParser creates a journal entry parser.
+// inner may be nil to only expose the journal fields.
+func NewJournaldParser(inner Parser) *JournaldParser {
+	return &JournaldParser{inner: inner}
+}
+
+// Parse parses a journal entry.
+// Returns nil if the entry is not valid JSON, or if an inner parser is set
+// and MESSAGE cannot be parsed with it.
+func (p *JournaldParser) Parse(line string) map[string]interface{} {
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return nil
+	}
+
+	result := make(map[string]interface{}, len(entry))
+	for key, val := range entry {
+		if val == nil {
+			// journalctl omits values larger than its field size limit
+			continue
+		}
+		result[key] = journalValue(val)
+	}
+
+	if p.inner == nil {
+		return result
+	}
+
+	msg, _ := result["MESSAGE"].(string)
+	fields := p.inner.Parse(msg)
+	if fields == nil {
+		return nil
+	}
+	for key, val := range fields {
+		// Journal fields take precedence over fields parsed from MESSAGE
+		if _, exists := result[key]; !exists {
+			result[key] = val
+		}
+	}
+	return result
+}
+
+// journalValue converts a byte array value to a string.
+// Other values, including arrays of repeated field values, are returned unchanged.
+func journalValue(val interface{}) interface{} {
+	arr, ok := val.([]interface{})
+	if !ok || len(arr) == 0 {
+		return val
+	}
+
+	buf := make([]byte, 0, len(arr))
+	for _, v := range arr {
+		n, ok := v.(float64)
+		if !ok || n < 0 || n > 255 || n != float64(int(n)) {
+			return val
+		}
+		buf = append(buf, byte(n))
+	}
+	return string(buf)
+}
@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: MIT
+
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJournaldParser_Parse(t *testing.T) {
+	p := NewJournaldParser(nil)
+
+	line := `{"__CURSOR":"s=1;i=2","MESSAGE":"Started nginx","PRIORITY":"6","_SYSTEMD_UNIT":"nginx.service","_PID":"42","LARGE":null}`
+	got := p.Parse(line)
+	want := map[string]interface{}{
+		"__CURSOR":      "s=1;i=2",
+		"MESSAGE":       "Started nginx",
+		"PRIORITY":      "6",
+		"_SYSTEMD_UNIT": "nginx.service",
+		"_PID":          "42",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse() = %v, want %v", got, want)
+	}
+}
+
+func TestJournaldParser_Binary(t *testing.T) {
+	p := NewJournaldParser(nil)
+
+	got := p.Parse(`{"MESSAGE":[104,105,10],"TAGS":["a","b"]}`)
+	if got["MESSAGE"] != "hi\n" {
+		t.Errorf("MESSAGE = %q, want %q", got["MESSAGE"], "hi\n")
+	}
+	if !reflect.DeepEqual(got["TAGS"], []interface{}{"a", "b"}) {
+		t.Errorf("TAGS = %v, want repeated values unchanged", got["TAGS"])
+	}
+}
+
+func TestJournaldParser_Inner(t *testing.T) {
+	p := NewJournaldParser(NewLogfmtParser())
+
+	got := p.Parse(`{"MESSAGE":"level=error status=500 PRIORITY=1","PRIORITY":"3"}`)
+	if got == nil {
+		t.Fatal("Parse() = nil")
+	}
+	if got["level"] != "error" || got["status"] != "500" {
+		t.Errorf("message fields not merged: %v", got)
+	}
+	if got["PRIORITY"] != "3" {
+		t.Errorf("PRIORITY = %v, journal field should take precedence", got["PRIORITY"])
+	}
+
+	if got := p.Parse(`{"MESSAGE":"   "}`); got != nil {
+		t.Errorf("Parse() with unparsable MESSAGE = %v, want nil", got)
+	}
+}
+
+func TestJournaldParser_Invalid(t *testing.T) {
+	p := NewJournaldParser(nil)
+	if got := p.Parse("not json"); got != nil {
+		t.Errorf("Parse() = %v, want nil", got)
+	}
+}
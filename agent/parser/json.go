@@ -27,11 +27,16 @@ func (p *JSONParser) Parse(line string) map[string]interface{} {
 
 // GetField extracts a field from parsed data using dot notation.
 // Supports nested fields like "metrics.active_sessions" or "response.bytes".
+// A top-level key containing dots (as produced by logfmt) matches first.
 func GetField(data map[string]interface{}, field string) (interface{}, bool) {
 	if data == nil {
 		return nil, false
 	}
 
+	if val, ok := data[field]; ok {
+		return val, true
+	}
+
 	parts := strings.Split(field, ".")
 	var current interface{} = data
 
@@ -57,7 +62,12 @@ func GetFieldString(data map[string]interface{}, field string) (string, bool) {
 	if !ok {
 		return "", false
 	}
+	return StringValue(val)
+}
 
+// StringValue converts a field value, as returned by GetField, to a
+// string, as GetFieldString does.
+func StringValue(val interface{}) (string, bool) {
 	switch v := val.(type) {
 	case string:
 		return v, true
@@ -80,7 +90,12 @@ func GetFieldFloat(data map[string]interface{}, field string) (float64, bool) {
 	if !ok {
 		return 0, false
 	}
+	return FloatValue(val)
+}
 
+// FloatValue converts a field value, as returned by GetField, to a
+// float64, as GetFieldFloat does.
+func FloatValue(val interface{}) (float64, bool) {
 	switch v := val.(type) {
 	case float64:
 		return v, true
@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: MIT
+
+package parser
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// LogfmtParser parses logfmt log lines such as
+// `level=error msg="db down" duration=1.2s`.
+type LogfmtParser struct{}
+
+// NewLogfmtParser creates a new logfmt parser.
+func NewLogfmtParser() *LogfmtParser {
+	return &LogfmtParser{}
+}
+
+// Parse parses a logfmt log line.
+// Values are returned as strings; a key without a value is set to true.
+// Returns nil if the line is malformed or contains no key=value pair.
+func (p *LogfmtParser) Parse(line string) map[string]interface{} {
+	result := make(map[string]interface{})
+	hasValue := false
+
+	i := 0
+	for {
+		// Skip whitespace between pairs
+		for i < len(line) && isLogfmtSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			break
+		}
+
+		start := i
+		for i < len(line) && line[i] != '=' && line[i] != '"' && !isLogfmtSpace(line[i]) {
+			i++
+		}
+		key := line[start:i]
+		if key == "" {
+			return nil
+		}
+
+		if i >= len(line) || line[i] != '=' {
+			if i < len(line) && line[i] == '"' {
+				return nil
+			}
+			result[key] = true
+			continue
+		}
+		i++ // skip '='
+
+		if i < len(line) && line[i] == '"' {
+			value, n, ok := unquoteLogfmt(line[i:])
+			if !ok {
+				return nil
+			}
+			result[key] = value
+			i += n
+		} else {
+			start = i
+			for i < len(line) && !isLogfmtSpace(line[i]) {
+				if line[i] == '"' {
+					return nil
+				}
+				i++
+			}
+			result[key] = line[start:i]
+		}
+		hasValue = true
+	}
+
+	if !hasValue {
+		return nil
+	}
+
+	return result
+}
+
+// unquoteLogfmt decodes the quoted value at the start of s.
+// Returns the value, the number of bytes consumed, and whether the value
+// was properly terminated.
+func unquoteLogfmt(s string) (string, int, bool) {
+	var b strings.Builder
+	for i := 1; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '"':
+			return b.String(), i + 1, true
+		case c == '\\' && i+1 < len(s):
+			switch s[i+1] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			default:
+				b.WriteByte(s[i+1])
+			}
+			i += 2
+		default:
+			r, size := utf8.DecodeRuneInString(s[i:])
+			b.WriteRune(r)
+			i += size
+		}
+	}
+	return "", 0, false
+}
+
+// isLogfmtSpace reports whether c separates logfmt pairs.
+func isLogfmtSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
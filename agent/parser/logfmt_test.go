@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: MIT
+
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLogfmtParser_Parse(t *testing.T) {
+	p := NewLogfmtParser()
+
+	tests := []struct {
+		name string
+		line string
+		want map[string]interface{}
+	}{
+		{
+			name: "simple pairs",
+			line: `level=error msg="db down" duration=1.2s`,
+			want: map[string]interface{}{"level": "error", "msg": "db down", "duration": "1.2s"},
+		},
+		{
+			name: "escaped quotes",
+			line: `msg="say \"hi\"\n" path=C:\\tmp`,
+			want: map[string]interface{}{"msg": "say \"hi\"\n", "path": `C:\\tmp`},
+		},
+		{
+			name: "empty value",
+			line: `level=info msg= caller=main.go:12`,
+			want: map[string]interface{}{"level": "info", "msg": "", "caller": "main.go:12"},
+		},
+		{
+			name: "empty quoted value",
+			line: `msg="" level=debug`,
+			want: map[string]interface{}{"msg": "", "level": "debug"},
+		},
+		{
+			name: "bare key",
+			line: `level=warn retry`,
+			want: map[string]interface{}{"level": "warn", "retry": true},
+		},
+		{
+			name: "dotted keys",
+			line: `http.status=500 http.method=GET`,
+			want: map[string]interface{}{"http.status": "500", "http.method": "GET"},
+		},
+		{
+			name: "extra whitespace",
+			line: "  a=1 \t b=2  ",
+			want: map[string]interface{}{"a": "1", "b": "2"},
+		},
+		{
+			name: "unterminated quote",
+			line: `msg="oops level=error`,
+		},
+		{
+			name: "missing key",
+			line: `=value`,
+		},
+		{
+			name: "plain text",
+			line: `just some words`,
+		},
+		{
+			name: "empty line",
+			line: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.Parse(tt.line)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse(%q) = %v, want %v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetField_DottedKey(t *testing.T) {
+	data := NewLogfmtParser().Parse(`http.status=500`)
+
+	got, ok := GetFieldString(data, "http.status")
+	if !ok || got != "500" {
+		t.Errorf("GetFieldString() = %q, %v, want %q, true", got, ok, "500")
+	}
+}
@@ -17,6 +17,14 @@ func New(format string, pattern string) (Parser, error) {
 		return NewJSONParser(), nil
 	case "regex":
 		return NewRegexParser(pattern)
+	case "grok":
+		return NewGrokParser(pattern, nil)
+	case "csv":
+		return NewCSVParser(',', nil, true), nil
+	case "logfmt":
+		return NewLogfmtParser(), nil
+	case "syslog":
+		return NewSyslogParser(), nil
 	default:
 		return nil, &UnsupportedFormatError{Format: format}
 	}
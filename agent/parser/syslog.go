@@ -0,0 +1,218 @@
+// SPDX-License-Identifier: MIT
+
+package parser
+
+import (
+	"strconv"
+	"strings"
+)
+
+// SyslogParser parses RFC3164 (BSD) and RFC5424 syslog lines.
+//
+// The <PRI> header is optional, since local syslog daemons usually omit it
+// when writing files such as /var/log/auth.log.
+type SyslogParser struct{}
+
+// NewSyslogParser creates a new syslog parser.
+func NewSyslogParser() *SyslogParser {
+	return &SyslogParser{}
+}
+
+// Parse parses a syslog line into the fields priority, facility, severity,
+// timestamp, host, app, pid, msgid, structured_data and message. Fields not
+// present in the line are omitted. Numeric fields are returned as strings.
+// Returns nil if the line is not a syslog line.
+func (p *SyslogParser) Parse(line string) map[string]interface{} {
+	result := make(map[string]interface{})
+
+	rest := line
+	if strings.HasPrefix(rest, "<") {
+		end := strings.IndexByte(rest, '>')
+		if end < 2 || end > 4 {
+			return nil
+		}
+		pri, err := strconv.Atoi(rest[1:end])
+		if err != nil || pri < 0 || pri > 191 {
+			return nil
+		}
+		result["priority"] = strconv.Itoa(pri)
+		result["facility"] = strconv.Itoa(pri / 8)
+		result["severity"] = strconv.Itoa(pri % 8)
+		rest = rest[end+1:]
+	}
+
+	if version, ok := rfc5424Version(rest); ok {
+		if !parseRFC5424(rest[len(version)+1:], result) {
+			return nil
+		}
+		result["version"] = version
+		return result
+	}
+
+	if !parseRFC3164(rest, result) {
+		return nil
+	}
+	return result
+}
+
+// rfc5424Version returns the VERSION field if s starts with one
+// (1 to 3 digits without a leading zero, followed by a space).
+func rfc5424Version(s string) (string, bool) {
+	i := 0
+	for i < len(s) && i < 3 && isDigit(s[i]) {
+		i++
+	}
+	if i == 0 || s[0] == '0' || i >= len(s) || s[i] != ' ' {
+		return "", false
+	}
+	return s[:i], true
+}
+
+// parseRFC5424 parses the part of an RFC5424 line following the version:
+// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parseRFC5424(s string, result map[string]interface{}) bool {
+	names := []string{"timestamp", "host", "app", "pid", "msgid"}
+	for _, name := range names {
+		field, rest, ok := strings.Cut(s, " ")
+		if !ok || field == "" {
+			return false
+		}
+		if field != "-" {
+			result[name] = field
+		}
+		s = rest
+	}
+
+	if strings.HasPrefix(s, "-") {
+		s = s[1:]
+	} else {
+		sd, n, ok := parseStructuredData(s)
+		if !ok {
+			return false
+		}
+		result["structured_data"] = sd
+		s = s[n:]
+	}
+
+	if s != "" {
+		if s[0] != ' ' {
+			return false
+		}
+		result["message"] = strings.TrimPrefix(s[1:], "\ufeff") // UTF-8 BOM
+	}
+	return true
+}
+
+// parseStructuredData parses one or more SD-ELEMENTs at the start of s into
+// a map of SD-ID to its parameters. Returns the number of bytes consumed.
+func parseStructuredData(s string) (map[string]interface{}, int, bool) {
+	sd := make(map[string]interface{})
+	i := 0
+	for i < len(s) && s[i] == '[' {
+		i++
+		start := i
+		for i < len(s) && s[i] != ' ' && s[i] != ']' {
+			i++
+		}
+		if i >= len(s) || i == start {
+			return nil, 0, false
+		}
+		params := make(map[string]interface{})
+		sd[s[start:i]] = params
+
+		for i < len(s) && s[i] == ' ' {
+			i++
+			start = i
+			for i < len(s) && s[i] != '=' {
+				i++
+			}
+			if i+1 >= len(s) || s[i+1] != '"' {
+				return nil, 0, false
+			}
+			name := s[start:i]
+			i += 2
+
+			var value strings.Builder
+			for i < len(s) && s[i] != '"' {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\' || s[i+1] == ']') {
+					i++
+				}
+				value.WriteByte(s[i])
+				i++
+			}
+			if i >= len(s) {
+				return nil, 0, false
+			}
+			params[name] = value.String()
+			i++ // closing quote
+		}
+
+		if i >= len(s) || s[i] != ']' {
+			return nil, 0, false
+		}
+		i++
+	}
+	if len(sd) == 0 {
+		return nil, 0, false
+	}
+	return sd, i, true
+}
+
+// parseRFC3164 parses a BSD syslog line: TIMESTAMP HOSTNAME TAG: MSG
+// The timestamp is either "Mmm dd hh:mm:ss" or an RFC3339 timestamp as
+// written by rsyslog's high-precision file format.
+func parseRFC3164(s string, result map[string]interface{}) bool {
+	var timestamp string
+	switch {
+	case isBSDTimestamp(s):
+		timestamp, s = s[:15], s[15:]
+	case len(s) > 10 && s[4] == '-' && s[7] == '-' && s[10] == 'T':
+		timestamp, s, _ = strings.Cut(s, " ")
+		s = " " + s
+	default:
+		return false
+	}
+	if !strings.HasPrefix(s, " ") {
+		return false
+	}
+	result["timestamp"] = timestamp
+
+	host, rest, ok := strings.Cut(s[1:], " ")
+	if !ok || host == "" {
+		return false
+	}
+	result["host"] = host
+
+	// TAG is app or app[pid], terminated by a colon
+	if tag, msg, ok := strings.Cut(rest, ": "); ok && tag != "" && !strings.ContainsAny(tag, " ") {
+		if app, pid, ok := strings.Cut(tag, "["); ok && strings.HasSuffix(pid, "]") {
+			result["app"] = app
+			result["pid"] = strings.TrimSuffix(pid, "]")
+		} else {
+			result["app"] = tag
+		}
+		rest = msg
+	}
+	result["message"] = rest
+	return true
+}
+
+// isBSDTimestamp reports whether s starts with a "Mmm dd hh:mm:ss" timestamp.
+func isBSDTimestamp(s string) bool {
+	if len(s) < 15 {
+		return false
+	}
+	switch s[:3] {
+	case "Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec":
+	default:
+		return false
+	}
+	return s[3] == ' ' && (s[4] == ' ' || isDigit(s[4])) && isDigit(s[5]) && s[6] == ' ' &&
+		isDigit(s[7]) && isDigit(s[8]) && s[9] == ':' &&
+		isDigit(s[10]) && isDigit(s[11]) && s[12] == ':' &&
+		isDigit(s[13]) && isDigit(s[14])
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
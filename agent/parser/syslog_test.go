@@ -0,0 +1,135 @@
+// SPDX-License-Identifier: MIT
+
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSyslogParser_Parse(t *testing.T) {
+	p := NewSyslogParser()
+
+	tests := []struct {
+		name string
+		line string
+		want map[string]interface{}
+	}{
+		{
+			name: "rfc3164 file line",
+			line: `Jan 15 10:30:00 web01 sshd[1234]: Failed password for root from 10.0.0.1 port 22 ssh2`,
+			want: map[string]interface{}{
+				"timestamp": "Jan 15 10:30:00",
+				"host":      "web01",
+				"app":       "sshd",
+				"pid":       "1234",
+				"message":   "Failed password for root from 10.0.0.1 port 22 ssh2",
+			},
+		},
+		{
+			name: "rfc3164 with priority and padded day",
+			line: `<34>Oct  1 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8`,
+			want: map[string]interface{}{
+				"priority":  "34",
+				"facility":  "4",
+				"severity":  "2",
+				"timestamp": "Oct  1 22:14:15",
+				"host":      "mymachine",
+				"app":       "su",
+				"message":   "'su root' failed for lonvick on /dev/pts/8",
+			},
+		},
+		{
+			name: "rfc3164 with rfc3339 timestamp",
+			line: `2024-01-15T10:30:00.123456+00:00 web01 CRON[42]: (root) CMD (run-parts /etc/cron.hourly)`,
+			want: map[string]interface{}{
+				"timestamp": "2024-01-15T10:30:00.123456+00:00",
+				"host":      "web01",
+				"app":       "CRON",
+				"pid":       "42",
+				"message":   "(root) CMD (run-parts /etc/cron.hourly)",
+			},
+		},
+		{
+			name: "rfc3164 without tag",
+			line: `Jan 15 10:30:00 web01 kernel message without tag`,
+			want: map[string]interface{}{
+				"timestamp": "Jan 15 10:30:00",
+				"host":      "web01",
+				"message":   "kernel message without tag",
+			},
+		},
+		{
+			name: "rfc5424 with structured data",
+			line: `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application"] An application event`,
+			want: map[string]interface{}{
+				"priority":  "165",
+				"facility":  "20",
+				"severity":  "5",
+				"version":   "1",
+				"timestamp": "2003-10-11T22:14:15.003Z",
+				"host":      "mymachine.example.com",
+				"app":       "evntslog",
+				"msgid":     "ID47",
+				"structured_data": map[string]interface{}{
+					"exampleSDID@32473": map[string]interface{}{"iut": "3", "eventSource": "Application"},
+				},
+				"message": "An application event",
+			},
+		},
+		{
+			name: "rfc5424 without structured data",
+			line: "<34>1 2003-10-11T22:14:15.003Z host su 77 - - \ufeffsu failed",
+			want: map[string]interface{}{
+				"priority":  "34",
+				"facility":  "4",
+				"severity":  "2",
+				"version":   "1",
+				"timestamp": "2003-10-11T22:14:15.003Z",
+				"host":      "host",
+				"app":       "su",
+				"pid":       "77",
+				"message":   "su failed",
+			},
+		},
+		{
+			name: "rfc5424 escaped structured data",
+			line: `<13>1 - - app - - [meta note="a \"quoted\" \]"]`,
+			want: map[string]interface{}{
+				"priority": "13",
+				"facility": "1",
+				"severity": "5",
+				"version":  "1",
+				"app":      "app",
+				"structured_data": map[string]interface{}{
+					"meta": map[string]interface{}{"note": `a "quoted" ]`},
+				},
+			},
+		},
+		{
+			name: "invalid priority",
+			line: `<999>Jan 15 10:30:00 web01 app: msg`,
+		},
+		{
+			name: "unterminated structured data",
+			line: `<13>1 - - app - - [meta note="x"`,
+		},
+		{
+			name: "not syslog",
+			line: `{"event": "request"}`,
+		},
+		{
+			name: "empty line",
+			line: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.Parse(tt.line)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse(%q) =\n%v\nwant\n%v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/kubernetes"
+)
+
+// resolvePodMetadata sets the fields added to the lines of sources with
+// kubernetes_metadata: the downward API provides what it can, and the API
+// server the rest unless lookup_pod is disabled. Failing to look the pod
+// up is not fatal, the lines then carry what the downward API provided.
+func (a *Agent) resolvePodMetadata(ctx context.Context, cfg *config.Config) {
+	a.podFields.Store(a.podMetadata(ctx, cfg))
+}
+
+// podMetadata returns the fields added to the lines of sources with
+// kubernetes_metadata, see resolvePodMetadata, or nil when disabled.
+func (a *Agent) podMetadata(ctx context.Context, cfg *config.Config) *map[string]interface{} {
+	k := &cfg.KubernetesMetadata
+	if !k.IsEnabled() {
+		return nil
+	}
+
+	pod, err := kubernetes.Self(k.LabelsFile)
+	if err != nil {
+		a.logger.Warn("reading pod labels failed", "labels_file", k.LabelsFile, "error", err)
+	}
+
+	if k.LookupEnabled() && (pod.Labels == nil || pod.UID == "" || pod.NodeName == "") {
+		if err := lookupPod(ctx, &pod); err != nil {
+			a.logger.Warn("looking up the agent's pod failed, add a downward API volume for its labels", "pod", pod.Name, "namespace", pod.Namespace, "error", err)
+		}
+	}
+
+	fields := kubernetes.Fields(pod, "")
+	delete(fields["kubernetes"].(map[string]interface{}), "container")
+	a.logger.Info("enriching lines with pod metadata", "pod", pod.Name, "namespace", pod.Namespace, "node", pod.NodeName, "labels", len(pod.Labels))
+	return &fields
+}
+
+// reloadPodMetadata resolves the pod metadata of cfg ahead of a reload of
+// the running agent that changes kubernetes_metadata, without holding the
+// agent lock while it queries the API server. It reports false when there
+// is nothing to resolve.
+func (a *Agent) reloadPodMetadata(cfg *config.Config) (*map[string]interface{}, bool) {
+	a.mu.Lock()
+	running, run := a.running, a.run
+	a.mu.Unlock()
+
+	if !running || reflect.DeepEqual(a.Config().KubernetesMetadata, cfg.KubernetesMetadata) {
+		return nil, false
+	}
+	return a.podMetadata(run.ctx, cfg), true
+}
+
+// attachPodFields lets a processor add the pod metadata to its lines,
+// unless it reads a kubernetes source whose lines carry their own pod's.
+func (a *Agent) attachPodFields(proc *sourceProcessor) {
+	if !proc.source.IsKubernetes() {
+		proc.pod = &a.podFields
+	}
+}
+
+// lookupPod completes pod with its metadata from the API server.
+func lookupPod(ctx context.Context, pod *kubernetes.Pod) error {
+	client, err := kubernetes.NewClient(kubernetes.Config{})
+	if err != nil {
+		return err
+	}
+	found, err := client.GetPod(ctx, pod.Namespace, pod.Name)
+	if err != nil {
+		return err
+	}
+	if pod.Labels == nil {
+		pod.Labels = found.Labels
+	}
+	if pod.UID == "" {
+		pod.UID = found.UID
+	}
+	if pod.NodeName == "" {
+		pod.NodeName = found.NodeName
+	}
+	return nil
+}
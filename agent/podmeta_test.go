@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/kubernetes"
+)
+
+func TestAgent_KubernetesMetadata(t *testing.T) {
+	t.Setenv(kubernetes.EnvPodName, "checkout-7d9f")
+	t.Setenv(kubernetes.EnvPodNamespace, "shop")
+	t.Setenv(kubernetes.EnvPodUID, "u1")
+	t.Setenv(kubernetes.EnvNodeName, "node-a")
+
+	labelsFile := filepath.Join(t.TempDir(), "labels")
+	if err := os.WriteFile(labelsFile, []byte("app=\"checkout\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	enabled, lookup := true, false
+	cfg := &config.Config{
+		AppName: "test-app",
+		KubernetesMetadata: config.KubernetesMetadataConfig{
+			Enabled:    &enabled,
+			LabelsFile: labelsFile,
+			LookupPod:  &lookup,
+		},
+		Sources: []config.Source{
+			{
+				Path:   "/var/log/app.log",
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter", Labels: []string{"kubernetes.namespace", "kubernetes.labels.app", "kubernetes.node"}},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	ag.resolvePodMetadata(context.Background(), cfg)
+	ag.ProcessLine(0, `{"status": 200}`)
+
+	series, ok := ag.Metrics()["requests"].([]aggregator.Series)
+	if !ok || len(series) != 1 {
+		t.Fatalf("requests = %v, want one series", ag.Metrics()["requests"])
+	}
+	want := map[string]string{"kubernetes.namespace": "shop", "kubernetes.labels.app": "checkout", "kubernetes.node": "node-a"}
+	for k, v := range want {
+		if series[0].Labels[k] != v {
+			t.Errorf("label %s = %q, want %q", k, series[0].Labels[k], v)
+		}
+	}
+}
+
+func TestAgent_ReloadKubernetesMetadata(t *testing.T) {
+	t.Setenv(kubernetes.EnvPodName, "checkout-7d9f")
+	t.Setenv(kubernetes.EnvPodNamespace, "shop")
+
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(logFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	newConfig := func(enabled bool) *config.Config {
+		lookup := false
+		return &config.Config{
+			AppName:       "test-app",
+			Offline:       true,
+			Interval:      time.Hour,
+			PositionsFile: "none",
+			KubernetesMetadata: config.KubernetesMetadataConfig{
+				Enabled:   &enabled,
+				LookupPod: &lookup,
+			},
+			Sources: []config.Source{
+				{
+					Path:   logFile,
+					Format: "json",
+					Metrics: []config.Metric{
+						{Name: "requests", Type: "counter", Labels: []string{"kubernetes.namespace"}},
+					},
+				},
+			},
+		}
+	}
+
+	ag, err := New(Options{Config: newConfig(false), DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer ag.Stop(0)
+
+	if err := ag.Reload(newConfig(true)); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	ag.ProcessLine(0, `{"status": 200}`)
+
+	series, ok := ag.Metrics()["requests"].([]aggregator.Series)
+	if !ok || len(series) != 1 || series[0].Labels["kubernetes.namespace"] != "shop" {
+		t.Errorf("requests = %v, want a series of namespace shop", ag.Metrics()["requests"])
+	}
+}
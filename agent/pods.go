@@ -0,0 +1,174 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/kubernetes"
+	"github.com/kolapsis/shm-agent/agent/tailer"
+)
+
+// maxPartialLine bounds a container log line reassembled from partial
+// runtime lines. Longer lines are dropped.
+const maxPartialLine = 1024 * 1024
+
+// discoverPods tails the log files of the pods selected by a kubernetes
+// source and stops the tailers of files whose pod is gone.
+// Must be called with tailersMu held.
+func (a *Agent) discoverPods(ctx context.Context, proc *sourceProcessor, mode discoverMode) error {
+	k := proc.source.Kubernetes
+	if k == nil {
+		k = &config.KubernetesConfig{}
+	}
+
+	client, err := a.kubeClient(proc.key, k)
+	if err == nil {
+		var pods []kubernetes.Pod
+		pods, err = client.ListPods(ctx, kubernetes.PodFilter{
+			Namespace:     k.Namespace,
+			LabelSelector: k.Selector,
+			NodeName:      k.NodeName,
+		})
+		if err == nil {
+			a.tailPods(ctx, proc, k, pods, mode)
+			return nil
+		}
+	}
+
+	if mode == discoverInitial {
+		return fmt.Errorf("discovering pods for %s: %w", proc.source.Location(), err)
+	}
+	a.logger.Error("failed to discover pods", "source", proc.source.Location(), "error", err)
+	return nil
+}
+
+// kubeClient returns the API client of a source, creating it on first use.
+func (a *Agent) kubeClient(key string, k *config.KubernetesConfig) (*kubernetes.Client, error) {
+	if client, ok := a.kube[key]; ok {
+		return client, nil
+	}
+
+	client, err := kubernetes.NewClient(kubernetes.Config{
+		Host:      k.APIServer,
+		TokenFile: k.TokenFile,
+		CAFile:    k.CAFile,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if a.kube == nil {
+		a.kube = make(map[string]*kubernetes.Client)
+	}
+	a.kube[key] = client
+	return client, nil
+}
+
+// tailPods starts a tailer for every container log file of pods that is
+// not already tailed, and stops the source's other tailers.
+func (a *Agent) tailPods(ctx context.Context, proc *sourceProcessor, k *config.KubernetesConfig, pods []kubernetes.Pod, mode discoverMode) {
+	logsDir := k.LogsDir
+	if logsDir == "" {
+		logsDir = kubernetes.DefaultLogsDir
+	}
+
+	if a.tailers == nil {
+		a.tailers = make(map[tailerKey]*tailer.Tailer)
+	}
+
+	current := make(map[string]bool)
+	for _, pod := range pods {
+		files, err := kubernetes.LogFiles(logsDir, pod, k.Container)
+		if err != nil {
+			a.logger.Error("failed to list pod log files", "pod", pod.Namespace+"/"+pod.Name, "error", err)
+			continue
+		}
+
+		for _, path := range files {
+			current[path] = true
+			key := tailerKey{source: proc.key, path: path}
+			if _, ok := a.tailers[key]; ok {
+				continue
+			}
+
+			fields := kubernetes.Fields(pod, kubernetes.ContainerFromPath(path))
+			newTailer := func() *tailer.Tailer {
+				var t *tailer.Tailer
+				t = tailer.New(path, a.podLineHandler(proc.key, path, func() int64 { return t.Line() }, fields), a.logger)
+				if proc.countLines {
+					t.CountLines()
+				}
+				t.OnReopen(a.reopenHandler(proc.key))
+				return t
+			}
+			if _, ok := a.parked[key]; ok {
+				a.unpark(ctx, key, newTailer)
+				continue
+			}
+
+			a.makeRoom()
+			t := newTailer()
+			if offset, ok := a.resumeOffset(path); ok {
+				err = t.StartAt(ctx, offset)
+			} else if mode == discoverRescan {
+				err = t.StartFromBeginning(ctx)
+			} else {
+				err = t.Start(ctx)
+			}
+			if err != nil {
+				a.logger.Error("failed to start tailer", "path", path, "error", err)
+				continue
+			}
+
+			if mode == discoverRescan {
+				a.logger.Info("discovered pod log file", "pod", pod.Namespace+"/"+pod.Name, "path", path)
+			}
+			a.tailers[key] = t
+		}
+	}
+
+	for key, t := range a.tailers {
+		if key.source != proc.key || current[key.path] {
+			continue
+		}
+		if err := t.Stop(); err != nil {
+			a.logger.Error("error stopping tailer", "path", t.Path(), "error", err)
+		}
+		delete(a.tailers, key)
+		a.logger.Info("pod log file is gone, stopped tailing", "path", key.path)
+	}
+	a.forgetParked(proc.key, current)
+}
+
+// podLineHandler returns a tailer handler that removes the container
+// runtime framing from lines, reassembles partial lines and forwards them
+// with their path, line number and the pod metadata fields.
+func (a *Agent) podLineHandler(key, path string, lineNum func() int64, fields map[string]interface{}) tailer.LineHandler {
+	var partial strings.Builder
+	return func(raw string) {
+		line := kubernetes.ParseLine(raw)
+
+		msg := line.Message
+		if line.Partial || partial.Len() > 0 {
+			if partial.Len()+len(msg) > maxPartialLine {
+				a.errors.Warn("oversized:"+path, "dropping oversized container log line", "path", path, "limit", maxPartialLine)
+				partial.Reset()
+				return
+			}
+			partial.WriteString(msg)
+			if line.Partial {
+				return
+			}
+			msg = partial.String()
+			partial.Reset()
+		}
+
+		if proc := a.processor(key); proc != nil {
+			proc.processLineWith(msg, lineContext{path: path, line: lineNum(), fields: fields})
+		}
+	}
+}
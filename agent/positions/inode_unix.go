@@ -0,0 +1,19 @@
+// SPDX-License-Identifier: MIT
+
+//go:build !windows
+
+package positions
+
+import (
+	"os"
+	"syscall"
+)
+
+// Inode returns the inode number of a file.
+func Inode(info os.FileInfo) (uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Ino), true
+}
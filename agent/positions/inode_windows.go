@@ -0,0 +1,15 @@
+// SPDX-License-Identifier: MIT
+
+//go:build windows
+
+package positions
+
+import (
+	"os"
+)
+
+// Inode is not available on Windows; positions are matched by path and
+// size only.
+func Inode(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
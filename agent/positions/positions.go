@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: MIT
+
+// Package positions persists file read offsets so tailing can resume where
+// it left off after a restart.
+package positions
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/kolapsis/shm-agent/agent/atomicfile"
+)
+
+// Entry is the saved read position of a file.
+type Entry struct {
+	Path   string `json:"path"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// storedPositions is the JSON structure of the positions file.
+type storedPositions struct {
+	Positions []Entry `json:"positions"`
+}
+
+// Store holds file positions keyed by path.
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+// Open loads the positions file at path. A missing file yields an empty store.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		entries: make(map[string]Entry),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading positions file: %w", err)
+	}
+
+	var stored storedPositions
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("parsing positions file: %w", err)
+	}
+
+	for _, e := range stored.Positions {
+		s.entries[e.Path] = e
+	}
+
+	return s, nil
+}
+
+// Path returns the location of the positions file.
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Resume returns the offset to resume reading path from.
+// It returns false if no position is saved, if the file was replaced since
+// (different inode), or if it was truncated below the saved offset.
+func (s *Store) Resume(path string) (int64, bool) {
+	s.mu.Lock()
+	e, ok := s.entries[path]
+	s.mu.Unlock()
+
+	if !ok {
+		return 0, false
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+
+	if inode, ok := Inode(info); ok && inode != e.Inode {
+		return 0, false
+	}
+
+	if info.Size() < e.Offset {
+		return 0, false
+	}
+
+	return e.Offset, true
+}
+
+// Set records the offset of path, along with the inode of the file
+// currently at that path.
+func (s *Store) Set(path string, offset int64) {
+	var inode uint64
+	if info, err := os.Stat(path); err == nil {
+		inode, _ = Inode(info)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[path] = Entry{Path: path, Inode: inode, Offset: offset}
+}
+
+// Remove forgets the position of path.
+func (s *Store) Remove(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, path)
+}
+
+// Retain forgets the positions of all paths not in paths, so files that are
+// no longer tailed do not accumulate.
+func (s *Store) Retain(paths []string) {
+	keep := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		keep[p] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for p := range s.entries {
+		if !keep[p] {
+			delete(s.entries, p)
+		}
+	}
+}
+
+// Save writes the positions file atomically.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	stored := storedPositions{Positions: make([]Entry, 0, len(s.entries))}
+	for _, e := range s.entries {
+		stored.Positions = append(stored.Positions, e)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(stored.Positions, func(i, j int) bool {
+		return stored.Positions[i].Path < stored.Positions[j].Path
+	})
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling positions: %w", err)
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("creating positions directory: %w", err)
+	}
+
+	if err := atomicfile.Write(s.path, data, 0600); err != nil {
+		return fmt.Errorf("writing positions file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: MIT
+
+package positions
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore_SaveAndResume(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	storePath := filepath.Join(dir, "positions.json")
+
+	if err := os.WriteFile(logPath, []byte("line1\nline2\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	s, err := Open(storePath)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	if _, ok := s.Resume(logPath); ok {
+		t.Error("Resume() on empty store should return false")
+	}
+
+	s.Set(logPath, 6)
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	reopened, err := Open(storePath)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	offset, ok := reopened.Resume(logPath)
+	if !ok || offset != 6 {
+		t.Errorf("Resume() = %d, %v, want 6, true", offset, ok)
+	}
+}
+
+func TestStore_ResumeAfterTruncate(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+
+	if err := os.WriteFile(logPath, []byte("line1\nline2\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	s, err := Open(filepath.Join(dir, "positions.json"))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	s.Set(logPath, 12)
+
+	if err := os.Truncate(logPath, 0); err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+
+	if _, ok := s.Resume(logPath); ok {
+		t.Error("Resume() after truncation should return false")
+	}
+}
+
+func TestStore_ResumeAfterReplace(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+
+	if err := os.WriteFile(logPath, []byte("line1\nline2\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	s, err := Open(filepath.Join(dir, "positions.json"))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	s.Set(logPath, 6)
+
+	// Rotate: the path now points to a different file
+	if err := os.Rename(logPath, logPath+".1"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	if err := os.WriteFile(logPath, []byte("new file content\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	if _, ok := s.Resume(logPath); ok {
+		t.Error("Resume() after file replacement should return false")
+	}
+}
+
+func TestOpen_InvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "positions.json")
+	if err := os.WriteFile(path, []byte("not json"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	if _, err := Open(path); err == nil {
+		t.Error("Open() should return error for invalid JSON")
+	}
+}
@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestAgent_ResumesFromSavedPositions(t *testing.T) {
+	server := newTestServer(t)
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+
+	if err := os.WriteFile(logPath, []byte("{}\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cfg := &config.Config{
+		ServerURL:     server.URL,
+		IdentityFile:  filepath.Join(dir, "identity.json"),
+		PositionsFile: filepath.Join(dir, "positions.json"),
+		AppName:       "test-app",
+		AppVersion:    "1.0.0",
+		Environment:   "test",
+		Interval:      time.Hour,
+		Sources: []config.Source{
+			{
+				Path:   logPath,
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+				},
+			},
+		},
+	}
+
+	appendLine := func() {
+		f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("OpenFile() error = %v", err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString("{}\n"); err != nil {
+			t.Fatalf("WriteString() error = %v", err)
+		}
+	}
+
+	// First run: starts at the end, sees one new line
+	first, err := New(Options{Config: cfg})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := first.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	appendLine()
+	time.Sleep(200 * time.Millisecond)
+	if v := first.Metrics()["requests"].(float64); v != 1 {
+		t.Errorf("first run requests = %v, want 1", v)
+	}
+	if err := first.Stop(0); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	// Written while the agent is down
+	appendLine()
+	appendLine()
+
+	second, err := New(Options{Config: cfg})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := second.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if v := second.Metrics()["requests"].(float64); v != 2 {
+		t.Errorf("second run requests = %v, want 2 (lines written while down)", v)
+	}
+	if err := second.Stop(0); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+}
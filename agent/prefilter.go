@@ -0,0 +1,45 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+// linePrefilter keeps the raw lines of a source's prefilter. A nil
+// prefilter keeps every line.
+type linePrefilter struct {
+	contains string
+	regex    *regexp.Regexp
+}
+
+// newLinePrefilter returns the prefilter of a source, or nil when unset.
+func newLinePrefilter(cfg *config.PrefilterConfig) (*linePrefilter, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	f := &linePrefilter{contains: cfg.Contains}
+	if cfg.Regex != "" {
+		re, err := regexp.Compile(cfg.Regex)
+		if err != nil {
+			return nil, err
+		}
+		f.regex = re
+	}
+	return f, nil
+}
+
+// keep reports whether the line is parsed.
+func (f *linePrefilter) keep(line string) bool {
+	switch {
+	case f == nil:
+		return true
+	case f.regex != nil:
+		return f.regex.MatchString(line)
+	default:
+		return strings.Contains(line, f.contains)
+	}
+}
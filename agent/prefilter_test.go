@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestAgent_Prefilter(t *testing.T) {
+	cfg := &config.Config{
+		AppName: "test-app",
+		Sources: []config.Source{
+			{
+				Path:      "/var/log/app.log",
+				Format:    "json",
+				Prefilter: &config.PrefilterConfig{Contains: "ERROR"},
+				Metrics: []config.Metric{
+					{Name: "errors", Type: "counter"},
+				},
+			},
+			{
+				Path:      "/var/log/other.log",
+				Format:    "json",
+				Prefilter: &config.PrefilterConfig{Regex: `"status":\s*5\d\d`},
+				Metrics: []config.Metric{
+					{Name: "server_errors", Type: "counter"},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	for _, line := range []string{`{"level": "INFO"}`, `{"level": "ERROR"}`, `not json, ERROR`, `{"level": "error"}`} {
+		ag.ProcessLine(0, line)
+	}
+	for _, line := range []string{`{"status": 200}`, `{"status": 503}`, `{"status": 500}`} {
+		ag.ProcessLine(1, line)
+	}
+
+	metrics := ag.Metrics()
+	if metrics["errors"] != float64(1) || metrics["server_errors"] != float64(2) {
+		t.Errorf("errors = %v, server_errors = %v, want 1 and 2", metrics["errors"], metrics["server_errors"])
+	}
+	st := ag.Stats().Sources[0]
+	if st.LinesPrefiltered != 2 || st.LinesParsed != 1 || st.ParseErrors != 1 {
+		t.Errorf("prefiltered %d, parsed %d, parse errors %d, want 2, 1 and 1", st.LinesPrefiltered, st.LinesParsed, st.ParseErrors)
+	}
+
+	ex, err := Explain(cfg, 0, `{"level": "INFO"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ex.Prefiltered || ex.Parsed {
+		t.Errorf("Explain() prefiltered = %v, parsed = %v, want true and false", ex.Prefiltered, ex.Parsed)
+	}
+}
@@ -0,0 +1,289 @@
+// SPDX-License-Identifier: MIT
+
+// Package prometheus exposes aggregated metrics in the Prometheus text
+// exposition format.
+//
+// The aggregator resets counters, sums and sets at every snapshot, whereas
+// Prometheus expects counters to only go up. The Exporter therefore
+// accumulates the snapshots it receives: counters and sums are exposed as
+// running totals, gauges with their last value, and sets as a gauge holding
+// the number of unique values seen during the last interval. Percentiles
+// are exposed as summaries: quantiles of the last interval with running
+// _count and _sum totals. Counter_by metrics are counters with a series
+// per value, labeled with the field counted.
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+)
+
+// ContentType is the content type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// TypeFunc returns the type of a metric.
+type TypeFunc func(name string) (aggregator.MetricType, bool)
+
+// family holds the exported series of one metric.
+type family struct {
+	typ    aggregator.MetricType
+	series map[string]*sample // keyed by encoded labels
+}
+
+// sample is one exported series.
+type sample struct {
+	suffix string // name suffix, e.g. _count for summaries
+	labels string // encoded label set, e.g. {method="GET"}
+	value  float64
+}
+
+// Exporter accumulates snapshots and renders them for Prometheus.
+type Exporter struct {
+	types TypeFunc
+
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// New creates an Exporter. types is typically Aggregator.GetMetricType.
+func New(types TypeFunc) *Exporter {
+	return &Exporter{
+		types:    types,
+		families: make(map[string]*family),
+	}
+}
+
+// Name returns "prometheus".
+func (e *Exporter) Name() string {
+	return "prometheus"
+}
+
+// Send merges a snapshot into the exported state.
+func (e *Exporter) Send(_ context.Context, metrics map[string]interface{}) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for name, value := range metrics {
+		typ, ok := e.types(name)
+		if !ok {
+			continue
+		}
+
+		f, ok := e.families[name]
+		if !ok || f.typ != typ {
+			f = &family{typ: typ, series: make(map[string]*sample)}
+			e.families[name] = f
+		}
+
+		if typ == aggregator.Percentile {
+			f.addSummary(value)
+			continue
+		}
+
+		cumulative := typ == aggregator.Counter || typ == aggregator.Sum || typ == aggregator.CounterBy
+		if !cumulative {
+			// Gauges and sets describe the current state only
+			f.series = make(map[string]*sample)
+		}
+
+		for _, s := range aggregator.SeriesOf(value) {
+			f.add("", encodeLabels(s.Labels), toFloat(s.Value), cumulative)
+		}
+	}
+
+	// Stop exporting metrics that were unregistered
+	for name := range e.families {
+		if _, ok := e.types(name); !ok {
+			delete(e.families, name)
+		}
+	}
+
+	return nil
+}
+
+// addSummary merges the distributions of a percentile metric. Quantiles
+// are replaced, counts and sums accumulated.
+func (f *family) addSummary(value interface{}) {
+	for key, s := range f.series {
+		if s.suffix == "" {
+			delete(f.series, key)
+		}
+	}
+
+	var series []aggregator.Series
+	switch v := value.(type) {
+	case []aggregator.Series:
+		series = v
+	case aggregator.Distribution:
+		series = []aggregator.Series{{Value: v}}
+	}
+
+	for _, s := range series {
+		d, ok := s.Value.(aggregator.Distribution)
+		if !ok {
+			continue
+		}
+		labels := encodeLabels(s.Labels)
+		f.add("_count", labels, d["count"], true)
+		f.add("_sum", labels, d["sum"], true)
+
+		for name, v := range d {
+			q, err := strconv.ParseFloat(strings.TrimPrefix(name, "p"), 64)
+			if !strings.HasPrefix(name, "p") || err != nil {
+				continue
+			}
+			withQuantile := make(map[string]string, len(s.Labels)+1)
+			for k, v := range s.Labels {
+				withQuantile[k] = v
+			}
+			withQuantile["quantile"] = strconv.FormatFloat(math.Round(q*1e4)/1e6, 'f', -1, 64)
+			f.add("", encodeLabels(withQuantile), v, false)
+		}
+	}
+}
+
+// add records a value for the series with the given name suffix and labels.
+func (f *family) add(suffix, labels string, value float64, cumulative bool) {
+	key := suffix + labels
+	s, ok := f.series[key]
+	if !ok {
+		s = &sample{suffix: suffix, labels: labels}
+		f.series[key] = s
+	}
+	if cumulative {
+		s.value += value
+	} else {
+		s.value = value
+	}
+}
+
+// Write renders the exported metrics in the text exposition format.
+func (e *Exporter) Write(w io.Writer) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	names := make([]string, 0, len(e.families))
+	for name := range e.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		f := e.families[name]
+		metricName := sanitizeName(name)
+
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", metricName, promType(f.typ))
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := f.series[key]
+			fmt.Fprintf(&buf, "%s%s%s %s\n", metricName, s.suffix, s.labels, formatFloat(s.value))
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ServeHTTP serves the metrics page.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	e.Write(w)
+}
+
+// promType maps a metric type to its Prometheus type.
+func promType(typ aggregator.MetricType) string {
+	switch typ {
+	case aggregator.Counter, aggregator.Sum, aggregator.CounterBy:
+		return "counter"
+	case aggregator.Percentile:
+		return "summary"
+	default:
+		return "gauge"
+	}
+}
+
+// toFloat converts an exported metric value to float64, 0 when it is not
+// a number. Unlike aggregator.Float, it keeps NaN and infinities, which
+// the exposition format supports.
+func toFloat(v interface{}) float64 {
+	f, _ := aggregator.Float(v)
+	return f
+}
+
+// formatFloat formats a sample value.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// encodeLabels renders a label set as {a="1",b="2"} with sorted names.
+func encodeLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(sanitizeLabelName(name))
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(labels[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sanitizeName replaces characters that are not valid in a metric name.
+func sanitizeName(name string) string {
+	return sanitize(name, true)
+}
+
+// sanitizeLabelName replaces characters that are not valid in a label name.
+func sanitizeLabelName(name string) string {
+	return sanitize(name, false)
+}
+
+func sanitize(name string, allowColon bool) string {
+	var b strings.Builder
+	for i, r := range name {
+		valid := r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+			i > 0 && r >= '0' && r <= '9' || allowColon && r == ':'
+		if valid {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
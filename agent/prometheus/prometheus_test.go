@@ -0,0 +1,138 @@
+// SPDX-License-Identifier: MIT
+
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+)
+
+func newTestExporter() (*Exporter, *aggregator.Aggregator) {
+	agg := aggregator.New()
+	agg.Register("requests", aggregator.Counter)
+	agg.Register("bytes", aggregator.Sum)
+	agg.Register("sessions", aggregator.Gauge)
+	agg.Register("users", aggregator.Set)
+	agg.RegisterLabeled("http_requests", aggregator.Counter, []string{"method", "path"}, 0)
+	agg.Register("requests_by_status", aggregator.CounterBy)
+	agg.SetCountKey("requests_by_status", "status")
+	return New(agg.GetMetricType), agg
+}
+
+func TestExporter_Accumulates(t *testing.T) {
+	e, agg := newTestExporter()
+
+	for i := 0; i < 2; i++ {
+		agg.Inc("requests")
+		agg.Add("bytes", 100)
+		agg.SetGauge("sessions", float64(10+i))
+		agg.AddToSet("users", "alice")
+		agg.IncLabeled("http_requests", []string{"GET", `/a"b`})
+		agg.CountLabeled("requests_by_status", nil, "200", 1)
+		e.Send(context.Background(), agg.Snapshot())
+	}
+
+	var b strings.Builder
+	if err := e.Write(&b); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	want := `# TYPE bytes counter
+bytes 200
+# TYPE http_requests counter
+http_requests{method="GET",path="/a\"b"} 2
+# TYPE requests counter
+requests 2
+# TYPE requests_by_status counter
+requests_by_status{status="200"} 2
+# TYPE sessions gauge
+sessions 11
+# TYPE users gauge
+users 1
+`
+	if got := b.String(); got != want {
+		t.Errorf("Write() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestExporter_ForgetsUnregistered(t *testing.T) {
+	e, agg := newTestExporter()
+
+	agg.Inc("requests")
+	agg.Add("bytes", 100)
+	e.Send(context.Background(), agg.Snapshot())
+
+	agg.Unregister("bytes")
+	e.Send(context.Background(), agg.Snapshot())
+
+	var b strings.Builder
+	e.Write(&b)
+	if strings.Contains(b.String(), "bytes") {
+		t.Errorf("unregistered metric still exported:\n%s", b.String())
+	}
+}
+
+func TestExporter_Summary(t *testing.T) {
+	agg := aggregator.New()
+	agg.RegisterLabeled("latency", aggregator.Percentile, []string{"method"}, 0)
+	agg.SetQuantiles("latency", []float64{0.5, 0.999})
+	e := New(agg.GetMetricType)
+
+	for i := 0; i < 2; i++ {
+		agg.ObserveLabeled("latency", []string{"GET"}, 10)
+		e.Send(context.Background(), agg.Snapshot())
+	}
+
+	var b strings.Builder
+	if err := e.Write(&b); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	want := `# TYPE latency summary
+latency_count{method="GET"} 2
+latency_sum{method="GET"} 20
+latency{method="GET",quantile="0.5"} 10
+latency{method="GET",quantile="0.999"} 10
+`
+	if got := b.String(); got != want {
+		t.Errorf("Write() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestExporter_ServeHTTP(t *testing.T) {
+	e, agg := newTestExporter()
+	agg.Inc("requests")
+	e.Send(context.Background(), agg.Snapshot())
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("Content-Type = %q, want %q", ct, ContentType)
+	}
+	if !strings.Contains(rec.Body.String(), "requests 1\n") {
+		t.Errorf("body = %q, want requests 1", rec.Body.String())
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	tests := map[string]string{
+		"http_requests": "http_requests",
+		"api.latency":   "api_latency",
+		"9lives":        "_lives",
+		"ns:metric":     "ns:metric",
+	}
+	for in, want := range tests {
+		if got := sanitizeName(in); got != want {
+			t.Errorf("sanitizeName(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if got := sanitizeLabelName("ns:label"); got != "ns_label" {
+		t.Errorf("sanitizeLabelName() = %q, want %q", got, "ns_label")
+	}
+}
@@ -0,0 +1,145 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+// queuedRecord is a record waiting for a worker.
+type queuedRecord struct {
+	line string
+	lc   lineContext
+}
+
+// recordQueue hands the records of a source to a pool of workers. When
+// the queue is full, readers block, slowing down the tailers of a source
+// that cannot keep up, or records are dropped, as set by on_overflow.
+type recordQueue struct {
+	records  chan queuedRecord
+	handle   func(string, lineContext)
+	overflow string // on_overflow
+	workers  sync.WaitGroup
+
+	// mu is held for reading while a record is queued, and for writing to
+	// close the queue.
+	mu     sync.RWMutex
+	closed bool
+
+	// pending counts the records queued or being handled; idle is
+	// signalled when it drops to zero.
+	pendingMu sync.Mutex
+	idle      *sync.Cond
+	pending   int
+
+	full    atomic.Int64 // records read while the queue was full
+	dropped atomic.Int64 // records dropped on overflow or once the queue was closed
+}
+
+// newRecordQueue starts workers handling the queued records with handle.
+func newRecordQueue(workers, size int, overflow string, handle func(string, lineContext)) *recordQueue {
+	q := &recordQueue{
+		records:  make(chan queuedRecord, size),
+		handle:   handle,
+		overflow: overflow,
+	}
+	q.idle = sync.NewCond(&q.pendingMu)
+	q.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// work handles queued records until the queue is closed.
+func (q *recordQueue) work() {
+	defer q.workers.Done()
+	for r := range q.records {
+		q.handle(r.line, r.lc)
+		q.done()
+	}
+}
+
+// done ends the handling of a record.
+func (q *recordQueue) done() {
+	q.pendingMu.Lock()
+	q.pending--
+	if q.pending == 0 {
+		q.idle.Broadcast()
+	}
+	q.pendingMu.Unlock()
+}
+
+// push queues a record. When the queue is full, it waits for room, drops
+// the oldest queued record or drops the record, depending on the overflow
+// policy. Records pushed once the queue is closed are dropped.
+func (q *recordQueue) push(line string, lc lineContext) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		q.dropped.Add(1)
+		return
+	}
+
+	q.pendingMu.Lock()
+	q.pending++
+	q.pendingMu.Unlock()
+
+	r := queuedRecord{line: line, lc: lc}
+	select {
+	case q.records <- r:
+		return
+	default:
+	}
+
+	q.full.Add(1)
+	switch q.overflow {
+	case config.OverflowDropNewest:
+		q.dropped.Add(1)
+		q.done()
+	case config.OverflowDropOldest:
+		for {
+			select {
+			case <-q.records:
+				q.dropped.Add(1)
+				q.done()
+			default:
+			}
+			select {
+			case q.records <- r:
+				return
+			default: // refilled by another reader
+			}
+		}
+	default:
+		q.records <- r
+	}
+}
+
+// wait blocks until every queued record is handled.
+func (q *recordQueue) wait() {
+	q.pendingMu.Lock()
+	defer q.pendingMu.Unlock()
+	for q.pending > 0 {
+		q.idle.Wait()
+	}
+}
+
+// close handles the queued records and stops the workers.
+func (q *recordQueue) close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.records)
+	}
+	q.mu.Unlock()
+	q.workers.Wait()
+}
+
+// length returns the number of records waiting for a worker.
+func (q *recordQueue) length() int {
+	return len(q.records)
+}
@@ -0,0 +1,171 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestRecordQueue(t *testing.T) {
+	var handled atomic.Int64
+	release := make(chan struct{})
+	q := newRecordQueue(2, 1, config.OverflowBlock, func(string, lineContext) {
+		<-release
+		handled.Add(1)
+	})
+
+	// Two records are held by the workers and one fills the queue, so
+	// the next one waits for room
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 4; i++ {
+			q.push("line", lineContext{})
+		}
+		close(done)
+	}()
+	for i := 0; i < 4; i++ {
+		release <- struct{}{}
+	}
+	<-done
+	q.wait()
+	if got := handled.Load(); got != 4 {
+		t.Errorf("handled %d records, want 4", got)
+	}
+	if q.full.Load() == 0 {
+		t.Error("no record waited for room in a full queue")
+	}
+
+	close(release)
+	q.push("queued before close", lineContext{})
+	q.close()
+	q.push("after close", lineContext{})
+	if got := handled.Load(); got != 5 {
+		t.Errorf("handled %d records after close, want 5", got)
+	}
+	if got := q.dropped.Load(); got != 1 {
+		t.Errorf("dropped = %d, want 1", got)
+	}
+}
+
+func TestRecordQueue_Overflow(t *testing.T) {
+	for _, tt := range []struct {
+		overflow string
+		want     []string
+	}{
+		{config.OverflowDropNewest, []string{"held", "1", "2"}},
+		{config.OverflowDropOldest, []string{"held", "3", "4"}},
+	} {
+		t.Run(tt.overflow, func(t *testing.T) {
+			var mu sync.Mutex
+			var handled []string
+			started := make(chan struct{})
+			release := make(chan struct{})
+			q := newRecordQueue(1, 2, tt.overflow, func(line string, _ lineContext) {
+				if line == "held" {
+					close(started)
+					<-release
+				}
+				mu.Lock()
+				handled = append(handled, line)
+				mu.Unlock()
+			})
+
+			// The worker holds the first record while the others fill
+			// and overflow the queue, without blocking the reader
+			q.push("held", lineContext{})
+			<-started
+			for _, line := range []string{"1", "2", "3", "4"} {
+				q.push(line, lineContext{})
+			}
+			close(release)
+			q.close()
+
+			if !reflect.DeepEqual(handled, tt.want) {
+				t.Errorf("handled %v, want %v", handled, tt.want)
+			}
+			if q.dropped.Load() != 2 || q.full.Load() != 2 {
+				t.Errorf("dropped = %d, full = %d, want 2 and 2", q.dropped.Load(), q.full.Load())
+			}
+		})
+	}
+}
+
+func TestAgent_DroppedLines(t *testing.T) {
+	cfg := &config.Config{
+		AppName: "test-app",
+		Sources: []config.Source{{
+			Path:       "/var/log/app.log",
+			Format:     "json",
+			QueueSize:  1,
+			OnOverflow: config.OverflowDropNewest,
+			Metrics:    []config.Metric{{Name: "requests", Type: "counter"}},
+		}},
+	}
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ag.Stop(0)
+
+	ag.currentProcessors()[0].queue.dropped.Add(3)
+	ag.recordSelfMetrics()
+	if got := ag.Metrics()[MetricDroppedLines]; got != float64(3) {
+		t.Errorf("%s = %v, want 3", MetricDroppedLines, got)
+	}
+}
+
+func TestAgent_Workers(t *testing.T) {
+	cfg := &config.Config{
+		AppName: "test-app",
+		Sources: []config.Source{
+			{
+				Path:    "/var/log/app.log",
+				Format:  "json",
+				Workers: 4,
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+					{Name: "bytes", Type: "sum", Extract: &config.Extract{Field: "size"}},
+				},
+			},
+			{
+				Path:    "/var/log/stats.csv",
+				Format:  "csv",
+				CSV:     &config.CSVConfig{Delimiter: ",", Header: true},
+				Workers: 4,
+				Metrics: []config.Metric{
+					{Name: "sessions", Type: "sum", Extract: &config.Extract{Field: "scur"}},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ag.Stop(0)
+
+	ag.ProcessLine(1, "# pxname,scur")
+	for i := 1; i <= 1000; i++ {
+		ag.ProcessLine(0, fmt.Sprintf(`{"size": %d}`, i))
+		ag.ProcessLine(1, fmt.Sprintf("web,%d", i%3))
+	}
+	ag.Flush()
+
+	got := ag.Metrics()
+	if got["requests"] != float64(1000) || got["bytes"] != float64(500500) {
+		t.Errorf("requests = %v, bytes = %v, want 1000 and 500500", got["requests"], got["bytes"])
+	}
+	if got["sessions"] != float64(1000) {
+		t.Errorf("sessions = %v, want 1000", got["sessions"])
+	}
+	if st := ag.Stats().Sources[0]; st.LinesParsed != 1000 || st.LinesDropped != 0 {
+		t.Errorf("parsed = %d, dropped = %d, want 1000 and 0", st.LinesParsed, st.LinesDropped)
+	}
+}
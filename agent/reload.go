@@ -0,0 +1,253 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/gelf"
+	"github.com/kolapsis/shm-agent/agent/journald"
+	"github.com/kolapsis/shm-agent/agent/tailer"
+)
+
+// Reload applies a new configuration.
+//
+// Sources whose definition is unchanged keep their processor and counters;
+// new sources get tailers and removed sources have theirs stopped. Metrics
+// keep their aggregated values across the reload. Changing the type,
+// labels or max_series of an existing metric, any server setting or the
+// listen address requires a restart.
+func (a *Agent) Reload(cfg *config.Config) error {
+	podFields, podResolved := a.reloadPodMetadata(cfg)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.checkMetricChanges(cfg); err != nil {
+		return err
+	}
+
+	old := a.Config()
+	if serverSettingsChanged(old, cfg) {
+		a.logger.Warn("server or listener settings changed, restart the agent to apply them")
+	}
+
+	oldProcessors := make(map[string]*sourceProcessor)
+	for _, proc := range a.currentProcessors() {
+		oldProcessors[proc.key] = proc
+	}
+
+	// Metrics are only registered once every new source was built, so that
+	// a failed reload leaves the aggregator as it was
+	var processors, created []*sourceProcessor
+	for i := range cfg.Sources {
+		src := &cfg.Sources[i]
+		if proc, ok := oldProcessors[sourceKey(src)]; ok && reflect.DeepEqual(*proc.source, *src) {
+			processors = append(processors, proc)
+			continue
+		}
+
+		proc, err := buildSourceProcessor(src, a.aggregator, a.logger, a.verbosity)
+		if err != nil {
+			for _, proc := range created {
+				proc.close()
+			}
+			return fmt.Errorf("source %s: %w", src.Path, err)
+		}
+		created = append(created, proc)
+		processors = append(processors, proc)
+	}
+	for _, proc := range created {
+		registerMetrics(proc.source, a.aggregator)
+		a.attachPodFields(proc)
+		a.attachEventWindows(proc)
+		a.attachLineSamples(proc)
+		a.attachMatchedLines(proc)
+	}
+
+	a.events.configure(cfg)
+
+	a.procMu.Lock()
+	a.cfg = cfg
+	a.processors = processors
+	a.procMu.Unlock()
+
+	kept := make(map[*sourceProcessor]bool, len(processors))
+	for _, proc := range processors {
+		kept[proc] = true
+	}
+	for _, proc := range oldProcessors {
+		if !kept[proc] {
+			proc.close()
+		}
+	}
+
+	a.history.resize(cfg.History)
+
+	if removed := a.aggregator.Prune(metricNames(cfg)); len(removed) > 0 {
+		a.logger.Info("removed metrics no longer configured", "metrics", removed)
+	}
+
+	a.logger.Info("configuration reloaded", "sources", len(processors))
+
+	podMetadataChanged := !reflect.DeepEqual(old.KubernetesMetadata, cfg.KubernetesMetadata)
+	if podMetadataChanged {
+		a.podFields.Store(nil)
+	}
+
+	if !a.running {
+		return nil
+	}
+
+	if podMetadataChanged {
+		if !podResolved {
+			// The agent started while the metadata was being resolved
+			podFields = a.podMetadata(a.run.ctx, cfg)
+		}
+		a.podFields.Store(podFields)
+	}
+
+	a.stopRemovedTailers(processors)
+
+	if err := a.discover(a.run.ctx, discoverReload); err != nil {
+		return err
+	}
+
+	// Let the loop pick up the new interval
+	select {
+	case a.reloaded <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// metricNames returns a function reporting whether a metric is defined by
+// cfg, self metrics included when enabled.
+func metricNames(cfg *config.Config) func(name string) bool {
+	names := make(map[string]bool)
+	for _, src := range cfg.Sources {
+		for _, m := range src.Metrics {
+			names[m.Name] = true
+		}
+	}
+	selfMetrics := cfg.SelfMetricsEnabled()
+	return func(name string) bool {
+		return names[name] || (selfMetrics && strings.HasPrefix(name, config.SelfMetricPrefix))
+	}
+}
+
+// checkMetricChanges rejects configurations that redefine the type, labels
+// or max_series of an already registered metric.
+func (a *Agent) checkMetricChanges(cfg *config.Config) error {
+	for _, src := range cfg.Sources {
+		for _, m := range src.Metrics {
+			typ, ok := a.aggregator.GetMetricType(m.Name)
+			if !ok {
+				continue
+			}
+			if typ != aggregatorType(&m) {
+				return fmt.Errorf("metric %s: type changed from %s to %s, restart required", m.Name, typ, m.Type)
+			}
+			labels, _ := a.aggregator.GetMetricLabels(m.Name)
+			if !slices.Equal(labels, m.Labels) {
+				return fmt.Errorf("metric %s: labels changed, restart required", m.Name)
+			}
+			maxSeries, _ := a.aggregator.GetMetricMaxSeries(m.Name)
+			if want := m.MaxSeries; maxSeries != want && (want > 0 || maxSeries != aggregator.DefaultMaxSeries) {
+				return fmt.Errorf("metric %s: max_series changed, restart required", m.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// stopRemovedTailers stops the tailers of sources that are no longer
+// configured.
+func (a *Agent) stopRemovedTailers(processors []*sourceProcessor) {
+	keep := make(map[string]bool, len(processors))
+	for _, proc := range processors {
+		keep[proc.key] = true
+	}
+
+	a.tailersMu.Lock()
+	var removed []*tailer.Tailer
+	for key, t := range a.tailers {
+		if !keep[key.source] {
+			removed = append(removed, t)
+			delete(a.tailers, key)
+		}
+	}
+	var removedJournals []*journald.Reader
+	for key, r := range a.journals {
+		if !keep[key] {
+			removedJournals = append(removedJournals, r)
+			delete(a.journals, key)
+		}
+	}
+	var removedGELFs []*gelf.Listener
+	for key, l := range a.gelfs {
+		if !keep[key] {
+			removedGELFs = append(removedGELFs, l)
+			delete(a.gelfs, key)
+		}
+	}
+	for key := range a.kube {
+		if !keep[key] {
+			delete(a.kube, key)
+		}
+	}
+	for key := range a.parked {
+		if !keep[key.source] {
+			delete(a.parked, key)
+		}
+	}
+	a.tailersMu.Unlock()
+
+	for _, t := range removed {
+		if err := t.Stop(); err != nil {
+			a.logger.Error("error stopping tailer", "path", t.Path(), "error", err)
+		}
+	}
+	for _, r := range removedJournals {
+		r.Stop()
+	}
+	for _, l := range removedGELFs {
+		l.Stop()
+	}
+}
+
+// serverSettingsChanged reports whether settings that are only applied at
+// start differ between two configurations.
+func serverSettingsChanged(old, cfg *config.Config) bool {
+	return old.Offline != cfg.Offline ||
+		!slices.Equal(old.OutputNames(), cfg.OutputNames()) ||
+		old.OTLP.Endpoint != cfg.OTLP.Endpoint ||
+		!maps.Equal(old.OTLP.Headers, cfg.OTLP.Headers) ||
+		old.OTLP.HTTP != cfg.OTLP.HTTP ||
+		!reflect.DeepEqual(old.StatsD, cfg.StatsD) ||
+		!reflect.DeepEqual(old.InfluxDB, cfg.InfluxDB) ||
+		!reflect.DeepEqual(old.Kafka, cfg.Kafka) ||
+		old.File != cfg.File ||
+		old.ServerURL != cfg.ServerURL ||
+		old.AppName != cfg.AppName ||
+		old.AppVersion != cfg.AppVersion ||
+		old.Environment != cfg.Environment ||
+		!maps.Equal(old.Tags, cfg.Tags) ||
+		old.HostMetadataEnabled() != cfg.HostMetadataEnabled() ||
+		old.IdentityFile != cfg.IdentityFile ||
+		old.SequenceFile != cfg.SequenceFile ||
+		old.IdentityEncryption != cfg.IdentityEncryption ||
+		old.MaxPayloadSize != cfg.MaxPayloadSize ||
+		old.SnapshotFormat != cfg.SnapshotFormat ||
+		old.HTTP != cfg.HTTP ||
+		old.Auth != cfg.Auth ||
+		old.TLS != cfg.TLS ||
+		old.ListenAddr != cfg.ListenAddr
+}
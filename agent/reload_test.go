@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+// reloadTestConfig returns a config with one JSON source per path.
+func reloadTestConfig(paths ...string) *config.Config {
+	cfg := &config.Config{
+		ServerURL:   "https://example.com",
+		AppName:     "test-app",
+		AppVersion:  "1.0.0",
+		Environment: "test",
+		Interval:    time.Hour,
+	}
+	for _, path := range paths {
+		cfg.Sources = append(cfg.Sources, config.Source{
+			Path:   path,
+			Format: "json",
+			Metrics: []config.Metric{
+				{Name: "requests", Type: "counter"},
+			},
+		})
+	}
+	return cfg
+}
+
+func TestAgent_Reload(t *testing.T) {
+	dir := t.TempDir()
+	pathA := filepath.Join(dir, "a.log")
+	pathB := filepath.Join(dir, "b.log")
+
+	for _, path := range []string{pathA, pathB} {
+		if err := os.WriteFile(path, []byte{}, 0644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	ag, err := New(Options{Config: reloadTestConfig(pathA), DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer ag.Stop(0)
+
+	ag.ProcessLine(0, `{}`)
+
+	// Add a source and a metric
+	cfg := reloadTestConfig(pathA, pathB)
+	cfg.Sources[0].Metrics = append(cfg.Sources[0].Metrics, config.Metric{
+		Name: "errors",
+		Type: "counter",
+	})
+
+	if err := ag.Reload(cfg); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	metrics := ag.Metrics()
+	if v := metrics["requests"].(float64); v != 1 {
+		t.Errorf("requests after reload = %v, want 1 (kept)", v)
+	}
+	if _, ok := metrics["errors"]; !ok {
+		t.Error("errors metric should be registered after reload")
+	}
+
+	ag.tailersMu.Lock()
+	tailers := len(ag.tailers)
+	ag.tailersMu.Unlock()
+
+	if tailers != 2 {
+		t.Errorf("tailers after reload = %d, want 2", tailers)
+	}
+
+	// Remove the first source
+	if err := ag.Reload(reloadTestConfig(pathB)); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	ag.tailersMu.Lock()
+	_, stillTailed := ag.tailers[tailerKey{source: sourceKey(&cfg.Sources[0]), path: pathA}]
+	tailers = len(ag.tailers)
+	ag.tailersMu.Unlock()
+
+	if stillTailed || tailers != 1 {
+		t.Errorf("tailers after removal = %d (a.log tailed: %v), want 1", tailers, stillTailed)
+	}
+	if _, ok := ag.Metrics()["errors"]; ok {
+		t.Error("errors metric should be unregistered once removed from the config")
+	}
+}
+
+func TestAgent_ReloadRejectsTypeChange(t *testing.T) {
+	ag, err := New(Options{Config: reloadTestConfig("/var/log/test.log"), DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	cfg := reloadTestConfig("/var/log/test.log")
+	cfg.Sources[0].Metrics[0].Type = "sum"
+	cfg.Sources[0].Metrics[0].Extract = &config.Extract{Field: "bytes"}
+
+	if err := ag.Reload(cfg); err == nil {
+		t.Error("Reload() should reject a metric type change")
+	}
+
+	if got := ag.Config().Sources[0].Metrics[0].Type; got != "counter" {
+		t.Errorf("config after rejected reload has type %q, want counter", got)
+	}
+}
+
+func TestAgent_ReloadRejectsMaxSeriesChange(t *testing.T) {
+	cfg := reloadTestConfig("/var/log/test.log")
+	cfg.Sources[0].Metrics[0].Labels = []string{"method"}
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	// The default cap is the same as an unset one
+	same := reloadTestConfig("/var/log/test.log")
+	same.Sources[0].Metrics[0].Labels = []string{"method"}
+	same.Sources[0].Metrics[0].MaxSeries = config.DefaultMaxSeries
+	if err := ag.Reload(same); err != nil {
+		t.Errorf("Reload() with the default max_series error = %v", err)
+	}
+
+	changed := reloadTestConfig("/var/log/test.log")
+	changed.Sources[0].Metrics[0].Labels = []string{"method"}
+	changed.Sources[0].Metrics[0].MaxSeries = 10
+	if err := ag.Reload(changed); err == nil {
+		t.Error("Reload() should reject a max_series change")
+	}
+}
+
+func TestAgent_ReloadFailureRegistersNothing(t *testing.T) {
+	ag, err := New(Options{Config: reloadTestConfig("/var/log/test.log"), DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	// The second source fails to build after the first one was built
+	cfg := reloadTestConfig("/var/log/test.log", "/var/log/other.log", "/var/log/bad.log")
+	cfg.Sources[1].Metrics[0].Name = "other_requests"
+	cfg.Sources[2].Metrics[0].Name = "bad_requests"
+	cfg.Sources[2].PathPattern = "("
+	if err := ag.Reload(cfg); err == nil {
+		t.Fatal("Reload() should fail on an invalid path_pattern")
+	}
+	for _, name := range []string{"other_requests", "bad_requests"} {
+		if _, ok := ag.aggregator.GetMetricType(name); ok {
+			t.Errorf("%s is registered after a failed reload", name)
+		}
+	}
+}
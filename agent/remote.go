@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/atomicfile"
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+// ConfigLoader loads the configuration with the document served by the
+// server, as config.LoadOptions.Remote.
+type ConfigLoader func(remote []byte) (*config.Config, error)
+
+// RemoteConfigStatus is the state of the configuration served by the
+// server, as reported by /healthz and /readyz.
+type RemoteConfigStatus struct {
+	ETag      string     `json:"etag,omitempty"`       // of the document last fetched
+	AppliedAt *time.Time `json:"applied_at,omitempty"` // when a document was last applied
+	Error     string     `json:"error,omitempty"`      // why the last document was not applied
+}
+
+// pollRemoteConfig fetches the configuration served by the server at
+// every poll interval until ctx is cancelled, and applies it when it
+// changed. The run does not wait for it: a reload waits for a stopping
+// agent, which would otherwise wait for the reload.
+func (a *Agent) pollRemoteConfig(ctx context.Context) {
+	var etag string
+	for {
+		if a.Config().RemoteEnabled() {
+			var done bool
+			etag, done = a.checkRemoteConfig(ctx, etag)
+			if done {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(a.Config().Remote.PollInterval):
+		}
+	}
+}
+
+// checkRemoteConfig fetches the configuration unless it is still that of
+// etag, and applies it unless it is the one cached, which the agent was
+// loaded with. It returns the ETag to send next, and true when the server
+// does not serve configurations.
+func (a *Agent) checkRemoteConfig(ctx context.Context, etag string) (string, bool) {
+	rc, err := a.sender.FetchConfig(ctx, etag)
+	switch {
+	case errors.Is(err, sender.ErrConfigNotModified):
+		return etag, false
+	case errors.Is(err, sender.ErrConfigUnsupported):
+		a.logger.Warn("server does not serve configurations, remote_config is ignored")
+		return "", true
+	case err != nil:
+		if ctx.Err() == nil {
+			a.errors.Warn("remote_config", "fetching remote configuration failed", "error", err)
+		}
+		return etag, false
+	}
+
+	status := RemoteConfigStatus{ETag: rc.ETag}
+	if prev := a.remoteConfig.Load(); prev != nil {
+		status.AppliedAt = prev.AppliedAt
+	}
+	defer func() { a.remoteConfig.Store(&status) }()
+
+	path := a.Config().Remote.CacheFile
+	if cached, err := os.ReadFile(path); err == nil && bytes.Equal(cached, rc.Data) {
+		return rc.ETag, false
+	}
+
+	cfg, err := a.loadConfig(rc.Data)
+	if err == nil {
+		err = a.Reload(cfg)
+	}
+	if err != nil {
+		// Not fetched again until it changes
+		status.Error = err.Error()
+		a.logger.Error("remote configuration rejected, keeping current configuration",
+			"etag", rc.ETag, "error", err)
+		return rc.ETag, false
+	}
+
+	now := time.Now()
+	status.AppliedAt = &now
+	a.logger.Info("applied remote configuration", "etag", rc.ETag, "sources", len(cfg.Sources))
+	if err := writeRemoteCache(path, rc.Data); err != nil {
+		a.logger.Warn("failed to cache remote configuration", "file", path, "error", err)
+	}
+	return rc.ETag, false
+}
+
+// writeRemoteCache replaces the cached remote configuration.
+func writeRemoteCache(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("creating remote configuration directory: %w", err)
+	}
+	if err := atomicfile.Write(path, data, 0600); err != nil {
+		return fmt.Errorf("writing remote configuration cache: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/sender/shmtest"
+)
+
+func TestAgent_RemoteConfig(t *testing.T) {
+	srv := shmtest.NewServer()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	for _, name := range []string{"app.log", "worker.log"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(`
+server_url: `+srv.URL+`
+app_name: test-app
+app_version: "1.0.0"
+state_dir: `+dir+`
+positions_file: none
+interval: 1h
+remote_config:
+  enabled: true
+sources:
+  - path: `+filepath.Join(dir, "app.log")+`
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	remote := []byte(`
+sources:
+  - path: ` + filepath.Join(dir, "worker.log") + `
+    format: json
+    metrics:
+      - name: jobs
+        type: counter
+`)
+	srv.SetConfig(remote)
+
+	load := func(remote []byte) (*config.Config, error) {
+		return config.LoadWithOptions(path, config.LoadOptions{Remote: remote})
+	}
+	cfg, err := load(nil)
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	ag, err := NewBuilder(cfg, WithConfigLoader(load)).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer ag.Stop(0)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ag.Config().Sources) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(ag.Config().Sources); n != 2 {
+		t.Fatalf("sources = %d, want the local and the remote one", n)
+	}
+	st := ag.Ready().RemoteConfig
+	for st == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		st = ag.Ready().RemoteConfig
+	}
+	if st == nil || st.ETag == "" || st.AppliedAt == nil || st.Error != "" {
+		t.Errorf("RemoteConfig = %+v, want the document applied", st)
+	}
+	if cached, err := os.ReadFile(cfg.Remote.CacheFile); err != nil || string(cached) != string(remote) {
+		t.Errorf("cache = %q, %v, want the document", cached, err)
+	}
+	if v := srv.Violations(); len(v) > 0 {
+		t.Errorf("violations = %q", v)
+	}
+
+	// A restart loads the cached document
+	restarted, err := load(nil)
+	if err != nil || len(restarted.Sources) != 2 {
+		t.Errorf("loading with the cache: %d sources, %v", len(restarted.Sources), err)
+	}
+
+	// A document that does not load is rejected, keeping the configuration
+	srv.SetConfig([]byte("sources:\n  - path: " + filepath.Join(dir, "worker.log") + "\n    format: nope\n"))
+	etag, _ := ag.checkRemoteConfig(context.Background(), st.ETag)
+	if etag == st.ETag {
+		t.Error("checkRemoteConfig() kept the ETag of the previous document")
+	}
+	if got := ag.Ready().RemoteConfig; got.Error == "" || !got.AppliedAt.Equal(*st.AppliedAt) {
+		t.Errorf("RemoteConfig = %+v, want the error and the previous application time", got)
+	}
+	if n := len(ag.Config().Sources); n != 2 {
+		t.Errorf("sources = %d after a rejected document, want 2", n)
+	}
+}
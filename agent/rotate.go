@@ -0,0 +1,172 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/identity"
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+// pendingIdentitySuffix is appended to the identity file to name where a
+// rotation saves the new identity until the server accepted it.
+const pendingIdentitySuffix = ".pending"
+
+// pendingIdentityTimeout bounds how long the agent checks which key the
+// server holds after an interrupted rotation, when it starts.
+const pendingIdentityTimeout = 30 * time.Second
+
+// RotateIdentity replaces the key of the identity of cfg: it sends a new
+// public key to the server, signed with the current key, then saves the
+// identity with the new key. The instance ID is kept, so the server keeps
+// the history of the instance. It returns the rotated identity.
+//
+// The new identity is first saved next to the identity file, and kept
+// there when the server may have applied it without answering, e.g. on a
+// timeout, so that the new key is never lost. The next rotation, or the
+// next start of the agent, first finds out which key the server holds.
+// A running agent keeps signing with the old key, so it must be stopped
+// during the rotation.
+func RotateIdentity(ctx context.Context, cfg *config.Config, logger *slog.Logger) (*sender.Identity, error) {
+	if cfg.ServerURL == "" {
+		return nil, fmt.Errorf("no server_url configured")
+	}
+	opts, err := identityOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Finish an interrupted rotation rather than losing its key
+	promoted, err := resolvePendingIdentity(ctx, cfg, opts, logger)
+	if err != nil {
+		return nil, err
+	}
+	if promoted != nil {
+		return promoted, nil
+	}
+
+	ident, err := identity.LoadWithOptions(cfg.IdentityFile, opts)
+	if err != nil {
+		return nil, fmt.Errorf("loading identity: %w", err)
+	}
+	key, err := identity.NewKey()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := cfg.IdentityFile + pendingIdentitySuffix
+	if err := identity.SaveWithOptions(pending, ident.WithKey(key), opts); err != nil {
+		return nil, err
+	}
+
+	snd, err := identitySender(cfg, ident, opts, logger)
+	if err != nil {
+		os.Remove(pending)
+		return nil, err
+	}
+	defer snd.Close()
+
+	if err := snd.RotateKey(ctx, key); err != nil {
+		// A rejected request leaves the server with the current key
+		var statusErr *sender.StatusError
+		if errors.Is(err, sender.ErrRotateUnsupported) || errors.As(err, &statusErr) {
+			os.Remove(pending)
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w (the new identity is kept in %s in case the server applied it)", err, pending)
+	}
+	os.Remove(pending)
+	return ident, nil
+}
+
+// resolvePendingIdentity settles a rotation interrupted before the server
+// answered: it checks which of the pending identity and the current one
+// the server accepts, saves it as the identity and removes the pending
+// one. It returns the pending identity if it was promoted, and nil if
+// there was none or the server still holds the current key. It fails when
+// the server cannot tell, leaving both files in place.
+func resolvePendingIdentity(ctx context.Context, cfg *config.Config, opts identity.Options, logger *slog.Logger) (*sender.Identity, error) {
+	pending := cfg.IdentityFile + pendingIdentitySuffix
+	next, err := identity.LoadWithOptions(pending, opts)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading pending identity: %w", err)
+	}
+	current, err := identity.LoadWithOptions(cfg.IdentityFile, opts)
+	if err != nil {
+		return nil, fmt.Errorf("loading identity: %w", err)
+	}
+
+	for _, ident := range []*sender.Identity{next, current} {
+		snd, err := identitySender(cfg, ident, opts, logger)
+		if err != nil {
+			return nil, err
+		}
+		err = snd.CheckKey(ctx)
+		snd.Close()
+
+		var statusErr *sender.StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnauthorized {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("checking the key of pending identity %s: %w", pending, err)
+		}
+
+		if ident == current {
+			logger.Info("server kept the current key, discarding the pending identity", "pending_file", pending)
+			os.Remove(pending)
+			return nil, nil
+		}
+		if err := identity.SaveWithOptions(cfg.IdentityFile, next, opts); err != nil {
+			return nil, err
+		}
+		os.Remove(pending)
+		logger.Info("server holds the key of the pending identity, using it", "pending_file", pending, "public_key", next.PubKeyHex)
+		return next, nil
+	}
+	return nil, fmt.Errorf("server accepts neither the identity nor the pending one in %s", pending)
+}
+
+// settleRotation resolves the pending identity of an interrupted key
+// rotation, if any, within pendingIdentityTimeout.
+func (a *Agent) settleRotation(cfg *config.Config) error {
+	if _, err := os.Stat(cfg.IdentityFile + pendingIdentitySuffix); err != nil {
+		return nil
+	}
+	opts, err := identityOptions(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pendingIdentityTimeout)
+	defer cancel()
+	promoted, err := resolvePendingIdentity(ctx, cfg, opts, a.logger)
+	if promoted != nil {
+		a.forgetIdentity()
+	}
+	return err
+}
+
+// identitySender creates a sender for ident, saving it to the identity
+// file of cfg.
+func identitySender(cfg *config.Config, ident *sender.Identity, opts identity.Options, logger *slog.Logger) (*sender.Sender, error) {
+	scfg, err := senderConfig(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	scfg.Identity = ident
+	scfg.PersistIdentity = func(id *sender.Identity) error {
+		return identity.SaveWithOptions(cfg.IdentityFile, id, opts)
+	}
+	return sender.New(scfg), nil
+}
@@ -0,0 +1,161 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/identity"
+	"github.com/kolapsis/shm-agent/agent/sender"
+	"github.com/kolapsis/shm-agent/agent/sender/shmtest"
+)
+
+func TestRotateIdentity(t *testing.T) {
+	srv := shmtest.NewServer()
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "identity.json")
+	old, err := identity.Generate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{ServerURL: srv.URL, AppName: "test-app", AppVersion: "1.0.0", IdentityFile: path}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	rotated, err := RotateIdentity(context.Background(), cfg, logger)
+	if err != nil {
+		t.Fatalf("RotateIdentity() error = %v", err)
+	}
+	saved, err := identity.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.InstanceID != old.InstanceID || saved.PubKeyHex == old.PubKeyHex || saved.PubKeyHex != rotated.PubKeyHex {
+		t.Errorf("saved identity %s/%s, want instance %s with a new key", saved.InstanceID, saved.PubKeyHex, old.InstanceID)
+	}
+	if saved.Registration == nil {
+		t.Error("saved identity lost its registration")
+	}
+	if _, err := os.Stat(path + pendingIdentitySuffix); !os.IsNotExist(err) {
+		t.Errorf("pending identity left behind: %v", err)
+	}
+
+	// A server without rotation leaves the identity alone
+	srv.SetStatus(shmtest.PathRotate, 404)
+	if _, err := RotateIdentity(context.Background(), cfg, logger); !errors.Is(err, sender.ErrRotateUnsupported) {
+		t.Fatalf("RotateIdentity() error = %v, want ErrRotateUnsupported", err)
+	}
+	if again, _ := identity.Load(path); again.PubKeyHex != saved.PubKeyHex {
+		t.Error("rejected rotation changed the identity file")
+	}
+	if _, err := os.Stat(path + pendingIdentitySuffix); !os.IsNotExist(err) {
+		t.Errorf("pending identity left behind after a rejection: %v", err)
+	}
+}
+
+func TestRotateIdentity_Timeout(t *testing.T) {
+	srv := shmtest.NewServer()
+	defer srv.Close()
+
+	// The server applies rotations, but the answer can be lost
+	var lose atomic.Bool
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == shmtest.PathRotate && lose.Load() {
+			srv.Config.Handler.ServeHTTP(httptest.NewRecorder(), r)
+			<-r.Context().Done()
+			return
+		}
+		srv.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer front.Close()
+
+	path := filepath.Join(t.TempDir(), "identity.json")
+	old, err := identity.Generate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := path + pendingIdentitySuffix
+	cfg := &config.Config{ServerURL: front.URL, AppName: "test-app", AppVersion: "1.0.0", IdentityFile: path}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	rotate := func() (*sender.Identity, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		return RotateIdentity(ctx, cfg, logger)
+	}
+	loadKey := func(path string) string {
+		t.Helper()
+		ident, err := identity.Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ident.PubKeyHex
+	}
+
+	lose.Store(true)
+	if _, err := rotate(); err == nil {
+		t.Fatal("RotateIdentity() with a lost answer: error = nil")
+	}
+	if loadKey(path) != old.PubKeyHex {
+		t.Fatal("identity file changed without an answer")
+	}
+	applied := loadKey(pending)
+
+	// The next rotation finishes the interrupted one instead of
+	// overwriting its key
+	lose.Store(false)
+	ident, err := rotate()
+	if err != nil {
+		t.Fatalf("RotateIdentity() error = %v", err)
+	}
+	if ident.PubKeyHex != applied || loadKey(path) != applied {
+		t.Errorf("identity key = %s, want the key the server applied %s", ident.PubKeyHex, applied)
+	}
+	if _, err := os.Stat(pending); !os.IsNotExist(err) {
+		t.Errorf("pending identity left behind: %v", err)
+	}
+
+	// The agent falls back to the pending identity when it starts
+	lose.Store(true)
+	rotate()
+	applied = loadKey(pending)
+	lose.Store(false)
+	a := &Agent{logger: logger}
+	if err := a.settleRotation(cfg); err != nil {
+		t.Fatalf("settleRotation() error = %v", err)
+	}
+	if loadKey(path) != applied {
+		t.Error("agent did not switch to the key the server applied")
+	}
+
+	// A pending identity the server never applied is discarded
+	current := loadKey(path)
+	stale, _ := identity.Load(path)
+	key, _ := identity.NewKey()
+	if err := identity.Save(pending, stale.WithKey(key)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.settleRotation(cfg); err != nil {
+		t.Fatalf("settleRotation() error = %v", err)
+	}
+	if loadKey(path) != current {
+		t.Error("stale pending identity replaced the current one")
+	}
+	if _, err := os.Stat(pending); !os.IsNotExist(err) {
+		t.Errorf("stale pending identity left behind: %v", err)
+	}
+	if v := srv.Violations(); len(v) != 1 {
+		t.Errorf("violations = %q, want the rejected check of the stale key only", v)
+	}
+}
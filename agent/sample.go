@@ -0,0 +1,37 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import "sync/atomic"
+
+// lineSampler keeps the first of every rate lines. A nil sampler keeps
+// every line.
+type lineSampler struct {
+	rate int64
+	seen atomic.Int64
+}
+
+// newLineSampler returns a sampler for a sample_rate, or nil when every line
+// is kept.
+func newLineSampler(rate int) *lineSampler {
+	if rate <= 1 {
+		return nil
+	}
+	return &lineSampler{rate: int64(rate)}
+}
+
+// keep reports whether the next line is sampled.
+func (s *lineSampler) keep() bool {
+	if s == nil {
+		return true
+	}
+	return (s.seen.Add(1)-1)%s.rate == 0
+}
+
+// weight returns the number of lines a sampled line stands for.
+func (s *lineSampler) weight() float64 {
+	if s == nil {
+		return 1
+	}
+	return float64(s.rate)
+}
@@ -0,0 +1,68 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestAgent_SampleRate(t *testing.T) {
+	cfg := &config.Config{
+		AppName: "test-app",
+		Sources: []config.Source{
+			{
+				Path:       "/var/log/app.log",
+				Format:     "json",
+				SampleRate: 4,
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+					{Name: "bytes", Type: "sum", Extract: &config.Extract{Field: "size"}},
+					{Name: "last_size", Type: "gauge", Extract: &config.Extract{Field: "size"}},
+				},
+			},
+			{
+				Path:   "/var/log/other.log",
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "events", Type: "counter", SampleRate: 3},
+					{Name: "all_events", Type: "counter"},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	for i := 1; i <= 10; i++ {
+		ag.ProcessLine(0, fmt.Sprintf(`{"size": %d}`, i))
+		ag.ProcessLine(1, `{}`)
+	}
+
+	// Lines 1, 5 and 9 of the first source, each standing for 4 lines
+	got := ag.Metrics()
+	want := map[string]float64{
+		"requests":   12,
+		"bytes":      (1 + 5 + 9) * 4,
+		"last_size":  9,
+		"events":     12, // lines 1, 4, 7 and 10
+		"all_events": 10,
+	}
+	for name, w := range want {
+		if got[name] != w {
+			t.Errorf("%s = %v, want %v", name, got[name], w)
+		}
+	}
+
+	st := ag.Stats().Sources
+	if st[0].LinesSkipped != 7 || st[0].LinesParsed != 3 {
+		t.Errorf("skipped = %d, parsed = %d, want 7 and 3", st[0].LinesSkipped, st[0].LinesParsed)
+	}
+	if st[1].LinesSkipped != 0 {
+		t.Errorf("metric sampling skipped %d source lines", st[1].LinesSkipped)
+	}
+}
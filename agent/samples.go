@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"strings"
+	"sync"
+)
+
+// maxSampleLen is the longest line kept as a sample, in bytes.
+const maxSampleLen = 1024
+
+// LineSample is a line kept as an example of a line that failed to parse
+// or matched no metric.
+type LineSample struct {
+	Path string `json:"path,omitempty"` // file the line was read from, if known
+	Line int64  `json:"line,omitempty"` // line number in that file, if known
+	Text string `json:"text"`
+}
+
+// lineSamples keeps the first lines of a source that failed to parse and
+// the first that matched no metric, up to max of each.
+type lineSamples struct {
+	max int
+
+	mu        sync.Mutex
+	parse     []LineSample
+	unmatched []LineSample
+}
+
+// newLineSamples returns samples of up to n lines of each kind, or nil
+// when n is not positive.
+func newLineSamples(n int) *lineSamples {
+	if n <= 0 {
+		return nil
+	}
+	return &lineSamples{max: n}
+}
+
+// parseError keeps a line that failed to parse, if there is room.
+func (s *lineSamples) parseError(line string, lc lineContext) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.parse = s.add(s.parse, line, lc)
+}
+
+// noMatch keeps a line that matched no metric, if there is room.
+func (s *lineSamples) noMatch(line string, lc lineContext) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unmatched = s.add(s.unmatched, line, lc)
+}
+
+// add appends a sample to samples unless full. Must be called with s.mu
+// held.
+func (s *lineSamples) add(samples []LineSample, line string, lc lineContext) []LineSample {
+	if len(samples) >= s.max {
+		return samples
+	}
+	if len(line) > maxSampleLen {
+		line = strings.ToValidUTF8(line[:maxSampleLen], "")
+	}
+	return append(samples, LineSample{Path: lc.path, Line: lc.line, Text: line})
+}
+
+// get returns copies of the samples kept.
+func (s *lineSamples) get() (parse, unmatched []LineSample) {
+	if s == nil {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]LineSample(nil), s.parse...), append([]LineSample(nil), s.unmatched...)
+}
+
+// attachLineSamples lets a processor keep samples of the lines it could
+// not use, if the agent keeps any.
+func (a *Agent) attachLineSamples(proc *sourceProcessor) {
+	proc.samples = newLineSamples(a.errorSamples)
+}
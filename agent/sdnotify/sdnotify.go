@@ -0,0 +1,71 @@
+// SPDX-License-Identifier: MIT
+
+// Package sdnotify implements the systemd service notification protocol,
+// so that a Type=notify unit knows when the agent is ready and restarts it
+// when it stops pinging the watchdog.
+//
+// States are sent as datagrams to the socket named by $NOTIFY_SOCKET, so
+// the agent does not need to link against libsystemd. Without the
+// variable, as when not run by systemd, nothing is sent.
+package sdnotify
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// States sent to systemd.
+const (
+	Ready    = "READY=1"    // startup finished
+	Stopping = "STOPPING=1" // shutdown started
+	Watchdog = "WATCHDOG=1" // the service is alive
+)
+
+// Status returns the state describing the service in systemctl status.
+func Status(status string) string {
+	return "STATUS=" + status
+}
+
+// Enabled reports whether the process was started by systemd with a
+// notification socket.
+func Enabled() bool {
+	return os.Getenv("NOTIFY_SOCKET") != ""
+}
+
+// Notify sends states to systemd as one message. It does nothing when
+// Enabled is false.
+func Notify(states ...string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("connecting to notification socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(strings.Join(states, "\n"))); err != nil {
+		return fmt.Errorf("notifying systemd: %w", err)
+	}
+	return nil
+}
+
+// WatchdogInterval returns how often the watchdog must be pinged: half of
+// the unit's WatchdogSec, as systemd recommends. It returns 0 when the
+// watchdog is disabled or set for another process.
+func WatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
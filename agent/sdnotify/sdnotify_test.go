@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unixgram sockets on windows")
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if Enabled() {
+		t.Error("Enabled() = true without NOTIFY_SOCKET")
+	}
+	if err := Notify(Ready); err != nil {
+		t.Errorf("Notify() without a socket error = %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	if !Enabled() {
+		t.Error("Enabled() = false with NOTIFY_SOCKET")
+	}
+	if err := Notify(Ready, Status("Running")); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "READY=1\nSTATUS=Running" {
+		t.Errorf("message = %q", got)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing.sock"))
+	if err := Notify(Ready); err == nil {
+		t.Error("Notify() to a missing socket: expected error")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	for _, tt := range []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"nope", "", 0},
+		{"20000000", "", 10 * time.Second},
+		{"20000000", pid, 10 * time.Second},
+		{"20000000", "1", 0},
+	} {
+		t.Setenv("WATCHDOG_USEC", tt.usec)
+		t.Setenv("WATCHDOG_PID", tt.pid)
+		if got := WatchdogInterval(); got != tt.want {
+			t.Errorf("WatchdogInterval() with WATCHDOG_USEC=%q WATCHDOG_PID=%q = %s, want %s", tt.usec, tt.pid, got, tt.want)
+		}
+	}
+}
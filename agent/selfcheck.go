@@ -0,0 +1,656 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+// CheckResult is the self-check outcome of one metric.
+type CheckResult struct {
+	Source  int    // index of the source in the configuration
+	Metric  string // metric name
+	Line    string // generated line
+	Problem string // why the line was not recorded, empty when it was
+}
+
+// OK reports whether the generated line was recorded by the metric.
+func (r CheckResult) OK() bool {
+	return r.Problem == ""
+}
+
+// SelfCheck generates a line for every metric of cfg, built to satisfy its
+// match conditions and to carry its extract and label fields, and runs it
+// through the pipeline of the metric's source. A metric that does not
+// record its line most likely never increments, e.g. because the source
+// pattern cannot produce the fields its conditions expect.
+func SelfCheck(cfg *config.Config) ([]CheckResult, error) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var results []CheckResult
+	for i := range cfg.Sources {
+		src := &cfg.Sources[i]
+		for j := range src.Metrics {
+			if src.Metrics[j].Type == "derived" {
+				continue // not computed from lines
+			}
+
+			// A fresh pipeline per metric keeps the counters of one
+			// check from hiding the failure of another.
+			proc, err := newSourceProcessor(src, aggregator.New(), logger, 0)
+			if err != nil {
+				return nil, fmt.Errorf("source[%d]: %w", i, err)
+			}
+			proc.unmatched = nil // sample lines are not traffic
+			proc.prefilter = nil // built from the fields, not the raw text it selects
+
+			fields := sampleFields(&src.Metrics[j])
+			unmapFields(src, fields)
+			line, lc, unplaced := sampleLine(src, fields, cfg.KubernetesMetadata.IsEnabled())
+			if src.Format == "csv" && src.CSV.Header && !src.IsJournald() {
+				// The line is preceded by the header naming its columns
+				header, record, _ := strings.Cut(line, "\n")
+				proc.processLineWith(header, lc)
+				proc.processLineWith(record, lc)
+			} else {
+				proc.processLineWith(line, lc)
+			}
+			proc.flush()
+			proc.close()
+
+			results = append(results, CheckResult{
+				Source:  i,
+				Metric:  src.Metrics[j].Name,
+				Line:    line,
+				Problem: checkRecorded(proc, proc.metric(&src.Metrics[j]), unplaced),
+			})
+		}
+	}
+	return results, nil
+}
+
+// metric returns the processor of a metric of the source.
+func (p *sourceProcessor) metric(cfg *config.Metric) *metricProcessor {
+	for _, m := range p.metrics {
+		if m.cfg == cfg {
+			return m
+		}
+	}
+	return nil
+}
+
+// checkRecorded explains why a metric did not record the processed line,
+// or returns "" if it did. unplaced lists the fields the line lacks.
+func checkRecorded(proc *sourceProcessor, m *metricProcessor, unplaced []string) string {
+	var problem string
+	switch {
+	case proc.parseErrors.Load() > 0:
+		problem = "line does not parse as " + sourceFormat(proc.source)
+	case m.matched.Load() == 0:
+		problem = "line does not match"
+	case m.extractMissing.Load() > 0:
+		problem = fmt.Sprintf("extract field %q is missing", m.cfg.Extract.Field)
+	case m.extractInvalid.Load() > 0 && m.cfg.Extract.Type != "":
+		problem = fmt.Sprintf("extract field %q is not a valid %s", m.cfg.Extract.Field, m.cfg.Extract.Type)
+	case m.extractInvalid.Load() > 0:
+		problem = fmt.Sprintf("extract field %q is not numeric", m.cfg.Extract.Field)
+	default:
+		return ""
+	}
+
+	if len(unplaced) > 0 {
+		problem += fmt.Sprintf(" (the format cannot carry %s)", strings.Join(unplaced, ", "))
+	}
+	return problem
+}
+
+// sourceFormat describes the format of a source's lines.
+func sourceFormat(src *config.Source) string {
+	if src.IsJournald() {
+		if src.Format != "" {
+			return "journal entry with " + src.Format + " message"
+		}
+		return "journal entry"
+	}
+	if src.IsGELF() {
+		if src.Format != "" {
+			return "GELF message with " + src.Format + " short_message"
+		}
+		return "GELF message"
+	}
+	return src.Format
+}
+
+// sampleFields returns the field values, by dotted path, that a line needs
+// to be recorded by m. Numbers are float64, other values strings.
+func sampleFields(m *config.Metric) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if m.Match != nil {
+		satisfy(m.Match, fields)
+	}
+
+	if m.Extract != nil {
+		if _, ok := fields[m.Extract.Field]; !ok {
+			if m.Type == "set" || m.Type == "counter_by" {
+				fields[m.Extract.Field] = "sample"
+			} else {
+				fields[m.Extract.Field] = 42.0
+			}
+		}
+	}
+
+	for _, label := range m.Labels {
+		if _, ok := fields[label]; !ok {
+			fields[label] = "sample"
+		}
+	}
+	return fields
+}
+
+// unmapFields replaces the fields set by map_fields with a value of their
+// source field that maps to them.
+func unmapFields(src *config.Source, fields map[string]interface{}) {
+	for _, name := range src.MappedFields() {
+		want, ok := fields[name]
+		if !ok {
+			continue
+		}
+		fm := src.MapFields[name]
+		if fm.Field != name {
+			delete(fields, name)
+		}
+		fields[fm.Field] = unmapValue(&fm.ValueMap, valueString(want))
+	}
+}
+
+// unmapValue returns a value that vm maps to want, or want itself.
+func unmapValue(vm *config.ValueMap, want string) interface{} {
+	keys := make([]string, 0, len(vm.Values))
+	for k := range vm.Values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if vm.Values[k] == want {
+			return k
+		}
+	}
+	for _, r := range vm.Rules {
+		if r.Value != want {
+			continue
+		}
+		switch {
+		case r.Regex != "":
+			if s, _, err := sampleMatching(r.Regex, nil); err == nil {
+				return s
+			}
+		case r.Gte != nil:
+			return *r.Gte
+		default:
+			return *r.Lt - 1
+		}
+	}
+	return want
+}
+
+// satisfy sets the fields a match needs. Negated matches and conditions
+// are left to the check itself: they hold as long as no other field
+// contradicts them.
+func satisfy(match *config.Match, fields map[string]interface{}) {
+	for i := range match.All {
+		satisfy(&match.All[i], fields)
+	}
+	if len(match.Any) > 0 {
+		satisfy(&match.Any[0], fields)
+	}
+	if match.Field == "" || match.NotEquals != "" || len(match.NotIn) > 0 || match.NotContains != "" ||
+		(match.Exists != nil && !*match.Exists) {
+		return
+	}
+	if _, ok := fields[match.Field]; !ok {
+		fields[match.Field] = matchValue(match)
+	}
+}
+
+// matchValue returns a value satisfying a single condition.
+func matchValue(match *config.Match) interface{} {
+	switch {
+	case match.Equals != "":
+		return match.Equals
+	case len(match.In) > 0:
+		return match.In[0]
+	case match.Contains != "":
+		return match.Contains
+	case match.Regex != "":
+		if s, _, err := sampleMatching(match.Regex, nil); err == nil {
+			return s
+		}
+	}
+
+	lo, hi := math.Inf(-1), math.Inf(1)
+	strict := false
+	switch {
+	case match.Gt != nil:
+		lo, strict = *match.Gt, true
+	case match.Gte != nil:
+		lo = *match.Gte
+	case match.Lt != nil:
+		hi, strict = *match.Lt, true
+	case match.Lte != nil:
+		hi = *match.Lte
+	case len(match.Between) == 2:
+		lo, hi = match.Between[0], match.Between[1]
+	default:
+		return "sample"
+	}
+
+	// Integers fit patterns such as \d+ in regex sources
+	switch {
+	case math.IsInf(hi, 1):
+		if v := math.Ceil(lo); v > lo || !strict {
+			return v
+		}
+		return lo + 1
+	case math.IsInf(lo, -1):
+		if v := math.Floor(hi); v < hi || !strict {
+			return v
+		}
+		return hi - 1
+	}
+	if v := math.Round((lo + hi) / 2); v >= lo && v <= hi {
+		return v
+	}
+	return (lo + hi) / 2
+}
+
+// sampleLine renders fields as a line of the source's format. Fields set by
+// the pipeline itself go to the line context instead, as do path_pattern
+// fields and kubernetes.* fields when podMetadata adds them to every line.
+// It returns the fields the format could not carry.
+func sampleLine(src *config.Source, fields map[string]interface{}, podMetadata bool) (string, lineContext, []string) {
+	lc := lineContext{line: 1}
+	if !src.IsJournald() && !src.IsGELF() && !src.IsKubernetes() && !src.IsStdin() {
+		lc.path = src.Path
+	}
+
+	lineFields := make(map[string]interface{}, len(fields))
+	for name, val := range fields {
+		switch {
+		case name == config.FieldPath:
+			lc.path = valueString(val)
+		case name == config.FieldLine:
+			if n, err := strconv.ParseInt(valueString(val), 10, 64); err == nil && n > 0 {
+				lc.line = n
+			}
+		case name == config.FieldSource:
+		case src.AddFields[name] != "":
+			// set on every line by add_fields
+		case (src.IsKubernetes() || podMetadata) && strings.HasPrefix(name, "kubernetes."),
+			slices.Contains(src.PathFields(), name):
+			if lc.fields == nil {
+				lc.fields = make(map[string]interface{})
+			}
+			setPath(lc.fields, name, val)
+		default:
+			lineFields[name] = val
+		}
+	}
+
+	if src.IsJournald() {
+		line, unplaced := journalLine(src, lineFields)
+		return line, lc, unplaced
+	}
+	if src.IsGELF() {
+		line, unplaced := gelfLine(src, lineFields)
+		return line, lc, unplaced
+	}
+	line, unplaced := formatLine(src, lineFields)
+	return line, lc, unplaced
+}
+
+// journalLine renders a journal entry. Upper-case journal fields are set on
+// the entry; the other fields go to MESSAGE in the source format.
+func journalLine(src *config.Source, fields map[string]interface{}) (string, []string) {
+	entry := make(map[string]interface{})
+	message := make(map[string]interface{})
+	for name, val := range fields {
+		if src.Format == "" || isJournalField(name) {
+			entry[name] = valueString(val)
+		} else {
+			message[name] = val
+		}
+	}
+
+	var unplaced []string
+	if src.Format != "" {
+		entry["MESSAGE"], unplaced = formatLine(src, message)
+	} else if _, ok := entry["MESSAGE"]; !ok {
+		entry["MESSAGE"] = "sample"
+	}
+
+	data, _ := json.Marshal(entry)
+	return string(data), unplaced
+}
+
+// gelfLine renders a GELF message. Without a source format, fields are set
+// as additional fields; with one, they go to short_message in that format.
+func gelfLine(src *config.Source, fields map[string]interface{}) (string, []string) {
+	msg := map[string]interface{}{"version": "1.1", "host": "sample"}
+	var unplaced []string
+	if src.Format != "" {
+		msg["short_message"], unplaced = formatLine(src, fields)
+	} else {
+		msg["short_message"] = "sample"
+		for name, val := range fields {
+			msg["_"+name] = val
+		}
+	}
+
+	data, _ := json.Marshal(msg)
+	return string(data), unplaced
+}
+
+// isJournalField reports whether name looks like a journal field name.
+func isJournalField(name string) bool {
+	for _, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// formatLine renders fields in the format of a source.
+func formatLine(src *config.Source, fields map[string]interface{}) (string, []string) {
+	switch src.Format {
+	case "json":
+		obj := make(map[string]interface{})
+		for _, name := range sortedKeys(fields) {
+			setPath(obj, name, fields[name])
+		}
+		data, _ := json.Marshal(obj)
+		return string(data), nil
+
+	case "logfmt":
+		var pairs []string
+		if _, ok := fields["msg"]; !ok {
+			pairs = append(pairs, "msg=sample")
+		}
+		for _, name := range sortedKeys(fields) {
+			pairs = append(pairs, name+"="+logfmtValue(valueString(fields[name])))
+		}
+		return strings.Join(pairs, " "), nil
+
+	case "syslog":
+		return syslogLine(fields)
+
+	case "csv":
+		return csvLine(src.CSV, fields)
+
+	case "regex", "grok", "access_log":
+		values := make(map[string]string, len(fields))
+		for name, val := range fields {
+			values[name] = valueString(val)
+		}
+		pattern, _ := src.RegexPattern() // validated with the config
+		line, unplaced, err := sampleMatching(pattern, values)
+		if err != nil {
+			return "", sortedKeys(fields)
+		}
+		return line, unplaced
+	}
+	return "", sortedKeys(fields)
+}
+
+// csvLine renders a delimited line of the listed columns. With a header,
+// the columns are the fields, and the line is preceded by its header.
+func csvLine(cfg *config.CSVConfig, fields map[string]interface{}) (string, []string) {
+	w := func(values []string) string {
+		var b strings.Builder
+		cw := csv.NewWriter(&b)
+		cw.Comma = cfg.Comma()
+		cw.Write(values)
+		cw.Flush()
+		return strings.TrimRight(b.String(), "\r\n")
+	}
+
+	columns := cfg.Columns
+	if cfg.Header {
+		columns = sortedKeys(fields)
+	}
+	values := make([]string, len(columns))
+	placed := make(map[string]bool, len(columns))
+	for i, col := range columns {
+		if val, ok := fields[col]; ok {
+			values[i] = valueString(val)
+			placed[col] = true
+		}
+	}
+
+	var unplaced []string
+	for _, name := range sortedKeys(fields) {
+		if !placed[name] {
+			unplaced = append(unplaced, name)
+		}
+	}
+
+	line := w(values)
+	if cfg.Header {
+		line = w(columns) + "\n" + line
+	}
+	return line, unplaced
+}
+
+// syslogLine renders an RFC5424 line. Structured data parameters are set
+// with structured_data.<id>.<param> fields.
+func syslogLine(fields map[string]interface{}) (string, []string) {
+	header := map[string]string{
+		"timestamp": "2024-01-01T00:00:00Z",
+		"host":      "host",
+		"app":       "app",
+		"pid":       "-",
+		"msgid":     "-",
+		"message":   "sample",
+	}
+	facility, severity := 1, 6
+	sd := make(map[string]map[string]string)
+
+	var unplaced []string
+	for _, name := range sortedKeys(fields) {
+		val := valueString(fields[name])
+		switch name {
+		case "timestamp", "host", "app", "pid", "msgid", "message":
+			header[name] = val
+		case "facility":
+			facility, _ = strconv.Atoi(val)
+		case "severity":
+			severity, _ = strconv.Atoi(val)
+		case "priority":
+			pri, _ := strconv.Atoi(val)
+			facility, severity = pri/8, pri%8
+		default:
+			id, param, ok := strings.Cut(strings.TrimPrefix(name, "structured_data."), ".")
+			if !ok || !strings.HasPrefix(name, "structured_data.") {
+				unplaced = append(unplaced, name)
+				continue
+			}
+			if sd[id] == nil {
+				sd[id] = make(map[string]string)
+			}
+			sd[id][param] = val
+		}
+	}
+
+	structured := "-"
+	if len(sd) > 0 {
+		var b strings.Builder
+		for _, id := range sortedKeys(sd) {
+			b.WriteString("[" + id)
+			for _, param := range sortedKeys(sd[id]) {
+				fmt.Fprintf(&b, " %s=%q", param, sd[id][param])
+			}
+			b.WriteString("]")
+		}
+		structured = b.String()
+	}
+
+	line := fmt.Sprintf("<%d>1 %s %s %s %s %s %s %s", facility*8+severity,
+		header["timestamp"], header["host"], header["app"], header["pid"],
+		header["msgid"], structured, header["message"])
+	return line, unplaced
+}
+
+// sampleMatching returns a string matched by pattern, in which each named
+// group whose own pattern matches values[name] captures that value. It
+// returns the names of values that could not be placed.
+func sampleMatching(pattern string, values map[string]string) (string, []string, error) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", nil, err
+	}
+
+	g := &sampler{values: values, placed: make(map[string]bool)}
+	g.write(re)
+
+	var unplaced []string
+	for _, name := range sortedKeys(values) {
+		if !g.placed[name] {
+			unplaced = append(unplaced, name)
+		}
+	}
+	return g.b.String(), unplaced, nil
+}
+
+// sampler writes a string matched by a parsed regular expression.
+type sampler struct {
+	b      strings.Builder
+	values map[string]string
+	placed map[string]bool
+}
+
+func (g *sampler) write(re *syntax.Regexp) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		g.b.WriteString(string(re.Rune))
+	case syntax.OpCharClass:
+		g.b.WriteRune(classRune(re.Rune))
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		g.b.WriteByte('x')
+	case syntax.OpCapture:
+		if val, ok := g.values[re.Name]; ok && re.Name != "" && fullMatch(re.Sub[0], val) {
+			g.b.WriteString(val)
+			g.placed[re.Name] = true
+			return
+		}
+		g.write(re.Sub[0])
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			g.write(sub)
+		}
+	case syntax.OpAlternate:
+		// Prefer the branch capturing a wanted value
+		for _, sub := range re.Sub {
+			if g.wants(sub) {
+				g.write(sub)
+				return
+			}
+		}
+		g.write(re.Sub[0])
+	case syntax.OpPlus:
+		g.write(re.Sub[0])
+	case syntax.OpStar, syntax.OpQuest:
+		if g.wants(re.Sub[0]) {
+			g.write(re.Sub[0])
+		}
+	case syntax.OpRepeat:
+		n := re.Min
+		if n == 0 && g.wants(re.Sub[0]) {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			g.write(re.Sub[0])
+		}
+	}
+}
+
+// wants reports whether re contains a named group with a wanted value.
+func (g *sampler) wants(re *syntax.Regexp) bool {
+	if re.Op == syntax.OpCapture {
+		if _, ok := g.values[re.Name]; ok {
+			return true
+		}
+	}
+	for _, sub := range re.Sub {
+		if g.wants(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// classRune picks a readable rune of a character class, given as pairs of
+// inclusive ranges.
+func classRune(ranges []rune) rune {
+	for _, c := range []rune{'a', '0', 'A', ' '} {
+		for i := 0; i+1 < len(ranges); i += 2 {
+			if ranges[i] <= c && c <= ranges[i+1] {
+				return c
+			}
+		}
+	}
+	for i := 0; i+1 < len(ranges); i += 2 {
+		if ranges[i+1] >= '!' {
+			return max(ranges[i], '!')
+		}
+	}
+	if len(ranges) > 0 {
+		return ranges[0]
+	}
+	return 'x'
+}
+
+// fullMatch reports whether re matches all of s.
+func fullMatch(re *syntax.Regexp, s string) bool {
+	anchored, err := regexp.Compile(`^(?:` + re.String() + `)$`)
+	return err == nil && anchored.MatchString(s)
+}
+
+// logfmtValue quotes a logfmt value when needed.
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// valueString formats a sample value.
+func valueString(val interface{}) string {
+	if f, ok := val.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(val)
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
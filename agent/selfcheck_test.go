@@ -0,0 +1,215 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestSelfCheck(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+server_url: https://shm.example.com
+app_name: test
+app_version: "1.0"
+sources:
+  - path: /var/log/app.json
+    format: json
+    add_fields:
+      env: prod
+    metrics:
+      - name: slow_requests
+        type: percentile
+        match:
+          all:
+            - field: request.method
+              in: [GET, POST]
+            - field: duration_ms
+              gt: 500
+        extract:
+          field: duration_ms
+      - name: users
+        type: set
+        extract:
+          field: user.id
+        labels: [region]
+      - name: staging_errors
+        type: counter
+        match:
+          field: env
+          equals: staging
+  - path: /var/log/app.log
+    format: logfmt
+    path_pattern: '/var/log/(?P<app>[^/.]+)\.log$'
+    metrics:
+      - name: app_warnings
+        type: counter
+        match:
+          all:
+            - field: app
+              equals: app
+            - field: level
+              equals: warn
+      - name: errors
+        type: counter
+        match:
+          field: level
+          regex: '^(error|fatal)$'
+        labels: [component]
+  - path: /var/log/access.log
+    format: regex
+    pattern: '^(?P<ip>\S+) "(?P<method>[A-Z]+) (?P<path>\S+)" (?P<status>\d{3}) (?P<bytes>\d+)$'
+    map_fields:
+      status_class:
+        field: status
+        rules:
+          - {regex: '^5\d\d$', value: 5xx}
+    metrics:
+      - name: server_error_class
+        type: counter
+        match:
+          field: status_class
+          equals: 5xx
+      - name: server_errors
+        type: counter
+        match:
+          field: status
+          between: [500, 599]
+      - name: bytes
+        type: sum
+        extract:
+          field: bytes
+      - name: status_ok
+        type: counter
+        match:
+          field: status
+          equals: OK
+  - path: /var/log/api.log
+    format: grok
+    pattern: '^%{IP:client} %{WORD:verb} %{NUMBER:bytes:int}$'
+    metrics:
+      - name: api_bytes
+        type: sum
+        match:
+          field: verb
+          equals: POST
+        extract:
+          field: bytes
+  - path: /var/log/requests.tsv
+    format: csv
+    csv:
+      delimiter: "\t"
+      columns: [time, "", status, duration]
+    metrics:
+      - name: tsv_slow
+        type: counter
+        match:
+          field: duration
+          gt: 1000
+  - path: /var/log/haproxy.csv
+    format: csv
+    csv:
+      header: true
+    metrics:
+      - name: haproxy_sessions
+        type: gauge
+        labels: [pxname]
+        extract:
+          field: scur
+  - path: /var/log/nginx/access.log
+    format: access_log
+    preset: combined
+    metrics:
+      - name: web_errors
+        type: counter
+        match:
+          field: status
+          gte: 500
+        labels: [method]
+  - path: /var/log/syslog
+    format: syslog
+    metrics:
+      - name: sshd_failures
+        type: counter
+        match:
+          all:
+            - field: app
+              equals: sshd
+            - field: severity
+              lte: 4
+            - field: message
+              contains: Failed password
+  - type: journald
+    format: logfmt
+    metrics:
+      - name: unit_errors
+        type: counter
+        match:
+          all:
+            - field: _SYSTEMD_UNIT
+              equals: app.service
+            - field: level
+              equals: error
+`))
+	if err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+
+	results, err := SelfCheck(cfg)
+	if err != nil {
+		t.Fatalf("SelfCheck() error: %v", err)
+	}
+
+	problems := make(map[string]string)
+	for _, r := range results {
+		problems[r.Metric] = r.Problem
+		if r.Line == "" {
+			t.Errorf("%s: empty line", r.Metric)
+		}
+	}
+	if len(results) != 15 {
+		t.Fatalf("got %d results, want 15", len(results))
+	}
+
+	for _, name := range []string{"slow_requests", "users", "errors", "app_warnings", "server_errors", "server_error_class", "bytes", "api_bytes", "tsv_slow", "haproxy_sessions", "web_errors", "sshd_failures", "unit_errors"} {
+		if problems[name] != "" {
+			t.Errorf("%s: unexpected problem %q", name, problems[name])
+		}
+	}
+
+	// add_fields always sets env to prod
+	if p := problems["staging_errors"]; p != "line does not match" {
+		t.Errorf("staging_errors problem = %q, want no match", p)
+	}
+
+	// The status group only captures digits
+	if p := problems["status_ok"]; !strings.Contains(p, "does not match") || !strings.Contains(p, "status") {
+		t.Errorf("status_ok problem = %q, want no match naming status", p)
+	}
+}
+
+func TestSampleMatching(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		values   map[string]string
+		want     string
+		unplaced string
+	}{
+		{`^(?P<a>\d+)-(?P<b>[a-z]+)$`, map[string]string{"a": "42", "b": "x"}, "42-x", ""},
+		{`^(?P<a>\d+)$`, map[string]string{"a": "not a number"}, "0", "a"},
+		{`^(?:GET|(?P<m>POST))( (?P<p>/\S*))?$`, map[string]string{"m": "POST", "p": "/x"}, "POST /x", ""},
+		{`^x{2,3}y?$`, nil, "xx", ""},
+	}
+
+	for _, tt := range tests {
+		got, unplaced, err := sampleMatching(tt.pattern, tt.values)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.pattern, err)
+		}
+		if got != tt.want || strings.Join(unplaced, ",") != tt.unplaced {
+			t.Errorf("sampleMatching(%q) = %q, %v; want %q, %q", tt.pattern, got, unplaced, tt.want, tt.unplaced)
+		}
+	}
+}
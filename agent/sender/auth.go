@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// AuthConfig adds a token to every request, for servers behind an
+// authenticating gateway. Requests are still signed.
+type AuthConfig struct {
+	Token     string
+	TokenFile string // read at every request, so that a rotated token applies
+	Header    string // defaults to Authorization, with a Bearer token
+}
+
+// enabled reports whether a token is configured.
+func (c AuthConfig) enabled() bool {
+	return c.Token != "" || c.TokenFile != ""
+}
+
+// token returns the token, reading the token file if any. An empty token
+// file is an error rather than a request sent with an empty token.
+func (c AuthConfig) token() (string, error) {
+	if c.TokenFile == "" {
+		return c.Token, nil
+	}
+	data, err := os.ReadFile(c.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("reading token file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", c.TokenFile)
+	}
+	return token, nil
+}
+
+// authTransport sets the authentication header on every request to the
+// server. Requests to other hosts, such as a redirect followed by the
+// client, are sent without the token.
+type authTransport struct {
+	next http.RoundTripper
+	auth AuthConfig
+	host string // host of the server URL
+}
+
+// newAuthTransport creates an authTransport adding the token to the
+// requests to the host of serverURL.
+func newAuthTransport(next http.RoundTripper, auth AuthConfig, serverURL string) *authTransport {
+	t := &authTransport{next: next, auth: auth}
+	if u, err := url.Parse(serverURL); err == nil {
+		t.host = u.Host
+	}
+	return t
+}
+
+// RoundTrip sends a copy of the request carrying the token, if it goes to
+// the server.
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.host == "" || !strings.EqualFold(req.URL.Host, t.host) {
+		return t.next.RoundTrip(req)
+	}
+	token, err := t.auth.token()
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	if t.auth.Header == "" || strings.EqualFold(t.auth.Header, "Authorization") {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else {
+		req.Header.Set(t.auth.Header, token)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of the underlying
+// transport.
+func (t *authTransport) CloseIdleConnections() {
+	if c, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
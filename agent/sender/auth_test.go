@@ -0,0 +1,153 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSender_Auth(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]string) // path -> header value
+	header := "Authorization"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.URL.Path] = r.Header.Get(header)
+		mu.Unlock()
+		if r.URL.Path == "/v1/register" {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte("first\n"), 0o600)
+
+	tests := []struct {
+		name   string
+		auth   AuthConfig
+		header string
+		want   string
+	}{
+		{name: "bearer token", auth: AuthConfig{Token: "s3cret"}, header: "Authorization", want: "Bearer s3cret"},
+		{name: "api key", auth: AuthConfig{Token: "s3cret", Header: "X-API-Key"}, header: "X-API-Key", want: "s3cret"},
+		{name: "token file", auth: AuthConfig{TokenFile: tokenFile}, header: "Authorization", want: "Bearer first"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			header = tt.header
+			clear(seen)
+			mu.Unlock()
+
+			pub, priv, _ := ed25519.GenerateKey(nil)
+			s := New(Config{
+				ServerURL: srv.URL,
+				Identity:  &Identity{InstanceID: "test", PrivateKey: priv, PublicKey: pub},
+				Auth:      tt.auth,
+			})
+			defer s.Close()
+
+			if err := s.Register(context.Background()); err != nil {
+				t.Fatalf("Register() error = %v", err)
+			}
+			if err := s.SendSnapshot(context.Background(), map[string]interface{}{"n": float64(1)}); err != nil {
+				t.Fatalf("SendSnapshot() error = %v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, path := range []string{"/v1/register", "/v1/activate", "/v1/snapshot"} {
+				if seen[path] != tt.want {
+					t.Errorf("%s %s = %q, want %q", path, tt.header, seen[path], tt.want)
+				}
+			}
+		})
+	}
+
+	// A rotated token file applies to the next request
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	s := New(Config{
+		ServerURL: srv.URL,
+		Identity:  &Identity{InstanceID: "test", PrivateKey: priv, PublicKey: pub},
+		Auth:      AuthConfig{TokenFile: tokenFile},
+	})
+	s.registered = true
+	defer s.Close()
+
+	os.WriteFile(tokenFile, []byte("second"), 0o600)
+	if err := s.SendSnapshot(context.Background(), map[string]interface{}{"n": float64(1)}); err != nil {
+		t.Fatalf("SendSnapshot() error = %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := seen["/v1/snapshot"]; got != "Bearer second" {
+		t.Errorf("Authorization after rotation = %q, want %q", got, "Bearer second")
+	}
+	clear(seen)
+	mu.Unlock()
+
+	// An empty token file fails the request rather than sending no token
+	os.WriteFile(tokenFile, []byte("\n"), 0o600)
+	if err := s.SendSnapshot(context.Background(), map[string]interface{}{"n": float64(1)}); err == nil {
+		t.Error("SendSnapshot() with an empty token file succeeded")
+	}
+	mu.Lock()
+	if _, ok := seen["/v1/snapshot"]; ok {
+		t.Error("a request was sent with an empty token file")
+	}
+}
+
+func TestSender_AuthRedirect(t *testing.T) {
+	var mu sync.Mutex
+	var leaked []string
+	hits := 0
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		if v := r.Header.Get("Authorization"); v != "" {
+			leaked = append(leaked, v)
+		}
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(other.Close)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	t.Cleanup(srv.Close)
+
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	s := New(Config{
+		ServerURL: srv.URL,
+		Identity:  &Identity{InstanceID: "test", PrivateKey: priv, PublicKey: pub},
+		Auth:      AuthConfig{Token: "s3cret"},
+	})
+	s.registered = true
+	defer s.Close()
+
+	s.SendSnapshot(context.Background(), map[string]interface{}{"n": float64(1)})
+	mu.Lock()
+	defer mu.Unlock()
+	if hits == 0 {
+		t.Fatal("the redirect was not followed")
+	}
+	if len(leaked) != 0 {
+		t.Errorf("token sent to another host after a redirect: %q", leaked)
+	}
+
+	// Closing the sender reaches the connections under the auth transport
+	if _, ok := s.client.Transport.(interface{ CloseIdleConnections() }); !ok {
+		t.Error("auth transport does not close idle connections")
+	}
+}
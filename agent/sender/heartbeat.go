@@ -0,0 +1,103 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+)
+
+// HeartbeatRequest reports the version and health of the agent.
+type HeartbeatRequest struct {
+	InstanceID    string   `json:"instance_id"`
+	AgentVersion  string   `json:"agent_version"`
+	OSArch        string   `json:"os_arch"`
+	Status        string   `json:"status"` // "ok" or "unavailable"
+	Problems      []string `json:"problems,omitempty"`
+	UptimeSeconds float64  `json:"uptime_seconds"`
+}
+
+// HeartbeatResponse tells the agent which versions the server supports.
+// Every field is optional.
+type HeartbeatResponse struct {
+	// MinAgentVersion is the oldest agent version the server supports;
+	// older agents are deprecated.
+	MinAgentVersion string `json:"min_agent_version,omitempty"`
+
+	// LatestAgentVersion is the most recent agent version released.
+	LatestAgentVersion string `json:"latest_agent_version,omitempty"`
+
+	// Message is shown to the operators of the agent, e.g. upgrade notes.
+	Message string `json:"message,omitempty"`
+}
+
+// ErrHeartbeatUnsupported is returned by Heartbeat when the server does
+// not know the heartbeat endpoint.
+var ErrHeartbeatUnsupported = errors.New("server does not support heartbeats")
+
+// maxHeartbeatResponse is the largest heartbeat response read.
+const maxHeartbeatResponse = 64 << 10
+
+// Heartbeat reports the version and health of the agent to the server and
+// returns the versions it supports. The instance ID, agent version and
+// platform of req are filled in when empty.
+func (s *Sender) Heartbeat(ctx context.Context, req HeartbeatRequest) (*HeartbeatResponse, error) {
+	if req.InstanceID == "" {
+		req.InstanceID = s.identity.InstanceID
+	}
+	if req.AgentVersion == "" {
+		req.AgentVersion = s.agentVersion
+	}
+	if req.OSArch == "" {
+		req.OSArch = runtime.GOOS + "/" + runtime.GOARCH
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling heartbeat request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.serverURL+"/v1/heartbeat", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating heartbeat request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if err := signRequest(httpReq.Header, s.identity.PrivateKey, body); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("sending heartbeat request: %w", err)
+	}
+	defer drainAndClose(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusAccepted, http.StatusNoContent:
+		return &HeartbeatResponse{}, nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, ErrHeartbeatUnsupported
+	default:
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, &StatusError{Op: "heartbeat", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxHeartbeatResponse))
+	if err != nil {
+		return nil, fmt.Errorf("reading heartbeat response: %w", err)
+	}
+	var hr HeartbeatResponse
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &hr); err != nil {
+			return nil, fmt.Errorf("parsing heartbeat response: %w", err)
+		}
+	}
+	return &hr, nil
+}
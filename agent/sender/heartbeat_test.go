@@ -0,0 +1,71 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeartbeat(t *testing.T) {
+	var got HeartbeatRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/heartbeat" || r.Header.Get(HeaderSignature) == "" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(`{"min_agent_version": "1.4.0", "latest_agent_version": "1.6.2", "message": "upgrade"}`))
+	}))
+	defer srv.Close()
+
+	s := newTestSender(t, srv.URL, 0)
+	s.agentVersion = "1.5.0"
+	resp, err := s.Heartbeat(context.Background(), HeartbeatRequest{Status: "ok", UptimeSeconds: 42})
+	if err != nil {
+		t.Fatalf("Heartbeat() error = %v", err)
+	}
+	want := HeartbeatResponse{MinAgentVersion: "1.4.0", LatestAgentVersion: "1.6.2", Message: "upgrade"}
+	if *resp != want {
+		t.Errorf("response = %+v, want %+v", *resp, want)
+	}
+	if got.InstanceID != s.identity.InstanceID || got.AgentVersion != "1.5.0" || got.OSArch == "" || got.Status != "ok" {
+		t.Errorf("request = %+v, want the instance, agent version and platform filled in", got)
+	}
+}
+
+func TestHeartbeat_Status(t *testing.T) {
+	tests := []struct {
+		code    int
+		body    string
+		wantErr error
+	}{
+		{http.StatusNoContent, "", nil},
+		{http.StatusOK, "", nil},
+		{http.StatusNotFound, "404 page not found", ErrHeartbeatUnsupported},
+		{http.StatusOK, "not json", errors.New("parsing")},
+		{http.StatusServiceUnavailable, "down", errors.New("status")},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.code)
+			w.Write([]byte(tt.body))
+		}))
+		s := newTestSender(t, srv.URL, 0)
+		resp, err := s.Heartbeat(context.Background(), HeartbeatRequest{})
+		srv.Close()
+
+		switch {
+		case tt.wantErr == nil && (err != nil || *resp != HeartbeatResponse{}):
+			t.Errorf("%d %q: Heartbeat() = %v, %v, want an empty response", tt.code, tt.body, resp, err)
+		case tt.wantErr == ErrHeartbeatUnsupported && !errors.Is(err, ErrHeartbeatUnsupported):
+			t.Errorf("%d: Heartbeat() error = %v, want ErrHeartbeatUnsupported", tt.code, err)
+		case tt.wantErr != nil && err == nil:
+			t.Errorf("%d %q: Heartbeat() error = nil, want an error", tt.code, tt.body)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// Registration records a successful registration with a server, so that
+// restarts do not register again unless something changed.
+type Registration struct {
+	ServerURL    string    `json:"server_url"`
+	Fingerprint  string    `json:"fingerprint"` // hash of the registered metadata
+	RegisteredAt time.Time `json:"registered_at"`
+}
+
+// registerRequest builds the registration payload for the current settings.
+func (s *Sender) registerRequest() RegisterRequest {
+	return RegisterRequest{
+		InstanceID:     s.identity.InstanceID,
+		PublicKey:      s.identity.PubKeyHex,
+		AppName:        s.appName,
+		AppVersion:     s.appVersion,
+		DeploymentMode: detectDeploymentMode(),
+		Environment:    s.environment,
+		OSArch:         fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH),
+		Tags:           s.tags,
+		Host:           s.host,
+	}
+}
+
+// fingerprint hashes the registration payload. Any change to the registered
+// metadata (app version, environment, keys...) changes the fingerprint.
+func fingerprint(req RegisterRequest) string {
+	data, _ := json.Marshal(req)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedRegistrationValid reports whether the identity's saved registration
+// still applies to this server and metadata.
+func (s *Sender) cachedRegistrationValid() bool {
+	reg := s.identity.Registration
+	return reg != nil &&
+		reg.ServerURL == s.serverURL &&
+		reg.Fingerprint == fingerprint(s.registerRequest())
+}
+
+// saveRegistration records the registration state in the identity and
+// persists it. Passing nil clears it.
+func (s *Sender) saveRegistration(reg *Registration) {
+	s.identity.Registration = reg
+	if s.persistIdentity == nil {
+		return
+	}
+	if err := s.persistIdentity(s.identity); err != nil {
+		s.logger.Warn("failed to save registration state", "error", err)
+	}
+}
+
+// invalidateRegistration forgets the registration after the server stopped
+// recognizing the instance, so that the next delivery registers again.
+func (s *Sender) invalidateRegistration(err error) {
+	s.logger.Warn("server no longer recognizes this instance, re-registering", "error", err)
+	s.registered = false
+	s.saveRegistration(nil)
+}
+
+// registrationLost reports whether err means the server no longer knows
+// this instance: 401 Unauthorized or 410 Gone.
+func registrationLost(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	return statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusGone
+}
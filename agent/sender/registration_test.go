@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/hostinfo"
+)
+
+func TestSender_CachedRegistration(t *testing.T) {
+	fs := newFlakyServer(t)
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	ident := &Identity{InstanceID: "test", PrivateKey: priv, PublicKey: pub}
+
+	persisted := 0
+	newSender := func(version string) *Sender {
+		return New(Config{
+			ServerURL:       fs.URL,
+			AppName:         "app",
+			AppVersion:      version,
+			Identity:        ident,
+			PersistIdentity: func(*Identity) error { persisted++; return nil },
+		})
+	}
+
+	if err := newSender("1.0.0").Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if ident.Registration == nil || persisted != 1 {
+		t.Fatalf("registration not saved (persisted %d times)", persisted)
+	}
+
+	// Restart with the same metadata: no new registration
+	newSender("1.0.0").Register(context.Background())
+	if got := fs.registers.Load(); got != 1 {
+		t.Errorf("registers = %d, want 1 (cached)", got)
+	}
+
+	// app_version changed: register again
+	newSender("1.1.0").Register(context.Background())
+	if got := fs.registers.Load(); got != 2 {
+		t.Errorf("registers = %d, want 2 after version change", got)
+	}
+}
+
+func TestSender_ReregistersWhenForgotten(t *testing.T) {
+	fs := newFlakyServer(t)
+	_, key, _ := ed25519.GenerateKey(nil)
+	s := newRetrySender(fs.URL, nil, key)
+
+	if err := s.SendSnapshot(context.Background(), snapshot(1)); err != nil {
+		t.Fatalf("SendSnapshot() error = %v", err)
+	}
+
+	// The server forgets the instance once
+	fs.status.Store(http.StatusGone)
+	fs.recover.Store(true)
+
+	if err := s.SendSnapshot(context.Background(), snapshot(2)); err != nil {
+		t.Fatalf("SendSnapshot() error = %v", err)
+	}
+	if got := fs.registers.Load(); got != 2 {
+		t.Errorf("registers = %d, want 2", got)
+	}
+	if got := fs.values(); len(got) != 2 {
+		t.Errorf("received %v, want 2 snapshots", got)
+	}
+}
+
+func TestSender_TagsAndHost(t *testing.T) {
+	var register RegisterRequest
+	var snapshot SnapshotRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/v1/register":
+			json.Unmarshal(body, &register)
+		case "/v1/snapshot":
+			json.Unmarshal(body, &snapshot)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	ident := &Identity{InstanceID: "test", PrivateKey: priv, PublicKey: pub}
+	tags := map[string]string{"role": "web", "region": "eu-west-1"}
+	host := &hostinfo.Host{Hostname: "web-1", Kernel: "6.1.0", CPUs: 4, CloudProvider: "aws"}
+	newSender := func(tags map[string]string) *Sender {
+		return New(Config{ServerURL: srv.URL, AppName: "app", Identity: ident, Tags: tags, Host: host})
+	}
+
+	s := newSender(tags)
+	if err := s.SendSnapshot(context.Background(), map[string]interface{}{"a": 1.0}); err != nil {
+		t.Fatalf("SendSnapshot() error = %v", err)
+	}
+	if !reflect.DeepEqual(register.Tags, tags) || !reflect.DeepEqual(register.Host, host) {
+		t.Errorf("registered tags %v and host %+v, want %v and %+v", register.Tags, register.Host, tags, host)
+	}
+	if !reflect.DeepEqual(snapshot.Tags, tags) || !reflect.DeepEqual(snapshot.Host, host) {
+		t.Errorf("snapshot tags %v and host %+v, want %v and %+v", snapshot.Tags, snapshot.Host, tags, host)
+	}
+
+	// Tags are registered metadata
+	if !newSender(tags).cachedRegistrationValid() {
+		t.Error("registration not cached with the same tags")
+	}
+	if newSender(map[string]string{"role": "db"}).cachedRegistrationValid() {
+		t.Error("registration still cached after the tags changed")
+	}
+}
@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// RemoteConfig is the configuration document the server serves to the
+// agent, see config.ParseRemote.
+type RemoteConfig struct {
+	Data []byte // empty when the server has none for the agent
+	ETag string
+}
+
+// ErrConfigNotModified is returned by FetchConfig when the configuration
+// is still the one of the ETag given.
+var ErrConfigNotModified = errors.New("configuration not modified")
+
+// ErrConfigUnsupported is returned by FetchConfig when the server does
+// not know the configuration endpoint.
+var ErrConfigUnsupported = errors.New("server does not serve configurations")
+
+// maxConfigResponse is the largest configuration read.
+const maxConfigResponse = 1 << 20
+
+// FetchConfig fetches the configuration the server serves to the agent.
+// Given the ETag of the configuration last fetched, it returns
+// ErrConfigNotModified when unchanged. The request is signed like the
+// others, over an empty body.
+func (s *Sender) FetchConfig(ctx context.Context, etag string) (*RemoteConfig, error) {
+	u := s.serverURL + "/v1/config?instance_id=" + url.QueryEscape(s.identity.InstanceID)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating config request: %w", err)
+	}
+	httpReq.Header.Set("Accept", "application/yaml, application/json")
+	if etag != "" {
+		httpReq.Header.Set("If-None-Match", etag)
+	}
+	if err := signRequest(httpReq.Header, s.identity.PrivateKey, nil); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("sending config request: %w", err)
+	}
+	defer drainAndClose(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return &RemoteConfig{Data: []byte{}, ETag: resp.Header.Get("ETag")}, nil
+	case http.StatusNotModified:
+		return nil, ErrConfigNotModified
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, ErrConfigUnsupported
+	default:
+		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, maxConfigResponse))
+		return nil, &StatusError{Op: "config", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigResponse+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading config response: %w", err)
+	}
+	if len(data) > maxConfigResponse {
+		return nil, fmt.Errorf("config response larger than %d bytes", maxConfigResponse)
+	}
+	return &RemoteConfig{Data: data, ETag: resp.Header.Get("ETag")}, nil
+}
@@ -0,0 +1,235 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/spool"
+)
+
+// Retry defaults.
+const (
+	DefaultInitialBackoff = 5 * time.Second
+	DefaultMaxBackoff     = 5 * time.Minute
+)
+
+// DefaultRetention bounds the in-memory queue used when no spool is set.
+var DefaultRetention = spool.Retention{
+	MaxAge:     24 * time.Hour,
+	MaxBytes:   64 << 20,
+	MaxEntries: 1000,
+}
+
+// RetryConfig controls the backoff between delivery attempts.
+// The delay doubles after each failed attempt, from InitialBackoff up to
+// MaxBackoff, with up to 20% random jitter.
+type RetryConfig struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// withDefaults returns the config with zero fields set to their defaults.
+func (c RetryConfig) withDefaults() RetryConfig {
+	if c.InitialBackoff <= 0 {
+		c.InitialBackoff = DefaultInitialBackoff
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = DefaultMaxBackoff
+	}
+	if c.MaxBackoff < c.InitialBackoff {
+		c.MaxBackoff = c.InitialBackoff
+	}
+	return c
+}
+
+// delay returns the backoff after the given number of consecutive failures.
+func (c RetryConfig) delay(failures int) time.Duration {
+	d := c.InitialBackoff
+	for i := 1; i < failures && d < c.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	return d + time.Duration(rand.Int64N(int64(d)/5+1))
+}
+
+// StatusError is returned when the server answers with an unexpected status.
+type StatusError struct {
+	Op         string // "register", "activate", "snapshot", "heartbeat", "config" or "rotate"
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s failed with status %d: %s", e.Op, e.StatusCode, e.Body)
+}
+
+// retryable reports whether a failed request may succeed if sent again.
+// Network errors, timeouts, rate limiting and server errors are retryable;
+// other client errors mean the request itself is rejected.
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+	return retryableStatus(statusErr.StatusCode)
+}
+
+// Flush sends every queued snapshot request, oldest first.
+//
+// It stops at the first retryable failure and schedules the next attempt
+// with exponential backoff; until then, Flush returns an error without
+// contacting the server. If the server answers 401 or 410, the instance
+// registers again and the request is retried once. Other requests rejected
+// by the server are dropped.
+func (s *Sender) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.queue.Len() == 0 {
+		return nil
+	}
+
+	if wait := time.Until(s.nextAttempt); wait > 0 {
+		return fmt.Errorf("server unavailable, %d requests queued, next attempt in %s",
+			s.queue.Len(), wait.Round(time.Second))
+	}
+
+	if !s.registered {
+		if err := s.Register(ctx); err != nil {
+			if retryable(err) {
+				s.backoff()
+			}
+			return fmt.Errorf("registering: %w", err)
+		}
+	}
+
+	var errs []error
+	reregistered := false
+	for {
+		entry, ok, err := s.queue.Oldest()
+		if err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		if !ok {
+			break
+		}
+
+		err = s.postSnapshot(ctx, entry.Data)
+		if err != nil && registrationLost(err) && !reregistered {
+			// Stale registration: register again and retry the same entry
+			reregistered = true
+			s.invalidateRegistration(err)
+			if err := s.Register(ctx); err != nil {
+				if retryable(err) {
+					s.backoff()
+				}
+				return errors.Join(append(errs, fmt.Errorf("re-registering: %w", err))...)
+			}
+			continue
+		}
+
+		if err != nil {
+			if retryable(err) && ctx.Err() == nil {
+				s.backoff()
+				errs = append(errs, fmt.Errorf("%w (%d requests queued)", err, s.queue.Len()))
+				return errors.Join(errs...)
+			}
+			if ctx.Err() != nil {
+				return errors.Join(append(errs, err)...)
+			}
+			s.failedAttempts.Add(1)
+			s.errors.Error("rejected", "snapshot rejected by server, dropped", "error", err)
+			errs = append(errs, err)
+		} else {
+			s.lastDelivery.Store(time.Now().UnixNano())
+		}
+		if err == nil && s.failures > 0 {
+			s.logger.Info("server reachable again, delivering queued snapshots", "queued", s.queue.Len())
+			s.failures = 0
+			s.nextAttempt = time.Time{}
+		}
+
+		if err := s.queue.Remove(entry.ID); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// backoff records a failed attempt and schedules the next one.
+// Must be called with s.mu held.
+func (s *Sender) backoff() {
+	s.failedAttempts.Add(1)
+	s.failures++
+	delay := s.retry.delay(s.failures)
+	s.nextAttempt = time.Now().Add(delay)
+	s.errors.Warn("unavailable", "server unavailable, will retry",
+		"attempt", s.failures, "retry_in", delay.Round(time.Millisecond), "queued", s.queue.Len())
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run retries queued snapshot requests once their backoff has elapsed,
+// so that a backlog is delivered as soon as the server is reachable rather
+// than at the next snapshot. It returns when ctx is cancelled.
+func (s *Sender) Run(ctx context.Context) {
+	for {
+		s.mu.Lock()
+		failing := s.failures > 0
+		next := s.nextAttempt
+		s.mu.Unlock()
+
+		if !failing || s.queue.Len() == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.wake:
+				continue
+			}
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+			if err := s.Flush(ctx); err != nil {
+				s.errors.Debug("retry", "retry failed", "error", err)
+			}
+		}
+	}
+}
+
+// LastDelivery returns when a snapshot request was last accepted by the
+// server, or the zero time if none was.
+func (s *Sender) LastDelivery() time.Time {
+	if ns := s.lastDelivery.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// FailedAttempts returns the number of delivery attempts that failed,
+// including registrations and requests rejected by the server.
+func (s *Sender) FailedAttempts() int64 {
+	return s.failedAttempts.Load()
+}
+
+// QueueStats returns the size and eviction counters of the send queue.
+func (s *Sender) QueueStats() spool.Stats {
+	return s.queue.Stats()
+}
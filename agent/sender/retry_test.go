@@ -0,0 +1,205 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/spool"
+)
+
+// flakyServer accepts snapshots only while up; otherwise it answers status.
+type flakyServer struct {
+	*httptest.Server
+
+	status    atomic.Int32 // 0 when up
+	registers atomic.Int32
+	recover   atomic.Bool // registering brings the server back up
+
+	mu       sync.Mutex
+	received []float64 // value of metric "n" of each accepted snapshot
+}
+
+func newFlakyServer(t *testing.T) *flakyServer {
+	t.Helper()
+
+	fs := &flakyServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/register", func(w http.ResponseWriter, r *http.Request) {
+		fs.registers.Add(1)
+		if fs.recover.Load() {
+			fs.status.Store(0)
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("/v1/activate", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/v1/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		if status := fs.status.Load(); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+		var req struct {
+			Metrics map[string]float64 `json:"metrics"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		fs.mu.Lock()
+		fs.received = append(fs.received, req.Metrics["n"])
+		fs.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	fs.Server = httptest.NewServer(mux)
+	t.Cleanup(fs.Close)
+	return fs
+}
+
+func (fs *flakyServer) values() []float64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([]float64(nil), fs.received...)
+}
+
+func newRetrySender(url string, queue spool.Queue, key ed25519.PrivateKey) *Sender {
+	return New(Config{
+		ServerURL: url,
+		Identity:  &Identity{InstanceID: "test", PrivateKey: key, PublicKey: key.Public().(ed25519.PublicKey)},
+		Queue:     queue,
+		Retry:     RetryConfig{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond},
+	})
+}
+
+func snapshot(n float64) map[string]interface{} {
+	return map[string]interface{}{"n": n}
+}
+
+func TestSender_QueuesDuringOutage(t *testing.T) {
+	fs := newFlakyServer(t)
+	_, key, _ := ed25519.GenerateKey(nil)
+	s := newRetrySender(fs.URL, nil, key)
+	ctx := context.Background()
+
+	fs.status.Store(http.StatusServiceUnavailable)
+	if err := s.SendSnapshot(ctx, snapshot(1)); err == nil {
+		t.Fatal("SendSnapshot() should fail while the server is down")
+	}
+
+	// Still in backoff: queued without contacting the server
+	if err := s.SendSnapshot(ctx, snapshot(2)); err == nil {
+		t.Fatal("SendSnapshot() should fail during backoff")
+	}
+	if got := s.QueueStats().Entries; got != 2 {
+		t.Fatalf("queued = %d, want 2", got)
+	}
+	if !s.LastDelivery().IsZero() {
+		t.Error("LastDelivery() should be zero before a delivery")
+	}
+
+	fs.status.Store(0)
+	time.Sleep(30 * time.Millisecond)
+
+	if err := s.SendSnapshot(ctx, snapshot(3)); err != nil {
+		t.Fatalf("SendSnapshot() error = %v", err)
+	}
+
+	got := fs.values()
+	want := []float64{1, 2, 3}
+	if len(got) != len(want) {
+		t.Fatalf("received %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("received %v, want %v (in order)", got, want)
+		}
+	}
+	if s.QueueStats().Entries != 0 {
+		t.Error("queue should be empty")
+	}
+	if time.Since(s.LastDelivery()) > time.Second {
+		t.Errorf("LastDelivery() = %v, want just now", s.LastDelivery())
+	}
+}
+
+func TestSender_DropsRejectedSnapshot(t *testing.T) {
+	fs := newFlakyServer(t)
+	_, key, _ := ed25519.GenerateKey(nil)
+	s := newRetrySender(fs.URL, nil, key)
+
+	fs.status.Store(http.StatusBadRequest)
+	if err := s.SendSnapshot(context.Background(), snapshot(1)); err == nil {
+		t.Fatal("SendSnapshot() should report the rejection")
+	}
+
+	if got := s.QueueStats().Entries; got != 0 {
+		t.Errorf("queued = %d, want 0 (rejected requests are not retried)", got)
+	}
+}
+
+func TestSender_RunRetries(t *testing.T) {
+	fs := newFlakyServer(t)
+	_, key, _ := ed25519.GenerateKey(nil)
+	s := newRetrySender(fs.URL, nil, key)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	fs.status.Store(http.StatusBadGateway)
+	s.SendSnapshot(ctx, snapshot(1))
+	fs.status.Store(0)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(fs.values()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("queued snapshot was not retried")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSender_SpoolSurvivesRestart(t *testing.T) {
+	fs := newFlakyServer(t)
+	_, key, _ := ed25519.GenerateKey(nil)
+	dir := t.TempDir()
+
+	sp, err := spool.Open(dir, spool.Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.status.Store(http.StatusServiceUnavailable)
+	newRetrySender(fs.URL, sp, key).SendSnapshot(context.Background(), snapshot(1))
+
+	// New sender on the same spool after a restart
+	sp, err = spool.Open(dir, spool.Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.status.Store(0)
+	if err := newRetrySender(fs.URL, sp, key).Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	if got := fs.values(); len(got) != 1 || got[0] != 1 {
+		t.Errorf("received %v, want [1]", got)
+	}
+}
+
+func TestRetryConfig_Delay(t *testing.T) {
+	c := RetryConfig{InitialBackoff: time.Second, MaxBackoff: 4 * time.Second}.withDefaults()
+
+	for failures, base := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 4 * time.Second} {
+		d := c.delay(failures)
+		if d < base || d > base+base/5 {
+			t.Errorf("delay(%d) = %v, want within 20%% above %v", failures, d, base)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// RotateRequest replaces the public key of an instance. It is signed with
+// the current key, and Proof, a signature of RotationMessage by the new
+// key, shows that the agent holds the new key too.
+type RotateRequest struct {
+	InstanceID string `json:"instance_id"`
+	PublicKey  string `json:"public_key"` // the new key, hex encoded
+	Proof      string `json:"proof"`
+}
+
+// RotationMessage returns the bytes signed by the new key of a rotation:
+// "rotate\n<instance_id>\n<new public key>".
+func RotationMessage(instanceID, publicKey string) []byte {
+	return []byte("rotate\n" + instanceID + "\n" + publicKey)
+}
+
+// ErrRotateUnsupported is returned by RotateKey when the server does not
+// know the rotation endpoint.
+var ErrRotateUnsupported = errors.New("server does not support key rotation")
+
+// WithKey returns a copy of the identity using key, with the same
+// instance ID and registration.
+func (id *Identity) WithKey(key ed25519.PrivateKey) *Identity {
+	pub := key.Public().(ed25519.PublicKey)
+	next := *id
+	next.PrivateKey = key
+	next.PublicKey = pub
+	next.PrivKeyHex = hex.EncodeToString(key)
+	next.PubKeyHex = hex.EncodeToString(pub)
+	return &next
+}
+
+// RotateKey makes key the key of the instance: it registers the instance
+// first if needed, sends its new public key in a request signed with the
+// current key, then switches to key and persists the identity. The
+// instance ID, and so what the server holds for the instance, is kept.
+// It must not run concurrently with other requests of the sender.
+func (s *Sender) RotateKey(ctx context.Context, key ed25519.PrivateKey) error {
+	if err := s.Register(ctx); err != nil {
+		return err
+	}
+
+	next := s.identity.WithKey(key)
+	if err := s.rotate(ctx, next); err != nil {
+		return err
+	}
+	s.logger.Info("rotated instance key", "instance_id", next.InstanceID, "public_key", next.PubKeyHex)
+
+	// The registered public key changed, and so did the fingerprint
+	*s.identity = *next
+	s.identity.Registration = &Registration{
+		ServerURL:    s.serverURL,
+		Fingerprint:  fingerprint(s.registerRequest()),
+		RegisteredAt: time.Now().UTC(),
+	}
+	if s.persistIdentity != nil {
+		if err := s.persistIdentity(s.identity); err != nil {
+			return fmt.Errorf("saving rotated identity: %w", err)
+		}
+	}
+	return nil
+}
+
+// CheckKey checks that the server accepts the current key of the
+// instance, with a rotation to that same key, which changes nothing on the
+// server. Unlike RotateKey, it never registers. A key the server does not
+// accept fails with a StatusError of status 401.
+func (s *Sender) CheckKey(ctx context.Context) error {
+	return s.rotate(ctx, s.identity)
+}
+
+// rotate sends the public key of next, signed with the current key.
+func (s *Sender) rotate(ctx context.Context, next *Identity) error {
+	key := next.PrivateKey
+	req := RotateRequest{
+		InstanceID: next.InstanceID,
+		PublicKey:  next.PubKeyHex,
+		Proof:      sign(key, RotationMessage(next.InstanceID, next.PubKeyHex)),
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("marshaling rotate request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.serverURL+"/v1/rotate", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating rotate request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if err := signRequest(httpReq.Header, s.identity.PrivateKey, body); err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("sending rotate request: %w", err)
+	}
+	defer drainAndClose(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return ErrRotateUnsupported
+	default:
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return &StatusError{Op: "rotate", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+	}
+	return nil
+}
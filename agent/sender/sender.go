@@ -7,23 +7,31 @@ import (
 	"bytes"
 	"context"
 	"crypto/ed25519"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
-	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/hostinfo"
+	"github.com/kolapsis/shm-agent/agent/logthrottle"
+	"github.com/kolapsis/shm-agent/agent/spool"
 )
 
 // Identity holds the cryptographic identity for the agent.
 type Identity struct {
-	InstanceID string            `json:"instance_id"`
+	InstanceID string             `json:"instance_id"`
 	PrivateKey ed25519.PrivateKey `json:"-"`
 	PublicKey  ed25519.PublicKey  `json:"-"`
-	PrivKeyHex string            `json:"private_key"`
-	PubKeyHex  string            `json:"public_key"`
+	PrivKeyHex string             `json:"private_key"`
+	PubKeyHex  string             `json:"public_key"`
+
+	// Registration is the last successful registration, if any.
+	Registration *Registration `json:"registration,omitempty"`
 }
 
 // RegisterRequest is the payload for instance registration.
@@ -35,25 +43,108 @@ type RegisterRequest struct {
 	DeploymentMode string `json:"deployment_mode"`
 	Environment    string `json:"environment"`
 	OSArch         string `json:"os_arch"`
+
+	Tags map[string]string `json:"tags,omitempty"`
+	Host *hostinfo.Host    `json:"host,omitempty"`
 }
 
 // SnapshotRequest is the payload for snapshot submission.
+// Snapshots larger than the payload limit are split into several requests
+// sharing the same timestamp and sequence; Part and Parts are then set
+// (1-based).
 type SnapshotRequest struct {
 	InstanceID string          `json:"instance_id"`
 	Timestamp  time.Time       `json:"timestamp"`
 	Metrics    json.RawMessage `json:"metrics"`
+	Part       int             `json:"part,omitempty"`
+	Parts      int             `json:"parts,omitempty"`
+
+	// Sequence numbers the snapshots of an instance from 1, so that the
+	// server can detect gaps, duplicates and out-of-order delivery. With
+	// Config.SequenceFile, it keeps increasing across restarts.
+	Sequence uint64 `json:"sequence"`
+
+	// IntervalStart and IntervalEnd bound the period the metrics were
+	// aggregated over, when known.
+	IntervalStart *time.Time `json:"interval_start,omitempty"`
+	IntervalEnd   *time.Time `json:"interval_end,omitempty"`
+
+	// Annotations flag notable metrics of the snapshot. They are sent with
+	// the first part only.
+	Annotations map[string]Annotation `json:"annotations,omitempty"`
+
+	// Tags and Host are those of the registration, with every part.
+	Tags map[string]string `json:"tags,omitempty"`
+	Host *hostinfo.Host    `json:"host,omitempty"`
 }
 
+// Snapshot is a snapshot to send.
+type Snapshot struct {
+	Metrics     map[string]interface{}
+	Annotations map[string]Annotation // keyed by metric name
+
+	// Start and End bound the aggregation interval; zero when unknown.
+	Start, End time.Time
+
+	// WindowStarts holds the start of the window of windowed sets, by
+	// name, as of the snapshot.
+	WindowStarts map[string]time.Time
+
+	// Timestamp is the time reported for the snapshot. Defaults to End,
+	// or to the current time when End is zero.
+	Timestamp time.Time
+}
+
+// AnnotationBurst marks a metric whose value is well above its recent average.
+const AnnotationBurst = "burst"
+
+// Annotation describes why a metric of a snapshot is notable.
+type Annotation struct {
+	Type     string  `json:"type"`
+	Value    float64 `json:"value"`
+	Baseline float64 `json:"baseline"` // trailing average the value is compared to
+	Ratio    float64 `json:"ratio"`    // value / baseline
+}
+
+// DefaultMaxPayloadSize is the default maximum snapshot request body size.
+const DefaultMaxPayloadSize = 1 << 20 // 1 MiB
+
 // Sender sends metrics to the SHM server.
 type Sender struct {
 	serverURL   string
 	appName     string
 	appVersion  string
 	environment string
-	identity    *Identity
-	client      *http.Client
-	logger      *slog.Logger
-	registered  bool
+	tags        map[string]string
+	host        *hostinfo.Host
+
+	agentVersion string
+	identity     *Identity
+	client       *http.Client
+	logger       *slog.Logger
+	errors       *logthrottle.Logger // recurring delivery errors
+	registered   bool
+
+	persistIdentity func(*Identity) error
+
+	maxPayloadSize int
+
+	format string
+	types  func(name string) (aggregator.MetricType, bool)
+
+	queue spool.Queue
+	retry RetryConfig
+	wake  chan struct{}
+
+	// mu serializes deliveries and guards the backoff state.
+	mu          sync.Mutex
+	failures    int
+	nextAttempt time.Time
+
+	sequence       atomic.Uint64 // of the last queued snapshot
+	sequenceFile   string
+	lastDelivery   atomic.Int64 // unix nanoseconds, 0 before the first delivery
+	failedAttempts atomic.Int64 // requests that failed or were rejected
 }
 
 // Config holds sender configuration.
@@ -63,7 +154,49 @@ type Config struct {
 	AppVersion  string
 	Environment string
 	Identity    *Identity
-	Logger      *slog.Logger
+
+	// Tags and Host are sent with the registration and every snapshot.
+	// Host is nil when host metadata is disabled.
+	Tags map[string]string
+	Host *hostinfo.Host
+
+	// AgentVersion is the version of the agent reported by Heartbeat.
+	AgentVersion string
+
+	Logger *slog.Logger
+
+	// MaxPayloadSize is the maximum snapshot request body size in bytes.
+	// Defaults to DefaultMaxPayloadSize.
+	MaxPayloadSize int
+
+	// Format selects the encoding of the metrics of snapshots: FormatMap
+	// (default) or FormatStructured.
+	Format string
+
+	// Types fills the type of each FormatStructured entry and leaves the
+	// interval out of gauges. Unused with FormatMap.
+	Types func(name string) (aggregator.MetricType, bool)
+
+	// Transport tunes connection handling.
+	Transport TransportConfig
+
+	// Auth adds a token to every request, in addition to signatures.
+	Auth AuthConfig
+
+	// Queue holds snapshot requests until they are delivered.
+	// Defaults to an in-memory queue with DefaultRetention.
+	Queue spool.Queue
+
+	// Retry controls the backoff between delivery attempts.
+	Retry RetryConfig
+
+	// PersistIdentity saves the identity after its registration state
+	// changed. Without it, the agent registers at every start.
+	PersistIdentity func(*Identity) error
+
+	// SequenceFile keeps the sequence of the last queued snapshot across
+	// restarts. Without it, the sequence starts over at 1.
+	SequenceFile string
 }
 
 // New creates a new Sender.
@@ -73,17 +206,64 @@ func New(cfg Config) *Sender {
 		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
 	}
 
-	return &Sender{
-		serverURL:   cfg.ServerURL,
-		appName:     cfg.AppName,
-		appVersion:  cfg.AppVersion,
-		environment: cfg.Environment,
-		identity:    cfg.Identity,
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
-		logger: logger,
+	maxPayloadSize := cfg.MaxPayloadSize
+	if maxPayloadSize <= 0 {
+		maxPayloadSize = DefaultMaxPayloadSize
 	}
+
+	queue := cfg.Queue
+	if queue == nil {
+		queue = spool.NewMemory(DefaultRetention)
+	}
+
+	s := &Sender{
+		maxPayloadSize: maxPayloadSize,
+		format:         cfg.Format,
+		types:          cfg.Types,
+		serverURL:      cfg.ServerURL,
+		appName:        cfg.AppName,
+		appVersion:     cfg.AppVersion,
+		environment:    cfg.Environment,
+		tags:           cfg.Tags,
+		host:           cfg.Host,
+		agentVersion:   cfg.AgentVersion,
+		identity:       cfg.Identity,
+		client:         NewHTTPClient(cfg.Transport.withoutRetries(), logger),
+		logger:         logger,
+		errors:         logthrottle.New(logger, 0),
+		queue:          queue,
+		retry:          cfg.Retry.withDefaults(),
+		wake:           make(chan struct{}, 1),
+
+		persistIdentity: cfg.PersistIdentity,
+		sequenceFile:    cfg.SequenceFile,
+	}
+
+	if cfg.Auth.enabled() {
+		s.client.Transport = newAuthTransport(s.client.Transport, cfg.Auth, cfg.ServerURL)
+	}
+
+	if s.sequenceFile != "" {
+		seq, err := loadSequence(s.sequenceFile, s.identity.InstanceID)
+		if err != nil {
+			logger.Warn("failed to load snapshot sequence, starting over", "sequence_file", s.sequenceFile, "error", err)
+		}
+		s.sequence.Store(seq)
+	}
+
+	if s.cachedRegistrationValid() {
+		s.registered = true
+		logger.Debug("using saved registration", "registered_at", s.identity.Registration.RegisteredAt)
+	}
+
+	return s
+}
+
+// Close releases idle connections held by the sender and logs the
+// delivery errors repeated since they were last logged.
+func (s *Sender) Close() {
+	s.client.CloseIdleConnections()
+	s.errors.Flush()
 }
 
 // Register registers the agent with the server.
@@ -92,15 +272,7 @@ func (s *Sender) Register(ctx context.Context) error {
 		return nil
 	}
 
-	req := RegisterRequest{
-		InstanceID:     s.identity.InstanceID,
-		PublicKey:      s.identity.PubKeyHex,
-		AppName:        s.appName,
-		AppVersion:     s.appVersion,
-		DeploymentMode: detectDeploymentMode(),
-		Environment:    s.environment,
-		OSArch:         fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH),
-	}
+	req := s.registerRequest()
 
 	body, err := json.Marshal(req)
 	if err != nil {
@@ -117,18 +289,27 @@ func (s *Sender) Register(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("sending register request: %w", err)
 	}
-	defer resp.Body.Close()
+	defer drainAndClose(resp.Body)
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("register failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+		return &StatusError{Op: "register", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
 	}
 
-	s.registered = true
 	s.logger.Info("registered with server", "instance_id", s.identity.InstanceID)
 
 	// Activate after registration
-	return s.activate(ctx)
+	if err := s.activate(ctx); err != nil {
+		return err
+	}
+
+	s.registered = true
+	s.saveRegistration(&Registration{
+		ServerURL:    s.serverURL,
+		Fingerprint:  fingerprint(req),
+		RegisteredAt: time.Now().UTC(),
+	})
+	return nil
 }
 
 // activate sends an activation request.
@@ -142,82 +323,201 @@ func (s *Sender) activate(ctx context.Context) error {
 		return fmt.Errorf("marshaling activate request: %w", err)
 	}
 
-	signature := sign(s.identity.PrivateKey, body)
-
 	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.serverURL+"/v1/activate", bytes.NewReader(body))
 	if err != nil {
 		return fmt.Errorf("creating activate request: %w", err)
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("X-Signature", signature)
+	if err := signRequest(httpReq.Header, s.identity.PrivateKey, body); err != nil {
+		return err
+	}
 
 	resp, err := s.client.Do(httpReq)
 	if err != nil {
 		return fmt.Errorf("sending activate request: %w", err)
 	}
-	defer resp.Body.Close()
+	defer drainAndClose(resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("activate failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+		return &StatusError{Op: "activate", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
 	}
 
 	s.logger.Info("activated with server")
 	return nil
 }
 
-// SendSnapshot sends metrics to the server.
+// SendSnapshot queues a snapshot and sends every queued request to the
+// server, oldest first.
+//
+// If the request would exceed the payload size limit, the metrics are split
+// across several requests. A metric too large to fit in a request on its
+// own is dropped with a warning. Requests that could not be delivered stay
+// queued and are retried with exponential backoff, by the next call or by
+// Run.
 func (s *Sender) SendSnapshot(ctx context.Context, metrics map[string]interface{}) error {
-	if !s.registered {
-		if err := s.Register(ctx); err != nil {
-			return fmt.Errorf("registering: %w", err)
-		}
-	}
+	return s.SendAnnotatedSnapshot(ctx, metrics, nil)
+}
 
-	metricsJSON, err := json.Marshal(metrics)
-	if err != nil {
-		return fmt.Errorf("marshaling metrics: %w", err)
-	}
+// SendAnnotatedSnapshot is like SendSnapshot and attaches annotations,
+// keyed by metric name, to the snapshot.
+func (s *Sender) SendAnnotatedSnapshot(ctx context.Context, metrics map[string]interface{}, annotations map[string]Annotation) error {
+	return s.Send(ctx, Snapshot{Metrics: metrics, Annotations: annotations})
+}
 
-	req := SnapshotRequest{
+// Send is like SendSnapshot for a snapshot with its interval.
+func (s *Sender) Send(ctx context.Context, snap Snapshot) error {
+	base := SnapshotRequest{
 		InstanceID: s.identity.InstanceID,
-		Timestamp:  time.Now().UTC(),
-		Metrics:    metricsJSON,
+		Timestamp:  snap.Timestamp,
+		Sequence:   s.nextSequence(),
+		Tags:       s.tags,
+		Host:       s.host,
+	}
+	if !snap.Start.IsZero() {
+		start := snap.Start.UTC()
+		base.IntervalStart = &start
+	}
+	if !snap.End.IsZero() {
+		end := snap.End.UTC()
+		base.IntervalEnd = &end
+	}
+	if base.Timestamp.IsZero() {
+		base.Timestamp = snap.End
+	}
+	if base.Timestamp.IsZero() {
+		base.Timestamp = time.Now()
 	}
+	base.Timestamp = base.Timestamp.UTC()
 
-	body, err := json.Marshal(req)
+	parts, err := s.splitMetrics(snap, base)
 	if err != nil {
-		return fmt.Errorf("marshaling snapshot request: %w", err)
+		return err
+	}
+
+	for i, part := range parts {
+		req := base
+		req.Metrics = part
+		if i == 0 {
+			req.Annotations = snap.Annotations
+		}
+		if len(parts) > 1 {
+			req.Part = i + 1
+			req.Parts = len(parts)
+		}
+
+		body, err := json.Marshal(req)
+		if err != nil {
+			return fmt.Errorf("marshaling snapshot request: %w", err)
+		}
+		if err := s.queue.Push(body); err != nil {
+			return fmt.Errorf("queueing snapshot: %w", err)
+		}
 	}
 
-	signature := sign(s.identity.PrivateKey, body)
+	s.logger.Debug("queued snapshot", "sequence", base.Sequence, "metrics_count", len(snap.Metrics), "parts", len(parts))
+
+	return s.Flush(ctx)
+}
 
+// nextSequence returns the sequence of a new snapshot and saves it.
+func (s *Sender) nextSequence() uint64 {
+	seq := s.sequence.Add(1)
+	if s.sequenceFile != "" {
+		if err := saveSequence(s.sequenceFile, s.identity.InstanceID, seq); err != nil {
+			s.errors.Warn("sequence", "failed to save snapshot sequence", "sequence_file", s.sequenceFile, "error", err)
+		}
+	}
+	return seq
+}
+
+// postSnapshot signs and sends a single encoded snapshot request.
+func (s *Sender) postSnapshot(ctx context.Context, body []byte) error {
 	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.serverURL+"/v1/snapshot", bytes.NewReader(body))
 	if err != nil {
 		return fmt.Errorf("creating snapshot request: %w", err)
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("X-Signature", signature)
+	if err := signRequest(httpReq.Header, s.identity.PrivateKey, body); err != nil {
+		return err
+	}
 
 	resp, err := s.client.Do(httpReq)
 	if err != nil {
 		return fmt.Errorf("sending snapshot request: %w", err)
 	}
-	defer resp.Body.Close()
+	defer drainAndClose(resp.Body)
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("snapshot failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+		return &StatusError{Op: "snapshot", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
 	}
 
-	s.logger.Debug("sent snapshot", "metrics_count", len(metrics))
 	return nil
 }
 
-// sign creates an Ed25519 signature of the message.
-func sign(privateKey ed25519.PrivateKey, message []byte) string {
-	sig := ed25519.Sign(privateKey, message)
-	return hex.EncodeToString(sig)
+// splitMetrics encodes the metrics of a snapshot into one or more JSON
+// objects, or arrays for FormatStructured, so that each snapshot request
+// stays within the payload size limit. Metrics are packed in name order.
+// Annotations are counted against the budget of every part, as are the
+// fields of base.
+func (s *Sender) splitMetrics(snap Snapshot, base SnapshotRequest) ([]json.RawMessage, error) {
+	open, closing := byte('{'), byte('}')
+	if s.format == FormatStructured {
+		open, closing = '[', ']'
+	}
+
+	// Size of a request with empty metrics and part counters
+	empty := base
+	empty.Metrics = json.RawMessage{open, closing}
+	empty.Part, empty.Parts = 999, 999
+	empty.Annotations = snap.Annotations
+	overhead, err := json.Marshal(empty)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling snapshot request: %w", err)
+	}
+	budget := s.maxPayloadSize - len(overhead)
+
+	entries, err := s.encodeMetrics(snap)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []json.RawMessage
+	var current []byte
+
+	flush := func() {
+		if current != nil {
+			parts = append(parts, json.RawMessage(append(current, closing)))
+			current = nil
+		}
+	}
+
+	for _, e := range entries {
+		if len(e.data) > budget {
+			s.logger.Warn("metric exceeds the snapshot payload size limit, dropped",
+				"metric", e.name, "size", len(e.data), "max_payload_size", s.maxPayloadSize)
+			continue
+		}
+
+		// +1 for the separating comma
+		if current != nil && len(current)+1+len(e.data) > budget {
+			flush()
+		}
+
+		if current == nil {
+			current = append([]byte{open}, e.data...)
+		} else {
+			current = append(append(current, ','), e.data...)
+		}
+	}
+	flush()
+
+	if len(parts) == 0 {
+		parts = append(parts, json.RawMessage{open, closing})
+	}
+
+	return parts, nil
 }
 
 // detectDeploymentMode detects how the agent is deployed.
@@ -0,0 +1,263 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type snapshotServer struct {
+	mu       sync.Mutex
+	requests []SnapshotRequest
+	sizes    []int
+}
+
+func newSnapshotServer(t *testing.T) (*snapshotServer, *httptest.Server) {
+	t.Helper()
+
+	ss := &snapshotServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/register", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("/v1/activate", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/v1/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req SnapshotRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ss.mu.Lock()
+		ss.requests = append(ss.requests, req)
+		ss.sizes = append(ss.sizes, len(body))
+		ss.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return ss, srv
+}
+
+func newTestSender(t *testing.T, url string, maxPayloadSize int) *Sender {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(Config{
+		ServerURL:      url,
+		AppName:        "test",
+		Identity:       &Identity{InstanceID: "test-instance", PrivateKey: priv, PublicKey: pub},
+		MaxPayloadSize: maxPayloadSize,
+	})
+}
+
+func TestSendSnapshot_SingleRequest(t *testing.T) {
+	ss, srv := newSnapshotServer(t)
+	s := newTestSender(t, srv.URL, 0)
+
+	metrics := map[string]interface{}{"a": 1.0, "b": 2.0}
+	if err := s.SendSnapshot(context.Background(), metrics); err != nil {
+		t.Fatalf("SendSnapshot() error = %v", err)
+	}
+
+	if len(ss.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(ss.requests))
+	}
+	req := ss.requests[0]
+	if req.Part != 0 || req.Parts != 0 {
+		t.Errorf("Part/Parts = %d/%d, want unset", req.Part, req.Parts)
+	}
+}
+
+func TestSendSnapshot_SplitsLargeSnapshot(t *testing.T) {
+	ss, srv := newSnapshotServer(t)
+	const limit = 1024
+	s := newTestSender(t, srv.URL, limit)
+
+	metrics := make(map[string]interface{})
+	for i := 0; i < 100; i++ {
+		metrics[fmt.Sprintf("metric_with_a_long_name_%03d", i)] = float64(i)
+	}
+
+	if err := s.SendSnapshot(context.Background(), metrics); err != nil {
+		t.Fatalf("SendSnapshot() error = %v", err)
+	}
+
+	if len(ss.requests) < 2 {
+		t.Fatalf("got %d requests, want several", len(ss.requests))
+	}
+
+	seen := make(map[string]bool)
+	for i, req := range ss.requests {
+		if ss.sizes[i] > limit {
+			t.Errorf("request %d is %d bytes, limit %d", i, ss.sizes[i], limit)
+		}
+		if req.Part != i+1 || req.Parts != len(ss.requests) {
+			t.Errorf("request %d: Part/Parts = %d/%d", i, req.Part, req.Parts)
+		}
+		if !req.Timestamp.Equal(ss.requests[0].Timestamp) || req.Sequence != 1 {
+			t.Errorf("request %d has a different timestamp or sequence", i)
+		}
+		var part map[string]float64
+		if err := json.Unmarshal(req.Metrics, &part); err != nil {
+			t.Fatalf("request %d: invalid metrics: %v", i, err)
+		}
+		for name := range part {
+			seen[name] = true
+		}
+	}
+	if len(seen) != len(metrics) {
+		t.Errorf("received %d metrics, want %d", len(seen), len(metrics))
+	}
+}
+
+func TestSend_SequenceFile(t *testing.T) {
+	ss, srv := newSnapshotServer(t)
+	path := filepath.Join(t.TempDir(), "shm_sequence.json")
+	_, key, _ := ed25519.GenerateKey(nil)
+	newSender := func(instanceID string) *Sender {
+		return New(Config{
+			ServerURL:    srv.URL,
+			AppName:      "test",
+			Identity:     &Identity{InstanceID: instanceID, PrivateKey: key},
+			SequenceFile: path,
+		})
+	}
+
+	// The sequence continues after a restart, and starts over for
+	// another instance
+	for _, instanceID := range []string{"a", "a", "b"} {
+		s := newSender(instanceID)
+		for i := 0; i < 2; i++ {
+			if err := s.SendSnapshot(context.Background(), map[string]interface{}{"n": 1.0}); err != nil {
+				t.Fatalf("SendSnapshot() error = %v", err)
+			}
+		}
+		s.Close()
+	}
+
+	var got []uint64
+	for _, req := range ss.requests {
+		got = append(got, req.Sequence)
+	}
+	if want := []uint64{1, 2, 3, 4, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sequences = %v, want %v", got, want)
+	}
+}
+
+func TestSend_Interval(t *testing.T) {
+	ss, srv := newSnapshotServer(t)
+	s := newTestSender(t, srv.URL, 0)
+
+	start := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	end := start.Add(time.Minute)
+	metrics := map[string]interface{}{"a": 1.0}
+	for _, snap := range []Snapshot{
+		{Metrics: metrics, Start: start, End: end},
+		{Metrics: metrics, Start: end, End: end.Add(time.Minute), Timestamp: end},
+		{Metrics: metrics},
+	} {
+		if err := s.Send(context.Background(), snap); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+
+	if len(ss.requests) != 3 {
+		t.Fatalf("got %d requests, want 3", len(ss.requests))
+	}
+	for i, req := range ss.requests {
+		if req.Sequence != uint64(i+1) {
+			t.Errorf("request %d: sequence = %d, want %d", i, req.Sequence, i+1)
+		}
+	}
+	first := ss.requests[0]
+	if first.IntervalStart == nil || !first.IntervalStart.Equal(start) ||
+		first.IntervalEnd == nil || !first.IntervalEnd.Equal(end) || !first.Timestamp.Equal(end) {
+		t.Errorf("interval = %v - %v, timestamp %v; want %v - %v, timestamp at the end",
+			first.IntervalStart, first.IntervalEnd, first.Timestamp, start, end)
+	}
+	if ts := ss.requests[1].Timestamp; !ts.Equal(end) {
+		t.Errorf("timestamp = %v, want the one given, %v", ts, end)
+	}
+	if last := ss.requests[2]; last.IntervalStart != nil || last.IntervalEnd != nil || last.Timestamp.IsZero() {
+		t.Errorf("snapshot without interval: %+v", last)
+	}
+}
+
+func TestSendSnapshot_DropsOversizedMetric(t *testing.T) {
+	ss, srv := newSnapshotServer(t)
+	s := newTestSender(t, srv.URL, 1024)
+
+	metrics := map[string]interface{}{
+		"small": 1.0,
+		"huge":  strings.Repeat("x", 2048),
+	}
+	if err := s.SendSnapshot(context.Background(), metrics); err != nil {
+		t.Fatalf("SendSnapshot() error = %v", err)
+	}
+
+	if len(ss.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(ss.requests))
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(ss.requests[0].Metrics, &got); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got["huge"]; ok {
+		t.Error("oversized metric was sent")
+	}
+	if got["small"] != 1.0 {
+		t.Errorf("small = %v, want 1", got["small"])
+	}
+}
+
+func TestSendAnnotatedSnapshot(t *testing.T) {
+	ss, srv := newSnapshotServer(t)
+	const limit = 1024
+	s := newTestSender(t, srv.URL, limit)
+
+	metrics := make(map[string]interface{})
+	for i := 0; i < 100; i++ {
+		metrics[fmt.Sprintf("metric_with_a_long_name_%03d", i)] = float64(i)
+	}
+	annotations := map[string]Annotation{
+		"metric_with_a_long_name_042": {Type: AnnotationBurst, Value: 42, Baseline: 10, Ratio: 4.2},
+	}
+
+	if err := s.SendAnnotatedSnapshot(context.Background(), metrics, annotations); err != nil {
+		t.Fatalf("SendAnnotatedSnapshot() error = %v", err)
+	}
+
+	if len(ss.requests) < 2 {
+		t.Fatalf("got %d requests, want several", len(ss.requests))
+	}
+	for i, req := range ss.requests {
+		if ss.sizes[i] > limit {
+			t.Errorf("request %d is %d bytes, limit %d", i, ss.sizes[i], limit)
+		}
+		if i == 0 && req.Annotations["metric_with_a_long_name_042"].Type != AnnotationBurst {
+			t.Errorf("first request annotations = %v", req.Annotations)
+		}
+		if i > 0 && req.Annotations != nil {
+			t.Errorf("request %d repeats annotations", i)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/kolapsis/shm-agent/agent/atomicfile"
+)
+
+// storedSequence is the content of a sequence file.
+type storedSequence struct {
+	InstanceID string `json:"instance_id"`
+	Sequence   uint64 `json:"sequence"`
+}
+
+// loadSequence returns the last sequence saved for instanceID, 0 if the
+// file does not exist or belongs to another instance.
+func loadSequence(path, instanceID string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var stored storedSequence
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return 0, fmt.Errorf("parsing sequence file: %w", err)
+	}
+	if stored.InstanceID != instanceID {
+		return 0, nil
+	}
+	return stored.Sequence, nil
+}
+
+// saveSequence writes the sequence file atomically.
+func saveSequence(path, instanceID string, seq uint64) error {
+	data, err := json.Marshal(storedSequence{InstanceID: instanceID, Sequence: seq})
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.Write(path, data, 0600); err != nil {
+		return fmt.Errorf("writing sequence file: %w", err)
+	}
+	return nil
+}
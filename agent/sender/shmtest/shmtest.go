@@ -0,0 +1,441 @@
+// SPDX-License-Identifier: MIT
+
+// Package shmtest provides a mock SHM server for testing clients of the
+// protocol. It checks that requests are well-formed and signed by the
+// registered key without being replayed, answers with the status codes of
+// the real server, and records what it received.
+package shmtest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+// Endpoints of the protocol.
+const (
+	PathRegister  = "/v1/register"
+	PathActivate  = "/v1/activate"
+	PathSnapshot  = "/v1/snapshot"
+	PathHeartbeat = "/v1/heartbeat"
+	PathConfig    = "/v1/config"
+	PathRotate    = "/v1/rotate"
+)
+
+// maxBodySize is the largest request body accepted.
+const maxBodySize = 8 << 20
+
+// Server is a mock SHM server.
+type Server struct {
+	*httptest.Server
+
+	verifier *sender.Verifier
+
+	mu         sync.Mutex
+	instances  map[string]*instance
+	registered []sender.RegisterRequest
+	snapshots  []sender.SnapshotRequest
+	heartbeats []sender.HeartbeatRequest
+	rotations  []sender.RotateRequest
+	versions   sender.HeartbeatResponse // answered to heartbeats
+	config     []byte                   // served to every instance, none when nil
+	fetches    int                      // configuration requests answered 200
+	violations []string
+	status     map[string]int // forced response status by path
+}
+
+// instance is a registered agent.
+type instance struct {
+	publicKey ed25519.PublicKey
+	activated bool
+}
+
+// NewServer starts a mock server. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		verifier:  sender.NewVerifier(0),
+		instances: make(map[string]*instance),
+		status:    make(map[string]int),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(PathRegister, s.handle(s.register))
+	mux.HandleFunc(PathActivate, s.handle(s.activate))
+	mux.HandleFunc(PathSnapshot, s.handle(s.snapshot))
+	mux.HandleFunc(PathHeartbeat, s.handle(s.heartbeat))
+	mux.HandleFunc(PathConfig, s.serveConfig)
+	mux.HandleFunc(PathRotate, s.handle(s.rotate))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// SetStatus makes the server answer requests to path with code instead
+// of handling them, e.g. to test retries. A code of 0 restores handling.
+func (s *Server) SetStatus(path string, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if code == 0 {
+		delete(s.status, path)
+		return
+	}
+	s.status[path] = code
+}
+
+// SetVersions sets the versions answered to heartbeats.
+func (s *Server) SetVersions(resp sender.HeartbeatResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.versions = resp
+}
+
+// SetConfig sets the configuration document served to every instance;
+// nil serves none.
+func (s *Server) SetConfig(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = data
+}
+
+// ConfigFetches returns the number of configuration requests answered
+// with the document, not counting those answered 304.
+func (s *Server) ConfigFetches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+// Heartbeats returns the heartbeat requests accepted so far.
+func (s *Server) Heartbeats() []sender.HeartbeatRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sender.HeartbeatRequest(nil), s.heartbeats...)
+}
+
+// Registrations returns the registration requests accepted so far.
+func (s *Server) Registrations() []sender.RegisterRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sender.RegisterRequest(nil), s.registered...)
+}
+
+// Rotations returns the key rotation requests accepted so far.
+func (s *Server) Rotations() []sender.RotateRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sender.RotateRequest(nil), s.rotations...)
+}
+
+// Snapshots returns the snapshot requests accepted so far.
+func (s *Server) Snapshots() []sender.SnapshotRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sender.SnapshotRequest(nil), s.snapshots...)
+}
+
+// Violations describes the requests rejected for not following the
+// protocol, oldest first.
+func (s *Server) Violations() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.violations...)
+}
+
+// protocolError is a rejected request: its status code and reason.
+type protocolError struct {
+	code   int
+	reason string
+}
+
+func (e *protocolError) Error() string {
+	return e.reason
+}
+
+// reject returns a protocol error with a formatted reason.
+func reject(code int, format string, args ...any) error {
+	return &protocolError{code: code, reason: fmt.Sprintf(format, args...)}
+}
+
+// handle checks what every endpoint has in common, then runs h with the
+// request body, with s.mu held. h returns the success status or a protocol
+// error.
+func (s *Server) handle(h func(r *http.Request, body []byte) (int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if code, ok := s.status[r.URL.Path]; ok {
+			w.WriteHeader(code)
+			return
+		}
+
+		code, err := s.check(r, h)
+		if err != nil {
+			perr := err.(*protocolError)
+			s.violations = append(s.violations, fmt.Sprintf("%s: %s", r.URL.Path, perr.reason))
+			http.Error(w, perr.reason, perr.code)
+			return
+		}
+		if r.URL.Path == PathHeartbeat {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(code)
+			json.NewEncoder(w).Encode(s.versions)
+			return
+		}
+		w.WriteHeader(code)
+	}
+}
+
+// check validates the method, content type and body of a request and
+// passes the body to h.
+func (s *Server) check(r *http.Request, h func(r *http.Request, body []byte) (int, error)) (int, error) {
+	if r.Method != http.MethodPost {
+		return 0, reject(http.StatusMethodNotAllowed, "method %s, want POST", r.Method)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+		return 0, reject(http.StatusUnsupportedMediaType, "content type %q, want application/json", ct)
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return 0, reject(http.StatusBadRequest, "reading body: %v", err)
+	}
+	if len(body) > maxBodySize {
+		return 0, reject(http.StatusRequestEntityTooLarge, "body larger than %d bytes", maxBodySize)
+	}
+	return h(r, body)
+}
+
+// decode unmarshals a JSON body into v.
+func decode(body []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if err := dec.Decode(v); err != nil {
+		return reject(http.StatusBadRequest, "invalid JSON: %v", err)
+	}
+	return nil
+}
+
+// register handles a registration request.
+func (s *Server) register(_ *http.Request, body []byte) (int, error) {
+	var req sender.RegisterRequest
+	if err := decode(body, &req); err != nil {
+		return 0, err
+	}
+
+	for field, value := range map[string]string{
+		"instance_id": req.InstanceID,
+		"public_key":  req.PublicKey,
+		"app_name":    req.AppName,
+		"app_version": req.AppVersion,
+	} {
+		if value == "" {
+			return 0, reject(http.StatusBadRequest, "missing %s", field)
+		}
+	}
+	key, err := hex.DecodeString(req.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return 0, reject(http.StatusBadRequest, "public_key is not a hex encoded Ed25519 key")
+	}
+
+	s.instances[req.InstanceID] = &instance{publicKey: key}
+	s.registered = append(s.registered, req)
+	return http.StatusCreated, nil
+}
+
+// activate handles an activation request.
+func (s *Server) activate(r *http.Request, body []byte) (int, error) {
+	var req struct {
+		InstanceID string `json:"instance_id"`
+	}
+	if err := decode(body, &req); err != nil {
+		return 0, err
+	}
+
+	inst, err := s.verify(r, req.InstanceID, body)
+	if err != nil {
+		return 0, err
+	}
+	inst.activated = true
+	return http.StatusOK, nil
+}
+
+// snapshot handles a snapshot request.
+func (s *Server) snapshot(r *http.Request, body []byte) (int, error) {
+	var req sender.SnapshotRequest
+	if err := decode(body, &req); err != nil {
+		return 0, err
+	}
+
+	inst, err := s.verify(r, req.InstanceID, body)
+	if err != nil {
+		return 0, err
+	}
+	if !inst.activated {
+		return 0, reject(http.StatusUnauthorized, "instance %s is not activated", req.InstanceID)
+	}
+
+	if req.Timestamp.IsZero() {
+		return 0, reject(http.StatusBadRequest, "missing timestamp")
+	}
+	if req.Sequence == 0 {
+		return 0, reject(http.StatusBadRequest, "missing sequence")
+	}
+	if req.IntervalStart != nil && req.IntervalEnd != nil && req.IntervalStart.After(*req.IntervalEnd) {
+		return 0, reject(http.StatusBadRequest, "interval_start %s after interval_end %s", req.IntervalStart, req.IntervalEnd)
+	}
+	if err := checkMetrics(req.Metrics); err != nil {
+		return 0, err
+	}
+	if (req.Part == 0) != (req.Parts == 0) || req.Part < 0 || req.Part > req.Parts {
+		return 0, reject(http.StatusBadRequest, "invalid part %d of %d", req.Part, req.Parts)
+	}
+	if req.Part > 1 && req.Annotations != nil {
+		return 0, reject(http.StatusBadRequest, "annotations sent with part %d, want the first part only", req.Part)
+	}
+
+	s.snapshots = append(s.snapshots, req)
+	return http.StatusAccepted, nil
+}
+
+// checkMetrics checks the metrics of a snapshot: an object of values by
+// name, or an array of named entries in the structured format.
+func checkMetrics(data json.RawMessage) error {
+	var metrics map[string]json.RawMessage
+	if err := json.Unmarshal(data, &metrics); err == nil && metrics != nil {
+		return nil
+	}
+
+	var entries []sender.MetricEntry
+	if err := json.Unmarshal(data, &entries); err != nil || entries == nil {
+		return reject(http.StatusBadRequest, "metrics is neither a JSON object nor an array of entries")
+	}
+	for i, e := range entries {
+		if e.Name == "" {
+			return reject(http.StatusBadRequest, "metrics[%d] has no name", i)
+		}
+		if e.Interval != nil && e.Interval.Start.After(e.Interval.End) {
+			return reject(http.StatusBadRequest, "metrics[%d] interval starts after it ends", i)
+		}
+	}
+	return nil
+}
+
+// heartbeat handles a heartbeat request.
+func (s *Server) heartbeat(r *http.Request, body []byte) (int, error) {
+	var req sender.HeartbeatRequest
+	if err := decode(body, &req); err != nil {
+		return 0, err
+	}
+
+	inst, err := s.verify(r, req.InstanceID, body)
+	if err != nil {
+		return 0, err
+	}
+	if !inst.activated {
+		return 0, reject(http.StatusUnauthorized, "instance %s is not activated", req.InstanceID)
+	}
+	if req.AgentVersion == "" {
+		return 0, reject(http.StatusBadRequest, "missing agent_version")
+	}
+
+	s.heartbeats = append(s.heartbeats, req)
+	return http.StatusOK, nil
+}
+
+// rotate handles a key rotation request: signed with the current key,
+// with a proof signed by the new one.
+func (s *Server) rotate(r *http.Request, body []byte) (int, error) {
+	var req sender.RotateRequest
+	if err := decode(body, &req); err != nil {
+		return 0, err
+	}
+
+	inst, err := s.verify(r, req.InstanceID, body)
+	if err != nil {
+		return 0, err
+	}
+	if !inst.activated {
+		return 0, reject(http.StatusUnauthorized, "instance %s is not activated", req.InstanceID)
+	}
+	key, err := hex.DecodeString(req.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return 0, reject(http.StatusBadRequest, "public_key is not a hex encoded Ed25519 key")
+	}
+	proof, err := hex.DecodeString(req.Proof)
+	if err != nil || !ed25519.Verify(key, sender.RotationMessage(req.InstanceID, req.PublicKey), proof) {
+		return 0, reject(http.StatusBadRequest, "proof is not signed by the new key")
+	}
+
+	inst.publicKey = key
+	s.rotations = append(s.rotations, req)
+	return http.StatusOK, nil
+}
+
+// serveConfig handles a configuration request: a signed GET without body,
+// answered with the document and its ETag, 304 when the ETag matches or
+// 204 when there is none.
+func (s *Server) serveConfig(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if code, ok := s.status[r.URL.Path]; ok {
+		w.WriteHeader(code)
+		return
+	}
+
+	err := func() error {
+		if r.Method != http.MethodGet {
+			return reject(http.StatusMethodNotAllowed, "method %s, want GET", r.Method)
+		}
+		inst, err := s.verify(r, r.URL.Query().Get("instance_id"), nil)
+		if err != nil {
+			return err
+		}
+		if !inst.activated {
+			return reject(http.StatusUnauthorized, "instance %s is not activated", r.URL.Query().Get("instance_id"))
+		}
+		return nil
+	}()
+	if err != nil {
+		perr := err.(*protocolError)
+		s.violations = append(s.violations, fmt.Sprintf("%s: %s", r.URL.Path, perr.reason))
+		http.Error(w, perr.reason, perr.code)
+		return
+	}
+
+	if s.config == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	sum := sha256.Sum256(s.config)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s.fetches++
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(s.config)
+}
+
+// verify checks that the request comes from a registered instance and is
+// signed with its key, and is not a replay.
+func (s *Server) verify(r *http.Request, instanceID string, body []byte) (*instance, error) {
+	inst, ok := s.instances[instanceID]
+	if !ok {
+		return nil, reject(http.StatusUnauthorized, "unknown instance %q", instanceID)
+	}
+
+	if err := s.verifier.Verify(inst.publicKey, r.Header, body); err != nil {
+		return nil, reject(http.StatusUnauthorized, "%v", err)
+	}
+	return inst, nil
+}
@@ -0,0 +1,233 @@
+// SPDX-License-Identifier: MIT
+
+package shmtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+func newSender(t *testing.T, url string) *sender.Sender {
+	t.Helper()
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	s := sender.New(sender.Config{
+		ServerURL:   url,
+		AppName:     "test-app",
+		AppVersion:  "1.0.0",
+		Environment: "test",
+		Identity: &sender.Identity{
+			InstanceID: "instance-1",
+			PrivateKey: priv,
+			PublicKey:  pub,
+			PrivKeyHex: hex.EncodeToString(priv),
+			PubKeyHex:  hex.EncodeToString(pub),
+		},
+		MaxPayloadSize: 1024,
+		Retry:          sender.RetryConfig{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+	})
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestServer_SenderConforms(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	s := newSender(t, srv.URL)
+	ctx := context.Background()
+	if err := s.Register(ctx); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	// Large enough to be split into several parts
+	metrics := map[string]interface{}{
+		"requests": float64(1),
+		"big_a":    strings.Repeat("a", 600),
+		"big_b":    strings.Repeat("b", 600),
+	}
+	annotations := map[string]sender.Annotation{"requests": {Type: sender.AnnotationBurst, Value: 1}}
+	if err := s.SendAnnotatedSnapshot(ctx, metrics, annotations); err != nil {
+		t.Fatalf("SendAnnotatedSnapshot() error = %v", err)
+	}
+
+	if v := srv.Violations(); len(v) > 0 {
+		t.Errorf("violations = %q", v)
+	}
+	if n := len(srv.Registrations()); n != 1 {
+		t.Errorf("registrations = %d, want 1", n)
+	}
+	if n := len(srv.Snapshots()); n < 2 {
+		t.Errorf("snapshots = %d, want the snapshot split in several parts", n)
+	}
+}
+
+func TestServer_Heartbeat(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.SetVersions(sender.HeartbeatResponse{MinAgentVersion: "1.2.0"})
+
+	s := newSender(t, srv.URL)
+	ctx := context.Background()
+	if _, err := s.Heartbeat(ctx, sender.HeartbeatRequest{}); err == nil {
+		t.Error("Heartbeat() before registering: error = nil")
+	}
+	if err := s.Register(ctx); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	resp, err := s.Heartbeat(ctx, sender.HeartbeatRequest{AgentVersion: "1.1.0", Status: "ok"})
+	if err != nil {
+		t.Fatalf("Heartbeat() error = %v", err)
+	}
+	if resp.MinAgentVersion != "1.2.0" {
+		t.Errorf("MinAgentVersion = %q, want 1.2.0", resp.MinAgentVersion)
+	}
+	if hb := srv.Heartbeats(); len(hb) != 1 || hb[0].AgentVersion != "1.1.0" {
+		t.Errorf("heartbeats = %+v, want one from 1.1.0", hb)
+	}
+}
+
+func TestServer_RotateKey(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	s := newSender(t, srv.URL)
+	ctx := context.Background()
+	_, key, _ := ed25519.GenerateKey(nil)
+	if err := s.RotateKey(ctx, key); err != nil {
+		t.Fatalf("RotateKey() error = %v", err)
+	}
+	rotations := srv.Rotations()
+	if len(rotations) != 1 || rotations[0].PublicKey != hex.EncodeToString(key.Public().(ed25519.PublicKey)) {
+		t.Fatalf("rotations = %+v, want one to the new key", rotations)
+	}
+
+	// Later requests are signed with the new key
+	if err := s.SendSnapshot(ctx, map[string]interface{}{"requests": float64(1)}); err != nil {
+		t.Fatalf("SendSnapshot() error = %v", err)
+	}
+	if v := srv.Violations(); len(v) > 0 {
+		t.Errorf("violations = %q", v)
+	}
+	if n := len(srv.Registrations()); n != 1 {
+		t.Errorf("registrations = %d, want 1 (the rotation keeps the instance)", n)
+	}
+}
+
+func TestServer_Config(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	s := newSender(t, srv.URL)
+	ctx := context.Background()
+	if err := s.Register(ctx); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	rc, err := s.FetchConfig(ctx, "")
+	if err != nil || len(rc.Data) != 0 {
+		t.Fatalf("FetchConfig() without configuration = %+v, %v, want an empty one", rc, err)
+	}
+
+	srv.SetConfig([]byte("sources: []\n"))
+	rc, err = s.FetchConfig(ctx, "")
+	if err != nil {
+		t.Fatalf("FetchConfig() error = %v", err)
+	}
+	if string(rc.Data) != "sources: []\n" || rc.ETag == "" {
+		t.Errorf("FetchConfig() = %q with ETag %q", rc.Data, rc.ETag)
+	}
+	if _, err := s.FetchConfig(ctx, rc.ETag); err != sender.ErrConfigNotModified {
+		t.Errorf("FetchConfig(%s) error = %v, want %v", rc.ETag, err, sender.ErrConfigNotModified)
+	}
+	if n := srv.ConfigFetches(); n != 1 {
+		t.Errorf("ConfigFetches() = %d, want 1", n)
+	}
+	if v := srv.Violations(); len(v) > 0 {
+		t.Errorf("violations = %q", v)
+	}
+
+	srv.SetStatus(PathConfig, http.StatusNotFound)
+	if _, err := s.FetchConfig(ctx, ""); err != sender.ErrConfigUnsupported {
+		t.Errorf("FetchConfig() error = %v, want %v", err, sender.ErrConfigUnsupported)
+	}
+}
+
+func TestServer_RejectsViolations(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	post := func(path, body string, header http.Header) int {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+path, bytes.NewReader([]byte(body)))
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		header http.Header
+		want   int
+	}{
+		{"wrong content type", PathRegister, `{}`, http.Header{}, http.StatusUnsupportedMediaType},
+		{"missing fields", PathRegister, `{"instance_id":"x"}`, jsonHeader, http.StatusBadRequest},
+		{"unknown instance", PathSnapshot, `{"instance_id":"nobody"}`, jsonHeader, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if got := post(tt.path, tt.body, tt.header); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	if n := len(srv.Violations()); n != len(tests) {
+		t.Errorf("violations = %d, want %d", n, len(tests))
+	}
+
+	// A registered instance must sign its requests
+	s := newSender(t, srv.URL)
+	if err := s.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	header := http.Header{"Content-Type": {"application/json"}, "X-Signature": {"00"}}
+	if got := post(PathActivate, `{"instance_id":"instance-1"}`, header); got != http.StatusUnauthorized {
+		t.Errorf("badly signed activation: status = %d, want 401", got)
+	}
+}
+
+func TestServer_SetStatus(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	s := newSender(t, srv.URL)
+	ctx := context.Background()
+	if err := s.Register(ctx); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	srv.SetStatus(PathSnapshot, http.StatusServiceUnavailable)
+	if err := s.SendSnapshot(ctx, map[string]interface{}{"n": float64(1)}); err == nil {
+		t.Error("SendSnapshot() succeeded with the server unavailable")
+	}
+
+	srv.SetStatus(PathSnapshot, 0)
+	time.Sleep(10 * time.Millisecond) // past the backoff
+	if err := s.Flush(ctx); err != nil {
+		t.Errorf("Flush() error = %v", err)
+	}
+	if n := len(srv.Snapshots()); n != 1 {
+		t.Errorf("snapshots = %d, want the queued snapshot delivered", n)
+	}
+}
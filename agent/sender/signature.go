@@ -0,0 +1,130 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Signature headers. The signature covers the timestamp, the nonce and
+// the body, so that a captured request cannot be replayed.
+const (
+	HeaderSignature = "X-Signature"
+	HeaderTimestamp = "X-Timestamp" // unix seconds
+	HeaderNonce     = "X-Nonce"     // random, unique per request
+)
+
+// DefaultMaxClockSkew is the default age beyond which a Verifier rejects
+// a signed request.
+const DefaultMaxClockSkew = 5 * time.Minute
+
+// nonceSize is the number of random bytes of a nonce.
+const nonceSize = 16
+
+// signRequest sets the signature headers of a request carrying body.
+func signRequest(h http.Header, privateKey ed25519.PrivateKey, body []byte) error {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("generating nonce: %w", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+
+	h.Set(HeaderTimestamp, timestamp)
+	h.Set(HeaderNonce, nonceHex)
+	h.Set(HeaderSignature, sign(privateKey, signedMessage(timestamp, nonceHex, body)))
+	return nil
+}
+
+// signedMessage returns the bytes a signature covers:
+// "<timestamp>\n<nonce>\n<body>".
+func signedMessage(timestamp, nonce string, body []byte) []byte {
+	msg := make([]byte, 0, len(timestamp)+len(nonce)+2+len(body))
+	msg = append(msg, timestamp...)
+	msg = append(msg, '\n')
+	msg = append(msg, nonce...)
+	msg = append(msg, '\n')
+	return append(msg, body...)
+}
+
+// sign creates an Ed25519 signature of the message.
+func sign(privateKey ed25519.PrivateKey, message []byte) string {
+	sig := ed25519.Sign(privateKey, message)
+	return hex.EncodeToString(sig)
+}
+
+// Errors returned by Verifier.Verify.
+var (
+	ErrBadSignature = errors.New("invalid signature")
+	ErrStale        = errors.New("timestamp outside the allowed clock skew")
+	ErrReplayed     = errors.New("nonce already used")
+)
+
+// Verifier checks the signature headers of requests, as a server does. It
+// remembers the nonces of the requests it accepted for as long as their
+// timestamp is acceptable, to reject replays. It is safe for concurrent use.
+type Verifier struct {
+	maxSkew time.Duration
+	now     func() time.Time
+
+	mu   sync.Mutex
+	seen map[string]time.Time // nonce -> when it can be forgotten
+}
+
+// NewVerifier creates a Verifier accepting timestamps up to maxSkew away
+// from its clock. A maxSkew of 0 uses DefaultMaxClockSkew.
+func NewVerifier(maxSkew time.Duration) *Verifier {
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxClockSkew
+	}
+	return &Verifier{
+		maxSkew: maxSkew,
+		now:     time.Now,
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// Verify checks that the headers sign body with the key matching
+// publicKey, with a fresh timestamp and a nonce not seen before.
+func (v *Verifier) Verify(publicKey ed25519.PublicKey, h http.Header, body []byte) error {
+	timestamp, nonce := h.Get(HeaderTimestamp), h.Get(HeaderNonce)
+	if timestamp == "" || nonce == "" {
+		return fmt.Errorf("%w: missing %s or %s", ErrBadSignature, HeaderTimestamp, HeaderNonce)
+	}
+	sig, err := hex.DecodeString(h.Get(HeaderSignature))
+	if err != nil || !ed25519.Verify(publicKey, signedMessage(timestamp, nonce, body), sig) {
+		return ErrBadSignature
+	}
+
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: malformed %s", ErrBadSignature, HeaderTimestamp)
+	}
+	now := v.now()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for n, expiry := range v.seen {
+		if now.After(expiry) {
+			delete(v.seen, n)
+		}
+	}
+	if d := now.Sub(time.Unix(secs, 0)); d > v.maxSkew || d < -v.maxSkew {
+		return ErrStale
+	}
+	if _, ok := v.seen[nonce]; ok {
+		return ErrReplayed
+	}
+	// Past this, the timestamp is rejected as stale anyway
+	v.seen[nonce] = time.Unix(secs, 0).Add(v.maxSkew)
+	return nil
+}
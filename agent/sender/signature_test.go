@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignRequest_Verify(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	body := []byte(`{"instance_id":"test"}`)
+
+	signed := func() http.Header {
+		h := http.Header{}
+		if err := signRequest(h, priv, body); err != nil {
+			t.Fatalf("signRequest() error = %v", err)
+		}
+		return h
+	}
+
+	v := NewVerifier(time.Minute)
+	h := signed()
+	if err := v.Verify(pub, h, body); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if err := v.Verify(pub, h, body); !errors.Is(err, ErrReplayed) {
+		t.Errorf("replayed request: Verify() error = %v, want ErrReplayed", err)
+	}
+	if h2 := signed(); h2.Get(HeaderNonce) == h.Get(HeaderNonce) {
+		t.Error("two requests share a nonce")
+	}
+
+	tests := []struct {
+		name   string
+		key    ed25519.PublicKey
+		header func() http.Header
+		body   []byte
+		want   error
+	}{
+		{"tampered body", pub, signed, []byte(`{"instance_id":"other"}`), ErrBadSignature},
+		{"other key", otherPub, signed, body, ErrBadSignature},
+		{"no nonce", pub, func() http.Header {
+			h := signed()
+			h.Del(HeaderNonce)
+			return h
+		}, body, ErrBadSignature},
+		{"changed timestamp", pub, func() http.Header {
+			h := signed()
+			h.Set(HeaderTimestamp, strconv.FormatInt(time.Now().Unix()+1, 10))
+			return h
+		}, body, ErrBadSignature},
+	}
+	for _, tt := range tests {
+		if err := v.Verify(tt.key, tt.header(), tt.body); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Verify() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// A request signed too long ago is stale, and its nonce forgotten
+	h = signed()
+	v.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if err := v.Verify(pub, h, body); !errors.Is(err, ErrStale) {
+		t.Errorf("old request: Verify() error = %v, want ErrStale", err)
+	}
+	v.mu.Lock()
+	remembered := len(v.seen)
+	v.mu.Unlock()
+	if remembered != 0 {
+		t.Errorf("remembered nonces = %d, want expired ones forgotten", remembered)
+	}
+}
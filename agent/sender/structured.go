@@ -0,0 +1,106 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+)
+
+// Values of Config.Format.
+const (
+	FormatMap        = "map"        // metrics is an object of values by name
+	FormatStructured = "structured" // metrics is an array of MetricEntry
+)
+
+// MetricEntry is a value of a structured snapshot: a metric, or a series
+// of a labeled metric or of a counter_by.
+type MetricEntry struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type,omitempty"` // empty when unknown
+	Value  interface{}       `json:"value"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Interval is the period the value was aggregated over: the snapshot
+	// interval, or since the start of the window of a windowed set. It is
+	// not set for gauges, which hold their last value.
+	Interval *Interval `json:"interval,omitempty"`
+}
+
+// Interval bounds the period of a MetricEntry.
+type Interval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// entry is an encoded metric, or series, of a snapshot.
+type entry struct {
+	name string
+	data []byte
+}
+
+// encodeMetrics encodes the metrics of a snapshot in name order, as
+// "name":value members of an object, or as MetricEntry elements of an
+// array for FormatStructured.
+func (s *Sender) encodeMetrics(snap Snapshot) ([]entry, error) {
+	names := make([]string, 0, len(snap.Metrics))
+	for name := range snap.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]entry, 0, len(names))
+	for _, name := range names {
+		if s.format != FormatStructured {
+			key, err := json.Marshal(name)
+			if err != nil {
+				return nil, fmt.Errorf("marshaling metric name: %w", err)
+			}
+			value, err := json.Marshal(snap.Metrics[name])
+			if err != nil {
+				return nil, fmt.Errorf("marshaling metric %s: %w", name, err)
+			}
+			data := make([]byte, 0, len(key)+1+len(value))
+			data = append(append(append(data, key...), ':'), value...)
+			entries = append(entries, entry{name: name, data: data})
+			continue
+		}
+
+		for _, me := range s.metricEntries(name, snap) {
+			data, err := json.Marshal(me)
+			if err != nil {
+				return nil, fmt.Errorf("marshaling metric %s: %w", name, err)
+			}
+			entries = append(entries, entry{name: name, data: data})
+		}
+	}
+	return entries, nil
+}
+
+// metricEntries returns the entries of a metric of a snapshot, one per
+// series.
+func (s *Sender) metricEntries(name string, snap Snapshot) []MetricEntry {
+	var typ aggregator.MetricType
+	if s.types != nil {
+		typ, _ = s.types(name)
+	}
+
+	var interval *Interval
+	if typ != aggregator.Gauge && !snap.Start.IsZero() && !snap.End.IsZero() {
+		interval = &Interval{Start: snap.Start.UTC(), End: snap.End.UTC()}
+		if start, ok := snap.WindowStarts[name]; ok && !start.After(snap.End) {
+			interval.Start = start.UTC()
+		}
+	}
+
+	series := aggregator.SeriesOf(snap.Metrics[name])
+	entries := make([]MetricEntry, len(series))
+	for i, sr := range series {
+		entries[i] = MetricEntry{Name: name, Type: string(typ), Value: sr.Value, Labels: sr.Labels, Interval: interval}
+	}
+	return entries
+}
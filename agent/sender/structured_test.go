@@ -0,0 +1,121 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+)
+
+func TestSend_Structured(t *testing.T) {
+	ss, srv := newSnapshotServer(t)
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	end := start.Add(time.Minute)
+	day := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	types := map[string]aggregator.MetricType{
+		"requests": aggregator.Counter,
+		"sessions": aggregator.Gauge,
+		"by_code":  aggregator.CounterBy,
+		"users":    aggregator.Set,
+		"visitors": aggregator.Set,
+	}
+	s := New(Config{
+		ServerURL: srv.URL,
+		AppName:   "test",
+		Identity:  &Identity{InstanceID: "test-instance", PrivateKey: priv, PublicKey: pub},
+		Format:    FormatStructured,
+		Types: func(name string) (aggregator.MetricType, bool) {
+			typ, ok := types[name]
+			return typ, ok
+		},
+	})
+
+	snap := Snapshot{
+		Metrics: map[string]interface{}{
+			"requests": []aggregator.Series{
+				{Labels: map[string]string{"method": "GET"}, Value: float64(3)},
+				{Labels: map[string]string{"method": "POST"}, Value: float64(1)},
+			},
+			"sessions": float64(12),
+			"by_code":  aggregator.Counts{Key: "code", Values: map[string]float64{"E1": 2}},
+			"users":    7,
+			"visitors": 3,
+			"ratio":    0.5,
+		},
+		Start: start,
+		End:   end,
+		// A window that started after an interval of event time does not
+		// bound it
+		WindowStarts: map[string]time.Time{"users": day, "visitors": end.Add(time.Hour)},
+	}
+	if err := s.Send(context.Background(), snap); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	if len(ss.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(ss.requests))
+	}
+	var got []MetricEntry
+	if err := json.Unmarshal(ss.requests[0].Metrics, &got); err != nil {
+		t.Fatalf("metrics are not an array of entries: %v", err)
+	}
+	interval := &Interval{Start: start, End: end}
+	want := []MetricEntry{
+		{Name: "by_code", Type: "counter_by", Value: float64(2), Labels: map[string]string{"code": "E1"}, Interval: interval},
+		{Name: "ratio", Value: 0.5, Interval: interval},
+		{Name: "requests", Type: "counter", Value: float64(3), Labels: map[string]string{"method": "GET"}, Interval: interval},
+		{Name: "requests", Type: "counter", Value: float64(1), Labels: map[string]string{"method": "POST"}, Interval: interval},
+		{Name: "sessions", Type: "gauge", Value: float64(12)},
+		{Name: "users", Type: "set", Value: float64(7), Interval: &Interval{Start: day, End: end}},
+		{Name: "visitors", Type: "set", Value: float64(3), Interval: interval},
+	}
+	if !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(want)
+		t.Errorf("metrics =\n%s\nwant\n%s", gotJSON, wantJSON)
+	}
+}
+
+func TestSend_StructuredSplit(t *testing.T) {
+	ss, srv := newSnapshotServer(t)
+	const limit = 1024
+	s := newTestSender(t, srv.URL, limit)
+	s.format = FormatStructured
+
+	series := make([]aggregator.Series, 50)
+	for i := range series {
+		series[i] = aggregator.Series{Labels: map[string]string{"path": fmt.Sprintf("/page/%03d", i)}, Value: float64(i)}
+	}
+	if err := s.SendSnapshot(context.Background(), map[string]interface{}{"requests": series}); err != nil {
+		t.Fatalf("SendSnapshot() error = %v", err)
+	}
+
+	if len(ss.requests) < 2 {
+		t.Fatalf("got %d requests, want several", len(ss.requests))
+	}
+	total := 0
+	for i, req := range ss.requests {
+		if ss.sizes[i] > limit {
+			t.Errorf("request %d is %d bytes, limit %d", i, ss.sizes[i], limit)
+		}
+		var part []MetricEntry
+		if err := json.Unmarshal(req.Metrics, &part); err != nil {
+			t.Fatalf("request %d: invalid metrics: %v", i, err)
+		}
+		total += len(part)
+	}
+	if total != len(series) {
+		t.Errorf("received %d series, want %d", total, len(series))
+	}
+}
@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// traceBodyLimit is the number of body bytes included in trace logs.
+const traceBodyLimit = 512
+
+// tracingTransport logs a summary of every request and response.
+// Signatures and other headers are never logged, and URLs are stripped of
+// credentials and query strings.
+type tracingTransport struct {
+	next   http.RoundTripper
+	logger *slog.Logger
+}
+
+// RoundTrip sends the request and logs its outcome.
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil && req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			reqBody, _ = io.ReadAll(io.LimitReader(body, traceBodyLimit+1))
+			body.Close()
+		}
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	latency := time.Since(start)
+
+	attrs := []any{
+		"method", req.Method,
+		"url", sanitizeURL(req),
+		"latency", latency.Round(time.Microsecond),
+		"request_body", truncateBody(reqBody),
+	}
+
+	if err != nil {
+		t.logger.Info("http trace", append(attrs, "error", err)...)
+		return nil, err
+	}
+
+	// Read the start of the response body and put it back for the caller
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, traceBodyLimit+1))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(respBody), resp.Body), resp.Body}
+
+	t.logger.Info("http trace", append(attrs,
+		"status", resp.StatusCode,
+		"response_body", truncateBody(respBody),
+	)...)
+
+	return resp, nil
+}
+
+// CloseIdleConnections forwards to the wrapped transport.
+func (t *tracingTransport) CloseIdleConnections() {
+	if c, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// sanitizeURL returns the request URL without user info or query string.
+func sanitizeURL(req *http.Request) string {
+	u := *req.URL
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// truncateBody returns at most traceBodyLimit bytes of body as a string.
+func truncateBody(body []byte) string {
+	if len(body) <= traceBodyLimit {
+		return string(body)
+	}
+	body = body[:traceBodyLimit]
+	// Do not cut a multi-byte character in half
+	for len(body) > 0 && !utf8.Valid(body) {
+		body = body[:len(body)-1]
+	}
+	return string(body) + "...(truncated)"
+}
@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSender_TraceHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"` + strings.Repeat("x", 1000) + `"}`))
+	}))
+	defer srv.Close()
+
+	var logs bytes.Buffer
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	s := New(Config{
+		ServerURL: strings.Replace(srv.URL, "http://", "http://user:secret@", 1),
+		Identity:  &Identity{InstanceID: "test", PrivateKey: priv, PublicKey: pub},
+		Logger:    slog.New(slog.NewTextHandler(&logs, nil)),
+		Transport: TransportConfig{Trace: true},
+	})
+	s.registered = true
+
+	err := s.SendSnapshot(context.Background(), map[string]interface{}{"requests": 1.0})
+	if err == nil {
+		t.Fatal("SendSnapshot() should fail")
+	}
+
+	// The caller still sees the full response body
+	if !strings.Contains(err.Error(), strings.Repeat("x", 1000)) {
+		t.Error("response body was not passed through to the caller")
+	}
+
+	out := logs.String()
+	for _, want := range []string{"http trace", "method=POST", "/v1/snapshot", "status=400", `requests`, "...(truncated)"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("trace log missing %q:\n%s", want, out)
+		}
+	}
+	for _, secret := range []string{"secret", "X-Signature"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("trace log leaks %q:\n%s", secret, out)
+		}
+	}
+}
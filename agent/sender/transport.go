@@ -0,0 +1,292 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Transport defaults, used when the corresponding TransportConfig field is zero.
+const (
+	DefaultTimeout             = 30 * time.Second
+	DefaultIdleConnTimeout     = 90 * time.Second
+	DefaultMaxIdleConnsPerHost = 2
+	DefaultKeepAlive           = 30 * time.Second
+	DefaultRetryBackoff        = time.Second
+)
+
+// maxRetryAfter is the longest Retry-After a retrying client waits for;
+// a response asking for longer is returned as is.
+const maxRetryAfter = 30 * time.Second
+
+// TransportConfig tunes the HTTP client used to talk to the server.
+//
+// Connections are kept alive and reused across snapshots, and HTTP/2 is
+// negotiated over TLS when the server supports it, so that short intervals
+// do not pay for a TLS handshake on every request.
+type TransportConfig struct {
+	Timeout             time.Duration // whole request, including reading the response
+	IdleConnTimeout     time.Duration // how long an idle connection is kept for reuse
+	MaxIdleConnsPerHost int
+	KeepAlive           time.Duration // TCP keep-alive period of connections
+	DisableHTTP2        bool
+	DisableKeepAlives   bool
+
+	// Retries is the number of times a request that failed with a network
+	// error, a timeout or a 408, 429 or 5xx status is sent again, waiting
+	// RetryBackoff before the first retry, doubled after, or as long as a
+	// 429 or 503 response asks with Retry-After. Timeout then bounds each
+	// attempt. The Sender ignores it: a signed request cannot be sent
+	// twice, and undelivered snapshots are queued and retried anyway.
+	Retries      int
+	RetryBackoff time.Duration
+
+	// Proxy is the proxy every request goes through. Without it, the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables apply.
+	Proxy *url.URL
+
+	// TLS overrides the TLS settings of the connection, see LoadTLS.
+	TLS *tls.Config
+
+	// Trace logs a summary of every request and response at info level.
+	Trace bool
+}
+
+// NewHTTPClient creates the HTTP client for the given transport settings.
+// Outputs other than the server use it to share the same settings.
+func NewHTTPClient(cfg TransportConfig, logger *slog.Logger) *http.Client {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	idleConnTimeout := cfg.IdleConnTimeout
+	if idleConnTimeout <= 0 {
+		idleConnTimeout = DefaultIdleConnTimeout
+	}
+	maxIdleConnsPerHost := cfg.MaxIdleConnsPerHost
+	if maxIdleConnsPerHost <= 0 {
+		maxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+	keepAlive := cfg.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = DefaultKeepAlive
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: keepAlive,
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != nil {
+		proxy = http.ProxyURL(cfg.Proxy)
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     !cfg.DisableHTTP2,
+		MaxIdleConns:          maxIdleConnsPerHost,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableKeepAlives:     cfg.DisableKeepAlives,
+		TLSClientConfig:       cfg.TLS,
+	}
+	if cfg.DisableHTTP2 {
+		// A non-nil empty map prevents the automatic HTTP/2 upgrade
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	var rt http.RoundTripper = transport
+	if cfg.Trace {
+		rt = &tracingTransport{next: transport, logger: logger}
+	}
+	if cfg.Retries > 0 {
+		backoff := cfg.RetryBackoff
+		if backoff <= 0 {
+			backoff = DefaultRetryBackoff
+		}
+		// The client timeout would bound all the attempts together
+		return &http.Client{
+			Transport: &retryingTransport{next: rt, retries: cfg.Retries, backoff: backoff, timeout: timeout},
+		}
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: rt,
+	}
+}
+
+// withoutRetries returns cfg without transport retries, for signed
+// requests: the server rejects a signature it already accepted.
+func (cfg TransportConfig) withoutRetries() TransportConfig {
+	cfg.Retries = 0
+	return cfg
+}
+
+// retryingTransport sends requests again when they fail with an error that
+// may be transient, each attempt within its own timeout.
+type retryingTransport struct {
+	next    http.RoundTripper
+	retries int
+	backoff time.Duration // before the first retry, doubled after
+	timeout time.Duration // of every attempt, including reading the response
+}
+
+// RoundTrip sends the request, retrying it while it fails with a network
+// error or a 408, 429 or 5xx status, after the backoff or the Retry-After
+// of the response. Requests whose body cannot be read again are sent once.
+func (t *retryingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+		r := req.WithContext(ctx)
+		if attempt > 0 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			r.Body = body
+		}
+
+		resp, err := t.next.RoundTrip(r)
+		wait := t.backoff << attempt
+		wait += time.Duration(rand.Int64N(int64(wait)/5 + 1))
+		retry := attempt < t.retries && req.Context().Err() == nil &&
+			(req.Body == nil || req.GetBody != nil) &&
+			(err != nil || retryableStatus(resp.StatusCode))
+		if retry && err == nil {
+			if after, ok := retryAfter(resp, time.Now()); ok {
+				retry = after <= maxRetryAfter
+				wait = max(wait, after)
+			}
+		}
+		if !retry {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			// The attempt ends once the body is read and closed
+			resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+		if err == nil {
+			drainAndClose(resp.Body)
+		}
+		cancel()
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// CloseIdleConnections closes the idle connections of the underlying
+// transport.
+func (t *retryingTransport) CloseIdleConnections() {
+	if c, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// retryableStatus reports whether a response status may change if the
+// request is sent again.
+func retryableStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
+
+// retryAfter returns how long a 429 or 503 response asks to wait before
+// retrying, given in seconds or as a date.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// cancelOnClose releases the context of an attempt once its response body
+// is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// TLSConfig lists the files of the TLS settings for the server.
+type TLSConfig struct {
+	CAFile             string // PEM certificates trusted instead of the system roots
+	CertFile           string // PEM client certificate, with KeyFile
+	KeyFile            string
+	InsecureSkipVerify bool // do not verify the server certificate
+}
+
+// LoadTLS reads the files of cfg into TLS settings for
+// TransportConfig.TLS. It returns nil when cfg is the zero value.
+func LoadTLS(cfg TLSConfig) (*tls.Config, error) {
+	if cfg == (TLSConfig{}) {
+		return nil, nil
+	}
+
+	tc := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// drainAndClose discards what is left of a response body so that the
+// connection can go back to the idle pool, then closes it.
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, 64<<10))
+	body.Close()
+}
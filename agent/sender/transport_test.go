@@ -0,0 +1,383 @@
+// SPDX-License-Identifier: MIT
+
+package sender
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countConnections starts a server that accepts snapshots and counts the
+// TCP connections it receives.
+func countConnections(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+
+	var conns atomic.Int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv, &conns
+}
+
+func TestSender_ReusesConnections(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport TransportConfig
+		want      int64
+	}{
+		{name: "keep-alive", want: 1},
+		{name: "keep-alives disabled", transport: TransportConfig{DisableKeepAlives: true}, want: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, conns := countConnections(t)
+
+			pub, priv, _ := ed25519.GenerateKey(nil)
+			s := New(Config{
+				ServerURL: srv.URL,
+				Identity:  &Identity{InstanceID: "test", PrivateKey: priv, PublicKey: pub},
+				Transport: tt.transport,
+			})
+			s.registered = true
+			defer s.Close()
+
+			for i := 0; i < 3; i++ {
+				if err := s.SendSnapshot(context.Background(), map[string]interface{}{"n": float64(i)}); err != nil {
+					t.Fatalf("SendSnapshot() error = %v", err)
+				}
+			}
+
+			if got := conns.Load(); got != tt.want {
+				t.Errorf("connections = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSender_Proxy(t *testing.T) {
+	var proxied atomic.Int64
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A proxied request carries the absolute URL of the server
+		if r.URL.Host == "shm.invalid" {
+			proxied.Add(1)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(proxy.Close)
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	s := New(Config{
+		ServerURL: "http://shm.invalid",
+		Identity:  &Identity{InstanceID: "test", PrivateKey: priv, PublicKey: pub},
+		Transport: TransportConfig{Proxy: proxyURL},
+	})
+	s.registered = true
+	defer s.Close()
+
+	if err := s.SendSnapshot(context.Background(), map[string]interface{}{"n": float64(1)}); err != nil {
+		t.Fatalf("SendSnapshot() error = %v", err)
+	}
+	if proxied.Load() != 1 {
+		t.Errorf("proxied requests = %d, want 1", proxied.Load())
+	}
+}
+
+func TestNewHTTPClient_Defaults(t *testing.T) {
+	client := NewHTTPClient(TransportConfig{}, nil)
+
+	if client.Timeout != DefaultTimeout {
+		t.Errorf("Timeout = %v, want %v", client.Timeout, DefaultTimeout)
+	}
+	transport := client.Transport.(*http.Transport)
+	if !transport.ForceAttemptHTTP2 {
+		t.Error("HTTP/2 should be attempted by default")
+	}
+	if transport.MaxIdleConnsPerHost != DefaultMaxIdleConnsPerHost {
+		t.Errorf("MaxIdleConnsPerHost = %d, want %d", transport.MaxIdleConnsPerHost, DefaultMaxIdleConnsPerHost)
+	}
+	if transport.IdleConnTimeout != DefaultIdleConnTimeout {
+		t.Errorf("IdleConnTimeout = %v, want %v", transport.IdleConnTimeout, DefaultIdleConnTimeout)
+	}
+
+	transport = NewHTTPClient(TransportConfig{DisableHTTP2: true}, nil).Transport.(*http.Transport)
+	if transport.ForceAttemptHTTP2 || transport.TLSNextProto == nil {
+		t.Error("HTTP/2 should be disabled")
+	}
+}
+
+func TestNewHTTPClient_Retries(t *testing.T) {
+	var attempts atomic.Int32
+	var bodies []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(data))
+		mu.Unlock()
+		switch attempts.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			time.Sleep(200 * time.Millisecond) // beyond the timeout of an attempt
+		default:
+			io.WriteString(w, "ok")
+		}
+	}))
+	defer srv.Close()
+
+	client := NewHTTPClient(TransportConfig{Timeout: 100 * time.Millisecond, Retries: 2, RetryBackoff: time.Millisecond}, nil)
+	resp, err := client.Post(srv.URL, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatalf("Post() error = %v", err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(data) != "ok" {
+		t.Errorf("response = %d %q, want 200 after retries", resp.StatusCode, data)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 3 || bodies[2] != "payload" {
+		t.Errorf("server received %q, want the payload 3 times", bodies)
+	}
+
+	// Client errors are not retried, and the last response is returned
+	attempts.Store(0)
+	client = NewHTTPClient(TransportConfig{Retries: 3, RetryBackoff: time.Millisecond}, nil)
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	resp, err = client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || attempts.Load() != 1 {
+		t.Errorf("status = %d after %d attempts, want 400 after 1", resp.StatusCode, attempts.Load())
+	}
+}
+
+func TestNewHTTPClient_RetryAfter(t *testing.T) {
+	var attempts atomic.Int32
+	var first, second time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch attempts.Add(1) {
+		case 1:
+			first = time.Now()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			second = time.Now()
+		}
+	}))
+	defer srv.Close()
+
+	client := NewHTTPClient(TransportConfig{Retries: 1, RetryBackoff: time.Millisecond}, nil)
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || second.Sub(first) < time.Second {
+		t.Errorf("status %d after waiting %v, want 200 after the 1s Retry-After", resp.StatusCode, second.Sub(first))
+	}
+
+	// Too long a wait returns the response at once
+	attempts.Store(0)
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	resp, err = client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || attempts.Load() != 1 {
+		t.Errorf("status = %d after %d attempts, want 503 after 1", resp.StatusCode, attempts.Load())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		status int
+		value  string
+		want   time.Duration
+		ok     bool
+	}{
+		{http.StatusTooManyRequests, "5", 5 * time.Second, true},
+		{http.StatusServiceUnavailable, now.Add(time.Minute).Format(http.TimeFormat), time.Minute, true},
+		{http.StatusServiceUnavailable, now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{http.StatusServiceUnavailable, "soon", 0, false},
+		{http.StatusInternalServerError, "5", 0, false},
+		{http.StatusTooManyRequests, "", 0, false},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+		if tt.value != "" {
+			resp.Header.Set("Retry-After", tt.value)
+		}
+		got, ok := retryAfter(resp, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%d, %q) = %v, %v, want %v, %v", tt.status, tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSender_NoTransportRetries(t *testing.T) {
+	var snapshots atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/snapshot" {
+			snapshots.Add(1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	_, key, _ := ed25519.GenerateKey(nil)
+	s := New(Config{
+		ServerURL:  srv.URL,
+		AppName:    "app",
+		AppVersion: "1.0.0",
+		Identity:   &Identity{InstanceID: "test", PrivateKey: key},
+		Transport:  TransportConfig{Retries: 3, RetryBackoff: time.Millisecond},
+	})
+	defer s.Close()
+
+	// A retry would reuse the nonce of the signature: the request stays
+	// queued for the next delivery instead
+	s.SendSnapshot(context.Background(), snapshot(1))
+	if got := snapshots.Load(); got != 1 {
+		t.Errorf("snapshot requests = %d, want 1", got)
+	}
+}
+
+// writePEM writes a PEM block of the given type to a file of dir.
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSender_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	// Self-signed client certificate, trusted by the server
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "shm-agent"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+	certFile := writePEM(t, dir, "client.crt", "CERTIFICATE", der)
+	keyFile := writePEM(t, dir, "client.key", "PRIVATE KEY", keyDER)
+
+	var clients atomic.Int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 && r.TLS.PeerCertificates[0].Subject.CommonName == "shm-agent" {
+			clients.Add(1)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCert)
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // expected handshake failures
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	caFile := writePEM(t, dir, "ca.crt", "CERTIFICATE", srv.Certificate().Raw)
+
+	send := func(tc TLSConfig) error {
+		t.Helper()
+		tlsConfig, err := LoadTLS(tc)
+		if err != nil {
+			t.Fatalf("LoadTLS() error = %v", err)
+		}
+		pub, priv, _ := ed25519.GenerateKey(nil)
+		s := New(Config{
+			ServerURL: srv.URL,
+			Identity:  &Identity{InstanceID: "test", PrivateKey: priv, PublicKey: pub},
+			Transport: TransportConfig{TLS: tlsConfig},
+		})
+		s.registered = true
+		defer s.Close()
+		return s.SendSnapshot(context.Background(), map[string]interface{}{"n": float64(1)})
+	}
+
+	if err := send(TLSConfig{CAFile: caFile}); err == nil {
+		t.Error("SendSnapshot() without a client certificate succeeded")
+	}
+	if err := send(TLSConfig{CertFile: certFile, KeyFile: keyFile}); err == nil {
+		t.Error("SendSnapshot() without the server CA succeeded")
+	}
+	if err := send(TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}); err != nil {
+		t.Errorf("SendSnapshot() error = %v", err)
+	}
+	if err := send(TLSConfig{InsecureSkipVerify: true, CertFile: certFile, KeyFile: keyFile}); err != nil {
+		t.Errorf("SendSnapshot() with insecure_skip_verify error = %v", err)
+	}
+	if got := clients.Load(); got != 2 {
+		t.Errorf("requests with the client certificate = %d, want 2", got)
+	}
+}
+
+func TestLoadTLS(t *testing.T) {
+	if tc, err := LoadTLS(TLSConfig{}); tc != nil || err != nil {
+		t.Errorf("LoadTLS(zero) = %v, %v; want nil, nil", tc, err)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, nil, 0o600)
+	if _, err := LoadTLS(TLSConfig{CAFile: empty}); err == nil {
+		t.Error("expected error for a CA file without certificates")
+	}
+	if _, err := LoadTLS(TLSConfig{CertFile: empty, KeyFile: empty}); err == nil {
+		t.Error("expected error for an invalid client certificate")
+	}
+}
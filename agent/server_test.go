@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// testServer is a minimal SHM server recording received snapshots.
+type testServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	snapshots []map[string]interface{}
+}
+
+// newTestServer starts a server accepting register, activate and snapshot
+// requests.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	ts := &testServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/register", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("/v1/activate", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/v1/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Metrics map[string]interface{} `json:"metrics"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ts.mu.Lock()
+		ts.snapshots = append(ts.snapshots, req.Metrics)
+		ts.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	ts.Server = httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// received returns the snapshots received so far.
+func (ts *testServer) received() []map[string]interface{} {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return append([]map[string]interface{}(nil), ts.snapshots...)
+}
@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/hostinfo"
+	"github.com/kolapsis/shm-agent/agent/identity"
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+// senderConfig returns the sender settings of cfg: server, transport,
+// authentication and retries. The identity and queue are left to the caller.
+func senderConfig(cfg *config.Config, logger *slog.Logger) (sender.Config, error) {
+	tlsConfig, err := sender.LoadTLS(sender.TLSConfig{
+		CAFile:             cfg.TLS.CAFile,
+		CertFile:           cfg.TLS.CertFile,
+		KeyFile:            cfg.TLS.KeyFile,
+		InsecureSkipVerify: cfg.TLS.InsecureSkipVerify,
+	})
+	if err != nil {
+		return sender.Config{}, fmt.Errorf("loading tls settings: %w", err)
+	}
+	var proxy *url.URL
+	if cfg.HTTP.ProxyURL != "" {
+		if proxy, err = url.Parse(cfg.HTTP.ProxyURL); err != nil {
+			return sender.Config{}, fmt.Errorf("parsing proxy_url: %w", err)
+		}
+		logger.Info("sending through proxy", "proxy_url", proxy.Redacted())
+	}
+	if cfg.TLS.InsecureSkipVerify {
+		logger.Warn("server certificate verification is disabled (tls.insecure_skip_verify)")
+	}
+
+	var host *hostinfo.Host
+	if cfg.HostMetadataEnabled() {
+		host = hostinfo.Detect()
+	}
+
+	return sender.Config{
+		ServerURL:   cfg.ServerURL,
+		AppName:     cfg.AppName,
+		AppVersion:  cfg.AppVersion,
+		Environment: cfg.Environment,
+		Tags:        cfg.Tags,
+		Host:        host,
+		Logger:      logger,
+
+		AgentVersion: Version,
+
+		MaxPayloadSize: cfg.MaxPayloadSize,
+		Format:         cfg.SnapshotFormat,
+		Transport: sender.TransportConfig{
+			Timeout:             cfg.HTTP.Timeout,
+			IdleConnTimeout:     cfg.HTTP.IdleConnTimeout,
+			MaxIdleConnsPerHost: cfg.HTTP.MaxIdleConnsPerHost,
+			KeepAlive:           cfg.HTTP.KeepAlive,
+			DisableHTTP2:        cfg.HTTP.DisableHTTP2,
+			DisableKeepAlives:   cfg.HTTP.DisableKeepAlives,
+			Retries:             cfg.HTTP.Retries,
+			RetryBackoff:        cfg.HTTP.RetryBackoff,
+			Trace:               cfg.HTTP.Trace,
+			Proxy:               proxy,
+			TLS:                 tlsConfig,
+		},
+		Auth: sender.AuthConfig{
+			Token:     cfg.Auth.Token,
+			TokenFile: cfg.Auth.TokenFile,
+			Header:    cfg.Auth.Header,
+		},
+		Retry: sender.RetryConfig{
+			InitialBackoff: cfg.Retry.InitialBackoff,
+			MaxBackoff:     cfg.Retry.MaxBackoff,
+		},
+	}, nil
+}
+
+// ServerCheckMetric is the metric of the snapshot sent by CheckServer.
+const ServerCheckMetric = config.SelfMetricPrefix + "selftest"
+
+// ServerCheck is the outcome of one step of CheckServer.
+type ServerCheck struct {
+	Step    string // "register" (including activation) or "snapshot"
+	Latency time.Duration
+	Err     error
+}
+
+// CheckServer exercises the protocol against serverURL with the
+// connection settings of cfg: it registers and activates a throwaway
+// identity, then sends it a snapshot holding ServerCheckMetric. It stops
+// at the first failed step. The agent's own identity is left untouched.
+func CheckServer(ctx context.Context, cfg *config.Config, serverURL string, logger *slog.Logger) ([]ServerCheck, error) {
+	scfg, err := senderConfig(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	ident, err := identity.New()
+	if err != nil {
+		return nil, err
+	}
+	scfg.ServerURL = serverURL
+	scfg.Identity = ident
+
+	snd := sender.New(scfg)
+	defer snd.Close()
+
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"register", func() error { return snd.Register(ctx) }},
+		{"snapshot", func() error {
+			return snd.SendSnapshot(ctx, map[string]interface{}{ServerCheckMetric: float64(1)})
+		}},
+	}
+
+	var results []ServerCheck
+	for _, step := range steps {
+		start := time.Now()
+		err := step.run()
+		results = append(results, ServerCheck{Step: step.name, Latency: time.Since(start), Err: err})
+		if err != nil {
+			break
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,43 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/sender/shmtest"
+)
+
+func TestCheckServer(t *testing.T) {
+	srv := shmtest.NewServer()
+	defer srv.Close()
+
+	cfg := &config.Config{AppName: "test-app", AppVersion: "1.0.0", Environment: "test"}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	results, err := CheckServer(context.Background(), cfg, srv.URL, logger)
+	if err != nil {
+		t.Fatalf("CheckServer() error = %v", err)
+	}
+	if len(results) != 2 || results[0].Err != nil || results[1].Err != nil {
+		t.Fatalf("results = %+v, want register and snapshot ok", results)
+	}
+	if v := srv.Violations(); len(v) > 0 {
+		t.Errorf("violations = %q", v)
+	}
+	snapshots := srv.Snapshots()
+	if len(snapshots) != 1 || string(snapshots[0].Metrics) != `{"`+ServerCheckMetric+`":1}` {
+		t.Errorf("snapshots = %+v", snapshots)
+	}
+
+	// The first failed step ends the check
+	srv.SetStatus(shmtest.PathRegister, 500)
+	results, _ = CheckServer(context.Background(), cfg, srv.URL, logger)
+	if len(results) != 1 || results[0].Err == nil {
+		t.Errorf("results = %+v, want a failed register step only", results)
+	}
+}
@@ -0,0 +1,138 @@
+// SPDX-License-Identifier: MIT
+
+package spool
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memEntry is an entry of the in-memory queue.
+type memEntry struct {
+	file
+	data []byte
+}
+
+// Memory is an in-memory Queue with the same retention semantics as Spool.
+// Its content is lost when the agent stops.
+type Memory struct {
+	retention Retention
+	now       func() time.Time
+
+	mu      sync.Mutex
+	entries []memEntry // oldest first
+	bytes   int64
+	nextID  int64
+	evicted Stats
+}
+
+// NewMemory creates an empty in-memory queue.
+func NewMemory(retention Retention) *Memory {
+	return &Memory{
+		retention: retention,
+		now:       time.Now,
+	}
+}
+
+// Push appends a payload to the queue, then evicts the oldest entries if a
+// retention limit is exceeded.
+func (m *Memory) Push(data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	m.entries = append(m.entries, memEntry{
+		file: file{
+			id:      strconv.FormatInt(m.nextID, 10),
+			created: m.now(),
+			size:    int64(len(data)),
+		},
+		data: data,
+	})
+	m.bytes += int64(len(data))
+	m.enforce()
+
+	return nil
+}
+
+// Oldest returns the oldest entry that has not expired.
+func (m *Memory) Oldest() (Entry, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.enforce()
+
+	if len(m.entries) == 0 {
+		return Entry{}, false, nil
+	}
+	e := m.entries[0]
+	return Entry{ID: e.id, Created: e.created, Data: e.data}, true, nil
+}
+
+// Remove deletes an entry.
+func (m *Memory) Remove(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, e := range m.entries {
+		if e.id == id {
+			m.drop(i)
+			break
+		}
+	}
+	return nil
+}
+
+// Len returns the number of queued entries.
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
+
+// Stats returns the queue size and eviction counters.
+func (m *Memory) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := m.evicted
+	stats.Entries = len(m.entries)
+	stats.Bytes = m.bytes
+	return stats
+}
+
+// enforce evicts the oldest entries until all retention limits hold.
+// Must be called with the lock held.
+func (m *Memory) enforce() {
+	r := m.retention
+
+	if r.MaxAge > 0 {
+		cutoff := m.now().Add(-r.MaxAge)
+		for len(m.entries) > 0 && m.entries[0].created.Before(cutoff) {
+			m.drop(0)
+			m.evicted.EvictedAge++
+		}
+	}
+
+	if r.MaxEntries > 0 {
+		for len(m.entries) > r.MaxEntries {
+			m.drop(0)
+			m.evicted.EvictedEntries++
+		}
+	}
+
+	if r.MaxBytes > 0 {
+		for len(m.entries) > 0 && m.bytes > r.MaxBytes {
+			m.drop(0)
+			m.evicted.EvictedBytes++
+		}
+	}
+}
+
+// drop removes the i-th entry.
+// Must be called with the lock held.
+func (m *Memory) drop(i int) {
+	m.bytes -= m.entries[i].size
+	m.entries = append(m.entries[:i], m.entries[i+1:]...)
+}
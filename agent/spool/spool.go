@@ -0,0 +1,313 @@
+// SPDX-License-Identifier: MIT
+
+// Package spool provides bounded FIFO queues of snapshot payloads, so that
+// snapshots survive server outages. The on-disk Spool also survives agent
+// restarts; Memory is used when no spool directory is configured.
+//
+// Each on-disk entry is stored as its own file named after its creation
+// time. Retention limits (age, total size, entry count) are enforced by
+// evicting the oldest entries first.
+package spool
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/atomicfile"
+)
+
+// entrySuffix is the file extension of spooled entries.
+const entrySuffix = ".snap"
+
+// Queue is a bounded FIFO queue of payloads.
+type Queue interface {
+	// Push appends a payload, evicting the oldest entries if a retention
+	// limit is exceeded.
+	Push(data []byte) error
+
+	// Oldest returns the oldest entry that has not expired.
+	// It returns false if the queue is empty.
+	Oldest() (Entry, bool, error)
+
+	// Remove deletes an entry, typically once it has been delivered.
+	Remove(id string) error
+
+	// Len returns the number of queued entries.
+	Len() int
+
+	// Stats returns the queue size and eviction counters.
+	Stats() Stats
+}
+
+// Retention limits how much backlog the spool keeps.
+// A zero value disables the corresponding limit.
+type Retention struct {
+	MaxAge     time.Duration // entries older than this are evicted
+	MaxBytes   int64         // total size of all entries
+	MaxEntries int           // number of entries
+}
+
+// Entry is a spooled payload.
+type Entry struct {
+	ID      string
+	Created time.Time
+	Data    []byte
+}
+
+// Stats reports the spool's current size and eviction counters.
+type Stats struct {
+	Entries        int   `json:"entries"`
+	Bytes          int64 `json:"bytes"`
+	EvictedAge     int64 `json:"evicted_age"`
+	EvictedBytes   int64 `json:"evicted_bytes"`
+	EvictedEntries int64 `json:"evicted_entries"`
+}
+
+// Evicted returns the total number of evicted entries.
+func (s Stats) Evicted() int64 {
+	return s.EvictedAge + s.EvictedBytes + s.EvictedEntries
+}
+
+// file is the in-memory index record of a spooled entry.
+type file struct {
+	id      string
+	created time.Time
+	size    int64
+}
+
+// Spool is an on-disk queue of payloads.
+type Spool struct {
+	dir       string
+	retention Retention
+	now       func() time.Time
+
+	mu      sync.Mutex
+	files   []file // oldest first
+	bytes   int64
+	lastID  int64
+	evicted Stats
+}
+
+// Open opens the spool in dir, creating the directory if needed.
+// Temporary files left by interrupted writes are removed, other files are
+// left alone, as the directory may be shared with other state files, and
+// the retention limits are applied to the existing backlog.
+func Open(dir string, retention Retention) (*Spool, error) {
+	return open(dir, retention, time.Now)
+}
+
+func open(dir string, retention Retention, now func() time.Time) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating spool directory: %w", err)
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading spool directory: %w", err)
+	}
+
+	s := &Spool{
+		dir:       dir,
+		retention: retention,
+		now:       now,
+	}
+
+	for _, de := range dirEntries {
+		if de.IsDir() {
+			continue
+		}
+		name := de.Name()
+		if legacy, ok := strings.CutSuffix(name, ".tmp"); ok {
+			// Interrupted writes, named after their entry by older versions
+			target, _ := atomicfile.TempTarget(name)
+			_, isEntry := parseEntryName(target)
+			_, isLegacyEntry := parseEntryName(legacy)
+			if isEntry || isLegacyEntry {
+				os.Remove(filepath.Join(dir, name))
+			}
+			continue
+		}
+		nanos, ok := parseEntryName(name)
+		if !ok {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		s.files = append(s.files, file{
+			id:      strings.TrimSuffix(name, entrySuffix),
+			created: time.Unix(0, nanos),
+			size:    info.Size(),
+		})
+		s.bytes += info.Size()
+		if nanos > s.lastID {
+			s.lastID = nanos
+		}
+	}
+
+	sort.Slice(s.files, func(i, j int) bool {
+		return s.files[i].id < s.files[j].id
+	})
+
+	s.mu.Lock()
+	s.enforce()
+	s.mu.Unlock()
+
+	return s, nil
+}
+
+// parseEntryName returns the creation time encoded in an entry file name.
+func parseEntryName(name string) (int64, bool) {
+	id, ok := strings.CutSuffix(name, entrySuffix)
+	if !ok || len(id) != 20 {
+		return 0, false
+	}
+	nanos, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return nanos, true
+}
+
+// Dir returns the spool directory.
+func (s *Spool) Dir() string {
+	return s.dir
+}
+
+// Push appends a payload to the spool, then evicts the oldest entries if a
+// retention limit is exceeded.
+func (s *Spool) Push(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// IDs are creation times in nanoseconds, kept strictly increasing so
+	// that name order is queue order.
+	created := s.now().UnixNano()
+	if created <= s.lastID {
+		created = s.lastID + 1
+	}
+	id := fmt.Sprintf("%020d", created)
+
+	path := filepath.Join(s.dir, id+entrySuffix)
+	if err := atomicfile.Write(path, data, 0600); err != nil {
+		return fmt.Errorf("writing spool entry: %w", err)
+	}
+
+	s.lastID = created
+	s.files = append(s.files, file{id: id, created: time.Unix(0, created), size: int64(len(data))})
+	s.bytes += int64(len(data))
+	s.enforce()
+
+	return nil
+}
+
+// Oldest returns the oldest entry that has not expired.
+// It returns false if the spool is empty.
+func (s *Spool) Oldest() (Entry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.enforce()
+
+	for len(s.files) > 0 {
+		f := s.files[0]
+		data, err := os.ReadFile(s.path(f.id))
+		if os.IsNotExist(err) {
+			// Removed behind our back
+			s.drop(0)
+			continue
+		}
+		if err != nil {
+			return Entry{}, false, fmt.Errorf("reading spool entry: %w", err)
+		}
+		return Entry{ID: f.id, Created: f.created, Data: data}, true, nil
+	}
+
+	return Entry{}, false, nil
+}
+
+// Remove deletes an entry, typically once it has been delivered.
+func (s *Spool) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, f := range s.files {
+		if f.id == id {
+			if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("removing spool entry: %w", err)
+			}
+			s.drop(i)
+			return nil
+		}
+	}
+	return nil
+}
+
+// Len returns the number of spooled entries.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files)
+}
+
+// Stats returns the spool size and eviction counters.
+func (s *Spool) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.evicted
+	stats.Entries = len(s.files)
+	stats.Bytes = s.bytes
+	return stats
+}
+
+// enforce evicts the oldest entries until all retention limits hold.
+// Must be called with the lock held.
+func (s *Spool) enforce() {
+	r := s.retention
+
+	if r.MaxAge > 0 {
+		cutoff := s.now().Add(-r.MaxAge)
+		for len(s.files) > 0 && s.files[0].created.Before(cutoff) {
+			s.evict(&s.evicted.EvictedAge)
+		}
+	}
+
+	if r.MaxEntries > 0 {
+		for len(s.files) > r.MaxEntries {
+			s.evict(&s.evicted.EvictedEntries)
+		}
+	}
+
+	if r.MaxBytes > 0 {
+		for len(s.files) > 0 && s.bytes > r.MaxBytes {
+			s.evict(&s.evicted.EvictedBytes)
+		}
+	}
+}
+
+// evict removes the oldest entry and increments counter.
+// Must be called with the lock held.
+func (s *Spool) evict(counter *int64) {
+	os.Remove(s.path(s.files[0].id))
+	s.drop(0)
+	*counter++
+}
+
+// drop removes the i-th entry from the index.
+// Must be called with the lock held.
+func (s *Spool) drop(i int) {
+	s.bytes -= s.files[i].size
+	s.files = append(s.files[:i], s.files[i+1:]...)
+}
+
+func (s *Spool) path(id string) string {
+	return filepath.Join(s.dir, id+entrySuffix)
+}
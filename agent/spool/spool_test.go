@@ -0,0 +1,189 @@
+// SPDX-License-Identifier: MIT
+
+package spool
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeClock returns a controllable time source.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func newClock() *fakeClock {
+	return &fakeClock{t: time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)}
+}
+
+func TestSpool_FIFO(t *testing.T) {
+	clock := newClock()
+	s, err := open(t.TempDir(), Retention{}, clock.now)
+	if err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+
+	for _, payload := range []string{"one", "two", "three"} {
+		if err := s.Push([]byte(payload)); err != nil {
+			t.Fatalf("Push() error = %v", err)
+		}
+	}
+
+	for _, want := range []string{"one", "two", "three"} {
+		e, ok, err := s.Oldest()
+		if err != nil || !ok {
+			t.Fatalf("Oldest() = %v, %v", ok, err)
+		}
+		if string(e.Data) != want {
+			t.Errorf("Oldest() = %q, want %q", e.Data, want)
+		}
+		if err := s.Remove(e.ID); err != nil {
+			t.Fatalf("Remove() error = %v", err)
+		}
+	}
+
+	if _, ok, _ := s.Oldest(); ok {
+		t.Error("spool should be empty")
+	}
+}
+
+func TestSpool_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	clock := newClock()
+
+	s, err := open(dir, Retention{}, clock.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Push([]byte("a"))
+	s.Push([]byte("bb"))
+
+	// Leftovers from an interrupted write are cleaned up, files of others
+	// sharing the directory are kept
+	os.WriteFile(filepath.Join(dir, "00000000000000000001.snap.tmp"), []byte("x"), 0600)
+	os.WriteFile(filepath.Join(dir, "00000000000000000002.snap.123456.tmp"), []byte("x"), 0600)
+	os.WriteFile(filepath.Join(dir, "shm_identity.json"), []byte("{}"), 0600)
+	os.WriteFile(filepath.Join(dir, "shm_identity.json.tmp"), []byte("{}"), 0600)
+	os.WriteFile(filepath.Join(dir, "shm_identity.json.123456.tmp"), []byte("{}"), 0600)
+
+	s, err = open(dir, Retention{}, clock.now)
+	if err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+
+	stats := s.Stats()
+	if stats.Entries != 2 || stats.Bytes != 3 {
+		t.Errorf("Stats() = %+v, want 2 entries, 3 bytes", stats)
+	}
+	e, _, _ := s.Oldest()
+	if string(e.Data) != "a" {
+		t.Errorf("Oldest() = %q, want %q", e.Data, "a")
+	}
+	for _, name := range []string{"00000000000000000001.snap.tmp", "00000000000000000002.snap.123456.tmp"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("temporary file %s was not removed", name)
+		}
+	}
+	for _, name := range []string{"shm_identity.json", "shm_identity.json.tmp", "shm_identity.json.123456.tmp"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("unrelated file %s was removed: %v", name, err)
+		}
+	}
+}
+
+func TestSpool_MaxEntries(t *testing.T) {
+	s, err := open(t.TempDir(), Retention{MaxEntries: 2}, newClock().now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Push([]byte("1"))
+	s.Push([]byte("2"))
+	s.Push([]byte("3"))
+
+	stats := s.Stats()
+	if stats.Entries != 2 || stats.EvictedEntries != 1 {
+		t.Errorf("Stats() = %+v, want 2 entries and 1 eviction", stats)
+	}
+	e, _, _ := s.Oldest()
+	if string(e.Data) != "2" {
+		t.Errorf("Oldest() = %q, want %q", e.Data, "2")
+	}
+}
+
+func TestSpool_MaxBytes(t *testing.T) {
+	s, err := open(t.TempDir(), Retention{MaxBytes: 10}, newClock().now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Push([]byte("aaaa"))
+	s.Push([]byte("bbbb"))
+	s.Push([]byte("cccc"))
+
+	stats := s.Stats()
+	if stats.Bytes != 8 || stats.EvictedBytes != 1 {
+		t.Errorf("Stats() = %+v, want 8 bytes and 1 eviction", stats)
+	}
+
+	// An entry larger than the limit evicts everything, itself included
+	s.Push([]byte("this payload is too large"))
+	stats = s.Stats()
+	if stats.Entries != 0 || stats.Bytes != 0 || stats.EvictedBytes != 4 {
+		t.Errorf("Stats() = %+v, want empty spool and 4 evictions", stats)
+	}
+}
+
+func TestSpool_MaxAge(t *testing.T) {
+	clock := newClock()
+	s, err := open(t.TempDir(), Retention{MaxAge: time.Hour}, clock.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Push([]byte("old"))
+	clock.t = clock.t.Add(45 * time.Minute)
+	s.Push([]byte("new"))
+	clock.t = clock.t.Add(30 * time.Minute)
+
+	e, ok, err := s.Oldest()
+	if err != nil || !ok {
+		t.Fatalf("Oldest() = %v, %v", ok, err)
+	}
+	if string(e.Data) != "new" {
+		t.Errorf("Oldest() = %q, want %q", e.Data, "new")
+	}
+	if got := s.Stats().EvictedAge; got != 1 {
+		t.Errorf("EvictedAge = %d, want 1", got)
+	}
+}
+
+func TestMemory_Retention(t *testing.T) {
+	m := NewMemory(Retention{MaxEntries: 2})
+
+	m.Push([]byte("1"))
+	m.Push([]byte("2"))
+	m.Push([]byte("3"))
+
+	e, ok, err := m.Oldest()
+	if err != nil || !ok {
+		t.Fatalf("Oldest() = %v, %v", ok, err)
+	}
+	if string(e.Data) != "2" {
+		t.Errorf("Oldest() = %q, want %q", e.Data, "2")
+	}
+
+	m.Remove(e.ID)
+	stats := m.Stats()
+	if stats.Entries != 1 || stats.Bytes != 1 || stats.EvictedEntries != 1 {
+		t.Errorf("Stats() = %+v, want 1 entry, 1 byte, 1 eviction", stats)
+	}
+}
+
+// Both implementations satisfy Queue.
+var (
+	_ Queue = (*Spool)(nil)
+	_ Queue = (*Memory)(nil)
+)
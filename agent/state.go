@@ -0,0 +1,26 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"fmt"
+	"os"
+)
+
+// checkWritable creates every directory the agent writes to and checks
+// that a file can be created in it, so that a read-only filesystem fails
+// the start instead of the first save.
+func checkWritable(dirs []string) error {
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("creating state directory: %w (set state_dir to a writable directory)", err)
+		}
+		f, err := os.CreateTemp(dir, ".shm-agent-write-check-*")
+		if err != nil {
+			return fmt.Errorf("state directory %s is not writable: %w (set state_dir to a writable directory)", dir, err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+	return nil
+}
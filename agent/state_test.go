@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestAgent_StartFailsOnUnwritableStateDir(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(logPath, nil, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cfg := &config.Config{
+		AppName:       "test-app",
+		Offline:       true,
+		Interval:      time.Hour,
+		PositionsFile: filepath.Join(dir, "positions.json"),
+		Sources: []config.Source{
+			{
+				Path:    logPath,
+				Format:  "json",
+				Metrics: []config.Metric{{Name: "requests", Type: "counter"}},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	ag.Stop(0)
+
+	// A directory below a file can never be created, even by root
+	cfg.PositionsFile = filepath.Join(logPath, "state", "positions.json")
+	ag, err = New(Options{Config: cfg})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	err = ag.Start(context.Background())
+	if err == nil {
+		ag.Stop(0)
+		t.Fatal("Start() should fail when the state directory is not writable")
+	}
+	if !strings.Contains(err.Error(), "state_dir") {
+		t.Errorf("error = %v, want a hint to set state_dir", err)
+	}
+}
@@ -0,0 +1,146 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/spool"
+)
+
+// Stats is a point-in-time view of the agent's runtime counters.
+type Stats struct {
+	StartTime time.Time     `json:"start_time"`
+	Sources   []SourceStats `json:"sources"`
+
+	// Queue describes undelivered snapshots; nil when not sending to a server.
+	Queue *spool.Stats `json:"queue,omitempty"`
+
+	Version VersionStatus `json:"version"`
+}
+
+// SourceStats holds runtime counters for a single source.
+type SourceStats struct {
+	Path             string        `json:"path"`
+	Format           string        `json:"format"`
+	LinesParsed      int64         `json:"lines_parsed"`
+	LinesMatched     int64         `json:"lines_matched"`
+	LinesFiltered    int64         `json:"lines_filtered"`              // dropped by the source filter
+	LinesSkipped     int64         `json:"lines_skipped,omitempty"`     // left out by sample_rate
+	LinesPrefiltered int64         `json:"lines_prefiltered,omitempty"` // left out by the prefilter
+	QueueLength      int           `json:"queue_length,omitempty"`      // records waiting for a worker
+	QueueFull        int64         `json:"queue_full,omitempty"`        // records read while the queue was full
+	LinesDropped     int64         `json:"lines_dropped,omitempty"`     // records dropped on overflow or after the processor was closed
+	ParseErrors      int64         `json:"parse_errors"`
+	LinesLate        int64         `json:"lines_late,omitempty"`       // event time interval already closed
+	TimestampErrors  int64         `json:"timestamp_errors,omitempty"` // counted at the current time
+	Rotations        int64         `json:"rotations"`                  // files reopened after being moved or deleted
+	Truncations      int64         `json:"truncations"`                // files reopened after being truncated
+	Metrics          []MetricStats `json:"metrics"`
+
+	// Unmatched counts the lines that failed to parse or matched no
+	// metric by first token, most frequent first, when captured.
+	Unmatched []TokenCount `json:"unmatched,omitempty"`
+
+	// ParseErrorSamples and UnmatchedSamples are the first lines that
+	// failed to parse and that matched no metric, when kept.
+	ParseErrorSamples []LineSample `json:"parse_error_samples,omitempty"`
+	UnmatchedSamples  []LineSample `json:"unmatched_samples,omitempty"`
+}
+
+// MetricStats holds runtime counters for a single metric of a source.
+// Counters are cumulative since the agent was created.
+type MetricStats struct {
+	Name            string    `json:"name"`
+	Type            string    `json:"type"`
+	Shadow          bool      `json:"shadow,omitempty"` // computed but not sent
+	Matched         int64     `json:"matched"`
+	ExtractFailures int64     `json:"extract_failures"` // missing + invalid
+	ExtractMissing  int64     `json:"extract_missing"`  // extract field absent
+	ExtractInvalid  int64     `json:"extract_invalid"`  // extract field not convertible
+	LastMatch       time.Time `json:"last_match"`
+}
+
+// Stats returns runtime counters for every configured source and metric.
+func (a *Agent) Stats() Stats {
+	processors := a.currentProcessors()
+
+	stats := Stats{
+		StartTime: a.StartTime(),
+		Sources:   make([]SourceStats, 0, len(processors)),
+		Version:   a.VersionStatus(),
+	}
+	for _, proc := range processors {
+		stats.Sources = append(stats.Sources, proc.stats())
+	}
+
+	a.mu.Lock()
+	snd := a.sender
+	a.mu.Unlock()
+	if snd != nil {
+		q := snd.QueueStats()
+		stats.Queue = &q
+	}
+
+	return stats
+}
+
+// stats returns the processor's runtime counters.
+func (p *sourceProcessor) stats() SourceStats {
+	st := SourceStats{
+		Path:             p.source.Location(),
+		Format:           p.source.Format,
+		LinesParsed:      p.linesParsed.Load(),
+		LinesMatched:     p.linesMatched.Load(),
+		LinesFiltered:    p.linesFiltered.Load(),
+		LinesSkipped:     p.linesSkipped.Load(),
+		LinesPrefiltered: p.linesPrefiltered.Load(),
+		ParseErrors:      p.parseErrors.Load(),
+		LinesLate:        p.linesLate.Load(),
+		TimestampErrors:  p.timeErrors.Load(),
+		Rotations:        p.rotations.Load(),
+		Truncations:      p.truncations.Load(),
+		Metrics:          make([]MetricStats, 0, len(p.metrics)),
+	}
+	for _, m := range p.metrics {
+		st.Metrics = append(st.Metrics, m.stats())
+	}
+	if p.queue != nil {
+		st.QueueLength = p.queue.length()
+		st.QueueFull = p.queue.full.Load()
+		st.LinesDropped = p.linesDropped()
+	}
+	if p.unmatched != nil {
+		st.Unmatched = p.unmatched.top()
+	}
+	st.ParseErrorSamples, st.UnmatchedSamples = p.samples.get()
+	return st
+}
+
+// stats returns the metric's runtime counters.
+func (m *metricProcessor) stats() MetricStats {
+	missing := m.extractMissing.Load()
+	invalid := m.extractInvalid.Load()
+
+	st := MetricStats{
+		Name:            m.cfg.Name,
+		Type:            m.cfg.Type,
+		Shadow:          m.cfg.Shadow,
+		Matched:         m.matched.Load(),
+		ExtractFailures: missing + invalid,
+		ExtractMissing:  missing,
+		ExtractInvalid:  invalid,
+	}
+	if ns := m.lastMatch.Load(); ns != 0 {
+		st.LastMatch = time.Unix(0, ns)
+	}
+	return st
+}
+
+// linesDropped returns the number of lines the queue of the source dropped.
+func (p *sourceProcessor) linesDropped() int64 {
+	if p.queue == nil {
+		return 0
+	}
+	return p.queue.dropped.Load()
+}
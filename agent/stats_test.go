@@ -0,0 +1,138 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestAgent_Stats(t *testing.T) {
+	cfg := &config.Config{
+		ServerURL:   "https://example.com",
+		AppName:     "test-app",
+		AppVersion:  "1.0.0",
+		Environment: "test",
+		Sources: []config.Source{
+			{
+				Path:   "/var/log/test.log",
+				Format: "json",
+				Metrics: []config.Metric{
+					{
+						Name:  "errors",
+						Type:  "counter",
+						Match: &config.Match{Field: "level", Equals: "error"},
+					},
+					{
+						Name:    "total_bytes",
+						Type:    "sum",
+						Extract: &config.Extract{Field: "bytes"},
+					},
+				},
+			},
+		},
+	}
+
+	agent, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	lines := []string{
+		`{"level": "error", "bytes": 10}`,
+		`{"level": "info", "bytes": "n/a"}`,
+		`{"level": "info"}`,
+		`not json`,
+	}
+	for _, line := range lines {
+		agent.ProcessLine(0, line)
+	}
+
+	stats := agent.Stats()
+	if len(stats.Sources) != 1 {
+		t.Fatalf("len(Sources) = %d, want 1", len(stats.Sources))
+	}
+
+	src := stats.Sources[0]
+	if src.LinesParsed != 3 {
+		t.Errorf("LinesParsed = %d, want 3", src.LinesParsed)
+	}
+	if src.ParseErrors != 1 {
+		t.Errorf("ParseErrors = %d, want 1", src.ParseErrors)
+	}
+
+	if len(src.Metrics) != 2 {
+		t.Fatalf("len(Metrics) = %d, want 2", len(src.Metrics))
+	}
+
+	errs := src.Metrics[0]
+	if errs.Name != "errors" || errs.Matched != 1 {
+		t.Errorf("errors stats = %+v, want Matched=1", errs)
+	}
+	if errs.LastMatch.IsZero() {
+		t.Error("errors LastMatch should be set")
+	}
+
+	bytes := src.Metrics[1]
+	if bytes.Matched != 3 {
+		t.Errorf("total_bytes Matched = %d, want 3", bytes.Matched)
+	}
+	if bytes.ExtractFailures != 2 {
+		t.Errorf("total_bytes ExtractFailures = %d, want 2", bytes.ExtractFailures)
+	}
+	if bytes.ExtractMissing != 1 {
+		t.Errorf("total_bytes ExtractMissing = %d, want 1", bytes.ExtractMissing)
+	}
+	if bytes.ExtractInvalid != 1 {
+		t.Errorf("total_bytes ExtractInvalid = %d, want 1", bytes.ExtractInvalid)
+	}
+}
+
+func TestAgent_ErrorSamples(t *testing.T) {
+	cfg := &config.Config{
+		AppName: "test-app",
+		Sources: []config.Source{{
+			Path:   "/var/log/test.log",
+			Format: "json",
+			Metrics: []config.Metric{{
+				Name:  "errors",
+				Type:  "counter",
+				Match: &config.Match{Field: "level", Equals: "error"},
+			}},
+		}},
+	}
+
+	ag, err := NewBuilder(cfg, WithDryRun(true), WithErrorSamples(2)).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	for _, line := range []string{
+		`not json`,
+		`{"level": "error"}`,
+		`{"level": "info"}`,
+		`[1, 2`,
+		`{"level": "debug"}`,
+		`still not json`,
+		`{"level": "warn"}`,
+	} {
+		ag.ProcessLine(0, line)
+	}
+
+	src := ag.Stats().Sources[0]
+	if len(src.ParseErrorSamples) != 2 || src.ParseErrorSamples[0].Text != "not json" || src.ParseErrorSamples[1].Text != "[1, 2" {
+		t.Errorf("ParseErrorSamples = %+v, want the first 2 lines that failed to parse", src.ParseErrorSamples)
+	}
+	if len(src.UnmatchedSamples) != 2 || src.UnmatchedSamples[0].Text != `{"level": "info"}` || src.UnmatchedSamples[1].Text != `{"level": "debug"}` {
+		t.Errorf("UnmatchedSamples = %+v, want the first 2 lines that matched no metric", src.UnmatchedSamples)
+	}
+
+	ag, err = NewBuilder(cfg, WithDryRun(true)).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	ag.ProcessLine(0, `not json`)
+	if src := ag.Stats().Sources[0]; src.ParseErrorSamples != nil {
+		t.Errorf("ParseErrorSamples = %+v without WithErrorSamples", src.ParseErrorSamples)
+	}
+}
@@ -0,0 +1,258 @@
+// SPDX-License-Identifier: MIT
+
+// Package statsd sends snapshots as StatsD lines over UDP.
+//
+// Counters and sums are sent as counts of the snapshot interval, gauges
+// and sets as gauges, and percentiles as a count and sum plus one gauge
+// per quantile. Counter_by metrics are sent as a count per value, the field
+// counted being a label. With DogStatsD enabled, labels are sent as tags; otherwise
+// their values are appended to the metric name, in label name order.
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+// DefaultMaxPacketSize keeps datagrams within the MTU of most networks.
+const DefaultMaxPacketSize = 1432
+
+// TypeFunc looks up the type of a metric, which selects its StatsD line
+// type.
+type TypeFunc func(name string) (aggregator.MetricType, bool)
+
+// Config configures a Client.
+type Config struct {
+	Address       string   // UDP address of the StatsD server, e.g. 127.0.0.1:8125
+	Prefix        string   // added before every metric name, e.g. "shop."
+	DogStatsD     bool     // send labels as DogStatsD tags
+	Tags          []string // DogStatsD tags added to every line, e.g. "env:prod"
+	MaxPacketSize int      // defaults to DefaultMaxPacketSize
+
+	// Types decides which metrics are sent as counters ("|c"): counters
+	// and sums. The others, unknown metrics included, are sent as gauges.
+	Types TypeFunc
+}
+
+// Client sends snapshots to a StatsD server.
+type Client struct {
+	cfg Config
+
+	mu   sync.Mutex
+	conn net.Conn
+
+	lastDelivery atomic.Int64 // unix nanoseconds of the last snapshot sent
+}
+
+// New creates a Client. The address is resolved once, by Dial.
+func New(cfg Config) *Client {
+	if cfg.MaxPacketSize <= 0 {
+		cfg.MaxPacketSize = DefaultMaxPacketSize
+	}
+	return &Client{cfg: cfg}
+}
+
+// Dial opens the UDP socket lines are sent from.
+func (c *Client) Dial() error {
+	conn, err := net.Dial("udp", c.cfg.Address)
+	if err != nil {
+		return fmt.Errorf("connecting to statsd: %w", err)
+	}
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	return nil
+}
+
+// Name returns "statsd".
+func (c *Client) Name() string {
+	return "statsd"
+}
+
+// Send sends the metrics of a snapshot, packing lines into datagrams of at
+// most MaxPacketSize bytes. Being UDP, delivery is not confirmed.
+func (c *Client) Send(_ context.Context, snap sender.Snapshot) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return fmt.Errorf("statsd client is not connected")
+	}
+
+	var packet []byte
+	var errs []error
+	flush := func() {
+		if len(packet) == 0 {
+			return
+		}
+		if _, err := c.conn.Write(packet); err != nil {
+			errs = append(errs, err)
+		}
+		packet = packet[:0]
+	}
+	for _, line := range c.Lines(snap.Metrics) {
+		if len(packet) > 0 && len(packet)+1+len(line) > c.cfg.MaxPacketSize {
+			flush()
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	flush()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("sending to statsd: %w (%d datagrams failed)", errs[0], len(errs))
+	}
+	c.lastDelivery.Store(time.Now().UnixNano())
+	return nil
+}
+
+// LastDelivery returns when a snapshot was last sent, or the zero time.
+func (c *Client) LastDelivery() time.Time {
+	if ns := c.lastDelivery.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// Close closes the socket.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// Lines renders metrics as StatsD lines, in metric name order.
+func (c *Client) Lines(metrics map[string]interface{}) []string {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, name := range names {
+		var typ aggregator.MetricType
+		if c.cfg.Types != nil {
+			typ, _ = c.cfg.Types(name)
+		}
+		for _, s := range aggregator.SeriesOf(metrics[name]) {
+			lines = c.appendSeries(lines, name, typ, s)
+		}
+	}
+	return lines
+}
+
+// appendSeries appends the lines of one series of a metric.
+func (c *Client) appendSeries(lines []string, name string, typ aggregator.MetricType, s aggregator.Series) []string {
+	if d, ok := s.Value.(aggregator.Distribution); ok {
+		lines = append(lines,
+			c.line(name+".count", s.Labels, d["count"], "c"),
+			c.line(name+".sum", s.Labels, d["sum"], "c"))
+		quantiles := make([]string, 0, len(d))
+		for q := range d {
+			if strings.HasPrefix(q, "p") {
+				quantiles = append(quantiles, q)
+			}
+		}
+		sort.Strings(quantiles)
+		for _, q := range quantiles {
+			lines = c.appendGauge(lines, name+"."+q, s.Labels, d[q])
+		}
+		return lines
+	}
+
+	v, ok := aggregator.Float(s.Value)
+	if !ok {
+		return lines
+	}
+	if typ == aggregator.Counter || typ == aggregator.Sum || typ == aggregator.CounterBy {
+		return append(lines, c.line(name, s.Labels, v, "c"))
+	}
+	return c.appendGauge(lines, name, s.Labels, v)
+}
+
+// appendGauge appends the lines setting a gauge. A signed gauge value is a
+// relative change in StatsD, so a negative value is sent after a reset to 0.
+func (c *Client) appendGauge(lines []string, name string, labels map[string]string, v float64) []string {
+	if v < 0 {
+		lines = append(lines, c.line(name, labels, 0, "g"))
+	}
+	return append(lines, c.line(name, labels, v, "g"))
+}
+
+// line renders a single StatsD line.
+func (c *Client) line(name string, labels map[string]string, v float64, kind string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(sanitize(c.cfg.Prefix + name))
+	if !c.cfg.DogStatsD {
+		for _, k := range keys {
+			b.WriteByte('.')
+			b.WriteString(sanitize(labels[k]))
+		}
+	}
+	b.WriteByte(':')
+	b.WriteString(formatFloat(v))
+	b.WriteByte('|')
+	b.WriteString(kind)
+
+	if c.cfg.DogStatsD && len(keys)+len(c.cfg.Tags) > 0 {
+		b.WriteString("|#")
+		for i, tag := range c.cfg.Tags {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(sanitizeTag(tag))
+		}
+		for i, k := range keys {
+			if i > 0 || len(c.cfg.Tags) > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(sanitizeTag(k + ":" + labels[k]))
+		}
+	}
+	return b.String()
+}
+
+// formatFloat formats a value without exponent, which StatsD servers do
+// not all accept.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// sanitize replaces the characters that delimit the fields of a line in a
+// metric name or label value.
+func sanitize(s string) string {
+	return nameReplacer.Replace(s)
+}
+
+var nameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", "\n", "_", " ", "_")
+
+// sanitizeTag replaces the characters that delimit the fields of a line or
+// separate tags in a tag.
+func sanitizeTag(s string) string {
+	return tagReplacer.Replace(s)
+}
+
+var tagReplacer = strings.NewReplacer("|", "_", ",", "_", "\n", "_")
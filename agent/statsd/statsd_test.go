@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: MIT
+
+package statsd
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+var testTypes = map[string]aggregator.MetricType{
+	"requests": aggregator.Counter,
+	"bytes":    aggregator.Sum,
+	"temp":     aggregator.Gauge,
+	"users":    aggregator.Set,
+	"latency":  aggregator.Percentile,
+}
+
+func typeOf(name string) (aggregator.MetricType, bool) {
+	typ, ok := testTypes[name]
+	return typ, ok
+}
+
+var testMetrics = map[string]interface{}{
+	"requests": []aggregator.Series{
+		{Labels: map[string]string{"method": "GET", "status": "200"}, Value: float64(3)},
+	},
+	"bytes":   1.5,
+	"temp":    float64(-4),
+	"users":   2,
+	"latency": aggregator.Distribution{"count": 4, "sum": 10, "p50": 2, "p99": 4},
+	"ratio":   0.25,
+}
+
+func TestClient_Lines(t *testing.T) {
+	c := New(Config{Prefix: "shop.", Types: typeOf})
+	want := []string{
+		"shop.bytes:1.5|c",
+		"shop.latency.count:4|c",
+		"shop.latency.sum:10|c",
+		"shop.latency.p50:2|g",
+		"shop.latency.p99:4|g",
+		"shop.ratio:0.25|g",
+		"shop.requests.GET.200:3|c",
+		"shop.temp:0|g",
+		"shop.temp:-4|g",
+		"shop.users:2|g",
+	}
+	if got := c.Lines(testMetrics); !reflect.DeepEqual(got, want) {
+		t.Errorf("Lines() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestClient_LinesDogStatsD(t *testing.T) {
+	c := New(Config{DogStatsD: true, Tags: []string{"env:prod"}, Types: typeOf})
+	got := c.Lines(map[string]interface{}{
+		"requests": testMetrics["requests"],
+		"ratio":    0.25,
+	})
+	want := []string{
+		"ratio:0.25|g|#env:prod",
+		"requests:3|c|#env:prod,method:GET,status:200",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Lines() = %q, want %q", got, want)
+	}
+}
+
+func TestClient_Send(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	c := New(Config{Address: pc.LocalAddr().String(), Types: typeOf, MaxPacketSize: 64})
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+	if err := c.Send(context.Background(), sender.Snapshot{Metrics: testMetrics}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if c.LastDelivery().IsZero() {
+		t.Error("LastDelivery() is zero after Send")
+	}
+
+	// Lines are split across datagrams of at most 64 bytes
+	var lines []string
+	buf := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(lines) < len(c.Lines(testMetrics)) {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom() error = %v after %d lines", err, len(lines))
+		}
+		if n > 64 {
+			t.Errorf("datagram of %d bytes, want at most 64", n)
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	if !reflect.DeepEqual(lines, c.Lines(testMetrics)) {
+		t.Errorf("received %q, want %q", lines, c.Lines(testMetrics))
+	}
+}
@@ -0,0 +1,64 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"bufio"
+	"context"
+	"os"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/tailer"
+)
+
+// startStdin starts reading standard input for the sources whose path is
+// "-". Every line is processed by all of them. Standard input is read at
+// most once per agent. Must be called with tailersMu held.
+func (a *Agent) startStdin(ctx context.Context) {
+	if a.stdinStarted {
+		return
+	}
+	a.stdinStarted = true
+
+	r := a.stdin
+	if r == nil {
+		r = os.Stdin
+	}
+
+	go func() {
+		var n int64
+		count, err := tailer.ProcessReader(bufio.NewReaderSize(r, 64*1024), func(line string) {
+			if ctx.Err() != nil {
+				return
+			}
+			n++
+			lc := lineContext{path: config.StdinPath, line: n}
+			for _, proc := range a.currentProcessors() {
+				if proc.source.IsStdin() {
+					proc.processLineWith(line, lc)
+				}
+			}
+		}, 0)
+		if err != nil {
+			a.logger.Error("error reading stdin", "error", err)
+		}
+		a.logger.Info("stdin closed", "lines", count)
+
+		if a.onlyStdinSources() {
+			close(a.inputDone)
+		}
+	}()
+
+	a.logger.Info("started reading stdin")
+}
+
+// onlyStdinSources reports whether every source reads standard input, in
+// which case the agent has nothing left to read once it is closed.
+func (a *Agent) onlyStdinSources() bool {
+	for _, proc := range a.currentProcessors() {
+		if !proc.source.IsStdin() {
+			return false
+		}
+	}
+	return true
+}
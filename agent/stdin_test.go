@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestAgent_Stdin(t *testing.T) {
+	cfg := &config.Config{
+		AppName:  "test-app",
+		Interval: time.Hour,
+		Offline:  true,
+		Sources: []config.Source{
+			{
+				Path:   config.StdinPath,
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+				},
+			},
+			{
+				Path:   config.StdinPath,
+				Format: "logfmt",
+				Metrics: []config.Metric{
+					{Name: "logfmt_lines", Type: "counter"},
+				},
+			},
+		},
+	}
+
+	var mu sync.Mutex
+	var snapshots []map[string]interface{}
+	out := OutputFunc(func(_ context.Context, metrics map[string]interface{}) error {
+		mu.Lock()
+		snapshots = append(snapshots, metrics)
+		mu.Unlock()
+		return nil
+	})
+
+	input := strings.NewReader("{\"a\":1}\n{\"a\":2}\nlevel=info\n")
+	ag, err := NewBuilder(cfg, WithDryRun(true), WithOutput(out), WithStdin(input)).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Run returns on its own once stdin is exhausted
+	if err := ag.Run(ctx); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("Run() did not return when stdin was closed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(snapshots) != 1 {
+		t.Fatalf("got %d snapshots, want the final one", len(snapshots))
+	}
+	if v := snapshots[0]["requests"]; v != float64(2) {
+		t.Errorf("requests = %v, want 2", v)
+	}
+	if v := snapshots[0]["logfmt_lines"]; v != float64(1) {
+		t.Errorf("logfmt_lines = %v, want 1", v)
+	}
+	if got := ag.Stats().Sources[0].Path; got != "stdin" {
+		t.Errorf("source path = %q, want stdin", got)
+	}
+}
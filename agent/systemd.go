@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/sdnotify"
+)
+
+// Service statuses reported to systemd.
+const (
+	statusRunning             = "Running"
+	statusRegistrationPending = "Running, registration with the server pending"
+)
+
+// notifySystemd sends states to systemd when enabled with
+// WithSystemdNotify. Failures are logged: the agent runs on without a
+// notification socket.
+func (a *Agent) notifySystemd(states ...string) {
+	if !a.systemdNotify {
+		return
+	}
+	if err := sdnotify.Notify(states...); err != nil {
+		a.errors.Warn("sdnotify", "failed to notify systemd", "error", err)
+	}
+}
+
+// watchdogTicker returns a ticker pinging the systemd watchdog, or nil
+// when the unit has none.
+func (a *Agent) watchdogTicker() *time.Ticker {
+	if !a.systemdNotify {
+		return nil
+	}
+	interval := sdnotify.WatchdogInterval()
+	if interval <= 0 {
+		return nil
+	}
+	return time.NewTicker(interval)
+}
+
+// notifyRegistered reports the agent as running once a registration that
+// failed at startup went through, which the first delivery to the server
+// shows.
+func (a *Agent) notifyRegistered() {
+	if !a.registrationPending.Load() || a.sender == nil || a.sender.LastDelivery().IsZero() {
+		return
+	}
+	if a.registrationPending.CompareAndSwap(true, false) {
+		a.notifySystemd(sdnotify.Status(statusRunning))
+	}
+}
@@ -0,0 +1,185 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/sender/shmtest"
+)
+
+func TestAgent_SystemdNotify(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unixgram sockets on windows")
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", sock)
+	t.Setenv("WATCHDOG_USEC", "20000") // pinged every 10ms
+	t.Setenv("WATCHDOG_PID", "")
+
+	cfg := &config.Config{
+		AppName:  "test-app",
+		Interval: time.Hour,
+		Offline:  true,
+		Sources: []config.Source{
+			{
+				Path:   path,
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+				},
+			},
+		},
+	}
+	ag, err := NewBuilder(cfg, WithSystemdNotify(true)).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	read := func() string {
+		t.Helper()
+		buf := make([]byte, 256)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("reading notification: %v", err)
+		}
+		return string(buf[:n])
+	}
+	if got := read(); got != "READY=1\nSTATUS=Running" {
+		t.Errorf("first notification = %q, want READY=1", got)
+	}
+	if got := read(); got != "WATCHDOG=1" {
+		t.Errorf("second notification = %q, want WATCHDOG=1", got)
+	}
+
+	ag.Stop(0)
+	for {
+		got := read()
+		if got == "STOPPING=1" {
+			break
+		}
+		if got != "WATCHDOG=1" {
+			t.Fatalf("notification = %q, want STOPPING=1", got)
+		}
+	}
+
+	// Not sent unless enabled
+	ag, err = NewBuilder(cfg).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer ag.Stop(0)
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := conn.Read(buf); err == nil {
+		t.Errorf("notification %q sent without WithSystemdNotify", buf[:n])
+	}
+}
+
+func TestAgent_SystemdNotifyRegistration(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unixgram sockets on windows")
+	}
+
+	srv := shmtest.NewServer()
+	defer srv.Close()
+	var down atomic.Bool
+	down.Store(true)
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		srv.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer front.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", sock)
+	t.Setenv("WATCHDOG_USEC", "")
+
+	cfg := &config.Config{
+		AppName:       "test-app",
+		AppVersion:    "1.0.0",
+		ServerURL:     front.URL,
+		IdentityFile:  filepath.Join(dir, "identity.json"),
+		PositionsFile: "none",
+		SequenceFile:  "none",
+		Interval:      20 * time.Millisecond,
+		Sources: []config.Source{
+			{
+				Path:   path,
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "requests", Type: "counter"},
+				},
+			},
+		},
+	}
+	ag, err := NewBuilder(cfg, WithSystemdNotify(true)).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer ag.Stop(0)
+
+	read := func() string {
+		t.Helper()
+		buf := make([]byte, 256)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("reading notification: %v", err)
+		}
+		return string(buf[:n])
+	}
+
+	// Ready without the server, which shows in the status
+	if got, want := read(), "READY=1\nSTATUS="+statusRegistrationPending; got != want {
+		t.Errorf("first notification = %q, want %q", got, want)
+	}
+	down.Store(false)
+	if got, want := read(), "STATUS="+statusRunning; got != want {
+		t.Errorf("notification once registered = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: MIT
+
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Magic numbers of the compressed formats read by OpenFile.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// OpenFile opens a file for reading, decompressing gzip and zstd files
+// such as rotated logs. The format is recognized by its content, whatever
+// the file name.
+func OpenFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening file: %w", err)
+	}
+
+	r, err := decompress(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// decompress returns the content of file, decompressed if needed. Closing
+// the returned reader closes file.
+func decompress(file *os.File) (io.ReadCloser, error) {
+	br := bufio.NewReader(file)
+	magic, _ := br.Peek(len(zstdMagic))
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("reading gzip header: %w", err)
+		}
+		return &compressedReader{Reader: zr, close: zr.Close, file: file}, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("reading zstd header: %w", err)
+		}
+		return &compressedReader{Reader: zr, close: func() error { zr.Close(); return nil }, file: file}, nil
+	}
+	return &compressedReader{Reader: br, file: file}, nil
+}
+
+// compressedReader reads a possibly compressed file.
+type compressedReader struct {
+	io.Reader
+	close func() error // closes the decompressor, nil when uncompressed
+	file  *os.File
+}
+
+// Close releases the decompressor and closes the file.
+func (r *compressedReader) Close() error {
+	if r.close != nil {
+		r.close()
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,64 @@
+// SPDX-License-Identifier: MIT
+
+package tailer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestProcessFile_Compressed(t *testing.T) {
+	content := []byte("line1\nline2\nline3\n")
+	want := []string{"line1", "line2", "line3"}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(content)
+	zw.Close()
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zst := enc.EncodeAll(content, nil)
+	enc.Close()
+
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"app.log":      content,
+		"app.log.1.gz": gz.Bytes(),
+		"app.log.2":    gz.Bytes(), // recognized by content, not name
+		"app.log.zst":  zst,
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var lines []string
+		count, err := ProcessFile(path, func(line string) { lines = append(lines, line) }, 0)
+		if err != nil {
+			t.Errorf("%s: ProcessFile() error = %v", name, err)
+			continue
+		}
+		if count != 3 || !reflect.DeepEqual(lines, want) {
+			t.Errorf("%s: lines = %q, want %q", name, lines, want)
+		}
+	}
+
+	// A truncated archive fails rather than silently stopping
+	path := filepath.Join(dir, "truncated.gz")
+	if err := os.WriteFile(path, gz.Bytes()[:gz.Len()-4], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ProcessFile(path, func(string) {}, 0); err == nil {
+		t.Error("ProcessFile() of a truncated gzip file succeeded")
+	}
+}
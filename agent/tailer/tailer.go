@@ -4,28 +4,57 @@
 package tailer
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"log"
 	"log/slog"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/kolapsis/shm-agent/agent/logthrottle"
 	"github.com/nxadm/tail"
 )
 
 // LineHandler is called for each line read from the file.
 type LineHandler func(line string)
 
+// PartialLineWait is how long a line written without its trailing newline
+// is waited for before being delivered as is.
+const PartialLineWait = time.Second
+
+// maxPartialLine bounds the size of a line delivered without its newline.
+const maxPartialLine = 1 << 20
+
 // Tailer watches and tails a file.
 type Tailer struct {
 	path    string
 	handler LineHandler
 	logger  *slog.Logger
+	errors  *logthrottle.Logger // recurring read errors
 
 	mu     sync.Mutex
 	tail   *tail.Tail
 	cancel context.CancelFunc
+	done   chan struct{}
+
+	offset atomic.Int64 // byte offset after the last handled line
+	active atomic.Int64 // unix nanoseconds of the start or last handled line
+
+	countLines bool         // count the lines before the start offset
+	lineBase   int64        // lines before the start offset of the current file
+	line       atomic.Int64 // number of the line being or last handled
+
+	partialWait time.Duration // PartialLineWait, shortened by tests
+
+	onReopen    func(truncated bool)
+	rotations   atomic.Int64
+	truncations atomic.Int64
 }
 
 // New creates a new Tailer for the given file path.
@@ -35,54 +64,52 @@ func New(path string, handler LineHandler, logger *slog.Logger) *Tailer {
 	}
 
 	return &Tailer{
-		path:    path,
-		handler: handler,
-		logger:  logger,
+		path:        path,
+		handler:     handler,
+		logger:      logger,
+		errors:      logthrottle.New(logger, 0),
+		partialWait: PartialLineWait,
 	}
 }
 
-// Start begins tailing the file.
-// It starts from the end of the file and follows new lines.
-func (t *Tailer) Start(ctx context.Context) error {
+// CountLines makes the next start count the lines before its start offset,
+// so that Line returns line numbers from the top of the file rather than
+// from where tailing started. This reads the file up to that offset once.
+func (t *Tailer) CountLines() {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	t.countLines = true
+}
 
-	if t.tail != nil {
-		return fmt.Errorf("tailer already running")
-	}
-
-	// Check if file exists
-	if _, err := os.Stat(t.path); os.IsNotExist(err) {
-		return fmt.Errorf("file does not exist: %s", t.path)
-	}
-
-	cfg := tail.Config{
-		Follow:    true,
-		ReOpen:    true, // Handle log rotation
-		MustExist: true,
-		Location:  &tail.SeekInfo{Offset: 0, Whence: io.SeekEnd}, // Start at end
-		Logger:    tail.DiscardingLogger,
-	}
-
-	tailFile, err := tail.TailFile(t.path, cfg)
-	if err != nil {
-		return fmt.Errorf("tailing file: %w", err)
-	}
-
-	t.tail = tailFile
-
-	ctx, cancel := context.WithCancel(ctx)
-	t.cancel = cancel
-
-	go t.run(ctx)
+// OnReopen sets a function called whenever the file is reopened, after a
+// rotation or, when truncated is true, a truncation. It is called from the
+// tailing goroutine and must not block. Must be called before Start.
+func (t *Tailer) OnReopen(fn func(truncated bool)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onReopen = fn
+}
 
-	t.logger.Info("started tailing file", "path", t.path)
-	return nil
+// Start begins tailing the file.
+// It starts from the end of the file and follows new lines.
+func (t *Tailer) Start(ctx context.Context) error {
+	return t.start(ctx, &tail.SeekInfo{Offset: 0, Whence: io.SeekEnd}, "started tailing file")
 }
 
 // StartFromBeginning begins tailing from the beginning of the file.
 // Useful for testing and one-shot processing.
 func (t *Tailer) StartFromBeginning(ctx context.Context) error {
+	return t.start(ctx, &tail.SeekInfo{Offset: 0, Whence: io.SeekStart}, "started tailing file from beginning")
+}
+
+// StartAt begins tailing from the given byte offset, typically one saved
+// by a previous run.
+func (t *Tailer) StartAt(ctx context.Context, offset int64) error {
+	return t.start(ctx, &tail.SeekInfo{Offset: offset, Whence: io.SeekStart}, "resumed tailing file")
+}
+
+// start begins tailing the file from location.
+func (t *Tailer) start(ctx context.Context, location *tail.SeekInfo, msg string) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
@@ -90,16 +117,19 @@ func (t *Tailer) StartFromBeginning(ctx context.Context) error {
 		return fmt.Errorf("tailer already running")
 	}
 
-	if _, err := os.Stat(t.path); os.IsNotExist(err) {
+	// Check if file exists
+	info, err := os.Stat(t.path)
+	if os.IsNotExist(err) {
 		return fmt.Errorf("file does not exist: %s", t.path)
 	}
 
 	cfg := tail.Config{
-		Follow:    true,
-		ReOpen:    true,
-		MustExist: true,
-		Location:  &tail.SeekInfo{Offset: 0, Whence: io.SeekStart}, // Start at beginning
-		Logger:    tail.DiscardingLogger,
+		Follow:        true,
+		ReOpen:        true, // Handle log rotation
+		MustExist:     true,
+		CompleteLines: true, // Hold lines until their newline is written
+		Location:      location,
+		Logger:        log.New(reopenWatcher{t}, "", 0),
 	}
 
 	tailFile, err := tail.TailFile(t.path, cfg)
@@ -107,40 +137,187 @@ func (t *Tailer) StartFromBeginning(ctx context.Context) error {
 		return fmt.Errorf("tailing file: %w", err)
 	}
 
+	// Record the starting offset so Offset is meaningful before the first line
+	switch {
+	case location.Whence == io.SeekStart:
+		t.offset.Store(location.Offset)
+	case info != nil:
+		t.offset.Store(info.Size())
+	}
+
+	t.lineBase = 0
+	if t.countLines && t.offset.Load() > 0 {
+		n, err := countNewlines(t.path, t.offset.Load())
+		if err != nil {
+			t.logger.Warn("counting lines failed, line numbers are relative", "path", t.path, "error", err)
+		}
+		t.lineBase = n
+	}
+	t.line.Store(t.lineBase)
+	t.active.Store(time.Now().UnixNano())
+
 	t.tail = tailFile
 
 	ctx, cancel := context.WithCancel(ctx)
 	t.cancel = cancel
+	t.done = make(chan struct{})
 
-	go t.run(ctx)
+	go t.run(ctx, tailFile, t.done)
 
-	t.logger.Info("started tailing file from beginning", "path", t.path)
+	t.logger.Info(msg, "path", t.path, "offset", t.offset.Load())
 	return nil
 }
 
-// run processes lines from the tail.
-func (t *Tailer) run(ctx context.Context) {
+// run processes lines from the tail until ctx is cancelled or the tail
+// channel is closed. done is closed on return.
+//
+// Lines are only delivered once complete. When the file ends with a line
+// still missing its newline for partialWait, that fragment is delivered as
+// a line, and only the rest of the line is delivered once completed.
+func (t *Tailer) run(ctx context.Context, tf *tail.Tail, done chan struct{}) {
+	defer close(done)
+
+	idle := time.NewTimer(t.partialWait)
+	defer idle.Stop()
+
+	lastNum := 0
+	var fragment string     // delivered start of an incomplete line
+	var fragmentStart int64 // offset of that line
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case line, ok := <-t.tail.Lines:
+		case <-idle.C:
+			if text, ok := t.readFragment(); ok {
+				offset := t.offset.Load()
+				if fragment == "" {
+					fragmentStart = offset
+				}
+				fragment += text
+				t.line.Store(t.lineBase + int64(lastNum) + 1)
+				t.deliver(text, offset+int64(len(text)))
+			}
+			idle.Reset(t.partialWait)
+		case line, ok := <-tf.Lines:
 			if !ok {
 				t.logger.Debug("tail channel closed", "path", t.path)
 				return
 			}
 			if line.Err != nil {
-				t.logger.Error("error reading line", "path", t.path, "error", line.Err)
+				t.errors.Error("read", "error reading line", "path", t.path, "error", line.Err)
 				continue
 			}
-			if t.handler != nil {
-				t.handler(line.Text)
+			// Line numbers restart when the file is reopened after a rotation
+			if line.Num < lastNum {
+				t.lineBase = 0
+				fragment = ""
 			}
+			lastNum = line.Num
+			t.line.Store(t.lineBase + int64(line.Num))
+
+			text := line.Text
+			if fragment != "" {
+				start := line.SeekInfo.Offset - int64(len(text)) - 1
+				if start == fragmentStart && strings.HasPrefix(text, fragment) {
+					text = text[len(fragment):]
+				}
+				fragment = ""
+			}
+			t.deliver(text, line.SeekInfo.Offset)
+
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(t.partialWait)
 		}
 	}
 }
 
+// readFragment returns what was written after the last delivered line if
+// it is an incomplete line, that is, without a newline.
+func (t *Tailer) readFragment() (string, bool) {
+	offset := t.offset.Load()
+	info, err := os.Stat(t.path)
+	if err != nil || info.Size() <= offset || info.Size()-offset > maxPartialLine {
+		return "", false
+	}
+
+	f, err := os.Open(t.path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	buf := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		return "", false
+	}
+	if bytes.IndexByte(buf, '\n') >= 0 {
+		return "", false // complete lines the tail has yet to deliver
+	}
+	return string(buf), true
+}
+
+// reopenWatcher receives the messages of the tail library, which reports
+// reopened files only through its logger.
+type reopenWatcher struct {
+	t *Tailer
+}
+
+func (w reopenWatcher) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	switch {
+	case strings.HasPrefix(msg, "Successfully reopened truncated"):
+		w.t.reopened(true)
+	case strings.HasPrefix(msg, "Successfully reopened"):
+		w.t.reopened(false)
+	default:
+		w.t.logger.Debug(msg, "path", w.t.path)
+	}
+	return len(p), nil
+}
+
+// reopened records a reopening of the file.
+func (t *Tailer) reopened(truncated bool) {
+	if truncated {
+		t.truncations.Add(1)
+		t.logger.Info("file truncated, reading from the beginning", "path", t.path)
+	} else {
+		t.rotations.Add(1)
+		t.logger.Info("file rotated, reopened", "path", t.path)
+	}
+	if t.onReopen != nil {
+		t.onReopen(truncated)
+	}
+}
+
+// Rotations returns how many times the file was reopened after being moved
+// or deleted.
+func (t *Tailer) Rotations() int64 {
+	return t.rotations.Load()
+}
+
+// Truncations returns how many times the file was reopened after being
+// truncated.
+func (t *Tailer) Truncations() int64 {
+	return t.truncations.Load()
+}
+
+// deliver passes a line to the handler and records the offset after it.
+func (t *Tailer) deliver(text string, offset int64) {
+	t.active.Store(time.Now().UnixNano())
+	if t.handler != nil {
+		t.handler(text)
+	}
+	t.offset.Store(offset)
+}
+
 // Stop stops tailing the file.
+// It waits for the line handler to return so no lines are delivered after
+// Stop returns.
 func (t *Tailer) Stop() error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -150,6 +327,13 @@ func (t *Tailer) Stop() error {
 		t.cancel = nil
 	}
 
+	if t.done != nil {
+		<-t.done
+		t.done = nil
+	}
+
+	t.errors.Flush()
+
 	if t.tail != nil {
 		err := t.tail.Stop()
 		t.tail.Cleanup()
@@ -161,6 +345,101 @@ func (t *Tailer) Stop() error {
 	return nil
 }
 
+// Drain delivers the complete lines written after the last delivered one,
+// up to the current end of the file, so that lines still buffered when the
+// tailer was stopped are not lost. The tailer must be stopped. Drain
+// returns early when ctx is done; a last line without a newline is left
+// unread.
+func (t *Tailer) Drain(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.tail != nil {
+		return fmt.Errorf("tailer is running")
+	}
+
+	f, err := os.Open(t.path)
+	if err != nil {
+		return fmt.Errorf("opening file: %w", err)
+	}
+	defer f.Close()
+
+	offset := t.offset.Load()
+	if info, err := f.Stat(); err != nil || info.Size() <= offset {
+		return err // nothing was written since, or the file was truncated
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("seeking: %w", err)
+	}
+
+	r := bufio.NewReaderSize(f, 64*1024)
+	drained := 0
+	for ctx.Err() == nil {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading: %w", err)
+		}
+
+		t.line.Add(1)
+		if t.handler != nil {
+			t.handler(strings.TrimRight(line, "\n"))
+		}
+		offset += int64(len(line))
+		t.offset.Store(offset)
+		drained++
+	}
+
+	if drained > 0 {
+		t.logger.Info("drained file", "path", t.path, "lines", drained)
+	}
+	return ctx.Err()
+}
+
+// Offset returns the byte offset just after the last line delivered to the
+// handler. After a rotation it refers to the newly opened file.
+func (t *Tailer) Offset() int64 {
+	return t.offset.Load()
+}
+
+// Line returns the number of the line being delivered to the handler, or
+// of the last one delivered. Numbers start at 1 at the top of the file with
+// CountLines, and after the start offset otherwise.
+func (t *Tailer) Line() int64 {
+	return t.line.Load()
+}
+
+// LastActive returns when the tailer last delivered a line, or when it
+// started if it has not delivered any.
+func (t *Tailer) LastActive() time.Time {
+	return time.Unix(0, t.active.Load())
+}
+
+// countNewlines counts the newlines in the first n bytes of a file.
+func countNewlines(path string, n int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var count int64
+	buf := make([]byte, 64*1024)
+	r := io.LimitReader(f, n)
+	for {
+		read, err := r.Read(buf)
+		count += int64(bytes.Count(buf[:read], []byte{'\n'}))
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+	}
+}
+
 // Path returns the file path being tailed.
 func (t *Tailer) Path() string {
 	return t.path
@@ -168,11 +447,12 @@ func (t *Tailer) Path() string {
 
 // ProcessFile reads an entire file and processes each line.
 // This is a one-shot operation, not continuous tailing.
-// Useful for testing and batch processing.
+// Useful for testing and batch processing. Gzip and zstd files are
+// decompressed, see OpenFile.
 func ProcessFile(path string, handler LineHandler, limit int) (int, error) {
-	file, err := os.Open(path)
+	file, err := OpenFile(path)
 	if err != nil {
-		return 0, fmt.Errorf("opening file: %w", err)
+		return 0, err
 	}
 	defer file.Close()
 
@@ -6,6 +6,7 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
@@ -352,3 +353,286 @@ func TestProcessReader_EmptyLines(t *testing.T) {
 		}
 	}
 }
+
+func TestTailer_ContextCancelStopsDelivery(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+
+	if err := os.WriteFile(path, []byte{}, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	var mu sync.Mutex
+	var lines []string
+	handler := func(line string) {
+		mu.Lock()
+		lines = append(lines, line)
+		mu.Unlock()
+	}
+
+	tailer := New(path, handler, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := tailer.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer tailer.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := os.WriteFile(path, []byte("after cancel\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(lines) != 0 {
+		t.Errorf("len(lines) = %d, want 0 after cancel", len(lines))
+	}
+}
+
+func TestTailer_StartAtAndOffset(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+
+	if err := os.WriteFile(path, []byte("line1\nline2\nline3\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	var mu sync.Mutex
+	var lines []string
+	handler := func(line string) {
+		mu.Lock()
+		lines = append(lines, line)
+		mu.Unlock()
+	}
+
+	tailer := New(path, handler, nil)
+
+	if err := tailer.StartAt(context.Background(), 6); err != nil {
+		t.Fatalf("StartAt() error = %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if err := tailer.Stop(); err != nil {
+		t.Errorf("Stop() error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(lines) != 2 || lines[0] != "line2" {
+		t.Errorf("lines = %v, want [line2 line3]", lines)
+	}
+
+	if offset := tailer.Offset(); offset != 18 {
+		t.Errorf("Offset() = %d, want 18", offset)
+	}
+}
+
+func TestTailer_CountLines(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+
+	if err := os.WriteFile(path, []byte("line1\nline2\nline3\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	var mu sync.Mutex
+	var nums []int64
+	var tailer *Tailer
+	tailer = New(path, func(line string) {
+		mu.Lock()
+		nums = append(nums, tailer.Line())
+		mu.Unlock()
+	}, nil)
+	tailer.CountLines()
+
+	if err := tailer.StartAt(context.Background(), 6); err != nil {
+		t.Fatalf("StartAt() error = %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if err := tailer.Stop(); err != nil {
+		t.Errorf("Stop() error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(nums) != 2 || nums[0] != 2 || nums[1] != 3 {
+		t.Errorf("line numbers = %v, want [2 3]", nums)
+	}
+}
+
+func TestTailer_Drain(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+
+	if err := os.WriteFile(path, []byte("line1\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	var lines []string
+	tailer := New(path, func(line string) { lines = append(lines, line) }, nil)
+
+	if err := tailer.StartFromBeginning(context.Background()); err != nil {
+		t.Fatalf("StartFromBeginning() error = %v", err)
+	}
+	if err := tailer.Drain(context.Background()); err == nil {
+		t.Error("Drain() on a running tailer should return an error")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := tailer.Stop(); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	// Written after the tailer stopped, the last line is incomplete
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	f.WriteString("line2\nline3\npartial")
+	f.Close()
+
+	if err := tailer.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+
+	want := []string{"line1", "line2", "line3"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines = %v, want %v", lines, want)
+	}
+	if offset := tailer.Offset(); offset != 18 {
+		t.Errorf("Offset() = %d, want 18", offset)
+	}
+}
+
+func TestTailer_PartialLines(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+
+	if err := os.WriteFile(path, []byte{}, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	var mu sync.Mutex
+	var lines []string
+	tailer := New(path, func(line string) {
+		mu.Lock()
+		lines = append(lines, line)
+		mu.Unlock()
+	}, nil)
+	tailer.partialWait = 300 * time.Millisecond
+
+	if err := tailer.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer tailer.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer f.Close()
+
+	write := func(s string, wait time.Duration) {
+		if _, err := f.WriteString(s); err != nil {
+			t.Fatalf("WriteString() error = %v", err)
+		}
+		time.Sleep(wait)
+	}
+
+	// A line written in two parts is delivered whole
+	write(`{"event":`, 50*time.Millisecond)
+	write("\"a\"}\n", 100*time.Millisecond)
+
+	// A fragment left without newline is delivered after the wait, then
+	// only the rest of its line
+	write(`{"event":"b"`, 600*time.Millisecond)
+	write("}\n", 200*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	want := []string{`{"event":"a"}`, `{"event":"b"`, "}"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines = %q, want %q", lines, want)
+	}
+	if offset, size := tailer.Offset(), int64(len(`{"event":"a"}`+"\n"+`{"event":"b"}`+"\n")); offset != size {
+		t.Errorf("Offset() = %d, want %d", offset, size)
+	}
+}
+
+func TestTailer_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+
+	if err := os.WriteFile(path, []byte("line1\nline2\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	var mu sync.Mutex
+	var lines []string
+	var events []bool
+	tailer := New(path, func(line string) {
+		mu.Lock()
+		lines = append(lines, line)
+		mu.Unlock()
+	}, nil)
+	tailer.OnReopen(func(truncated bool) {
+		mu.Lock()
+		events = append(events, truncated)
+		mu.Unlock()
+	})
+
+	if err := tailer.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer tailer.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	// Rotated: moved away and recreated
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	if err := os.WriteFile(path, []byte("rotated-long-line\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	// Truncated in place, then written to
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	f.WriteString("new\n")
+	f.Close()
+	time.Sleep(300 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !reflect.DeepEqual(events, []bool{false, true}) {
+		t.Errorf("reopen events = %v, want [false true]", events)
+	}
+	if tailer.Rotations() != 1 || tailer.Truncations() != 1 {
+		t.Errorf("Rotations() = %d, Truncations() = %d, want 1 and 1", tailer.Rotations(), tailer.Truncations())
+	}
+	if !reflect.DeepEqual(lines, []string{"rotated-long-line", "new"}) {
+		t.Errorf("lines = %v, want [rotated-long-line new]", lines)
+	}
+}
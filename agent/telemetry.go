@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+// Self metrics describe the agent itself. Counts are per interval, like
+// sum metrics; the others are gauges.
+const (
+	MetricLinesRead     = config.SelfMetricPrefix + "lines_read"
+	MetricParseErrors   = config.SelfMetricPrefix + "parse_errors"
+	MetricSendFailures  = config.SelfMetricPrefix + "send_failures"
+	MetricDroppedLines  = config.SelfMetricPrefix + "dropped_lines"
+	MetricUptimeSeconds = config.SelfMetricPrefix + "uptime_seconds"
+	MetricMemoryBytes   = config.SelfMetricPrefix + "memory_bytes"
+	MetricGoroutines    = config.SelfMetricPrefix + "goroutines"
+)
+
+// selfMetrics lists the self metrics with their type.
+var selfMetrics = []struct {
+	name string
+	typ  aggregator.MetricType
+}{
+	{MetricLinesRead, aggregator.Sum},
+	{MetricParseErrors, aggregator.Sum},
+	{MetricSendFailures, aggregator.Sum},
+	{MetricDroppedLines, aggregator.Sum},
+	{MetricUptimeSeconds, aggregator.Gauge},
+	{MetricMemoryBytes, aggregator.Gauge},
+	{MetricGoroutines, aggregator.Gauge},
+}
+
+// telemetry turns the cumulative counters of the agent into the per
+// interval values of the self metrics.
+type telemetry struct {
+	mu       sync.Mutex
+	lines    map[*sourceProcessor][3]int64 // lines read, parse errors and lines dropped at the last snapshot
+	failures int64                         // send failures at the last snapshot
+}
+
+// recordSelfMetrics sets the self metrics for the snapshot about to be
+// taken. Metrics are registered on first use.
+func (a *Agent) recordSelfMetrics() {
+	if !a.Config().SelfMetricsEnabled() {
+		return
+	}
+	for _, m := range selfMetrics {
+		a.aggregator.Register(m.name, m.typ)
+	}
+
+	t := &a.telemetry
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Processors replaced by a reload start from zero; forget the others.
+	var lines, errors, dropped int64
+	last := make(map[*sourceProcessor][3]int64)
+	for _, proc := range a.currentProcessors() {
+		now := [3]int64{proc.linesRead.Load(), proc.parseErrors.Load(), proc.linesDropped()}
+		prev := t.lines[proc]
+		lines += now[0] - prev[0]
+		errors += now[1] - prev[1]
+		dropped += now[2] - prev[2]
+		last[proc] = now
+	}
+	t.lines = last
+
+	failures := a.outputFailures.Load()
+	if a.sender != nil {
+		failures += a.sender.FailedAttempts()
+	}
+
+	a.aggregator.Add(MetricLinesRead, float64(lines))
+	a.aggregator.Add(MetricParseErrors, float64(errors))
+	a.aggregator.Add(MetricDroppedLines, float64(dropped))
+	a.aggregator.Add(MetricSendFailures, float64(failures-t.failures))
+	t.failures = failures
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	if start := a.liveSince.Load(); start != 0 {
+		a.aggregator.SetGauge(MetricUptimeSeconds, time.Since(time.Unix(0, start)).Seconds())
+	}
+	a.aggregator.SetGauge(MetricMemoryBytes, float64(mem.HeapAlloc))
+	a.aggregator.SetGauge(MetricGoroutines, float64(runtime.NumGoroutine()))
+}
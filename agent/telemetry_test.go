@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestAgent_SelfMetrics(t *testing.T) {
+	cfg := reloadTestConfig("/var/log/app.log")
+	cfg.Sources[0].Prefilter = &config.PrefilterConfig{Contains: "{"}
+
+	var got []map[string]interface{}
+	out := OutputFunc(func(_ context.Context, metrics map[string]interface{}) error {
+		got = append(got, metrics)
+		return errors.New("output down")
+	})
+	ag, err := NewBuilder(cfg, WithDryRun(true), WithOutput(out)).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	ag.ProcessLine(0, `{}`)
+	ag.ProcessLine(0, `{}`)
+	ag.ProcessLine(0, `{not json`)
+	ag.ProcessLine(0, `left out by the prefilter`)
+	_ = ag.sendSnapshot(context.Background())
+
+	ag.ProcessLine(0, `{}`)
+	_ = ag.sendSnapshot(context.Background())
+
+	if len(got) != 2 {
+		t.Fatalf("got %d snapshots, want 2", len(got))
+	}
+
+	want := []map[string]float64{
+		{MetricLinesRead: 4, MetricParseErrors: 1, MetricSendFailures: 0},
+		{MetricLinesRead: 1, MetricParseErrors: 0, MetricSendFailures: 1},
+	}
+	for i, w := range want {
+		for name, value := range w {
+			if got[i][name] != value {
+				t.Errorf("snapshot %d: %s = %v, want %v", i, name, got[i][name], value)
+			}
+		}
+		for _, name := range []string{MetricMemoryBytes, MetricGoroutines} {
+			if v, _ := got[i][name].(float64); v <= 0 {
+				t.Errorf("snapshot %d: %s = %v, want a positive value", i, name, got[i][name])
+			}
+		}
+	}
+
+	disabled := false
+	cfg.SelfMetrics = &disabled
+	ag, err = NewBuilder(cfg, WithDryRun(true), WithOutput(out)).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	_ = ag.sendSnapshot(context.Background())
+	if _, ok := got[2][MetricLinesRead]; ok {
+		t.Error("self metrics should be omitted with self_metrics: false")
+	}
+}
@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/atomicfile"
+)
+
+// storedUniqueSets is the content of the unique_file.
+type storedUniqueSets struct {
+	Metrics map[string]aggregator.WindowedSet `json:"metrics"`
+}
+
+// loadUniqueSets restores the set metrics with a unique_window from path,
+// where they are saved after every snapshot from then on. A missing file
+// is not an error.
+func (a *Agent) loadUniqueSets(path string) error {
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("loading unique sets: %w", err)
+	default:
+		var stored storedUniqueSets
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return fmt.Errorf("loading unique sets: parsing %s: %w", path, err)
+		}
+		if err := a.aggregator.RestoreWindows(stored.Metrics); err != nil {
+			return fmt.Errorf("loading unique sets: %w", err)
+		}
+		a.logger.Info("restored unique sets", "unique_file", path, "metrics", len(stored.Metrics))
+	}
+	a.uniqueFile = path
+	return nil
+}
+
+// saveUniqueSets writes the set metrics with a unique_window to the
+// unique_file, if they are persisted. Failures are logged: the sets are
+// still counted in memory.
+func (a *Agent) saveUniqueSets() {
+	if a.uniqueFile == "" {
+		return
+	}
+	if err := writeUniqueSets(a.uniqueFile, a.aggregator.SaveWindows()); err != nil {
+		a.logger.Error("failed to save unique sets", "unique_file", a.uniqueFile, "error", err)
+	}
+}
+
+// writeUniqueSets writes the unique_file atomically. It may hold the
+// values of the sets, so it is only readable by the agent's user.
+func writeUniqueSets(path string, metrics map[string]aggregator.WindowedSet) error {
+	data, err := json.Marshal(storedUniqueSets{Metrics: metrics})
+	if err != nil {
+		return fmt.Errorf("marshaling unique sets: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("creating unique sets directory: %w", err)
+	}
+
+	if err := atomicfile.Write(path, data, 0600); err != nil {
+		return fmt.Errorf("writing unique sets file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestAgent_UniqueWindow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "unique.json")
+	cfg := &config.Config{
+		AppName:    "test-app",
+		UniqueFile: path,
+		Sources: []config.Source{
+			{
+				Path:   "/var/log/app.log",
+				Format: "json",
+				Metrics: []config.Metric{
+					{Name: "daily_users", Type: "set", Extract: &config.Extract{Field: "user"}, UniqueWindow: "day"},
+					{Name: "users", Type: "set", Extract: &config.Extract{Field: "user"}},
+				},
+			},
+		},
+	}
+
+	newAgent := func() *Agent {
+		ag, err := New(Options{Config: cfg, DryRun: true})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		if err := ag.loadUniqueSets(path); err != nil {
+			t.Fatalf("loadUniqueSets() error = %v", err)
+		}
+		return ag
+	}
+
+	ag := newAgent()
+	ag.ProcessLine(0, `{"user": "alice"}`)
+	ag.ProcessLine(0, `{"user": "bob"}`)
+	if err := ag.sendSnapshot(context.Background()); err != nil {
+		t.Fatalf("sendSnapshot() error = %v", err)
+	}
+	ag.ProcessLine(0, `{"user": "alice"}`)
+	if got := ag.Metrics(); got["daily_users"] != 2 || got["users"] != 1 {
+		t.Errorf("after a snapshot: daily_users = %v, users = %v; want 2, 1", got["daily_users"], got["users"])
+	}
+
+	// A restart resumes from the saved sets
+	ag = newAgent()
+	ag.ProcessLine(0, `{"user": "carol"}`)
+	if got := ag.Metrics()["daily_users"]; got != 3 {
+		t.Errorf("after a restart: daily_users = %v, want 3", got)
+	}
+}
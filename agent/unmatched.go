@@ -0,0 +1,149 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/logthrottle"
+)
+
+// Limits of the first token counts of unmatched lines.
+const (
+	maxUnmatchedTokens   = 100       // distinct tokens counted, the rest count as otherUnmatchedToken
+	maxUnmatchedTokenLen = 64        // longer tokens are truncated
+	unmatchedTopTokens   = 10        // tokens reported in stats
+	otherUnmatchedToken  = "(other)" // lines whose token is beyond maxUnmatchedTokens
+)
+
+// TokenCount is the number of lines starting with a token.
+type TokenCount struct {
+	Token string `json:"token"`
+	Count int64  `json:"count"`
+}
+
+// unmatchedCapture records the lines of a source that failed to parse or
+// matched no metric: it counts them by first token and appends them to a
+// file rotated once it reaches its size limit.
+type unmatchedCapture struct {
+	path     string // empty to only count
+	maxBytes int64
+	errors   *logthrottle.Logger
+
+	mu     sync.Mutex
+	tokens map[string]int64
+	file   *os.File // opened on the first line
+	size   int64
+}
+
+// newUnmatchedCapture returns a capture for cfg, or nil when cfg is nil.
+func newUnmatchedCapture(cfg *config.UnmatchedConfig, errors *logthrottle.Logger) *unmatchedCapture {
+	if cfg == nil {
+		return nil
+	}
+	return &unmatchedCapture{
+		path:     cfg.File,
+		maxBytes: cfg.MaxBytes,
+		errors:   errors,
+		tokens:   make(map[string]int64),
+	}
+}
+
+// record counts a line and writes it to the file, if any.
+func (u *unmatchedCapture) record(line string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	token := firstToken(line)
+	if _, ok := u.tokens[token]; !ok && len(u.tokens) >= maxUnmatchedTokens {
+		token = otherUnmatchedToken
+	}
+	u.tokens[token]++
+
+	if u.path == "" {
+		return
+	}
+	if err := u.write(line + "\n"); err != nil {
+		u.errors.Error("unmatched", "failed to write unmatched line", "file", u.path, "error", err)
+	}
+}
+
+// write appends s to the file, rotating it first when s would take it
+// beyond maxBytes. Must be called with u.mu held.
+func (u *unmatchedCapture) write(s string) error {
+	if u.file != nil && u.size > 0 && u.size+int64(len(s)) > u.maxBytes {
+		u.file.Close()
+		u.file = nil
+		if err := os.Rename(u.path, u.path+".1"); err != nil {
+			return fmt.Errorf("rotating: %w", err)
+		}
+	}
+	if u.file == nil {
+		f, err := os.OpenFile(u.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		u.file, u.size = f, info.Size()
+	}
+	n, err := u.file.WriteString(s)
+	u.size += int64(n)
+	return err
+}
+
+// top returns the most frequent first tokens, most frequent first.
+func (u *unmatchedCapture) top() []TokenCount {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	counts := make([]TokenCount, 0, len(u.tokens))
+	for token, n := range u.tokens {
+		counts = append(counts, TokenCount{Token: token, Count: n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Token < counts[j].Token
+	})
+	if len(counts) > unmatchedTopTokens {
+		counts = counts[:unmatchedTopTokens]
+	}
+	return counts
+}
+
+// close closes the file, if open.
+func (u *unmatchedCapture) close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.file == nil {
+		return nil
+	}
+	err := u.file.Close()
+	u.file = nil
+	return err
+}
+
+// firstToken returns the first whitespace-separated token of a line,
+// truncated to maxUnmatchedTokenLen bytes.
+func firstToken(line string) string {
+	token := strings.TrimLeftFunc(line, unicode.IsSpace)
+	if i := strings.IndexFunc(token, unicode.IsSpace); i >= 0 {
+		token = token[:i]
+	}
+	if len(token) > maxUnmatchedTokenLen {
+		token = strings.ToValidUTF8(token[:maxUnmatchedTokenLen], "")
+	}
+	return token
+}
@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestUnmatchedCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "unmatched.log")
+	u := newUnmatchedCapture(&config.UnmatchedConfig{File: path, MaxBytes: 32}, nil)
+
+	for _, line := range []string{"GET /a", "GET /b", "  POST /c", "DELETE /d", "GET /e"} {
+		u.record(line)
+	}
+	if err := u.close(); err != nil {
+		t.Fatalf("close() error = %v", err)
+	}
+
+	want := []TokenCount{{"GET", 3}, {"DELETE", 1}, {"POST", 1}}
+	if got := u.top(); !reflect.DeepEqual(got, want) {
+		t.Errorf("top() = %v, want %v", got, want)
+	}
+
+	// 32 bytes hold three lines: the fourth one rotated the file
+	rotated, _ := os.ReadFile(path + ".1")
+	current, _ := os.ReadFile(path)
+	if string(rotated) != "GET /a\nGET /b\n  POST /c\n" || string(current) != "DELETE /d\nGET /e\n" {
+		t.Errorf("rotated = %q, current = %q", rotated, current)
+	}
+}
+
+func TestUnmatchedCapture_TokenLimit(t *testing.T) {
+	u := newUnmatchedCapture(&config.UnmatchedConfig{}, nil)
+	for i := 0; i < maxUnmatchedTokens+5; i++ {
+		u.record(fmt.Sprintf("token%d rest", i))
+	}
+	if n := len(u.tokens); n != maxUnmatchedTokens+1 {
+		t.Errorf("distinct tokens = %d, want %d", n, maxUnmatchedTokens+1)
+	}
+	if u.tokens[otherUnmatchedToken] != 5 {
+		t.Errorf("%s = %d, want 5", otherUnmatchedToken, u.tokens[otherUnmatchedToken])
+	}
+}
+
+func TestAgent_Unmatched(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "unmatched.log")
+	cfg := &config.Config{
+		AppName: "test-app",
+		Sources: []config.Source{
+			{
+				Path:      "/var/log/app.log",
+				Format:    "json",
+				Unmatched: &config.UnmatchedConfig{File: path, MaxBytes: config.DefaultUnmatchedMaxBytes},
+				Metrics: []config.Metric{
+					{Name: "errors", Type: "counter", Match: &config.Match{Field: "level", Equals: "error"}},
+				},
+			},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	for _, line := range []string{
+		`{"level":"error"}`,
+		`{"level":"warn"}`,
+		`not json`,
+	} {
+		ag.ProcessLine(0, line)
+	}
+
+	want := []TokenCount{{`not`, 1}, {`{"level":"warn"}`, 1}}
+	if got := ag.Stats().Sources[0].Unmatched; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unmatched = %v, want %v", got, want)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "{\"level\":\"warn\"}\nnot json\n" {
+		t.Errorf("unmatched file = %q", data)
+	}
+}
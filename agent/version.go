@@ -0,0 +1,164 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/sender"
+)
+
+// Version is the version of the agent, set when building releases with
+// -ldflags "-X github.com/kolapsis/shm-agent/agent.Version=1.2.3".
+// Binaries installed with go install report their module version.
+var Version = "dev"
+
+func init() {
+	if Version != "dev" {
+		return
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		Version = strings.TrimPrefix(bi.Main.Version, "v")
+	}
+}
+
+// VersionStatus is what the server last said about the agent's version.
+type VersionStatus struct {
+	Version string `json:"version"`
+
+	// MinVersion and LatestVersion are the oldest version the server
+	// supports and the latest released, when it told.
+	MinVersion    string `json:"min_version,omitempty"`
+	LatestVersion string `json:"latest_version,omitempty"`
+
+	// Deprecated is set when the agent is older than MinVersion.
+	Deprecated bool `json:"deprecated"`
+
+	// UpdateAvailable is set when the agent is older than LatestVersion.
+	UpdateAvailable bool `json:"update_available"`
+
+	Message string `json:"message,omitempty"`
+
+	// CheckedAt is when the server last answered; nil before that.
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+}
+
+// VersionStatus returns the version of the agent and what the server last
+// said about it.
+func (a *Agent) VersionStatus() VersionStatus {
+	if st := a.versionStatus.Load(); st != nil {
+		return *st
+	}
+	return VersionStatus{Version: Version}
+}
+
+// checkVersion reports the version and health of the agent to the server,
+// and records the versions it supports. A deprecated version is logged as
+// a warning at every check. Servers without heartbeats are not asked
+// again.
+func (a *Agent) checkVersion(ctx context.Context) {
+	if a.sender == nil || a.heartbeatUnsupported.Load() {
+		return
+	}
+
+	h := a.Ready()
+	req := sender.HeartbeatRequest{
+		AgentVersion: Version,
+		Status:       h.Status,
+		Problems:     h.Problems,
+	}
+	if start := a.liveSince.Load(); start != 0 {
+		req.UptimeSeconds = time.Since(time.Unix(0, start)).Seconds()
+	}
+
+	resp, err := a.sender.Heartbeat(ctx, req)
+	if errors.Is(err, sender.ErrHeartbeatUnsupported) {
+		a.heartbeatUnsupported.Store(true)
+		a.logger.Debug("server does not support version reporting")
+		return
+	}
+	if err != nil {
+		a.errors.Warn("heartbeat", "reporting version failed", "error", err)
+		return
+	}
+
+	now := time.Now()
+	st := VersionStatus{
+		Version:       Version,
+		MinVersion:    resp.MinAgentVersion,
+		LatestVersion: resp.LatestAgentVersion,
+		Message:       resp.Message,
+		CheckedAt:     &now,
+	}
+	st.Deprecated = olderVersion(Version, resp.MinAgentVersion)
+	st.UpdateAvailable = olderVersion(Version, resp.LatestAgentVersion)
+	prev := a.versionStatus.Swap(&st)
+
+	switch {
+	case st.Deprecated:
+		a.logger.Warn("agent version is deprecated, upgrade the agent",
+			"version", Version, "min_version", st.MinVersion, "latest_version", st.LatestVersion, "message", st.Message)
+	case st.UpdateAvailable && (prev == nil || prev.LatestVersion != st.LatestVersion):
+		a.logger.Info("a newer agent version is available", "version", Version, "latest_version", st.LatestVersion)
+	}
+}
+
+// olderVersion reports whether version v is older than min. Versions are
+// compared by their dot-separated numbers, a pre-release ("1.2.0-rc.1")
+// being older than its release. Versions that are not numbered, such as
+// development builds, are never older.
+func olderVersion(v, min string) bool {
+	a, ok := parseVersion(v)
+	if !ok {
+		return false
+	}
+	b, ok := parseVersion(min)
+	if !ok {
+		return false
+	}
+	for i := 0; i < len(a.numbers) || i < len(b.numbers); i++ {
+		var x, y int
+		if i < len(a.numbers) {
+			x = a.numbers[i]
+		}
+		if i < len(b.numbers) {
+			y = b.numbers[i]
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return a.prerelease != "" && (b.prerelease == "" || a.prerelease < b.prerelease)
+}
+
+// version is a parsed version number.
+type version struct {
+	numbers    []int
+	prerelease string
+}
+
+// parseVersion parses versions such as "1.2.3", "v1.2" or "1.2.0-rc.1",
+// ignoring build metadata ("+...").
+func parseVersion(s string) (version, bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	s, _, _ = strings.Cut(s, "+")
+	s, pre, _ := strings.Cut(s, "-")
+	if s == "" {
+		return version{}, false
+	}
+	var v version
+	for _, part := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return version{}, false
+		}
+		v.numbers = append(v.numbers, n)
+	}
+	v.prerelease = pre
+	return v, true
+}
@@ -0,0 +1,108 @@
+// SPDX-License-Identifier: MIT
+
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/sender"
+	"github.com/kolapsis/shm-agent/agent/sender/shmtest"
+)
+
+func TestOlderVersion(t *testing.T) {
+	tests := []struct {
+		v, min string
+		want   bool
+	}{
+		{"1.2.3", "1.3.0", true},
+		{"1.2.3", "1.2.3", false},
+		{"1.10.0", "1.9.9", false},
+		{"v1.2", "1.2.1", true},
+		{"1.2", "1.2.0", false},
+		{"1.3.0-rc.1", "1.3.0", true},
+		{"1.3.0", "1.3.0-rc.1", false},
+		{"1.3.0-rc.1", "1.3.0-rc.2", true},
+		{"1.2.3+build.7", "1.2.3", false},
+		{"dev", "1.0.0", false},
+		{"1.0.0", "", false},
+		{"1.0.0", "latest", false},
+	}
+	for _, tt := range tests {
+		if got := olderVersion(tt.v, tt.min); got != tt.want {
+			t.Errorf("olderVersion(%q, %q) = %v, want %v", tt.v, tt.min, got, tt.want)
+		}
+	}
+}
+
+func TestAgent_CheckVersion(t *testing.T) {
+	defer func(v string) { Version = v }(Version)
+	Version = "1.1.0"
+
+	srv := shmtest.NewServer()
+	defer srv.Close()
+	srv.SetVersions(sender.HeartbeatResponse{MinAgentVersion: "1.2.0", LatestAgentVersion: "1.4.1"})
+
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(logPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		ServerURL:            srv.URL,
+		IdentityFile:         filepath.Join(dir, "identity.json"),
+		PositionsFile:        "none",
+		AppName:              "test-app",
+		AppVersion:           "1.0.0",
+		Interval:             time.Hour,
+		VersionCheckInterval: time.Hour,
+		Sources: []config.Source{
+			{Path: logPath, Format: "json", Metrics: []config.Metric{{Name: "requests", Type: "counter"}}},
+		},
+	}
+
+	ag, err := New(Options{Config: cfg})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if st := ag.VersionStatus(); st.Version != "1.1.0" || st.CheckedAt != nil {
+		t.Errorf("VersionStatus() before Start = %+v", st)
+	}
+	if err := ag.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer ag.Stop(0)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ag.VersionStatus().CheckedAt == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	st := ag.VersionStatus()
+	if !st.Deprecated || !st.UpdateAvailable || st.MinVersion != "1.2.0" || st.LatestVersion != "1.4.1" {
+		t.Errorf("VersionStatus() = %+v, want deprecated with an update available", st)
+	}
+	if h := ag.Live(); h.Version != "1.1.0" || !h.VersionDeprecated {
+		t.Errorf("Live() version = %q, deprecated = %v", h.Version, h.VersionDeprecated)
+	}
+	hb := srv.Heartbeats()
+	if len(hb) != 1 || hb[0].AgentVersion != "1.1.0" || hb[0].Status == "" {
+		t.Errorf("heartbeats = %+v, want one from 1.1.0", hb)
+	}
+	if v := srv.Violations(); len(v) > 0 {
+		t.Errorf("violations = %q", v)
+	}
+
+	// Servers without heartbeats are not asked again
+	srv.SetStatus(shmtest.PathHeartbeat, 404)
+	ag.checkVersion(context.Background())
+	srv.SetStatus(shmtest.PathHeartbeat, 0)
+	ag.checkVersion(context.Background())
+	if n := len(srv.Heartbeats()); n != 1 {
+		t.Errorf("heartbeats = %d after the server answered 404, want 1", n)
+	}
+}
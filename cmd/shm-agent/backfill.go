@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent"
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+// BackfillCmd replays historical log files by event time.
+type BackfillCmd struct {
+	Files  []string  `arg:"" help:"Log files to replay, oldest first, possibly gzip or zstd compressed" type:"existingfile"`
+	Source string    `name:"source" help:"Path or location of the source reading the files (default: the first source with a timestamp)"`
+	Since  time.Time `name:"since" help:"Skip lines logged before this time (RFC 3339)"`
+	Until  time.Time `name:"until" help:"Skip lines logged at or after this time (RFC 3339)"`
+}
+
+// Run sends the metrics of every interval of the files with its own
+// timestamps, or prints them with --dry-run.
+func (b *BackfillCmd) Run(cli *CLI) error {
+	cfg, err := cli.loadConfig()
+	if err != nil {
+		return err
+	}
+	source, err := backfillSource(cfg, b.Source)
+	if err != nil {
+		return err
+	}
+
+	verbosity := cli.verbosity(cfg)
+	dryRun := cli.DryRun || cfg.SelectedProfile().DryRun
+	logger := createLogger(verbosity)
+	logWarnings(logger, cfg)
+
+	ag, err := agent.NewBuilder(cfg,
+		agent.WithLogger(logger),
+		agent.WithDryRun(dryRun),
+		agent.WithVerbosity(verbosity),
+	).Build()
+	if err != nil {
+		return fmt.Errorf("creating agent: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer stop()
+
+	// With JSON output, only the intervals are written to standard output
+	var out io.Writer = os.Stdout
+	if cli.Output == outputJSON {
+		out = os.Stderr
+	}
+	fmt.Fprintf(out, "Backfilling source: %s\n", cfg.Sources[source].Location())
+	opts := agent.BackfillOptions{
+		Since: b.Since,
+		Until: b.Until,
+		OnInterval: func(start, end time.Time, metrics map[string]interface{}) {
+			if !dryRun {
+				fmt.Fprintf(out, "Sending interval %s - %s\n", start.Format(time.RFC3339), end.Format(time.RFC3339))
+				return
+			}
+			if cli.Output == outputJSON {
+				if err := writeJSON(os.Stdout, intervalReport{Start: start, End: end, Metrics: metrics}); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+				return
+			}
+			fmt.Fprintln(out)
+			fmt.Fprintf(out, " Interval %s - %s\n", start.Format(time.RFC3339), end.Format(time.RFC3339))
+			printMetricsTable(out, cfg, metrics, cli.Top)
+		},
+	}
+	res, err := ag.Backfill(ctx, source, b.Files, opts)
+
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "Lines read:       %d\n", res.Lines)
+	if res.Outside > 0 {
+		fmt.Fprintf(out, "Lines skipped:    %d (outside --since/--until)\n", res.Outside)
+	}
+	if res.Late > 0 {
+		fmt.Fprintf(out, "Lines late:       %d (dropped, files out of order?)\n", res.Late)
+	}
+	if res.TimestampErrors > 0 {
+		fmt.Fprintf(out, "Timestamp errors: %d (dropped)\n", res.TimestampErrors)
+	}
+	if res.Intervals > 0 {
+		fmt.Fprintf(out, "Intervals:        %d (%s to %s)\n", res.Intervals,
+			res.First.Format(time.RFC3339), res.Last.Add(cfg.Interval).Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(out, "Intervals:        0\n")
+	}
+	if err != nil {
+		return fmt.Errorf("backfill: %w", err)
+	}
+	return nil
+}
+
+// backfillSource returns the index of the source with the given path or
+// location, or of the first source with a timestamp when location is empty.
+func backfillSource(cfg *config.Config, location string) (int, error) {
+	if location != "" {
+		i, err := findSource(cfg, location)
+		if err == nil && cfg.Sources[i].Timestamp == nil {
+			err = fmt.Errorf("source %s has no timestamp, backfill needs event times", location)
+		}
+		return i, err
+	}
+	for i, src := range cfg.Sources {
+		if src.Timestamp != nil {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no source has a timestamp, backfill needs event times")
+}
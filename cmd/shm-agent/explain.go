@@ -0,0 +1,184 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent"
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/matcher"
+)
+
+// ExplainCmd shows how a single line is processed.
+type ExplainCmd struct {
+	Line   string `arg:"" optional:"" help:"Log line to explain (default: the first line of standard input)"`
+	Source string `name:"source" help:"Path or location of the source parsing the line (default: the first source)"`
+}
+
+// Run prints the fields of the line, then for every metric whether its
+// conditions match and what it would extract.
+func (e *ExplainCmd) Run(cli *CLI) error {
+	cfg, err := config.LoadWithOptions(cli.Config, cli.loadOptions())
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	source, err := findSource(cfg, e.Source)
+	if err != nil {
+		return err
+	}
+
+	line := e.Line
+	if line == "" || line == "-" {
+		if line, err = readLine(os.Stdin); err != nil {
+			return err
+		}
+	}
+
+	ex, err := agent.Explain(cfg, source, line)
+	if err != nil {
+		return err
+	}
+	if cli.Output == outputJSON {
+		return writeJSON(os.Stdout, ex)
+	}
+	printExplanation(os.Stdout, &cfg.Sources[source], ex)
+	return nil
+}
+
+// findSource returns the index of the source with the given path or
+// location, or the first source when location is empty.
+func findSource(cfg *config.Config, location string) (int, error) {
+	if location == "" {
+		if len(cfg.Sources) == 0 {
+			return 0, fmt.Errorf("no source configured")
+		}
+		return 0, nil
+	}
+	for i, src := range cfg.Sources {
+		if src.Location() == location || src.Path == location {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no source %s", location)
+}
+
+// readLine reads the first line of r, without its line ending.
+func readLine(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		if err == io.EOF {
+			return "", fmt.Errorf("no line to explain on standard input")
+		}
+		return "", fmt.Errorf("reading standard input: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// printExplanation prints how src processes a line.
+func printExplanation(w io.Writer, src *config.Source, ex *agent.Explanation) {
+	fmt.Fprintf(w, " Source: %s\n", ex.Source)
+	fmt.Fprintf(w, " Line:   %s\n", ex.Line)
+	fmt.Fprintln(w)
+
+	if ex.Prefiltered {
+		fmt.Fprintln(w, " The prefilter skips the line before parsing: no field, no metric.")
+		return
+	}
+	if !ex.Parsed {
+		fmt.Fprintf(w, " The line does not parse as %s: no field, no metric.\n", src.Format)
+		return
+	}
+
+	names := make([]string, 0, len(ex.Fields))
+	width := 0
+	for name := range ex.Fields {
+		names = append(names, name)
+		width = max(width, len(name))
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, " Fields:")
+	for _, name := range names {
+		fmt.Fprintf(w, "   %-*s  %s\n", width, name, formatField(ex.Fields[name]))
+	}
+	fmt.Fprintln(w)
+
+	if ex.Filter != nil {
+		if ex.Kept {
+			fmt.Fprintln(w, " Filter: kept")
+		} else {
+			fmt.Fprintln(w, " Filter: dropped, no metric records the line")
+		}
+		printSteps(w, ex.Filter)
+		fmt.Fprintln(w)
+	}
+	if ex.EventTime != nil {
+		fmt.Fprintf(w, " Event time: %s\n\n", ex.EventTime.Format(time.RFC3339Nano))
+	} else if ex.TimestampError {
+		fmt.Fprintf(w, " Event time: field %q is missing or invalid, the line would be counted at the current time\n\n", src.Timestamp.Field)
+	}
+
+	fmt.Fprintln(w, " Metrics:")
+	for _, m := range ex.Metrics {
+		status := "no match"
+		if m.Matched {
+			status = "match"
+		}
+		fmt.Fprintf(w, "   %-27s %-10s %s\n", m.Name, m.Type, status)
+		if len(m.Conditions) > 1 || m.Conditions[0].Condition != "always" {
+			printSteps(w, m.Conditions)
+		}
+		switch {
+		case m.ExtractError != "":
+			fmt.Fprintf(w, "       value:  none, %s\n", m.ExtractError)
+		case m.Value != nil:
+			fmt.Fprintf(w, "       value:  %s\n", formatField(m.Value))
+		}
+		if len(m.Labels) > 0 {
+			labels := make([]string, 0, len(m.Labels))
+			for name, value := range m.Labels {
+				labels = append(labels, name+"="+value)
+			}
+			sort.Strings(labels)
+			fmt.Fprintf(w, "       labels: %s\n", strings.Join(labels, " "))
+		}
+	}
+}
+
+// printSteps prints the outcome of every condition of a match, indented
+// by nesting, with the value of the field each compares.
+func printSteps(w io.Writer, steps []matcher.Step) {
+	for _, s := range steps {
+		mark := "no "
+		if s.Matched {
+			mark = "yes"
+		}
+		value := ""
+		switch {
+		case s.Present:
+			value = fmt.Sprintf("  (%q)", s.Value)
+		case s.Field != "":
+			value = "  (missing)"
+		}
+		fmt.Fprintf(w, "       %s %s%s%s\n", mark, strings.Repeat("  ", s.Depth), s.Condition, value)
+	}
+}
+
+// formatField formats a field value: strings quoted, other values as JSON.
+func formatField(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
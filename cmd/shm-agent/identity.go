@@ -0,0 +1,43 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent"
+)
+
+// rotateTimeout bounds a key rotation.
+const rotateTimeout = time.Minute
+
+// IdentityCmd manages the identity of the instance.
+type IdentityCmd struct {
+	Rotate IdentityRotateCmd `cmd:"" help:"Replace the key pair of the identity, keeping the instance ID"`
+}
+
+// IdentityRotateCmd rotates the key of the identity.
+type IdentityRotateCmd struct{}
+
+// Run rotates the key with the server of the configuration and saves it
+// in the identity file.
+func (c *IdentityRotateCmd) Run(cli *CLI) error {
+	cfg, err := cli.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rotateTimeout)
+	defer cancel()
+
+	ident, err := agent.RotateIdentity(ctx, cfg, createLogger(cli.verbosity(cfg)))
+	if err != nil {
+		return fmt.Errorf("rotating identity: %w", err)
+	}
+	fmt.Printf(" instance    %s\n", ident.InstanceID)
+	fmt.Printf(" public key  %s\n\n", ident.PubKeyHex)
+	fmt.Printf(" Key rotated and saved to %s\n", cfg.IdentityFile)
+	return nil
+}
@@ -0,0 +1,257 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"text/template"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+// serviceName is the name of the systemd unit written by install.
+const serviceName = "shm-agent"
+
+// InstallCmd installs the agent as a systemd service.
+type InstallCmd struct {
+	User     string `name:"user" help:"System user the service runs as (created if missing)" default:"shm-agent"`
+	StateDir string `name:"state-dir" help:"Working directory holding the identity, positions and spool files" default:"/var/lib/shm-agent"`
+	UnitDir  string `name:"unit-dir" help:"Directory where the systemd unit is written" default:"/etc/systemd/system"`
+	Binary   string `name:"binary" help:"Agent binary used in the unit (default: this executable)"`
+	NoStart  bool   `name:"no-start" help:"Write the unit without enabling and starting the service"`
+	Print    bool   `name:"print" help:"Print the unit file and exit without changing the system"`
+}
+
+// unitTemplate is the systemd unit. Logs are only read, so the whole file
+// system stays read-only except for the directories holding agent state.
+var unitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=SHM Agent - Log Metrics Collector
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+WatchdogSec=120
+ExecStart={{.Binary}} --config {{.Config}}{{if .ConfigDir}} --config-dir {{.ConfigDir}}{{end}}{{if .Profile}} --profile {{.Profile}}{{end}}
+ExecReload=/bin/kill -HUP $MAINPID
+WorkingDirectory={{.StateDir}}
+Restart=always
+RestartSec=5
+User={{.User}}
+
+# Security hardening
+NoNewPrivileges=true
+ProtectSystem=strict
+ProtectHome=true
+PrivateTmp=true
+ReadOnlyPaths=/
+{{- range .WritePaths}}
+ReadWritePaths={{.}}
+{{- end}}
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// unitParams holds the values rendered into the unit.
+type unitParams struct {
+	Binary     string
+	Config     string
+	ConfigDir  string
+	Profile    string
+	StateDir   string
+	User       string
+	WritePaths []string
+}
+
+// Run executes the install command.
+func (c *InstallCmd) Run(cli *CLI) error {
+	cfg, err := config.LoadWithOptions(cli.Config, cli.loadOptions())
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+
+	params, err := c.params(cli.Config, cli.ConfigDir, cfg)
+	if err != nil {
+		return err
+	}
+
+	var unit bytes.Buffer
+	if err := unitTemplate.Execute(&unit, params); err != nil {
+		return fmt.Errorf("rendering unit: %w", err)
+	}
+
+	if c.Print {
+		_, err := os.Stdout.Write(unit.Bytes())
+		return err
+	}
+
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("install requires systemd and is only supported on Linux")
+	}
+
+	u, err := ensureUser(c.User)
+	if err != nil {
+		return err
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	// Only directories created here or the state directory itself change
+	// owner: an existing shared directory such as /tmp is left alone.
+	for _, dir := range params.WritePaths {
+		_, statErr := os.Stat(dir)
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return fmt.Errorf("creating %s: %w", dir, err)
+		}
+		if os.IsNotExist(statErr) || dir == params.StateDir {
+			if err := os.Chown(dir, uid, gid); err != nil {
+				return fmt.Errorf("changing owner of %s: %w", dir, err)
+			}
+		}
+		fmt.Printf("State directory: %s\n", dir)
+	}
+
+	unitPath := filepath.Join(c.UnitDir, serviceName+".service")
+	if err := os.WriteFile(unitPath, unit.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("writing unit: %w", err)
+	}
+	fmt.Printf("Unit file: %s\n", unitPath)
+
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	if c.NoStart {
+		fmt.Printf("Start the service with: systemctl enable --now %s\n", serviceName)
+		return nil
+	}
+	if err := systemctl("enable", "--now", serviceName); err != nil {
+		return err
+	}
+	fmt.Printf("Service %s enabled and started\n", serviceName)
+
+	return nil
+}
+
+// params resolves the paths rendered into the unit. Relative state files in
+// the configuration resolve against the working directory of the service.
+func (c *InstallCmd) params(configPath, configDir string, cfg *config.Config) (unitParams, error) {
+	binary, err := binaryPath(c.Binary)
+	if err != nil {
+		return unitParams{}, err
+	}
+
+	configPath, err = filepath.Abs(configPath)
+	if err != nil {
+		return unitParams{}, fmt.Errorf("resolving config path: %w", err)
+	}
+
+	if configDir != "" {
+		configDir, err = filepath.Abs(configDir)
+		if err != nil {
+			return unitParams{}, fmt.Errorf("resolving config directory: %w", err)
+		}
+	}
+
+	stateDir, err := filepath.Abs(c.StateDir)
+	if err != nil {
+		return unitParams{}, fmt.Errorf("resolving state directory: %w", err)
+	}
+
+	return unitParams{
+		Binary:     binary,
+		Config:     configPath,
+		ConfigDir:  configDir,
+		Profile:    cfg.Profile,
+		StateDir:   stateDir,
+		User:       c.User,
+		WritePaths: stateDirs(stateDir, cfg),
+	}, nil
+}
+
+// binaryPath returns the absolute path of the agent binary run by a
+// service, this executable unless set.
+func binaryPath(binary string) (string, error) {
+	if binary == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return "", fmt.Errorf("locating executable: %w", err)
+		}
+		binary = exe
+	}
+	path, err := filepath.Abs(binary)
+	if err != nil {
+		return "", fmt.Errorf("resolving binary path: %w", err)
+	}
+	return path, nil
+}
+
+// stateDirs returns, sorted, the state directory and the directories the
+// agent writes to, relative ones resolving against the state directory.
+func stateDirs(stateDir string, cfg *config.Config) []string {
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return filepath.Clean(path)
+		}
+		return filepath.Join(stateDir, path)
+	}
+
+	dirs := map[string]bool{stateDir: true}
+	for _, dir := range cfg.WritableDirs() {
+		dirs[resolve(dir)] = true
+	}
+
+	paths := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		paths = append(paths, dir)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// ensureUser looks up the service user, creating a system account without
+// a login shell or home directory when it does not exist.
+func ensureUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err == nil {
+		return u, nil
+	}
+	var unknown user.UnknownUserError
+	if !errors.As(err, &unknown) {
+		return nil, fmt.Errorf("looking up user %s: %w", name, err)
+	}
+
+	cmd := exec.Command("useradd", "--system", "--user-group", "--no-create-home",
+		"--shell", "/usr/sbin/nologin", name)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("creating user %s: %w: %s", name, err, bytes.TrimSpace(out))
+	}
+	fmt.Printf("Created system user: %s\n", name)
+
+	u, err = user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("looking up user %s: %w", name, err)
+	}
+	return u, nil
+}
+
+// systemctl runs a systemctl command, passing its output through.
+func systemctl(args ...string) error {
+	cmd := exec.Command("systemctl", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("systemctl %s: %w", args[0], err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBinaryPath(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs := filepath.Join(t.TempDir(), "shm-agent")
+
+	tests := []struct {
+		name   string
+		binary string
+		want   string
+	}{
+		{"this executable", "", exe},
+		{"absolute", abs, abs},
+		{"relative", filepath.Join("bin", "shm-agent"), filepath.Join(wd, "bin", "shm-agent")},
+		{"unclean", abs + string(filepath.Separator) + ".", abs},
+	}
+	for _, tt := range tests {
+		got, err := binaryPath(tt.binary)
+		if err != nil {
+			t.Fatalf("%s: binaryPath() error = %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: binaryPath(%q) = %q, want %q", tt.name, tt.binary, got, tt.want)
+		}
+	}
+}
+
+func TestStateDirs(t *testing.T) {
+	dir := t.TempDir()
+	stateDir := filepath.Join(dir, "state")
+	other := filepath.Join(dir, "other")
+
+	tests := []struct {
+		name  string
+		extra string
+		want  []string
+	}{
+		{"defaults", "", []string{stateDir}},
+		{"relative", "spool:\n  dir: spool\npositions_file: cache/positions.json\n", []string{
+			stateDir, filepath.Join(stateDir, "cache"), filepath.Join(stateDir, "spool"),
+		}},
+		{"absolute", "identity_file: " + filepath.Join(other, "identity.json") + "\n", []string{other, stateDir}},
+		{"disabled", "positions_file: none\nunique_file: none\nsequence_file: none\n", []string{stateDir}},
+	}
+	for _, tt := range tests {
+		cfg := parseInstallConfig(t, tt.extra)
+		if got := stateDirs(stateDir, cfg); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: stateDirs() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUnitTemplate(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "shm-agent")
+	configPath := filepath.Join(dir, "config.yaml")
+	stateDir := filepath.Join(dir, "state")
+
+	tests := []struct {
+		name      string
+		configDir string
+		profile   string
+		extra     string
+		want      []string
+		notWant   []string
+	}{
+		{
+			name: "defaults",
+			want: []string{
+				"ExecStart=" + binary + " --config " + configPath + "\n",
+				"WorkingDirectory=" + stateDir + "\n",
+				"User=shm-agent\n",
+				"ReadOnlyPaths=/\nReadWritePaths=" + stateDir + "\n\n[Install]",
+			},
+			notWant: []string{"--config-dir", "--profile"},
+		},
+		{
+			name:      "config directory, profile and spool",
+			configDir: filepath.Join(dir, "conf.d"),
+			profile:   "prod",
+			extra:     "spool:\n  dir: spool\n",
+			want: []string{
+				"ExecStart=" + binary + " --config " + configPath + " --config-dir " + filepath.Join(dir, "conf.d") + " --profile prod\n",
+				"ReadWritePaths=" + stateDir + "\nReadWritePaths=" + filepath.Join(stateDir, "spool") + "\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseInstallConfig(t, tt.extra)
+			cfg.Profile = tt.profile
+			cmd := InstallCmd{User: "shm-agent", StateDir: stateDir, Binary: binary}
+			params, err := cmd.params(configPath, tt.configDir, cfg)
+			if err != nil {
+				t.Fatalf("params() error = %v", err)
+			}
+
+			var buf bytes.Buffer
+			if err := unitTemplate.Execute(&buf, params); err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			unit := buf.String()
+			for _, want := range append([]string{"[Service]\nType=notify\n"}, tt.want...) {
+				if !strings.Contains(unit, want) {
+					t.Errorf("unit does not contain %q:\n%s", want, unit)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(unit, s) {
+					t.Errorf("unit contains %q:\n%s", s, unit)
+				}
+			}
+		})
+	}
+}
@@ -9,32 +9,55 @@ import (
 	"io"
 	"log/slog"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/kolapsis/shm-agent/agent"
 	"github.com/kolapsis/shm-agent/agent/config"
-	"github.com/kolapsis/shm-agent/agent/tailer"
 )
 
 // CLI represents the command-line interface.
 type CLI struct {
-	Config   string        `short:"c" name:"config" help:"Path to configuration file" type:"existingfile" required:""`
-	DryRun   bool          `name:"dry-run" help:"Print metrics without sending to server"`
-	Interval time.Duration `name:"interval" help:"Override snapshot interval"`
-	Verbose  int           `short:"v" name:"verbose" type:"counter" help:"Increase verbosity (-v, -vv, -vvv)"`
-
-	Run  RunCmd  `cmd:"" default:"withargs" help:"Run the agent (default command)"`
-	Test TestCmd `cmd:"" help:"Test configuration with a log file"`
+	Config    string        `short:"c" name:"config" help:"Path to configuration file" type:"existingfile" required:""`
+	ConfigDir string        `name:"config-dir" help:"Directory of additional configuration files (*.yaml) adding sources" type:"existingdir"`
+	Profile   string        `name:"profile" help:"Apply a profile of the configuration, e.g. dev, staging or prod"`
+	DryRun    bool          `name:"dry-run" help:"Print metrics without sending to server"`
+	Diff      bool          `name:"diff" help:"In dry-run, show changes and rates since the previous snapshot"`
+	Interval  time.Duration `name:"interval" help:"Override snapshot interval"`
+	Shutdown  time.Duration `name:"shutdown-timeout" help:"Maximum time to wait for a graceful shutdown" default:"5s"`
+	Drain     time.Duration `name:"drain-timeout" help:"Maximum time to read already written lines on shutdown" default:"2s"`
+	Verbose   int           `short:"v" name:"verbose" type:"counter" help:"Increase verbosity (-v, -vv, -vvv)"`
+	Trace     bool          `name:"trace-http" help:"Log a summary of every request to the SHM server"`
+	Stdin     bool          `name:"stdin" help:"Read log lines from stdin instead of the paths of file sources"`
+	SelfCheck bool          `name:"selfcheck" help:"Check that every metric records a generated line, then exit"`
+	Top       int           `name:"top" help:"Series shown per labeled metric in dry-run and test tables (0 for all)" default:"10"`
+	Output    string        `name:"output" short:"o" help:"Format of test results, explanations and dry-run snapshots: table or json" enum:"table,json" default:"table"`
+
+	Version kong.VersionFlag `name:"version" help:"Print the agent version and exit"`
+
+	Run      RunCmd      `cmd:"" default:"withargs" help:"Run the agent (default command)"`
+	Test     TestCmd     `cmd:"" help:"Test configuration with a log file"`
+	Backfill BackfillCmd `cmd:"" help:"Send the metrics of historical log files by event time"`
+	Explain  ExplainCmd  `cmd:"" help:"Show how a single log line is parsed and matched"`
+	Install  InstallCmd  `cmd:"" help:"Install the agent as a systemd service"`
+	Service  ServiceCmd  `cmd:"" help:"Install and control the agent as a Windows service"`
+	Selftest SelftestCmd `cmd:"" help:"Check registration and snapshot delivery against the server"`
+	Identity IdentityCmd `cmd:"" help:"Manage the identity of the instance"`
 }
 
 // RunCmd runs the agent.
-type RunCmd struct{}
+type RunCmd struct {
+	WatchConfig bool   `name:"watch-config" help:"Reload the configuration when the file changes"`
+	WorkingDir  string `name:"working-dir" help:"Directory the agent runs in, where relative state files resolve" type:"existingdir"`
+}
 
 // TestCmd tests configuration with a file.
 type TestCmd struct {
-	File  string `arg:"" help:"Log file to process" type:"existingfile"`
-	Lines int    `short:"n" name:"lines" help:"Limit number of lines to process" default:"0"`
+	File       string `arg:"" help:"Log file to process, possibly gzip or zstd compressed" type:"existingfile"`
+	Lines      int    `short:"n" name:"lines" help:"Limit number of lines to process" default:"0"`
+	ShowErrors int    `name:"show-errors" help:"Print the first N lines that failed to parse and the first N that matched no metric" default:"0"`
 }
 
 func main() {
@@ -43,17 +66,57 @@ func main() {
 		kong.Name("shm-agent"),
 		kong.Description("Self-Hosted Metrics agent for log parsing and metric aggregation"),
 		kong.UsageOnError(),
+		kong.Vars{"version": agent.Version},
 	)
 
 	err := ctx.Run(&cli)
 	ctx.FatalIfErrorf(err)
 }
 
-// Run executes the run command.
-func (r *RunCmd) Run(cli *CLI) error {
-	cfg, err := config.Load(cli.Config)
+// loadOptions returns what is loaded besides the configuration file.
+func (cli *CLI) loadOptions() config.LoadOptions {
+	return config.LoadOptions{Dir: cli.ConfigDir, Profile: cli.Profile}
+}
+
+// verbosity returns the verbosity set with -v, or else by the profile.
+func (cli *CLI) verbosity(cfg *config.Config) int {
+	if cli.Verbose > 0 {
+		return cli.Verbose
+	}
+	return cfg.SelectedProfile().Verbose
+}
+
+// absPaths makes the configuration paths absolute, so that they survive a
+// change of working directory.
+func (cli *CLI) absPaths() error {
+	path, err := filepath.Abs(cli.Config)
 	if err != nil {
-		return fmt.Errorf("loading config: %w", err)
+		return fmt.Errorf("resolving config path: %w", err)
+	}
+	cli.Config = path
+	if cli.ConfigDir != "" {
+		dir, err := filepath.Abs(cli.ConfigDir)
+		if err != nil {
+			return fmt.Errorf("resolving config directory: %w", err)
+		}
+		cli.ConfigDir = dir
+	}
+	return nil
+}
+
+// loadConfig loads the configuration file and applies CLI overrides.
+func (cli *CLI) loadConfig() (*config.Config, error) {
+	return cli.loadRemoteConfig(nil)
+}
+
+// loadRemoteConfig is like loadConfig, with the document served by the
+// server instead of the one cached, see config.LoadOptions.Remote.
+func (cli *CLI) loadRemoteConfig(remote []byte) (*config.Config, error) {
+	opts := cli.loadOptions()
+	opts.Remote = remote
+	cfg, err := config.LoadWithOptions(cli.Config, opts)
+	if err != nil {
+		return nil, fmt.Errorf("loading config: %w", err)
 	}
 
 	// Override interval if specified
@@ -61,74 +124,235 @@ func (r *RunCmd) Run(cli *CLI) error {
 		cfg.Interval = cli.Interval
 	}
 
-	logger := createLogger(cli.Verbose)
+	if cli.Trace {
+		cfg.HTTP.Trace = true
+	}
+
+	if cli.Stdin {
+		for i := range cfg.Sources {
+			src := &cfg.Sources[i]
+			if src.Type == "" || src.Type == config.SourceFile {
+				src.Path = config.StdinPath
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// Run executes the run command, as a Windows service when started by the
+// service manager.
+func (r *RunCmd) Run(cli *CLI) error {
+	if r.WorkingDir != "" {
+		if err := cli.absPaths(); err != nil {
+			return err
+		}
+		if err := os.Chdir(r.WorkingDir); err != nil {
+			return fmt.Errorf("changing to working directory: %w", err)
+		}
+	}
+
+	if isService() {
+		return runService(func(ctx context.Context) error {
+			return r.run(ctx, cli)
+		})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer stop()
+	return r.run(ctx, cli)
+}
+
+// run runs the agent until ctx is cancelled.
+func (r *RunCmd) run(ctx context.Context, cli *CLI) error {
+	cfg, err := cli.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if cli.SelfCheck {
+		return runSelfCheck(os.Stdout, cfg)
+	}
+
+	verbosity := cli.verbosity(cfg)
+	dryRun := cli.DryRun || cfg.SelectedProfile().DryRun
+
+	logger := createLogger(verbosity)
+	logWarnings(logger, cfg)
+	if cfg.Profile != "" {
+		logger.Info("applied profile", "profile", cfg.Profile)
+	}
+
+	console := newConsoleOutput(os.Stdout, cli.Output, cli.Diff, cli.Top)
+
+	builder := agent.NewBuilder(cfg,
+		agent.WithLogger(logger),
+		agent.WithDryRun(dryRun),
+		agent.WithVerbosity(verbosity),
+		agent.WithShutdownTimeout(cli.Shutdown),
+		agent.WithDrainTimeout(cli.Drain),
+		agent.WithSystemdNotify(true),
+		agent.WithConfigLoader(func(remote []byte) (*config.Config, error) {
+			cfg, err := cli.loadRemoteConfig(remote)
+			if err == nil {
+				logWarnings(logger, cfg)
+			}
+			return cfg, err
+		}),
+	)
+	if dryRun {
+		builder.With(agent.WithOutput(console))
+	}
 
-	ag, err := agent.New(agent.Options{
-		Config:    cfg,
-		Logger:    logger,
-		DryRun:    cli.DryRun,
-		Verbosity: cli.Verbose,
-	})
+	ag, err := builder.Build()
 	if err != nil {
 		return fmt.Errorf("creating agent: %w", err)
 	}
+	console.attach(ag)
+
+	// SIGUSR1 dumps current metrics without resetting them
+	dumpChan := make(chan os.Signal, 1)
+	notifyDump(dumpChan)
+	defer signal.Stop(dumpChan)
+
+	// SIGHUP (or a config file change with --watch-config) reloads the config
+	reloadChan := make(chan os.Signal, 1)
+	notifyReload(reloadChan)
+	defer signal.Stop(reloadChan)
+
+	var configChanged <-chan struct{}
+	files := &fileSet{paths: cfg.Files}
+	if r.WatchConfig {
+		configChanged = watchFiles(ctx, files, configWatchInterval, logger)
+	}
+
+	reload := func() {
+		cfg, err := cli.loadConfig()
+		if err != nil {
+			logger.Error("config reload failed, keeping current config", "error", err)
+			return
+		}
+		logWarnings(logger, cfg)
+		if err := ag.Reload(cfg); err != nil {
+			logger.Error("config reload failed, keeping current config", "error", err)
+			return
+		}
+		files.set(cfg.Files)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-dumpChan:
+				logger.Info("received SIGUSR1, dumping metrics")
+				console.dump()
+			case <-reloadChan:
+				logger.Info("received SIGHUP, reloading config")
+				reload()
+			case <-configChanged:
+				logger.Info("config file changed, reloading config")
+				reload()
+			}
+		}
+	}()
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- ag.Run(ctx)
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		logger.Info("received shutdown signal")
+	}
 
-	ctx := context.Background()
-	return ag.Run(ctx)
+	// Give the agent a bounded amount of time to wind down after the
+	// signal; tailers use the same timeout internally.
+	select {
+	case err := <-errChan:
+		return err
+	case <-time.After(cli.Shutdown + time.Second):
+		return fmt.Errorf("agent did not stop within %s", cli.Shutdown)
+	}
 }
 
 // Run executes the test command.
 func (t *TestCmd) Run(cli *CLI) error {
-	cfg, err := config.Load(cli.Config)
+	cfg, err := config.LoadWithOptions(cli.Config, cli.loadOptions())
 	if err != nil {
 		return fmt.Errorf("loading config: %w", err)
 	}
 
-	logger := createLogger(cli.Verbose)
+	verbosity := cli.verbosity(cfg)
+	logger := createLogger(verbosity)
 
-	ag, err := agent.New(agent.Options{
-		Config:    cfg,
-		Logger:    logger,
-		DryRun:    true,
-		Verbosity: cli.Verbose,
-	})
+	ag, err := agent.NewBuilder(cfg,
+		agent.WithLogger(logger),
+		agent.WithDryRun(true),
+		agent.WithVerbosity(verbosity),
+		agent.WithErrorSamples(t.ShowErrors),
+	).Build()
 	if err != nil {
 		return fmt.Errorf("creating agent: %w", err)
 	}
 
-	fmt.Printf("Testing config: %s\n", cli.Config)
-	fmt.Printf("Processing file: %s\n", t.File)
-	if t.Lines > 0 {
-		fmt.Printf("Line limit: %d\n", t.Lines)
-	}
-	fmt.Println()
-
-	// Use the first source's processor
-	var linesProcessed int
-	var parseErrors int
-
-	processor := func(line string) {
-		ag.ProcessLine(0, line)
-		linesProcessed++
+	jsonOutput := cli.Output == outputJSON
+	if !jsonOutput {
+		fmt.Printf("Testing config: %s\n", cli.Config)
+		fmt.Printf("Processing file: %s\n", t.File)
+		if t.Lines > 0 {
+			fmt.Printf("Line limit: %d\n", t.Lines)
+		}
+		for _, w := range cfg.Warnings() {
+			fmt.Printf("Warning: %s\n", w)
+		}
+		fmt.Println()
 	}
 
-	count, err := tailer.ProcessFile(t.File, processor, t.Lines)
+	// Only the first source reads the file
+	count, err := ag.ProcessFileLimit(t.File, t.Lines)
 	if err != nil {
 		return fmt.Errorf("processing file: %w", err)
 	}
-
-	_ = parseErrors // TODO: track parse errors
+	stats := ag.Stats()
+	stats.Sources = stats.Sources[:min(len(stats.Sources), 1)]
+
+	if jsonOutput {
+		return writeJSON(os.Stdout, testReport{
+			Config:         cli.Config,
+			File:           t.File,
+			LinesProcessed: count,
+			Warnings:       cfg.Warnings(),
+			Metrics:        ag.Metrics(),
+			ShadowMetrics:  shadowNames(cfg),
+			Sources:        stats.Sources,
+		})
+	}
 
 	fmt.Printf("Lines processed: %d\n", count)
 	fmt.Println()
+	printSourceStats(os.Stdout, stats)
 
 	// Print results
-	metrics := ag.GetAggregator().Peek()
-	printMetrics(cfg, metrics, linesProcessed)
+	printMetrics(os.Stdout, cfg, ag.Metrics(), cli.Top)
+	printExtractFailures(os.Stdout, stats)
+	printUnmatched(os.Stdout, stats)
+	printErrorSamples(os.Stdout, stats)
 
 	return nil
 }
 
+// logWarnings logs likely mistakes found in the configuration.
+func logWarnings(logger *slog.Logger, cfg *config.Config) {
+	for _, w := range cfg.Warnings() {
+		logger.Warn("configuration warning", "warning", w)
+	}
+}
+
 // createLogger creates a logger based on verbosity level.
 func createLogger(verbosity int) *slog.Logger {
 	var level slog.Level
@@ -148,61 +372,13 @@ func createLogger(verbosity int) *slog.Logger {
 	}
 
 	// Use text handler for CLI
-	handler := slog.NewTextHandler(os.Stderr, opts)
+	handler := slog.NewTextHandler(logOutput, opts)
 	return slog.New(handler)
 }
 
-// printMetrics prints metrics in a formatted table.
-func printMetrics(cfg *config.Config, metrics map[string]interface{}, linesProcessed int) {
-	fmt.Println("───────────────────────────────────────────────────────────")
-	fmt.Println(" TEST RESULTS")
-	fmt.Println("───────────────────────────────────────────────────────────")
-
-	for _, src := range cfg.Sources {
-		fmt.Printf(" Source config: %s\n", src.Path)
-		fmt.Printf("   Format: %s\n", src.Format)
-		if src.Pattern != "" {
-			fmt.Printf("   Pattern: %s\n", src.Pattern)
-		}
-		fmt.Println()
-	}
-
-	fmt.Println(" Aggregated Metrics:")
-	fmt.Println(" ┌─────────────────────────────┬──────────┬────────────────┐")
-	fmt.Println(" │ Metric                      │ Type     │ Value          │")
-	fmt.Println(" ├─────────────────────────────┼──────────┼────────────────┤")
-
-	for _, src := range cfg.Sources {
-		for _, m := range src.Metrics {
-			val := metrics[m.Name]
-			valStr := formatValue(val)
-			fmt.Printf(" │ %-27s │ %-8s │ %14s │\n", m.Name, m.Type, valStr)
-		}
-	}
-
-	fmt.Println(" └─────────────────────────────┴──────────┴────────────────┘")
-	fmt.Println("───────────────────────────────────────────────────────────")
-}
-
-// formatValue formats a metric value for display.
-func formatValue(v interface{}) string {
-	if v == nil {
-		return "0"
-	}
-	switch val := v.(type) {
-	case float64:
-		if val == float64(int64(val)) {
-			return fmt.Sprintf("%d", int64(val))
-		}
-		return fmt.Sprintf("%.2f", val)
-	case int:
-		return fmt.Sprintf("%d", val)
-	case int64:
-		return fmt.Sprintf("%d", val)
-	default:
-		return fmt.Sprintf("%v", val)
-	}
-}
+// logOutput is where logs are written: standard error, or the event log
+// when running as a Windows service.
+var logOutput io.Writer = os.Stderr
 
 // discardLogger returns a logger that discards all output.
 func discardLogger() *slog.Logger {
@@ -0,0 +1,560 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kolapsis/shm-agent/agent"
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/config"
+	"github.com/kolapsis/shm-agent/agent/otlp"
+)
+
+// consoleOutput prints each snapshot as a table, or as a line of JSON
+// (dry-run mode).
+type consoleOutput struct {
+	w      io.Writer
+	agent  *agent.Agent
+	format string // outputTable or outputJSON
+	diff   bool   // show changes and rates since the previous snapshot
+	top    int    // series shown per labeled metric, 0 for all
+
+	mu       sync.Mutex
+	prev     map[string]float64
+	prevTime time.Time
+}
+
+// newConsoleOutput creates a console output writing to w.
+// The agent must be attached with attach before the first snapshot.
+func newConsoleOutput(w io.Writer, format string, diff bool, top int) *consoleOutput {
+	return &consoleOutput{w: w, format: format, diff: diff, top: top}
+}
+
+// attach sets the agent whose source statistics are printed.
+func (c *consoleOutput) attach(ag *agent.Agent) {
+	c.agent = ag
+}
+
+// Name implements agent.Output.
+func (c *consoleOutput) Name() string {
+	return "console"
+}
+
+// Send implements agent.Output.
+func (c *consoleOutput) Send(_ context.Context, metrics map[string]interface{}) error {
+	if c.format == outputJSON {
+		return c.printJSON(metrics, false)
+	}
+	c.print(metrics, true)
+	return nil
+}
+
+// dump prints the current metrics without resetting them, followed by the
+// recent snapshots (SIGUSR1). Dumps are compared against the last snapshot
+// but do not replace it.
+func (c *consoleOutput) dump() {
+	if c.format == outputJSON {
+		if err := c.printJSON(c.agent.Metrics(), true); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	}
+	c.print(c.agent.Metrics(), false)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	printHistory(c.w, c.agent.Config(), c.agent.History())
+}
+
+// print writes a snapshot table. When record is true, the values become
+// the baseline for the next diff.
+func (c *consoleOutput) print(metrics map[string]interface{}, record bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w := c.w
+	cfg := c.agent.Config()
+	elapsed := time.Since(c.agent.StartTime()).Round(time.Second)
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "───────────────────────────────────────────────────────────")
+	fmt.Fprintf(w, " SNAPSHOT @ %s (%s elapsed)\n", now, elapsed)
+	fmt.Fprintln(w, "───────────────────────────────────────────────────────────")
+
+	stats := c.agent.Stats()
+	printSourceStats(w, stats)
+	printExtractFailures(w, stats)
+	printUnmatched(w, stats)
+
+	if c.diff {
+		c.printDiffTable(metrics)
+	} else {
+		printMetricsTable(w, cfg, metrics, c.top)
+	}
+	printShadowMetrics(w, cfg)
+	fmt.Fprintln(w)
+
+	if record {
+		c.prev = make(map[string]float64, len(metrics))
+		for name, v := range metrics {
+			c.prev[name] = numericValue(v)
+		}
+		c.prevTime = time.Now()
+	}
+
+	if cfg.Offline {
+		fmt.Fprintln(w, " [DRY-RUN] Offline mode, no server configured")
+	}
+	for _, out := range outputNames(cfg) {
+		switch out {
+		case config.OutputOTLP:
+			fmt.Fprintf(w, " [DRY-RUN] Would export over OTLP to %s\n", otlp.MetricsURL(cfg.OTLP.Endpoint))
+		case config.OutputStatsD:
+			fmt.Fprintf(w, " [DRY-RUN] Would send to statsd at %s\n", cfg.StatsD.Address)
+		case config.OutputInfluxDB:
+			fmt.Fprintf(w, " [DRY-RUN] Would write to InfluxDB at %s\n", cfg.InfluxDB.URL)
+		case config.OutputKafka:
+			fmt.Fprintf(w, " [DRY-RUN] Would produce to Kafka topic %s\n", cfg.Kafka.Topic)
+		case config.OutputFile:
+			fmt.Fprintf(w, " [DRY-RUN] Would append to %s\n", cfg.File.Path)
+		default:
+			fmt.Fprintf(w, " [DRY-RUN] Would send to %s\n", cfg.ServerURL)
+		}
+	}
+	fmt.Fprintln(w, "───────────────────────────────────────────────────────────")
+}
+
+// printJSON writes a snapshot, or a dump of the current metrics, as a line
+// of JSON.
+func (c *consoleOutput) printJSON(metrics map[string]interface{}, dump bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cfg := c.agent.Config()
+	report := snapshotReport{
+		Time:           time.Now().UTC(),
+		ElapsedSeconds: time.Since(c.agent.StartTime()).Seconds(),
+		Dump:           dump,
+		Metrics:        metrics,
+		ShadowMetrics:  shadowNames(cfg),
+		Sources:        c.agent.Stats().Sources,
+	}
+	for _, out := range outputNames(cfg) {
+		switch out {
+		case config.OutputOTLP:
+			report.OTLPEndpoint = otlp.MetricsURL(cfg.OTLP.Endpoint)
+		case config.OutputStatsD:
+			report.StatsDAddress = cfg.StatsD.Address
+		case config.OutputInfluxDB:
+			report.InfluxDBURL = cfg.InfluxDB.URL
+		case config.OutputKafka:
+			report.KafkaTopic = cfg.Kafka.Topic
+		case config.OutputFile:
+			report.FilePath = cfg.File.Path
+		default:
+			report.ServerURL = cfg.ServerURL
+		}
+	}
+	return writeJSON(c.w, report)
+}
+
+// outputNames returns the outputs snapshots would be delivered to, all
+// but the SHM server when offline.
+func outputNames(cfg *config.Config) []string {
+	var names []string
+	for _, name := range cfg.OutputNames() {
+		if cfg.HasOutput(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// printDiffTable prints the metrics table with the change since the
+// previous snapshot and a per-second rate. Changed metrics are marked with *.
+//
+// Counters and sums are reset at every snapshot, so their rate is the
+// interval value over the elapsed time; gauges and sets use the change.
+// Must be called with c.mu held.
+func (c *consoleOutput) printDiffTable(metrics map[string]interface{}) {
+	w := c.w
+	cfg := c.agent.Config()
+
+	start := c.prevTime
+	if start.IsZero() {
+		start = c.agent.StartTime()
+	}
+	seconds := time.Since(start).Seconds()
+
+	fmt.Fprintln(w, " Aggregated Metrics:")
+	fmt.Fprintln(w, " ┌─────────────────────────────┬────────────┬────────────────┬────────────────┬────────────┐")
+	fmt.Fprintln(w, " │ Metric                      │ Type       │ Value          │ Change         │ Rate/s     │")
+	fmt.Fprintln(w, " ├─────────────────────────────┼────────────┼────────────────┼────────────────┼────────────┤")
+
+	for _, src := range cfg.Sources {
+		for _, m := range src.Metrics {
+			val := numericValue(metrics[m.Name])
+			prev, seen := c.prev[m.Name]
+
+			change := "-"
+			marker := " "
+			if seen {
+				delta := val - prev
+				change = formatDelta(delta)
+				if delta != 0 {
+					marker = "*"
+				}
+			}
+
+			rate := val
+			if m.Type == "gauge" || m.Type == "set" || m.Type == "derived" {
+				rate = val - prev
+			}
+			rateStr := "-"
+			if seconds > 0 && (seen || m.Type == "counter" || m.Type == "counter_by" || m.Type == "sum") {
+				rateStr = formatValue(rate / seconds)
+			}
+
+			fmt.Fprintf(w, " │%s%-27s │ %-10s │ %14s │ %14s │ %10s │\n",
+				marker, m.Name, m.Type, formatValue(metrics[m.Name]), change, rateStr)
+		}
+	}
+
+	fmt.Fprintln(w, " └─────────────────────────────┴────────────┴────────────────┴────────────────┴────────────┘")
+}
+
+// numericValue returns a metric value as a float, summing labeled series
+// and counter_by counts. Percentiles count their observations.
+func numericValue(v interface{}) float64 {
+	switch val := v.(type) {
+	case float64:
+		return val
+	case int:
+		return float64(val)
+	case int64:
+		return float64(val)
+	case aggregator.Distribution:
+		return val["count"]
+	case aggregator.Counts:
+		return val.Total()
+	case []aggregator.Series:
+		var total float64
+		for _, s := range val {
+			total += numericValue(s.Value)
+		}
+		return total
+	default:
+		return 0
+	}
+}
+
+// formatDelta formats a change with an explicit sign.
+func formatDelta(delta float64) string {
+	if delta > 0 {
+		return "+" + formatValue(delta)
+	}
+	return formatValue(delta)
+}
+
+// printMetrics prints test results in a formatted table.
+func printMetrics(w io.Writer, cfg *config.Config, metrics map[string]interface{}, top int) {
+	fmt.Fprintln(w, "───────────────────────────────────────────────────────────")
+	fmt.Fprintln(w, " TEST RESULTS")
+	fmt.Fprintln(w, "───────────────────────────────────────────────────────────")
+
+	for _, src := range cfg.Sources {
+		fmt.Fprintf(w, " Source config: %s\n", src.Location())
+		if src.Format != "" {
+			fmt.Fprintf(w, "   Format: %s\n", src.Format)
+		}
+		if src.Pattern != "" {
+			fmt.Fprintf(w, "   Pattern: %s\n", src.Pattern)
+		}
+		fmt.Fprintln(w)
+	}
+
+	printMetricsTable(w, cfg, metrics, top)
+	printShadowMetrics(w, cfg)
+	fmt.Fprintln(w, "───────────────────────────────────────────────────────────")
+}
+
+// printShadowMetrics lists the shadow metrics, which the tables show but
+// the agent does not send.
+func printShadowMetrics(w io.Writer, cfg *config.Config) {
+	names := shadowNames(cfg)
+	if len(names) == 0 {
+		return
+	}
+	fmt.Fprintf(w, " Shadow metrics, not sent: %s\n", strings.Join(names, ", "))
+}
+
+// printSourceStats prints the line counters of every source.
+func printSourceStats(w io.Writer, stats agent.Stats) {
+	for _, st := range stats.Sources {
+		fmt.Fprintf(w, " Source: %s\n", st.Path)
+		fmt.Fprintf(w, "   Lines parsed:   %d\n", st.LinesParsed)
+		fmt.Fprintf(w, "   Lines matched:  %d\n", st.LinesMatched)
+		if st.LinesFiltered > 0 {
+			fmt.Fprintf(w, "   Lines filtered: %d\n", st.LinesFiltered)
+		}
+		if st.LinesPrefiltered > 0 {
+			fmt.Fprintf(w, "   Lines skipped:  %d (prefilter)\n", st.LinesPrefiltered)
+		}
+		if st.LinesSkipped > 0 {
+			fmt.Fprintf(w, "   Lines skipped:  %d (sampled)\n", st.LinesSkipped)
+		}
+		if st.QueueFull > 0 || st.LinesDropped > 0 {
+			fmt.Fprintf(w, "   Queue:          %d waiting, %d waited for room, %d dropped\n", st.QueueLength, st.QueueFull, st.LinesDropped)
+		}
+		fmt.Fprintf(w, "   Parse errors:   %d\n", st.ParseErrors)
+		if st.LinesLate > 0 || st.TimestampErrors > 0 {
+			fmt.Fprintf(w, "   Event time:     %d late, %d invalid timestamps\n", st.LinesLate, st.TimestampErrors)
+		}
+		if st.Rotations > 0 || st.Truncations > 0 {
+			fmt.Fprintf(w, "   Reopened:       %d rotated, %d truncated\n", st.Rotations, st.Truncations)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// printErrorSamples prints the lines kept as samples of the lines that
+// failed to parse or matched no metric, with their line number.
+func printErrorSamples(w io.Writer, stats agent.Stats) {
+	for _, src := range stats.Sources {
+		printLineSamples(w, fmt.Sprintf("Lines of %s that failed to parse:", src.Path), src.ParseErrorSamples)
+		printLineSamples(w, fmt.Sprintf("Lines of %s that matched no metric:", src.Path), src.UnmatchedSamples)
+	}
+}
+
+// printLineSamples prints samples under a title, if any.
+func printLineSamples(w io.Writer, title string, samples []agent.LineSample) {
+	if len(samples) == 0 {
+		return
+	}
+	fmt.Fprintf(w, " %s\n", title)
+	for _, s := range samples {
+		if s.Line > 0 {
+			fmt.Fprintf(w, "   %6d: %s\n", s.Line, s.Text)
+		} else {
+			fmt.Fprintf(w, "   %s\n", s.Text)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// printExtractFailures lists metrics whose extract field was missing or not
+// convertible, which usually points at a misspelled field name.
+func printExtractFailures(w io.Writer, stats agent.Stats) {
+	printed := false
+	for _, src := range stats.Sources {
+		for _, m := range src.Metrics {
+			if m.ExtractFailures == 0 {
+				continue
+			}
+			if !printed {
+				fmt.Fprintln(w, " Extract failures:")
+				printed = true
+			}
+			fmt.Fprintf(w, "   %-27s missing=%d invalid=%d (of %d matches)\n",
+				m.Name, m.ExtractMissing, m.ExtractInvalid, m.Matched)
+		}
+	}
+	if printed {
+		fmt.Fprintln(w)
+	}
+}
+
+// printUnmatched lists the most frequent first tokens of the lines that
+// failed to parse or matched no metric, for sources capturing them.
+func printUnmatched(w io.Writer, stats agent.Stats) {
+	for _, src := range stats.Sources {
+		if len(src.Unmatched) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, " Unmatched lines of %s, by first token:\n", src.Path)
+		for _, tc := range src.Unmatched {
+			fmt.Fprintf(w, "   %-27s %d\n", tc.Token, tc.Count)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// printMetricsTable prints the aggregated metrics table. Labeled and
+// counter_by metrics are followed by a row per series or value, highest
+// value first, up to top series (all when top is 0); the metric column
+// widens to fit their labels.
+func printMetricsTable(w io.Writer, cfg *config.Config, metrics map[string]interface{}, top int) {
+	var rows [][3]string
+	for _, src := range cfg.Sources {
+		for _, m := range src.Metrics {
+			val := metrics[m.Name]
+			rows = append(rows, [3]string{m.Name, m.Type, formatValue(val)})
+
+			switch v := val.(type) {
+			case []aggregator.Series:
+				labels := m.Labels
+				if m.Type == "counter_by" {
+					labels = append(append([]string(nil), m.Labels...), m.Extract.Field)
+				}
+				rows = append(rows, seriesRows(labels, aggregator.Flatten(v), top)...)
+			case aggregator.Counts:
+				rows = append(rows, seriesRows([]string{v.Key}, v.Series(nil), top)...)
+			}
+		}
+	}
+
+	width := metricColumnWidth
+	for _, row := range rows {
+		width = max(width, utf8.RuneCountInString(row[0]))
+	}
+	width = min(width, maxMetricColumnWidth)
+	line := strings.Repeat("─", width+2)
+
+	fmt.Fprintln(w, " Aggregated Metrics:")
+	fmt.Fprintf(w, " ┌%s┬────────────┬────────────────┐\n", line)
+	fmt.Fprintf(w, " │ %-*s │ Type       │ Value          │\n", width, "Metric")
+	fmt.Fprintf(w, " ├%s┼────────────┼────────────────┤\n", line)
+	for _, row := range rows {
+		fmt.Fprintf(w, " │ %-*s │ %-10s │ %14s │\n", width, truncate(row[0], width), row[1], row[2])
+	}
+	fmt.Fprintf(w, " └%s┴────────────┴────────────────┘\n", line)
+}
+
+// Widths of the metric column of the metrics table.
+const (
+	metricColumnWidth    = 27
+	maxMetricColumnWidth = 60
+)
+
+// seriesRows returns a table row per series of a labeled metric, sorted by
+// value, highest first, then by labels, and a row counting those beyond top.
+func seriesRows(labelNames []string, series []aggregator.Series, top int) [][3]string {
+	sorted := append([]aggregator.Series(nil), series...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		vi, vj := numericValue(sorted[i].Value), numericValue(sorted[j].Value)
+		if vi != vj {
+			return vi > vj
+		}
+		return formatLabels(labelNames, sorted[i].Labels) < formatLabels(labelNames, sorted[j].Labels)
+	})
+
+	shown := sorted
+	if top > 0 && len(shown) > top {
+		shown = shown[:top]
+	}
+	rows := make([][3]string, 0, len(shown)+1)
+	for _, s := range shown {
+		rows = append(rows, [3]string{"  " + formatLabels(labelNames, s.Labels), "", formatValue(s.Value)})
+	}
+	if rest := len(sorted) - len(shown); rest > 0 {
+		rows = append(rows, [3]string{fmt.Sprintf("  ... %d more series", rest), "", ""})
+	}
+	return rows
+}
+
+// formatLabels formats the labels of a series in the order of the
+// metric's label names, e.g. "method=GET status=200".
+func formatLabels(names []string, labels map[string]string) string {
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+"="+labels[name])
+	}
+	return strings.Join(parts, " ")
+}
+
+// truncate shortens s to n runes, marking the cut with "…".
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// historyColumns is the number of snapshots printed by printHistory.
+const historyColumns = 8
+
+// printHistory prints the most recent snapshots with one row per metric and
+// one column per snapshot, oldest first. Labeled metrics show their total.
+func printHistory(w io.Writer, cfg *config.Config, entries []agent.HistoryEntry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	shown := entries
+	if len(shown) > historyColumns {
+		shown = shown[len(shown)-historyColumns:]
+	}
+
+	fmt.Fprintf(w, " Recent Snapshots (%d of %d kept):\n", len(shown), len(entries))
+	fmt.Fprintf(w, "   %-27s", "Metric")
+	for _, e := range shown {
+		fmt.Fprintf(w, " %9s", e.Time.Local().Format("15:04:05"))
+	}
+	fmt.Fprintln(w)
+
+	for _, src := range cfg.Sources {
+		for _, m := range src.Metrics {
+			fmt.Fprintf(w, "   %-27s", m.Name)
+			for _, e := range shown {
+				fmt.Fprintf(w, " %9s", formatValue(numericValue(e.Metrics[m.Name])))
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	fmt.Fprintln(w, "───────────────────────────────────────────────────────────")
+}
+
+// formatDistribution shows the highest quantile of a percentile metric,
+// which fits in a table cell.
+func formatDistribution(d aggregator.Distribution) string {
+	name, value, top := "", 0.0, -1.0
+	for key, v := range d {
+		q, err := strconv.ParseFloat(strings.TrimPrefix(key, "p"), 64)
+		if !strings.HasPrefix(key, "p") || err != nil || q <= top {
+			continue
+		}
+		name, value, top = key, v, q
+	}
+	if name == "" {
+		return "-"
+	}
+	return name + "=" + formatValue(value)
+}
+
+// formatValue formats a metric value for display.
+func formatValue(v interface{}) string {
+	if v == nil {
+		return "0"
+	}
+	switch val := v.(type) {
+	case float64:
+		if val == float64(int64(val)) {
+			return fmt.Sprintf("%d", int64(val))
+		}
+		return fmt.Sprintf("%.2f", val)
+	case int:
+		return fmt.Sprintf("%d", val)
+	case int64:
+		return fmt.Sprintf("%d", val)
+	case aggregator.Distribution:
+		return formatDistribution(val)
+	case aggregator.Counts:
+		return fmt.Sprintf("%d values", len(val.Values))
+	case []aggregator.Series:
+		return fmt.Sprintf("%d series", len(val))
+	default:
+		return fmt.Sprintf("%v", val)
+	}
+}
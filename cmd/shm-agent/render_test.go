@@ -0,0 +1,147 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/kolapsis/shm-agent/agent/aggregator"
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+func TestSeriesRows(t *testing.T) {
+	series := []aggregator.Series{
+		{Labels: map[string]string{"method": "POST", "status": "200"}, Value: 2.0},
+		{Labels: map[string]string{"method": "GET", "status": "500"}, Value: 1.0},
+		{Labels: map[string]string{"method": "GET", "status": "200"}, Value: 5.0},
+		{Labels: map[string]string{"method": "DELETE", "status": "200"}, Value: 2.0},
+	}
+	names := []string{"method", "status"}
+
+	tests := []struct {
+		name string
+		top  int
+		want [][3]string
+	}{
+		{"all", 0, [][3]string{
+			{"  method=GET status=200", "", "5"},
+			{"  method=DELETE status=200", "", "2"}, // ties in label order
+			{"  method=POST status=200", "", "2"},
+			{"  method=GET status=500", "", "1"},
+		}},
+		{"top", 2, [][3]string{
+			{"  method=GET status=200", "", "5"},
+			{"  method=DELETE status=200", "", "2"},
+			{"  ... 2 more series", "", ""},
+		}},
+		{"top above the series", 10, [][3]string{
+			{"  method=GET status=200", "", "5"},
+			{"  method=DELETE status=200", "", "2"},
+			{"  method=POST status=200", "", "2"},
+			{"  method=GET status=500", "", "1"},
+		}},
+	}
+	for _, tt := range tests {
+		if got := seriesRows(names, series, tt.top); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: seriesRows() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// The series of the snapshot are left in place
+	if series[0].Value != 2.0 || series[2].Value != 5.0 {
+		t.Error("seriesRows() reordered its argument")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"requests", 10, "requests"},
+		{"requests", 8, "requests"},
+		{"requests", 5, "requ…"},
+		{"durée_moyenne", 13, "durée_moyenne"},
+		{"durée_moyenne", 5, "duré…"},
+		{"日本語のメトリック", 4, "日本語…"},
+	}
+	for _, tt := range tests {
+		got := truncate(tt.s, tt.n)
+		if got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) = %q is not valid UTF-8", tt.s, tt.n, got)
+		}
+	}
+}
+
+func TestPrintMetricsTable(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+app_name: test-app
+app_version: "1.0.0"
+offline: true
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+        labels: [method]
+      - name: by_status
+        type: counter_by
+        extract: {field: status}
+      - name: durée_de_traitement_des_requêtes_entrantes_par_le_serveur_applicatif_principal
+        type: counter
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	long := cfg.Sources[0].Metrics[2].Name
+
+	metrics := map[string]interface{}{
+		"requests": []aggregator.Series{
+			{Labels: map[string]string{"method": "GET"}, Value: 3.0},
+			{Labels: map[string]string{"method": "POST"}, Value: 1.0},
+			{Labels: map[string]string{"method": "PUT"}, Value: 2.0},
+		},
+		"by_status": aggregator.Counts{Key: "status", Values: map[string]float64{"200": 4, "404": 1}},
+		long:        1.5,
+	}
+
+	var buf bytes.Buffer
+	printMetricsTable(&buf, cfg, metrics, 2)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+
+	var rows []string
+	for _, line := range lines[4 : len(lines)-1] {
+		cells := strings.Split(line, "│")
+		rows = append(rows, strings.TrimSpace(cells[1])+"|"+strings.TrimSpace(cells[2])+"|"+strings.TrimSpace(cells[3]))
+	}
+	want := []string{
+		"requests|counter|3 series",
+		"method=GET||3",
+		"method=PUT||2",
+		"... 1 more series||",
+		"by_status|counter_by|2 values",
+		"status=200||4",
+		"status=404||1",
+		truncate(long, maxMetricColumnWidth) + "|counter|1.50",
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows =\n%s\nwant\n%s", strings.Join(rows, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Multi-byte names do not shift the columns
+	width := utf8.RuneCountInString(lines[1])
+	for i, line := range lines[1:] {
+		if n := utf8.RuneCountInString(line); n != width {
+			t.Errorf("line %d is %d runes wide, want %d: %q", i+1, n, width, line)
+		}
+	}
+}
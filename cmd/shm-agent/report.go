@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent"
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+// Output formats of the test command and dry-run snapshots.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// testReport is the result of the test command with --output json.
+type testReport struct {
+	Config         string                 `json:"config"`
+	File           string                 `json:"file"`
+	LinesProcessed int                    `json:"lines_processed"`
+	Warnings       []string               `json:"warnings,omitempty"`
+	Metrics        map[string]interface{} `json:"metrics"`
+	ShadowMetrics  []string               `json:"shadow_metrics,omitempty"`
+	Sources        []agent.SourceStats    `json:"sources"`
+}
+
+// snapshotReport is a dry-run snapshot with --output json.
+type snapshotReport struct {
+	Time           time.Time              `json:"time"`
+	ElapsedSeconds float64                `json:"elapsed_seconds"`
+	Dump           bool                   `json:"dump,omitempty"` // printed on SIGUSR1, not a snapshot
+	Metrics        map[string]interface{} `json:"metrics"`
+	ShadowMetrics  []string               `json:"shadow_metrics,omitempty"`
+	Sources        []agent.SourceStats    `json:"sources"`
+
+	// ServerURL is where the snapshot would be sent; empty when offline
+	// or not sending to the server. The other fields are set for the
+	// other outputs snapshots would be delivered to.
+	ServerURL     string `json:"server_url,omitempty"`
+	OTLPEndpoint  string `json:"otlp_endpoint,omitempty"`
+	StatsDAddress string `json:"statsd_address,omitempty"`
+	InfluxDBURL   string `json:"influxdb_url,omitempty"`
+	KafkaTopic    string `json:"kafka_topic,omitempty"`
+	FilePath      string `json:"file_path,omitempty"`
+}
+
+// intervalReport is an interval of a dry-run backfill with --output json.
+type intervalReport struct {
+	Start   time.Time              `json:"start"`
+	End     time.Time              `json:"end"`
+	Metrics map[string]interface{} `json:"metrics"`
+}
+
+// writeJSON writes v to w as a single line of JSON.
+func writeJSON(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding JSON output: %w", err)
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// shadowNames returns the shadow metrics of cfg, sorted.
+func shadowNames(cfg *config.Config) []string {
+	var names []string
+	for name := range cfg.ShadowMetrics() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,169 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent"
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+// newReportAgent creates a dry-run agent from yaml and feeds lines to its
+// first source.
+func newReportAgent(t *testing.T, yaml string, lines ...string) (*config.Config, *agent.Agent) {
+	t.Helper()
+	cfg, err := config.Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	ag, err := agent.New(agent.Options{Config: cfg, DryRun: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	for _, line := range lines {
+		ag.ProcessLine(0, line)
+	}
+	return cfg, ag
+}
+
+const reportConfig = `
+app_name: test-app
+app_version: "1.0.0"
+offline: true
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+        labels: [method]
+      - name: by_status
+        type: counter_by
+        extract: {field: status}
+      - name: draft
+        type: counter
+        shadow: true
+`
+
+// decodeLine decodes the single line of JSON written to buf.
+func decodeLine(t *testing.T, buf *bytes.Buffer) map[string]interface{} {
+	t.Helper()
+	out := buf.String()
+	if strings.Count(out, "\n") != 1 || !strings.HasSuffix(out, "\n") {
+		t.Fatalf("output is not a single line: %q", out)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(out), &got); err != nil {
+		t.Fatalf("output is not JSON: %v", err)
+	}
+	return got
+}
+
+func TestWriteJSON_TestReport(t *testing.T) {
+	cfg, ag := newReportAgent(t, reportConfig,
+		`{"method":"GET","status":200}`,
+		`{"method":"GET","status":500}`,
+		`{"method":"POST","status":200}`,
+	)
+
+	var buf bytes.Buffer
+	err := writeJSON(&buf, testReport{
+		Config:         "config.yaml",
+		File:           "app.log",
+		LinesProcessed: 3,
+		Metrics:        ag.Metrics(),
+		ShadowMetrics:  shadowNames(cfg),
+		Sources:        ag.Stats().Sources,
+	})
+	if err != nil {
+		t.Fatalf("writeJSON() error = %v", err)
+	}
+	got := decodeLine(t, &buf)
+
+	if got["config"] != "config.yaml" || got["file"] != "app.log" || got["lines_processed"] != 3.0 {
+		t.Errorf("header = %v, %v, %v", got["config"], got["file"], got["lines_processed"])
+	}
+	if _, ok := got["warnings"]; ok {
+		t.Error("empty warnings are not omitted")
+	}
+	if !reflect.DeepEqual(got["shadow_metrics"], []interface{}{"draft"}) {
+		t.Errorf("shadow_metrics = %v, want [draft]", got["shadow_metrics"])
+	}
+
+	metrics := got["metrics"].(map[string]interface{})
+	wantRequests := []interface{}{
+		map[string]interface{}{"labels": map[string]interface{}{"method": "GET"}, "value": 2.0},
+		map[string]interface{}{"labels": map[string]interface{}{"method": "POST"}, "value": 1.0},
+	}
+	if !reflect.DeepEqual(metrics["requests"], wantRequests) {
+		t.Errorf("requests = %v, want %v", metrics["requests"], wantRequests)
+	}
+	if !reflect.DeepEqual(metrics["by_status"], map[string]interface{}{"200": 2.0, "500": 1.0}) {
+		t.Errorf("by_status = %v", metrics["by_status"])
+	}
+
+	sources := got["sources"].([]interface{})
+	if len(sources) != 1 {
+		t.Fatalf("got %d sources, want 1", len(sources))
+	}
+	if src := sources[0].(map[string]interface{}); src["path"] != "/var/log/app.log" || src["lines_parsed"] != 3.0 {
+		t.Errorf("source = %v", src)
+	}
+}
+
+func TestConsoleOutput_PrintJSON(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		outputs string
+		want    map[string]interface{}
+	}{
+		{"offline", "offline: true\n", map[string]interface{}{}},
+		{"server", "server_url: https://shm.example.com\n", map[string]interface{}{
+			"server_url": "https://shm.example.com",
+		}},
+		{"outputs", "server_url: https://shm.example.com\noutputs: [statsd, file]\nfile:\n  path: /tmp/snapshots.jsonl\n", map[string]interface{}{
+			"statsd_address": "127.0.0.1:8125",
+			"file_path":      "/tmp/snapshots.jsonl",
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			yaml := strings.Replace(reportConfig, "offline: true\n", tt.outputs, 1)
+			_, ag := newReportAgent(t, yaml, `{"method":"GET","status":200}`)
+
+			var buf bytes.Buffer
+			out := newConsoleOutput(&buf, outputJSON, false, 0)
+			out.attach(ag)
+			if err := out.Send(context.Background(), ag.Metrics()); err != nil {
+				t.Fatalf("Send() error = %v", err)
+			}
+			got := decodeLine(t, &buf)
+
+			for _, key := range []string{"time", "elapsed_seconds", "metrics", "sources"} {
+				if _, ok := got[key]; !ok {
+					t.Errorf("%s is missing", key)
+				}
+			}
+			if _, ok := got["dump"]; ok {
+				t.Error("dump is set on a snapshot")
+			}
+			for _, key := range []string{"server_url", "otlp_endpoint", "statsd_address", "influxdb_url", "kafka_topic", "file_path"} {
+				if got[key] != tt.want[key] {
+					t.Errorf("%s = %v, want %v", key, got[key], tt.want[key])
+				}
+			}
+
+			// A dump of the current metrics is flagged as such
+			buf.Reset()
+			out.dump()
+			if got := decodeLine(t, &buf); got["dump"] != true {
+				t.Errorf("dump = %v, want true", got["dump"])
+			}
+		})
+	}
+}
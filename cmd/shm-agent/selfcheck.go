@@ -0,0 +1,44 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/kolapsis/shm-agent/agent"
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+// runSelfCheck runs every metric against a generated line and prints the
+// outcome, failing if any metric could not record its line.
+func runSelfCheck(w io.Writer, cfg *config.Config) error {
+	results, err := agent.SelfCheck(cfg)
+	if err != nil {
+		return fmt.Errorf("self-check: %w", err)
+	}
+
+	failed := 0
+	source := -1
+	for _, r := range results {
+		if r.Source != source {
+			source = r.Source
+			src := &cfg.Sources[source]
+			fmt.Fprintf(w, " source[%d] %s\n", source, src.Location())
+		}
+		if r.OK() {
+			fmt.Fprintf(w, "   ok    %-27s %s\n", r.Metric, r.Line)
+			continue
+		}
+		failed++
+		fmt.Fprintf(w, "   FAIL  %-27s %s\n", r.Metric, r.Problem)
+		fmt.Fprintf(w, "         %-27s %s\n", "", r.Line)
+	}
+	fmt.Fprintln(w)
+
+	if failed > 0 {
+		return fmt.Errorf("self-check failed: %d of %d metrics cannot record a line", failed, len(results))
+	}
+	fmt.Fprintf(w, " All %d metrics recorded their line\n", len(results))
+	return nil
+}
@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent"
+	"github.com/kolapsis/shm-agent/agent/sender/shmtest"
+)
+
+// selftestTimeout bounds the whole self-test.
+const selftestTimeout = time.Minute
+
+// mockServer is the --server value selecting the built-in mock server.
+const mockServer = "mock"
+
+// SelftestCmd checks that the agent can talk to the SHM server.
+type SelftestCmd struct {
+	Server string `name:"server" help:"Server URL to test instead of server_url, or \"mock\" for the built-in mock server"`
+}
+
+// Run registers a throwaway instance with the server and sends it a
+// snapshot, with the connection settings of the configuration.
+func (s *SelftestCmd) Run(cli *CLI) error {
+	cfg, err := cli.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	serverURL := s.Server
+	if serverURL == "" {
+		serverURL = cfg.ServerURL
+	}
+	if serverURL == "" {
+		return fmt.Errorf("no server_url configured, set one with --server")
+	}
+
+	var mock *shmtest.Server
+	if serverURL == mockServer {
+		mock = shmtest.NewServer()
+		defer mock.Close()
+		serverURL = mock.URL
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+	defer cancel()
+
+	results, err := agent.CheckServer(ctx, cfg, serverURL, createLogger(cli.verbosity(cfg)))
+	if err != nil {
+		return fmt.Errorf("selftest: %w", err)
+	}
+	var violations []string
+	if mock != nil {
+		violations = mock.Violations()
+	}
+	return printServerChecks(os.Stdout, serverURL, results, violations)
+}
+
+// printServerChecks prints the outcome of every step, and the protocol
+// violations found by the mock server, failing if any step failed.
+func printServerChecks(w io.Writer, serverURL string, results []agent.ServerCheck, violations []string) error {
+	fmt.Fprintf(w, " server %s\n", serverURL)
+	failed := false
+	for _, r := range results {
+		if r.Err != nil {
+			failed = true
+			fmt.Fprintf(w, "   FAIL  %-10s %s\n", r.Step, r.Err)
+			continue
+		}
+		fmt.Fprintf(w, "   ok    %-10s %s\n", r.Step, r.Latency.Round(time.Millisecond))
+	}
+	for _, v := range violations {
+		failed = true
+		fmt.Fprintf(w, "   FAIL  %-10s %s\n", "protocol", v)
+	}
+	fmt.Fprintln(w)
+
+	if failed {
+		return fmt.Errorf("selftest failed")
+	}
+	fmt.Fprintln(w, " Registration and snapshot delivery work")
+	return nil
+}
@@ -0,0 +1,160 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+// serviceDisplayName is the name of the Windows service shown in the
+// service manager.
+const serviceDisplayName = "SHM Agent"
+
+// serviceControlTimeout bounds how long start and stop wait for the
+// service to change state.
+const serviceControlTimeout = 30 * time.Second
+
+// ServiceCmd installs and controls the agent as a Windows service.
+type ServiceCmd struct {
+	Install   ServiceInstallCmd   `cmd:"" help:"Install the Windows service, started at boot"`
+	Uninstall ServiceUninstallCmd `cmd:"" help:"Stop and remove the Windows service"`
+	Start     ServiceStartCmd     `cmd:"" help:"Start the Windows service"`
+	Stop      ServiceStopCmd      `cmd:"" help:"Stop the Windows service"`
+}
+
+// ServiceInstallCmd installs the Windows service.
+type ServiceInstallCmd struct {
+	StateDir string `name:"state-dir" help:"Working directory holding the identity, positions and spool files (default: %ProgramData%\\shm-agent)"`
+	Binary   string `name:"binary" help:"Agent binary run by the service (default: this executable)"`
+	NoStart  bool   `name:"no-start" help:"Install the service without starting it"`
+
+	WatchConfig bool `name:"watch-config" help:"Reload the configuration when the file changes"`
+}
+
+// ServiceUninstallCmd removes the Windows service.
+type ServiceUninstallCmd struct{}
+
+// ServiceStartCmd starts the Windows service.
+type ServiceStartCmd struct{}
+
+// ServiceStopCmd stops the Windows service.
+type ServiceStopCmd struct{}
+
+// serviceParams holds what the service is installed with.
+type serviceParams struct {
+	Binary    string
+	Args      []string // of the run command
+	StateDirs []string // the state directory first
+}
+
+// Run executes the service install command.
+func (c *ServiceInstallCmd) Run(cli *CLI) error {
+	cfg, err := config.LoadWithOptions(cli.Config, cli.loadOptions())
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+
+	params, err := c.params(cli, cfg)
+	if err != nil {
+		return err
+	}
+	for _, dir := range params.StateDirs {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return fmt.Errorf("creating %s: %w", dir, err)
+		}
+		fmt.Printf("State directory: %s\n", dir)
+	}
+
+	if err := installService(params); err != nil {
+		return err
+	}
+	fmt.Printf("Service %s installed\n", serviceName)
+
+	if c.NoStart {
+		fmt.Printf("Start the service with: shm-agent service start\n")
+		return nil
+	}
+	if err := startService(); err != nil {
+		return err
+	}
+	fmt.Printf("Service %s started\n", serviceName)
+	return nil
+}
+
+// params resolves the binary and the arguments the service runs with. The
+// service runs in the state directory, where relative state files resolve.
+func (c *ServiceInstallCmd) params(cli *CLI, cfg *config.Config) (serviceParams, error) {
+	binary, err := binaryPath(c.Binary)
+	if err != nil {
+		return serviceParams{}, err
+	}
+
+	configPath, err := filepath.Abs(cli.Config)
+	if err != nil {
+		return serviceParams{}, fmt.Errorf("resolving config path: %w", err)
+	}
+
+	dir := c.StateDir
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("ProgramData"), serviceName)
+	}
+	stateDir, err := filepath.Abs(dir)
+	if err != nil {
+		return serviceParams{}, fmt.Errorf("resolving state directory: %w", err)
+	}
+
+	args := []string{"run", "--config", configPath, "--working-dir", stateDir}
+	if cli.ConfigDir != "" {
+		dir, err := filepath.Abs(cli.ConfigDir)
+		if err != nil {
+			return serviceParams{}, fmt.Errorf("resolving config directory: %w", err)
+		}
+		args = append(args, "--config-dir", dir)
+	}
+	if cfg.Profile != "" {
+		args = append(args, "--profile", cfg.Profile)
+	}
+	if c.WatchConfig {
+		args = append(args, "--watch-config")
+	}
+
+	dirs := []string{stateDir}
+	for _, dir := range stateDirs(stateDir, cfg) {
+		if dir != stateDir {
+			dirs = append(dirs, dir)
+		}
+	}
+	return serviceParams{Binary: binary, Args: args, StateDirs: dirs}, nil
+}
+
+// Run executes the service uninstall command.
+func (c *ServiceUninstallCmd) Run() error {
+	if err := uninstallService(); err != nil {
+		return err
+	}
+	fmt.Printf("Service %s removed\n", serviceName)
+	return nil
+}
+
+// Run executes the service start command.
+func (c *ServiceStartCmd) Run() error {
+	if err := startService(); err != nil {
+		return err
+	}
+	fmt.Printf("Service %s started\n", serviceName)
+	return nil
+}
+
+// Run executes the service stop command.
+func (c *ServiceStopCmd) Run() error {
+	if err := stopService(); err != nil {
+		return err
+	}
+	fmt.Printf("Service %s stopped\n", serviceName)
+	return nil
+}
@@ -0,0 +1,44 @@
+// SPDX-License-Identifier: MIT
+
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// errNoServiceManager is returned by the service commands outside Windows.
+var errNoServiceManager = errors.New("service requires the Windows service manager and is only supported on Windows, use install for systemd")
+
+// isService reports whether the agent was started by the Windows service
+// manager, never the case outside Windows.
+func isService() bool {
+	return false
+}
+
+// runService runs the agent as a Windows service.
+func runService(run func(ctx context.Context) error) error {
+	return errNoServiceManager
+}
+
+// installService installs the Windows service.
+func installService(serviceParams) error {
+	return errNoServiceManager
+}
+
+// uninstallService removes the Windows service.
+func uninstallService() error {
+	return errNoServiceManager
+}
+
+// startService starts the Windows service.
+func startService() error {
+	return errNoServiceManager
+}
+
+// stopService stops the Windows service.
+func stopService() error {
+	return errNoServiceManager
+}
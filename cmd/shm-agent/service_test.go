@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kolapsis/shm-agent/agent/config"
+)
+
+// parseInstallConfig parses a configuration sending to a server with
+// extra settings.
+func parseInstallConfig(t *testing.T, extra string) *config.Config {
+	t.Helper()
+	cfg, err := config.Parse([]byte(`
+server_url: https://shm.example.com
+app_name: test-app
+app_version: "1.0.0"
+sources:
+  - path: /var/log/app.log
+    format: json
+    metrics:
+      - name: requests
+        type: counter
+` + extra))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	return cfg
+}
+
+func TestServiceInstallCmd_Params(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "bin", "shm-agent.exe")
+	configPath := filepath.Join(dir, "config.yaml")
+	stateDir := filepath.Join(dir, "state")
+
+	tests := []struct {
+		name     string
+		cmd      ServiceInstallCmd
+		cli      CLI
+		extra    string
+		profile  string
+		wantArgs []string
+		wantDirs []string
+	}{
+		{
+			name:     "defaults",
+			cmd:      ServiceInstallCmd{Binary: binary, StateDir: stateDir},
+			cli:      CLI{Config: configPath},
+			wantArgs: []string{"run", "--config", configPath, "--working-dir", stateDir},
+			wantDirs: []string{stateDir},
+		},
+		{
+			name:    "every option",
+			cmd:     ServiceInstallCmd{Binary: binary, StateDir: stateDir, WatchConfig: true},
+			cli:     CLI{Config: configPath, ConfigDir: filepath.Join(dir, "conf.d")},
+			profile: "prod",
+			wantArgs: []string{"run", "--config", configPath, "--working-dir", stateDir,
+				"--config-dir", filepath.Join(dir, "conf.d"), "--profile", "prod", "--watch-config"},
+			wantDirs: []string{stateDir},
+		},
+		{
+			name:     "state files outside the state directory",
+			cmd:      ServiceInstallCmd{Binary: binary, StateDir: stateDir},
+			cli:      CLI{Config: configPath},
+			extra:    "spool:\n  dir: spool\npositions_file: " + filepath.Join(dir, "positions", "positions.json") + "\n",
+			wantArgs: []string{"run", "--config", configPath, "--working-dir", stateDir},
+			wantDirs: []string{stateDir, filepath.Join(dir, "positions"), filepath.Join(stateDir, "spool")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseInstallConfig(t, tt.extra)
+			cfg.Profile = tt.profile
+			got, err := tt.cmd.params(&tt.cli, cfg)
+			if err != nil {
+				t.Fatalf("params() error = %v", err)
+			}
+			if got.Binary != binary {
+				t.Errorf("Binary = %q, want %q", got.Binary, binary)
+			}
+			if !reflect.DeepEqual(got.Args, tt.wantArgs) {
+				t.Errorf("Args = %q, want %q", got.Args, tt.wantArgs)
+			}
+			if !reflect.DeepEqual(got.StateDirs, tt.wantDirs) {
+				t.Errorf("StateDirs = %q, want %q", got.StateDirs, tt.wantDirs)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+// SPDX-License-Identifier: MIT
+
+//go:build windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// isService reports whether the agent was started by the Windows service
+// manager.
+func isService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// runService runs the agent as a Windows service until the service
+// manager stops it, logging to the event log.
+func runService(run func(ctx context.Context) error) error {
+	if elog, err := eventlog.Open(serviceName); err == nil {
+		defer elog.Close()
+		logOutput = eventLogWriter{elog}
+	}
+
+	h := &serviceHandler{run: run}
+	if err := svc.Run(serviceName, h); err != nil {
+		return fmt.Errorf("running service: %w", err)
+	}
+	return h.err
+}
+
+// serviceHandler runs the agent for the service manager.
+type serviceHandler struct {
+	run func(ctx context.Context) error
+	err error // why the agent stopped
+}
+
+// Execute runs the agent, cancelling it on a stop or shutdown request. An
+// agent stopping on an error exits with a service specific code, so that
+// the service manager restarts it.
+func (h *serviceHandler) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- h.run(ctx)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-done:
+			h.err = err
+			if err != nil {
+				return true, 1
+			}
+			return false, 0
+
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+			}
+		}
+	}
+}
+
+// eventLogWriter writes every log line as an event, of the level of the
+// line.
+type eventLogWriter struct {
+	log *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := string(bytes.TrimSpace(p))
+	var err error
+	switch {
+	case bytes.Contains(p, []byte("level=ERROR")):
+		err = w.log.Error(1, msg)
+	case bytes.Contains(p, []byte("level=WARN")):
+		err = w.log.Warning(1, msg)
+	default:
+		err = w.log.Info(1, msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// installService creates the service, started at boot and restarted when
+// it fails, or updates it when it exists. It registers the event log
+// source the service logs to.
+func installService(params serviceParams) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	cfg := mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: "SHM Agent - Log Metrics Collector",
+		StartType:   mgr.StartAutomatic,
+	}
+
+	s, err := m.OpenService(serviceName)
+	if err == nil {
+		cfg.BinaryPathName = commandLine(params.Binary, params.Args)
+		err = s.UpdateConfig(cfg)
+	} else {
+		s, err = m.CreateService(serviceName, params.Binary, cfg, params.Args...)
+	}
+	if err != nil {
+		return fmt.Errorf("installing service: %w", err)
+	}
+	defer s.Close()
+
+	restart := []mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 5 * time.Second}}
+	if err := s.SetRecoveryActions(restart, uint32((24 * time.Hour).Seconds())); err != nil {
+		return fmt.Errorf("setting recovery actions: %w", err)
+	}
+	if err := s.SetRecoveryActionsOnNonCrashFailures(true); err != nil {
+		return fmt.Errorf("setting recovery actions: %w", err)
+	}
+
+	// Registered again, as it fails when the source exists
+	eventlog.Remove(serviceName)
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		return fmt.Errorf("registering event log source: %w", err)
+	}
+	return nil
+}
+
+// uninstallService stops the service if running, then removes it and its
+// event log source.
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("opening service %s: %w", serviceName, err)
+	}
+	defer s.Close()
+
+	if err := stop(s); err != nil {
+		return err
+	}
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("removing service: %w", err)
+	}
+	eventlog.Remove(serviceName)
+	return nil
+}
+
+// startService starts the service and waits until it runs.
+func startService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("opening service %s: %w", serviceName, err)
+	}
+	defer s.Close()
+
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("starting service: %w", err)
+	}
+	return waitState(s, svc.Running)
+}
+
+// stopService stops the service and waits until it stopped.
+func stopService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("opening service %s: %w", serviceName, err)
+	}
+	defer s.Close()
+
+	return stop(s)
+}
+
+// stop stops s, unless not running, and waits until it stopped.
+func stop(s *mgr.Service) error {
+	if _, err := s.Control(svc.Stop); err != nil {
+		if errors.Is(err, windows.ERROR_SERVICE_NOT_ACTIVE) {
+			return nil
+		}
+		return fmt.Errorf("stopping service: %w", err)
+	}
+	return waitState(s, svc.Stopped)
+}
+
+// waitState waits for s to reach state, for at most serviceControlTimeout.
+func waitState(s *mgr.Service, state svc.State) error {
+	deadline := time.Now().Add(serviceControlTimeout)
+	for {
+		st, err := s.Query()
+		if err != nil {
+			return fmt.Errorf("querying service: %w", err)
+		}
+		if st.State == state {
+			return nil
+		}
+		if state == svc.Running && st.State == svc.Stopped {
+			return fmt.Errorf("service stopped while starting, see the event log")
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service did not change state within %s", serviceControlTimeout)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
+
+// commandLine quotes a binary and its arguments as a service command line.
+func commandLine(binary string, args []string) string {
+	line := syscall.EscapeArg(binary)
+	for _, arg := range args {
+		line += " " + syscall.EscapeArg(arg)
+	}
+	return line
+}
@@ -0,0 +1,24 @@
+// SPDX-License-Identifier: MIT
+
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// shutdownSignals are the signals that trigger a graceful shutdown.
+var shutdownSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+
+// notifyDump registers ch to receive the metric dump signal (SIGUSR1).
+func notifyDump(ch chan<- os.Signal) {
+	signal.Notify(ch, syscall.SIGUSR1)
+}
+
+// notifyReload registers ch to receive the configuration reload signal (SIGHUP).
+func notifyReload(ch chan<- os.Signal) {
+	signal.Notify(ch, syscall.SIGHUP)
+}
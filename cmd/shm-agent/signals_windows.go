@@ -0,0 +1,19 @@
+// SPDX-License-Identifier: MIT
+
+//go:build windows
+
+package main
+
+import (
+	"os"
+)
+
+// shutdownSignals are the signals that trigger a graceful shutdown.
+var shutdownSignals = []os.Signal{os.Interrupt}
+
+// notifyDump is a no-op on Windows, which has no SIGUSR1.
+func notifyDump(ch chan<- os.Signal) {}
+
+// notifyReload is a no-op on Windows, which has no SIGHUP.
+// Use --watch-config instead.
+func notifyReload(ch chan<- os.Signal) {}
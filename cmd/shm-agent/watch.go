@@ -0,0 +1,101 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// configWatchInterval is how often --watch-config checks the config files.
+const configWatchInterval = 2 * time.Second
+
+// fileSet is the list of watched paths, replaced when a reload changes the
+// included files.
+type fileSet struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (f *fileSet) set(paths []string) {
+	f.mu.Lock()
+	f.paths = paths
+	f.mu.Unlock()
+}
+
+func (f *fileSet) get() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.paths
+}
+
+// watchFiles polls the paths of files and sends on the returned channel
+// whenever the modification time or size of one of them changes. A
+// directory changes when files are added to or removed from it. Polling is
+// used instead of inotify so that editors replacing the file and
+// bind-mounted ConfigMaps both work.
+func watchFiles(ctx context.Context, files *fileSet, interval time.Duration, logger *slog.Logger) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+
+	// fingerprint reports false while a file cannot be read, e.g. when an
+	// editor is replacing it, so that no reload is attempted meanwhile. A
+	// file still missing at the next poll was deleted, which is a change,
+	// so that the reload drops it.
+	missing := make(map[string]bool) // paths missing at the last poll
+	fingerprint := func() (string, bool) {
+		var b strings.Builder
+		ok := true
+		gone := make(map[string]bool)
+		for _, path := range files.get() {
+			info, err := os.Stat(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				gone[path] = true
+				if missing[path] {
+					fmt.Fprintf(&b, "%s:missing\n", path)
+					continue
+				}
+			}
+			if err != nil {
+				logger.Warn("cannot stat config file", "path", path, "error", err)
+				ok = false
+				continue
+			}
+			fmt.Fprintf(&b, "%s:%d:%d\n", path, info.ModTime().UnixNano(), info.Size())
+		}
+		missing = gone
+		return b.String(), ok
+	}
+
+	last, _ := fingerprint()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				current, ok := fingerprint()
+				if !ok || current == last {
+					continue
+				}
+				last = current
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return changed
+}
@@ -0,0 +1,56 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchFiles_Deleted(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "config.yaml")
+	included := filepath.Join(dir, "included.yaml")
+	for _, path := range []string{main, included} {
+		if err := os.WriteFile(path, []byte("sources: []\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	files := &fileSet{paths: []string{main, included}}
+	changed := watchFiles(ctx, files, 10*time.Millisecond, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// A deleted file is a change once it stays missing
+	if err := os.Remove(included); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no change reported for a deleted file")
+	}
+
+	// and only once, even if the reload kept watching it
+	select {
+	case <-changed:
+		t.Error("change reported again for a file still missing")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Its return is a change too
+	if err := os.WriteFile(included, []byte("sources: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no change reported for a restored file")
+	}
+}
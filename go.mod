@@ -1,15 +1,17 @@
 module github.com/kolapsis/shm-agent
 
-go 1.22
+go 1.25.0
 
 require (
 	github.com/alecthomas/kong v1.6.0
+	github.com/klauspost/compress v1.18.0
 	github.com/nxadm/tail v1.4.11
+	golang.org/x/crypto v0.54.0
+	golang.org/x/sys v0.47.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/fsnotify/fsnotify v1.8.0 // indirect
-	golang.org/x/sys v0.28.0 // indirect
 	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
 )